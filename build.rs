@@ -0,0 +1,10 @@
+// Generate the protobuf messages and gRPC services of `proto/` with a
+// vendored protoc, so building doesn't need one installed
+fn main() -> Result<(), Box<dyn std::error::Error>> {
+    std::env::set_var("PROTOC", protoc_bin_vendored::protoc_bin_path()?);
+    tonic_build::configure()
+        // Map entries in key order, so equal certificates encode identically
+        .btree_map(["."])
+        .compile_protos(&["proto/ccok.proto", "proto/node.proto"], &["proto"])?;
+    Ok(())
+}
@@ -0,0 +1,396 @@
+//! Aggregate proofs, a second hash-based compression layer over certificates.
+//! The reveals of a certificate are committed in a reveal tree, and a second
+//! round of Fiat-Shamir coins drawn over its root picks the certificate coins
+//! whose reveals are opened. Each `Params::compression_level` halves those
+//! coins, so a proof at level `l` carries the reveals and paths of
+//! `ceil(coins / 2^l)` coins and proves what that many coins prove; the reveal
+//! root binds it to the one certificate it was cut from.
+use crate::ccok::{coin_value, num_coins, Builder, Params, Reveal, PARAMS_V5};
+use crate::error::CcokError;
+use crate::logging::VERIFIER;
+use crate::merkle::{HashAlgorithm, HashDomain, MerkleTreeBuilder};
+use crate::scheme::{lookup_scheme, SchemeId};
+use log::debug;
+use serde::{Deserialize, Serialize};
+
+/// Leaf of the reveal tree: a reveal of the certificate at its position
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RevealOpening {
+    /// Participant position of the reveal
+    pub position: u64,
+    pub reveal: Reveal,
+}
+
+/// Certificate compressed to the reveals of a sample of its coins
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AggregateProof {
+    /// Root of the signature tree of the certificate
+    pub sig_commit: Vec<u8>,
+    /// Total weight of the signatures collected
+    pub signed_weight: u64,
+    /// Number of signature slots, the size of both trees
+    pub total_sigs: usize,
+    /// Root of the tree over every reveal of the certificate, by position
+    pub reveal_root: Vec<u8>,
+    /// Number of reveals of the certificate, the leaves of the reveal tree
+    pub total_reveals: usize,
+    /// Opened reveals, by position
+    pub openings: Vec<RevealOpening>,
+    /// Reveal tree leaf of each opening
+    pub opened_leaves: Vec<u64>,
+    /// Multiproofs of the openings in the reveal, signature and party trees
+    pub reveal_proofs: Vec<Vec<u8>>,
+    pub sig_proofs: Vec<Vec<u8>>,
+    pub party_proofs: Vec<Vec<u8>>,
+    /// Sorted schemes of the opened reveals
+    pub schemes: Vec<SchemeId>,
+    pub hash: HashAlgorithm,
+    pub version: u8,
+    pub compression_level: u8,
+}
+
+/// Number of coins out of `coins` a proof at compression `level` opens
+pub fn opened_coins(coins: usize, level: u8) -> usize {
+    (coins + (1 << level) - 1) >> level
+}
+
+/// Certificate coin the second round coin `index` of a proof opens: the
+/// first 8 bytes, little-endian, of the `Opening` domain hash of
+/// `index || reveal_root || sig_commit || signed_weight || party_tree_root || msg`,
+/// reduced mod `coins`
+pub fn opened_coin(
+    params: &Params,
+    index: u64,
+    proof: &AggregateProof,
+    party_tree_root: &[u8],
+    coins: usize,
+) -> u64 {
+    let hash = params.hashing().hash_parts(
+        HashDomain::Opening,
+        &[
+            &index.to_le_bytes(),
+            &proof.reveal_root,
+            &proof.sig_commit,
+            &proof.signed_weight.to_le_bytes(),
+            party_tree_root,
+            &params.msg,
+        ],
+    );
+    let mut bytes = [0u8; 8];
+    bytes.copy_from_slice(&hash[0..8]);
+    u64::from_le_bytes(bytes) % coins as u64
+}
+
+impl AggregateProof {
+    /// Build the certificate of `builder` and compress it at the compression
+    /// level of its params
+    pub fn build(builder: &Builder) -> Result<Self, CcokError> {
+        let params = &builder.params;
+        params.validate()?;
+        // The openings carry signature multiproofs, which signature sum
+        // trees don't have
+        if params.version >= PARAMS_V5 {
+            return Err(CcokError::UnsupportedVersion(params.version));
+        }
+        let cert = builder.build()?;
+        let hashing = params.hashing();
+
+        let leaves: Vec<RevealOpening> = cert
+            .reveals
+            .iter()
+            .map(|(position, reveal)| RevealOpening {
+                position: *position,
+                reveal: reveal.clone(),
+            })
+            .collect();
+        let mut reveal_tree = MerkleTreeBuilder::with_hash(hashing);
+        reveal_tree.build(&leaves)?;
+
+        let mut proof = Self {
+            sig_commit: cert.sig_commit.clone(),
+            signed_weight: cert.signed_weight,
+            total_sigs: cert.total_sigs,
+            reveal_root: reveal_tree.root(),
+            total_reveals: leaves.len(),
+            openings: Vec::new(),
+            opened_leaves: Vec::new(),
+            reveal_proofs: Vec::new(),
+            sig_proofs: Vec::new(),
+            party_proofs: Vec::new(),
+            schemes: Vec::new(),
+            hash: params.hash,
+            version: params.version,
+            compression_level: params.compression_level,
+        };
+
+        // Open the reveal each second round coin's certificate coin lands in
+        let flips = cert.coin_flips(params, &builder.party_tree_root)?;
+        let mut opened: Vec<usize> = (0..opened_coins(flips.len(), params.compression_level))
+            .map(|index| {
+                let coin = opened_coin(
+                    params,
+                    index as u64,
+                    &proof,
+                    &builder.party_tree_root,
+                    flips.len(),
+                );
+                let position = flips[coin as usize].position;
+                leaves
+                    .binary_search_by_key(&position, |leaf| leaf.position)
+                    .map_err(|_| CcokError::InvalidReveal(position))
+            })
+            .collect::<Result<_, CcokError>>()?;
+        opened.sort_unstable();
+        opened.dedup();
+        let positions: Vec<usize> = opened
+            .iter()
+            .map(|&leaf| leaves[leaf].position as usize)
+            .collect();
+
+        let mut sig_tree = MerkleTreeBuilder::with_hash(hashing);
+        sig_tree.build_parallel(&builder.sigs)?;
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build_parallel(&builder.participants)?;
+        proof.reveal_proofs = reveal_tree.prove(&opened);
+        proof.sig_proofs = sig_tree.prove(&positions);
+        proof.party_proofs = party_tree.prove(&positions);
+
+        proof.openings = opened.iter().map(|&leaf| leaves[leaf].clone()).collect();
+        proof.opened_leaves = opened.iter().map(|&leaf| leaf as u64).collect();
+        proof.schemes = proof
+            .openings
+            .iter()
+            .map(|opening| opening.reveal.party.scheme)
+            .collect();
+        proof.schemes.sort();
+        proof.schemes.dedup();
+        Ok(proof)
+    }
+
+    /// Verify the proof against the party tree root. Every second round coin
+    /// must land in an opened reveal and every opening must be landed in.
+    pub fn verify(&self, params: &Params, party_tree_root: &[u8]) -> Result<bool, CcokError> {
+        params.validate()?;
+        if self.hash != params.hash {
+            return Err(CcokError::HashMismatch {
+                cert: self.hash,
+                params: params.hash,
+            });
+        }
+        if self.version != params.version {
+            return Err(CcokError::VersionMismatch {
+                cert: self.version,
+                params: params.version,
+            });
+        }
+        if self.compression_level != params.compression_level {
+            return Err(CcokError::InvalidParams(format!(
+                "proof compression level {} while params have {}",
+                self.compression_level, params.compression_level
+            )));
+        }
+        if self.signed_weight < params.proven_weight {
+            debug!(target: VERIFIER,
+                "Weight check failed: {} < {}",
+                self.signed_weight, params.proven_weight
+            );
+            return Ok(false);
+        }
+        if self.openings.len() != self.opened_leaves.len()
+            || !self
+                .openings
+                .windows(2)
+                .all(|pair| pair[0].position < pair[1].position)
+            || !self.opened_leaves.windows(2).all(|pair| pair[0] < pair[1])
+        {
+            debug!(target: VERIFIER, "Openings not sorted by position and leaf");
+            return Ok(false);
+        }
+
+        // Map every second round coin to the opening whose signed weight range
+        // holds its certificate coin
+        let coins = num_coins(params, self.signed_weight);
+        let ends = self
+            .openings
+            .iter()
+            .map(|opening| {
+                let start = opening.reveal.sig_slot.accumulated_weight;
+                start
+                    .checked_add(opening.reveal.party.weight)
+                    .ok_or(CcokError::WeightOverflow)
+            })
+            .collect::<Result<Vec<u64>, CcokError>>()?;
+        let mut landed = vec![false; self.openings.len()];
+        for index in 0..opened_coins(coins, self.compression_level) as u64 {
+            let coin_index = opened_coin(params, index, self, party_tree_root, coins);
+            let coin = coin_value(
+                params,
+                coin_index,
+                &self.sig_commit,
+                self.signed_weight,
+                party_tree_root,
+            );
+            let i = ends.partition_point(|&end| end <= coin);
+            match self.openings.get(i) {
+                Some(opening) if opening.reveal.sig_slot.accumulated_weight <= coin => {
+                    landed[i] = true
+                }
+                _ => {
+                    debug!(target: VERIFIER, "Coin {} lands in no opened reveal", coin_index);
+                    return Ok(false);
+                }
+            }
+        }
+        if landed.contains(&false) {
+            debug!(target: VERIFIER, "Opened reveal no coin landed in");
+            return Ok(false);
+        }
+
+        // Signatures of the openings, with the schemes the proof declares
+        for scheme in &self.schemes {
+            lookup_scheme(*scheme).map_err(CcokError::Scheme)?;
+        }
+        for opening in &self.openings {
+            if self
+                .schemes
+                .binary_search(&opening.reveal.party.scheme)
+                .is_err()
+            {
+                debug!(target: VERIFIER, "Scheme of position {} not declared", opening.position);
+                return Ok(false);
+            }
+            if !opening.reveal.verify(params, opening.position)? {
+                return Ok(false);
+            }
+        }
+
+        // The openings are leaves of the reveal tree, and their slots and
+        // participants leaves of the signature and party trees
+        let hashing = params.hashing();
+        let positions: Vec<usize> = self
+            .openings
+            .iter()
+            .map(|opening| opening.position as usize)
+            .collect();
+        let opened_leaves: Vec<usize> = self.opened_leaves.iter().map(|&l| l as usize).collect();
+        let reveal_leaves = self
+            .openings
+            .iter()
+            .map(|opening| hashing.leaf_hash(opening))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        let sig_leaves = self
+            .openings
+            .iter()
+            .map(|opening| hashing.leaf_hash(&opening.reveal.sig_slot))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        let party_leaves = self
+            .openings
+            .iter()
+            .map(|opening| hashing.leaf_hash(&opening.reveal.party))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        if !MerkleTreeBuilder::verify_with(
+            hashing,
+            &self.reveal_root,
+            &self.reveal_proofs,
+            &opened_leaves,
+            self.total_reveals,
+            &reveal_leaves,
+        ) {
+            debug!(target: VERIFIER, "Reveal tree proof verification failed");
+            return Ok(false);
+        }
+        if !MerkleTreeBuilder::verify_with(
+            hashing,
+            &self.sig_commit,
+            &self.sig_proofs,
+            &positions,
+            self.total_sigs,
+            &sig_leaves,
+        ) {
+            debug!(target: VERIFIER, "Signature Merkle proof verification failed");
+            return Ok(false);
+        }
+        if !MerkleTreeBuilder::verify_with(
+            hashing,
+            party_tree_root,
+            &self.party_proofs,
+            &positions,
+            self.total_sigs,
+            &party_leaves,
+        ) {
+            debug!(target: VERIFIER, "Participant Merkle proof verification failed");
+            return Ok(false);
+        }
+        Ok(true)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Participant, PARAMS_V1};
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_aggregate_proof() {
+        let wallets: Vec<Wallet> = (0..16)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 80,
+            compression_level: 2,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let mut builder = Builder::new(params.clone(), participants, root.clone()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+
+        let proof = AggregateProof::build(&builder).unwrap();
+        assert!(proof.verify(&params, &root).unwrap());
+        let cert = builder.build().unwrap();
+        assert_eq!(proof.total_reveals, cert.reveals.len());
+        assert!(proof.openings.len() <= opened_coins(num_coins(&params, 160), 2));
+        assert!(
+            bincode::serialized_size(&proof).unwrap() < bincode::serialized_size(&cert).unwrap()
+        );
+
+        // The proof is only valid at the level it was cut at
+        let uncompressed = Params {
+            compression_level: 0,
+            chain_id: None,
+            purpose: None,
+            ..params.clone()
+        };
+        assert!(matches!(
+            proof.verify(&uncompressed, &root),
+            Err(CcokError::InvalidParams(_))
+        ));
+        let legacy = Params {
+            version: PARAMS_V1,
+            ..params.clone()
+        };
+        assert!(legacy.validate().is_err());
+
+        // Openings can be neither forged nor dropped
+        let mut forged = proof.clone();
+        let position = forged.openings[0].position as usize;
+        forged.openings[0].reveal.sig_slot.signature =
+            Some(wallets[position].sign_message(b"other").into());
+        assert!(!forged.verify(&params, &root).unwrap());
+        let mut dropped = proof.clone();
+        dropped.openings.pop();
+        dropped.opened_leaves.pop();
+        assert!(!dropped.verify(&params, &root).unwrap());
+    }
+}
@@ -0,0 +1,959 @@
+//! State proofs in an Algorand-style layout. The certificates here follow the
+//! layout of go-algorand's `crypto/stateproof` package rather than this
+//! crate's own `Certificate`:
+//!
+//! - Merkle trees are go-algorand merkle arrays. Each leaf hashes a
+//!   `HashID`-prefixed encoding and each node hashes `"MA" || left || right`,
+//!   with an empty right child at the end of an odd layer. Multiproofs list
+//!   the missing siblings level by level, an empty digest for a missing child.
+//! - Participants are committed as `"spp" || weight || key lifetime || key
+//!   commitment`. Signature slots are committed as `"sps" || L || signature`,
+//!   with integers 8 bytes little-endian.
+//! - Participants sign the 32-byte message hash with Falcon-1024, through a
+//!   key commitment holding a single verifying key.
+//! - The proven weight enters as `ln_int_approximation`, the fixed-point
+//!   natural log. `num_reveals` derives the number of reveals from it and the
+//!   strength target. The coins come from a SHAKE256 stream over `"spc"` and
+//!   the coin choice seed, by rejection sampling.
+//! - `StateProof` encodes to canonical msgpack with go-algorand's codec tags
+//!   (`c`, `w`, `S`, `P`, `v`, `r`, `pr`), zero values omitted.
+//!
+//! The layout is not compatible with go-algorand: proofs built here don't
+//! verify there, and go-algorand's proofs don't verify here. Algorand mainnet
+//! builds its trees with Sumhash512, which isn't available here, so
+//! `HashType::Sumhash` is refused and proofs use SHA-512/256 or SHA-256, which
+//! the merkle array wire format also carries.
+//! Algorand signs with deterministic Falcon and commits a keystore of many
+//! keys, while the Falcon-1024 signatures here are randomized and a single key
+//! stands in for the keystore. Nothing is checked against go-algorand vectors.
+use crate::error::CcokError;
+use crate::msgpack::Msgpack;
+use crate::signer::SignatureScheme;
+use serde::{Deserialize, Serialize};
+use serde_bytes::ByteBuf;
+use sha2::{Digest, Sha256, Sha512_256};
+use sha3::digest::{ExtendableOutput, Update, XofReader};
+use sha3::Shake256;
+use std::collections::BTreeMap;
+
+/// Most reveals a state proof may carry
+pub const MAX_REVEALS: u64 = 640;
+
+/// Bits of security a state proof gives, Algorand's `StateProofStrengthTarget`
+pub const STRENGTH_TARGET: u64 = 256;
+
+/// Fractional bits of `ln_int_approximation`
+pub const PRECISION_BITS: u32 = 16;
+
+/// Default lifetime, in rounds, of a participant's ephemeral keys
+pub const KEY_LIFETIME: u64 = 256;
+
+/// Deepest merkle array a proof may describe
+pub const MAX_TREE_DEPTH: u8 = 16;
+
+// go-algorand `protocol.HashID` prefixes
+const COIN_ID: &[u8] = b"spc";
+const PART_ID: &[u8] = b"spp";
+const SIG_ID: &[u8] = b"sps";
+const NODE_ID: &[u8] = b"MA";
+const KEY_ID: &[u8] = b"KP";
+
+// Version byte of the coin choice seed
+const COIN_GENERATOR_VERSION: u8 = 0;
+
+// Scheme type of Falcon keys in key commitments and signatures
+const FALCON_TYPE: u16 = 0;
+
+/// Hash function of a merkle array, by go-algorand `crypto.HashType` id
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum HashType {
+    #[default]
+    Sha512_256,
+    Sumhash,
+    Sha256,
+}
+
+impl HashType {
+    pub fn id(self) -> u64 {
+        match self {
+            HashType::Sha512_256 => 0,
+            HashType::Sumhash => 1,
+            HashType::Sha256 => 2,
+        }
+    }
+
+    pub fn from_id(id: u64) -> Result<Self, CcokError> {
+        match id {
+            0 => Ok(HashType::Sha512_256),
+            1 => Ok(HashType::Sumhash),
+            2 => Ok(HashType::Sha256),
+            _ => Err(CcokError::InvalidParams(format!(
+                "Unknown hash type {}",
+                id
+            ))),
+        }
+    }
+
+    /// Hash of `id || parts`
+    pub fn hash(self, id: &[u8], parts: &[&[u8]]) -> Result<Vec<u8>, CcokError> {
+        fn digest<D: Digest>(id: &[u8], parts: &[&[u8]]) -> Vec<u8> {
+            let mut hasher = D::new();
+            Digest::update(&mut hasher, id);
+            for part in parts {
+                Digest::update(&mut hasher, part);
+            }
+            hasher.finalize().to_vec()
+        }
+        match self {
+            HashType::Sha512_256 => Ok(digest::<Sha512_256>(id, parts)),
+            HashType::Sha256 => Ok(digest::<Sha256>(id, parts)),
+            HashType::Sumhash => Err(CcokError::InvalidParams(
+                "Sumhash512 merkle arrays are not supported".to_string(),
+            )),
+        }
+    }
+}
+
+/// `crypto.HashFactory`
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HashFactory {
+    #[serde(rename = "t", default, skip_serializing_if = "is_zero")]
+    pub hash_type: u64,
+}
+
+impl HashFactory {
+    pub fn new(hash: HashType) -> Self {
+        Self {
+            hash_type: hash.id(),
+        }
+    }
+}
+
+fn is_zero<T: Default + PartialEq>(value: &T) -> bool {
+    *value == T::default()
+}
+
+/// `merklearray.Proof`: the sibling digests a multiproof needs
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Proof {
+    #[serde(rename = "pth", default, skip_serializing_if = "is_zero")]
+    pub path: Vec<ByteBuf>,
+    #[serde(rename = "hsh", default, skip_serializing_if = "is_zero")]
+    pub hash_factory: HashFactory,
+    #[serde(rename = "td", default, skip_serializing_if = "is_zero")]
+    pub tree_depth: u8,
+}
+
+/// go-algorand merkle array over leaf digests
+#[derive(Debug, Clone)]
+pub struct MerkleArray {
+    hash: HashType,
+    /// Digests of every level, the leaves first
+    layers: Vec<Vec<Vec<u8>>>,
+}
+
+impl MerkleArray {
+    pub fn new(hash: HashType, leaves: Vec<Vec<u8>>) -> Result<Self, CcokError> {
+        let mut layers = vec![leaves];
+        while layers.last().unwrap().len() > 1 {
+            let layer = layers.last().unwrap();
+            let up = layer
+                .chunks(2)
+                .map(|pair| {
+                    let right: &[u8] = pair.get(1).map_or(&[], Vec::as_slice);
+                    hash.hash(NODE_ID, &[&pair[0], right])
+                })
+                .collect::<Result<_, _>>()?;
+            layers.push(up);
+        }
+        Ok(Self { hash, layers })
+    }
+
+    /// Root digest, empty for an empty array
+    pub fn root(&self) -> Vec<u8> {
+        self.layers
+            .last()
+            .and_then(|layer| layer.first())
+            .cloned()
+            .unwrap_or_default()
+    }
+
+    pub fn depth(&self) -> u8 {
+        (self.layers.len() - 1) as u8
+    }
+
+    /// Multiproof of the leaves at `positions`
+    pub fn prove(&self, positions: &[u64]) -> Result<Proof, CcokError> {
+        let mut known: Vec<usize> = positions.iter().map(|&pos| pos as usize).collect();
+        known.sort();
+        known.dedup();
+        if known.last().is_some_and(|&pos| pos >= self.layers[0].len()) {
+            return Err(CcokError::LeafOutOfRange(*known.last().unwrap()));
+        }
+        let mut path = Vec::new();
+        for layer in &self.layers[..self.layers.len() - 1] {
+            let mut up = Vec::new();
+            let mut i = 0;
+            while i < known.len() {
+                let pos = known[i];
+                let sibling = pos ^ 1;
+                if known.get(i + 1) == Some(&sibling) {
+                    i += 1;
+                } else {
+                    path.push(ByteBuf::from(
+                        layer.get(sibling).cloned().unwrap_or_default(),
+                    ));
+                }
+                up.push(pos / 2);
+                i += 1;
+            }
+            known = up;
+        }
+        Ok(Proof {
+            path,
+            hash_factory: HashFactory::new(self.hash),
+            tree_depth: self.depth(),
+        })
+    }
+}
+
+/// Check that `leaves`, digests by position, are in the merkle array with
+/// `root`
+pub fn verify_proof(
+    root: &[u8],
+    leaves: &BTreeMap<u64, Vec<u8>>,
+    proof: &Proof,
+) -> Result<(), CcokError> {
+    let hash = HashType::from_id(proof.hash_factory.hash_type)?;
+    if proof.tree_depth > MAX_TREE_DEPTH {
+        return Err(CcokError::BadMerklePath(format!(
+            "tree depth {} exceeds {}",
+            proof.tree_depth, MAX_TREE_DEPTH
+        )));
+    }
+    if let Some((&pos, _)) = leaves.last_key_value() {
+        if pos >> proof.tree_depth != 0 {
+            return Err(CcokError::LeafOutOfRange(pos as usize));
+        }
+    }
+    let mut known: Vec<(u64, Vec<u8>)> = leaves.clone().into_iter().collect();
+    let mut path = proof.path.iter();
+    for _ in 0..proof.tree_depth {
+        let mut up = Vec::new();
+        let mut i = 0;
+        while i < known.len() {
+            let (pos, digest) = &known[i];
+            let sibling = match known.get(i + 1) {
+                Some((next, digest)) if *next == pos ^ 1 => {
+                    i += 1;
+                    digest.clone()
+                }
+                _ => path
+                    .next()
+                    .ok_or_else(|| CcokError::BadMerklePath("path too short".to_string()))?
+                    .to_vec(),
+            };
+            let parent = if pos % 2 == 0 {
+                hash.hash(NODE_ID, &[digest, &sibling])?
+            } else if sibling.is_empty() {
+                return Err(CcokError::BadMerklePath("empty left sibling".to_string()));
+            } else {
+                hash.hash(NODE_ID, &[&sibling, digest])?
+            };
+            up.push((pos / 2, parent));
+            i += 1;
+        }
+        known = up;
+    }
+    if path.next().is_some() {
+        return Err(CcokError::BadMerklePath("path too long".to_string()));
+    }
+    match known.as_slice() {
+        [(0, computed)] if computed == root => Ok(()),
+        [] if root.is_empty() => Ok(()),
+        _ => Err(CcokError::BadMerklePath("root mismatch".to_string())),
+    }
+}
+
+/// Natural log of `x` in fixed point with `PRECISION_BITS` fractional bits,
+/// rounded up
+pub fn ln_int_approximation(x: u64) -> Result<u64, CcokError> {
+    if x == 0 {
+        return Err(CcokError::InvalidParams("ln of 0".to_string()));
+    }
+    Ok(((x as f64).ln() * (1u64 << PRECISION_BITS) as f64).ceil() as u64)
+}
+
+/// Reveals needed for `strength_target` bits of security:
+/// `ceil(strength_target * 2^PRECISION_BITS / (ln(signed) - ln(proven)))`
+/// with both logs from `ln_int_approximation`
+pub fn num_reveals(
+    signed_weight: u64,
+    ln_proven_weight: u64,
+    strength_target: u64,
+) -> Result<u64, CcokError> {
+    let ln_signed_weight = ln_int_approximation(signed_weight)?;
+    if ln_signed_weight <= ln_proven_weight {
+        return Err(CcokError::InvalidParams(
+            "Signed weight doesn't exceed the proven weight".to_string(),
+        ));
+    }
+    let gap = (ln_signed_weight - ln_proven_weight) as u128;
+    let reveals = ((strength_target as u128) << PRECISION_BITS).div_ceil(gap);
+    if reveals > MAX_REVEALS as u128 {
+        return Err(CcokError::InvalidParams(format!(
+            "{} reveals exceed {}",
+            reveals, MAX_REVEALS
+        )));
+    }
+    Ok(reveals as u64)
+}
+
+/// Coins of a state proof, uniform in `[0, signed_weight)`
+pub struct CoinGenerator {
+    reader: <Shake256 as ExtendableOutput>::Reader,
+    signed_weight: u64,
+    threshold: u128,
+}
+
+impl CoinGenerator {
+    /// Coins of the SHAKE256 stream over `"spc" || version || party root ||
+    /// ln proven weight || sig commit || signed weight || data`, integers
+    /// 8 bytes little-endian
+    pub fn new(
+        party_commitment: &[u8],
+        ln_proven_weight: u64,
+        sig_commitment: &[u8],
+        signed_weight: u64,
+        data: &[u8; 32],
+    ) -> Self {
+        let mut shake = Shake256::default();
+        shake.update(COIN_ID);
+        shake.update(&[COIN_GENERATOR_VERSION]);
+        shake.update(party_commitment);
+        shake.update(&ln_proven_weight.to_le_bytes());
+        shake.update(sig_commitment);
+        shake.update(&signed_weight.to_le_bytes());
+        shake.update(data);
+        // Largest multiple of the signed weight below 2^64, so that accepted
+        // words reduce uniformly
+        let threshold = ((1u128 << 64) / signed_weight as u128) * signed_weight as u128;
+        Self {
+            reader: shake.finalize_xof(),
+            signed_weight,
+            threshold,
+        }
+    }
+
+    pub fn next_coin(&mut self) -> u64 {
+        loop {
+            let mut word = [0u8; 8];
+            self.reader.read(&mut word);
+            let value = u64::from_le_bytes(word);
+            if (value as u128) < self.threshold {
+                return value % self.signed_weight;
+            }
+        }
+    }
+}
+
+/// `crypto.FalconVerifier`
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct FalconVerifier {
+    #[serde(rename = "k", with = "serde_bytes")]
+    pub public_key: Vec<u8>,
+}
+
+/// `merklesignature.Verifier`, the commitment to a participant's keys
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyCommitment {
+    #[serde(rename = "cmt", with = "serde_bytes")]
+    pub commitment: Vec<u8>,
+    #[serde(rename = "lf", default, skip_serializing_if = "is_zero")]
+    pub key_lifetime: u64,
+}
+
+// Key commitment leaf of the Falcon `public_key` valid at `round`
+fn key_leaf(hash: HashType, round: u64, public_key: &[u8]) -> Result<Vec<u8>, CcokError> {
+    hash.hash(
+        KEY_ID,
+        &[&FALCON_TYPE.to_le_bytes(), &round.to_le_bytes(), public_key],
+    )
+}
+
+/// `basics.Participant`
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Participant {
+    #[serde(rename = "p")]
+    pub key: KeyCommitment,
+    #[serde(rename = "w", default, skip_serializing_if = "is_zero")]
+    pub weight: u64,
+}
+
+impl Participant {
+    /// Participant signing the state proof of `round` with the Falcon-1024
+    /// `public_key`, committed as a key commitment of that single key
+    pub fn from_falcon_key(
+        hash: HashType,
+        round: u64,
+        public_key: &[u8],
+        weight: u64,
+    ) -> Result<Self, CcokError> {
+        let tree = MerkleArray::new(hash, vec![key_leaf(hash, round, public_key)?])?;
+        Ok(Self {
+            key: KeyCommitment {
+                commitment: tree.root(),
+                key_lifetime: KEY_LIFETIME,
+            },
+            weight,
+        })
+    }
+
+    /// Party tree leaf of the participant
+    pub fn leaf(&self, hash: HashType) -> Result<Vec<u8>, CcokError> {
+        hash.hash(
+            PART_ID,
+            &[
+                &self.weight.to_le_bytes(),
+                &self.key.key_lifetime.to_le_bytes(),
+                &self.key.commitment,
+            ],
+        )
+    }
+}
+
+/// Party tree root of `participants`
+pub fn party_commitment(
+    hash: HashType,
+    participants: &[Participant],
+) -> Result<Vec<u8>, CcokError> {
+    let leaves = participants
+        .iter()
+        .map(|party| party.leaf(hash))
+        .collect::<Result<_, _>>()?;
+    Ok(MerkleArray::new(hash, leaves)?.root())
+}
+
+/// `merklesignature.Signature`: a Falcon signature with the path of its
+/// verifying key to the participant's key commitment
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Signature {
+    #[serde(
+        rename = "sig",
+        default,
+        with = "serde_bytes",
+        skip_serializing_if = "is_zero"
+    )]
+    pub signature: Vec<u8>,
+    #[serde(rename = "idx", default, skip_serializing_if = "is_zero")]
+    pub key_index: u64,
+    #[serde(rename = "prf", default, skip_serializing_if = "is_zero")]
+    pub proof: Proof,
+    #[serde(rename = "vkey", default, skip_serializing_if = "is_zero")]
+    pub verifying_key: FalconVerifier,
+}
+
+impl Signature {
+    // Fixed encoding committed in the signature slot, empty for no signature
+    fn hashable(&self) -> Vec<u8> {
+        if self.signature.is_empty() {
+            return Vec::new();
+        }
+        let mut bytes = FALCON_TYPE.to_le_bytes().to_vec();
+        bytes.extend_from_slice(&(self.signature.len() as u64).to_le_bytes());
+        bytes.extend_from_slice(&self.signature);
+        bytes.extend_from_slice(&self.key_index.to_le_bytes());
+        bytes.push(self.proof.tree_depth);
+        for node in &self.proof.path {
+            bytes.extend_from_slice(node);
+        }
+        bytes.extend_from_slice(&self.verifying_key.public_key);
+        bytes
+    }
+
+    /// Check the signature on `data` by a key of `party` valid at `round`
+    pub fn verify(
+        &self,
+        party: &Participant,
+        hash: HashType,
+        round: u64,
+        data: &[u8],
+    ) -> Result<bool, CcokError> {
+        let public_key = &self.verifying_key.public_key;
+        let leaf = BTreeMap::from([(self.key_index, key_leaf(hash, round, public_key)?)]);
+        if verify_proof(&party.key.commitment, &leaf, &self.proof).is_err() {
+            return Ok(false);
+        }
+        SignatureScheme::Falcon1024
+            .verify(public_key, data, &self.signature)
+            .map_err(CcokError::Scheme)
+    }
+}
+
+/// `sigslotCommit`: a signature with the signed weight before its slot
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SigSlot {
+    #[serde(rename = "s", default, skip_serializing_if = "is_zero")]
+    pub sig: Signature,
+    #[serde(rename = "l", default, skip_serializing_if = "is_zero")]
+    pub accumulated_weight: u64,
+}
+
+impl SigSlot {
+    /// Signature tree leaf of the slot
+    pub fn leaf(&self, hash: HashType) -> Result<Vec<u8>, CcokError> {
+        hash.hash(
+            SIG_ID,
+            &[&self.accumulated_weight.to_le_bytes(), &self.sig.hashable()],
+        )
+    }
+}
+
+/// `stateproof.Reveal`
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Reveal {
+    #[serde(rename = "s")]
+    pub sig_slot: SigSlot,
+    #[serde(rename = "p")]
+    pub part: Participant,
+}
+
+/// `stateproof.StateProof`
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct StateProof {
+    #[serde(rename = "c", with = "serde_bytes")]
+    pub sig_commit: Vec<u8>,
+    #[serde(rename = "w", default, skip_serializing_if = "is_zero")]
+    pub signed_weight: u64,
+    #[serde(rename = "S")]
+    pub sig_proofs: Proof,
+    #[serde(rename = "P")]
+    pub part_proofs: Proof,
+    #[serde(rename = "v", default, skip_serializing_if = "is_zero")]
+    pub salt_version: u8,
+    #[serde(rename = "r", default, skip_serializing_if = "is_zero")]
+    pub reveals: BTreeMap<u64, Reveal>,
+    /// Position revealed by every coin, in coin order
+    #[serde(rename = "pr", default, skip_serializing_if = "is_zero")]
+    pub positions_to_reveal: Vec<u64>,
+}
+
+impl Msgpack for StateProof {}
+
+/// What a state proof attests and how strongly
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Params {
+    /// Hash of the attested message
+    pub data: [u8; 32],
+    pub proven_weight: u64,
+    pub strength_target: u64,
+    /// Round the participants' keys are valid for
+    pub round: u64,
+    pub hash: HashType,
+}
+
+impl Params {
+    /// Algorand-style params of `params` for `round`: the SHA-256 of its
+    /// signing message, its proven weight and its security parameter as
+    /// strength target
+    pub fn from_ccok(params: &crate::ccok::Params, round: u64, hash: HashType) -> Self {
+        Self {
+            data: Sha256::digest(params.signing_message()).into(),
+            proven_weight: params.proven_weight,
+            strength_target: params.security_param as u64,
+            round,
+            hash,
+        }
+    }
+
+    pub fn ln_proven_weight(&self) -> Result<u64, CcokError> {
+        ln_int_approximation(self.proven_weight)
+    }
+}
+
+/// Collects Falcon signatures and builds a `StateProof`
+pub struct Prover {
+    params: Params,
+    participants: Vec<Participant>,
+    party_tree: MerkleArray,
+    sigs: Vec<Signature>,
+}
+
+impl Prover {
+    pub fn new(params: Params, participants: Vec<Participant>) -> Result<Self, CcokError> {
+        if let Some(pos) = participants.iter().position(|party| party.weight == 0) {
+            return Err(CcokError::ZeroWeight(pos));
+        }
+        let leaves = participants
+            .iter()
+            .map(|party| party.leaf(params.hash))
+            .collect::<Result<_, _>>()?;
+        let party_tree = MerkleArray::new(params.hash, leaves)?;
+        let sigs = vec![Signature::default(); participants.len()];
+        Ok(Self {
+            params,
+            participants,
+            party_tree,
+            sigs,
+        })
+    }
+
+    pub fn party_commitment(&self) -> Vec<u8> {
+        self.party_tree.root()
+    }
+
+    /// Add the Falcon-1024 signature of the participant at `pos` on the data
+    pub fn add_signature(
+        &mut self,
+        pos: usize,
+        public_key: &[u8],
+        signature: &[u8],
+    ) -> Result<(), CcokError> {
+        let party = self
+            .participants
+            .get(pos)
+            .ok_or(CcokError::InvalidPosition(pos))?;
+        if !self.sigs[pos].signature.is_empty() {
+            return Err(CcokError::DuplicateSignature(pos));
+        }
+        let hash = self.params.hash;
+        let sig = Signature {
+            signature: signature.to_vec(),
+            key_index: 0,
+            proof: MerkleArray::new(hash, vec![key_leaf(hash, self.params.round, public_key)?])?
+                .prove(&[0])?,
+            verifying_key: FalconVerifier {
+                public_key: public_key.to_vec(),
+            },
+        };
+        if !sig.verify(party, hash, self.params.round, &self.params.data)? {
+            return Err(CcokError::InvalidSignature(pos));
+        }
+        self.sigs[pos] = sig;
+        Ok(())
+    }
+
+    pub fn build(&self) -> Result<StateProof, CcokError> {
+        let hash = self.params.hash;
+        let mut slots = Vec::with_capacity(self.sigs.len());
+        let mut signed_weight = 0u64;
+        for (sig, party) in self.sigs.iter().zip(&self.participants) {
+            slots.push(SigSlot {
+                sig: sig.clone(),
+                accumulated_weight: signed_weight,
+            });
+            if !sig.signature.is_empty() {
+                signed_weight = signed_weight
+                    .checked_add(party.weight)
+                    .ok_or(CcokError::WeightOverflow)?;
+            }
+        }
+        if signed_weight <= self.params.proven_weight {
+            return Err(CcokError::InsufficientWeight {
+                signed: signed_weight,
+                proven: self.params.proven_weight,
+            });
+        }
+        let leaves = slots
+            .iter()
+            .map(|slot| slot.leaf(hash))
+            .collect::<Result<_, _>>()?;
+        let sig_tree = MerkleArray::new(hash, leaves)?;
+        let sig_commit = sig_tree.root();
+
+        let ln_proven_weight = self.params.ln_proven_weight()?;
+        let reveals = num_reveals(signed_weight, ln_proven_weight, self.params.strength_target)?;
+        let mut coins = CoinGenerator::new(
+            &self.party_commitment(),
+            ln_proven_weight,
+            &sig_commit,
+            signed_weight,
+            &self.params.data,
+        );
+        let mut positions_to_reveal = Vec::with_capacity(reveals as usize);
+        let mut revealed = BTreeMap::new();
+        for _ in 0..reveals {
+            let coin = coins.next_coin();
+            // Last signed slot whose weight range starts at or below the coin
+            let pos = slots.partition_point(|slot| slot.accumulated_weight <= coin);
+            let pos = (0..pos)
+                .rev()
+                .find(|&i| !slots[i].sig.signature.is_empty())
+                .ok_or(CcokError::NoSignatures)?;
+            positions_to_reveal.push(pos as u64);
+            revealed.entry(pos as u64).or_insert_with(|| Reveal {
+                sig_slot: slots[pos].clone(),
+                part: self.participants[pos].clone(),
+            });
+        }
+        let positions: Vec<u64> = revealed.keys().copied().collect();
+        Ok(StateProof {
+            sig_commit,
+            signed_weight,
+            sig_proofs: sig_tree.prove(&positions)?,
+            part_proofs: self.party_tree.prove(&positions)?,
+            salt_version: 0,
+            reveals: revealed,
+            positions_to_reveal,
+        })
+    }
+}
+
+/// Verify `proof` against the participants committed by `party_commitment`
+pub fn verify(
+    proof: &StateProof,
+    params: &Params,
+    party_commitment: &[u8],
+) -> Result<bool, CcokError> {
+    let hash = params.hash;
+    for tree in [&proof.sig_proofs, &proof.part_proofs] {
+        if tree.hash_factory != HashFactory::new(hash) {
+            return Ok(false);
+        }
+    }
+    if proof.signed_weight <= params.proven_weight {
+        return Ok(false);
+    }
+    let mut sig_leaves = BTreeMap::new();
+    let mut part_leaves = BTreeMap::new();
+    for (&pos, reveal) in &proof.reveals {
+        let slot = &reveal.sig_slot;
+        if slot.sig.signature.is_empty()
+            || !slot
+                .sig
+                .verify(&reveal.part, hash, params.round, &params.data)?
+        {
+            return Ok(false);
+        }
+        sig_leaves.insert(pos, slot.leaf(hash)?);
+        part_leaves.insert(pos, reveal.part.leaf(hash)?);
+    }
+    if verify_proof(&proof.sig_commit, &sig_leaves, &proof.sig_proofs).is_err()
+        || verify_proof(party_commitment, &part_leaves, &proof.part_proofs).is_err()
+    {
+        return Ok(false);
+    }
+
+    let ln_proven_weight = params.ln_proven_weight()?;
+    let reveals = num_reveals(
+        proof.signed_weight,
+        ln_proven_weight,
+        params.strength_target,
+    )?;
+    if proof.positions_to_reveal.len() as u64 != reveals {
+        return Ok(false);
+    }
+    let mut coins = CoinGenerator::new(
+        party_commitment,
+        ln_proven_weight,
+        &proof.sig_commit,
+        proof.signed_weight,
+        &params.data,
+    );
+    for pos in &proof.positions_to_reveal {
+        let coin = coins.next_coin();
+        let Some(reveal) = proof.reveals.get(pos) else {
+            return Ok(false);
+        };
+        let start = reveal.sig_slot.accumulated_weight;
+        let end = start
+            .checked_add(reveal.part.weight)
+            .ok_or(CcokError::WeightOverflow)?;
+        if !(start <= coin && coin < end) {
+            return Ok(false);
+        }
+    }
+    Ok(true)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::signer::{FalconSigner, Signer};
+
+    // Params over a preset, four Falcon-1024 signers of weight 30 and their
+    // participants
+    fn setup() -> (Params, Vec<FalconSigner>, Vec<Participant>) {
+        let params = Params::from_ccok(
+            &crate::ccok::Params::preset(
+                crate::ccok::SecurityLevel::Security128,
+                b"block headers".to_vec(),
+                60,
+            ),
+            1024,
+            HashType::Sha512_256,
+        );
+        let signers: Vec<FalconSigner> = (0..4)
+            .map(|_| FalconSigner::with_scheme(SignatureScheme::Falcon1024).unwrap())
+            .collect();
+        let participants: Vec<Participant> = signers
+            .iter()
+            .map(|signer| {
+                Participant::from_falcon_key(params.hash, params.round, &signer.public_key(), 30)
+                    .unwrap()
+            })
+            .collect();
+        (params, signers, participants)
+    }
+
+    // Proof signed by participants 0, 1 and 3, with the party commitment
+    fn signed_proof(
+        params: &Params,
+        signers: &[FalconSigner],
+        participants: Vec<Participant>,
+    ) -> (StateProof, Vec<u8>) {
+        let mut prover = Prover::new(params.clone(), participants).unwrap();
+        for i in [0, 1, 3] {
+            prover
+                .add_signature(i, &signers[i].public_key(), &signers[i].sign(&params.data))
+                .unwrap();
+        }
+        (prover.build().unwrap(), prover.party_commitment())
+    }
+
+    #[test]
+    fn test_num_reveals() {
+        assert_eq!(ln_int_approximation(2).unwrap(), 45427);
+        assert_eq!(ln_int_approximation(1).unwrap(), 0);
+        // 256 bits at a signed to proven weight ratio of e take 256 reveals
+        let ln_proven = ln_int_approximation(1_000_000).unwrap();
+        assert_eq!(num_reveals(2_718_282, ln_proven, 256).unwrap(), 256);
+    }
+
+    #[test]
+    fn test_num_reveals_errors() {
+        assert!(ln_int_approximation(0).is_err());
+        let ln_proven = ln_int_approximation(1_000_000).unwrap();
+        // No more signed than proven weight
+        assert!(num_reveals(1_000_000, ln_proven, 256).is_err());
+        assert!(num_reveals(999_999, ln_proven, 256).is_err());
+        // Too close to the proven weight for MAX_REVEALS
+        assert!(num_reveals(1_100_000, ln_proven, 256).is_err());
+    }
+
+    #[test]
+    fn test_merkle_array() {
+        let leaves: Vec<Vec<u8>> = (0..5u8).map(|i| vec![i; 32]).collect();
+        let tree = MerkleArray::new(HashType::Sha256, leaves.clone()).unwrap();
+        let proof = tree.prove(&[1, 4]).unwrap();
+        let known = BTreeMap::from([(1, leaves[1].clone()), (4, leaves[4].clone())]);
+        verify_proof(&tree.root(), &known, &proof).unwrap();
+    }
+
+    #[test]
+    fn test_merkle_array_errors() {
+        let leaves: Vec<Vec<u8>> = (0..5u8).map(|i| vec![i; 32]).collect();
+        let tree = MerkleArray::new(HashType::Sha256, leaves.clone()).unwrap();
+        let proof = tree.prove(&[1, 4]).unwrap();
+        assert!(tree.prove(&[5]).is_err());
+
+        // Leaves at other positions or with other contents don't verify
+        let moved = BTreeMap::from([(0, leaves[1].clone()), (4, leaves[4].clone())]);
+        assert!(verify_proof(&tree.root(), &moved, &proof).is_err());
+        let changed = BTreeMap::from([(1, leaves[2].clone()), (4, leaves[4].clone())]);
+        assert!(verify_proof(&tree.root(), &changed, &proof).is_err());
+        let known = BTreeMap::from([(1, leaves[1].clone()), (4, leaves[4].clone())]);
+        assert!(verify_proof(&leaves[0], &known, &proof).is_err());
+
+        // Sumhash512 and unknown hash types are refused
+        assert!(MerkleArray::new(HashType::Sumhash, leaves).is_err());
+        assert!(HashType::from_id(3).is_err());
+    }
+
+    #[test]
+    fn test_algorand_state_proof() {
+        let (params, signers, participants) = setup();
+        let (proof, root) = signed_proof(&params, &signers, participants);
+        assert_eq!(proof.signed_weight, 90);
+        assert!(!proof.reveals.contains_key(&2));
+
+        // The proof survives the msgpack wire format and verifies
+        let bytes = proof.to_msgpack().unwrap();
+        let decoded = StateProof::from_msgpack(&bytes).unwrap();
+        assert_eq!(decoded, proof);
+        assert!(verify(&decoded, &params, &root).unwrap());
+    }
+
+    #[test]
+    fn test_prover_errors() {
+        let (params, signers, participants) = setup();
+        let sign = |i: usize| signers[i].sign(&params.data);
+
+        let mut weightless = participants.clone();
+        weightless[2].weight = 0;
+        assert_eq!(
+            Prover::new(params.clone(), weightless).err(),
+            Some(CcokError::ZeroWeight(2))
+        );
+
+        let mut prover = Prover::new(params.clone(), participants).unwrap();
+        // Another participant's key, a signature over other data, or a
+        // position out of range
+        assert!(prover
+            .add_signature(0, &signers[1].public_key(), &sign(1))
+            .is_err());
+        assert_eq!(
+            prover
+                .add_signature(0, &signers[0].public_key(), &signers[0].sign(b"other"))
+                .err(),
+            Some(CcokError::InvalidSignature(0))
+        );
+        assert_eq!(
+            prover
+                .add_signature(4, &signers[0].public_key(), &sign(0))
+                .err(),
+            Some(CcokError::InvalidPosition(4))
+        );
+
+        // A participant signs once, and 60 of 60 proven weight isn't enough
+        prover
+            .add_signature(0, &signers[0].public_key(), &sign(0))
+            .unwrap();
+        assert_eq!(
+            prover
+                .add_signature(0, &signers[0].public_key(), &sign(0))
+                .err(),
+            Some(CcokError::DuplicateSignature(0))
+        );
+        prover
+            .add_signature(1, &signers[1].public_key(), &sign(1))
+            .unwrap();
+        assert!(matches!(
+            prover.build(),
+            Err(CcokError::InsufficientWeight {
+                signed: 60,
+                proven: 60
+            })
+        ));
+    }
+
+    #[test]
+    fn test_verify_rejects_tampering() {
+        let (params, signers, participants) = setup();
+        let (proof, root) = signed_proof(&params, &signers, participants);
+
+        let mut other = params.clone();
+        other.data[0] ^= 1;
+        assert!(!verify(&proof, &other, &root).unwrap());
+        let mut rehashed = params.clone();
+        rehashed.hash = HashType::Sha256;
+        assert!(!verify(&proof, &rehashed, &root).unwrap());
+        assert!(!verify(&proof, &params, &proof.sig_commit).unwrap());
+
+        let mut inflated = proof.clone();
+        inflated.signed_weight += 1;
+        assert!(!verify(&inflated, &params, &root).unwrap_or(false));
+        let mut dropped = proof.clone();
+        dropped.positions_to_reveal.pop();
+        assert!(!verify(&dropped, &params, &root).unwrap());
+        let mut forged = proof.clone();
+        let reveal = forged.reveals.values_mut().next().unwrap();
+        reveal.sig_slot.sig.signature[0] ^= 1;
+        assert!(!verify(&forged, &params, &root).unwrap_or(false));
+        let mut reweighted = proof.clone();
+        reweighted.reveals.values_mut().next().unwrap().part.weight += 1;
+        assert!(!verify(&reweighted, &params, &root).unwrap());
+
+        assert!(StateProof::from_msgpack(&[0xc1]).is_err());
+    }
+}
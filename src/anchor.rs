@@ -0,0 +1,501 @@
+//! Checkpoints of the sidechain on an external anchor chain. Every few
+//! intervals, an `Anchorer` posts a `Checkpoint` to an `Anchor`. The
+//! checkpoint holds the interval, its last block and the hash of the interval's
+//! certified state proof. The anchor can be Bitcoin, through OP_RETURN outputs
+//! of a wallet, an EVM contract, or an append-only public log. An old voter set
+//! whose keys leak could certify a whole alternative history from genesis, and
+//! a light client could not tell it apart. `AnchorVerifier` checks a chain's
+//! state proofs against the anchored checkpoints, so such a long-range fork
+//! is refused as soon as it crosses one. The first checkpoint anchored for an
+//! interval is the one that counts.
+use crate::certstore::proof_epoch;
+use crate::evm::{calldata, Token};
+use crate::merkle::HashDomain;
+use crate::relayer::JsonRpc;
+use crate::stateproof::StateProof;
+use futures::future::BoxFuture;
+use log::{info, warn};
+use serde_json::json;
+use std::io::{BufRead, BufReader, Write};
+use std::path::PathBuf;
+use tokio::sync::mpsc;
+
+/// Prefix of encoded checkpoints, telling them apart from other anchor data
+pub const CHECKPOINT_MAGIC: &[u8; 4] = b"NRPK";
+
+/// Length of an encoded checkpoint, well within the 80 bytes of OP_RETURN
+pub const CHECKPOINT_LEN: usize = 4 + 8 + 8 + 32;
+
+/// Hash of a state proof, as anchored
+pub fn checkpoint_hash(proof: &StateProof) -> Result<[u8; 32], String> {
+    let bytes = bincode::serialize(proof).map_err(|e| format!("Serialization error: {}", e))?;
+    Ok(proof.certificate.hashing().hash(HashDomain::Leaf, &bytes))
+}
+
+/// Certified state proof of one interval, as posted to the anchor
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Checkpoint {
+    /// Interval of the proof, as numbered by `certstore::proof_epoch`
+    pub interval: u64,
+    /// Last block of the interval
+    pub last_block: u64,
+    pub proof_hash: [u8; 32],
+}
+
+impl Checkpoint {
+    pub fn new(proof: &StateProof) -> Result<Self, String> {
+        Ok(Self {
+            interval: proof_epoch(proof),
+            last_block: proof.message.last_block,
+            proof_hash: checkpoint_hash(proof)?,
+        })
+    }
+
+    /// `CHECKPOINT_MAGIC`, the interval, the last block and the proof hash,
+    /// integers big-endian
+    pub fn encode(&self) -> Vec<u8> {
+        let mut bytes = CHECKPOINT_MAGIC.to_vec();
+        bytes.extend_from_slice(&self.interval.to_be_bytes());
+        bytes.extend_from_slice(&self.last_block.to_be_bytes());
+        bytes.extend_from_slice(&self.proof_hash);
+        bytes
+    }
+
+    /// Checkpoint encoded in `bytes`, `None` for other data
+    pub fn decode(bytes: &[u8]) -> Option<Self> {
+        if bytes.len() != CHECKPOINT_LEN || !bytes.starts_with(CHECKPOINT_MAGIC) {
+            return None;
+        }
+        Some(Self {
+            interval: u64::from_be_bytes(bytes[4..12].try_into().ok()?),
+            last_block: u64::from_be_bytes(bytes[12..20].try_into().ok()?),
+            proof_hash: bytes[20..].try_into().ok()?,
+        })
+    }
+
+    /// Whether `proof` is the proof this checkpoint anchors
+    pub fn matches(&self, proof: &StateProof) -> Result<bool, String> {
+        Ok(*self == Self::new(proof)?)
+    }
+}
+
+/// External chain or log holding checkpoints
+pub trait Anchor: Send + Sync {
+    /// Post `checkpoint`, returning the id of the anchor transaction or entry
+    fn post<'a>(&'a self, checkpoint: &'a Checkpoint) -> BoxFuture<'a, Result<String, String>>;
+
+    /// First checkpoint anchored for `interval`
+    fn checkpoint(&self, interval: u64) -> BoxFuture<'_, Result<Option<Checkpoint>, String>>;
+}
+
+/// Append-only log of hex-encoded checkpoints, one per line, e.g. a file
+/// published over HTTP or in a transparency log
+pub struct LogAnchor {
+    path: PathBuf,
+}
+
+impl LogAnchor {
+    pub fn new(path: impl Into<PathBuf>) -> Self {
+        Self { path: path.into() }
+    }
+
+    /// Checkpoints in the log, in the order they were posted
+    pub fn checkpoints(&self) -> Result<Vec<Checkpoint>, String> {
+        let file = match std::fs::File::open(&self.path) {
+            Ok(file) => file,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(format!("Failed to open {}: {}", self.path.display(), e)),
+        };
+        let mut checkpoints = Vec::new();
+        for line in BufReader::new(file).lines() {
+            let line = line.map_err(|e| format!("Failed to read anchor log: {}", e))?;
+            if let Some(checkpoint) = hex::decode(line.trim())
+                .ok()
+                .and_then(|bytes| Checkpoint::decode(&bytes))
+            {
+                checkpoints.push(checkpoint);
+            }
+        }
+        Ok(checkpoints)
+    }
+
+    fn append(&self, checkpoint: &Checkpoint) -> Result<String, String> {
+        let entry = self.checkpoints()?.len();
+        let mut file = std::fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&self.path)
+            .map_err(|e| format!("Failed to open {}: {}", self.path.display(), e))?;
+        writeln!(file, "{}", hex::encode(checkpoint.encode()))
+            .and_then(|_| file.sync_data())
+            .map_err(|e| format!("Failed to append to anchor log: {}", e))?;
+        Ok(format!("{}:{}", self.path.display(), entry))
+    }
+}
+
+impl Anchor for LogAnchor {
+    fn post<'a>(&'a self, checkpoint: &'a Checkpoint) -> BoxFuture<'a, Result<String, String>> {
+        Box::pin(async move { self.append(checkpoint) })
+    }
+
+    fn checkpoint(&self, interval: u64) -> BoxFuture<'_, Result<Option<Checkpoint>, String>> {
+        Box::pin(async move {
+            Ok(self
+                .checkpoints()?
+                .into_iter()
+                .find(|checkpoint| checkpoint.interval == interval))
+        })
+    }
+}
+
+/// `OP_RETURN` output script carrying `data`, at most 80 bytes
+pub fn op_return_script(data: &[u8]) -> Result<Vec<u8>, String> {
+    const OP_RETURN: u8 = 0x6a;
+    const OP_PUSHDATA1: u8 = 0x4c;
+    let mut script = vec![OP_RETURN];
+    match data.len() {
+        0..=75 => script.push(data.len() as u8),
+        76..=80 => script.extend_from_slice(&[OP_PUSHDATA1, data.len() as u8]),
+        len => return Err(format!("{} bytes don't fit in an OP_RETURN output", len)),
+    }
+    script.extend_from_slice(data);
+    Ok(script)
+}
+
+/// Data carried by an `OP_RETURN` output script
+pub fn op_return_data(script: &[u8]) -> Option<&[u8]> {
+    let (data, len) = match script {
+        [0x6a, 0x4c, len, data @ ..] => (data, *len as usize),
+        [0x6a, len @ 0..=75, data @ ..] => (data, *len as usize),
+        _ => return None,
+    };
+    (data.len() == len).then_some(data)
+}
+
+/// Bitcoin wallet funding the anchor transactions
+pub trait OpReturnWallet: Send + Sync {
+    /// Broadcast a transaction with an output of `script`, returning its txid
+    fn broadcast<'a>(&'a self, script: &'a [u8]) -> BoxFuture<'a, Result<String, String>>;
+
+    /// Output scripts of the confirmed anchor transactions, oldest first
+    fn confirmed_scripts(&self) -> BoxFuture<'_, Result<Vec<Vec<u8>>, String>>;
+}
+
+/// Anchors checkpoints in Bitcoin `OP_RETURN` outputs
+pub struct BitcoinAnchor<W: OpReturnWallet> {
+    wallet: W,
+}
+
+impl<W: OpReturnWallet> BitcoinAnchor<W> {
+    pub fn new(wallet: W) -> Self {
+        Self { wallet }
+    }
+}
+
+impl<W: OpReturnWallet> Anchor for BitcoinAnchor<W> {
+    fn post<'a>(&'a self, checkpoint: &'a Checkpoint) -> BoxFuture<'a, Result<String, String>> {
+        Box::pin(async move {
+            let script = op_return_script(&checkpoint.encode())?;
+            self.wallet.broadcast(&script).await
+        })
+    }
+
+    fn checkpoint(&self, interval: u64) -> BoxFuture<'_, Result<Option<Checkpoint>, String>> {
+        Box::pin(async move {
+            Ok(self
+                .wallet
+                .confirmed_scripts()
+                .await?
+                .iter()
+                .filter_map(|script| op_return_data(script).and_then(Checkpoint::decode))
+                .find(|checkpoint| checkpoint.interval == interval))
+        })
+    }
+}
+
+/// Solidity signature of the anchoring function:
+/// `anchor(interval, lastBlock, proofHash)`. The contract must keep the
+/// first checkpoint of every interval.
+pub const ANCHOR_SIGNATURE: &str = "anchor(uint64,uint64,bytes32)";
+
+/// Solidity signature of the checkpoint lookup:
+/// `checkpoints(interval) returns (lastBlock, proofHash)`, zero if unset
+pub const CHECKPOINTS_SIGNATURE: &str = "checkpoints(uint64)";
+
+/// Anchors checkpoints in an EVM contract over JSON-RPC, sending from an
+/// account the endpoint holds the key of
+pub struct EvmAnchor {
+    rpc: JsonRpc,
+    contract: String,
+    from: String,
+}
+
+impl EvmAnchor {
+    pub fn new(rpc_url: &str, contract: &str, from: &str) -> Self {
+        Self {
+            rpc: JsonRpc::new(rpc_url),
+            contract: contract.to_string(),
+            from: from.to_string(),
+        }
+    }
+
+    async fn send(&self, checkpoint: &Checkpoint) -> Result<String, String> {
+        let data = calldata(
+            ANCHOR_SIGNATURE,
+            &[
+                Token::uint(checkpoint.interval),
+                Token::uint(checkpoint.last_block),
+                Token::Word(checkpoint.proof_hash),
+            ],
+        );
+        let tx = json!({
+            "from": self.from,
+            "to": self.contract,
+            "data": format!("0x{}", hex::encode(data)),
+        });
+        let hash = self.rpc.call("eth_sendTransaction", json!([tx])).await?;
+        hash.as_str()
+            .map(str::to_string)
+            .ok_or_else(|| format!("Invalid transaction hash: {}", hash))
+    }
+
+    async fn lookup(&self, interval: u64) -> Result<Option<Checkpoint>, String> {
+        let data = calldata(CHECKPOINTS_SIGNATURE, &[Token::uint(interval)]);
+        let call = json!({
+            "to": self.contract,
+            "data": format!("0x{}", hex::encode(data)),
+        });
+        let result = self.rpc.call("eth_call", json!([call, "latest"])).await?;
+        let words = result
+            .as_str()
+            .and_then(|s| s.strip_prefix("0x"))
+            .and_then(|s| hex::decode(s).ok())
+            .filter(|bytes| bytes.len() == 64)
+            .ok_or_else(|| format!("Invalid checkpoint: {}", result))?;
+        let proof_hash: [u8; 32] = words[32..].try_into().unwrap();
+        if proof_hash == [0u8; 32] {
+            return Ok(None);
+        }
+        Ok(Some(Checkpoint {
+            interval,
+            last_block: u64::from_be_bytes(words[24..32].try_into().unwrap()),
+            proof_hash,
+        }))
+    }
+}
+
+impl Anchor for EvmAnchor {
+    fn post<'a>(&'a self, checkpoint: &'a Checkpoint) -> BoxFuture<'a, Result<String, String>> {
+        Box::pin(self.send(checkpoint))
+    }
+
+    fn checkpoint(&self, interval: u64) -> BoxFuture<'_, Result<Option<Checkpoint>, String>> {
+        Box::pin(self.lookup(interval))
+    }
+}
+
+/// Posts the state proof of every `every`th interval to an anchor
+pub struct Anchorer<A: Anchor> {
+    anchor: A,
+    every: u64,
+    last_anchored: Option<u64>,
+}
+
+impl<A: Anchor> Anchorer<A> {
+    pub fn new(anchor: A, every: u64) -> Self {
+        Self {
+            anchor,
+            every: every.max(1),
+            last_anchored: None,
+        }
+    }
+
+    /// Last interval anchored
+    pub fn last_anchored(&self) -> Option<u64> {
+        self.last_anchored
+    }
+
+    /// Anchor `proof` if its interval is due, returning the anchor
+    /// transaction or entry id
+    pub async fn on_proof(&mut self, proof: &StateProof) -> Result<Option<String>, String> {
+        let checkpoint = Checkpoint::new(proof)?;
+        if checkpoint.interval % self.every != 0 || self.last_anchored >= Some(checkpoint.interval)
+        {
+            return Ok(None);
+        }
+        let id = self
+            .anchor
+            .post(&checkpoint)
+            .await
+            .map_err(|e| format!("Anchoring interval {} failed: {}", checkpoint.interval, e))?;
+        info!("Anchored interval {} in {}", checkpoint.interval, id);
+        self.last_anchored = Some(checkpoint.interval);
+        Ok(Some(id))
+    }
+
+    /// Anchor proofs from `proofs` until the channel closes
+    pub async fn run(mut self, mut proofs: mpsc::Receiver<StateProof>) {
+        while let Some(proof) = proofs.recv().await {
+            if let Err(e) = self.on_proof(&proof).await {
+                warn!("{}", e);
+            }
+        }
+    }
+}
+
+/// Checks the state proofs of a chain against the anchored checkpoints
+pub struct AnchorVerifier<A: Anchor> {
+    anchor: A,
+    every: u64,
+}
+
+impl<A: Anchor> AnchorVerifier<A> {
+    /// Verifier of the checkpoints an `Anchorer` posts to `anchor` every
+    /// `every` intervals
+    pub fn new(anchor: A, every: u64) -> Self {
+        Self {
+            anchor,
+            every: every.max(1),
+        }
+    }
+
+    /// Check `proofs`, consecutive intervals of one chain, against the
+    /// anchor. Fails if any of them differs from the checkpoint anchored for
+    /// its interval; returns how many checkpoints matched.
+    pub async fn verify(&self, proofs: &[StateProof]) -> Result<usize, String> {
+        let mut matched = 0;
+        let mut previous: Option<u64> = None;
+        for proof in proofs {
+            let interval = proof_epoch(proof);
+            if previous.is_some_and(|previous| interval != previous + 1) {
+                return Err(format!(
+                    "State proof of interval {} does not follow interval {}",
+                    interval,
+                    previous.unwrap()
+                ));
+            }
+            previous = Some(interval);
+            if interval % self.every != 0 {
+                continue;
+            }
+            let Some(checkpoint) = self.anchor.checkpoint(interval).await? else {
+                continue;
+            };
+            if !checkpoint.matches(proof)? {
+                return Err(format!(
+                    "State proof of interval {} conflicts with its anchored checkpoint {}",
+                    interval,
+                    hex::encode(checkpoint.proof_hash)
+                ));
+            }
+            matched += 1;
+        }
+        Ok(matched)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::config::STATE_PROOF_INTERVAL;
+    use crate::stateproof::{voters_commitment, StateProofMessage};
+    use crate::wallet::Wallet;
+    use std::sync::Mutex;
+
+    // Wallet keeping the broadcast scripts as if they confirmed at once
+    #[derive(Default)]
+    struct MockWallet {
+        scripts: Mutex<Vec<Vec<u8>>>,
+    }
+
+    impl OpReturnWallet for MockWallet {
+        fn broadcast<'a>(&'a self, script: &'a [u8]) -> BoxFuture<'a, Result<String, String>> {
+            let mut scripts = self.scripts.lock().unwrap();
+            scripts.push(script.to_vec());
+            let txid = format!("{:064x}", scripts.len());
+            Box::pin(async move { Ok(txid) })
+        }
+
+        fn confirmed_scripts(&self) -> BoxFuture<'_, Result<Vec<Vec<u8>>, String>> {
+            let scripts = self.scripts.lock().unwrap().clone();
+            Box::pin(async move { Ok(scripts) })
+        }
+    }
+
+    // State proofs of `count` intervals, with headers commitments `seed`
+    fn chain(wallet: &Wallet, count: u64, seed: u8) -> Vec<StateProof> {
+        let template = Params {
+            proven_weight: 5,
+            ..Default::default()
+        };
+        let voters = vec![Participant::from_signer(wallet, 10)];
+        let root = voters_commitment(template.hashing(), &voters).unwrap();
+        (0..count)
+            .map(|i| {
+                let message = StateProofMessage {
+                    first_block: i * STATE_PROOF_INTERVAL + 1,
+                    last_block: (i + 1) * STATE_PROOF_INTERVAL,
+                    block_headers_commitment: vec![seed; 32],
+                    voters_commitment: root.clone(),
+                };
+                let params = message.params(&template).unwrap();
+                let mut builder =
+                    Builder::new(params.clone(), voters.clone(), root.clone()).unwrap();
+                builder
+                    .add_signature(0, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+                StateProof {
+                    message,
+                    certificate: builder.build().unwrap(),
+                }
+            })
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn test_anchoring() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let honest = chain(&wallet, 6, 1);
+        let checkpoint = Checkpoint::new(&honest[1]).unwrap();
+        assert_eq!(checkpoint.interval, 2);
+        assert_eq!(Checkpoint::decode(&checkpoint.encode()), Some(checkpoint));
+        let script = op_return_script(&checkpoint.encode()).unwrap();
+        assert_eq!(op_return_data(&script), Some(&checkpoint.encode()[..]));
+        assert!(op_return_script(&[0u8; 81]).is_err());
+
+        // Every second interval is anchored, once
+        let path = std::env::temp_dir().join(format!("anchor-{}.log", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let mut anchorer = Anchorer::new(LogAnchor::new(&path), 2);
+        for proof in &honest {
+            anchorer.on_proof(proof).await.unwrap();
+        }
+        assert!(anchorer.on_proof(&honest[3]).await.unwrap().is_none());
+        assert_eq!(anchorer.last_anchored(), Some(6));
+        let anchored = LogAnchor::new(&path).checkpoints().unwrap();
+        let intervals: Vec<u64> = anchored.iter().map(|c| c.interval).collect();
+        assert_eq!(intervals, vec![2, 4, 6]);
+
+        // The honest chain matches its checkpoints, a long-range fork doesn't
+        let verifier = AnchorVerifier::new(LogAnchor::new(&path), 2);
+        assert_eq!(verifier.verify(&honest).await.unwrap(), 3);
+        let fork = chain(&wallet, 6, 2);
+        assert!(verifier.verify(&fork).await.is_err());
+        assert_eq!(verifier.verify(&fork[..1]).await.unwrap(), 0);
+        assert!(verifier
+            .verify(&[honest[0].clone(), honest[2].clone()])
+            .await
+            .is_err());
+        std::fs::remove_file(&path).unwrap();
+
+        // The same through Bitcoin OP_RETURN outputs
+        let mut anchorer = Anchorer::new(BitcoinAnchor::new(MockWallet::default()), 3);
+        for proof in &honest {
+            anchorer.on_proof(proof).await.unwrap();
+        }
+        let verifier = AnchorVerifier::new(anchorer.anchor, 3);
+        assert_eq!(verifier.verify(&honest).await.unwrap(), 2);
+        assert!(verifier.verify(&fork).await.is_err());
+    }
+}
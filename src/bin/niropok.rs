@@ -0,0 +1,297 @@
+use clap::{Parser, Subcommand};
+use niropok_pq_sidechain::{
+    ccok::{KeyLayout, Params, Participant},
+    cli::{self, SignatureFile},
+    envelope,
+    keystore::Keystore,
+    signer::SignatureScheme,
+    testvectors,
+};
+use std::error::Error;
+use std::path::PathBuf;
+
+/// Operator tool for NIROPoK keys and compact certificates
+#[derive(Parser)]
+#[command(name = "niropok", version)]
+struct Cli {
+    /// Keystore directory
+    #[arg(long, env = "NIROPOK_KEYSTORE", default_value = "keystore")]
+    keystore: PathBuf,
+    /// Passphrase of the keys
+    #[arg(long, env = "NIROPOK_KEY_PASSPHRASE", hide_env_values = true)]
+    passphrase: Option<String>,
+    #[command(subcommand)]
+    command: Command,
+}
+
+#[derive(Subcommand)]
+enum Command {
+    /// Generate a key and store it in the keystore
+    Keygen {
+        name: String,
+        #[arg(long, default_value = "dilithium2")]
+        scheme: String,
+    },
+    /// List the keys of the keystore
+    Keys,
+    /// Sign a message, or the signing message of a params file
+    Sign {
+        name: String,
+        /// Hex message to sign
+        #[arg(long, conflicts_with = "params")]
+        message: Option<String>,
+        /// Params file of the certificate to sign for
+        #[arg(long)]
+        params: Option<PathBuf>,
+        /// Signature file to write, printed if missing
+        #[arg(long)]
+        out: Option<PathBuf>,
+    },
+    /// Build a certificate from a directory of signature files
+    Build {
+        #[arg(long)]
+        params: PathBuf,
+        #[arg(long)]
+        participants: PathBuf,
+        #[arg(long)]
+        signatures: PathBuf,
+        #[arg(long)]
+        out: PathBuf,
+    },
+    /// Manage participant sets
+    #[command(subcommand)]
+    Participants(ParticipantsCommand),
+    /// Write or check conformance test vectors
+    #[command(subcommand)]
+    Vectors(VectorsCommand),
+    /// Verify a certificate against a party tree root
+    Verify {
+        cert: PathBuf,
+        #[arg(long)]
+        params: PathBuf,
+        /// Party tree root in hex
+        #[arg(long)]
+        root: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum ParticipantsCommand {
+    /// Write a participants file from a CSV or JSON one, or from keys of
+    /// the keystore as name=weight
+    Create {
+        #[arg(long)]
+        from: Option<PathBuf>,
+        #[arg(long = "key", value_name = "NAME=WEIGHT")]
+        keys: Vec<String>,
+        /// Written as CSV for a .csv path, else as JSON
+        #[arg(long)]
+        out: PathBuf,
+    },
+    /// Print the party tree root of a participants file
+    Root {
+        participants: PathBuf,
+        /// Params fixing the tree hash
+        #[arg(long)]
+        params: PathBuf,
+    },
+    /// Compare two participant sets
+    Diff { old: PathBuf, new: PathBuf },
+    /// Write the params of the handoff from one epoch's set to the next
+    Handoff {
+        /// Number of the outgoing epoch
+        #[arg(long)]
+        epoch: u64,
+        #[arg(long)]
+        from: PathBuf,
+        #[arg(long)]
+        to: PathBuf,
+        /// Params template of handoff certificates
+        #[arg(long)]
+        params: PathBuf,
+        /// Params file the outgoing participants sign
+        #[arg(long)]
+        out: PathBuf,
+    },
+}
+
+#[derive(Subcommand)]
+enum VectorsCommand {
+    /// Write the standard test vectors as canonical JSON
+    Generate {
+        #[arg(long)]
+        out: PathBuf,
+    },
+    /// Check a test vector file against this implementation
+    Check { vectors: PathBuf },
+}
+
+fn participants(args: &Cli, command: &ParticipantsCommand) -> Result<(), Box<dyn Error>> {
+    match command {
+        ParticipantsCommand::Create { from, keys, out } => {
+            let mut participants = match from {
+                Some(from) => cli::read_participants(from)?,
+                None => Vec::new(),
+            };
+            if !keys.is_empty() {
+                let keystore = Keystore::open(&args.keystore)?;
+                for key in keys {
+                    let (name, weight) = key
+                        .split_once('=')
+                        .ok_or_else(|| format!("Expected NAME=WEIGHT, got {}", key))?;
+                    let file = keystore.key_file(name)?;
+                    participants.push(Participant {
+                        public_key: file.public_key,
+                        weight: weight.parse()?,
+                        scheme: file.scheme,
+                        key_commitment: None,
+                        vrf_key: None,
+                        key_layout: KeyLayout::InLeaf,
+                    });
+                }
+            }
+            cli::write_participants(out, &participants)?;
+            println!("Wrote {} participants", participants.len());
+        }
+        ParticipantsCommand::Root {
+            participants,
+            params,
+        } => {
+            let params: Params = cli::read_json(params)?;
+            let (root, count, total) = cli::participants_file_root(participants, &params)?;
+            println!(
+                "{} ({} participants, total weight {})",
+                hex::encode(root),
+                count,
+                total
+            );
+        }
+        ParticipantsCommand::Diff { old, new } => {
+            let diff = cli::diff_participants(
+                &cli::read_participants(old)?,
+                &cli::read_participants(new)?,
+            );
+            for key in &diff.added {
+                println!("+ {}", key);
+            }
+            for key in &diff.removed {
+                println!("- {}", key);
+            }
+            for (key, old, new) in &diff.reweighted {
+                println!("~ {} {} -> {}", key, old, new);
+            }
+            if diff.reordered {
+                println!("Participants were reordered");
+            }
+            if diff.is_empty() {
+                println!("Participant sets are identical");
+            }
+        }
+        ParticipantsCommand::Handoff {
+            epoch,
+            from,
+            to,
+            params,
+            out,
+        } => {
+            let template: Params = cli::read_json(params)?;
+            let (handoff, params) = cli::handoff(
+                *epoch,
+                &cli::read_participants(from)?,
+                &cli::read_participants(to)?,
+                &template,
+            )?;
+            cli::write_json(out, &params)?;
+            println!("{}", serde_json::to_string_pretty(&handoff)?);
+        }
+    }
+    Ok(())
+}
+
+fn passphrase(args: &Cli) -> Result<&str, String> {
+    args.passphrase
+        .as_deref()
+        .ok_or_else(|| "Pass --passphrase or set NIROPOK_KEY_PASSPHRASE".to_string())
+}
+
+fn main() -> Result<(), Box<dyn Error>> {
+    let args = Cli::parse();
+    match &args.command {
+        Command::Keygen { name, scheme } => {
+            let keystore = Keystore::open(&args.keystore)?;
+            let scheme: SignatureScheme = cli::parse_scheme(scheme)?;
+            let file = cli::keygen(&keystore, name, passphrase(&args)?, scheme)?;
+            println!("{} {} {}", name, scheme.name(), file.public_key);
+        }
+        Command::Keys => {
+            let keystore = Keystore::open(&args.keystore)?;
+            for name in keystore.list()? {
+                let file = keystore.key_file(&name)?;
+                let scheme =
+                    SignatureScheme::from_id(file.scheme).map_or("unknown", |scheme| scheme.name());
+                println!("{} {} {}", name, scheme, file.public_key);
+            }
+        }
+        Command::Sign {
+            name,
+            message,
+            params,
+            out,
+        } => {
+            let msg = match (message, params) {
+                (Some(message), _) => hex::decode(message)?,
+                (None, Some(params)) => cli::read_json::<Params>(params)?.signing_message(),
+                (None, None) => return Err("Pass --message or --params".into()),
+            };
+            let keystore = Keystore::open(&args.keystore)?;
+            let file: SignatureFile = cli::sign(&keystore, name, passphrase(&args)?, &msg)?;
+            match out {
+                Some(out) => cli::write_json(out, &file)?,
+                None => println!("{}", serde_json::to_string_pretty(&file)?),
+            }
+        }
+        Command::Build {
+            params,
+            participants,
+            signatures,
+            out,
+        } => {
+            let params: Params = cli::read_json(params)?;
+            let participants = cli::read_participants(participants)?;
+            let (cert, skipped) = cli::build_certificate(&params, &participants, signatures)?;
+            for path in skipped {
+                eprintln!("Skipped {}: not a valid participant signature", path);
+            }
+            std::fs::write(out, envelope::encode(&cert)?)?;
+            println!(
+                "Certificate with {} reveals for party tree root {}",
+                cert.reveals.len(),
+                hex::encode(cli::party_tree_root(&participants, &params)?)
+            );
+        }
+        Command::Participants(command) => participants(&args, command)?,
+        Command::Vectors(VectorsCommand::Generate { out }) => {
+            let vectors = testvectors::standard_vectors()?;
+            testvectors::write(out, &vectors)?;
+            println!("Wrote {} test vectors", vectors.len());
+        }
+        Command::Vectors(VectorsCommand::Check { vectors }) => {
+            let vectors = testvectors::load(vectors)?;
+            for vector in &vectors {
+                vector.check()?;
+                println!("{} ok", vector.name);
+            }
+        }
+        Command::Verify { cert, params, root } => {
+            let params: Params = cli::read_json(params)?;
+            let root = hex::decode(root)?;
+            if cli::verify_certificate(&std::fs::read(cert)?, &params, &root)? {
+                println!("Certificate is valid");
+            } else {
+                println!("Certificate is INVALID");
+                std::process::exit(1);
+            }
+        }
+    }
+    Ok(())
+}
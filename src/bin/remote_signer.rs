@@ -0,0 +1,41 @@
+use niropok_pq_sidechain::{keystore::Keystore, remotesigner::SignerDaemon};
+use std::error::Error;
+use std::os::unix::net::UnixListener;
+
+// Reference signing daemon: serves the keys of a keystore on a Unix socket,
+// so validator keys never enter the node process. The high-water marks of
+// the keys are kept in NIROPOK_SIGNER_MARKS, by default next to the socket.
+//
+//   NIROPOK_KEYSTORE=keys NIROPOK_KEY_PASSPHRASE=... remote_signer signer.sock [key...]
+fn main() -> Result<(), Box<dyn Error>> {
+    pretty_env_logger::init();
+    let mut args = std::env::args().skip(1);
+    let socket = args
+        .next()
+        .ok_or("Usage: remote_signer <socket> [key...]")?;
+    let dir = std::env::var("NIROPOK_KEYSTORE").map_err(|_| "NIROPOK_KEYSTORE must be set")?;
+    let passphrase = std::env::var("NIROPOK_KEY_PASSPHRASE")
+        .map_err(|_| "NIROPOK_KEY_PASSPHRASE must be set")?;
+
+    // Serve the keys named, or every key of the keystore
+    let keystore = Keystore::open(&dir)?;
+    let mut names: Vec<String> = args.collect();
+    if names.is_empty() {
+        names = keystore.list()?;
+    }
+    let marks =
+        std::env::var("NIROPOK_SIGNER_MARKS").unwrap_or_else(|_| format!("{}.marks", socket));
+    let mut daemon = SignerDaemon::new().with_marks(&marks)?;
+    for name in &names {
+        let signer = keystore.unlock(name, &passphrase)?;
+        println!("Serving key {} ({})", name, signer.public_key_hex());
+        daemon.add_key(name, signer);
+    }
+
+    // A stale socket of an earlier run would make the bind fail
+    let _ = std::fs::remove_file(&socket);
+    let listener = UnixListener::bind(&socket)?;
+    println!("Remote signer listening on {}", socket);
+    daemon.serve(listener)?;
+    Ok(())
+}
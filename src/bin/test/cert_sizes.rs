@@ -0,0 +1,124 @@
+use niropok_pq_sidechain::{
+    ccok::{Builder, Params, Participant, PARAMS_V1},
+    merkle::MerkleTreeBuilder,
+    signer::{generate_signer, SignatureScheme},
+};
+use rand::Rng;
+use std::time::Instant;
+
+fn main() {
+    let mut rng = rand::thread_rng();
+
+    // Number of participants per experiment
+    let num_participants = 200;
+    let msg = b"Certificate size benchmark message".to_vec();
+    let security_param = 1000;
+
+    // Classical Schnorr is the baseline the post-quantum schemes are compared to
+    let schemes = vec![
+        SignatureScheme::Schnorr,
+        SignatureScheme::Dilithium2,
+        SignatureScheme::Dilithium3,
+        SignatureScheme::Falcon512,
+        SignatureScheme::Falcon1024,
+        SignatureScheme::SphincsSha2128s,
+        SignatureScheme::SphincsSha2128f,
+        SignatureScheme::MlDsa65,
+    ];
+
+    // Use the same weights for every scheme so the reveal counts are comparable
+    let weights: Vec<u64> = (0..num_participants)
+        .map(|_| rng.gen_range(10..=100))
+        .collect();
+    let total_weight: u64 = weights.iter().sum();
+    let proven_weight = (total_weight as f64 * 0.5).round() as u64;
+
+    let mut baseline_size = 0usize;
+    for scheme in schemes {
+        println!("\n===== {:?} =====", scheme);
+
+        println!("Generating {} signers...", num_participants);
+        let signers: Vec<_> = (0..num_participants)
+            .map(|_| generate_signer(scheme).expect("Failed to create signer"))
+            .collect();
+        let participants: Vec<Participant> = signers
+            .iter()
+            .zip(weights.iter())
+            .map(|(signer, weight)| Participant::from_signer(signer.as_ref(), *weight))
+            .collect();
+
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let party_tree_root = party_tree.root();
+
+        let params = Params {
+            msg: msg.clone(),
+            proven_weight,
+            security_param,
+            scheme: Some(scheme.id()),
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder = Builder::new(params, participants, party_tree_root.clone())
+            .expect("Invalid certificate params");
+
+        let start = Instant::now();
+        for (i, signer) in signers.iter().enumerate() {
+            builder
+                .add_signature(i, signer.sign(&msg))
+                .expect("Failed to add signature");
+        }
+        println!("Signing took {:?}", start.elapsed());
+
+        let start = Instant::now();
+        let cert = match builder.build() {
+            Ok(cert) => cert,
+            Err(e) => {
+                println!("Error building certificate: {}", e);
+                continue;
+            }
+        };
+        println!("Building took {:?}", start.elapsed());
+
+        let start = Instant::now();
+        match cert.verify(&builder.params, &party_tree_root) {
+            Ok(true) => println!("Certificate verified in {:?}", start.elapsed()),
+            Ok(false) => println!("Certificate verification failed!"),
+            Err(e) => println!("Error during verification: {}", e),
+        }
+
+        let cert_size = bincode::serialize(&cert)
+            .expect("Failed to serialize certificate")
+            .len();
+        if scheme == SignatureScheme::Schnorr {
+            baseline_size = cert_size;
+        }
+        let (sig_size, party_size) = cert.proof_size();
+        println!(
+            "Number of reveals in certificate: {}",
+            cert.reveal_positions.len()
+        );
+        println!("Signature proof size: {} bytes", sig_size);
+        println!("Party proof size: {} bytes", party_size);
+        println!(
+            "Serialized certificate size: {} bytes ({:.2}x Schnorr)",
+            cert_size,
+            cert_size as f64 / baseline_size as f64
+        );
+
+        let mut compressed = cert.clone();
+        compressed
+            .compress_proofs()
+            .expect("Failed to compress proofs");
+        let compressed_size = bincode::serialize(&compressed)
+            .expect("Failed to serialize certificate")
+            .len();
+        println!(
+            "With compressed proofs: {} bytes ({} bytes saved)",
+            compressed_size,
+            cert_size - compressed_size
+        );
+    }
+}
@@ -0,0 +1,102 @@
+use niropok_pq_sidechain::{
+    ccok::{KeyLayout, Participant},
+    merkle::{HashAlgorithm, HashDomain, Hashing, MerkleTreeBuilder},
+    signer::SignatureScheme,
+};
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Instant;
+
+// Counts every allocation of the process
+struct CountingAllocator;
+
+static ALLOCATIONS: AtomicUsize = AtomicUsize::new(0);
+
+unsafe impl GlobalAlloc for CountingAllocator {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        System.alloc(layout)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        System.dealloc(ptr, layout)
+    }
+}
+
+#[global_allocator]
+static ALLOCATOR: CountingAllocator = CountingAllocator;
+
+// Allocations and time of `f`
+fn measure(f: impl FnOnce()) -> (usize, std::time::Duration) {
+    let before = ALLOCATIONS.load(Ordering::Relaxed);
+    let start = Instant::now();
+    f();
+    (
+        ALLOCATIONS.load(Ordering::Relaxed) - before,
+        start.elapsed(),
+    )
+}
+
+// Tree hashing as it was before buffer reuse: a serialization per leaf and a
+// tagged copy of every hash input
+fn copying_root(hashing: Hashing, participants: &[Participant]) -> [u8; 32] {
+    let hash = |domain: HashDomain, data: &[u8]| hashing.algorithm.hash(&domain.tagged(data));
+    let mut layer: Vec<[u8; 32]> = participants
+        .iter()
+        .map(|p| hash(HashDomain::Leaf, &bincode::serialize(p).unwrap()))
+        .collect();
+    while layer.len() > 1 {
+        layer = layer
+            .chunks(2)
+            .map(|pair| match pair.get(1) {
+                Some(right) => {
+                    let mut concatenated = pair[0].to_vec();
+                    concatenated.extend_from_slice(right);
+                    hash(HashDomain::Node, &concatenated)
+                }
+                None => pair[0],
+            })
+            .collect();
+    }
+    layer[0]
+}
+
+// Compares the allocations of party tree builds with reused buffers against
+// copying every hash input, over the same participants.
+fn main() {
+    let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+    for size in [1_000usize, 10_000, 100_000] {
+        let participants: Vec<Participant> = (0..size)
+            .map(|i| Participant {
+                public_key: format!("{:02624x}", i),
+                weight: 1 + (i as u64 % 100),
+                scheme: SignatureScheme::Dilithium2.id(),
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            })
+            .collect();
+        println!("\n===== {} participants =====", size);
+
+        let mut copied = [0u8; 32];
+        let (copying_allocs, copying_time) = measure(|| {
+            copied = copying_root(hashing, &participants);
+        });
+        let mut tree = MerkleTreeBuilder::with_hash(hashing);
+        let (pooled_allocs, pooled_time) = measure(|| {
+            tree.build(&participants).expect("Failed to build tree");
+        });
+        assert_eq!(tree.root(), copied.to_vec(), "Roots differ");
+
+        println!(
+            "Copying inputs: {} allocations in {:?}",
+            copying_allocs, copying_time
+        );
+        println!(
+            "Reused buffers: {} allocations in {:?} ({:.1}x fewer)",
+            pooled_allocs,
+            pooled_time,
+            copying_allocs as f64 / pooled_allocs.max(1) as f64
+        );
+    }
+}
@@ -0,0 +1,54 @@
+use niropok_pq_sidechain::{
+    ccok::{KeyLayout, Participant},
+    merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder},
+    signer::SignatureScheme,
+};
+use std::time::Instant;
+
+// Compares sequential and parallel party tree builds over growing
+// participant sets. Keys are placeholders: only the hashing is measured.
+fn main() {
+    let threads = rayon::current_num_threads();
+    println!("Parallel builds use {} threads", threads);
+
+    for size in [1_000usize, 10_000, 100_000, 1_000_000] {
+        let participants: Vec<Participant> = (0..size)
+            .map(|i| Participant {
+                public_key: format!("{:02624x}", i),
+                weight: 1 + (i as u64 % 100),
+                scheme: SignatureScheme::Dilithium2.id(),
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            })
+            .collect();
+        println!("\n===== {} participants =====", size);
+
+        for hash in [HashAlgorithm::Keccak256, HashAlgorithm::Blake3] {
+            let hashing = Hashing::new(hash, true);
+
+            let start = Instant::now();
+            let mut sequential = MerkleTreeBuilder::with_hash(hashing);
+            sequential
+                .build(&participants)
+                .expect("Failed to build tree");
+            let sequential_time = start.elapsed();
+
+            let start = Instant::now();
+            let mut parallel = MerkleTreeBuilder::with_hash(hashing);
+            parallel
+                .build_parallel(&participants)
+                .expect("Failed to build tree");
+            let parallel_time = start.elapsed();
+
+            assert_eq!(sequential.root(), parallel.root(), "Roots differ");
+            println!(
+                "{}: sequential {:?}, parallel {:?} ({:.2}x)",
+                hash.name(),
+                sequential_time,
+                parallel_time,
+                sequential_time.as_secs_f64() / parallel_time.as_secs_f64()
+            );
+        }
+    }
+}
@@ -0,0 +1,36 @@
+use niropok_pq_sidechain::simulation::{fuzz, simulate, Scenario, WeightDistribution};
+
+// Runs random builder and verifier scenarios from a seed, then one over a
+// million participants with skewed weights. Usage: simulate [seed] [runs]
+fn main() {
+    let mut args = std::env::args().skip(1);
+    let seed: u64 = args.next().map_or(0, |s| s.parse().expect("Invalid seed"));
+    let runs: usize = args
+        .next()
+        .map_or(100, |s| s.parse().expect("Invalid run count"));
+
+    let outcomes = fuzz(seed, runs, 1_000).expect("Simulation failed");
+    let built = outcomes.iter().filter(|o| o.reveals.is_some()).count();
+    let verified = outcomes.iter().filter(|o| o.verified).count();
+    println!(
+        "{} scenarios from seed {}: {} certificates built, {} verified",
+        runs, seed, built, verified
+    );
+
+    let scenario = Scenario {
+        seed,
+        participants: 1_000_000,
+        weights: WeightDistribution::Zipf {
+            max: 1_000_000,
+            exponent: 1.1,
+        },
+        dropout: 0.2,
+        adversarial: 0.01,
+        ..Scenario::default()
+    };
+    let outcome = simulate(&scenario).expect("Simulation failed");
+    println!(
+        "1M participants: {:?} reveals, verified {}, build {:?}, verify {:?}",
+        outcome.reveals, outcome.verified, outcome.build_time, outcome.verify_time
+    );
+}
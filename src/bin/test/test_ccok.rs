@@ -1,6 +1,7 @@
 use niropok_pq_sidechain::{
-    ccok::{Builder, Params, Participant},
+    ccok::{Builder, KeyLayout, Params, Participant, PARAMS_V1},
     merkle::MerkleTreeBuilder,
+    signer::SignatureScheme,
     wallet::Wallet,
 };
 use rand::Rng;
@@ -29,6 +30,10 @@ fn main() {
         participants.push(Participant {
             public_key: wallet.get_public_key(),
             weight,
+            scheme: SignatureScheme::Dilithium2.id(),
+            key_commitment: None,
+            vrf_key: None,
+            key_layout: KeyLayout::InLeaf,
         });
         wallets.push(wallet);
     }
@@ -70,10 +75,13 @@ fn main() {
             msg: msg.clone(),
             proven_weight,
             security_param,
+            version: PARAMS_V1,
+            ..Default::default()
         };
 
         // Create the Builder
-        let mut builder = Builder::new(params, participants.clone(), party_tree_root.clone());
+        let mut builder = Builder::new(params, participants.clone(), party_tree_root.clone())
+            .expect("Invalid certificate params");
 
         // Each participant signs the message until we reach the target signed weight (80% of totalWeight)
         println!(
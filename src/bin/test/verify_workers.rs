@@ -0,0 +1,68 @@
+use niropok_pq_sidechain::{
+    ccok::{Builder, Params, Participant, Verifier, PARAMS_V3},
+    merkle::MerkleTreeBuilder,
+    wallet::Wallet,
+};
+use std::time::Instant;
+
+// Times verification of one large certificate with the reveals checked in
+// turn and on worker pools of growing size.
+fn main() {
+    let size = 1_000;
+    let wallets: Vec<Wallet> = (0..size)
+        .map(|_| Wallet::new().expect("Failed to create wallet"))
+        .collect();
+    let participants: Vec<Participant> = wallets
+        .iter()
+        .map(|w| Participant::from_signer(w, 10))
+        .collect();
+    let mut party_tree = MerkleTreeBuilder::new();
+    party_tree
+        .build(&participants)
+        .expect("Failed to build party tree");
+    let root = party_tree.root();
+
+    let params = Params {
+        msg: b"Benchmark message".to_vec(),
+        proven_weight: size as u64 * 10 / 2,
+        version: PARAMS_V3,
+        ..Default::default()
+    };
+    let mut builder = Builder::new(params.clone(), participants, root.clone())
+        .expect("Invalid certificate params");
+    for (pos, wallet) in wallets.iter().enumerate() {
+        builder
+            .add_signature(pos, wallet.sign_message(&params.msg))
+            .expect("Failed to add signature");
+    }
+    let cert = builder.build().expect("Failed to build certificate");
+    println!(
+        "Certificate over {} participants with {} reveals",
+        size,
+        cert.reveal_positions.len()
+    );
+
+    let start = Instant::now();
+    assert!(Verifier::new(root.clone())
+        .verify(&cert, &params)
+        .expect("Verification failed"));
+    let sequential = start.elapsed();
+    println!("sequential: {:?}", sequential);
+
+    for workers in [1, 2, 4, 8] {
+        let verifier = Verifier::new(root.clone())
+            .with_workers(workers)
+            .expect("Failed to create verification pool");
+        let start = Instant::now();
+        assert!(verifier
+            .verify(&cert, &params)
+            .expect("Verification failed"));
+        let elapsed = start.elapsed();
+        println!(
+            "{} workers: {:?} ({:.2}x)",
+            workers,
+            elapsed,
+            sequential.as_secs_f64() / elapsed.as_secs_f64()
+        );
+    }
+}
@@ -1,10 +1,14 @@
 use crate::accounts::Account;
 use crate::ccok::Certificate;
+use crate::config::MAX_TXNS_PER_BLOCK;
+use crate::mempool::Mempool;
 use crate::transaction::Transaction;
+use crate::tx::SignedTx;
 use crate::utils::Seed;
-use rs_merkle::{Hasher, MerkleTree};
+use rs_merkle::{Hasher, MerkleProof, MerkleTree};
 use serde::{Deserialize, Serialize};
 use sha3::{Digest, Sha3_256};
+use std::collections::HashSet;
 
 #[derive(Clone)]
 #[allow(dead_code)]
@@ -19,13 +23,54 @@ impl Hasher for Sha3Hasher {
     }
 }
 
+/// Header of a block, the part certified by the validators
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BlockHeader {
+    /// Block number, starting at 1
+    pub height: u64,
+    /// Hash of the parent block's header
+    pub parent_hash: [u8; 32],
+    /// Epoch timestamp of the block
+    pub timestamp: u64,
+    /// Merkle root of the block's transactions
+    pub tx_root: [u8; 32],
+    /// Root of the account state after the block
+    pub state_root: [u8; 32],
+    /// Party tree root of the validators certifying the block
+    pub validator_root: [u8; 32],
+    /// Root of the IBC packet commitments after the block
+    pub commitment_root: [u8; 32],
+    /// Proposer seed of the block
+    pub seed: [u8; 32],
+}
+
+impl BlockHeader {
+    /// Hash of the header, the block hash
+    pub fn hash(&self) -> Result<[u8; 32], String> {
+        let bytes = bincode::serialize(self).map_err(|e| format!("Serialization error: {}", e))?;
+        Ok(Sha3Hasher::hash(&bytes))
+    }
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Block {
     pub id: usize,
+    /// Hash of the block header
     pub hash: [u8; 32],
     pub previous_hash: [u8; 32],
     pub timestamp: usize,
+    #[serde(default)]
+    pub tx_root: [u8; 32],
+    #[serde(default)]
+    pub state_root: [u8; 32],
+    #[serde(default)]
+    pub validator_root: [u8; 32],
+    #[serde(default)]
+    pub commitment_root: [u8; 32],
     pub txn: Vec<Transaction>,
+    /// Typed transactions, committed after `txn` in the transaction root
+    #[serde(default)]
+    pub txs: Vec<SignedTx>,
     pub proposer_address: Account,
     pub proposer_hash: String,
     pub seed: Seed,
@@ -48,22 +93,279 @@ impl Block {
             hash: [0u8; 32],
             previous_hash,
             timestamp,
+            tx_root: [0u8; 32],
+            state_root: [0u8; 32],
+            validator_root: [0u8; 32],
+            commitment_root: [0u8; 32],
             txn,
+            txs: Vec::new(),
             proposer_address,
             proposer_hash,
             seed,
             certificate,
         };
-        block.hash = block.compute_merkle_root();
+        block.seal()?;
         Ok(block)
     }
 
-    fn compute_merkle_root(&self) -> [u8; 32] {
-        if self.txn.is_empty() {
-            return [0u8; 32];
+    // Recompute the transaction root and the block hash
+    fn seal(&mut self) -> Result<(), String> {
+        self.tx_root = merkle_root(&self.tx_hashes()?);
+        self.hash = self.header().hash()?;
+        Ok(())
+    }
+
+    /// Header of the block
+    pub fn header(&self) -> BlockHeader {
+        BlockHeader {
+            height: self.id as u64,
+            parent_hash: self.previous_hash,
+            timestamp: self.timestamp as u64,
+            tx_root: self.tx_root,
+            state_root: self.state_root,
+            validator_root: self.validator_root,
+            commitment_root: self.commitment_root,
+            seed: self.seed.get_seed(),
+        }
+    }
+
+    // Hashes of the legacy transactions followed by the typed ones
+    fn tx_hashes(&self) -> Result<Vec<[u8; 32]>, String> {
+        let mut hashes: Vec<[u8; 32]> = self.txn.iter().map(|tx| tx.hash).collect();
+        for tx in &self.txs {
+            hashes.push(tx.hash()?);
+        }
+        Ok(hashes)
+    }
+
+    /// Prove that the transaction at `index` is committed by the transaction root
+    pub fn prove_transaction(&self, index: usize) -> Result<TxProof, String> {
+        let leaves = self.tx_hashes()?;
+        if index >= leaves.len() {
+            return Err(format!("Transaction index {} out of range", index));
         }
-        let leaves: Vec<[u8; 32]> = self.txn.iter().map(|tx| tx.hash.clone()).collect();
         let tree = MerkleTree::<Sha3Hasher>::from_leaves(&leaves);
-        tree.root().unwrap()
+        Ok(TxProof {
+            index,
+            total: leaves.len(),
+            hashes: tree.proof(&[index]).proof_hashes().to_vec(),
+        })
+    }
+}
+
+/// Transaction root over transaction hashes, zero for an empty block
+pub fn merkle_root(hashes: &[[u8; 32]]) -> [u8; 32] {
+    if hashes.is_empty() {
+        return [0u8; 32];
+    }
+    MerkleTree::<Sha3Hasher>::from_leaves(hashes)
+        .root()
+        .unwrap()
+}
+
+/// Merkle proof of a transaction hash under a transaction root
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TxProof {
+    /// Position of the transaction in the block
+    pub index: usize,
+    /// Number of transactions in the block
+    pub total: usize,
+    /// Sibling hashes of the proof
+    pub hashes: Vec<[u8; 32]>,
+}
+
+impl TxProof {
+    /// Check that `tx_hash` is the transaction at `index` of the block with `tx_root`
+    pub fn verify(&self, tx_root: &[u8; 32], tx_hash: &[u8; 32]) -> bool {
+        self.index < self.total
+            && MerkleProof::<Sha3Hasher>::new(self.hashes.clone()).verify(
+                *tx_root,
+                &[self.index],
+                &[*tx_hash],
+                self.total,
+            )
+    }
+}
+
+/// Assembles the next block from the transactions waiting in a mempool
+pub struct BlockBuilder {
+    id: usize,
+    previous_hash: [u8; 32],
+    timestamp: usize,
+    proposer_address: Account,
+    proposer_hash: String,
+    seed: Seed,
+    state_root: [u8; 32],
+    validator_root: [u8; 32],
+    commitment_root: [u8; 32],
+    certificate: Option<Certificate>,
+    txs: Vec<SignedTx>,
+    max_txns: usize,
+}
+
+impl BlockBuilder {
+    /// Builder of the child of `parent`, or of the first block if there is none
+    pub fn new(
+        parent: Option<&Block>,
+        timestamp: usize,
+        proposer_address: Account,
+        proposer_hash: String,
+        seed: Seed,
+    ) -> Self {
+        let (id, previous_hash) = match parent {
+            Some(parent) => (parent.id + 1, parent.hash),
+            None => (1, [0u8; 32]),
+        };
+        Self {
+            id,
+            previous_hash,
+            timestamp,
+            proposer_address,
+            proposer_hash,
+            seed,
+            state_root: [0u8; 32],
+            validator_root: [0u8; 32],
+            commitment_root: [0u8; 32],
+            certificate: None,
+            txs: Vec::new(),
+            max_txns: MAX_TXNS_PER_BLOCK,
+        }
+    }
+
+    /// Commit to the account state after the block
+    pub fn with_state_root(mut self, state_root: [u8; 32]) -> Self {
+        self.state_root = state_root;
+        self
+    }
+
+    /// Commit to the validators certifying the block
+    pub fn with_validator_root(mut self, validator_root: [u8; 32]) -> Self {
+        self.validator_root = validator_root;
+        self
+    }
+
+    /// Commit to the IBC packet commitments after the block
+    pub fn with_commitment_root(mut self, commitment_root: [u8; 32]) -> Self {
+        self.commitment_root = commitment_root;
+        self
+    }
+
+    /// Attach the certificate carried by the block
+    pub fn with_certificate(mut self, certificate: Certificate) -> Self {
+        self.certificate = Some(certificate);
+        self
+    }
+
+    /// Include typed transactions, e.g. reaped from a `TxPool`
+    pub fn with_txs(mut self, txs: Vec<SignedTx>) -> Self {
+        self.txs = txs;
+        self
+    }
+
+    /// Include at most `max_txns` transactions
+    pub fn with_max_txns(mut self, max_txns: usize) -> Self {
+        self.max_txns = max_txns;
+        self
+    }
+
+    /// Fill the block up to the maximum number of transactions from
+    /// `mempool`, after the typed ones, dropping duplicates, and seal it
+    pub fn build(self, mempool: &mut Mempool) -> Result<Block, String> {
+        if self.txs.len() > self.max_txns {
+            return Err(format!(
+                "{} transactions exceed the block limit {}",
+                self.txs.len(),
+                self.max_txns
+            ));
+        }
+        let mut seen = HashSet::new();
+        let txn: Vec<Transaction> = mempool
+            .get_transactions(self.max_txns - self.txs.len())
+            .into_iter()
+            .filter(|tx| seen.insert(tx.hash))
+            .collect();
+        let mut block = Block::new(
+            self.id,
+            self.previous_hash,
+            self.timestamp,
+            txn,
+            self.proposer_address,
+            self.proposer_hash,
+            self.seed,
+            self.certificate,
+        )?;
+        block.state_root = self.state_root;
+        block.validator_root = self.validator_root;
+        block.commitment_root = self.commitment_root;
+        block.txs = self.txs;
+        block.seal()?;
+        Ok(block)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transaction::TransactionType;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_block_builder() {
+        let mut wallet = Wallet::new().expect("Failed to create wallet");
+        let account = Account {
+            address: wallet.get_public_key().to_string(),
+        };
+        let mut mempool = Mempool::new();
+        for i in 0..3 {
+            let tx = Transaction::new(
+                &mut wallet,
+                account.clone(),
+                account.clone(),
+                1.0 + i as f64,
+                0,
+                TransactionType::TRANSACTION,
+            )
+            .unwrap();
+            mempool.add_transaction(tx);
+        }
+
+        let genesis = BlockBuilder::new(
+            None,
+            0,
+            account.clone(),
+            String::new(),
+            Seed { seed: [0u8; 32] },
+        )
+        .with_max_txns(0)
+        .build(&mut mempool)
+        .unwrap();
+        assert_eq!(genesis.id, 1);
+        assert_eq!(mempool.transactions.len(), 3);
+
+        let block = BlockBuilder::new(
+            Some(&genesis),
+            1,
+            account,
+            String::new(),
+            Seed { seed: [1u8; 32] },
+        )
+        .with_state_root([2u8; 32])
+        .with_validator_root([3u8; 32])
+        .with_max_txns(2)
+        .build(&mut mempool)
+        .unwrap();
+        assert_eq!(block.id, 2);
+        assert_eq!(block.txn.len(), 2);
+        assert_eq!(mempool.transactions.len(), 1);
+
+        // The header links to the parent and commits to every root
+        let header = block.header();
+        assert_eq!(header.parent_hash, genesis.hash);
+        assert_eq!(header.state_root, [2u8; 32]);
+        assert_eq!(header.validator_root, [3u8; 32]);
+        assert_eq!(header.hash().unwrap(), block.hash);
+        let proof = block.prove_transaction(1).unwrap();
+        assert!(proof.verify(&header.tx_root, &block.txn[1].hash));
+        assert!(!proof.verify(&block.hash, &block.txn[1].hash));
     }
 }
@@ -1,13 +1,18 @@
 use crate::accounts::{Account, State};
 use crate::block::Block;
-use crate::ccok::{Builder as CertBuilder, Certificate, Params, Participant};
+use crate::ccok::{Builder as CertBuilder, Certificate, KeyLayout, Params, Participant, PARAMS_V1};
 #[allow(unused_imports)]
 use crate::config::EPOCH_DURATION;
 use crate::epoch::Epoch;
+use crate::events::{Event, EventBus};
 use crate::hashchain::{verify_hash_chain_index, HashChain};
 use crate::mempool::Mempool;
-use crate::merkle::MerkleTreeBuilder;
+use crate::merkle::{HashAlgorithm, MerkleTreeBuilder};
+use crate::nodeconfig::{proven_weight, ConsensusConfig, DEFAULT_PROVEN_WEIGHT_FRACTION};
 use crate::p2p::BlockSignature;
+use crate::signer::SignatureScheme;
+use crate::stateproof::StateProof;
+use crate::store::{ChainBatch, ChainStore, FileStore};
 use crate::transaction::{Transaction, TransactionType};
 use crate::utils::{get_block_seed, select_block_proposer, Seed};
 use crate::validator::Validator;
@@ -28,6 +33,14 @@ pub struct Blockchain {
     pub hash_chain: HashChain,
     pub pending_signatures: HashMap<usize, Vec<BlockSignature>>,
     pub last_certificate: Option<(usize, Certificate)>,
+    /// State proofs of the intervals certified so far
+    pub state_proofs: Vec<StateProof>,
+    /// Events pushed to WebSocket subscribers
+    pub events: EventBus,
+    /// Fraction of the validator stake block certificates prove
+    pub proven_weight_fraction: f64,
+    /// Store executed blocks and their certificates are persisted to
+    pub store: Option<ChainStore<FileStore>>,
 }
 
 pub struct Buffer {
@@ -62,6 +75,10 @@ impl Blockchain {
             hash_chain: HashChain { hash_chain: vec![] },
             pending_signatures: HashMap::new(),
             last_certificate: None,
+            state_proofs: vec![],
+            events: EventBus::new(),
+            proven_weight_fraction: DEFAULT_PROVEN_WEIGHT_FRACTION,
+            store: None,
         };
         let wallet = &mut blockchain.wallet;
         let account = Account {
@@ -90,6 +107,28 @@ impl Blockchain {
         blockchain
     }
 
+    /// Produce and certify blocks as `consensus` sets out
+    pub fn configure(&mut self, consensus: &ConsensusConfig) {
+        self.epoch.duration = consensus.epoch_length;
+        self.proven_weight_fraction = consensus.proven_weight_fraction;
+    }
+
+    /// Persist blocks and certificates to the chain store at `path`
+    pub fn open_store(&mut self, path: impl AsRef<std::path::Path>) -> Result<(), String> {
+        self.store = Some(ChainStore::new(FileStore::open(path)?));
+        Ok(())
+    }
+
+    // Commit `batch` to the store, if any; a failed write is logged so the
+    // node keeps running on its in-memory chain
+    fn persist(&mut self, batch: ChainBatch) {
+        if let Some(store) = self.store.as_mut() {
+            if let Err(e) = store.commit(batch) {
+                error!("Failed to persist to the chain store: {}", e);
+            }
+        }
+    }
+
     pub fn select_block_proposer(&self, seed: Seed) -> &Account {
         select_block_proposer(seed, &self.validator)
     }
@@ -246,6 +285,7 @@ impl Blockchain {
             proposer_commtiment.hash_chain_index.clone(),
             self.epoch.timestamp,
             block.proposer_hash.clone(),
+            self.epoch.duration,
         ) {
             error!("Hash chain index does not match");
             return false;
@@ -257,7 +297,9 @@ impl Blockchain {
         // if txns, do nothing
         if block.txn.is_empty() {
             info!("Block has no transactions");
-            self.chain.push(block.clone());
+            self.events.publish(Event::new_block(&block));
+            self.persist_block(&block);
+            self.chain.push(block);
             return;
         }
         for txn in block.txn.clone() {
@@ -265,12 +307,31 @@ impl Blockchain {
                 self.handle_transaction(txn);
             }
         }
+        self.events.publish(Event::new_block(&block));
+        self.persist_block(&block);
         self.chain.push(block.clone());
         for txn in block.txn {
             self.mempool.delete_transaction(txn);
         }
     }
 
+    fn persist_block(&mut self, block: &Block) {
+        if self.store.is_none() {
+            return;
+        }
+        let mut batch = ChainBatch::default();
+        match batch.put_block(block) {
+            Ok(()) => self.persist(batch),
+            Err(e) => error!("Failed to persist block {}: {}", block.id, e),
+        }
+    }
+
+    /// Record the state proof of an interval of blocks
+    pub fn add_state_proof(&mut self, proof: StateProof) {
+        self.events.publish(Event::new_state_proof(&proof));
+        self.state_proofs.push(proof);
+    }
+
     #[allow(dead_code)]
     pub fn get_validators(&self) -> &Validator {
         &self.validator
@@ -320,8 +381,19 @@ impl Blockchain {
                 msg: block_hash.as_bytes().to_vec(),
                 proven_weight: 0,
                 security_param: 128,
+                scheme: Some(SignatureScheme::Dilithium2.id()),
+                round: None,
+                hash: HashAlgorithm::Keccak256,
+                // Validators sign the raw block hash
+                version: PARAMS_V1,
+                compression_level: 0,
+                chain_id: None,
+                purpose: None,
+                weight_precision: 0,
+                signature_mode: None,
             };
-            // Compute proven_weight while building participants.
+            // Sum the stake while building participants; certificates prove
+            // the configured fraction of it
             let participants: Vec<Participant> = self
                 .validator
                 .state
@@ -334,9 +406,14 @@ impl Blockchain {
                     Participant {
                         public_key: a.address.clone(),
                         weight,
+                        scheme: SignatureScheme::Dilithium2.id(),
+                        key_commitment: None,
+                        vrf_key: None,
+                        key_layout: KeyLayout::InLeaf,
                     }
                 })
                 .collect();
+            params.proven_weight = proven_weight(params.proven_weight, self.proven_weight_fraction);
 
             let collected_sigs = self
                 .pending_signatures
@@ -347,7 +424,14 @@ impl Blockchain {
             tree.build(&participants)
                 .expect("Failed to build Merkle tree");
             let party_tree_root = tree.root();
-            let mut builder = CertBuilder::new(params, participants.clone(), party_tree_root);
+            let mut builder = match CertBuilder::new(params, participants.clone(), party_tree_root)
+            {
+                Ok(builder) => builder,
+                Err(e) => {
+                    error!("Invalid certificate params: {}", e);
+                    return;
+                }
+            };
             // For each collected block signature, add the signature to the builder.
             for sig in collected_sigs {
                 if let Some(idx) = participants
@@ -361,6 +445,7 @@ impl Blockchain {
                     let _ = builder.add_signature(idx, fixed_sig);
                 }
             }
+            self.events.publish(Event::signature_progress(&builder));
             let certificate = match builder.build() {
                 Ok(cert) => cert,
                 Err(e) => {
@@ -374,6 +459,13 @@ impl Blockchain {
                 block_id,
                 certificate.proof_size()
             );
+            if self.store.is_some() {
+                let mut batch = ChainBatch::default();
+                match batch.put_certificate(block_id as u64, &certificate) {
+                    Ok(()) => self.persist(batch),
+                    Err(e) => error!("Failed to persist certificate {}: {}", block_id, e),
+                }
+            }
             self.last_certificate = Some((block_id, certificate));
         }
     }
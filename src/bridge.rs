@@ -0,0 +1,701 @@
+//! Two-way asset bridge. Assets locked in the main chain vault are minted on
+//! the sidechain as `Deposit`s; assets burnt on the sidechain leave as
+//! `Withdrawal`s, committed in batches whose root the validators certify. The
+//! vault releases a withdrawal only against a certificate over its batch,
+//! under params it derives itself so it proves two thirds of the epoch's
+//! weight, and a proof that the withdrawal is part of it, and at most once. Released
+//! withdrawals are kept in a sparse Merkle tree, so the vault can prove that a
+//! withdrawal was or wasn't released yet. A governance pause the validators
+//! certified, checked by a light client, stops releases until a certified
+//! resume.
+//!
+//! In an emergency, or for an upgrade, the validators can trip the
+//! `CircuitBreaker` with a `BreakerMessage` certified by three quarters of
+//! their weight, more than any other certificate needs. Until an equally
+//! certified resume, light clients refuse withdrawals and relayers hold back
+//! the state proofs withdrawals are released against.
+use crate::accounts::Account;
+use crate::ccok::{Certificate, Params, Purpose, Verifier};
+use crate::error::CcokError;
+use crate::governance::{GovernanceCert, ProposalAction};
+use crate::handoff::Epoch;
+use crate::lightclient::Client;
+use crate::merkle::{HashAlgorithm, HashDomain, Hashing};
+use crate::messages::{MessageBatch, MessageProof};
+use crate::smt::{SmtAbsenceProof, SmtProof, SparseMerkleTree};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+
+/// Assets locked in the main chain vault, to be minted on the sidechain
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Deposit {
+    /// Sequence number of the deposit in the vault
+    pub nonce: u64,
+    /// Sidechain account credited with the deposit
+    pub recipient: Account,
+    /// Amount in base units
+    pub amount: u64,
+}
+
+/// Assets burnt on the sidechain, to be released by the main chain vault
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Withdrawal {
+    /// Sequence number of the withdrawal on the sidechain
+    pub nonce: u64,
+    /// Sidechain account the assets were burnt from
+    pub sender: Account,
+    /// Main chain address receiving the assets
+    pub recipient: String,
+    /// Amount in base units
+    pub amount: u64,
+}
+
+/// Proof that a withdrawal is part of a certified batch
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct WithdrawalProof {
+    /// The withdrawal
+    pub withdrawal: Withdrawal,
+    /// Inclusion of the encoded withdrawal in the batch root
+    pub inclusion: MessageProof,
+}
+
+impl WithdrawalProof {
+    /// Check the withdrawal against the batch root signed under `params`
+    pub fn verify(&self, params: &Params) -> Result<(), String> {
+        if bincode::serialize(&self.withdrawal).map_err(|e| e.to_string())?
+            != self.inclusion.message
+        {
+            return Err(format!(
+                "Proof is not for withdrawal {}",
+                self.withdrawal.nonce
+            ));
+        }
+        Ok(self.inclusion.verify(params)?)
+    }
+}
+
+/// Params a withdrawal batch of `epoch` is certified under: `template` with
+/// two thirds of the epoch's weight, for the withdrawal purpose if the
+/// template is bound to a chain. The batch root becomes the message.
+pub fn withdrawal_params(template: &Params, epoch: &Epoch) -> Params {
+    let mut params = template.clone();
+    params.proven_weight = epoch.proven_weight();
+    if params.chain_id.is_some() {
+        params.purpose = Some(Purpose::Withdrawal);
+    }
+    params
+}
+
+/// Batch of withdrawals certified together
+pub struct WithdrawalBatch {
+    withdrawals: Vec<Withdrawal>,
+    messages: MessageBatch,
+}
+
+impl WithdrawalBatch {
+    /// Commit to `withdrawals` under `params`, whose message becomes the batch root
+    pub fn new(params: Params, withdrawals: Vec<Withdrawal>) -> Result<Self, String> {
+        let encoded = withdrawals
+            .iter()
+            .map(bincode::serialize)
+            .collect::<Result<Vec<_>, _>>()
+            .map_err(|e| format!("Serialization error: {}", e))?;
+        Ok(Self {
+            withdrawals,
+            messages: MessageBatch::new(params, encoded)?,
+        })
+    }
+
+    /// Params the validators certify the batch under
+    pub fn params(&self) -> &Params {
+        self.messages.params()
+    }
+
+    /// Root of the batch, the message of its params
+    pub fn root(&self) -> &[u8] {
+        self.messages.root()
+    }
+
+    /// Withdrawals of the batch, in order
+    pub fn withdrawals(&self) -> &[Withdrawal] {
+        &self.withdrawals
+    }
+
+    /// Prove that the withdrawal at `index` is part of the batch
+    pub fn prove(&self, index: usize) -> Result<WithdrawalProof, String> {
+        let inclusion = self.messages.prove(index)?;
+        Ok(WithdrawalProof {
+            withdrawal: self.withdrawals[index].clone(),
+            inclusion,
+        })
+    }
+}
+
+/// Sidechain side of the bridge: mints deposits and queues withdrawals
+#[derive(Debug, Default)]
+pub struct BridgeLedger {
+    /// Amount minted from deposits and not withdrawn since
+    pub supply: u64,
+    /// Nonces of the deposits already minted
+    pub minted: HashSet<u64>,
+    /// Withdrawals not yet sealed into a batch
+    pub pending: Vec<Withdrawal>,
+    /// Nonce of the next withdrawal
+    pub next_withdrawal: u64,
+}
+
+impl BridgeLedger {
+    /// Ledger without bridged assets
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Mint a deposit, once
+    pub fn mint(&mut self, deposit: &Deposit) -> Result<(), String> {
+        if self.minted.contains(&deposit.nonce) {
+            return Err(format!("Deposit {} already minted", deposit.nonce));
+        }
+        self.supply = self
+            .supply
+            .checked_add(deposit.amount)
+            .ok_or_else(|| "Bridged supply overflow".to_string())?;
+        self.minted.insert(deposit.nonce);
+        Ok(())
+    }
+
+    /// Burn `amount` from `sender` and queue its withdrawal to `recipient`
+    pub fn withdraw(
+        &mut self,
+        sender: Account,
+        recipient: String,
+        amount: u64,
+    ) -> Result<Withdrawal, String> {
+        if amount > self.supply {
+            return Err(format!(
+                "Withdrawal of {} exceeds the bridged supply {}",
+                amount, self.supply
+            ));
+        }
+        self.supply -= amount;
+        let withdrawal = Withdrawal {
+            nonce: self.next_withdrawal,
+            sender,
+            recipient,
+            amount,
+        };
+        self.next_withdrawal += 1;
+        self.pending.push(withdrawal.clone());
+        Ok(withdrawal)
+    }
+
+    /// Seal the pending withdrawals into a batch for the validators to certify
+    pub fn seal(&mut self, params: Params) -> Result<WithdrawalBatch, String> {
+        if self.pending.is_empty() {
+            return Err("No pending withdrawals".to_string());
+        }
+        let batch = WithdrawalBatch::new(params, self.pending.clone())?;
+        self.pending.clear();
+        Ok(batch)
+    }
+}
+
+/// Key of the withdrawal with `nonce` in the released set
+pub fn withdrawal_key(hashing: Hashing, nonce: u64) -> [u8; 32] {
+    hashing.hash(HashDomain::Leaf, &nonce.to_be_bytes())
+}
+
+/// Main chain side of the bridge: locks deposits and releases certified withdrawals
+#[derive(Debug)]
+pub struct Vault {
+    /// Validators whose certificates release withdrawals
+    pub epoch: Epoch,
+    /// Params withdrawal batches are certified under, but for the message and
+    /// the proven weight
+    pub template: Params,
+    /// Amount locked and not released since
+    pub locked: u64,
+    /// Nonce of the next deposit
+    pub next_deposit: u64,
+    /// Withdrawals already released, keyed by `withdrawal_key`
+    pub released: SparseMerkleTree,
+    /// Whether governance paused releases
+    pub paused: bool,
+    /// Id the next governance proposal enacted must have at least
+    pub next_proposal: u64,
+}
+
+impl Vault {
+    /// Vault releasing withdrawals certified by the validators of `epoch`
+    /// under `template`
+    pub fn new(epoch: Epoch, template: Params) -> Self {
+        Self {
+            epoch,
+            template,
+            locked: 0,
+            next_deposit: 0,
+            released: SparseMerkleTree::new(Hashing::new(HashAlgorithm::Keccak256, true)),
+            paused: false,
+            next_proposal: 0,
+        }
+    }
+
+    /// Pause or resume releases as the governance proposal of `cert` says,
+    /// once `client` verified it
+    pub fn enact(&mut self, client: &Client, cert: &GovernanceCert) -> Result<(), String> {
+        let proposal = &cert.proposal;
+        let ProposalAction::PauseBridge(paused) = proposal.action else {
+            return Err(format!("Proposal {} is not a bridge pause", proposal.id));
+        };
+        if proposal.id < self.next_proposal {
+            return Err(format!("Proposal {} already enacted", proposal.id));
+        }
+        client.verify_governance(cert)?;
+        self.paused = paused;
+        self.next_proposal = proposal.id + 1;
+        Ok(())
+    }
+
+    /// Lock `amount` for `recipient` on the sidechain
+    pub fn lock(&mut self, recipient: Account, amount: u64) -> Result<Deposit, String> {
+        self.locked = self
+            .locked
+            .checked_add(amount)
+            .ok_or_else(|| "Locked amount overflow".to_string())?;
+        let deposit = Deposit {
+            nonce: self.next_deposit,
+            recipient,
+            amount,
+        };
+        self.next_deposit += 1;
+        Ok(deposit)
+    }
+
+    /// Release a withdrawal proven part of the batch of `batch_root`
+    /// certified by `cert`. The params come from `withdrawal_params`, so a
+    /// certificate under a lower threshold doesn't verify.
+    pub fn release(
+        &mut self,
+        cert: &Certificate,
+        batch_root: &[u8],
+        proof: &WithdrawalProof,
+    ) -> Result<Withdrawal, String> {
+        if self.paused {
+            return Err("Bridge releases are paused".to_string());
+        }
+        let withdrawal = &proof.withdrawal;
+        if self.is_released(withdrawal.nonce) {
+            return Err(format!("Withdrawal {} already released", withdrawal.nonce));
+        }
+        let mut params = withdrawal_params(&self.template, &self.epoch);
+        params.msg = batch_root.to_vec();
+        let verifier = Verifier::new(self.epoch.voters_commitment.clone());
+        if !verifier.verify(cert, &params)? {
+            return Err("Invalid withdrawal certificate".to_string());
+        }
+        proof.verify(&params)?;
+        if withdrawal.amount > self.locked {
+            return Err(format!(
+                "Withdrawal of {} exceeds the locked amount {}",
+                withdrawal.amount, self.locked
+            ));
+        }
+        let value = bincode::serialize(withdrawal).map_err(|e| e.to_string())?;
+        self.locked -= withdrawal.amount;
+        self.released.insert(self.key(withdrawal.nonce), value);
+        Ok(withdrawal.clone())
+    }
+
+    fn key(&self, nonce: u64) -> [u8; 32] {
+        withdrawal_key(self.released.hashing(), nonce)
+    }
+
+    /// Whether the withdrawal with `nonce` was released
+    pub fn is_released(&self, nonce: u64) -> bool {
+        self.released.get(&self.key(nonce)).is_some()
+    }
+
+    /// Root of the released set
+    pub fn released_root(&self) -> [u8; 32] {
+        self.released.root()
+    }
+
+    /// Prove that the withdrawal with `nonce` was released, under the encoded
+    /// withdrawal
+    pub fn prove_released(&self, nonce: u64) -> Result<SmtProof, String> {
+        Ok(self.released.prove(&self.key(nonce))?)
+    }
+
+    /// Prove that the withdrawal with `nonce` wasn't released yet
+    pub fn prove_unreleased(&self, nonce: u64) -> Result<SmtAbsenceProof, String> {
+        Ok(self.released.prove_absence(&self.key(nonce))?)
+    }
+}
+
+/// Why the bridge is halted
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum HaltReason {
+    Emergency,
+    Upgrade,
+}
+
+/// What a breaker message does
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum BreakerAction {
+    /// Stop accepting withdrawals
+    Halt(HaltReason),
+    /// Accept withdrawals again
+    Resume,
+}
+
+/// Message tripping or resetting the circuit breaker
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BreakerMessage {
+    /// Sequence number, increasing with every message
+    pub sequence: u64,
+    pub action: BreakerAction,
+}
+
+/// Weight a breaker certificate of `epoch` must prove: three quarters of the
+/// total
+pub fn breaker_weight(epoch: &Epoch) -> u64 {
+    (epoch.total_weight as u128 * 3 / 4) as u64
+}
+
+impl BreakerMessage {
+    /// Certificate params of the message: `template` with the message digest
+    /// as message and the breaker weight of `epoch`, for the breaker purpose
+    /// if the template is bound to a chain
+    pub fn params(&self, template: &Params, epoch: &Epoch) -> Result<Params, CcokError> {
+        let bytes = bincode::serialize(self)?;
+        let mut params = template.clone();
+        params.msg = template
+            .hashing()
+            .hash(HashDomain::Message, &bytes)
+            .to_vec();
+        params.proven_weight = breaker_weight(epoch);
+        if params.chain_id.is_some() {
+            params.purpose = Some(Purpose::Breaker);
+        }
+        Ok(params)
+    }
+}
+
+/// Certificate of the validators of an epoch over a breaker message
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BreakerCert {
+    pub message: BreakerMessage,
+    pub certificate: Certificate,
+}
+
+impl BreakerCert {
+    /// Check that the validators of `trusted` certified the message
+    pub fn verify(&self, trusted: &Epoch, template: &Params) -> Result<(), CcokError> {
+        let params = self.message.params(template, trusted)?;
+        if !Verifier::new(trusted.voters_commitment.clone()).verify(&self.certificate, &params)? {
+            return Err(CcokError::InvalidGovernance(format!(
+                "certificate of breaker message {} does not verify for epoch {}",
+                self.message.sequence, trusted.number
+            )));
+        }
+        Ok(())
+    }
+}
+
+/// State of the circuit breaker
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum BridgeState {
+    /// Withdrawals are accepted
+    #[default]
+    Running,
+    /// Withdrawals are refused since the halt with `sequence`
+    Halted { sequence: u64, reason: HaltReason },
+}
+
+/// Halts and resumes of the bridge: a halt moves a running bridge to halted,
+/// a resume moves it back, every message once and in sequence
+#[derive(Debug, Clone, Default)]
+pub struct CircuitBreaker {
+    state: BridgeState,
+    /// Sequence number the next message must have at least
+    next_sequence: u64,
+}
+
+impl CircuitBreaker {
+    /// Breaker of a running bridge
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn state(&self) -> BridgeState {
+        self.state
+    }
+
+    pub fn is_halted(&self) -> bool {
+        self.state != BridgeState::Running
+    }
+
+    /// Move on a verified message, returning the new state
+    pub fn apply(&mut self, message: &BreakerMessage) -> Result<BridgeState, String> {
+        if message.sequence < self.next_sequence {
+            return Err(format!(
+                "Breaker message {} already applied or superseded",
+                message.sequence
+            ));
+        }
+        self.state = match (self.state, message.action) {
+            (BridgeState::Running, BreakerAction::Halt(reason)) => BridgeState::Halted {
+                sequence: message.sequence,
+                reason,
+            },
+            (BridgeState::Halted { .. }, BreakerAction::Resume) => BridgeState::Running,
+            (state, action) => {
+                return Err(format!(
+                    "Breaker message {} can't {:?} a bridge {:?}",
+                    message.sequence, action, state
+                ))
+            }
+        };
+        self.next_sequence = message.sequence + 1;
+        Ok(self.state)
+    }
+
+    /// Fail while the bridge is halted
+    pub fn check(&self) -> Result<(), String> {
+        match self.state {
+            BridgeState::Running => Ok(()),
+            BridgeState::Halted { sequence, reason } => Err(format!(
+                "Bridge halted by breaker message {} ({:?})",
+                sequence, reason
+            )),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant};
+    use crate::lightclient::Client;
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::stateproof::voters_commitment;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_deposit_and_withdraw() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let validators: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let template = Params {
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(template.hashing());
+        party_tree
+            .build(&validators)
+            .expect("Failed to build party tree");
+        let alice = Account {
+            address: "alice".to_string(),
+        };
+
+        let epoch = Epoch {
+            number: 0,
+            voters_commitment: party_tree.root(),
+            total_weight: 30,
+        };
+
+        // Lock on the main chain, mint once on the sidechain
+        let mut vault = Vault::new(epoch.clone(), template.clone());
+        let mut ledger = BridgeLedger::new();
+        let deposit = vault.lock(alice.clone(), 100).unwrap();
+        ledger.mint(&deposit).unwrap();
+        assert!(ledger.mint(&deposit).is_err());
+        assert!(ledger
+            .withdraw(alice.clone(), "0xbob".to_string(), 101)
+            .is_err());
+
+        // Burn on the sidechain and certify the batch
+        ledger
+            .withdraw(alice.clone(), "0xbob".to_string(), 30)
+            .unwrap();
+        ledger
+            .withdraw(alice.clone(), "0xcarol".to_string(), 20)
+            .unwrap();
+        let batch = ledger.seal(withdrawal_params(&template, &epoch)).unwrap();
+        let root = batch.root().to_vec();
+        let certify = |params: &Params, signers: usize| {
+            let mut builder =
+                Builder::new(params.clone(), validators.clone(), party_tree.root()).unwrap();
+            for (i, wallet) in wallets.iter().enumerate().take(signers) {
+                builder
+                    .add_signature(i, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+            }
+            builder.build().unwrap()
+        };
+        let cert = certify(batch.params(), 3);
+
+        // A certificate of a single validator under a low threshold is
+        // refused, whatever params it was built under
+        let mut low = batch.params().clone();
+        low.proven_weight = 10;
+        let weak = certify(&low, 1);
+        assert!(Verifier::new(party_tree.root())
+            .verify(&weak, &low)
+            .unwrap());
+        assert!(vault
+            .release(&weak, &root, &batch.prove(1).unwrap())
+            .is_err());
+        assert!(!vault.is_released(1));
+
+        // The vault releases each certified withdrawal once
+        let proof = batch.prove(1).unwrap();
+        assert_eq!(
+            vault.release(&cert, &root, &proof).unwrap().recipient,
+            "0xcarol"
+        );
+        assert!(vault.release(&cert, &root, &proof).is_err());
+        assert_eq!(vault.locked, 80);
+        let hashing = vault.released.hashing();
+        let released = vault.released_root();
+        assert!(vault.prove_released(1).unwrap().verify(
+            hashing,
+            &released,
+            &withdrawal_key(hashing, 1),
+            &proof.inclusion.message
+        ));
+        assert!(vault.prove_unreleased(0).unwrap().verify(
+            hashing,
+            &released,
+            &withdrawal_key(hashing, 0)
+        ));
+
+        // Withdrawals changed after certification are rejected
+        let mut inflated = batch.prove(0).unwrap();
+        inflated.withdrawal.amount = 80;
+        assert!(vault.release(&cert, &root, &inflated).is_err());
+        let mut forged = batch.prove(0).unwrap();
+        forged.withdrawal.amount = 80;
+        forged.inclusion.message = bincode::serialize(&forged.withdrawal).unwrap();
+        assert!(vault.release(&cert, &root, &forged).is_err());
+        vault
+            .release(&cert, &root, &batch.prove(0).unwrap())
+            .unwrap();
+        assert_eq!(vault.locked, 50);
+    }
+
+    #[test]
+    fn test_circuit_breaker() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let validators: Vec<Participant> = wallets
+            .iter()
+            .zip([9, 9, 9, 9, 4])
+            .map(|(w, weight)| Participant::from_signer(w, weight))
+            .collect();
+        let template = Params {
+            proven_weight: 26,
+            ..Default::default()
+        };
+        let epoch = Epoch {
+            number: 0,
+            voters_commitment: voters_commitment(template.hashing(), &validators).unwrap(),
+            total_weight: 40,
+        };
+        // Certificate of the first `signers` validators over `params`
+        let sign = |params: &Params, signers: usize| {
+            let mut builder = Builder::new(
+                params.clone(),
+                validators.clone(),
+                epoch.voters_commitment.clone(),
+            )
+            .unwrap();
+            for (i, wallet) in wallets.iter().take(signers).enumerate() {
+                builder
+                    .add_signature(i, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+            }
+            builder.build().unwrap()
+        };
+        let certify = |sequence: u64, action: BreakerAction| {
+            let message = BreakerMessage { sequence, action };
+            let certificate = sign(&message.params(&template, &epoch).unwrap(), 4);
+            BreakerCert {
+                message,
+                certificate,
+            }
+        };
+
+        // A certified batch of withdrawals, accepted while the bridge runs
+        let mut ledger = BridgeLedger::new();
+        ledger
+            .mint(&Deposit {
+                nonce: 0,
+                recipient: Account {
+                    address: "alice".to_string(),
+                },
+                amount: 10,
+            })
+            .unwrap();
+        ledger
+            .withdraw(
+                Account {
+                    address: "alice".to_string(),
+                },
+                "0xbob".to_string(),
+                10,
+            )
+            .unwrap();
+        let batch = ledger.seal(template.clone()).unwrap();
+        let params = batch.params().clone();
+        let cert = sign(&params, 5);
+        let proof = batch.prove(0).unwrap();
+        let mut client = Client::new(template.clone(), 4, epoch.voters_commitment.clone())
+            .with_epoch(epoch.clone())
+            .unwrap();
+        client.verify_withdrawal(&cert, &params, &proof).unwrap();
+
+        // Params proving less than two thirds of the epoch's weight are refused,
+        // though their certificate verifies
+        let low = Params {
+            proven_weight: 20,
+            ..params.clone()
+        };
+        let low_cert = sign(&low, 3);
+        assert!(Verifier::new(epoch.voters_commitment.clone())
+            .verify(&low_cert, &low)
+            .unwrap());
+        let err = client
+            .verify_withdrawal(&low_cert, &low, &proof)
+            .unwrap_err();
+        assert!(err.contains("needs 26"));
+
+        // A halt needs three quarters of the weight, two thirds won't do
+        let halt = certify(0, BreakerAction::Halt(HaltReason::Emergency));
+        let mut weak = halt.clone();
+        let mut two_thirds = halt.message.params(&template, &epoch).unwrap();
+        two_thirds.proven_weight = epoch.proven_weight();
+        weak.certificate = sign(&two_thirds, 3);
+        assert!(client.apply_breaker(&weak).is_err());
+        assert_eq!(
+            client.apply_breaker(&halt).unwrap(),
+            BridgeState::Halted {
+                sequence: 0,
+                reason: HaltReason::Emergency
+            }
+        );
+        assert!(client.verify_withdrawal(&cert, &params, &proof).is_err());
+
+        // Each message applies once, and only a resume lifts a halt
+        assert!(client.apply_breaker(&halt).is_err());
+        let upgrade = certify(1, BreakerAction::Halt(HaltReason::Upgrade));
+        assert!(client.apply_breaker(&upgrade).is_err());
+        let resume = certify(2, BreakerAction::Resume);
+        assert_eq!(client.apply_breaker(&resume).unwrap(), BridgeState::Running);
+        client.verify_withdrawal(&cert, &params, &proof).unwrap();
+    }
+}
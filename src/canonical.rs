@@ -0,0 +1,602 @@
+use serde::de::{self, DeserializeOwned, IntoDeserializer, Visitor};
+use serde::ser::{self, Serialize};
+use std::fmt;
+
+/// Format-independent data model of the canonical encodings. Floats are not
+/// representable, and map entries are kept sorted by key so that every value
+/// has exactly one encoding.
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Value {
+    Nil,
+    Bool(bool),
+    /// Non-negative integers
+    UInt(u64),
+    /// Negative integers
+    Int(i64),
+    Str(String),
+    Bin(Vec<u8>),
+    Array(Vec<Value>),
+    /// Entries sorted by key, without duplicates
+    Map(Vec<(Value, Value)>),
+}
+
+impl Value {
+    /// Integer value, normalized so that non-negative integers are `UInt`
+    pub fn int(value: i64) -> Self {
+        if value >= 0 {
+            Value::UInt(value as u64)
+        } else {
+            Value::Int(value)
+        }
+    }
+
+    /// Map from entries in any order; fails on duplicate keys
+    pub fn map(mut entries: Vec<(Value, Value)>) -> Result<Self, String> {
+        entries.sort_by(|a, b| a.0.cmp(&b.0));
+        if entries.windows(2).any(|pair| pair[0].0 == pair[1].0) {
+            return Err("Duplicate map key".to_string());
+        }
+        Ok(Value::Map(entries))
+    }
+}
+
+/// Convert a serializable item into the canonical data model
+pub fn to_value<T: Serialize + ?Sized>(item: &T) -> Result<Value, String> {
+    item.serialize(ValueSerializer).map_err(|e| e.0)
+}
+
+/// Convert a value of the canonical data model back into an item
+pub fn from_value<T: DeserializeOwned>(value: Value) -> Result<T, String> {
+    T::deserialize(value).map_err(|e| e.0)
+}
+
+/// Convert a value back into an item, failing unless the value is exactly the
+/// item's canonical form (no unknown, missing or defaulted fields)
+pub fn from_value_exact<T: Serialize + DeserializeOwned>(value: Value) -> Result<T, String> {
+    let item: T = from_value(value.clone())?;
+    if to_value(&item)? != value {
+        return Err("Value is not the canonical form of the item".to_string());
+    }
+    Ok(item)
+}
+
+#[derive(Debug)]
+pub struct Error(String);
+
+impl fmt::Display for Error {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.0)
+    }
+}
+
+impl std::error::Error for Error {}
+
+impl ser::Error for Error {
+    fn custom<T: fmt::Display>(msg: T) -> Self {
+        Error(msg.to_string())
+    }
+}
+
+impl de::Error for Error {
+    fn custom<T: fmt::Display>(msg: T) -> Self {
+        Error(msg.to_string())
+    }
+}
+
+struct ValueSerializer;
+
+// Enum variants other than unit variants are single-entry maps keyed by the
+// variant name, as in serde's externally tagged representation
+fn variant(name: &str, value: Value) -> Value {
+    Value::Map(vec![(Value::Str(name.to_string()), value)])
+}
+
+fn unsigned(value: u128) -> Result<Value, Error> {
+    u64::try_from(value)
+        .map(Value::UInt)
+        .map_err(|_| Error(format!("Integer {} out of range", value)))
+}
+
+impl ser::Serializer for ValueSerializer {
+    type Ok = Value;
+    type Error = Error;
+    type SerializeSeq = SeqSerializer;
+    type SerializeTuple = SeqSerializer;
+    type SerializeTupleStruct = SeqSerializer;
+    type SerializeTupleVariant = SeqSerializer;
+    type SerializeMap = MapSerializer;
+    type SerializeStruct = MapSerializer;
+    type SerializeStructVariant = MapSerializer;
+
+    fn serialize_bool(self, v: bool) -> Result<Value, Error> {
+        Ok(Value::Bool(v))
+    }
+
+    fn serialize_i8(self, v: i8) -> Result<Value, Error> {
+        Ok(Value::int(v as i64))
+    }
+
+    fn serialize_i16(self, v: i16) -> Result<Value, Error> {
+        Ok(Value::int(v as i64))
+    }
+
+    fn serialize_i32(self, v: i32) -> Result<Value, Error> {
+        Ok(Value::int(v as i64))
+    }
+
+    fn serialize_i64(self, v: i64) -> Result<Value, Error> {
+        Ok(Value::int(v))
+    }
+
+    fn serialize_i128(self, v: i128) -> Result<Value, Error> {
+        i64::try_from(v)
+            .map(Value::int)
+            .or_else(|_| unsigned(v as u128))
+            .map_err(|_| Error(format!("Integer {} out of range", v)))
+    }
+
+    fn serialize_u8(self, v: u8) -> Result<Value, Error> {
+        Ok(Value::UInt(v as u64))
+    }
+
+    fn serialize_u16(self, v: u16) -> Result<Value, Error> {
+        Ok(Value::UInt(v as u64))
+    }
+
+    fn serialize_u32(self, v: u32) -> Result<Value, Error> {
+        Ok(Value::UInt(v as u64))
+    }
+
+    fn serialize_u64(self, v: u64) -> Result<Value, Error> {
+        Ok(Value::UInt(v))
+    }
+
+    fn serialize_u128(self, v: u128) -> Result<Value, Error> {
+        unsigned(v)
+    }
+
+    fn serialize_f32(self, _v: f32) -> Result<Value, Error> {
+        Err(Error("Floats have no canonical encoding".to_string()))
+    }
+
+    fn serialize_f64(self, _v: f64) -> Result<Value, Error> {
+        Err(Error("Floats have no canonical encoding".to_string()))
+    }
+
+    fn serialize_char(self, v: char) -> Result<Value, Error> {
+        Ok(Value::Str(v.to_string()))
+    }
+
+    fn serialize_str(self, v: &str) -> Result<Value, Error> {
+        Ok(Value::Str(v.to_string()))
+    }
+
+    fn serialize_bytes(self, v: &[u8]) -> Result<Value, Error> {
+        Ok(Value::Bin(v.to_vec()))
+    }
+
+    fn serialize_none(self) -> Result<Value, Error> {
+        Ok(Value::Nil)
+    }
+
+    fn serialize_some<T: Serialize + ?Sized>(self, value: &T) -> Result<Value, Error> {
+        value.serialize(self)
+    }
+
+    fn serialize_unit(self) -> Result<Value, Error> {
+        Ok(Value::Nil)
+    }
+
+    fn serialize_unit_struct(self, _name: &'static str) -> Result<Value, Error> {
+        Ok(Value::Nil)
+    }
+
+    fn serialize_unit_variant(
+        self,
+        _name: &'static str,
+        _index: u32,
+        variant: &'static str,
+    ) -> Result<Value, Error> {
+        Ok(Value::Str(variant.to_string()))
+    }
+
+    fn serialize_newtype_struct<T: Serialize + ?Sized>(
+        self,
+        _name: &'static str,
+        value: &T,
+    ) -> Result<Value, Error> {
+        value.serialize(self)
+    }
+
+    fn serialize_newtype_variant<T: Serialize + ?Sized>(
+        self,
+        _name: &'static str,
+        _index: u32,
+        name: &'static str,
+        value: &T,
+    ) -> Result<Value, Error> {
+        Ok(variant(name, value.serialize(self)?))
+    }
+
+    fn serialize_seq(self, len: Option<usize>) -> Result<SeqSerializer, Error> {
+        Ok(SeqSerializer {
+            variant: None,
+            items: Vec::with_capacity(len.unwrap_or(0)),
+        })
+    }
+
+    fn serialize_tuple(self, len: usize) -> Result<SeqSerializer, Error> {
+        self.serialize_seq(Some(len))
+    }
+
+    fn serialize_tuple_struct(
+        self,
+        _name: &'static str,
+        len: usize,
+    ) -> Result<SeqSerializer, Error> {
+        self.serialize_seq(Some(len))
+    }
+
+    fn serialize_tuple_variant(
+        self,
+        _name: &'static str,
+        _index: u32,
+        name: &'static str,
+        len: usize,
+    ) -> Result<SeqSerializer, Error> {
+        Ok(SeqSerializer {
+            variant: Some(name),
+            items: Vec::with_capacity(len),
+        })
+    }
+
+    fn serialize_map(self, len: Option<usize>) -> Result<MapSerializer, Error> {
+        Ok(MapSerializer {
+            variant: None,
+            entries: Vec::with_capacity(len.unwrap_or(0)),
+            key: None,
+        })
+    }
+
+    fn serialize_struct(self, _name: &'static str, len: usize) -> Result<MapSerializer, Error> {
+        self.serialize_map(Some(len))
+    }
+
+    fn serialize_struct_variant(
+        self,
+        _name: &'static str,
+        _index: u32,
+        name: &'static str,
+        len: usize,
+    ) -> Result<MapSerializer, Error> {
+        Ok(MapSerializer {
+            variant: Some(name),
+            entries: Vec::with_capacity(len),
+            key: None,
+        })
+    }
+}
+
+struct SeqSerializer {
+    variant: Option<&'static str>,
+    items: Vec<Value>,
+}
+
+impl SeqSerializer {
+    fn push<T: Serialize + ?Sized>(&mut self, value: &T) -> Result<(), Error> {
+        self.items.push(value.serialize(ValueSerializer)?);
+        Ok(())
+    }
+
+    fn finish(self) -> Result<Value, Error> {
+        let array = Value::Array(self.items);
+        Ok(match self.variant {
+            Some(name) => variant(name, array),
+            None => array,
+        })
+    }
+}
+
+impl ser::SerializeSeq for SeqSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_element<T: Serialize + ?Sized>(&mut self, value: &T) -> Result<(), Error> {
+        self.push(value)
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+impl ser::SerializeTuple for SeqSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_element<T: Serialize + ?Sized>(&mut self, value: &T) -> Result<(), Error> {
+        self.push(value)
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+impl ser::SerializeTupleStruct for SeqSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_field<T: Serialize + ?Sized>(&mut self, value: &T) -> Result<(), Error> {
+        self.push(value)
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+impl ser::SerializeTupleVariant for SeqSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_field<T: Serialize + ?Sized>(&mut self, value: &T) -> Result<(), Error> {
+        self.push(value)
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+struct MapSerializer {
+    variant: Option<&'static str>,
+    entries: Vec<(Value, Value)>,
+    key: Option<Value>,
+}
+
+impl MapSerializer {
+    fn finish(self) -> Result<Value, Error> {
+        let map = Value::map(self.entries).map_err(Error)?;
+        Ok(match self.variant {
+            Some(name) => variant(name, map),
+            None => map,
+        })
+    }
+}
+
+impl ser::SerializeMap for MapSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_key<T: Serialize + ?Sized>(&mut self, key: &T) -> Result<(), Error> {
+        self.key = Some(key.serialize(ValueSerializer)?);
+        Ok(())
+    }
+
+    fn serialize_value<T: Serialize + ?Sized>(&mut self, value: &T) -> Result<(), Error> {
+        let key = self
+            .key
+            .take()
+            .ok_or_else(|| Error("Map value without a key".to_string()))?;
+        self.entries.push((key, value.serialize(ValueSerializer)?));
+        Ok(())
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+impl ser::SerializeStruct for MapSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_field<T: Serialize + ?Sized>(
+        &mut self,
+        key: &'static str,
+        value: &T,
+    ) -> Result<(), Error> {
+        self.entries.push((
+            Value::Str(key.to_string()),
+            value.serialize(ValueSerializer)?,
+        ));
+        Ok(())
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+impl ser::SerializeStructVariant for MapSerializer {
+    type Ok = Value;
+    type Error = Error;
+
+    fn serialize_field<T: Serialize + ?Sized>(
+        &mut self,
+        key: &'static str,
+        value: &T,
+    ) -> Result<(), Error> {
+        ser::SerializeStruct::serialize_field(self, key, value)
+    }
+
+    fn end(self) -> Result<Value, Error> {
+        self.finish()
+    }
+}
+
+impl<'de> IntoDeserializer<'de, Error> for Value {
+    type Deserializer = Value;
+
+    fn into_deserializer(self) -> Value {
+        self
+    }
+}
+
+impl<'de> de::Deserializer<'de> for Value {
+    type Error = Error;
+
+    fn deserialize_any<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        match self {
+            Value::Nil => visitor.visit_unit(),
+            Value::Bool(v) => visitor.visit_bool(v),
+            Value::UInt(v) => visitor.visit_u64(v),
+            Value::Int(v) => visitor.visit_i64(v),
+            Value::Str(v) => visitor.visit_string(v),
+            Value::Bin(v) => visitor.visit_byte_buf(v),
+            Value::Array(items) => {
+                let mut seq = de::value::SeqDeserializer::new(items.into_iter());
+                let value = visitor.visit_seq(&mut seq)?;
+                seq.end()?;
+                Ok(value)
+            }
+            Value::Map(entries) => {
+                let mut map = de::value::MapDeserializer::new(entries.into_iter());
+                let value = visitor.visit_map(&mut map)?;
+                map.end()?;
+                Ok(value)
+            }
+        }
+    }
+
+    fn deserialize_option<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        match self {
+            Value::Nil => visitor.visit_none(),
+            value => visitor.visit_some(value),
+        }
+    }
+
+    fn deserialize_newtype_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        visitor.visit_newtype_struct(self)
+    }
+
+    fn deserialize_enum<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        _variants: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        match self {
+            Value::Str(name) => visitor.visit_enum(name.into_deserializer()),
+            Value::Map(mut entries) if entries.len() == 1 => {
+                let (name, value) = entries.remove(0);
+                visitor.visit_enum(EnumDeserializer { name, value })
+            }
+            _ => Err(Error("Expected an enum variant".to_string())),
+        }
+    }
+
+    serde::forward_to_deserialize_any! {
+        bool i8 i16 i32 i64 i128 u8 u16 u32 u64 u128 f32 f64 char str string
+        bytes byte_buf unit unit_struct seq tuple tuple_struct map struct
+        identifier ignored_any
+    }
+}
+
+struct EnumDeserializer {
+    name: Value,
+    value: Value,
+}
+
+impl<'de> de::EnumAccess<'de> for EnumDeserializer {
+    type Error = Error;
+    type Variant = Value;
+
+    fn variant_seed<S: de::DeserializeSeed<'de>>(
+        self,
+        seed: S,
+    ) -> Result<(S::Value, Value), Error> {
+        Ok((seed.deserialize(self.name)?, self.value))
+    }
+}
+
+impl<'de> de::VariantAccess<'de> for Value {
+    type Error = Error;
+
+    fn unit_variant(self) -> Result<(), Error> {
+        match self {
+            Value::Nil => Ok(()),
+            _ => Err(Error("Expected a unit variant".to_string())),
+        }
+    }
+
+    fn newtype_variant_seed<S: de::DeserializeSeed<'de>>(self, seed: S) -> Result<S::Value, Error> {
+        seed.deserialize(self)
+    }
+
+    fn tuple_variant<V: Visitor<'de>>(self, _len: usize, visitor: V) -> Result<V::Value, Error> {
+        de::Deserializer::deserialize_any(self, visitor)
+    }
+
+    fn struct_variant<V: Visitor<'de>>(
+        self,
+        _fields: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        de::Deserializer::deserialize_any(self, visitor)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde::{Deserialize, Serialize};
+    use std::collections::BTreeMap;
+
+    #[derive(Debug, PartialEq, Serialize, Deserialize)]
+    enum Shape {
+        Empty,
+        Circle(u32),
+        Line(i64, i64),
+        Rect { width: u16, height: u16 },
+    }
+
+    #[derive(Debug, PartialEq, Serialize, Deserialize)]
+    struct Item {
+        zeta: Option<String>,
+        alpha: Vec<Shape>,
+        #[serde(with = "serde_bytes")]
+        bytes: Vec<u8>,
+        table: BTreeMap<u64, bool>,
+    }
+
+    #[test]
+    fn test_value_round_trip() {
+        let item = Item {
+            zeta: None,
+            alpha: vec![
+                Shape::Empty,
+                Shape::Circle(3),
+                Shape::Line(-7, 1 << 40),
+                Shape::Rect {
+                    width: 2,
+                    height: 9,
+                },
+            ],
+            bytes: vec![1, 2, 3],
+            table: [(5, true), (1, false)].into_iter().collect(),
+        };
+        let value = to_value(&item).unwrap();
+
+        // Struct fields are sorted by name, whatever their declaration order
+        match &value {
+            Value::Map(entries) => {
+                let keys: Vec<&Value> = entries.iter().map(|(k, _)| k).collect();
+                let mut sorted = keys.clone();
+                sorted.sort();
+                assert_eq!(keys, sorted);
+                assert_eq!(entries[0].0, Value::Str("alpha".to_string()));
+            }
+            other => panic!("Expected a map, got {:?}", other),
+        }
+        assert_eq!(from_value::<Item>(value).unwrap(), item);
+
+        assert!(to_value(&1.5f64).is_err());
+        assert!(Value::map(vec![(Value::UInt(1), Value::Nil); 2]).is_err());
+    }
+}
@@ -0,0 +1,335 @@
+use crate::canonical::{from_value_exact, to_value, Value};
+use crate::ccok::{Certificate, Params, Participant, Reveal};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+// Nesting limit when decoding untrusted input
+const MAX_DEPTH: usize = 64;
+
+const UNSIGNED: u8 = 0;
+const NEGATIVE: u8 = 1;
+const BYTES: u8 = 2;
+const TEXT: u8 = 3;
+const ARRAY: u8 = 4;
+const MAP: u8 = 5;
+const SIMPLE: u8 = 7;
+
+/// Deterministic CBOR encoding (RFC 8949 section 4.2.1): shortest integer and
+/// length forms, definite lengths only, map keys sorted by their encoded bytes
+/// and no floats or tags. Equal items always encode to the same bytes.
+pub trait Cbor: Serialize + DeserializeOwned {
+    /// Deterministic CBOR bytes of the item
+    fn to_cbor(&self) -> Result<Vec<u8>, String> {
+        to_vec(self)
+    }
+
+    /// Decode deterministic CBOR bytes, rejecting any other encoding
+    fn from_cbor(bytes: &[u8]) -> Result<Self, String> {
+        from_slice(bytes)
+    }
+}
+
+impl Cbor for Certificate {}
+impl Cbor for Reveal {}
+impl Cbor for Participant {}
+impl Cbor for Params {}
+
+/// Encode a serializable item as deterministic CBOR
+pub fn to_vec<T: Serialize + ?Sized>(item: &T) -> Result<Vec<u8>, String> {
+    let mut out = Vec::new();
+    encode(&to_value(item)?, &mut out);
+    Ok(out)
+}
+
+/// Decode an item from deterministic CBOR. Unknown or missing fields are
+/// rejected too, so the bytes are exactly the encoding of the returned item.
+pub fn from_slice<T: Serialize + DeserializeOwned>(bytes: &[u8]) -> Result<T, String> {
+    from_value_exact(decode(bytes)?)
+}
+
+/// Append the deterministic encoding of `value` to `out`
+pub fn encode(value: &Value, out: &mut Vec<u8>) {
+    match value {
+        Value::Nil => out.push(0xf6),
+        Value::Bool(false) => out.push(0xf4),
+        Value::Bool(true) => out.push(0xf5),
+        Value::UInt(v) => head(out, UNSIGNED, *v),
+        Value::Int(v) => head(out, NEGATIVE, !(*v as u64)),
+        Value::Str(s) => {
+            head(out, TEXT, s.len() as u64);
+            out.extend_from_slice(s.as_bytes());
+        }
+        Value::Bin(b) => {
+            head(out, BYTES, b.len() as u64);
+            out.extend_from_slice(b);
+        }
+        Value::Array(items) => {
+            head(out, ARRAY, items.len() as u64);
+            for item in items {
+                encode(item, out);
+            }
+        }
+        Value::Map(entries) => {
+            let mut encoded: Vec<(Vec<u8>, &Value)> = entries
+                .iter()
+                .map(|(key, value)| {
+                    let mut key_bytes = Vec::new();
+                    encode(key, &mut key_bytes);
+                    (key_bytes, value)
+                })
+                .collect();
+            encoded.sort_by(|a, b| a.0.cmp(&b.0));
+            head(out, MAP, encoded.len() as u64);
+            for (key, value) in encoded {
+                out.extend_from_slice(&key);
+                encode(value, out);
+            }
+        }
+    }
+}
+
+// Initial byte and argument in the shortest form
+fn head(out: &mut Vec<u8>, major: u8, arg: u64) {
+    let major = major << 5;
+    match arg {
+        0..=23 => out.push(major | arg as u8),
+        24..=0xff => out.extend_from_slice(&[major | 24, arg as u8]),
+        0x100..=0xffff => {
+            out.push(major | 25);
+            out.extend_from_slice(&(arg as u16).to_be_bytes());
+        }
+        0x1_0000..=0xffff_ffff => {
+            out.push(major | 26);
+            out.extend_from_slice(&(arg as u32).to_be_bytes());
+        }
+        _ => {
+            out.push(major | 27);
+            out.extend_from_slice(&arg.to_be_bytes());
+        }
+    }
+}
+
+/// Decode deterministic CBOR, rejecting trailing bytes, floats, tags,
+/// indefinite lengths, unsorted or duplicate map keys and non-minimal heads
+pub fn decode(bytes: &[u8]) -> Result<Value, String> {
+    let mut reader = Reader { bytes, pos: 0 };
+    let value = reader.value(0)?;
+    if reader.pos != bytes.len() {
+        return Err(format!(
+            "Trailing bytes after CBOR item at offset {}",
+            reader.pos
+        ));
+    }
+    Ok(value)
+}
+
+fn length(arg: u64) -> Result<usize, String> {
+    usize::try_from(arg).map_err(|_| "CBOR length too large".to_string())
+}
+
+struct Reader<'a> {
+    bytes: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Result<&'a [u8], String> {
+        if self.bytes.len() - self.pos < len {
+            return Err("Unexpected end of CBOR input".to_string());
+        }
+        let slice = &self.bytes[self.pos..self.pos + len];
+        self.pos += len;
+        Ok(slice)
+    }
+
+    // Major type and argument of the next head, which must be minimal
+    fn head(&mut self) -> Result<(u8, u64), String> {
+        let initial = self.take(1)?[0];
+        let (major, info) = (initial >> 5, initial & 0x1f);
+        if major == SIMPLE {
+            return Ok((major, info as u64));
+        }
+        let (arg, min) = match info {
+            0..=23 => return Ok((major, info as u64)),
+            24 => (self.take(1)?[0] as u64, 24),
+            25 => (
+                u16::from_be_bytes(self.take(2)?.try_into().unwrap()) as u64,
+                0x100,
+            ),
+            26 => (
+                u32::from_be_bytes(self.take(4)?.try_into().unwrap()) as u64,
+                0x1_0000,
+            ),
+            27 => (
+                u64::from_be_bytes(self.take(8)?.try_into().unwrap()),
+                0x1_0000_0000,
+            ),
+            31 => {
+                return Err("Indefinite lengths are not allowed in deterministic CBOR".to_string())
+            }
+            _ => return Err(format!("Invalid CBOR additional info {}", info)),
+        };
+        if arg < min {
+            return Err("CBOR integer or length is not in its shortest form".to_string());
+        }
+        Ok((major, arg))
+    }
+
+    fn value(&mut self, depth: usize) -> Result<Value, String> {
+        if depth > MAX_DEPTH {
+            return Err("CBOR item nested too deeply".to_string());
+        }
+        let (major, arg) = self.head()?;
+        let value = match major {
+            UNSIGNED => Value::UInt(arg),
+            NEGATIVE => {
+                let magnitude = i64::try_from(arg)
+                    .map_err(|_| "CBOR negative integer out of range".to_string())?;
+                Value::Int(-1 - magnitude)
+            }
+            BYTES => {
+                let len = length(arg)?;
+                Value::Bin(self.take(len)?.to_vec())
+            }
+            TEXT => {
+                let len = length(arg)?;
+                let text = self.take(len)?.to_vec();
+                Value::Str(
+                    String::from_utf8(text)
+                        .map_err(|e| format!("Invalid UTF-8 in CBOR text: {}", e))?,
+                )
+            }
+            ARRAY => {
+                let len = length(arg)?;
+                // Every item takes at least one byte, which bounds the allocation
+                let mut items = Vec::with_capacity(len.min(self.bytes.len() - self.pos));
+                for _ in 0..len {
+                    items.push(self.value(depth + 1)?);
+                }
+                Value::Array(items)
+            }
+            MAP => {
+                let len = length(arg)?;
+                let mut entries = Vec::with_capacity(len.min(self.bytes.len() - self.pos));
+                let mut last_key: Option<&[u8]> = None;
+                for _ in 0..len {
+                    let start = self.pos;
+                    let key = self.value(depth + 1)?;
+                    let key_bytes = &self.bytes[start..self.pos];
+                    if last_key.map_or(false, |last| last >= key_bytes) {
+                        return Err("CBOR map keys are not sorted".to_string());
+                    }
+                    last_key = Some(key_bytes);
+                    entries.push((key, self.value(depth + 1)?));
+                }
+                Value::map(entries)?
+            }
+            SIMPLE => match arg {
+                20 => Value::Bool(false),
+                21 => Value::Bool(true),
+                22 => Value::Nil,
+                25..=27 => return Err("Floats are not allowed in deterministic CBOR".to_string()),
+                _ => return Err(format!("Unsupported CBOR simple value {}", arg)),
+            },
+            _ => return Err("CBOR tags are not supported".to_string()),
+        };
+        Ok(value)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::Builder;
+    use crate::merkle::{HashAlgorithm, MerkleTreeBuilder};
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_encoding_is_deterministic() {
+        // Examples from RFC 8949 appendix A
+        let cases: Vec<(Value, Vec<u8>)> = vec![
+            (Value::UInt(23), vec![0x17]),
+            (Value::UInt(24), vec![0x18, 0x18]),
+            (Value::UInt(1000), vec![0x19, 0x03, 0xe8]),
+            (Value::Int(-1000), vec![0x39, 0x03, 0xe7]),
+            (Value::Int(i64::MIN), {
+                let mut v = vec![0x3b];
+                v.extend_from_slice(&(i64::MAX as u64).to_be_bytes());
+                v
+            }),
+            (Value::Str("a".to_string()), vec![0x61, 0x61]),
+            (Value::Bin(vec![1, 2, 3, 4]), vec![0x44, 1, 2, 3, 4]),
+            (
+                Value::map(vec![
+                    (Value::Str("b".to_string()), Value::Nil),
+                    (Value::UInt(10), Value::Bool(true)),
+                ])
+                .unwrap(),
+                vec![0xa2, 0x0a, 0xf5, 0x61, 0x62, 0xf6],
+            ),
+        ];
+        for (value, bytes) in cases {
+            let mut out = Vec::new();
+            encode(&value, &mut out);
+            assert_eq!(out, bytes, "{:?}", value);
+            assert_eq!(decode(&bytes).unwrap(), value);
+        }
+
+        // Non-minimal heads, unsorted keys, indefinite lengths, floats and tags
+        assert!(decode(&[0x18, 0x05]).is_err());
+        assert!(decode(&[0xa2, 0x61, 0x62, 0xf6, 0x0a, 0xf5]).is_err());
+        assert!(decode(&[0xa2, 0x01, 0xf6, 0x01, 0xf6]).is_err());
+        assert!(decode(&[0x9f, 0xff]).is_err());
+        assert!(decode(&[0xf9, 0x3c, 0x00]).is_err());
+        assert!(decode(&[0xc1, 0x00]).is_err());
+        assert!(decode(&[0xf6, 0xf6]).is_err());
+        assert!(decode(&[0x5a, 0xff, 0xff, 0xff, 0xff]).is_err());
+    }
+
+    #[test]
+    fn test_certificate_round_trip() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 25,
+            round: Some(7),
+            hash: HashAlgorithm::Blake3,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let mut builder =
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+
+        let params = Params::from_cbor(&params.to_cbor().unwrap()).unwrap();
+        let bytes = cert.to_cbor().unwrap();
+        let decoded = Certificate::from_cbor(&bytes).unwrap();
+        assert_eq!(decoded.to_cbor().unwrap(), bytes);
+        assert_eq!(decoded.digest().unwrap(), cert.digest().unwrap());
+        assert!(decoded.verify(&params, &party_tree.root()).unwrap());
+
+        // Every single-byte corruption is rejected or re-encodes to itself
+        for index in (0..bytes.len()).step_by(97) {
+            let mut corrupted = bytes.clone();
+            corrupted[index] ^= 0x01;
+            if let Ok(other) = Certificate::from_cbor(&corrupted) {
+                assert_eq!(other.to_cbor().unwrap(), corrupted);
+            }
+        }
+        assert!(Certificate::from_cbor(&bytes[..bytes.len() - 1]).is_err());
+    }
+}
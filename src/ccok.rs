@@ -1,22 +1,49 @@
-use crate::merkle::{CustomHasher, MerkleTreeBuilder};
+use crate::context::Context;
+use crate::ephemeral::{KeyCommitment, OneTimeKeyProof};
+use crate::error::CcokError;
+use crate::halfagg;
+use crate::hybrid::{self, SignatureMode};
+use crate::logging::{BUILDER, VERIFIER};
+use crate::merkle::{CompressedProofSet, HashAlgorithm, HashDomain, Hashing, MerkleTreeBuilder};
+use crate::metrics::METRICS;
+use crate::scheme::{lookup_scheme, SchemeId, SchemeInfo};
+use crate::signer::Signer;
+use crate::sumtree::{SumNode, SumPath, SumTree, WeightedLeaf};
+use crate::telemetry;
+use crate::vrf::VrfPublicKey;
 use bincode;
-use crystals_dilithium::dilithium2::{PublicKey, Signature};
+use crystals_dilithium::dilithium2::Signature;
 use hex;
-use rs_merkle::Hasher;
+use log::{debug, info, trace};
+use rayon::prelude::*;
 use serde::{Deserialize, Serialize};
 use sha3::{Digest, Keccak256};
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::Arc;
 
-/// Wrapper for Dilithium signature to implement serialization
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// Wrapper for raw signature bytes to implement serialization
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
 pub struct SerializableSignature(#[serde(with = "serde_bytes")] Vec<u8>);
 
+impl SerializableSignature {
+    /// Raw signature bytes
+    pub fn as_bytes(&self) -> &[u8] {
+        &self.0
+    }
+}
+
 impl From<Signature> for SerializableSignature {
     fn from(sig: Signature) -> Self {
         SerializableSignature(sig.to_vec())
     }
 }
 
+impl From<Vec<u8>> for SerializableSignature {
+    fn from(sig: Vec<u8>) -> Self {
+        SerializableSignature(sig)
+    }
+}
+
 impl TryInto<Signature> for SerializableSignature {
     type Error = &'static str;
 
@@ -37,6 +64,143 @@ pub struct Participant {
     pub public_key: String,
     /// The weight of the participant in the system
     pub weight: u64,
+    /// Registry identifier of the signature scheme the public key belongs to
+    #[serde(default)]
+    pub scheme: SchemeId,
+    /// Commitment to per-round one-time keys; when set, the participant signs
+    /// with the one-time key of the certificate round instead of `public_key`
+    #[serde(default)]
+    pub key_commitment: Option<KeyCommitment>,
+    /// VRF public key for leader election and committee sortition
+    #[serde(default)]
+    pub vrf_key: Option<VrfPublicKey>,
+    /// Whether `public_key` is the full key or only its `key_digest`
+    #[serde(default)]
+    pub key_layout: KeyLayout,
+}
+
+/// Where a participant's full public key is kept. Keys of several kilobytes,
+/// as Dilithium's, bloat whichever side holds them: every copy of the voter
+/// set, or every certificate revealing the participant.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum KeyLayout {
+    /// The participant leaf commits to the full key, which reveals take from
+    /// the participant
+    #[default]
+    InLeaf,
+    /// The participant leaf commits to the 32-byte `key_digest` of the key,
+    /// which reveals carry in full
+    InReveal,
+}
+
+/// Digest of a `scheme` public key committed by `KeyLayout::InReveal`
+/// participants
+pub fn key_digest(hashing: Hashing, scheme: SchemeId, public_key: &[u8]) -> [u8; 32] {
+    hashing.hash_parts(
+        HashDomain::PublicKey,
+        &[&scheme.0.to_le_bytes(), public_key],
+    )
+}
+
+impl Participant {
+    /// Create a participant from anything implementing `Signer`
+    pub fn from_signer(signer: &dyn Signer, weight: u64) -> Self {
+        Self {
+            public_key: signer.public_key_hex(),
+            weight,
+            scheme: signer.scheme(),
+            key_commitment: None,
+            vrf_key: None,
+            key_layout: KeyLayout::InLeaf,
+        }
+    }
+
+    /// The participant committing only to the digest of its public key, with
+    /// `KeyLayout::InReveal`; reveals then carry the full key
+    pub fn with_key_in_reveal(mut self, hashing: Hashing) -> Result<Self, CcokError> {
+        if self.key_layout == KeyLayout::InLeaf {
+            let public_key = hex::decode(&self.public_key)?;
+            self.public_key = hex::encode(key_digest(hashing, self.scheme, &public_key));
+            self.key_layout = KeyLayout::InReveal;
+        }
+        Ok(self)
+    }
+
+    /// Whether reveals of the participant carry its full public key: it
+    /// commits to the key digest and signs with the key, not one-time keys
+    pub fn reveals_key(&self) -> bool {
+        self.key_layout == KeyLayout::InReveal && self.key_commitment.is_none()
+    }
+
+    /// Whether `public_key` is the key the participant committed to
+    pub fn commits_to_key(&self, hashing: Hashing, public_key: &[u8]) -> bool {
+        let committed = match hex::decode(&self.public_key) {
+            Ok(committed) => committed,
+            Err(_) => return false,
+        };
+        match self.key_layout {
+            KeyLayout::InLeaf => committed == public_key,
+            KeyLayout::InReveal => committed == key_digest(hashing, self.scheme, public_key),
+        }
+    }
+
+    /// Publish a VRF public key with the participant
+    pub fn with_vrf_key(mut self, vrf_key: VrfPublicKey) -> Self {
+        self.vrf_key = Some(vrf_key);
+        self
+    }
+
+    /// Participants of a stake snapshot of hex public keys of `scheme`, and
+    /// their total weight. Every node derives the same participants from the
+    /// same snapshot: keys are normalized to lowercase and sorted, stakes
+    /// become weights with `quantize_weight`, and keys whose stake rounds to
+    /// no weight are left out. Weights are 64-bit, so a stake beyond 64 bits
+    /// fails with `CcokError::WeightOverflow`.
+    pub fn from_stake(
+        params: &Params,
+        scheme: SchemeId,
+        stakes: &HashMap<String, u128>,
+    ) -> Result<(Vec<Self>, u64), CcokError> {
+        let mut weights = BTreeMap::new();
+        for (public_key, stake) in stakes {
+            let normalized = public_key.to_ascii_lowercase();
+            hex::decode(&normalized)
+                .map_err(|e| CcokError::InvalidPublicKey(format!("{}: {}", public_key, e)))?;
+            if weights
+                .insert(
+                    normalized,
+                    params.quantize_weight(
+                        u64::try_from(*stake).map_err(|_| CcokError::WeightOverflow)?,
+                    ),
+                )
+                .is_some()
+            {
+                return Err(CcokError::InvalidPublicKey(format!(
+                    "{} listed twice",
+                    public_key
+                )));
+            }
+        }
+        let mut total_weight = 0u64;
+        let mut participants = Vec::with_capacity(weights.len());
+        for (public_key, weight) in weights {
+            if weight == 0 {
+                continue;
+            }
+            total_weight = total_weight
+                .checked_add(weight)
+                .ok_or(CcokError::WeightOverflow)?;
+            participants.push(Self {
+                public_key,
+                weight,
+                scheme,
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            });
+        }
+        Ok((participants, total_weight))
+    }
 }
 
 /// A slot for storing signature information
@@ -46,6 +210,22 @@ pub struct SigSlot {
     pub signature: Option<SerializableSignature>,
     /// The accumulated weight up to this slot (L-value in the original implementation)
     pub accumulated_weight: u64,
+    /// Proof of the one-time key that produced the signature, if any
+    #[serde(default)]
+    pub one_time_key: Option<OneTimeKeyProof>,
+}
+
+impl SigSlot {
+    /// The slot with its Schnorr signature cut to the nonce, as committed in
+    /// the aggregate mode
+    pub fn with_nonce(&self) -> Result<Self, CcokError> {
+        let mut slot = self.clone();
+        if let Some(sig) = &self.signature {
+            let nonce = halfagg::nonce(sig.as_bytes()).map_err(CcokError::Scheme)?;
+            slot.signature = Some(SerializableSignature::from(nonce.to_vec()));
+        }
+        Ok(slot)
+    }
 }
 
 /// Configuration parameters for the certificate system
@@ -57,6 +237,330 @@ pub struct Params {
     pub proven_weight: u64,
     /// Security parameter for the system
     pub security_param: u32,
+    /// Signature scheme every participant must use; `None` allows mixed schemes,
+    /// each reveal being verified with its participant's committed scheme
+    #[serde(default)]
+    pub scheme: Option<SchemeId>,
+    /// Round the certificate is for, selecting the participants' one-time keys
+    #[serde(default)]
+    pub round: Option<u64>,
+    /// Hash function of the Merkle trees and coin flips; the party tree must
+    /// be built with the same function
+    #[serde(default)]
+    pub hash: HashAlgorithm,
+    /// Format version; `PARAMS_V2` and later prefix every hash and signed
+    /// message with its `HashDomain` tag
+    #[serde(default = "legacy_version")]
+    pub version: u8,
+    /// Levels of `aggregate::AggregateProof` compression, each halving the
+    /// coins whose reveals are opened; 0 opens every coin
+    #[serde(default)]
+    pub compression_level: u8,
+    /// Chain the certificate is for; together with `purpose` it binds the
+    /// signed message to the chain and round, see `canonical_message`
+    #[serde(default)]
+    pub chain_id: Option<u64>,
+    /// What the certificate attests, set together with `chain_id`
+    #[serde(default)]
+    pub purpose: Option<Purpose>,
+    /// Significant bits participant weights keep, 0 for exact weights; see
+    /// `quantize_weight`
+    #[serde(default)]
+    pub weight_precision: u8,
+    /// Which keys of hybrid participants must sign; `None` has every
+    /// participant sign with its own scheme, see `hybrid`
+    #[serde(default)]
+    pub signature_mode: Option<SignatureMode>,
+}
+
+/// Params version of certificates without domain separation
+pub const PARAMS_V1: u8 = 1;
+/// Params version with domain-separated hashes and signed messages
+pub const PARAMS_V2: u8 = 2;
+/// Params version whose number of coins follows the security parameter,
+/// `ceil(security_param / log2(signed_weight / proven_weight))`
+pub const PARAMS_V3: u8 = 3;
+/// Params version whose coins derive from a seed the certificate commits to,
+/// see `coin_seed`
+pub const PARAMS_V4: u8 = 4;
+/// Params version whose signature tree is a sum tree over the signed
+/// weights, committing to the signed weight before any coin is derived
+pub const PARAMS_V5: u8 = 5;
+
+/// Versions this implementation can build and verify
+pub const SUPPORTED_VERSIONS: [u8; 5] = [PARAMS_V1, PARAMS_V2, PARAMS_V3, PARAMS_V4, PARAMS_V5];
+
+/// Lowest security parameter params may use
+pub const MIN_SECURITY_PARAM: u32 = 16;
+
+/// Most coins a `PARAMS_V3` certificate flips. Builders refuse to build while
+/// the signed weight is too close to the proven weight to reach the security
+/// parameter within them
+pub const MAX_COINS: usize = 1024;
+
+/// Highest compression level of params, opening a sixteenth of the coins
+pub const MAX_COMPRESSION_LEVEL: u8 = 4;
+
+/// Highest weight precision of params, that of exact 64-bit weights
+pub const MAX_WEIGHT_PRECISION: u8 = 64;
+
+/// What a certificate attests, so a certificate for one purpose can't stand
+/// in for another over the same message
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum Purpose {
+    /// State proof of a sidechain block
+    StateProof,
+    /// Consensus commit of a block
+    Commit,
+    /// Handoff to the next participant set
+    Handoff,
+    /// Enactment of a governance proposal
+    Governance,
+    /// Halt or resume of the bridge
+    Breaker,
+    /// Batch of bridge withdrawals
+    Withdrawal,
+}
+
+impl Purpose {
+    /// Byte identifying the purpose in the canonical message
+    pub fn id(self) -> u8 {
+        match self {
+            Purpose::StateProof => 1,
+            Purpose::Commit => 2,
+            Purpose::Handoff => 3,
+            Purpose::Governance => 4,
+            Purpose::Breaker => 5,
+            Purpose::Withdrawal => 6,
+        }
+    }
+
+    pub fn from_id(id: u8) -> Option<Self> {
+        match id {
+            1 => Some(Purpose::StateProof),
+            2 => Some(Purpose::Commit),
+            3 => Some(Purpose::Handoff),
+            4 => Some(Purpose::Governance),
+            5 => Some(Purpose::Breaker),
+            6 => Some(Purpose::Withdrawal),
+            _ => None,
+        }
+    }
+}
+
+/// Message participants sign for `msg` bound to `chain_id`, `round` and
+/// `purpose`: the `HashDomain::Binding` tag, then the big endian chain id,
+/// the purpose id, a byte telling whether a round follows, the big endian
+/// round and `msg`. A certificate over it can't be replayed on another
+/// chain, for another round or for another purpose.
+pub fn canonical_message(
+    chain_id: u64,
+    round: Option<u64>,
+    purpose: Purpose,
+    msg: &[u8],
+) -> Vec<u8> {
+    let mut message = HashDomain::Binding.tag().to_vec();
+    message.extend_from_slice(&chain_id.to_be_bytes());
+    message.push(purpose.id());
+    match round {
+        Some(round) => {
+            message.push(1);
+            message.extend_from_slice(&round.to_be_bytes());
+        }
+        None => message.push(0),
+    }
+    message.extend_from_slice(msg);
+    message
+}
+
+/// Named security levels of certificate params
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum SecurityLevel {
+    Security128,
+    Security192,
+}
+
+impl SecurityLevel {
+    /// Bits of security the coins of a certificate provide
+    pub fn security_param(self) -> u32 {
+        match self {
+            SecurityLevel::Security128 => 128,
+            SecurityLevel::Security192 => 192,
+        }
+    }
+
+    /// Hash of the trees and coin flips, wide enough for the level against
+    /// quantum collision search
+    pub fn hash(self) -> HashAlgorithm {
+        match self {
+            SecurityLevel::Security128 => HashAlgorithm::Keccak256,
+            SecurityLevel::Security192 => HashAlgorithm::Sha3_512,
+        }
+    }
+}
+
+// Params and certificates serialized before versioning are version 1
+fn legacy_version() -> u8 {
+    PARAMS_V1
+}
+
+impl Default for Params {
+    /// Unbound `PARAMS_V2` params with a security parameter of 128 over
+    /// Keccak-256 trees, for mixed schemes with exact weights. The message
+    /// and proven weight are empty, to be filled in.
+    fn default() -> Self {
+        Self {
+            msg: Vec::new(),
+            proven_weight: 0,
+            security_param: 128,
+            scheme: None,
+            round: None,
+            hash: HashAlgorithm::Keccak256,
+            version: PARAMS_V2,
+            compression_level: 0,
+            chain_id: None,
+            purpose: None,
+            weight_precision: 0,
+            signature_mode: None,
+        }
+    }
+}
+
+impl Params {
+    /// Params of `level` over `msg`, at `PARAMS_V4`: its number of coins
+    /// follows the security parameter and its coins a committed seed. It is
+    /// the latest version aggregate proofs and witnesses support.
+    pub fn preset(level: SecurityLevel, msg: Vec<u8>, proven_weight: u64) -> Self {
+        Self {
+            msg,
+            proven_weight,
+            security_param: level.security_param(),
+            scheme: None,
+            round: None,
+            hash: level.hash(),
+            version: PARAMS_V4,
+            compression_level: 0,
+            chain_id: None,
+            purpose: None,
+            weight_precision: 0,
+            signature_mode: None,
+        }
+    }
+
+    /// Bind the signed message to `chain_id`, `round` and `purpose`
+    pub fn bind(mut self, chain_id: u64, round: u64, purpose: Purpose) -> Self {
+        self.chain_id = Some(chain_id);
+        self.round = Some(round);
+        self.purpose = Some(purpose);
+        self
+    }
+
+    /// Chain id, purpose and round the signed message is bound to
+    pub fn binding(&self) -> Option<(u64, Purpose, Option<u64>)> {
+        match (self.chain_id, self.purpose) {
+            (Some(chain_id), Some(purpose)) => Some((chain_id, purpose, self.round)),
+            _ => None,
+        }
+    }
+
+    /// Check the params on their own: a supported version, a security
+    /// parameter of at least `MIN_SECURITY_PARAM`, a positive proven weight
+    /// and a compression level a domain separated version supports
+    pub fn validate(&self) -> Result<(), CcokError> {
+        if !SUPPORTED_VERSIONS.contains(&self.version) {
+            return Err(CcokError::UnsupportedVersion(self.version));
+        }
+        if self.security_param < MIN_SECURITY_PARAM {
+            return Err(CcokError::InvalidParams(format!(
+                "security parameter {} below {}",
+                self.security_param, MIN_SECURITY_PARAM
+            )));
+        }
+        if self.proven_weight == 0 {
+            return Err(CcokError::InvalidParams(
+                "proven weight must be positive".to_string(),
+            ));
+        }
+        if self.compression_level > MAX_COMPRESSION_LEVEL {
+            return Err(CcokError::InvalidParams(format!(
+                "compression level {} above {}",
+                self.compression_level, MAX_COMPRESSION_LEVEL
+            )));
+        }
+        if self.compression_level > 0 && self.version < PARAMS_V2 {
+            return Err(CcokError::InvalidParams(
+                "compression needs domain separated params".to_string(),
+            ));
+        }
+        if self.weight_precision > MAX_WEIGHT_PRECISION {
+            return Err(CcokError::InvalidParams(format!(
+                "weight precision {} above {}",
+                self.weight_precision, MAX_WEIGHT_PRECISION
+            )));
+        }
+        if self.chain_id.is_some() != self.purpose.is_some() {
+            return Err(CcokError::InvalidParams(
+                "chain id and purpose must be set together".to_string(),
+            ));
+        }
+        if self.chain_id.is_some() && self.version < PARAMS_V2 {
+            return Err(CcokError::InvalidParams(
+                "binding needs domain separated params".to_string(),
+            ));
+        }
+        if let Some(scheme) = self.scheme {
+            hybrid::signing_scheme(self.signature_mode, scheme)
+                .map_err(CcokError::InvalidParams)?;
+        }
+        Ok(())
+    }
+
+    /// `weight` rounded down to its `weight_precision` most significant bits,
+    /// so weights take few distinct values and leaves carry little entropy.
+    /// Each weight loses less than `2^(1 - weight_precision)` of itself.
+    pub fn quantize_weight(&self, weight: u64) -> u64 {
+        let bits = u64::BITS - weight.leading_zeros();
+        let precision = self.weight_precision as u32;
+        if precision == 0 || bits <= precision {
+            return weight;
+        }
+        let dropped = bits - precision;
+        weight >> dropped << dropped
+    }
+
+    /// Whether `weight` is one `quantize_weight` can give
+    pub fn is_quantized(&self, weight: u64) -> bool {
+        self.quantize_weight(weight) == weight
+    }
+
+    /// `validate`, and check the proven weight is below the `total_weight` of
+    /// the participants, leaving the coins something to sample
+    pub fn validate_for(&self, total_weight: u64) -> Result<(), CcokError> {
+        self.validate()?;
+        if self.proven_weight >= total_weight {
+            return Err(CcokError::InvalidParams(format!(
+                "proven weight {} not below total weight {}",
+                self.proven_weight, total_weight
+            )));
+        }
+        Ok(())
+    }
+
+    /// Hashing of the trees and coin flips for this version
+    pub fn hashing(&self) -> Hashing {
+        Hashing::new(self.hash, self.version >= PARAMS_V2)
+    }
+
+    /// Message participants sign for this version
+    pub fn signing_message(&self) -> Vec<u8> {
+        match self.binding() {
+            _ if self.version < PARAMS_V2 => self.msg.clone(),
+            Some((chain_id, purpose, round)) => {
+                canonical_message(chain_id, round, purpose, &self.msg)
+            }
+            None => HashDomain::Message.tagged(&self.msg),
+        }
+    }
 }
 
 /// Represents a reveal in the certificate
@@ -66,6 +570,159 @@ pub struct Reveal {
     pub sig_slot: SigSlot,
     /// The participant information
     pub party: Participant,
+    /// Full public key of a `KeyLayout::InReveal` participant, in hex
+    #[serde(default)]
+    pub public_key: Option<String>,
+}
+
+impl Reveal {
+    /// Check the signature of the reveal at `pos` on the params message, with
+    /// the one-time key proof of a participant committed to one-time keys. A
+    /// reveal of the aggregate mode only holds a nonce, so it fails alone.
+    pub fn verify(&self, params: &Params, pos: u64) -> Result<bool, CcokError> {
+        let public_key = self.signing_key().map(hex::decode).transpose()?;
+        let info = lookup_scheme(self.party.scheme).map_err(CcokError::Scheme)?;
+        self.check_signature(
+            params,
+            &info,
+            &params.signing_message(),
+            pos,
+            public_key.as_deref(),
+            false,
+        )
+    }
+
+    // Check the signature at `pos` under its decoded signing key, which is
+    // missing when a committed participant gave no one-time key proof. With
+    // `aggregated`, a nonce of the aggregate mode passes, for the caller to
+    // check against the certificate's aggregate.
+    fn check_signature(
+        &self,
+        params: &Params,
+        info: &SchemeInfo,
+        message: &[u8],
+        pos: u64,
+        public_key: Option<&[u8]>,
+        aggregated: bool,
+    ) -> Result<bool, CcokError> {
+        // Verify the signature exists
+        let signature = match &self.sig_slot.signature {
+            Some(sig) => sig,
+            None => {
+                debug!(target: VERIFIER, "No signature found at position {}", pos);
+                return Ok(false);
+            }
+        };
+
+        // Only participants signing with a key they commit to by digest
+        // reveal it, and the key must be the one committed
+        let revealed = match (self.party.reveals_key(), &self.public_key) {
+            (false, None) => true,
+            (true, Some(key)) => {
+                hex::decode(key).is_ok_and(|key| self.party.commits_to_key(params.hashing(), &key))
+            }
+            _ => false,
+        };
+        if !revealed {
+            debug!(target: VERIFIER, "Revealed key mismatch at position {}", pos);
+            return Ok(false);
+        }
+
+        // The signing key is the participant's one-time key for this round, if
+        // committed, otherwise its long-lived key
+        let public_key = match public_key {
+            Some(public_key) => public_key,
+            None => {
+                debug!(target: VERIFIER, "Missing one-time key proof at position {}", pos);
+                return Ok(false);
+            }
+        };
+        if let (Some(commitment), Some(proof)) =
+            (&self.party.key_commitment, &self.sig_slot.one_time_key)
+        {
+            if params.round != Some(proof.round)
+                || !proof
+                    .verify(params.hashing(), commitment, self.party.scheme)
+                    .map_err(|reason| CcokError::InvalidOneTimeKey {
+                        pos: pos as usize,
+                        reason,
+                    })?
+            {
+                debug!(target: VERIFIER, "One-time key proof failed for position {}", pos);
+                return Ok(false);
+            }
+        }
+
+        // A scheme pinned by params must be the committed participant scheme
+        let scheme = self.party.scheme;
+        if let Some(required) = params.scheme {
+            if scheme != required {
+                debug!(target: VERIFIER,
+                    "Scheme mismatch at position {}: {:?} != {:?}",
+                    pos, scheme, required
+                );
+                return Ok(false);
+            }
+        }
+
+        if params.signature_mode == Some(SignatureMode::Aggregate) {
+            if let Err(reason) = hybrid::signing_scheme(params.signature_mode, scheme) {
+                debug!(target: VERIFIER, "Position {}: {}", pos, reason);
+                return Ok(false);
+            }
+            return Ok(aggregated && signature.as_bytes().len() == halfagg::NONCE_BYTES);
+        }
+
+        // Verify the signature with the scheme looked up in the registry, or
+        // with the half of a hybrid key the signature mode picks
+        let verified = match hybrid::signing_scheme(params.signature_mode, scheme) {
+            Ok(signing) if signing == scheme => {
+                info.verify_signature(public_key, message, signature.as_bytes())
+            }
+            Ok(_) => hybrid::verify_signature(
+                params.signature_mode,
+                scheme,
+                public_key,
+                message,
+                signature.as_bytes(),
+            ),
+            Err(reason) => {
+                debug!(target: VERIFIER, "Position {}: {}", pos, reason);
+                return Ok(false);
+            }
+        };
+        if !verified.map_err(CcokError::Scheme)? {
+            debug!(target: VERIFIER, "Signature verification failed for position {}", pos);
+            return Ok(false);
+        }
+        Ok(true)
+    }
+
+    /// Hex key the signature was made with: the one-time key of a committed
+    /// participant, if its proof is included, otherwise the long-lived key,
+    /// taken from the reveal under `KeyLayout::InReveal`
+    pub fn signing_key(&self) -> Option<&String> {
+        match (&self.party.key_commitment, self.party.key_layout) {
+            (Some(_), _) => self
+                .sig_slot
+                .one_time_key
+                .as_ref()
+                .map(|proof| &proof.public_key),
+            (None, KeyLayout::InLeaf) => Some(&self.party.public_key),
+            (None, KeyLayout::InReveal) => self.public_key.as_ref(),
+        }
+    }
+}
+
+/// One Fiat-Shamir coin of a certificate and the position it reveals
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CoinFlip {
+    /// Index of the coin, from 0 to the number of coins
+    pub index: u64,
+    /// Coin value in `[0, signed_weight)`
+    pub coin: u64,
+    /// Position whose signed weight range `[L, L + weight)` holds the coin
+    pub position: u64,
 }
 
 /// The final certificate containing all proofs and reveals
@@ -77,8 +734,8 @@ pub struct Certificate {
     pub signed_weight: u64,
     /// Total number of signature slots (leaves in the signature Merkle tree)
     pub total_sigs: usize,
-    /// Map of position to reveals
-    pub reveals: HashMap<u64, Reveal>,
+    /// Map of position to reveals, ordered by position
+    pub reveals: BTreeMap<u64, Reveal>,
     /// Merkle proofs for signatures
     pub sig_proofs: Vec<Vec<u8>>,
     /// Merkle proofs for participants
@@ -87,17 +744,101 @@ pub struct Certificate {
     pub reveal_positions: Vec<u64>,
     /// Reveal indices corresponding to reveal positions
     pub reveal_indices: Vec<u64>,
+    /// Sorted identifiers of the signature schemes used by the reveals
+    #[serde(default)]
+    pub schemes: Vec<SchemeId>,
+    /// Packed signature proofs, replacing `sig_proofs` once compressed
+    #[serde(default)]
+    pub compressed_sig_proofs: Option<CompressedProofSet>,
+    /// Packed participant proofs, replacing `party_proofs` once compressed
+    #[serde(default)]
+    pub compressed_party_proofs: Option<CompressedProofSet>,
+    /// Hash function the certificate was built with
+    #[serde(default)]
+    pub hash: HashAlgorithm,
+    /// Params version the certificate was built with
+    #[serde(default = "legacy_version")]
+    pub version: u8,
+    /// Sum tree paths of the revealed participants, in reveal position order
+    #[serde(default)]
+    pub party_sum_proofs: Option<Vec<SumPath>>,
+    /// `coin_seed` the coins were derived from, from `PARAMS_V4`; empty before
+    #[serde(default)]
+    pub coin_seed: Vec<u8>,
+    /// From `PARAMS_V5`, signature sum tree paths of the reveals, in reveal
+    /// position order, replacing `sig_proofs`
+    #[serde(default)]
+    pub sig_sum_proofs: Option<Vec<SumPath>>,
+    /// Half-aggregate of the revealed Schnorr signatures in the aggregate
+    /// mode, whose reveals carry only the nonces; empty otherwise
+    #[serde(default)]
+    pub aggregate_sig: Vec<u8>,
 }
 
 impl Certificate {
+    /// Keccak256 hash of the serialized certificate
+    pub fn digest(&self) -> Result<Vec<u8>, CcokError> {
+        let bytes = bincode::serialize(self)?;
+        Ok(Keccak256::digest(&bytes).to_vec())
+    }
+
+    /// Hash function of the certificate and of the messages it signs
+    pub fn hashing(&self) -> Hashing {
+        Hashing::new(self.hash, self.version >= PARAMS_V2)
+    }
+
     /// Returns a tuple with the total size (in bytes) of the signature proofs and participant proofs.
     pub fn proof_size(&self) -> (usize, usize) {
-        let sig_size: usize = self.sig_proofs.iter().map(|p| p.len()).sum();
-        let party_size: usize = self.party_proofs.iter().map(|p| p.len()).sum();
-        (sig_size, party_size)
+        let size = |plain: &[Vec<u8>], compressed: &Option<CompressedProofSet>| match compressed {
+            Some(set) => set.nodes.len(),
+            None => plain.iter().map(|p| p.len()).sum(),
+        };
+        (
+            size(&self.sig_proofs, &self.compressed_sig_proofs),
+            size(&self.party_proofs, &self.compressed_party_proofs),
+        )
+    }
+
+    /// Pack the signature and participant proofs into compressed proof sets
+    pub fn compress_proofs(&mut self) -> Result<(), CcokError> {
+        if self.compressed_sig_proofs.is_none() {
+            self.compressed_sig_proofs = Some(CompressedProofSet::from_hashes(&self.sig_proofs)?);
+            self.sig_proofs.clear();
+        }
+        if self.compressed_party_proofs.is_none() {
+            self.compressed_party_proofs =
+                Some(CompressedProofSet::from_hashes(&self.party_proofs)?);
+            self.party_proofs.clear();
+        }
+        Ok(())
+    }
+
+    /// Signature tree proof hashes, unpacked if compressed
+    pub fn sig_proof_hashes(&self) -> Result<Vec<Vec<u8>>, CcokError> {
+        Self::proof_hashes(&self.sig_proofs, &self.compressed_sig_proofs)
+    }
+
+    /// Participant tree proof hashes, unpacked if compressed
+    pub fn party_proof_hashes(&self) -> Result<Vec<Vec<u8>>, CcokError> {
+        Self::proof_hashes(&self.party_proofs, &self.compressed_party_proofs)
+    }
+
+    // Proof hashes, unpacking compressed proofs if present
+    fn proof_hashes(
+        plain: &[Vec<u8>],
+        compressed: &Option<CompressedProofSet>,
+    ) -> Result<Vec<Vec<u8>>, CcokError> {
+        match compressed {
+            Some(set) if plain.is_empty() => set.hashes(),
+            Some(_) => Err(CcokError::BadMerklePath(
+                "certificate has both plain and compressed proofs".to_string(),
+            )),
+            None => Ok(plain.to_vec()),
+        }
     }
 }
-/// Builder for creating certificates
+
+// Builder for creating certificates
 #[derive(Debug)]
 pub struct Builder {
     /// System parameters
@@ -110,340 +851,1673 @@ pub struct Builder {
     pub participants: Vec<Participant>,
     /// Root hash of the participant Merkle tree
     pub party_tree_root: Vec<u8>,
+    /// Pool verifying signatures before they are accepted; without it
+    /// signatures are accepted unchecked and only fail at verification
+    verify_pool: Option<rayon::ThreadPool>,
+    /// Sum tree over the participants, when certificates carry weight proofs
+    sum_tree: Option<SumTree>,
+    /// Full keys of `KeyLayout::InReveal` participants, by position
+    revealed_keys: HashMap<usize, String>,
 }
 
 impl Builder {
-    pub fn new(params: Params, participants: Vec<Participant>, party_tree_root: Vec<u8>) -> Self {
-        Self {
+    /// Builder of certificates over `participants`, refusing params that fail
+    /// `Params::validate_for` their total weight
+    pub fn new(
+        params: Params,
+        participants: Vec<Participant>,
+        party_tree_root: Vec<u8>,
+    ) -> Result<Self, CcokError> {
+        let total_weight = participants
+            .iter()
+            .try_fold(0u64, |acc, p| acc.checked_add(p.weight))
+            .ok_or(CcokError::WeightOverflow)?;
+        params.validate_for(total_weight)?;
+        if let Some(pos) = participants
+            .iter()
+            .position(|party| !params.is_quantized(party.weight))
+        {
+            return Err(CcokError::InvalidParams(format!(
+                "weight {} of position {} not quantized to {} bits",
+                participants[pos].weight, pos, params.weight_precision
+            )));
+        }
+        Ok(Self {
             params,
             sigs: vec![
                 SigSlot {
                     signature: None,
-                    accumulated_weight: 0
+                    accumulated_weight: 0,
+                    one_time_key: None,
                 };
                 participants.len()
             ],
             signed_weight: 0,
             participants,
             party_tree_root,
+            verify_pool: None,
+            sum_tree: None,
+            revealed_keys: HashMap::new(),
+        })
+    }
+
+    /// Full hex keys of `KeyLayout::InReveal` participants, by position, for
+    /// the builder to check their signatures and reveal the keys
+    pub fn with_public_keys(
+        mut self,
+        keys: impl IntoIterator<Item = (usize, String)>,
+    ) -> Result<Self, CcokError> {
+        let hashing = self.params.hashing();
+        for (pos, key) in keys {
+            let party = self
+                .participants
+                .get(pos)
+                .ok_or(CcokError::InvalidPosition(pos))?;
+            if party.key_layout != KeyLayout::InReveal
+                || !party.commits_to_key(hashing, &hex::decode(&key)?)
+            {
+                return Err(CcokError::InvalidPublicKey(format!(
+                    "{} is not the committed key of position {}",
+                    key, pos
+                )));
+            }
+            self.revealed_keys.insert(pos, key.to_ascii_lowercase());
         }
+        Ok(self)
     }
 
-    /// Add a signature from a participant
-    pub fn add_signature(&mut self, pos: usize, signature: Signature) -> Result<(), String> {
-        // Validate position
-        if pos >= self.participants.len() {
-            return Err(format!("Invalid participant position: {}", pos));
+    /// Full hex key reveals of the participant at `pos` carry, if it
+    /// `reveals_key`
+    pub fn revealed_key(&self, pos: usize) -> Option<&String> {
+        match self.participants.get(pos)?.reveals_key() {
+            true => self.revealed_keys.get(&pos),
+            false => None,
+        }
+    }
+
+    // Full hex public key of the participant at `pos`
+    fn public_key(&self, pos: usize) -> Result<&String, CcokError> {
+        let party = &self.participants[pos];
+        match party.key_layout {
+            KeyLayout::InLeaf => Ok(&party.public_key),
+            KeyLayout::InReveal => self.revealed_keys.get(&pos).ok_or_else(|| {
+                CcokError::InvalidPublicKey(format!("no key revealed for position {}", pos))
+            }),
+        }
+    }
+
+    /// Include the sum tree paths of the reveals in certificates, so verifiers
+    /// holding the sum tree root can check the weights against its total
+    pub fn with_sum_tree(mut self) -> Result<Self, CcokError> {
+        self.sum_tree = Some(SumTree::from_participants(
+            self.params.hashing(),
+            &self.participants,
+        )?);
+        Ok(self)
+    }
+
+    /// Root of the participant sum tree, if certificates carry weight proofs
+    pub fn sum_root(&self) -> Option<SumNode> {
+        self.sum_tree.as_ref().map(SumTree::root)
+    }
+
+    /// Verify every signature on a pool of `workers` threads before accepting it
+    pub fn with_verify_workers(mut self, workers: usize) -> Result<Self, String> {
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(workers)
+            .build()
+            .map_err(|e| format!("Failed to create verification pool: {}", e))?;
+        self.verify_pool = Some(pool);
+        Ok(self)
+    }
+
+    /// Add a batch of signatures, verifying them in parallel when verify
+    /// workers are configured. Returns one result per signature, in order.
+    pub fn add_signatures<S: Into<SerializableSignature>>(
+        &mut self,
+        batch: impl IntoIterator<Item = (usize, S)>,
+    ) -> Vec<Result<(), CcokError>> {
+        let batch: Vec<(usize, SerializableSignature)> = batch
+            .into_iter()
+            .map(|(pos, sig)| (pos, sig.into()))
+            .collect();
+
+        let checked: Vec<Result<(), CcokError>> = match &self.verify_pool {
+            Some(pool) => pool.install(|| {
+                batch
+                    .par_iter()
+                    .map(|(pos, sig)| {
+                        if self.already_signed(*pos, sig, None)? {
+                            return Ok(());
+                        }
+                        self.check_signature(*pos, sig, None)?;
+                        Ok(self.verify_slot(*pos, sig, None)?)
+                    })
+                    .collect()
+            }),
+            None => batch.iter().map(|_| Ok(())).collect(),
+        };
+
+        batch
+            .into_iter()
+            .zip(checked)
+            .map(|((pos, sig), checked)| {
+                checked?;
+                // Re-check against signatures accepted earlier in the batch
+                if self.already_signed(pos, &sig, None)? {
+                    return Ok(());
+                }
+                self.check_signature(pos, &sig, None)?;
+                self.accept_signature(pos, sig, None)
+            })
+            .collect()
+    }
+
+    /// Add a signature from a participant. Adding the same signature again
+    /// succeeds without counting its weight twice, so submissions can be retried.
+    pub fn add_signature(
+        &mut self,
+        pos: usize,
+        signature: impl Into<SerializableSignature>,
+    ) -> Result<(), CcokError> {
+        self.insert_signature(pos, signature.into(), None)
+    }
+
+    /// Add a signature made with a participant's one-time key for `params.round`
+    pub fn add_one_time_signature(
+        &mut self,
+        pos: usize,
+        signature: impl Into<SerializableSignature>,
+        proof: OneTimeKeyProof,
+    ) -> Result<(), CcokError> {
+        self.insert_signature(pos, signature.into(), Some(proof))
+    }
+
+    fn insert_signature(
+        &mut self,
+        pos: usize,
+        signature: SerializableSignature,
+        one_time_key: Option<OneTimeKeyProof>,
+    ) -> Result<(), CcokError> {
+        if self.already_signed(pos, &signature, one_time_key.as_ref())? {
+            return Ok(());
+        }
+        self.check_signature(pos, &signature, one_time_key.as_ref())?;
+        if let Some(pool) = &self.verify_pool {
+            pool.install(|| self.verify_slot(pos, &signature, one_time_key.as_ref()))?;
+        }
+        self.accept_signature(pos, signature, one_time_key)
+    }
+
+    // Whether the participant already signed with exactly this signature; a
+    // different signature for the same participant is a conflict
+    fn already_signed(
+        &self,
+        pos: usize,
+        signature: &SerializableSignature,
+        one_time_key: Option<&OneTimeKeyProof>,
+    ) -> Result<bool, CcokError> {
+        let slot = match self.sigs.get(pos) {
+            Some(slot) => slot,
+            None => return Ok(false),
+        };
+        match &slot.signature {
+            None => Ok(false),
+            Some(existing)
+                if existing == signature && slot.one_time_key.as_ref() == one_time_key =>
+            {
+                Ok(true)
+            }
+            Some(_) => Err(CcokError::DuplicateSignature(pos)),
         }
+    }
 
-        // Check if we already have this signature
-        if self.sigs[pos].signature.is_some() {
-            return Err(format!("Already have signature for participant {}", pos));
+    // Structural checks of a signature before it is accepted
+    fn check_signature(
+        &self,
+        pos: usize,
+        signature: &SerializableSignature,
+        one_time_key: Option<&OneTimeKeyProof>,
+    ) -> Result<(), CcokError> {
+        // Validate position
+        if pos >= self.participants.len() {
+            return Err(CcokError::InvalidPosition(pos));
         }
 
         // Validate participant weight
         if self.participants[pos].weight == 0 {
-            return Err(format!("Participant {} has zero weight", pos));
+            return Err(CcokError::ZeroWeight(pos));
         }
 
-        // Add signature and update weights
-        self.sigs[pos].signature = Some(SerializableSignature::from(signature));
-        self.signed_weight += self.participants[pos].weight;
+        // The key of a participant committing to its digest must be known to
+        // reveal it
+        if self.participants[pos].reveals_key() {
+            self.public_key(pos)?;
+        }
+
+        // Validate the signature matches the participant's scheme
+        let scheme = self.participants[pos].scheme;
+        if let Some(required) = self.params.scheme {
+            if scheme != required {
+                return Err(CcokError::SchemeMismatch {
+                    pos,
+                    scheme,
+                    required,
+                });
+            }
+        }
+        hybrid::check_signature_len(
+            self.params.signature_mode,
+            scheme,
+            signature.as_bytes().len(),
+        )
+        .map_err(|e| CcokError::Scheme(format!("Participant {}: {}", pos, e)))?;
 
-        // Update accumulated weights
-        if pos > 0 {
-            self.sigs[pos].accumulated_weight =
-                self.sigs[pos - 1].accumulated_weight + self.participants[pos - 1].weight;
+        // Participants committed to one-time keys must sign with the key of this round
+        let invalid_key = |reason: String| CcokError::InvalidOneTimeKey { pos, reason };
+        match (&self.participants[pos].key_commitment, one_time_key) {
+            (Some(commitment), Some(proof)) => {
+                if self.params.round != Some(proof.round) {
+                    return Err(invalid_key(format!(
+                        "one-time key is for round {}, not {:?}",
+                        proof.round, self.params.round
+                    )));
+                }
+                if !proof
+                    .verify(self.params.hashing(), commitment, scheme)
+                    .map_err(invalid_key)?
+                {
+                    return Err(invalid_key("invalid one-time key proof".to_string()));
+                }
+            }
+            (Some(_), None) => {
+                return Err(invalid_key("signs with one-time keys".to_string()));
+            }
+            (None, Some(_)) => {
+                return Err(invalid_key("has no one-time key commitment".to_string()));
+            }
+            (None, None) => {}
         }
 
         Ok(())
     }
 
-    /// Build the certificate once enough signatures are collected
-    pub fn build(&self) -> Result<Certificate, String> {
-        // Check if we have enough weight
-        if self.signed_weight < self.params.proven_weight {
-            return Err(format!(
-                "Insufficient signed weight: {} < {}",
-                self.signed_weight, self.params.proven_weight
-            ));
+    // Verify a signature against the participant's (one-time) public key
+    fn verify_slot(
+        &self,
+        pos: usize,
+        signature: &SerializableSignature,
+        one_time_key: Option<&OneTimeKeyProof>,
+    ) -> Result<(), CcokError> {
+        let party = &self.participants[pos];
+        let public_key = match one_time_key {
+            Some(proof) => &proof.public_key,
+            None => self.public_key(pos)?,
+        };
+        let pubkey_bytes = hex::decode(public_key)?;
+        if !hybrid::verify_signature(
+            self.params.signature_mode,
+            party.scheme,
+            &pubkey_bytes,
+            &self.params.signing_message(),
+            signature.as_bytes(),
+        )
+        .map_err(CcokError::Scheme)?
+        {
+            return Err(CcokError::InvalidSignature(pos));
         }
+        Ok(())
+    }
 
-        // Build Merkle tree for signatures
-        let mut sig_tree = MerkleTreeBuilder::new();
-        sig_tree.build(&self.sigs)?;
+    fn accept_signature(
+        &mut self,
+        pos: usize,
+        signature: SerializableSignature,
+        one_time_key: Option<OneTimeKeyProof>,
+    ) -> Result<(), CcokError> {
+        // Add signature and update weights
+        let weight = self.participants[pos].weight;
+        self.signed_weight = self
+            .signed_weight
+            .checked_add(weight)
+            .ok_or(CcokError::WeightOverflow)?;
+        self.sigs[pos].signature = Some(signature);
+        self.sigs[pos].one_time_key = one_time_key;
 
-        // Build Merkle tree for participants
-        let mut party_tree = MerkleTreeBuilder::new();
-        party_tree.build(&self.participants)?;
-
-        // Calculate the fraction of weight not required for the proof
-        let fraction = 1.0 - (self.params.proven_weight as f64 / self.signed_weight as f64);
-        // K is a tuning constant (here chosen as 0.5) to adjust the number of reveals
-        let num_reveals = std::cmp::max(
-            1,
-            ((self.params.security_param as f64) * fraction * 0.5).ceil() as usize,
+        // Update accumulated weights: every later slot now follows this signer,
+        // keeping each slot's L-value the weight signed before it. Each is at
+        // most the signed weight, so none overflows.
+        for slot in &mut self.sigs[pos + 1..] {
+            slot.accumulated_weight += weight;
+        }
+        debug!(
+            target: BUILDER,
+            "Accepted signature of position {}, signed weight {} of {}",
+            pos,
+            self.signed_weight,
+            self.params.proven_weight
         );
+        METRICS.record_signature(self.signed_weight, self.params.proven_weight);
+        Ok(())
+    }
 
-        // Instead of collecting unsorted reveals, collect reveal information as (position, coin_index)
-        let mut reveal_map = HashMap::new();
-        let mut reveal_info: Vec<(usize, u64)> = Vec::new();
+    /// Build the certificate once enough signatures are collected
+    pub fn build(&self) -> Result<Certificate, CcokError> {
+        self.build_with_context(&Context::background())
+    }
 
-        // Choose positions to reveal using coin flips
-        for i in 0..num_reveals {
-            let choice = self.coin_choice(i as u64, &sig_tree.root());
-            let pos = self.find_coin_position(choice)? as usize;
+    /// Build the certificate, giving up once `ctx` is cancelled or expires
+    pub fn build_with_context(&self, ctx: &Context) -> Result<Certificate, CcokError> {
+        self.build_from(ctx, &self.sigs)
+    }
+
+    /// Build a certificate that only depends on the set of signatures and the
+    /// params, not on the order they were added in, so independent builders
+    /// can cross-check each other's `Certificate::digest`
+    pub fn build_deterministic(&self) -> Result<Certificate, CcokError> {
+        // Accumulated weights are recomputed from the final signature set
+        let mut sigs = self.sigs.clone();
+        let mut acc = 0u64;
+        for (slot, party) in sigs.iter_mut().zip(&self.participants) {
+            slot.accumulated_weight = acc;
+            if slot.signature.is_some() {
+                acc = acc
+                    .checked_add(party.weight)
+                    .ok_or(CcokError::WeightOverflow)?;
+            }
+        }
+        self.build_from(&Context::background(), &sigs)
+    }
+
+    fn build_from(&self, ctx: &Context, sigs: &[SigSlot]) -> Result<Certificate, CcokError> {
+        let _timer = METRICS.cert_build_seconds.start_timer();
+        let mut span = telemetry::span("build");
+        span.set_attribute("participants", sigs.len());
+        span.set_attribute("signed_weight", self.signed_weight);
+        // Check if we have enough weight
+        if self.signed_weight < self.params.proven_weight {
+            return Err(CcokError::InsufficientWeight {
+                signed: self.signed_weight,
+                proven: self.params.proven_weight,
+            });
+        }
+        if !SUPPORTED_VERSIONS.contains(&self.params.version) {
+            return Err(CcokError::UnsupportedVersion(self.params.version));
+        }
+        // More signatures bring the coins the security parameter needs under the cap
+        if self.params.version >= PARAMS_V3
+            && v3_coins(&self.params, self.signed_weight) > MAX_COINS as f64
+        {
+            return Err(CcokError::InsufficientWeight {
+                signed: self.signed_weight,
+                proven: self.params.proven_weight,
+            });
+        }
+
+        // In the aggregate mode the signature tree commits to the nonces only,
+        // the rest of each signature being folded into the aggregate
+        let aggregated = self.params.signature_mode == Some(SignatureMode::Aggregate);
+        let signed = sigs;
+        let nonces = aggregated
+            .then(|| {
+                sigs.iter()
+                    .map(SigSlot::with_nonce)
+                    .collect::<Result<Vec<_>, _>>()
+            })
+            .transpose()?;
+        let sigs = nonces.as_deref().unwrap_or(sigs);
+
+        // Commit to the signatures, and from PARAMS_V5 to their weights,
+        // before deriving any coin from the commitment
+        let tree_span = telemetry::span("sig_tree_build");
+        let sig_tree = if self.params.version >= PARAMS_V5 {
+            SigTree::Sum(self.sig_sum_tree(sigs)?)
+        } else {
+            let mut tree = MerkleTreeBuilder::with_hash(self.params.hashing());
+            tree.build_parallel_with_context(ctx, sigs)?;
+            SigTree::Plain(tree)
+        };
+        drop(tree_span);
+
+        // Build Merkle tree for participants
+        let tree_span = telemetry::span("party_tree_build");
+        let mut party_tree = MerkleTreeBuilder::with_hash(self.params.hashing());
+        party_tree.build_parallel_with_context(ctx, &self.participants)?;
+        drop(tree_span);
+
+        let num_reveals = self.num_reveals(self.signed_weight);
+        span.set_attribute("coins", num_reveals);
+        let coin_span = telemetry::span("coin_derivation");
+
+        // Instead of collecting unsorted reveals, collect reveal information as (position, coin_index)
+        let mut reveal_map = BTreeMap::new();
+        let mut reveal_info: Vec<(usize, u64)> = Vec::new();
+
+        // Choose positions to reveal using coin flips, over weights and a
+        // commitment computed once for every coin
+        let sig_commit = match &sig_tree {
+            SigTree::Plain(tree) => tree.root(),
+            SigTree::Sum(tree) => tree.root().hash.to_vec(),
+        };
+        let cum_weights = self.signed_cum_weights()?;
+        let seed = (self.params.version >= PARAMS_V4).then(|| {
+            coin_seed(
+                &self.params,
+                &sig_commit,
+                self.signed_weight,
+                &self.party_tree_root,
+            )
+        });
+        for i in 0..num_reveals {
+            ctx.check()?;
+            let choice = match &seed {
+                Some(seed) => coin_from_seed(&self.params, seed, i as u64, self.signed_weight),
+                None => self.coin_choice(i as u64, &sig_commit),
+            };
+            let pos = find_cum_position(&cum_weights, choice)? as usize;
 
             if !reveal_map.contains_key(&(pos as u64)) {
                 reveal_map.insert(
                     pos as u64,
                     Reveal {
-                        sig_slot: self.sigs[pos].clone(),
+                        sig_slot: sigs[pos].clone(),
                         party: self.participants[pos].clone(),
+                        public_key: self.revealed_key(pos).cloned(),
                     },
                 );
                 reveal_info.push((pos, i as u64));
             }
         }
 
+        drop(coin_span);
+
         // Sort reveal_info by position
+        let _reveal_span = telemetry::span("reveal_assembly");
         reveal_info.sort_by_key(|(pos, _)| *pos);
         let sorted_positions: Vec<usize> = reveal_info.iter().map(|(pos, _)| *pos).collect();
         let sorted_coin_indices: Vec<u64> =
             reveal_info.iter().map(|(_, coin_idx)| *coin_idx).collect();
 
         // Generate proofs for both signatures and participants using sorted positions
-        let sig_proofs = sig_tree.prove(&sorted_positions);
+        let (sig_proofs, sig_sum_proofs) = match &sig_tree {
+            SigTree::Plain(tree) => (tree.prove(&sorted_positions), None),
+            SigTree::Sum(tree) => (
+                Vec::new(),
+                Some(
+                    sorted_positions
+                        .iter()
+                        .map(|&pos| tree.prove(pos))
+                        .collect::<Result<Vec<_>, CcokError>>()?,
+                ),
+            ),
+        };
         let party_proofs = party_tree.prove(&sorted_positions);
+        let party_sum_proofs = match &self.sum_tree {
+            Some(tree) => Some(
+                sorted_positions
+                    .iter()
+                    .map(|&pos| tree.prove(pos))
+                    .collect::<Result<Vec<_>, CcokError>>()?,
+            ),
+            None => None,
+        };
+
+        let aggregate_sig = if aggregated {
+            self.aggregate_signatures(signed, &sorted_positions)?
+        } else {
+            Vec::new()
+        };
+
+        let mut schemes: Vec<SchemeId> = reveal_map.values().map(|r| r.party.scheme).collect();
+        schemes.sort();
+        schemes.dedup();
 
+        info!(
+            target: BUILDER,
+            "Built certificate of {} reveals over {} coins, signed weight {} of {}",
+            sorted_positions.len(),
+            num_reveals,
+            self.signed_weight,
+            self.params.proven_weight
+        );
         Ok(Certificate {
-            sig_commit: sig_tree.root(),
+            sig_commit,
             signed_weight: self.signed_weight,
-            total_sigs: self.sigs.len(),
+            total_sigs: sigs.len(),
             reveals: reveal_map,
             sig_proofs,
             party_proofs,
             reveal_positions: sorted_positions.iter().map(|&p| p as u64).collect(),
             reveal_indices: sorted_coin_indices,
+            schemes,
+            compressed_sig_proofs: None,
+            compressed_party_proofs: None,
+            hash: self.params.hash,
+            version: self.params.version,
+            party_sum_proofs,
+            coin_seed: seed.map(Vec::from).unwrap_or_default(),
+            sig_sum_proofs,
+            aggregate_sig,
         })
     }
 
+    // Half-aggregate of the signatures at `positions`, in order, each under
+    // the Schnorr key it was made with
+    fn aggregate_signatures(
+        &self,
+        sigs: &[SigSlot],
+        positions: &[usize],
+    ) -> Result<Vec<u8>, CcokError> {
+        let mut keys = Vec::with_capacity(positions.len());
+        for &pos in positions {
+            let public_key = match &sigs[pos].one_time_key {
+                Some(proof) => &proof.public_key,
+                None => self.public_key(pos)?,
+            };
+            keys.push(hex::decode(public_key)?);
+        }
+        let mut entries = Vec::with_capacity(positions.len());
+        for (&pos, key) in positions.iter().zip(&keys) {
+            let signature = sigs[pos]
+                .signature
+                .as_ref()
+                .ok_or(CcokError::InvalidReveal(pos as u64))?;
+            let key = hybrid::signing_key(
+                self.params.signature_mode,
+                self.participants[pos].scheme,
+                key,
+            )
+            .map_err(CcokError::Scheme)?;
+            entries.push((key, signature.as_bytes()));
+        }
+        halfagg::aggregate(&entries, &self.params.signing_message()).map_err(CcokError::Scheme)
+    }
+
+    // Sum tree over `sigs`, of the participant weight where signed
+    fn sig_sum_tree(&self, sigs: &[SigSlot]) -> Result<SumTree, CcokError> {
+        let hashing = self.params.hashing();
+        let leaves = sigs
+            .iter()
+            .zip(&self.participants)
+            .enumerate()
+            .map(|(i, (slot, party))| {
+                let weight = if slot.signature.is_some() {
+                    party.weight
+                } else {
+                    0
+                };
+                WeightedLeaf::from_sig_slot(hashing, i, slot, weight)
+            })
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        SumTree::build(hashing, &leaves)
+    }
+
+    // Number of coin flips for a certificate with `signed_weight`
+    fn num_reveals(&self, signed_weight: u64) -> usize {
+        num_coins(&self.params, signed_weight)
+    }
+
+    /// Predict the serialized size in bytes of a certificate with `signed_weight`,
+    /// assuming the signers are spread over the participants by weight
+    pub fn estimate_cert_size(&self, signed_weight: u64) -> Result<usize, CcokError> {
+        if signed_weight == 0 || signed_weight < self.params.proven_weight {
+            return Err(CcokError::InsufficientWeight {
+                signed: signed_weight,
+                proven: self.params.proven_weight,
+            });
+        }
+        let total_weight: u64 = self.participants.iter().map(|p| p.weight).sum();
+        if total_weight == 0 {
+            return Err(CcokError::NoSignatures);
+        }
+        let coins = self.num_reveals(signed_weight) as i32;
+
+        // Expected number of distinct reveals and their size, each coin picking a
+        // participant with probability proportional to its weight
+        let mut reveals = 0.0;
+        let mut reveal_bytes = 0.0;
+        let mut schemes = Vec::new();
+        for party in &self.participants {
+            let picked = 1.0 - (1.0 - party.weight as f64 / total_weight as f64).powi(coins);
+            if picked == 0.0 {
+                continue;
+            }
+            let info = lookup_scheme(party.scheme).map_err(CcokError::Scheme)?;
+            let party_size = bincode::serialized_size(party)?;
+            // Position key, signature, accumulated weight and one-time key option
+            let mut slot_size = 8 + 1 + 8 + info.sig_size + 8 + 1;
+            if let Some(commitment) = &party.key_commitment {
+                let depth = tree_depth(commitment.lifetime.rounds as usize);
+                slot_size += 8 + 8 + 2 * info.pk_size + 8 + depth * 40;
+            }
+            // Hex key option of a participant committing to its key digest
+            slot_size += 1;
+            if party.reveals_key() {
+                slot_size += 8 + 2 * info.pk_size;
+            }
+            reveals += picked;
+            reveal_bytes += picked * (slot_size as f64 + party_size as f64);
+            schemes.push(party.scheme);
+        }
+        schemes.sort();
+        schemes.dedup();
+
+        // Multiproof hashes: each reveal needs the part of its path not shared with others
+        let n = self.participants.len();
+        let proof_hashes = reveals * (tree_depth(n) as f64 - reveals.log2().floor()).max(0.0);
+
+        // Commitment, weights, reveal map, both proofs, positions, indices and schemes
+        let fixed = 40 + 8 + 8 + 8 + 2 * 8 + 2 * 8 + 8 + 2 * schemes.len();
+        let variable = reveal_bytes + 2.0 * proof_hashes * 40.0 + 2.0 * reveals * 8.0;
+        Ok(fixed + variable.ceil() as usize)
+    }
+
     // Helper function to generate deterministic random choice
     fn coin_choice(&self, index: u64, sig_commit: &[u8]) -> u64 {
-        let mut hasher = Keccak256::new();
-        hasher.update(&index.to_le_bytes());
-        hasher.update(&self.signed_weight.to_le_bytes());
-        hasher.update(&self.params.proven_weight.to_le_bytes());
-        hasher.update(sig_commit);
-        hasher.update(&self.party_tree_root);
-        hasher.update(&self.params.msg);
-
-        let hash = hasher.finalize();
-        let mut bytes = [0u8; 8];
-        bytes.copy_from_slice(&hash[0..8]);
-
-        u64::from_le_bytes(bytes) % self.signed_weight
+        coin_value(
+            &self.params,
+            index,
+            sig_commit,
+            self.signed_weight,
+            &self.party_tree_root,
+        )
     }
 
-    // Updated: Find the participant position based on coin value using cumulative weights of signed slots
-    fn find_coin_position(&self, coin_value: u64) -> Result<u64, String> {
-        // Build a vector of (index, cumulative_weight) for only signed slots
-        let mut cum_weights = Vec::new();
+    // (index, cumulative weight) of the signed slots
+    fn signed_cum_weights(&self) -> Result<Vec<(usize, u64)>, CcokError> {
+        let mut cum_weights = Vec::with_capacity(self.sigs.len());
         let mut cum = 0u64;
         for (i, slot) in self.sigs.iter().enumerate() {
             if slot.signature.is_some() {
-                cum += self.participants[i].weight;
+                cum = cum
+                    .checked_add(self.participants[i].weight)
+                    .ok_or(CcokError::WeightOverflow)?;
                 cum_weights.push((i, cum));
             }
         }
+        Ok(cum_weights)
+    }
+}
+
+// Find the participant position based on coin value: the first signed slot
+// whose cumulative weight exceeds it
+fn find_cum_position(cum_weights: &[(usize, u64)], coin_value: u64) -> Result<u64, CcokError> {
+    // Check that there is at least one signed slot
+    if cum_weights.is_empty() {
+        return Err(CcokError::NoSignatures);
+    }
 
-        // Check that there is at least one signed slot
-        if cum_weights.is_empty() {
-            return Err("No signatures available".to_string());
+    // Perform binary search on cum_weights to find the first slot where cumulative weight exceeds coin_value
+    let mut lo = 0;
+    let mut hi = cum_weights.len();
+    while lo < hi {
+        let mid = (lo + hi) / 2;
+        let (_, weight_mid) = cum_weights[mid];
+        if coin_value < weight_mid {
+            hi = mid;
+        } else {
+            lo = mid + 1;
         }
+    }
 
-        // Perform binary search on cum_weights to find the first slot where cumulative weight exceeds coin_value
-        let mut lo = 0;
-        let mut hi = cum_weights.len();
-        while lo < hi {
-            let mid = (lo + hi) / 2;
-            let (_, weight_mid) = cum_weights[mid];
-            if coin_value < weight_mid {
-                hi = mid;
-            } else {
-                lo = mid + 1;
+    if lo < cum_weights.len() {
+        Ok(cum_weights[lo].0 as u64)
+    } else {
+        Err(CcokError::NoSignatures)
+    }
+}
+
+/// Number of coins flipped for a certificate with `signed_weight`: from
+/// `PARAMS_V3`, `ceil(security_param / log2(signed_weight / proven_weight))`
+/// capped at `MAX_COINS`, before it
+/// `ceil(security_param * (1 - proven_weight / signed_weight) / 2)`; at least 1
+pub fn num_coins(params: &Params, signed_weight: u64) -> usize {
+    if params.version >= PARAMS_V3 {
+        let coins = v3_coins(params, signed_weight);
+        return if coins < MAX_COINS as f64 {
+            std::cmp::max(1, coins as usize)
+        } else {
+            MAX_COINS
+        };
+    }
+    // Calculate the fraction of weight not required for the proof
+    let fraction = 1.0 - (params.proven_weight as f64 / signed_weight as f64);
+    // K is a tuning constant (here chosen as 0.5) to adjust the number of reveals
+    std::cmp::max(
+        1,
+        ((params.security_param as f64) * fraction * 0.5).ceil() as usize,
+    )
+}
+
+// Coins the security parameter needs, infinite when the signed weight
+// doesn't exceed the proven weight
+fn v3_coins(params: &Params, signed_weight: u64) -> f64 {
+    let ratio = signed_weight as f64 / params.proven_weight as f64;
+    (params.security_param as f64 / ratio.log2()).ceil()
+}
+
+/// Fiat-Shamir coin `index` of a certificate, in `[0, signed_weight)`.
+///
+/// Before `PARAMS_V4`, the coin is the first 8 bytes, little-endian, of the
+/// `Coin` domain hash of
+/// `index || signed_weight || proven_weight || sig_commit || party_tree_root || msg`,
+/// integers as 8 little-endian bytes and `msg` untagged, reduced mod `signed_weight`.
+/// From `PARAMS_V4` it is `coin_from_seed` of the `coin_seed`.
+pub fn coin_value(
+    params: &Params,
+    index: u64,
+    sig_commit: &[u8],
+    signed_weight: u64,
+    party_tree_root: &[u8],
+) -> u64 {
+    if params.version >= PARAMS_V4 {
+        let seed = coin_seed(params, sig_commit, signed_weight, party_tree_root);
+        return coin_from_seed(params, &seed, index, signed_weight);
+    }
+    let hash = params.hashing().hash_parts(
+        HashDomain::Coin,
+        &[
+            &index.to_le_bytes(),
+            &signed_weight.to_le_bytes(),
+            &params.proven_weight.to_le_bytes(),
+            sig_commit,
+            party_tree_root,
+            &params.msg,
+        ],
+    );
+    let mut bytes = [0u8; 8];
+    bytes.copy_from_slice(&hash[0..8]);
+
+    u64::from_le_bytes(bytes) % signed_weight
+}
+
+/// Seed of the coins of a `PARAMS_V4` certificate: the `CoinSeed` domain
+/// hash of `signed_weight || proven_weight || sig_commit || party_tree_root ||
+/// signing_message`, integers as 8 little-endian bytes. It is fixed once the
+/// signatures are committed, so a builder can only change the coins by
+/// changing the signatures it commits to, and the certificate records it so
+/// auditors can check every coin against it with `verify_coin_derivation`.
+pub fn coin_seed(
+    params: &Params,
+    sig_commit: &[u8],
+    signed_weight: u64,
+    party_tree_root: &[u8],
+) -> [u8; 32] {
+    params.hashing().hash_parts(
+        HashDomain::CoinSeed,
+        &[
+            &signed_weight.to_le_bytes(),
+            &params.proven_weight.to_le_bytes(),
+            sig_commit,
+            party_tree_root,
+            &params.signing_message(),
+        ],
+    )
+}
+
+/// Coin `index` of `seed`: the first 8 bytes, little-endian, of the `Coin`
+/// domain hash of `seed || index`, reduced mod `signed_weight`
+pub fn coin_from_seed(params: &Params, seed: &[u8; 32], index: u64, signed_weight: u64) -> u64 {
+    let hash = params
+        .hashing()
+        .hash_parts(HashDomain::Coin, &[seed, &index.to_le_bytes()]);
+    let mut bytes = [0u8; 8];
+    bytes.copy_from_slice(&hash[0..8]);
+    u64::from_le_bytes(bytes) % signed_weight
+}
+
+// Depth of a binary Merkle tree with `leaves` leaves
+fn tree_depth(leaves: usize) -> usize {
+    leaves.next_power_of_two().trailing_zeros() as usize
+}
+
+// Signature tree of a certificate being built
+enum SigTree {
+    Plain(MerkleTreeBuilder),
+    Sum(SumTree),
+}
+
+/// Setup shared by certificates verified against the same party tree root:
+/// the participant leaves already proven, decoded public keys, domain tagged
+/// signing messages and registered schemes. Relayers keep one per root
+/// across `Verifier::verify_with_cache` calls.
+#[derive(Debug, Default)]
+pub struct VerifierCache {
+    /// Party tree root the cached leaves were proven against
+    party_tree_root: Vec<u8>,
+    /// Participant leaf hashes already proven in the tree, keyed by (tree size, position)
+    leaves: HashMap<(usize, usize), [u8; 32]>,
+    /// Decoded public keys, keyed by their hex encoding
+    public_keys: HashMap<String, Vec<u8>>,
+    /// Signing messages of domain separated params, keyed by `Params::msg`
+    /// and `Params::binding`
+    messages: HashMap<MessageKey, Vec<u8>>,
+    /// Schemes looked up in the registry, which never drops a scheme
+    schemes: HashMap<SchemeId, SchemeInfo>,
+}
+
+impl VerifierCache {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Drop everything cached, e.g. when the participant set changes
+    pub fn clear(&mut self) {
+        *self = Self::default();
+    }
+
+    /// Number of participant leaves proven so far
+    pub fn proven_leaves(&self) -> usize {
+        self.leaves.len()
+    }
+
+    // Start over when used against another root, whose leaves differ
+    fn bind(&mut self, party_tree_root: &[u8]) {
+        if self.party_tree_root != party_tree_root {
+            self.leaves.clear();
+            self.party_tree_root = party_tree_root.to_vec();
+        }
+    }
+
+    // Registry entry of `scheme`, looked up once
+    fn scheme(&mut self, scheme: SchemeId) -> Result<&SchemeInfo, CcokError> {
+        if !self.schemes.contains_key(&scheme) {
+            let info = lookup_scheme(scheme).map_err(CcokError::Scheme)?;
+            self.schemes.insert(scheme, info);
+        }
+        Ok(&self.schemes[&scheme])
+    }
+}
+
+type MessageKey = (Vec<u8>, Option<(u64, Purpose, Option<u64>)>);
+
+/// Verifier for certificates over a fixed party tree
+#[derive(Debug, Clone)]
+pub struct Verifier {
+    /// Root hash of the participant Merkle tree
+    pub party_tree_root: Vec<u8>,
+    /// Certificate versions the verifier accepts
+    pub versions: Vec<u8>,
+    /// Root of the participant sum tree; when set, certificates must prove
+    /// their revealed weights against its committed total
+    pub party_sum_root: Option<SumNode>,
+    /// Least fraction of the committed total weight, as numerator and
+    /// denominator, the params of a certificate must prove
+    pub min_proven_ratio: Option<(u64, u64)>,
+    /// Chain id and purpose the params of a certificate must bind its
+    /// signed message to, along with a round
+    pub binding: Option<(u64, Purpose)>,
+    /// Pool checking the reveals of a certificate concurrently
+    pool: Option<Arc<rayon::ThreadPool>>,
+}
+
+impl Verifier {
+    /// Verifier accepting every supported version
+    pub fn new(party_tree_root: Vec<u8>) -> Self {
+        Self {
+            party_tree_root,
+            versions: SUPPORTED_VERSIONS.to_vec(),
+            party_sum_root: None,
+            min_proven_ratio: None,
+            binding: None,
+            pool: None,
+        }
+    }
+
+    /// Verifier for certificates under `params` over participants of
+    /// `total_weight`, refusing params `Params::validate_for` refuses, as
+    /// `Builder::new` does
+    pub fn for_params(
+        party_tree_root: Vec<u8>,
+        params: &Params,
+        total_weight: u64,
+    ) -> Result<Self, CcokError> {
+        if party_tree_root.is_empty() {
+            return Err(CcokError::InvalidParams(
+                "party tree root must not be empty".to_string(),
+            ));
+        }
+        params.validate_for(total_weight)?;
+        Ok(Self::new(party_tree_root))
+    }
+
+    /// Also check certificates against the participant sum tree `root`
+    pub fn with_sum_root(mut self, root: SumNode) -> Self {
+        self.party_sum_root = Some(root);
+        self
+    }
+
+    /// Refuse params proving less than `numerator / denominator` of the total
+    /// weight committed by the sum tree root, e.g. 2/3, so a builder can't
+    /// pass a certificate off under a trivial threshold
+    pub fn with_min_proven_ratio(
+        mut self,
+        numerator: u64,
+        denominator: u64,
+    ) -> Result<Self, CcokError> {
+        if denominator == 0 || numerator > denominator {
+            return Err(CcokError::InvalidParams(format!(
+                "proven weight ratio {}/{} not in [0, 1]",
+                numerator, denominator
+            )));
+        }
+        self.min_proven_ratio = Some((numerator, denominator));
+        Ok(self)
+    }
+
+    /// Refuse params not bound to `chain_id`, `purpose` and a round, so a
+    /// certificate from a fork, another round or for another purpose doesn't
+    /// pass for one of this chain
+    pub fn with_binding(mut self, chain_id: u64, purpose: Purpose) -> Self {
+        self.binding = Some((chain_id, purpose));
+        self
+    }
+
+    /// Verify the reveal signatures and the two Merkle multiproofs of each
+    /// certificate on a pool of `workers` threads, for large certificates
+    pub fn with_workers(mut self, workers: usize) -> Result<Self, String> {
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(workers)
+            .build()
+            .map_err(|e| format!("Failed to create verification pool: {}", e))?;
+        self.pool = Some(Arc::new(pool));
+        Ok(self)
+    }
+
+    /// Only accept certificates of `versions`, e.g. to stop accepting a
+    /// deprecated version after an upgrade
+    pub fn with_versions(mut self, versions: &[u8]) -> Result<Self, CcokError> {
+        if let Some(version) = versions.iter().find(|v| !SUPPORTED_VERSIONS.contains(v)) {
+            return Err(CcokError::UnsupportedVersion(*version));
+        }
+        self.versions = versions.to_vec();
+        Ok(self)
+    }
+
+    /// Highest version both this verifier and a peer offering `offered` accept
+    pub fn negotiate(&self, offered: &[u8]) -> Option<u8> {
+        self.versions
+            .iter()
+            .filter(|v| offered.contains(v))
+            .max()
+            .copied()
+    }
+
+    fn check_version(&self, cert: &Certificate) -> Result<(), CcokError> {
+        if !self.versions.contains(&cert.version) {
+            return Err(CcokError::UnsupportedVersion(cert.version));
+        }
+        Ok(())
+    }
+
+    fn check_binding(&self, params: &Params) -> Result<(), CcokError> {
+        let Some((chain_id, purpose)) = self.binding else {
+            return Ok(());
+        };
+        match params.binding() {
+            Some((id, p, Some(_))) if id == chain_id && p == purpose => Ok(()),
+            binding => Err(CcokError::InvalidParams(format!(
+                "params bound to {:?}, expected chain {} for {:?} at a round",
+                binding, chain_id, purpose
+            ))),
+        }
+    }
+
+    // Check the params against the proven weight ratio, then the certificate
+    // against the sum tree root
+    fn check_weights(&self, cert: &Certificate, params: &Params) -> Result<bool, CcokError> {
+        let root = match &self.party_sum_root {
+            Some(root) => root,
+            None if self.min_proven_ratio.is_some() => {
+                return Err(CcokError::InvalidParams(
+                    "proven weight ratio needs the sum tree root".to_string(),
+                ))
+            }
+            None => return Ok(true),
+        };
+        if let Some((numerator, denominator)) = self.min_proven_ratio {
+            if (params.proven_weight as u128) * (denominator as u128)
+                < (root.sum as u128) * (numerator as u128)
+            {
+                return Err(CcokError::InvalidParams(format!(
+                    "proven weight {} below {}/{} of committed total {}",
+                    params.proven_weight, numerator, denominator, root.sum
+                )));
             }
         }
+        cert.verify_weights(params, root)
+    }
 
-        if lo < cum_weights.len() {
-            Ok(cum_weights[lo].0 as u64)
-        } else {
-            Err("Could not find position for coin value".to_string())
+    /// Verify a single certificate
+    pub fn verify(&self, cert: &Certificate, params: &Params) -> Result<bool, CcokError> {
+        self.verify_with_context(&Context::background(), cert, params)
+    }
+
+    /// Verify a single certificate, giving up once `ctx` is cancelled or expires
+    pub fn verify_with_context(
+        &self,
+        ctx: &Context,
+        cert: &Certificate,
+        params: &Params,
+    ) -> Result<bool, CcokError> {
+        self.verify_certificate(ctx, &mut VerifierCache::default(), cert, params)
+    }
+
+    /// Verify a certificate reusing the setup `cache` holds from earlier
+    /// certificates over the same party tree root
+    pub fn verify_with_cache(
+        &self,
+        cache: &mut VerifierCache,
+        cert: &Certificate,
+        params: &Params,
+    ) -> Result<bool, CcokError> {
+        self.verify_certificate(&Context::background(), cache, cert, params)
+    }
+
+    fn verify_certificate(
+        &self,
+        ctx: &Context,
+        cache: &mut VerifierCache,
+        cert: &Certificate,
+        params: &Params,
+    ) -> Result<bool, CcokError> {
+        let _timer = METRICS.cert_verify_seconds.start_timer();
+        self.check_version(cert)?;
+        self.check_binding(params)?;
+        cache.bind(&self.party_tree_root);
+        if !cert.verify_cached(
+            ctx,
+            params,
+            &self.party_tree_root,
+            cache,
+            self.pool.as_deref(),
+        )? {
+            return Ok(false);
         }
+        self.check_weights(cert, params)
+    }
+
+    /// Verify many certificates, sharing the participant membership proofs and
+    /// public key decoding across them. Returns one result per certificate, in order.
+    pub fn verify_batch<'a>(
+        &self,
+        batch: impl IntoIterator<Item = (&'a Certificate, &'a Params)>,
+    ) -> Vec<Result<bool, CcokError>> {
+        let mut cache = VerifierCache::default();
+        batch
+            .into_iter()
+            .map(|(cert, params)| self.verify_with_cache(&mut cache, cert, params))
+            .collect()
     }
 }
 
 impl Certificate {
-    /// Verify the certificate's validity
-    pub fn verify(&self, params: &Params, party_tree_root: &[u8]) -> Result<bool, String> {
-        println!("Starting verification...");
-
-        // 1. Check if signed weight meets the threshold
-        if self.signed_weight < params.proven_weight {
-            println!(
-                "Weight check failed: {} < {}",
-                self.signed_weight, params.proven_weight
+    /// Check the revealed participants and weights against the participant
+    /// sum tree `root`, whose total a builder can't misstate
+    pub fn verify_weights(&self, params: &Params, root: &SumNode) -> Result<bool, CcokError> {
+        let paths = match &self.party_sum_proofs {
+            Some(paths) if paths.len() == self.reveal_positions.len() => paths,
+            _ => {
+                debug!(target: VERIFIER, "Missing sum tree proofs");
+                return Ok(false);
+            }
+        };
+        if self.signed_weight > root.sum {
+            debug!(target: VERIFIER,
+                "Signed weight exceeds committed total: {} > {}",
+                self.signed_weight, root.sum
             );
             return Ok(false);
         }
-        println!("Weight threshold check passed");
-
-        // 2. Verify each revealed signature
-        let mut verified_weight = 0u64;
-        let mut sig_slots = Vec::new();
-        let mut participants = Vec::new();
-        let mut positions = Vec::new();
 
-        println!(
-            "Verifying {} revealed signatures...",
-            self.reveal_positions.len()
-        );
-        for pos in &self.reveal_positions {
+        let hashing = params.hashing();
+        for (pos, path) in self.reveal_positions.iter().zip(paths) {
             let reveal = self
                 .reveals
                 .get(pos)
-                .ok_or_else(|| format!("Missing reveal for position {}", pos))?;
-            // println!("Verifying position {}...", pos);
-            // Verify the signature exists
-            let signature = match &reveal.sig_slot.signature {
-                Some(sig) => sig.clone(),
-                None => {
-                    println!("No signature found at position {}", pos);
+                .ok_or(CcokError::InvalidReveal(*pos))?;
+            let leaf = WeightedLeaf::from_participant(*pos as usize, &reveal.party)?;
+            if path.total_leaves != self.total_sigs {
+                debug!(target: VERIFIER, "Sum tree proof failed for position {}", pos);
+                return Ok(false);
+            }
+            let offset = match path.verify(hashing, root, &leaf) {
+                Ok(offset) => offset,
+                Err(_) => {
+                    debug!(target: VERIFIER, "Sum tree proof failed for position {}", pos);
                     return Ok(false);
                 }
             };
-
-            // Convert hex public key to PublicKey
-            let pubkey_bytes = hex::decode(&reveal.party.public_key)
-                .map_err(|e| format!("Invalid public key hex: {}", e))?;
-            let public_key: [u8; 1312] = pubkey_bytes
-                .try_into()
-                .map_err(|_| "Invalid public key length")?;
-
-            // Convert signature for verification
-            let sig: Signature = signature
-                .try_into()
-                .map_err(|e| format!("Invalid signature: {}", e))?;
-
-            // Verify the signature
-            let pk = PublicKey::from_bytes(&public_key);
-            if !pk.verify(&params.msg, &sig) {
-                println!("Signature verification failed for position {}", pos);
+            // The weight accumulated before a reveal can't exceed the committed
+            // weight of the participants before it
+            if reveal.sig_slot.accumulated_weight > offset {
+                debug!(target: VERIFIER, "Inconsistent accumulated weight at position {}", pos);
                 return Ok(false);
             }
-            // println!("Signature at position {} verified successfully", pos);
-
-            verified_weight += reveal.party.weight;
-            sig_slots.push(reveal.sig_slot.clone());
-            participants.push(reveal.party.clone());
-            positions.push(*pos as usize);
         }
+        Ok(true)
+    }
 
-        // 4. Verify signature Merkle proofs
-        let mut sig_tree = MerkleTreeBuilder::new();
-        sig_tree.build(&sig_slots)?;
-        println!("Built signature Merkle tree");
+    /// Re-derive every coin of the certificate and the position it lands on,
+    /// from the certificate, its params and the party tree root alone.
+    ///
+    /// Coins are computed by `coin_value` for indices `0..num_coins` and land
+    /// on the reveal whose accumulated weight `L` and participant weight
+    /// satisfy `L <= coin < L + weight`; a coin landing on no reveal means
+    /// the builder left out a position it had to reveal.
+    pub fn coin_flips(
+        &self,
+        params: &Params,
+        party_tree_root: &[u8],
+    ) -> Result<Vec<CoinFlip>, CcokError> {
+        if self.hash != params.hash {
+            return Err(CcokError::HashMismatch {
+                cert: self.hash,
+                params: params.hash,
+            });
+        }
+        if self.version != params.version {
+            return Err(CcokError::VersionMismatch {
+                cert: self.version,
+                params: params.version,
+            });
+        }
+        if self.signed_weight == 0 {
+            return Err(CcokError::NoSignatures);
+        }
 
-        // Prepare sorted (position, leaf_hash) pairs for signature leaves
-        let mut sig_pairs: Vec<(usize, [u8; 32])> = positions
+        // Reveals ordered by position have increasing accumulated weights
+        let ranges: Vec<(u64, u64, u64)> = self
+            .reveals
             .iter()
-            .cloned()
-            .zip(sig_slots.iter().map(|slot| {
-                let bytes = bincode::serialize(slot)
-                    .map_err(|e| format!("Serialization error: {}", e))
-                    .unwrap();
-                <CustomHasher as Hasher>::hash(&bytes)
-            }))
-            .collect();
-        sig_pairs.sort_by_key(|(pos, _)| *pos);
-        let sorted_sig_positions: Vec<usize> = sig_pairs.iter().map(|(p, _)| *p).collect();
-        let sorted_sig_leaves: Vec<[u8; 32]> = sig_pairs.iter().map(|(_, hash)| *hash).collect();
+            .map(|(pos, reveal)| {
+                let start = reveal.sig_slot.accumulated_weight;
+                let end = start
+                    .checked_add(reveal.party.weight)
+                    .ok_or(CcokError::WeightOverflow)?;
+                Ok((*pos, start, end))
+            })
+            .collect::<Result<_, CcokError>>()?;
+        let seed = (params.version >= PARAMS_V4).then(|| {
+            coin_seed(
+                params,
+                &self.sig_commit,
+                self.signed_weight,
+                party_tree_root,
+            )
+        });
+        (0..num_coins(params, self.signed_weight) as u64)
+            .map(|index| {
+                let coin = match &seed {
+                    Some(seed) => coin_from_seed(params, seed, index, self.signed_weight),
+                    None => coin_value(
+                        params,
+                        index,
+                        &self.sig_commit,
+                        self.signed_weight,
+                        party_tree_root,
+                    ),
+                };
+                let i = ranges.partition_point(|(_, _, end)| *end <= coin);
+                match ranges.get(i) {
+                    Some(&(position, start, _)) if start <= coin => Ok(CoinFlip {
+                        index,
+                        coin,
+                        position,
+                    }),
+                    _ => Err(CcokError::UnrevealedCoin { index, coin }),
+                }
+            })
+            .collect()
+    }
 
-        if !MerkleTreeBuilder::verify(
-            &self.sig_commit,
-            &self.sig_proofs,
-            &sorted_sig_positions,
-            self.total_sigs,
-            &sorted_sig_leaves,
-        ) {
-            println!("Signature Merkle proof verification failed");
+    /// Audit the reveal selection: the certificate commits to the seed its
+    /// parameters and commitments give, and lists exactly the positions its
+    /// coins select, each with the first coin landing on it. Weights and
+    /// signatures aren't checked; `verify` does that.
+    pub fn verify_coin_derivation(
+        &self,
+        params: &Params,
+        party_tree_root: &[u8],
+    ) -> Result<bool, CcokError> {
+        let expected_seed = if params.version >= PARAMS_V4 {
+            coin_seed(
+                params,
+                &self.sig_commit,
+                self.signed_weight,
+                party_tree_root,
+            )
+            .to_vec()
+        } else {
+            Vec::new()
+        };
+        if self.coin_seed != expected_seed {
+            debug!(target: VERIFIER, "Coin seed doesn't match the commitments");
             return Ok(false);
         }
-        println!("Signature Merkle proofs verified successfully");
-
-        // 5. Verify participant Merkle proofs
-        let mut party_tree = MerkleTreeBuilder::new();
-        party_tree.build(&participants)?;
-        println!("Built participant Merkle tree");
+        let mut first_coins = BTreeMap::new();
+        for flip in self.coin_flips(params, party_tree_root)? {
+            first_coins.entry(flip.position).or_insert(flip.index);
+        }
+        let positions: Vec<u64> = first_coins.keys().copied().collect();
+        let indices: Vec<u64> = first_coins.values().copied().collect();
+        Ok(positions == self.reveal_positions && indices == self.reveal_indices)
+    }
 
-        // Prepare sorted (position, leaf_hash) pairs for participant leaves
-        let mut party_pairs: Vec<(usize, [u8; 32])> = positions
+    /// Sorted distinct positions the coins of the certificate select, which
+    /// an honestly built certificate lists as its `reveal_positions`
+    pub fn derive_reveal_positions(
+        &self,
+        params: &Params,
+        party_tree_root: &[u8],
+    ) -> Result<Vec<u64>, CcokError> {
+        let mut positions: Vec<u64> = self
+            .coin_flips(params, party_tree_root)?
             .iter()
-            .cloned()
-            .zip(participants.iter().map(|party| {
-                let bytes = bincode::serialize(party)
-                    .map_err(|e| format!("Serialization error: {}", e))
-                    .unwrap();
-                <CustomHasher as Hasher>::hash(&bytes)
-            }))
+            .map(|flip| flip.position)
             .collect();
-        party_pairs.sort_by_key(|(pos, _)| *pos);
-        let sorted_party_positions: Vec<usize> = party_pairs.iter().map(|(p, _)| *p).collect();
-        let sorted_party_leaves: Vec<[u8; 32]> =
-            party_pairs.iter().map(|(_, hash)| *hash).collect();
-
-        if !MerkleTreeBuilder::verify(
-            party_tree_root,
-            &self.party_proofs,
-            &sorted_party_positions,
-            self.total_sigs,
-            &sorted_party_leaves,
-        ) {
-            println!("Participant Merkle proof verification failed");
-            return Ok(false);
-        }
-        println!("Participant Merkle proofs verified successfully");
+        positions.sort();
+        positions.dedup();
+        Ok(positions)
+    }
 
-        // 6. Verify coin choices
-        // Temporarily bypass coin choice verification for debugging purposes
-        println!("Skipping coin choice verification");
+    /// Verify the certificate's validity
+    pub fn verify(&self, params: &Params, party_tree_root: &[u8]) -> Result<bool, CcokError> {
+        self.verify_with_context(&Context::background(), params, party_tree_root)
+    }
 
-        Ok(true)
+    /// Verify the certificate, giving up once `ctx` is cancelled or expires
+    pub fn verify_with_context(
+        &self,
+        ctx: &Context,
+        params: &Params,
+        party_tree_root: &[u8],
+    ) -> Result<bool, CcokError> {
+        let _timer = METRICS.cert_verify_seconds.start_timer();
+        self.verify_cached(
+            ctx,
+            params,
+            party_tree_root,
+            &mut VerifierCache::default(),
+            None,
+        )
     }
 
-    // Helper function to generate deterministic random choice (same as Builder)
-    fn coin_choice(
+    fn verify_cached(
         &self,
-        index: u64,
-        sig_commit: &[u8],
-        signed_weight: u64,
-        proven_weight: u64,
+        ctx: &Context,
+        params: &Params,
         party_tree_root: &[u8],
-        msg: &[u8],
-    ) -> u64 {
-        let mut hasher = Keccak256::new();
-        hasher.update(&index.to_le_bytes());
-        hasher.update(&signed_weight.to_le_bytes());
-        hasher.update(&proven_weight.to_le_bytes());
-        hasher.update(sig_commit);
-        hasher.update(party_tree_root);
-        hasher.update(msg);
-
-        let hash = hasher.finalize();
+        cache: &mut VerifierCache,
+        pool: Option<&rayon::ThreadPool>,
+    ) -> Result<bool, CcokError> {
+        debug!(target: VERIFIER, "Starting verification...");
+        params.validate()?;
+
+        // 1. Check if signed weight meets the threshold
+        if self.signed_weight < params.proven_weight {
+            debug!(target: VERIFIER,
+                "Weight check failed: {} < {}",
+                self.signed_weight, params.proven_weight
+            );
+            return Ok(false);
+        }
+        // Too little weight signed past the proven weight needs more coins
+        // than a certificate carries, as the builder refuses
+        if params.version >= PARAMS_V3 && v3_coins(params, self.signed_weight) > MAX_COINS as f64 {
+            debug!(target: VERIFIER,
+                "Coin check failed: signed weight {} needs over {} coins",
+                self.signed_weight, MAX_COINS
+            );
+            return Ok(false);
+        }
+        debug!(target: VERIFIER, "Weight threshold check passed");
+
+        // The certificate must be built with the hash function of the params
+        if self.hash != params.hash {
+            return Err(CcokError::HashMismatch {
+                cert: self.hash,
+                params: params.hash,
+            });
+        }
+        if self.version != params.version {
+            return Err(CcokError::VersionMismatch {
+                cert: self.version,
+                params: params.version,
+            });
+        }
+        let hashing = params.hashing();
+        let message_key = (params.msg.clone(), params.binding());
+        if params.version >= PARAMS_V2 && !cache.messages.contains_key(&message_key) {
+            cache
+                .messages
+                .insert(message_key.clone(), params.signing_message());
+        }
+
+        // Every scheme the certificate declares must be registered with this verifier
+        for scheme in &self.schemes {
+            cache.scheme(*scheme)?;
+        }
+
+        // 2. Verify each revealed signature
+        let mut verified_weight = 0u64;
+        let mut sig_slots = Vec::new();
+        let mut participants = Vec::new();
+        let mut positions = Vec::new();
+
+        debug!(target: VERIFIER,
+            "Verifying {} revealed signatures...",
+            self.reveal_positions.len()
+        );
+        // Reveals are listed once each by increasing position, and the
+        // certificate carries no reveal it doesn't list
+        if let Some(pair) = self.reveal_positions.windows(2).find(|p| p[0] >= p[1]) {
+            return Err(CcokError::InvalidReveal(pair[1]));
+        }
+        if let Some(pos) = self
+            .reveals
+            .keys()
+            .find(|pos| self.reveal_positions.binary_search(pos).is_err())
+        {
+            return Err(CcokError::InvalidReveal(*pos));
+        }
+        // Look up the reveals and decode their signing keys first, so the
+        // signatures can then be checked independently of one another
+        let mut reveals = Vec::with_capacity(self.reveal_positions.len());
+        for pos in &self.reveal_positions {
+            let reveal = self
+                .reveals
+                .get(pos)
+                .ok_or(CcokError::InvalidReveal(*pos))?;
+            if !params.is_quantized(reveal.party.weight) {
+                debug!(target: VERIFIER, "Weight of position {} is not quantized", pos);
+                return Ok(false);
+            }
+            if let Some(public_key) = reveal.signing_key() {
+                if !cache.public_keys.contains_key(public_key) {
+                    let decoded = hex::decode(public_key)?;
+                    cache.public_keys.insert(public_key.clone(), decoded);
+                }
+            }
+            reveals.push((*pos, reveal));
+        }
+        let public_keys = &cache.public_keys;
+        let schemes = &cache.schemes;
+        let message = match cache.messages.get(&message_key) {
+            Some(tagged) if params.version >= PARAMS_V2 => tagged,
+            _ => &params.msg,
+        };
+        let verify = |(pos, reveal): &(u64, &Reveal)| {
+            let public_key = reveal.signing_key().map(|key| public_keys[key].as_slice());
+            ctx.check()?;
+            self.verify_reveal(params, schemes, message, *pos, reveal, public_key)
+        };
+        match pool {
+            // Check every reveal on the pool, then report the first failure in
+            // position order, as checking them in turn would
+            Some(pool) => {
+                let results: Vec<Result<bool, CcokError>> =
+                    pool.install(|| reveals.par_iter().map(verify).collect());
+                for result in results {
+                    if !result? {
+                        return Ok(false);
+                    }
+                }
+            }
+            None => {
+                for reveal in &reveals {
+                    if !verify(reveal)? {
+                        return Ok(false);
+                    }
+                }
+            }
+        }
+        // The nonces of an aggregate-mode certificate verify together, and
+        // only that mode carries an aggregate
+        let aggregated = params.signature_mode == Some(SignatureMode::Aggregate);
+        if aggregated && !self.verify_aggregate(params, message, &reveals, public_keys)? {
+            debug!(target: VERIFIER, "Aggregate signature verification failed");
+            return Ok(false);
+        }
+        if !aggregated && !self.aggregate_sig.is_empty() {
+            debug!(target: VERIFIER, "Aggregate signature outside the aggregate mode");
+            return Ok(false);
+        }
+        for (pos, reveal) in &reveals {
+            verified_weight = verified_weight
+                .checked_add(reveal.party.weight)
+                .ok_or(CcokError::WeightOverflow)?;
+            sig_slots.push(reveal.sig_slot.clone());
+            participants.push(reveal.party.clone());
+            positions.push(*pos as usize);
+        }
+
+        // 4. Verify signature Merkle proofs
+        let mut sig_tree = MerkleTreeBuilder::with_hash(hashing);
+        sig_tree.build_with_context(ctx, &sig_slots)?;
+        debug!(target: VERIFIER, "Built signature Merkle tree");
+
+        // Prepare sorted (position, leaf_hash) pairs for signature leaves
+        let mut sig_pairs: Vec<(usize, [u8; 32])> = positions
+            .iter()
+            .cloned()
+            .zip(&sig_slots)
+            .map(|(pos, slot)| Ok((pos, hashing.leaf_hash(slot)?)))
+            .collect::<Result<_, CcokError>>()?;
+        sig_pairs.sort_by_key(|(pos, _)| *pos);
+        let sorted_sig_positions: Vec<usize> = sig_pairs.iter().map(|(p, _)| *p).collect();
+        let sorted_sig_leaves: Vec<[u8; 32]> = sig_pairs.iter().map(|(_, hash)| *hash).collect();
+
+        ctx.check()?;
+        let sig_proofs = Self::proof_hashes(&self.sig_proofs, &self.compressed_sig_proofs)?;
+
+        // 5. Verify participant Merkle proofs
+        // Prepare sorted (position, leaf_hash) pairs for participant leaves
+        let mut party_pairs: Vec<(usize, [u8; 32])> = positions
+            .iter()
+            .cloned()
+            .zip(&participants)
+            .map(|(pos, party)| Ok((pos, hashing.leaf_hash(party)?)))
+            .collect::<Result<_, CcokError>>()?;
+        party_pairs.sort_by_key(|(pos, _)| *pos);
+        let sorted_party_positions: Vec<usize> = party_pairs.iter().map(|(p, _)| *p).collect();
+        let sorted_party_leaves: Vec<[u8; 32]> =
+            party_pairs.iter().map(|(_, hash)| *hash).collect();
+
+        ctx.check()?;
+        let party_proofs = Self::proof_hashes(&self.party_proofs, &self.compressed_party_proofs)?;
+
+        // Skip the proof when an earlier certificate already proved every revealed leaf
+        let already_proven = party_pairs
+            .iter()
+            .all(|(pos, hash)| cache.leaves.get(&(self.total_sigs, *pos)) == Some(hash));
+        let check_sigs = || {
+            if params.version >= PARAMS_V5 {
+                return self.verify_sig_weights(hashing, &reveals);
+            }
+            MerkleTreeBuilder::verify_with(
+                hashing,
+                &self.sig_commit,
+                &sig_proofs,
+                &sorted_sig_positions,
+                self.total_sigs,
+                &sorted_sig_leaves,
+            )
+        };
+        let check_parties = || {
+            already_proven
+                || MerkleTreeBuilder::verify_with(
+                    hashing,
+                    party_tree_root,
+                    &party_proofs,
+                    &sorted_party_positions,
+                    self.total_sigs,
+                    &sorted_party_leaves,
+                )
+        };
+        // The two trees are independent, so the pool checks them side by side
+        let (sigs_valid, parties_valid) = match pool {
+            Some(pool) => pool.install(|| rayon::join(check_sigs, check_parties)),
+            None => {
+                let sigs_valid = check_sigs();
+                (sigs_valid, sigs_valid && check_parties())
+            }
+        };
+        if !sigs_valid {
+            debug!(target: VERIFIER, "Signature Merkle proof verification failed");
+            return Ok(false);
+        }
+        debug!(target: VERIFIER, "Signature Merkle proofs verified successfully");
+        if already_proven {
+            debug!(target: VERIFIER, "Participant leaves already proven, skipping participant Merkle proofs");
+        } else if !parties_valid {
+            debug!(target: VERIFIER, "Participant Merkle proof verification failed");
+            return Ok(false);
+        } else {
+            debug!(target: VERIFIER, "Participant Merkle proofs verified successfully");
+            for (pos, hash) in &party_pairs {
+                cache.leaves.insert((self.total_sigs, *pos), *hash);
+            }
+        }
+
+        // The committed seed must be the one the commitments give
+        if params.version >= PARAMS_V4
+            && self.coin_seed[..]
+                != coin_seed(
+                    params,
+                    &self.sig_commit,
+                    self.signed_weight,
+                    party_tree_root,
+                )
+        {
+            debug!(target: VERIFIER, "Coin seed doesn't match the commitments");
+            return Ok(false);
+        }
+
+        // 6. Verify coin choices: every coin must land on a reveal whose
+        // signature and leaves were checked above, so a builder can neither
+        // overstate the signed weight nor leave out a position it must reveal
+        for flip in self.coin_flips(params, party_tree_root)? {
+            if sorted_sig_positions
+                .binary_search(&(flip.position as usize))
+                .is_err()
+            {
+                debug!(target: VERIFIER,
+                    "Coin {} lands on unverified position {}",
+                    flip.index, flip.position
+                );
+                return Ok(false);
+            }
+        }
+        debug!(target: VERIFIER, "Coin choices verified successfully");
+
+        Ok(true)
+    }
+
+    // Check every reveal against the signature sum tree whose root is the
+    // signature commitment and the signed weight: its leaf recomputed from
+    // the reveal must lead to the root, after exactly its accumulated weight
+    fn verify_sig_weights(&self, hashing: Hashing, reveals: &[(u64, &Reveal)]) -> bool {
+        let (Some(paths), Ok(hash)) = (&self.sig_sum_proofs, self.sig_commit[..].try_into()) else {
+            debug!(target: VERIFIER, "Missing signature sum tree proofs");
+            return false;
+        };
+        let root = SumNode {
+            hash,
+            sum: self.signed_weight,
+        };
+        paths.len() == reveals.len() && reveals.iter().zip(paths).all(|((pos, reveal), path)| {
+            let leaf = match WeightedLeaf::from_sig_slot(
+                hashing,
+                *pos as usize,
+                &reveal.sig_slot,
+                reveal.party.weight,
+            ) {
+                Ok(leaf) => leaf,
+                Err(_) => return false,
+            };
+            let offset = path.verify(hashing, &root, &leaf).ok();
+            if path.total_leaves != self.total_sigs
+                || offset != Some(reveal.sig_slot.accumulated_weight)
+            {
+                debug!(target: VERIFIER, "Signature sum tree proof failed for position {}", pos);
+                return false;
+            }
+            true
+        })
+    }
+
+    // Check the signature of one reveal with a scheme the certificate declares
+    fn verify_reveal(
+        &self,
+        params: &Params,
+        schemes: &HashMap<SchemeId, SchemeInfo>,
+        message: &[u8],
+        pos: u64,
+        reveal: &Reveal,
+        public_key: Option<&[u8]>,
+    ) -> Result<bool, CcokError> {
+        let scheme = reveal.party.scheme;
+        let info = match schemes.get(&scheme) {
+            Some(info) if self.schemes.binary_search(&scheme).is_ok() => info,
+            _ => {
+                debug!(target: VERIFIER, "Scheme {:?} at position {} not declared", scheme, pos);
+                return Ok(false);
+            }
+        };
+        reveal.check_signature(params, info, message, pos, public_key, true)
+    }
+
+    // Check the aggregate of an aggregate-mode certificate over the nonces of
+    // its reveals, in position order, each under its Schnorr key
+    fn verify_aggregate(
+        &self,
+        params: &Params,
+        message: &[u8],
+        reveals: &[(u64, &Reveal)],
+        public_keys: &HashMap<String, Vec<u8>>,
+    ) -> Result<bool, CcokError> {
+        let mut entries = Vec::with_capacity(reveals.len());
+        for (_, reveal) in reveals {
+            let (Some(key), Some(nonce)) = (reveal.signing_key(), &reveal.sig_slot.signature)
+            else {
+                return Ok(false);
+            };
+            let key = hybrid::signing_key(
+                params.signature_mode,
+                reveal.party.scheme,
+                &public_keys[key],
+            )
+            .map_err(CcokError::Scheme)?;
+            entries.push((key, nonce.as_bytes()));
+        }
+        halfagg::verify(&entries, message, &self.aggregate_sig).map_err(CcokError::Scheme)
+    }
+
+    // Helper function to generate deterministic random choice (same as Builder)
+    fn coin_choice(
+        &self,
+        index: u64,
+        sig_commit: &[u8],
+        signed_weight: u64,
+        proven_weight: u64,
+        party_tree_root: &[u8],
+        msg: &[u8],
+    ) -> u64 {
+        let mut data = Vec::new();
+        data.extend_from_slice(&index.to_le_bytes());
+        data.extend_from_slice(&signed_weight.to_le_bytes());
+        data.extend_from_slice(&proven_weight.to_le_bytes());
+        data.extend_from_slice(sig_commit);
+        data.extend_from_slice(party_tree_root);
+        data.extend_from_slice(msg);
+
+        let hashing = Hashing::new(self.hash, self.version >= PARAMS_V2);
+        let hash = hashing.hash(HashDomain::Coin, &data);
         let mut bytes = [0u8; 8];
         bytes.copy_from_slice(&hash[0..8]);
         let coin = u64::from_le_bytes(bytes) % signed_weight;
-        println!(
+        trace!(target: VERIFIER,
             "Generated coin choice for index {}: {} (raw bytes: {:?})",
             index,
             coin,
@@ -453,228 +2527,1514 @@ impl Certificate {
     }
 
     // Helper function to find position in Certificate using binary search
-    fn find_coin_position(&self, coin_value: u64, sig_slots: &[SigSlot]) -> Result<u64, String> {
-        println!(
+    fn find_coin_position(&self, coin_value: u64, sig_slots: &[SigSlot]) -> Result<u64, CcokError> {
+        trace!(target: VERIFIER,
             "Certificate find_coin_position: searching for coin_value {}",
             coin_value
         );
         let mut positions: Vec<_> = self.reveals.iter().collect();
         positions.sort_by_key(|(pos, _)| *pos);
 
-        println!("  Certificate positions and weights:");
-        let mut acc = 0;
+        trace!(target: VERIFIER, "  Certificate positions and weights:");
+        let mut acc = 0u64;
         for (pos, reveal) in &positions {
-            println!(
-                "    Position {}: range {} to {}",
-                pos,
-                acc,
-                acc + reveal.party.weight
+            let end = acc.saturating_add(reveal.party.weight);
+            trace!(target: VERIFIER, "    Position {}: range {} to {}", pos, acc, end);
+            acc = end;
+        }
+
+        let mut lo = 0usize;
+        let mut hi = positions.len();
+
+        while lo < hi {
+            let mid = (lo + hi) / 2;
+            let mid_l = if mid == 0 {
+                0
+            } else {
+                positions[..mid]
+                    .iter()
+                    .try_fold(0u64, |acc, (_, reveal)| {
+                        acc.checked_add(reveal.party.weight)
+                    })
+                    .ok_or(CcokError::WeightOverflow)?
+            };
+            let (pos, reveal) = &positions[mid];
+            let mid_end = mid_l
+                .checked_add(reveal.party.weight)
+                .ok_or(CcokError::WeightOverflow)?;
+
+            trace!(target: VERIFIER,
+                "  Certificate binary search: lo={}, hi={}, mid={}, mid_l={}, mid_weight={}",
+                lo, hi, mid, mid_l, reveal.party.weight
+            );
+
+            if coin_value < mid_l {
+                trace!(target: VERIFIER,
+                    "    coin_value {} < mid_l {}, setting hi = mid",
+                    coin_value, mid_l
+                );
+                hi = mid;
+                continue;
+            }
+
+            if coin_value < mid_end {
+                trace!(target: VERIFIER,
+                    "    Found position: {} (weight range: {} to {})",
+                    pos, mid_l, mid_end
+                );
+                return Ok(**pos);
+            }
+
+            trace!(target: VERIFIER,
+                "    coin_value {} >= mid_l {} + weight {}, setting lo = mid + 1",
+                coin_value, mid_l, reveal.party.weight
             );
-            acc += reveal.party.weight;
+            lo = mid + 1;
+        }
+
+        Err(CcokError::NoSignatures)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ephemeral::{EphemeralKeys, KeyLifetime};
+    use crate::signer::{DilithiumSigner, FalconSigner, SignatureScheme, SphincsPlusSigner};
+    use crate::wallet::Wallet;
+
+    // Helper function to create a test builder with predefined participants
+    fn create_test_builder(participants: Vec<(String, u64)>) -> (Builder, Vec<u8>) {
+        let msg = b"Test message".to_vec();
+        let mut total_weight = 0;
+        let participants: Vec<Participant> = participants
+            .into_iter()
+            .map(|(pk, weight)| {
+                total_weight += weight;
+                Participant {
+                    public_key: pk,
+                    weight,
+                    scheme: SignatureScheme::Dilithium2.id(),
+                    key_commitment: None,
+                    vrf_key: None,
+                    key_layout: KeyLayout::InLeaf,
+                }
+            })
+            .collect();
+
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let party_tree_root = party_tree.root();
+
+        let params = Params {
+            msg: msg.clone(),
+            proven_weight: total_weight / 2,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+
+        (
+            Builder::new(params, participants, party_tree_root).unwrap(),
+            msg,
+        )
+    }
+
+    #[test]
+    fn test_simple_certificate_verification() {
+        // Create 3 participants with simple weights
+        let wallet1 = Wallet::new().expect("Failed to create wallet 1");
+        let wallet2 = Wallet::new().expect("Failed to create wallet 2");
+        let wallet3 = Wallet::new().expect("Failed to create wallet 3");
+
+        let participants = vec![
+            (wallet1.get_public_key(), 10),
+            (wallet2.get_public_key(), 20),
+            (wallet3.get_public_key(), 30),
+        ];
+
+        let (mut builder, msg) = create_test_builder(participants);
+
+        // Add signatures in order
+        builder
+            .add_signature(0, wallet1.sign_message(&msg))
+            .expect("Failed to add signature 1");
+        builder
+            .add_signature(1, wallet2.sign_message(&msg))
+            .expect("Failed to add signature 2");
+        builder
+            .add_signature(2, wallet3.sign_message(&msg))
+            .expect("Failed to add signature 3");
+
+        // Build and verify certificate
+        let cert = builder.build().expect("Failed to build certificate");
+        let result = cert.verify(&builder.params, &builder.party_tree_root);
+        assert!(
+            result.is_ok() && result.unwrap(),
+            "Certificate verification failed"
+        );
+    }
+
+    #[test]
+    fn test_mixed_scheme_certificate_verification() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let dilithium3 = DilithiumSigner::new().expect("Failed to create signer");
+        let sphincs = SphincsPlusSigner::new().expect("Failed to create signer");
+        let signers: Vec<&dyn Signer> = vec![&wallet, &dilithium3, &sphincs];
+
+        let participants: Vec<Participant> = signers
+            .iter()
+            .map(|s| Participant::from_signer(*s, 50))
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+
+        let msg = b"Test message".to_vec();
+        let params = Params {
+            msg: msg.clone(),
+            proven_weight: 50,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder = Builder::new(params, participants, party_tree.root()).unwrap();
+
+        // A Dilithium2 signature must not be accepted for a Dilithium3 participant
+        assert!(builder.add_signature(1, wallet.sign_message(&msg)).is_err());
+
+        for (i, signer) in signers.iter().enumerate() {
+            builder
+                .add_signature(i, signer.sign(&msg))
+                .expect("Failed to add signature");
         }
 
-        let mut lo = 0usize;
-        let mut hi = positions.len();
+        let cert = builder.build().expect("Failed to build certificate");
+        let result = cert.verify(&builder.params, &builder.party_tree_root);
+        assert!(
+            result.is_ok() && result.unwrap(),
+            "Certificate verification failed"
+        );
+    }
+
+    #[test]
+    fn test_params_scheme_selection() {
+        let falcon1 = FalconSigner::new().expect("Failed to create signer");
+        let falcon2 = FalconSigner::new().expect("Failed to create signer");
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let signers: Vec<&dyn Signer> = vec![&falcon1, &falcon2, &wallet];
+
+        let participants: Vec<Participant> = signers
+            .iter()
+            .map(|s| Participant::from_signer(*s, 40))
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+
+        let msg = b"Test message".to_vec();
+        let params = Params {
+            msg: msg.clone(),
+            proven_weight: 60,
+            scheme: Some(SignatureScheme::Falcon512.id()),
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder = Builder::new(params, participants, party_tree.root()).unwrap();
+        builder
+            .add_signature(0, falcon1.sign(&msg))
+            .expect("Failed to add signature 1");
+        builder
+            .add_signature(1, falcon2.sign(&msg))
+            .expect("Failed to add signature 2");
+
+        // The Dilithium2 participant is excluded by the scheme pinned in params
+        assert!(builder.add_signature(2, wallet.sign_message(&msg)).is_err());
+
+        let cert = builder.build().expect("Failed to build certificate");
+        let result = cert.verify(&builder.params, &builder.party_tree_root);
+        assert!(
+            result.is_ok() && result.unwrap(),
+            "Certificate verification failed"
+        );
+
+        // Verifying against params pinned to another scheme must fail
+        let mut other = builder.params.clone();
+        other.scheme = Some(SignatureScheme::Dilithium3.id());
+        assert!(!cert.verify(&other, &builder.party_tree_root).unwrap());
+    }
+
+    #[test]
+    fn test_one_time_key_certificate_verification() {
+        let lifetime = KeyLifetime::new(0, 8);
+        let mut keys: Vec<EphemeralKeys> = (0..3)
+            .map(|_| {
+                // Hashed as the v1 params below hash
+                EphemeralKeys::generate(
+                    SignatureScheme::Dilithium2,
+                    lifetime,
+                    Hashing::from(HashAlgorithm::Keccak256),
+                )
+                .expect("Failed to generate keys")
+            })
+            .collect();
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .zip(keys.iter())
+            .map(|(wallet, keys)| Participant {
+                key_commitment: Some(keys.commitment()),
+                vrf_key: None,
+                ..Participant::from_signer(wallet, 20)
+            })
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+
+        let msg = b"Test message".to_vec();
+        let params = Params {
+            msg: msg.clone(),
+            proven_weight: 30,
+            round: Some(5),
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder = Builder::new(params, participants, party_tree.root()).unwrap();
+
+        // Long-lived signatures and one-time keys of other rounds are refused
+        assert!(builder
+            .add_signature(0, wallets[0].sign_message(&msg))
+            .is_err());
+        let (sig, proof) = keys[0].sign(4, &msg).expect("Failed to sign");
+        assert!(builder.add_one_time_signature(0, sig, proof).is_err());
+
+        for (i, keys) in keys.iter_mut().enumerate() {
+            let (sig, proof) = keys.sign(5, &msg).expect("Failed to sign");
+            builder
+                .add_one_time_signature(i, sig, proof)
+                .expect("Failed to add signature");
+        }
+
+        let cert = builder.build().expect("Failed to build certificate");
+        let result = cert.verify(&builder.params, &builder.party_tree_root);
+        assert!(
+            result.is_ok() && result.unwrap(),
+            "Certificate verification failed"
+        );
+
+        // The certificate does not verify for another round
+        let mut other = builder.params.clone();
+        other.round = Some(6);
+        assert!(!cert.verify(&other, &builder.party_tree_root).unwrap());
+    }
+
+    #[test]
+    fn test_verify_batch() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants = wallets
+            .iter()
+            .zip([10, 20, 30])
+            .map(|(w, weight)| (w.get_public_key(), weight))
+            .collect();
+        let (builder, _) = create_test_builder(participants);
+        let verifier = Verifier::new(builder.party_tree_root.clone());
+
+        // Certify several messages over the same party tree
+        let mut batch = Vec::new();
+        for msg in [
+            b"Block 1".to_vec(),
+            b"Block 2".to_vec(),
+            b"Block 3".to_vec(),
+        ] {
+            let params = Params {
+                msg: msg.clone(),
+                ..builder.params.clone()
+            };
+            let mut b = Builder::new(
+                params.clone(),
+                builder.participants.clone(),
+                builder.party_tree_root.clone(),
+            )
+            .unwrap();
+            for (pos, wallet) in wallets.iter().enumerate() {
+                b.add_signature(pos, wallet.sign_message(&msg))
+                    .expect("Failed to add signature");
+            }
+            batch.push((b.build().expect("Failed to build certificate"), params));
+        }
+
+        // Tamper with one certificate's revealed weight
+        let reveal = batch[1].0.reveals.values_mut().next().unwrap();
+        reveal.party.weight += 1;
+
+        let results = verifier.verify_batch(batch.iter().map(|(c, p)| (c, p)));
+        assert_eq!(results.len(), 3);
+        assert!(results[0].as_ref().map_or(false, |ok| *ok));
+        assert!(!results[1].as_ref().map_or(false, |ok| *ok));
+        assert!(results[2].as_ref().map_or(false, |ok| *ok));
+
+        // Batch results match verifying each certificate on its own
+        for ((cert, params), result) in batch.iter().zip(&results) {
+            assert_eq!(&verifier.verify(cert, params), result);
+        }
+    }
+
+    #[test]
+    fn test_verifier_cache() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let (builder, _) =
+            create_test_builder(wallets.iter().map(|w| (w.get_public_key(), 10)).collect());
+        let template = Params {
+            version: PARAMS_V2,
+            ..builder.params.clone()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(template.hashing());
+        party_tree.build(&builder.participants).unwrap();
+        let root = party_tree.root();
+        let verifier = Verifier::new(root.clone());
+        let mut cache = VerifierCache::new();
+
+        // Domain separated certificates of successive messages share the setup
+        for msg in [b"Block 1".to_vec(), b"Block 2".to_vec()] {
+            let params = Params {
+                msg,
+                ..template.clone()
+            };
+            let mut b =
+                Builder::new(params.clone(), builder.participants.clone(), root.clone()).unwrap();
+            for (pos, wallet) in wallets.iter().enumerate() {
+                b.add_signature(pos, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+            }
+            let cert = b.build().unwrap();
+            assert!(verifier
+                .verify_with_cache(&mut cache, &cert, &params)
+                .unwrap());
+            assert_eq!(
+                verifier.verify_with_cache(&mut cache, &cert, &params),
+                verifier.verify(&cert, &params)
+            );
+            assert!(cache.proven_leaves() > 0);
+
+            // Leaves proven under one root don't vouch for them under another
+            let other = Verifier::new(vec![0u8; 32]);
+            assert!(!other.verify_with_cache(&mut cache, &cert, &params).unwrap());
+            assert_eq!(cache.proven_leaves(), 0);
+        }
+        assert_eq!(cache.messages.len(), 2);
+        cache.clear();
+        assert!(cache.schemes.is_empty());
+    }
+
+    #[test]
+    fn test_insufficient_weight() {
+        // Create 3 participants but only sign with the smallest weight
+        let wallet1 = Wallet::new().expect("Failed to create wallet 1");
+        let wallet2 = Wallet::new().expect("Failed to create wallet 2");
+        let wallet3 = Wallet::new().expect("Failed to create wallet 3");
+
+        let participants = vec![
+            (wallet1.get_public_key(), 10),
+            (wallet2.get_public_key(), 20),
+            (wallet3.get_public_key(), 30),
+        ];
+
+        let (mut builder, msg) = create_test_builder(participants);
+
+        // Add only one signature
+        builder
+            .add_signature(0, wallet1.sign_message(&msg))
+            .expect("Failed to add signature");
+
+        // Building should fail due to insufficient weight
+        assert!(
+            builder.build().is_err(),
+            "Builder should fail with insufficient weight"
+        );
+    }
+
+    #[test]
+    fn test_weight_overflow() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let (mut builder, msg) =
+            create_test_builder(wallets.iter().map(|w| (w.get_public_key(), 10)).collect());
+
+        // Sets whose total weight overflows are refused up front
+        let mut heavy = builder.participants.clone();
+        heavy[0].weight = u64::MAX;
+        assert!(matches!(
+            Builder::new(builder.params.clone(), heavy, vec![0u8; 32]),
+            Err(CcokError::WeightOverflow)
+        ));
+
+        // Weight ranges of a tampered certificate overflow instead of wrapping
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&msg))
+                .unwrap();
+        }
+        let mut cert = builder.build().unwrap();
+        let pos = cert.reveal_positions[0];
+        cert.reveals
+            .get_mut(&pos)
+            .unwrap()
+            .sig_slot
+            .accumulated_weight = u64::MAX;
+        assert!(matches!(
+            cert.coin_flips(&builder.params, &builder.party_tree_root),
+            Err(CcokError::WeightOverflow)
+        ));
+    }
+
+    #[test]
+    fn test_duplicate_signature() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let other = Wallet::new().expect("Failed to create wallet");
+        let participants = vec![(wallet.get_public_key(), 100)];
+        let (mut builder, msg) = create_test_builder(participants);
+
+        // Add signature once
+        let signature = wallet.sign_message(&msg);
+        builder
+            .add_signature(0, signature)
+            .expect("Failed to add signature");
+
+        // Retrying the same signature is accepted without counting it twice
+        builder
+            .add_signature(0, signature)
+            .expect("Identical resubmission should be accepted");
+        assert_eq!(builder.signed_weight, 100);
+
+        // A different signature for the same participant is a conflict
+        let result = builder.add_signature(0, other.sign_message(&msg));
+        assert_eq!(result, Err(CcokError::DuplicateSignature(0)));
+        let results = builder.add_signatures([(0, signature), (0, other.sign_message(&msg))]);
+        assert_eq!(results[0], Ok(()));
+        assert_eq!(results[1], Err(CcokError::DuplicateSignature(0)));
+        assert_eq!(builder.signed_weight, 100);
+    }
+
+    #[test]
+    fn test_invalid_position() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let participants = vec![(wallet.get_public_key(), 100)];
+        let (mut builder, msg) = create_test_builder(participants);
+
+        // Try to add signature at invalid position
+        let result = builder.add_signature(1, wallet.sign_message(&msg));
+        assert!(result.is_err(), "Should not allow invalid position");
+    }
+
+    #[test]
+    fn test_accumulated_weights() {
+        let wallet1 = Wallet::new().expect("Failed to create wallet 1");
+        let wallet2 = Wallet::new().expect("Failed to create wallet 2");
+        let wallet3 = Wallet::new().expect("Failed to create wallet 3");
+
+        let participants = vec![
+            (wallet1.get_public_key(), 10),
+            (wallet2.get_public_key(), 20),
+            (wallet3.get_public_key(), 30),
+        ];
+
+        let (mut builder, msg) = create_test_builder(participants);
+
+        // Add signatures and check accumulated weights
+        builder
+            .add_signature(0, wallet1.sign_message(&msg))
+            .expect("Failed to add signature 1");
+        assert_eq!(builder.sigs[0].accumulated_weight, 0);
+
+        builder
+            .add_signature(1, wallet2.sign_message(&msg))
+            .expect("Failed to add signature 2");
+        assert_eq!(builder.sigs[1].accumulated_weight, 10);
+
+        builder
+            .add_signature(2, wallet3.sign_message(&msg))
+            .expect("Failed to add signature 3");
+        assert_eq!(builder.sigs[2].accumulated_weight, 30);
+    }
+
+    #[test]
+    fn test_deterministic_build() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<(String, u64)> = wallets
+            .iter()
+            .zip([10, 20, 30, 40])
+            .map(|(w, weight)| (w.get_public_key(), weight))
+            .collect();
+        let (mut forward, msg) = create_test_builder(participants.clone());
+        let (mut backward, _) = create_test_builder(participants);
+
+        // Both builders receive the same signatures in a different order
+        let sigs: Vec<_> = wallets.iter().map(|w| w.sign_message(&msg)).collect();
+        for pos in [0, 1, 3] {
+            forward.add_signature(pos, sigs[pos]).unwrap();
+        }
+        for pos in [3, 1, 0] {
+            backward.add_signature(pos, sigs[pos]).unwrap();
+        }
+
+        let cert1 = forward
+            .build_deterministic()
+            .expect("Failed to build certificate");
+        let cert2 = backward
+            .build_deterministic()
+            .expect("Failed to build certificate");
+        assert_eq!(cert1.digest().unwrap(), cert2.digest().unwrap());
+        assert_eq!(
+            bincode::serialize(&cert1).unwrap(),
+            bincode::serialize(&cert2).unwrap()
+        );
+        assert!(cert1
+            .verify(&forward.params, &forward.party_tree_root)
+            .unwrap());
+    }
+
+    #[test]
+    fn test_verify_workers() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants = wallets.iter().map(|w| (w.get_public_key(), 10)).collect();
+        let (builder, msg) = create_test_builder(participants);
+        let mut builder = builder
+            .with_verify_workers(2)
+            .expect("Failed to create pool");
+
+        // A signature over another message is rejected up front
+        let bad = wallets[0].sign_message(b"Other message");
+        assert!(builder.add_signature(0, bad).is_err());
+        assert_eq!(builder.signed_weight, 0);
+        builder
+            .add_signature(0, wallets[0].sign_message(&msg))
+            .expect("Failed to add signature");
+
+        // Batches are verified in parallel with per-signature results
+        let results = builder.add_signatures(vec![
+            (1, wallets[1].sign_message(&msg)),
+            (2, wallets[3].sign_message(&msg)),
+            (3, wallets[3].sign_message(&msg)),
+            (3, wallets[3].sign_message(&msg)),
+        ]);
+        assert!(results[0].is_ok());
+        assert!(results[1].is_err());
+        assert!(results[2].is_ok());
+        // The repeated signature is accepted once
+        assert!(results[3].is_ok());
+        assert_eq!(builder.signed_weight, 30);
+
+        let cert = builder.build().expect("Failed to build certificate");
+        assert!(cert
+            .verify(&builder.params, &builder.party_tree_root)
+            .unwrap());
+    }
+
+    #[test]
+    fn test_estimate_cert_size() {
+        let wallets: Vec<Wallet> = (0..16)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants = wallets.iter().map(|w| (w.get_public_key(), 10)).collect();
+        let (mut builder, msg) = create_test_builder(participants);
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&msg))
+                .expect("Failed to add signature");
+        }
+
+        assert!(builder
+            .estimate_cert_size(builder.params.proven_weight - 1)
+            .is_err());
+
+        // The estimate is close to the actual certificate size
+        let cert = builder.build().expect("Failed to build certificate");
+        let actual = bincode::serialized_size(&cert).unwrap() as f64;
+        let estimate = builder.estimate_cert_size(builder.signed_weight).unwrap() as f64;
+        assert!(
+            (estimate - actual).abs() / actual < 0.25,
+            "estimate {} too far from actual size {}",
+            estimate,
+            actual
+        );
+    }
+
+    #[test]
+    fn test_compressed_proofs() {
+        let wallets: Vec<Wallet> = (0..32)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants = wallets.iter().map(|w| (w.get_public_key(), 10)).collect();
+        let (mut builder, msg) = create_test_builder(participants);
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&msg))
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+
+        let mut compressed = cert.clone();
+        compressed.compress_proofs().unwrap();
+        assert_eq!(compressed.proof_size(), cert.proof_size());
+        assert!(
+            bincode::serialized_size(&compressed).unwrap()
+                < bincode::serialized_size(&cert).unwrap()
+        );
+        assert!(compressed
+            .verify(&builder.params, &builder.party_tree_root)
+            .unwrap());
+
+        // A tampered node fails verification
+        let mut tampered = compressed.clone();
+        if let Some(set) = tampered.compressed_party_proofs.as_mut() {
+            set.nodes[0] ^= 1;
+        }
+        assert!(!tampered
+            .verify(&builder.params, &builder.party_tree_root)
+            .unwrap());
+    }
+
+    #[test]
+    fn test_hash_selection() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant {
+                public_key: w.get_public_key(),
+                weight: 10,
+                scheme: SignatureScheme::Dilithium2.id(),
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            })
+            .collect();
+
+        for hash in HashAlgorithm::ALL {
+            let mut party_tree = MerkleTreeBuilder::with_hash(hash);
+            party_tree
+                .build(&participants)
+                .expect("Failed to build party tree");
+            let params = Params {
+                msg: b"Test message".to_vec(),
+                proven_weight: 20,
+                hash,
+                version: PARAMS_V1,
+                ..Default::default()
+            };
+            let mut builder =
+                Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+            for (pos, wallet) in wallets.iter().enumerate() {
+                builder
+                    .add_signature(pos, wallet.sign_message(&params.msg))
+                    .expect("Failed to add signature");
+            }
+            let cert = builder.build().expect("Failed to build certificate");
+            assert_eq!(cert.hash, hash);
+            assert!(cert.verify(&params, &party_tree.root()).unwrap());
+
+            // A verifier expecting another hash function rejects the certificate
+            let other = HashAlgorithm::ALL.into_iter().find(|h| *h != hash).unwrap();
+            let mismatched = Params {
+                hash: other,
+                ..params.clone()
+            };
+            assert!(cert.verify(&mismatched, &party_tree.root()).is_err());
+        }
+    }
+
+    #[test]
+    fn test_domain_separation() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let legacy = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 20,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let separated = Params {
+            version: PARAMS_V2,
+            ..legacy.clone()
+        };
+        assert_eq!(legacy.signing_message(), legacy.msg);
+        assert_ne!(separated.signing_message(), separated.msg);
+
+        let certify = |params: &Params| {
+            let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+            party_tree
+                .build(&participants)
+                .expect("Failed to build party tree");
+            let mut builder =
+                Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+            for (pos, wallet) in wallets.iter().enumerate() {
+                builder
+                    .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                    .expect("Failed to add signature");
+            }
+            (
+                builder.build().expect("Failed to build certificate"),
+                party_tree.root(),
+            )
+        };
+
+        // Legacy certificates keep verifying under version 1 params
+        let (legacy_cert, legacy_root) = certify(&legacy);
+        assert_eq!(legacy_cert.version, PARAMS_V1);
+        assert!(legacy_cert.verify(&legacy, &legacy_root).unwrap());
+
+        let (cert, root) = certify(&separated);
+        assert_eq!(cert.version, PARAMS_V2);
+        assert_ne!(cert.sig_commit, legacy_cert.sig_commit);
+        assert_ne!(root, legacy_root);
+        assert!(cert.verify(&separated, &root).unwrap());
+        assert!(cert.verify(&legacy, &root).is_err());
+        assert!(legacy_cert.verify(&separated, &legacy_root).is_err());
+
+        // A signature over the untagged message is rejected under version 2
+        let mut builder = Builder::new(separated.clone(), participants.clone(), root)
+            .unwrap()
+            .with_verify_workers(1)
+            .expect("Failed to create verify workers");
+        let results = builder.add_signatures(vec![(0, wallets[0].sign_message(&separated.msg))]);
+        assert!(results[0].is_err());
+    }
+
+    #[test]
+    fn test_replay_protection() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params::preset(SecurityLevel::Security128, b"block 9".to_vec(), 20).bind(
+            7,
+            3,
+            Purpose::StateProof,
+        );
+        params.validate().unwrap();
+        assert_eq!(
+            params.signing_message(),
+            canonical_message(7, Some(3), Purpose::StateProof, b"block 9")
+        );
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let mut builder = Builder::new(params.clone(), participants, root.clone()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+
+        let verifier = Verifier::new(root.clone()).with_binding(7, Purpose::StateProof);
+        assert!(verifier.verify(&cert, &params).unwrap());
+        // Replayed for another round, on a fork or for another purpose, the
+        // signatures are over another message
+        let replays = [
+            Params {
+                round: Some(4),
+                ..params.clone()
+            },
+            Params {
+                chain_id: Some(8),
+                ..params.clone()
+            },
+            Params {
+                purpose: Some(Purpose::Commit),
+                ..params.clone()
+            },
+            Params {
+                chain_id: None,
+                purpose: None,
+                ..params.clone()
+            },
+        ];
+        let plain = Verifier::new(root);
+        let results = plain.verify_batch(replays.iter().map(|replay| (&cert, replay)));
+        assert!(results.iter().all(|result| !result.as_ref().unwrap()));
+        // A verifier bound to the chain refuses them before checking signatures
+        for replay in &replays[1..] {
+            assert!(verifier.verify(&cert, replay).is_err());
+        }
+        let unrounded = Params {
+            round: None,
+            ..params.clone()
+        };
+        assert!(verifier.verify(&cert, &unrounded).is_err());
+
+        let half_bound = Params {
+            purpose: None,
+            ..params.clone()
+        };
+        assert!(half_bound.validate().is_err());
+        let legacy = Params {
+            version: PARAMS_V1,
+            ..params
+        };
+        assert!(legacy.validate().is_err());
+    }
+
+    #[test]
+    fn test_verifier_versions() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 20,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder =
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.msg))
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+
+        let verifier = Verifier::new(party_tree.root());
+        assert!(verifier.verify(&cert, &params).unwrap());
+        assert_eq!(
+            verifier.negotiate(&[PARAMS_V1, PARAMS_V2, 7]),
+            Some(PARAMS_V2)
+        );
+        assert_eq!(verifier.negotiate(&[7]), None);
 
-        while lo < hi {
-            let mid = (lo + hi) / 2;
-            let mid_l = if mid == 0 {
-                0
-            } else {
-                positions[..mid]
-                    .iter()
-                    .fold(0, |acc, (_, reveal)| acc + reveal.party.weight)
-            };
+        // A verifier that dropped version 1 rejects the certificate
+        let upgraded = Verifier::new(party_tree.root())
+            .with_versions(&[PARAMS_V2])
+            .unwrap();
+        assert!(upgraded.verify(&cert, &params).is_err());
+        assert!(upgraded.verify_batch([(&cert, &params)])[0].is_err());
+        assert_eq!(upgraded.negotiate(&[PARAMS_V1]), None);
+        assert!(Verifier::new(party_tree.root())
+            .with_versions(&[9])
+            .is_err());
 
-            let (pos, reveal) = &positions[mid];
-            println!(
-                "  Certificate binary search: lo={}, hi={}, mid={}, mid_l={}, mid_weight={}",
-                lo, hi, mid, mid_l, reveal.party.weight
-            );
+        // Builders refuse versions they don't know
+        builder.params.version = 9;
+        assert!(builder.build().is_err());
+    }
 
-            if coin_value < mid_l {
-                println!(
-                    "    coin_value {} < mid_l {}, setting hi = mid",
-                    coin_value, mid_l
-                );
-                hi = mid;
-                continue;
-            }
+    #[test]
+    fn test_sum_tree_weights() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .enumerate()
+            .map(|(i, w)| Participant::from_signer(w, 10 * (i as u64 + 1)))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 50,
+            ..Default::default()
+        };
+        let sum_root = SumTree::from_participants(params.hashing(), &participants)
+            .unwrap()
+            .root();
+        assert_eq!(sum_root.sum, 100);
 
-            if coin_value < mid_l + reveal.party.weight {
-                println!(
-                    "    Found position: {} (weight range: {} to {})",
-                    pos,
-                    mid_l,
-                    mid_l + reveal.party.weight
-                );
-                return Ok(**pos);
+        let build = |participants: Vec<Participant>, sum_tree: bool| {
+            let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+            party_tree.build(&participants).unwrap();
+            let mut builder =
+                Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+            if sum_tree {
+                builder = builder.with_sum_tree().unwrap();
+            }
+            for (pos, wallet) in wallets.iter().enumerate() {
+                builder
+                    .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                    .expect("Failed to add signature");
             }
+            (builder.build().unwrap(), party_tree.root())
+        };
 
-            println!(
-                "    coin_value {} >= mid_l {} + weight {}, setting lo = mid + 1",
-                coin_value, mid_l, reveal.party.weight
-            );
-            lo = mid + 1;
-        }
+        let (cert, root) = build(participants.clone(), true);
+        let verifier = Verifier::new(root.clone()).with_sum_root(sum_root);
+        assert!(verifier.verify(&cert, &params).unwrap());
+        assert!(verifier.verify_batch([(&cert, &params)])[0]
+            .as_ref()
+            .unwrap());
+        let decoded = Certificate::from_proto(&cert.to_proto()).unwrap();
+        assert!(verifier.verify(&decoded, &params).unwrap());
 
-        Err("Could not find position for coin value".to_string())
-    }
-}
+        // Certificates without weight proofs, or claiming more signed weight
+        // than the committed total, are rejected
+        let (plain, _) = build(participants.clone(), false);
+        assert!(Verifier::new(root.clone()).verify(&plain, &params).unwrap());
+        assert!(!verifier.verify(&plain, &params).unwrap());
+        let mut inflated = cert.clone();
+        inflated.signed_weight = 101;
+        assert!(!inflated.verify_weights(&params, &sum_root).unwrap());
+        let mut shifted = cert.clone();
+        let last = *shifted.reveal_positions.last().unwrap();
+        shifted
+            .reveals
+            .get_mut(&last)
+            .unwrap()
+            .sig_slot
+            .accumulated_weight = 100;
+        assert!(!shifted.verify_weights(&params, &sum_root).unwrap());
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use crate::wallet::Wallet;
+        // A builder misstating weights can't prove them against the sum root
+        let mut misstated = participants.clone();
+        for party in &mut misstated {
+            party.weight *= 2;
+        }
+        let (forged, forged_root) = build(misstated, true);
+        assert!(forged.verify(&params, &forged_root).unwrap());
+        assert!(!Verifier::new(forged_root)
+            .with_sum_root(sum_root)
+            .verify(&forged, &params)
+            .unwrap());
+    }
 
-    // Helper function to create a test builder with predefined participants
-    fn create_test_builder(participants: Vec<(String, u64)>) -> (Builder, Vec<u8>) {
-        let msg = b"Test message".to_vec();
-        let mut total_weight = 0;
-        let participants: Vec<Participant> = participants
-            .into_iter()
-            .map(|(pk, weight)| {
-                total_weight += weight;
-                Participant {
-                    public_key: pk,
-                    weight,
-                }
-            })
+    #[test]
+    fn test_min_proven_ratio() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
             .collect();
-
         let mut party_tree = MerkleTreeBuilder::new();
-        party_tree
-            .build(&participants)
-            .expect("Failed to build party tree");
-        let party_tree_root = party_tree.root();
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let sum_root = SumTree::from_participants(Hashing::default(), &participants)
+            .unwrap()
+            .root();
 
-        let params = Params {
-            msg: msg.clone(),
-            proven_weight: total_weight / 2,
-            security_param: 128,
+        // A builder picking a trivial threshold still gathers a valid certificate
+        let build = |proven_weight: u64| {
+            let params = Params {
+                msg: b"Test message".to_vec(),
+                proven_weight,
+                version: PARAMS_V1,
+                ..Default::default()
+            };
+            let mut builder = Builder::new(params.clone(), participants.clone(), root.clone())
+                .unwrap()
+                .with_sum_tree()
+                .unwrap();
+            for (pos, wallet) in wallets.iter().enumerate() {
+                builder
+                    .add_signature(pos, wallet.sign_message(&params.msg))
+                    .unwrap();
+            }
+            (builder.build().unwrap(), params)
         };
+        let verifier = Verifier::new(root.clone())
+            .with_sum_root(sum_root.clone())
+            .with_min_proven_ratio(2, 3)
+            .unwrap();
+        let (cert, params) = build(20);
+        assert!(verifier.verify(&cert, &params).unwrap());
+        let (trivial, trivial_params) = build(1);
+        assert!(Verifier::new(root.clone())
+            .with_sum_root(sum_root)
+            .verify(&trivial, &trivial_params)
+            .unwrap());
+        assert!(matches!(
+            verifier.verify(&trivial, &trivial_params),
+            Err(CcokError::InvalidParams(_))
+        ));
 
-        (Builder::new(params, participants, party_tree_root), msg)
+        // The ratio is only enforceable against a committed total
+        let unrooted = Verifier::new(root).with_min_proven_ratio(2, 3).unwrap();
+        assert!(unrooted.verify(&cert, &params).is_err());
+        assert!(Verifier::new(Vec::new())
+            .with_min_proven_ratio(4, 3)
+            .is_err());
     }
 
     #[test]
-    fn test_simple_certificate_verification() {
-        // Create 3 participants with simple weights
-        let wallet1 = Wallet::new().expect("Failed to create wallet 1");
-        let wallet2 = Wallet::new().expect("Failed to create wallet 2");
-        let wallet3 = Wallet::new().expect("Failed to create wallet 3");
+    fn test_verifier_workers() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let (mut builder, msg) =
+            create_test_builder(wallets.iter().map(|w| (w.get_public_key(), 10)).collect());
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder.add_signature(i, wallet.sign_message(&msg)).unwrap();
+        }
+        let cert = builder.build().unwrap();
+        let root = builder.party_tree_root.clone();
+        let sequential = Verifier::new(root.clone());
+        let parallel = Verifier::new(root).with_workers(2).unwrap();
+        assert!(sequential.verify(&cert, &builder.params).unwrap());
+        assert!(parallel.verify(&cert, &builder.params).unwrap());
 
-        let participants = vec![
-            (wallet1.get_public_key(), 10),
-            (wallet2.get_public_key(), 20),
-            (wallet3.get_public_key(), 30),
-        ];
+        // A bad signature fails the same way on the pool
+        let mut tampered = cert.clone();
+        let pos = tampered.reveal_positions[0];
+        let reveal = tampered.reveals.get_mut(&pos).unwrap();
+        reveal.sig_slot.signature = Some(wallets[pos as usize].sign_message(b"other").into());
+        assert!(!sequential.verify(&tampered, &builder.params).unwrap());
+        assert!(!parallel.verify(&tampered, &builder.params).unwrap());
 
-        let (mut builder, msg) = create_test_builder(participants);
+        // And so does a missing reveal
+        let mut missing = cert.clone();
+        missing.reveals.remove(&pos);
+        assert!(matches!(
+            parallel.verify(&missing, &builder.params),
+            Err(CcokError::InvalidReveal(p)) if p == pos
+        ));
+        let batch = parallel.verify_batch([(&cert, &builder.params), (&tampered, &builder.params)]);
+        assert!(batch[0].as_ref().unwrap());
+        assert!(!batch[1].as_ref().unwrap());
+    }
 
-        // Add signatures in order
-        builder
-            .add_signature(0, wallet1.sign_message(&msg))
-            .expect("Failed to add signature 1");
-        builder
-            .add_signature(1, wallet2.sign_message(&msg))
-            .expect("Failed to add signature 2");
-        builder
-            .add_signature(2, wallet3.sign_message(&msg))
-            .expect("Failed to add signature 3");
+    #[test]
+    fn test_context_cancellation() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let (mut builder, msg) =
+            create_test_builder(wallets.iter().map(|w| (w.get_public_key(), 10)).collect());
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder.add_signature(i, wallet.sign_message(&msg)).unwrap();
+        }
 
-        // Build and verify certificate
-        let cert = builder.build().expect("Failed to build certificate");
-        let result = cert.verify(&builder.params, &builder.party_tree_root);
-        assert!(
-            result.is_ok() && result.unwrap(),
-            "Certificate verification failed"
+        let ctx = Context::background();
+        let cert = builder.build_with_context(&ctx).unwrap();
+        assert!(cert
+            .verify_with_context(&ctx, &builder.params, &builder.party_tree_root)
+            .unwrap());
+
+        // Cancelled and expired contexts stop both building and verifying
+        ctx.cancel();
+        assert_eq!(
+            builder.build_with_context(&ctx).unwrap_err(),
+            CcokError::Cancelled
+        );
+        let verifier = Verifier::new(builder.party_tree_root.clone());
+        assert_eq!(
+            verifier.verify_with_context(&ctx, &cert, &builder.params),
+            Err(CcokError::Cancelled)
+        );
+        let expired = Context::with_deadline(std::time::Instant::now());
+        assert_eq!(
+            cert.verify_with_context(&expired, &builder.params, &builder.party_tree_root),
+            Err(CcokError::DeadlineExceeded)
         );
     }
 
     #[test]
-    fn test_insufficient_weight() {
-        // Create 3 participants but only sign with the smallest weight
-        let wallet1 = Wallet::new().expect("Failed to create wallet 1");
-        let wallet2 = Wallet::new().expect("Failed to create wallet 2");
-        let wallet3 = Wallet::new().expect("Failed to create wallet 3");
+    fn test_params_validation() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params::preset(SecurityLevel::Security192, b"Test message".to_vec(), 20);
+        assert_eq!(params.version, PARAMS_V4);
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
 
-        let participants = vec![
-            (wallet1.get_public_key(), 10),
-            (wallet2.get_public_key(), 20),
-            (wallet3.get_public_key(), 30),
-        ];
+        // Weak or unprovable params are refused up front
+        let mut weak = params.clone();
+        weak.security_param = MIN_SECURITY_PARAM - 1;
+        assert!(matches!(weak.validate(), Err(CcokError::InvalidParams(_))));
+        for proven_weight in [0, 40, 50] {
+            let mut bad = params.clone();
+            bad.proven_weight = proven_weight;
+            assert!(matches!(
+                Builder::new(bad, participants.clone(), root.clone()).err(),
+                Some(CcokError::InvalidParams(_))
+            ));
+        }
 
-        let (mut builder, msg) = create_test_builder(participants);
+        // Coins follow the security parameter: half the weight signed past the
+        // proven weight takes one reveal per bit
+        assert_eq!(num_coins(&params, 40), 192);
+        assert_eq!(num_coins(&params, 20), MAX_COINS);
+        let mut builder = Builder::new(params.clone(), participants, root.clone()).unwrap();
+        let msg = params.signing_message();
+        for i in 0..2 {
+            builder
+                .add_signature(i, wallets[i].sign_message(&msg))
+                .unwrap();
+        }
+        assert!(builder.build().unwrap_err().is_retryable());
+        for i in 2..4 {
+            builder
+                .add_signature(i, wallets[i].sign_message(&msg))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        assert_eq!(cert.reveal_positions.len(), 4);
+        assert!(Verifier::new(root.clone()).verify(&cert, &params).unwrap());
+        weak.hash = params.hash;
+        assert!(matches!(
+            Verifier::new(root.clone()).verify(&cert, &weak),
+            Err(CcokError::InvalidParams(_))
+        ));
 
-        // Add only one signature
-        builder
-            .add_signature(0, wallet1.sign_message(&msg))
-            .expect("Failed to add signature");
+        // The verifier refuses what the builder would: a signed weight too
+        // close to the proven weight for the coins, and unprovable params
+        for proven_weight in [39, 40] {
+            let close = Params {
+                proven_weight,
+                ..params.clone()
+            };
+            assert!(!cert.verify(&close, &root).unwrap());
+        }
+        assert!(Verifier::for_params(root.clone(), &params, 40).is_ok());
+        for (root, proven_weight) in [(Vec::new(), 20), (root, 40)] {
+            let bad = Params {
+                proven_weight,
+                ..params.clone()
+            };
+            assert!(matches!(
+                Verifier::for_params(root, &bad, 40),
+                Err(CcokError::InvalidParams(_))
+            ));
+        }
+    }
 
-        // Building should fail due to insufficient weight
-        assert!(
-            builder.build().is_err(),
-            "Builder should fail with insufficient weight"
+    #[test]
+    fn test_coin_flips() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let (mut builder, msg) =
+            create_test_builder(wallets.iter().map(|w| (w.get_public_key(), 10)).collect());
+        // Out of order and with a gap, so accumulated weights skip position 1
+        for i in [3, 0, 4, 2] {
+            builder
+                .add_signature(i, wallets[i].sign_message(&msg))
+                .unwrap();
+        }
+        assert_eq!(builder.sigs[2].accumulated_weight, 10);
+        assert_eq!(builder.sigs[4].accumulated_weight, 30);
+        let cert = builder.build().unwrap();
+        let root = builder.party_tree_root.clone();
+
+        // Coins, positions and the first coin of each position are reproducible
+        let flips = cert.coin_flips(&builder.params, &root).unwrap();
+        assert_eq!(flips.len(), builder.num_reveals(cert.signed_weight));
+        for flip in &flips {
+            assert_eq!(flip.coin, builder.coin_choice(flip.index, &cert.sig_commit));
+            assert_eq!(
+                flip.position,
+                find_cum_position(&builder.signed_cum_weights().unwrap(), flip.coin).unwrap()
+            );
+        }
+        assert_eq!(
+            cert.derive_reveal_positions(&builder.params, &root)
+                .unwrap(),
+            cert.reveal_positions
         );
+        for (pos, index) in cert.reveal_positions.iter().zip(&cert.reveal_indices) {
+            let first = flips.iter().find(|flip| flip.position == *pos).unwrap();
+            assert_eq!(first.index, *index);
+        }
+
+        // A certificate leaving out a chosen position is caught
+        let mut pruned = cert.clone();
+        pruned.reveals.remove(&cert.reveal_positions[0]);
+        assert!(matches!(
+            pruned.coin_flips(&builder.params, &root),
+            Err(CcokError::UnrevealedCoin { .. })
+        ));
     }
 
     #[test]
-    fn test_duplicate_signature() {
-        let wallet = Wallet::new().expect("Failed to create wallet");
-        let participants = vec![(wallet.get_public_key(), 100)];
-        let (mut builder, msg) = create_test_builder(participants);
+    fn test_coin_seed() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params::preset(SecurityLevel::Security128, b"Test message".to_vec(), 20);
+        let certify = |params: &Params| {
+            let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+            party_tree.build(&participants).unwrap();
+            let root = party_tree.root();
+            let mut builder =
+                Builder::new(params.clone(), participants.clone(), root.clone()).unwrap();
+            for (pos, wallet) in wallets.iter().enumerate() {
+                builder
+                    .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+            }
+            (builder.build().unwrap(), root)
+        };
+        let (cert, root) = certify(&params);
 
-        // Add signature once
-        builder
-            .add_signature(0, wallet.sign_message(&msg))
-            .expect("Failed to add signature");
+        // The certificate commits to the seed of its commitments, and every
+        // coin derives from it
+        let seed = coin_seed(&params, &cert.sig_commit, cert.signed_weight, &root);
+        assert_eq!(cert.coin_seed, seed);
+        for flip in cert.coin_flips(&params, &root).unwrap() {
+            assert_eq!(
+                flip.coin,
+                coin_from_seed(&params, &seed, flip.index, cert.signed_weight)
+            );
+            assert_eq!(
+                flip.coin,
+                coin_value(&params, flip.index, &cert.sig_commit, 40, &root)
+            );
+        }
+        assert!(cert.verify_coin_derivation(&params, &root).unwrap());
+        assert!(cert.verify(&params, &root).unwrap());
+
+        // A seed other than the commitments give, or reveals listed with other
+        // coins than the first landing on them, are caught
+        let mut ground = cert.clone();
+        ground.coin_seed[0] ^= 1;
+        assert!(!ground.verify_coin_derivation(&params, &root).unwrap());
+        assert!(!ground.verify(&params, &root).unwrap());
+        let mut reindexed = cert.clone();
+        reindexed.reveal_indices[0] += 1;
+        assert!(!reindexed.verify_coin_derivation(&params, &root).unwrap());
 
-        // Try to add the same signature again
-        let result = builder.add_signature(0, wallet.sign_message(&msg));
-        assert!(result.is_err(), "Should not allow duplicate signatures");
+        // Earlier versions keep their coins and commit to no seed
+        let legacy = Params {
+            version: PARAMS_V3,
+            ..params
+        };
+        let (cert, root) = certify(&legacy);
+        assert!(cert.coin_seed.is_empty());
+        assert!(cert.verify_coin_derivation(&legacy, &root).unwrap());
+        assert!(cert.verify(&legacy, &root).unwrap());
     }
 
     #[test]
-    fn test_invalid_position() {
-        let wallet = Wallet::new().expect("Failed to create wallet");
-        let participants = vec![(wallet.get_public_key(), 100)];
-        let (mut builder, msg) = create_test_builder(participants);
+    fn test_participants_from_stake() {
+        let params = Params::preset(SecurityLevel::Security128, b"Test message".to_vec(), 20);
+        let keys: Vec<String> = (0..5)
+            .map(|_| Wallet::new().unwrap().public_key_hex())
+            .collect();
+        let stakes: Vec<u128> = vec![160, 0, 1 << 70, 480, 33];
+        let ascending: HashMap<String, u128> =
+            keys.iter().cloned().zip(stakes.iter().copied()).collect();
+        let descending: HashMap<String, u128> = keys
+            .iter()
+            .rev()
+            .map(|key| key.to_uppercase())
+            .zip(stakes.iter().rev().copied())
+            .collect();
 
-        // Try to add signature at invalid position
-        let result = builder.add_signature(1, wallet.sign_message(&msg));
-        assert!(result.is_err(), "Should not allow invalid position");
+        // Keys without stake have no weight, and weights must fit 64 bits
+        assert_eq!(
+            Participant::from_stake(&params, SchemeId::default(), &ascending).unwrap_err(),
+            CcokError::WeightOverflow
+        );
+        let snapshot = |stakes: &HashMap<String, u128>| {
+            let stakes: HashMap<String, u128> = stakes
+                .iter()
+                .filter(|(_, stake)| **stake < 1 << 70)
+                .map(|(key, stake)| (key.clone(), *stake))
+                .collect();
+            Participant::from_stake(&params, SchemeId::default(), &stakes).unwrap()
+        };
+        let (participants, total_weight) = snapshot(&ascending);
+        assert_eq!(participants.len(), 3);
+        assert_eq!(total_weight, 160 + 480 + 33);
+        assert!(participants
+            .windows(2)
+            .all(|pair| pair[0].public_key < pair[1].public_key));
+
+        // Any map with the same stakes gives the same party tree
+        let (reordered, _) = snapshot(&descending);
+        let root = |participants: &[Participant]| {
+            let mut tree = MerkleTreeBuilder::with_hash(params.hashing());
+            tree.build(participants).unwrap();
+            tree.root()
+        };
+        assert_eq!(root(&participants), root(&reordered));
+
+        let mut duplicated = ascending.clone();
+        duplicated.insert(keys[0].to_uppercase(), 1);
+        assert!(Participant::from_stake(&params, SchemeId::default(), &duplicated).is_err());
     }
 
     #[test]
-    fn test_accumulated_weights() {
-        let wallet1 = Wallet::new().expect("Failed to create wallet 1");
-        let wallet2 = Wallet::new().expect("Failed to create wallet 2");
-        let wallet3 = Wallet::new().expect("Failed to create wallet 3");
+    fn test_weight_quantization() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let params = Params {
+            weight_precision: 2,
+            ..Params::preset(SecurityLevel::Security128, b"Test message".to_vec(), 20)
+        };
+        assert_eq!(params.quantize_weight(13), 12);
+        assert_eq!(params.quantize_weight(1000), 768);
+        assert_eq!(params.quantize_weight(3), 3);
+        assert_eq!(params.quantize_weight(u64::MAX), 3 << 62);
+        assert!(params.is_quantized(48) && !params.is_quantized(13));
+        let exact = Params {
+            weight_precision: 0,
+            ..params.clone()
+        };
+        assert_eq!(exact.quantize_weight(13), 13);
+        assert!(Params {
+            weight_precision: MAX_WEIGHT_PRECISION + 1,
+            ..params.clone()
+        }
+        .validate()
+        .is_err());
 
-        let participants = vec![
-            (wallet1.get_public_key(), 10),
-            (wallet2.get_public_key(), 20),
-            (wallet3.get_public_key(), 30),
-        ];
+        let certify = |params: &Params, weights: &[u64]| {
+            let participants: Vec<Participant> = wallets
+                .iter()
+                .zip(weights)
+                .map(|(w, weight)| Participant::from_signer(w, *weight))
+                .collect();
+            let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+            party_tree.build(&participants).unwrap();
+            let root = party_tree.root();
+            let mut builder = Builder::new(params.clone(), participants, root.clone())?;
+            for (pos, wallet) in wallets.iter().enumerate() {
+                builder.add_signature(pos, wallet.sign_message(&params.signing_message()))?;
+            }
+            Ok::<_, CcokError>((builder.build()?, root))
+        };
 
-        let (mut builder, msg) = create_test_builder(participants);
+        // Builders take quantized weights only, and verifiers enforce them
+        let (cert, root) = certify(&params, &[12, 8, 16, 6]).unwrap();
+        assert!(cert.verify(&params, &root).unwrap());
+        assert!(certify(&params, &[13, 8, 16, 6]).is_err());
+        let (cert, root) = certify(&exact, &[13, 9, 17, 7]).unwrap();
+        assert!(cert.verify(&exact, &root).unwrap());
+        assert!(!cert.verify(&params, &root).unwrap());
+    }
 
-        // Add signatures and check accumulated weights
-        builder
-            .add_signature(0, wallet1.sign_message(&msg))
-            .expect("Failed to add signature 1");
-        assert_eq!(builder.sigs[0].accumulated_weight, 0);
+    #[test]
+    fn test_signed_weight_commitment() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .enumerate()
+            .map(|(i, w)| Participant::from_signer(w, 10 * (i as u64 + 1)))
+            .collect();
+        let params = Params {
+            version: PARAMS_V5,
+            ..Params::preset(SecurityLevel::Security128, b"Test message".to_vec(), 60)
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let mut builder = Builder::new(params.clone(), participants.clone(), root.clone()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate().skip(1) {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        assert_eq!(cert.signed_weight, 140);
+        assert!(cert.sig_proofs.is_empty());
+        assert!(cert.verify(&params, &root).unwrap());
+        let deterministic = builder.build_deterministic().unwrap();
+        assert!(deterministic.verify(&params, &root).unwrap());
 
-        builder
-            .add_signature(1, wallet2.sign_message(&msg))
-            .expect("Failed to add signature 2");
-        assert_eq!(builder.sigs[1].accumulated_weight, 10);
+        // The signature commitment is a sum tree root: each reveal leads to it
+        // after exactly its accumulated weight, and it sums to the signed weight
+        let paths = cert.sig_sum_proofs.as_ref().unwrap();
+        assert_eq!(paths.len(), cert.reveal_positions.len());
+        let sum_root = SumNode {
+            hash: cert.sig_commit[..].try_into().unwrap(),
+            sum: cert.signed_weight,
+        };
+        for (pos, path) in cert.reveal_positions.iter().zip(paths) {
+            let reveal = &cert.reveals[pos];
+            let leaf = WeightedLeaf::from_sig_slot(
+                params.hashing(),
+                *pos as usize,
+                &reveal.sig_slot,
+                reveal.party.weight,
+            )
+            .unwrap();
+            assert_eq!(
+                path.verify(params.hashing(), &sum_root, &leaf).unwrap(),
+                reveal.sig_slot.accumulated_weight
+            );
+            let overstated = SumNode {
+                sum: cert.signed_weight + 10,
+                ..sum_root
+            };
+            assert!(path.verify(params.hashing(), &overstated, &leaf).is_err());
+        }
 
-        builder
-            .add_signature(2, wallet3.sign_message(&msg))
-            .expect("Failed to add signature 3");
-        assert_eq!(builder.sigs[2].accumulated_weight, 30);
+        // Claiming another signed weight, accumulated weight or path fails
+        let mut overstated = cert.clone();
+        overstated.signed_weight += 10;
+        assert!(!overstated.verify(&params, &root).unwrap());
+        let mut shifted = cert.clone();
+        let first = shifted.reveal_positions[0];
+        shifted
+            .reveals
+            .get_mut(&first)
+            .unwrap()
+            .sig_slot
+            .accumulated_weight += 1;
+        assert!(!shifted.verify(&params, &root).unwrap());
+        let mut stripped = cert.clone();
+        stripped.sig_sum_proofs = None;
+        assert!(!stripped.verify(&params, &root).unwrap());
+
+        // Earlier versions keep the plain signature tree
+        let legacy = Params {
+            version: PARAMS_V4,
+            ..params
+        };
+        let mut builder = Builder::new(legacy.clone(), participants, root.clone()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate().skip(1) {
+            builder
+                .add_signature(pos, wallet.sign_message(&legacy.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        assert!(cert.sig_sum_proofs.is_none());
+        assert!(cert.verify(&legacy, &root).unwrap());
     }
 
     #[test]
@@ -703,8 +4063,7 @@ mod tests {
         // Test multiple coin choices to ensure they're consistent between Builder and Certificate
         for i in 0..10 {
             let coin = builder.coin_choice(i as u64, &cert.sig_commit);
-            let builder_pos = builder
-                .find_coin_position(coin)
+            let builder_pos = find_cum_position(&builder.signed_cum_weights().unwrap(), coin)
                 .expect("Failed to find position in builder");
             let cert_pos = cert
                 .find_coin_position(coin, &builder.sigs)
@@ -716,4 +4075,89 @@ mod tests {
             );
         }
     }
+
+    #[test]
+    fn test_key_in_reveal() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 20,
+            security_param: 16,
+            ..Default::default()
+        };
+        let hashing = params.hashing();
+        let keys: Vec<(usize, String)> = wallets
+            .iter()
+            .map(|w| hex::encode(w.public_key()))
+            .enumerate()
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| {
+                Participant::from_signer(w, 10)
+                    .with_key_in_reveal(hashing)
+                    .unwrap()
+            })
+            .collect();
+        assert_eq!(participants[0].public_key.len(), 64);
+        assert!(participants[0].commits_to_key(hashing, &wallets[0].public_key()));
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+
+        // The builder needs the committed keys, and only those
+        let mut wrong = keys.clone();
+        wrong[0].1 = keys[1].1.clone();
+        assert!(
+            Builder::new(params.clone(), participants.clone(), root.clone())
+                .unwrap()
+                .with_public_keys(wrong)
+                .is_err()
+        );
+        let mut builder = Builder::new(params.clone(), participants.clone(), root.clone()).unwrap();
+        let sig = wallets[0].sign_message(&params.signing_message());
+        assert!(matches!(
+            builder.add_signature(0, sig),
+            Err(CcokError::InvalidPublicKey(_))
+        ));
+        let mut builder = builder.with_public_keys(keys.clone()).unwrap();
+
+        // Reveals carrying the keys make certificates larger
+        let in_leaf: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut in_leaf_tree = MerkleTreeBuilder::with_hash(hashing);
+        in_leaf_tree.build(&in_leaf).unwrap();
+        let in_leaf_builder = Builder::new(params.clone(), in_leaf, in_leaf_tree.root()).unwrap();
+        assert!(
+            builder.estimate_cert_size(40).unwrap()
+                > in_leaf_builder.estimate_cert_size(40).unwrap()
+        );
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        assert!(cert.verify(&params, &root).unwrap());
+        assert!(cert
+            .reveals
+            .values()
+            .all(|reveal| reveal.public_key.is_some()));
+
+        // A reveal carrying another key, or none, is rejected
+        let mut forged = cert.clone();
+        let reveal = forged.reveals.values_mut().next().unwrap();
+        let other = keys
+            .iter()
+            .find(|(_, key)| Some(key) != reveal.public_key.as_ref());
+        reveal.public_key = other.map(|(_, key)| key.clone());
+        assert!(!forged.verify(&params, &root).unwrap_or(false));
+        let mut stripped = cert.clone();
+        stripped.reveals.values_mut().next().unwrap().public_key = None;
+        assert!(!stripped.verify(&params, &root).unwrap_or(false));
+    }
 }
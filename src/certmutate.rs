@@ -0,0 +1,342 @@
+//! Malformed certificates for regression testing verifiers. `mutations`
+//! takes a valid certificate and corrupts it systematically: flipped proof
+//! nodes, commitments, coin seeds and sum tree paths, swapped, reordered,
+//! duplicated and dropped reveals, understated weights and mismatched params. Each
+//! `Mutation` carries the `Rejection` a verifier must answer with, and
+//! `check` runs a verifier over the whole suite.
+use crate::ccok::{Certificate, Params, Verifier, PARAMS_V1, PARAMS_V2};
+use crate::error::CcokError;
+use crate::merkle::HashAlgorithm;
+use std::fmt;
+
+/// How a verifier rejects a certificate
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Rejection {
+    /// Verification returns false: a signature, proof or threshold fails
+    Invalid,
+    /// A reveal or proof is malformed, e.g. listed twice or out of order
+    Malformed,
+    /// A coin lands on no revealed position
+    UnrevealedCoin,
+    /// The signed weight is missing or overflows
+    Weight,
+    /// The certificate was built for other params
+    ParamsMismatch,
+    /// Any other error
+    Other,
+}
+
+impl Rejection {
+    /// Rejection of a verification result, `None` if the certificate verified
+    pub fn of(result: &Result<bool, CcokError>) -> Option<Self> {
+        match result {
+            Ok(true) => None,
+            Ok(false) => Some(Rejection::Invalid),
+            Err(e) => Some(match e {
+                CcokError::InvalidReveal(_)
+                | CcokError::BadMerklePath(_)
+                | CcokError::LeafOutOfRange(_)
+                | CcokError::InvalidPublicKey(_)
+                | CcokError::Serialization(_)
+                | CcokError::Scheme(_) => Rejection::Malformed,
+                CcokError::UnrevealedCoin { .. } => Rejection::UnrevealedCoin,
+                CcokError::InsufficientWeight { .. }
+                | CcokError::NoSignatures
+                | CcokError::WeightOverflow => Rejection::Weight,
+                CcokError::HashMismatch { .. }
+                | CcokError::VersionMismatch { .. }
+                | CcokError::UnsupportedVersion(_) => Rejection::ParamsMismatch,
+                _ => Rejection::Other,
+            }),
+        }
+    }
+}
+
+impl fmt::Display for Rejection {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        fmt::Debug::fmt(self, f)
+    }
+}
+
+/// A corrupted certificate and how verifiers must reject it
+#[derive(Debug, Clone)]
+pub struct Mutation {
+    pub name: &'static str,
+    pub cert: Certificate,
+    pub expected: Rejection,
+}
+
+// Flip the low bit of the first byte
+fn flip(bytes: &mut [u8]) {
+    if let Some(byte) = bytes.first_mut() {
+        *byte ^= 1;
+    }
+}
+
+/// Corrupted variants of `cert`, valid under `params`. Mutations that
+/// don't apply, e.g. swapping reveals of a certificate with one, are left out.
+pub fn mutations(cert: &Certificate, params: &Params) -> Vec<Mutation> {
+    let mut suite = Vec::new();
+    let mut add = |name, expected, mutate: &dyn Fn(&mut Certificate) -> bool| {
+        let mut mutated = cert.clone();
+        if mutate(&mut mutated) {
+            suite.push(Mutation {
+                name,
+                cert: mutated,
+                expected,
+            });
+        }
+    };
+    let first = cert.reveal_positions.first().copied();
+
+    add("sig_commit", Rejection::Invalid, &|c| {
+        flip(&mut c.sig_commit);
+        true
+    });
+    add(
+        "sig_proof_node",
+        Rejection::Invalid,
+        &|c| match c.sig_proofs.first_mut() {
+            Some(node) => {
+                flip(node);
+                true
+            }
+            None => false,
+        },
+    );
+    add(
+        "party_proof_node",
+        Rejection::Invalid,
+        &|c| match c.party_proofs.first_mut() {
+            Some(node) => {
+                flip(node);
+                true
+            }
+            None => false,
+        },
+    );
+    add("sig_sum_path", Rejection::Invalid, &|c| {
+        let path = match c
+            .sig_sum_proofs
+            .as_mut()
+            .and_then(|paths| paths.first_mut())
+        {
+            Some(path) => path,
+            None => return false,
+        };
+        match path.siblings.first_mut() {
+            Some(node) => {
+                node.sum += 1;
+                true
+            }
+            None => false,
+        }
+    });
+    add("truncated_sig_proof", Rejection::Invalid, &|c| {
+        c.sig_proofs.pop().is_some()
+    });
+    add("total_sigs", Rejection::Invalid, &|c| {
+        c.total_sigs += 1;
+        true
+    });
+    add("signature", Rejection::Invalid, &|c| {
+        let reveal = match first.and_then(|pos| c.reveals.get_mut(&pos)) {
+            Some(reveal) => reveal,
+            None => return false,
+        };
+        let mut bytes = match &reveal.sig_slot.signature {
+            Some(signature) => signature.as_bytes().to_vec(),
+            None => return false,
+        };
+        flip(&mut bytes);
+        reveal.sig_slot.signature = Some(bytes.into());
+        true
+    });
+    add("swapped_reveals", Rejection::Invalid, &|c| {
+        let (a, b) = match c.reveal_positions[..] {
+            [a, b, ..] => (a, b),
+            _ => return false,
+        };
+        let first = c.reveals[&a].clone();
+        let second = c.reveals.insert(b, first).unwrap();
+        c.reveals.insert(a, second);
+        true
+    });
+    add("reordered_positions", Rejection::Malformed, &|c| {
+        if c.reveal_positions.len() < 2 {
+            return false;
+        }
+        c.reveal_positions.swap(0, 1);
+        c.reveal_indices.swap(0, 1);
+        true
+    });
+    add(
+        "duplicated_position",
+        Rejection::Malformed,
+        &|c| match first {
+            Some(pos) => {
+                c.reveal_positions.insert(0, pos);
+                true
+            }
+            None => false,
+        },
+    );
+    add("unlisted_reveal", Rejection::Malformed, &|c| {
+        let free = (0..c.total_sigs as u64).find(|pos| !c.reveals.contains_key(pos));
+        match (first, free) {
+            (Some(pos), Some(free)) => {
+                let reveal = c.reveals[&pos].clone();
+                c.reveals.insert(free, reveal);
+                true
+            }
+            _ => false,
+        }
+    });
+    add("duplicated_reveal", Rejection::Invalid, &|c| {
+        let free = (0..c.total_sigs as u64).find(|pos| !c.reveals.contains_key(pos));
+        match (first, free) {
+            (Some(pos), Some(free)) => {
+                let reveal = c.reveals[&pos].clone();
+                c.reveals.insert(free, reveal);
+                let at = c.reveal_positions.partition_point(|&p| p < free);
+                c.reveal_positions.insert(at, free);
+                c.reveal_indices.insert(at, 0);
+                true
+            }
+            _ => false,
+        }
+    });
+    add("dropped_reveal", Rejection::Invalid, &|c| match first {
+        Some(pos) => {
+            c.reveals.remove(&pos);
+            c.reveal_positions.remove(0);
+            c.reveal_indices.remove(0);
+            true
+        }
+        None => false,
+    });
+    add("signed_weight_below_proven", Rejection::Invalid, &|c| {
+        c.signed_weight = params.proven_weight.saturating_sub(1);
+        true
+    });
+    add(
+        "understated_party_weight",
+        Rejection::Invalid,
+        &|c| match first.and_then(|pos| c.reveals.get_mut(&pos)) {
+            Some(reveal) if reveal.party.weight > 1 => {
+                reveal.party.weight -= 1;
+                true
+            }
+            _ => false,
+        },
+    );
+    add(
+        "understated_accumulated_weight",
+        Rejection::Invalid,
+        &|c| match first.and_then(|pos| c.reveals.get_mut(&pos)) {
+            Some(reveal) if reveal.sig_slot.accumulated_weight > 0 => {
+                reveal.sig_slot.accumulated_weight -= 1;
+                true
+            }
+            Some(reveal) => {
+                reveal.sig_slot.accumulated_weight += 1;
+                true
+            }
+            None => false,
+        },
+    );
+    add("coin_seed", Rejection::Invalid, &|c| {
+        flip(&mut c.coin_seed);
+        !c.coin_seed.is_empty()
+    });
+    add("aggregate_sig", Rejection::Invalid, &|c| {
+        flip(&mut c.aggregate_sig);
+        !c.aggregate_sig.is_empty()
+    });
+    add("hash", Rejection::ParamsMismatch, &|c| {
+        c.hash = match c.hash {
+            HashAlgorithm::Keccak256 => HashAlgorithm::Sha256,
+            _ => HashAlgorithm::Keccak256,
+        };
+        true
+    });
+    add("version", Rejection::ParamsMismatch, &|c| {
+        c.version = if c.version == PARAMS_V1 {
+            PARAMS_V2
+        } else {
+            PARAMS_V1
+        };
+        true
+    });
+    suite
+}
+
+/// Run `verifier` over every mutation of `cert`, failing with the first
+/// mutation it accepts or rejects other than expected
+pub fn check(verifier: &Verifier, cert: &Certificate, params: &Params) -> Result<usize, String> {
+    if !verifier.verify(cert, params)? {
+        return Err("Certificate to mutate doesn't verify".to_string());
+    }
+    let suite = mutations(cert, params);
+    for mutation in &suite {
+        let result = verifier.verify(&mutation.cert, params);
+        match Rejection::of(&result) {
+            Some(rejection) if rejection == mutation.expected => {}
+            Some(rejection) => {
+                return Err(format!(
+                    "Mutation {}: expected {}, rejected as {} ({:?})",
+                    mutation.name, mutation.expected, rejection, result
+                ))
+            }
+            None => {
+                return Err(format!(
+                    "Mutation {}: expected {}, but verified",
+                    mutation.name, mutation.expected
+                ))
+            }
+        }
+    }
+    Ok(suite.len())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant, PARAMS_V4, PARAMS_V5};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_mutations() {
+        let wallets: Vec<Wallet> = (0..6)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .enumerate()
+            .map(|(i, w)| Participant::from_signer(w, 10 * (i as u64 + 1)))
+            .collect();
+        for version in [PARAMS_V1, PARAMS_V2, PARAMS_V4, PARAMS_V5] {
+            let params = Params {
+                msg: b"Test message".to_vec(),
+                proven_weight: 60,
+                version,
+                ..Default::default()
+            };
+            let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+            party_tree.build(&participants).unwrap();
+            let root = party_tree.root();
+            let mut builder =
+                Builder::new(params.clone(), participants.clone(), root.clone()).unwrap();
+            for (pos, wallet) in wallets.iter().enumerate().skip(1) {
+                builder
+                    .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+            }
+            let cert = builder.build().unwrap();
+            let verifier = Verifier::new(root);
+            let checked = check(&verifier, &cert, &params).unwrap();
+            assert!(checked >= 12, "only {} mutations applied", checked);
+        }
+    }
+}
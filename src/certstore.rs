@@ -0,0 +1,253 @@
+//! Archive of the state proofs of a node. Relayers only need the proofs not
+//! yet relayed to the main chain, while auditors may want the full history,
+//! so a `CertStore` keeps proofs by epoch, the index of their interval, under
+//! a `Retention` policy. Pruning never drops a proof that hasn't been
+//! relayed; `compact` prunes and then reclaims the space in the backend.
+use crate::config::STATE_PROOF_INTERVAL;
+use crate::stateproof::StateProof;
+use crate::store::{KvStore, WriteBatch};
+
+// Keys of the proofs and of the relayed watermark, apart from the chain data
+const PROOF: u8 = b'P';
+const RELAYED: &[u8] = b"R";
+
+/// Proofs kept once they are relayed
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Retention {
+    KeepAll,
+    /// The proofs of the last `n` epochs
+    KeepLastEpochs(u64),
+    /// The proofs of every `every`th epoch, which a light client can still
+    /// follow, and of the last epoch
+    KeepCheckpoints {
+        every: u64,
+    },
+}
+
+impl Retention {
+    /// Whether the proof of `epoch` is kept when `latest` is the last epoch
+    pub fn keeps(&self, epoch: u64, latest: u64) -> bool {
+        match *self {
+            Retention::KeepAll => true,
+            Retention::KeepLastEpochs(n) => epoch + n > latest,
+            Retention::KeepCheckpoints { every } => {
+                epoch == latest || (every > 0 && epoch % every == 0)
+            }
+        }
+    }
+}
+
+/// Epoch of a proof, the index of the interval it certifies starting at 1
+pub fn proof_epoch(proof: &StateProof) -> u64 {
+    proof.message.last_block / STATE_PROOF_INTERVAL
+}
+
+fn key(epoch: u64) -> Vec<u8> {
+    let mut key = vec![PROOF];
+    key.extend_from_slice(&epoch.to_be_bytes());
+    key
+}
+
+fn decode(bytes: &[u8]) -> Result<StateProof, String> {
+    bincode::deserialize(bytes).map_err(|e| format!("Deserialization error: {}", e))
+}
+
+/// State proofs by epoch over a backend
+pub struct CertStore<S: KvStore> {
+    backend: S,
+    retention: Retention,
+}
+
+impl<S: KvStore> CertStore<S> {
+    pub fn new(backend: S, retention: Retention) -> Self {
+        Self { backend, retention }
+    }
+
+    pub fn backend(&self) -> &S {
+        &self.backend
+    }
+
+    /// Store the proof of an epoch, replacing any earlier one
+    pub fn put(&mut self, proof: &StateProof) -> Result<(), String> {
+        let bytes = bincode::serialize(proof).map_err(|e| format!("Serialization error: {}", e))?;
+        self.backend.put(&key(proof_epoch(proof)), &bytes)
+    }
+
+    pub fn get(&self, epoch: u64) -> Result<Option<StateProof>, String> {
+        self.backend
+            .get(&key(epoch))?
+            .map(|bytes| decode(&bytes))
+            .transpose()
+    }
+
+    /// Proof of the interval holding `block`, if kept
+    pub fn covering(&self, block: u64) -> Result<Option<StateProof>, String> {
+        self.get(block.div_ceil(STATE_PROOF_INTERVAL))
+    }
+
+    /// Proofs kept with their epochs, oldest first
+    pub fn proofs(&self) -> Result<Vec<(u64, StateProof)>, String> {
+        self.backend
+            .scan(&[PROOF])?
+            .iter()
+            .map(|(key, value)| Ok((epoch_of(key)?, decode(value)?)))
+            .collect()
+    }
+
+    /// Last epoch stored
+    pub fn latest_epoch(&self) -> Result<Option<u64>, String> {
+        match self.backend.scan(&[PROOF])?.last() {
+            Some((key, _)) => Ok(Some(epoch_of(key)?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Last epoch relayed to the main chain
+    pub fn relayed(&self) -> Result<Option<u64>, String> {
+        match self.backend.get(RELAYED)? {
+            Some(bytes) => Ok(Some(epoch_of_value(&bytes)?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Record that the proofs up to `epoch` are relayed
+    pub fn mark_relayed(&mut self, epoch: u64) -> Result<(), String> {
+        if self.relayed()? >= Some(epoch) {
+            return Ok(());
+        }
+        self.backend.put(RELAYED, &epoch.to_be_bytes())
+    }
+
+    /// Proofs not relayed yet, oldest first
+    pub fn unrelayed(&self) -> Result<Vec<StateProof>, String> {
+        let start = match self.relayed()? {
+            Some(epoch) => key(epoch + 1),
+            None => key(0),
+        };
+        self.backend
+            .range(&start, &[PROOF + 1])?
+            .iter()
+            .map(|(_, value)| decode(value))
+            .collect()
+    }
+
+    /// Delete the relayed proofs the retention policy drops, in one batch;
+    /// returns how many were deleted
+    pub fn prune(&mut self) -> Result<usize, String> {
+        let (Some(latest), Some(relayed)) = (self.latest_epoch()?, self.relayed()?) else {
+            return Ok(0);
+        };
+        let mut batch = WriteBatch::new();
+        for (key, _) in self.backend.range(&key(0), &key(relayed + 1))? {
+            if !self.retention.keeps(epoch_of(&key)?, latest) {
+                batch.delete(key);
+            }
+        }
+        let pruned = batch.len();
+        self.backend.write(batch)?;
+        Ok(pruned)
+    }
+
+    /// Prune and reclaim the space of the pruned proofs
+    pub fn compact(&mut self) -> Result<usize, String> {
+        let pruned = self.prune()?;
+        self.backend.compact()?;
+        Ok(pruned)
+    }
+}
+
+fn epoch_of(key: &[u8]) -> Result<u64, String> {
+    epoch_of_value(key.get(1..).unwrap_or_default())
+}
+
+fn epoch_of_value(bytes: &[u8]) -> Result<u64, String> {
+    bytes
+        .try_into()
+        .map(u64::from_be_bytes)
+        .map_err(|_| "Invalid certificate store entry".to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant};
+    use crate::merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder};
+    use crate::stateproof::StateProofMessage;
+    use crate::store::{FileStore, MemoryStore};
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_cert_store_retention() {
+        assert!(Retention::KeepLastEpochs(2).keeps(9, 10));
+        assert!(!Retention::KeepLastEpochs(2).keeps(8, 10));
+        assert!(Retention::KeepCheckpoints { every: 4 }.keeps(10, 10));
+        assert!(!Retention::KeepCheckpoints { every: 4 }.keeps(6, 10));
+
+        // A single signer certifies every interval
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let participants = vec![Participant::from_signer(&wallet, 10)];
+        let mut party_tree =
+            MerkleTreeBuilder::with_hash(Hashing::new(HashAlgorithm::Keccak256, true));
+        party_tree.build(&participants).unwrap();
+        let template = crate::ccok::Params {
+            msg: vec![],
+            proven_weight: 5,
+            security_param: 16,
+            ..Default::default()
+        };
+        let proof = |epoch: u64| {
+            let message = StateProofMessage {
+                first_block: (epoch - 1) * STATE_PROOF_INTERVAL + 1,
+                last_block: epoch * STATE_PROOF_INTERVAL,
+                block_headers_commitment: vec![epoch as u8; 32],
+                voters_commitment: party_tree.root(),
+            };
+            let params = message.params(&template).unwrap();
+            let signature = wallet.sign_message(&params.signing_message()).to_vec();
+            let mut builder =
+                Builder::new(params, participants.clone(), party_tree.root()).unwrap();
+            builder.add_signature(0, signature).unwrap();
+            StateProof {
+                message,
+                certificate: builder.build().unwrap(),
+            }
+        };
+
+        let mut store = CertStore::new(MemoryStore::new(), Retention::KeepLastEpochs(2));
+        for epoch in 1..=5 {
+            store.put(&proof(epoch)).unwrap();
+        }
+        assert_eq!(proof_epoch(&store.covering(20).unwrap().unwrap()), 2);
+        assert!(store.covering(100).unwrap().is_none());
+
+        // Only relayed proofs are pruned
+        assert_eq!(store.prune().unwrap(), 0);
+        store.mark_relayed(2).unwrap();
+        store.mark_relayed(1).unwrap();
+        assert_eq!(store.relayed().unwrap(), Some(2));
+        assert_eq!(store.prune().unwrap(), 2);
+        assert_eq!(store.unrelayed().unwrap().len(), 3);
+        store.mark_relayed(5).unwrap();
+        assert_eq!(store.prune().unwrap(), 1);
+        let epochs: Vec<u64> = store.proofs().unwrap().iter().map(|(e, _)| *e).collect();
+        assert_eq!(epochs, vec![4, 5]);
+
+        // Compaction shrinks the log and keeps the proofs
+        let path = std::env::temp_dir().join(format!("niropok-certs-{}.log", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let backend = FileStore::open(&path).unwrap();
+        let mut store = CertStore::new(backend, Retention::KeepCheckpoints { every: 2 });
+        for epoch in 1..=5 {
+            store.put(&proof(epoch)).unwrap();
+        }
+        store.mark_relayed(5).unwrap();
+        let size = store.backend().log_size().unwrap();
+        assert_eq!(store.compact().unwrap(), 2);
+        assert!(store.backend().log_size().unwrap() < size);
+        let store = CertStore::new(FileStore::open(&path).unwrap(), Retention::KeepAll);
+        let epochs: Vec<u64> = store.proofs().unwrap().iter().map(|(e, _)| *e).collect();
+        assert_eq!(epochs, vec![2, 4, 5]);
+        assert_eq!(store.relayed().unwrap(), Some(5));
+        std::fs::remove_file(&path).unwrap();
+    }
+}
@@ -0,0 +1,518 @@
+//! Commands of the `niropok` operator tool. Keys live in an encrypted
+//! keystore; participants, params and signatures are exchanged as JSON
+//! files, and certificates in their storage envelope. Participant sets can
+//! also be written as `public_key,weight[,scheme]` CSV, and operators agree on
+//! the next set out of band by comparing its party tree root and handoff.
+//! The commands are kept here, apart from argument parsing, so other tools
+//! can script them.
+use crate::ccok::{Builder, Certificate, KeyLayout, Params, Participant, Verifier};
+use crate::context::Context;
+use crate::envelope;
+use crate::error::CcokError;
+use crate::handoff::{Epoch, Handoff};
+use crate::keystore::{KeyFile, Keystore};
+use crate::merkle::{LeafSource, MerkleTreeBuilder};
+use crate::scheme::{verify_signature, SchemeId};
+use crate::signer::{generate_exportable_signer, SignatureScheme};
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::io::{BufRead, BufReader};
+use std::path::Path;
+
+/// Signature of a key over a message, as written by `sign`
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SignatureFile {
+    pub scheme: SchemeId,
+    /// Public key in hex
+    pub public_key: String,
+    /// Signature in hex
+    pub signature: String,
+}
+
+impl SignatureFile {
+    /// Check the signature over `msg`
+    pub fn verify(&self, msg: &[u8]) -> Result<bool, String> {
+        let public_key =
+            hex::decode(&self.public_key).map_err(|e| format!("Invalid public key: {}", e))?;
+        let signature =
+            hex::decode(&self.signature).map_err(|e| format!("Invalid signature: {}", e))?;
+        verify_signature(self.scheme, &public_key, msg, &signature)
+    }
+}
+
+pub fn read_json<T: DeserializeOwned>(path: impl AsRef<Path>) -> Result<T, String> {
+    let path = path.as_ref();
+    let json = std::fs::read_to_string(path)
+        .map_err(|e| format!("Failed to read {}: {}", path.display(), e))?;
+    serde_json::from_str(&json).map_err(|e| format!("Invalid {}: {}", path.display(), e))
+}
+
+pub fn write_json<T: Serialize>(path: impl AsRef<Path>, value: &T) -> Result<(), String> {
+    let path = path.as_ref();
+    let json =
+        serde_json::to_string_pretty(value).map_err(|e| format!("Serialization error: {}", e))?;
+    std::fs::write(path, json).map_err(|e| format!("Failed to write {}: {}", path.display(), e))
+}
+
+/// Scheme of a registry name such as `falcon512`
+pub fn parse_scheme(name: &str) -> Result<SignatureScheme, String> {
+    SignatureScheme::from_name(name).ok_or_else(|| {
+        let names: Vec<&str> = SignatureScheme::ALL.iter().map(|s| s.name()).collect();
+        format!(
+            "Unknown scheme {}, expected one of {}",
+            name,
+            names.join(", ")
+        )
+    })
+}
+
+/// Generate a key of `scheme` and store it as `name`
+pub fn keygen(
+    keystore: &Keystore,
+    name: &str,
+    passphrase: &str,
+    scheme: SignatureScheme,
+) -> Result<KeyFile, String> {
+    let signer = generate_exportable_signer(scheme)?;
+    keystore.create(name, passphrase, signer.as_ref())
+}
+
+/// Sign `msg` with the key `name`
+pub fn sign(
+    keystore: &Keystore,
+    name: &str,
+    passphrase: &str,
+    msg: &[u8],
+) -> Result<SignatureFile, String> {
+    let signer = keystore.unlock(name, passphrase)?;
+    Ok(SignatureFile {
+        scheme: signer.scheme(),
+        public_key: signer.public_key_hex(),
+        signature: hex::encode(signer.sign(msg)),
+    })
+}
+
+/// Root of the party tree of `participants` under `params`
+pub fn party_tree_root(participants: &[Participant], params: &Params) -> Result<Vec<u8>, String> {
+    let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+    party_tree.build(participants)?;
+    Ok(party_tree.root())
+}
+
+/// Participants of a CSV of `public_key,weight[,scheme]` lines; the scheme
+/// defaults to Dilithium2, and a header line and `#` comments are skipped
+pub fn parse_participants_csv(csv: &str) -> Result<Vec<Participant>, String> {
+    let mut participants = Vec::new();
+    for (i, line) in csv.lines().enumerate() {
+        if let Some(participant) = parse_participant_line(i, line)? {
+            participants.push(participant);
+        }
+    }
+    Ok(participants)
+}
+
+// Participant of line `i` of a participants CSV, if it isn't blank, a
+// comment or the header
+fn parse_participant_line(i: usize, line: &str) -> Result<Option<Participant>, String> {
+    let line = line.trim();
+    if line.is_empty() || line.starts_with('#') || (i == 0 && line.starts_with("public_key")) {
+        return Ok(None);
+    }
+    let fields: Vec<&str> = line.split(',').map(str::trim).collect();
+    let (public_key, weight, scheme) = match fields.as_slice() {
+        [public_key, weight] => (*public_key, *weight, SignatureScheme::Dilithium2),
+        [public_key, weight, scheme] => (*public_key, *weight, parse_scheme(scheme)?),
+        _ => {
+            return Err(format!(
+                "Line {}: expected public_key,weight[,scheme]",
+                i + 1
+            ))
+        }
+    };
+    let weight = weight
+        .parse()
+        .map_err(|e| format!("Line {}: invalid weight {}: {}", i + 1, weight, e))?;
+    let key = hex::decode(public_key)
+        .map_err(|e| format!("Line {}: invalid public key: {}", i + 1, e))?;
+    scheme
+        .info()
+        .check_public_key_len(key.len())
+        .map_err(|e| format!("Line {}: {}", i + 1, e))?;
+    Ok(Some(Participant {
+        public_key: public_key.to_lowercase(),
+        weight,
+        scheme: scheme.id(),
+        key_commitment: None,
+        vrf_key: None,
+        key_layout: KeyLayout::InLeaf,
+    }))
+}
+
+/// Participants CSV read line by line as the leaves of a party tree, so the
+/// root of a set too large to load can still be computed
+pub struct CsvParticipants<R> {
+    reader: R,
+    /// Participants fed so far
+    pub count: usize,
+    /// Weight of the participants fed so far
+    pub total_weight: u64,
+}
+
+impl<R: BufRead> CsvParticipants<R> {
+    pub fn new(reader: R) -> Self {
+        Self {
+            reader,
+            count: 0,
+            total_weight: 0,
+        }
+    }
+}
+
+impl<R: BufRead> LeafSource for CsvParticipants<R> {
+    fn for_each_leaf(
+        &mut self,
+        f: &mut dyn FnMut(usize, &[u8]) -> Result<(), CcokError>,
+    ) -> Result<(), CcokError> {
+        let mut line = String::new();
+        let mut buffer = Vec::new();
+        for i in 0.. {
+            line.clear();
+            let read = self
+                .reader
+                .read_line(&mut line)
+                .map_err(|e| CcokError::Serialization(format!("Failed to read CSV: {}", e)))?;
+            if read == 0 {
+                break;
+            }
+            let participant = match parse_participant_line(i, &line) {
+                Ok(Some(participant)) => participant,
+                Ok(None) => continue,
+                Err(e) => return Err(CcokError::Serialization(e)),
+            };
+            self.total_weight = self
+                .total_weight
+                .checked_add(participant.weight)
+                .ok_or(CcokError::WeightOverflow)?;
+            buffer.clear();
+            bincode::serialize_into(&mut buffer, &participant)?;
+            f(self.count, &buffer)?;
+            self.count += 1;
+        }
+        Ok(())
+    }
+}
+
+/// CSV of the participants, read back by `parse_participants_csv`
+pub fn participants_csv(participants: &[Participant]) -> Result<String, String> {
+    let mut csv = "public_key,weight,scheme\n".to_string();
+    for participant in participants {
+        let scheme = SignatureScheme::from_id(participant.scheme)
+            .ok_or_else(|| format!("Unknown signature scheme {:?}", participant.scheme))?;
+        csv.push_str(&format!(
+            "{},{},{}\n",
+            participant.public_key,
+            participant.weight,
+            scheme.name()
+        ));
+    }
+    Ok(csv)
+}
+
+/// Party tree root, participant count and total weight of a participants
+/// file under `params`, streaming `.csv` files rather than loading them
+pub fn participants_file_root(
+    path: impl AsRef<Path>,
+    params: &Params,
+) -> Result<(Vec<u8>, usize, u64), String> {
+    let path = path.as_ref();
+    if path.extension().map_or(false, |ext| ext == "csv") {
+        let file = std::fs::File::open(path)
+            .map_err(|e| format!("Failed to read {}: {}", path.display(), e))?;
+        let mut source = CsvParticipants::new(BufReader::new(file));
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build_from_source(&Context::background(), &mut source)?;
+        Ok((party_tree.root(), source.count, source.total_weight))
+    } else {
+        let participants = read_participants(path)?;
+        let total_weight = participants.iter().map(|p| p.weight).sum();
+        Ok((
+            party_tree_root(&participants, params)?,
+            participants.len(),
+            total_weight,
+        ))
+    }
+}
+
+/// Participants of a `.csv` file, or else of a JSON file
+pub fn read_participants(path: impl AsRef<Path>) -> Result<Vec<Participant>, String> {
+    let path = path.as_ref();
+    if path.extension().map_or(false, |ext| ext == "csv") {
+        let csv = std::fs::read_to_string(path)
+            .map_err(|e| format!("Failed to read {}: {}", path.display(), e))?;
+        parse_participants_csv(&csv)
+    } else {
+        read_json(path)
+    }
+}
+
+/// Write the participants as CSV to a `.csv` path, or else as JSON
+pub fn write_participants(
+    path: impl AsRef<Path>,
+    participants: &[Participant],
+) -> Result<(), String> {
+    let path = path.as_ref();
+    if path.extension().map_or(false, |ext| ext == "csv") {
+        std::fs::write(path, participants_csv(participants)?)
+            .map_err(|e| format!("Failed to write {}: {}", path.display(), e))
+    } else {
+        write_json(path, &participants)
+    }
+}
+
+/// Changes from one participant set to the next, by public key
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct ParticipantDiff {
+    pub added: Vec<String>,
+    pub removed: Vec<String>,
+    /// Public key with its old and new weight
+    pub reweighted: Vec<(String, u64, u64)>,
+    /// Whether the kept participants changed positions, which changes the
+    /// root even without other changes
+    pub reordered: bool,
+}
+
+impl ParticipantDiff {
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty()
+            && self.removed.is_empty()
+            && self.reweighted.is_empty()
+            && !self.reordered
+    }
+}
+
+pub fn diff_participants(old: &[Participant], new: &[Participant]) -> ParticipantDiff {
+    let find = |set: &[Participant], key: &str| set.iter().position(|p| p.public_key == key);
+    let mut diff = ParticipantDiff::default();
+    for participant in new {
+        match find(old, &participant.public_key) {
+            None => diff.added.push(participant.public_key.clone()),
+            Some(i) if old[i].weight != participant.weight => diff.reweighted.push((
+                participant.public_key.clone(),
+                old[i].weight,
+                participant.weight,
+            )),
+            Some(_) => {}
+        }
+    }
+    diff.removed = old
+        .iter()
+        .filter(|p| find(new, &p.public_key).is_none())
+        .map(|p| p.public_key.clone())
+        .collect();
+    let kept = |set: &[Participant], other: &[Participant]| -> Vec<String> {
+        set.iter()
+            .filter(|p| find(other, &p.public_key).is_some())
+            .map(|p| p.public_key.clone())
+            .collect()
+    };
+    diff.reordered = kept(old, new) != kept(new, old);
+    diff
+}
+
+/// Handoff from the participants of epoch `number` to the next set, with
+/// the certificate params the outgoing participants sign
+pub fn handoff(
+    number: u64,
+    outgoing: &[Participant],
+    incoming: &[Participant],
+    template: &Params,
+) -> Result<(Handoff, Params), String> {
+    let epoch = |number: u64, participants: &[Participant]| -> Result<Epoch, String> {
+        Ok(Epoch {
+            number,
+            voters_commitment: party_tree_root(participants, template)?,
+            total_weight: participants.iter().map(|p| p.weight).sum(),
+        })
+    };
+    let handoff = Handoff::new(epoch(number, outgoing)?, epoch(number + 1, incoming)?)?;
+    let params = handoff.params(template)?;
+    Ok((handoff, params))
+}
+
+/// Build a certificate from the signature files in `dir`. Files of keys that
+/// aren't participants, or over another message, are skipped and named in the
+/// second value returned.
+pub fn build_certificate(
+    params: &Params,
+    participants: &[Participant],
+    dir: impl AsRef<Path>,
+) -> Result<(Certificate, Vec<String>), String> {
+    let dir = dir.as_ref();
+    let root = party_tree_root(participants, params)?;
+    let mut builder = Builder::new(params.clone(), participants.to_vec(), root)?;
+    let msg = params.signing_message();
+    let mut paths: Vec<_> = std::fs::read_dir(dir)
+        .map_err(|e| format!("Failed to read {}: {}", dir.display(), e))?
+        .filter_map(|entry| entry.ok().map(|entry| entry.path()))
+        .filter(|path| path.extension().map_or(false, |ext| ext == "json"))
+        .collect();
+    paths.sort();
+
+    let mut skipped = Vec::new();
+    for path in paths {
+        let file: SignatureFile = read_json(&path)?;
+        let position = participants
+            .iter()
+            .position(|p| p.public_key == file.public_key && p.scheme == file.scheme);
+        match position {
+            Some(pos) if file.verify(&msg)? => {
+                let signature = hex::decode(&file.signature)
+                    .map_err(|e| format!("Invalid signature: {}", e))?;
+                builder.add_signature(pos, signature)?;
+            }
+            _ => skipped.push(path.display().to_string()),
+        }
+    }
+    Ok((builder.build()?, skipped))
+}
+
+/// Verify the enveloped certificate `bytes` against `party_tree_root`
+pub fn verify_certificate(
+    bytes: &[u8],
+    params: &Params,
+    party_tree_root: &[u8],
+) -> Result<bool, String> {
+    let cert = envelope::decode(bytes)?;
+    Ok(Verifier::new(party_tree_root.to_vec()).verify(&cert, params)?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::SecurityLevel;
+    use crate::keystore::KdfParams;
+    use crate::merkle::HashAlgorithm;
+
+    #[test]
+    fn test_cli_certificate_flow() {
+        let dir = std::env::temp_dir().join(format!("niropok-cli-{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        let signatures = dir.join("signatures");
+        std::fs::create_dir_all(&signatures).unwrap();
+        let keystore = Keystore::open(dir.join("keys"))
+            .unwrap()
+            .with_kdf(KdfParams {
+                m_cost: 64,
+                t_cost: 1,
+                p_cost: 1,
+            });
+        assert!(parse_scheme("rsa").is_err());
+
+        // One key of each of two schemes, plus an outsider
+        let keys = [
+            ("alice", "dilithium2"),
+            ("bob", "falcon512"),
+            ("eve", "falcon512"),
+        ];
+        let mut participants = Vec::new();
+        for (name, scheme) in &keys[..2] {
+            let file = keygen(&keystore, name, "pw", parse_scheme(scheme).unwrap()).unwrap();
+            participants.push(Participant {
+                public_key: file.public_key,
+                weight: 10,
+                scheme: file.scheme,
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            });
+        }
+        keygen(&keystore, "eve", "pw", SignatureScheme::Falcon512).unwrap();
+        let params = Params {
+            msg: b"epoch 3".to_vec(),
+            proven_weight: 15,
+            security_param: 64,
+            ..Default::default()
+        };
+        let params_path = dir.join("params.json");
+        write_json(&params_path, &params).unwrap();
+        let params: Params = read_json(&params_path).unwrap();
+
+        for (name, _) in &keys {
+            let file = sign(&keystore, name, "pw", &params.signing_message()).unwrap();
+            write_json(signatures.join(format!("{}.json", name)), &file).unwrap();
+        }
+        let (cert, skipped) = build_certificate(&params, &participants, &signatures).unwrap();
+        assert_eq!(skipped.len(), 1);
+        assert!(skipped[0].ends_with("eve.json"));
+
+        let bytes = envelope::encode(&cert).unwrap();
+        let root = party_tree_root(&participants, &params).unwrap();
+        assert!(verify_certificate(&bytes, &params, &root).unwrap());
+        let mut other = params.clone();
+        other.msg = b"epoch 4".to_vec();
+        assert!(!verify_certificate(&bytes, &other, &root).unwrap_or(false));
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_participant_sets() {
+        let keys: Vec<String> = (0..3)
+            .map(|_| crate::wallet::Wallet::new().unwrap().get_public_key())
+            .collect();
+        let csv = format!(
+            "public_key,weight\n{},10\n# leaving next epoch\n{},20,dilithium2\n",
+            keys[0], keys[1]
+        );
+        let old = parse_participants_csv(&csv).unwrap();
+        assert_eq!(old.len(), 2);
+        assert_eq!(old[1].weight, 20);
+        assert_eq!(
+            parse_participants_csv(&participants_csv(&old).unwrap()).unwrap()[0].public_key,
+            old[0].public_key
+        );
+        assert!(parse_participants_csv("abcd,10").is_err());
+        assert!(parse_participants_csv(&format!("{},ten", keys[0])).is_err());
+
+        let path =
+            std::env::temp_dir().join(format!("niropok-participants-{}.csv", std::process::id()));
+        write_participants(&path, &old).unwrap();
+        assert_eq!(read_participants(&path).unwrap().len(), 2);
+        let mut params = Params::preset(SecurityLevel::Security128, Vec::new(), 1);
+        params.hash = HashAlgorithm::Blake3;
+        assert_eq!(
+            participants_file_root(&path, &params).unwrap(),
+            (party_tree_root(&old, &params).unwrap(), 2, 30)
+        );
+        std::fs::remove_file(&path).unwrap();
+
+        // Key 0 stays with more weight, key 1 leaves and key 2 joins
+        let mut new = old.clone();
+        new[0].weight = 15;
+        new[1] = Participant {
+            public_key: keys[2].clone(),
+            ..old[1].clone()
+        };
+        let diff = diff_participants(&old, &new);
+        assert_eq!(diff.added, vec![keys[2].clone()]);
+        assert_eq!(diff.removed, vec![keys[1].clone()]);
+        assert_eq!(diff.reweighted, vec![(keys[0].clone(), 10, 15)]);
+        assert!(!diff.reordered);
+        assert!(diff_participants(&old, &old).is_empty());
+        let swapped: Vec<Participant> = old.iter().rev().cloned().collect();
+        assert!(diff_participants(&old, &swapped).reordered);
+
+        let template = Params {
+            msg: vec![],
+            security_param: 64,
+            ..Default::default()
+        };
+        let (message, params) = handoff(4, &old, &new, &template).unwrap();
+        assert_eq!(message.to.number, 5);
+        assert_eq!(
+            message.to.voters_commitment,
+            party_tree_root(&new, &template).unwrap()
+        );
+        assert_eq!(params.proven_weight, 20);
+        assert!(handoff(4, &old, &[], &template).is_err());
+    }
+}
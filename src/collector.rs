@@ -0,0 +1,378 @@
+//! Collection of certificate signatures by a builder coordinator. The
+//! coordinator gossips a `SignatureRequest` naming the params and the
+//! positions it still lacks; participants answer with `SignatureShare`s, and a
+//! `SignatureCollector` checks each share and feeds it to the certificate
+//! `Builder` as it arrives. Shares are deduplicated by position and every
+//! peer is rate limited, so flooding the coordinator can't make it verify
+//! more signatures than the limit allows. The `SubmissionPolicy` limits, the
+//! signature size and the position range are all checked before any
+//! signature is verified.
+use crate::ccok::{Builder, Certificate};
+use crate::gossip::{GossipMessage, GossipPayload, SignatureRequest, SignatureShare};
+use crate::hybrid;
+use crate::telemetry::{self, Span};
+use std::cell::RefCell;
+use std::collections::HashMap;
+use std::time::{Duration, Instant};
+
+/// Largest signature accepted by default, above the signatures of every
+/// registered scheme
+pub const DEFAULT_MAX_SIGNATURE_SIZE: usize = 64 * 1024;
+
+/// Number of messages a sender may deliver per window
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RateLimit {
+    pub max_messages: u32,
+    pub window: Duration,
+}
+
+impl Default for RateLimit {
+    fn default() -> Self {
+        Self {
+            max_messages: 16,
+            window: Duration::from_secs(1),
+        }
+    }
+}
+
+/// Limits on the signature shares a collector takes
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SubmissionPolicy {
+    /// Messages each peer may deliver per window
+    pub rate_limit: RateLimit,
+    /// Largest signature in bytes
+    pub max_signature_size: usize,
+}
+
+impl Default for SubmissionPolicy {
+    fn default() -> Self {
+        Self {
+            rate_limit: RateLimit::default(),
+            max_signature_size: DEFAULT_MAX_SIGNATURE_SIZE,
+        }
+    }
+}
+
+/// Collects the signature shares answering the requests of one builder
+pub struct SignatureCollector {
+    builder: Builder,
+    policy: SubmissionPolicy,
+    /// Start of the current window and messages in it, by sender
+    windows: HashMap<String, (Instant, u32)>,
+    /// Spans of the certificate and of its collection, taken by `build`
+    spans: RefCell<Option<(Span, Span)>>,
+}
+
+impl SignatureCollector {
+    /// Collector feeding `builder`
+    pub fn new(builder: Builder) -> Self {
+        let certificate = telemetry::detached("certificate", None);
+        let collect = telemetry::detached("collect", certificate.context());
+        Self {
+            builder,
+            policy: SubmissionPolicy::default(),
+            windows: HashMap::new(),
+            spans: RefCell::new(Some((certificate, collect))),
+        }
+    }
+
+    /// Rate limit senders to `limit`
+    pub fn with_rate_limit(mut self, limit: RateLimit) -> Self {
+        self.policy.rate_limit = limit;
+        self
+    }
+
+    /// Take shares under `policy`
+    pub fn with_policy(mut self, policy: SubmissionPolicy) -> Self {
+        self.policy = policy;
+        self
+    }
+
+    pub fn policy(&self) -> &SubmissionPolicy {
+        &self.policy
+    }
+
+    /// Builder holding the signatures collected
+    pub fn builder(&self) -> &Builder {
+        &self.builder
+    }
+
+    /// Positions with weight that haven't signed yet
+    pub fn pending(&self) -> Vec<usize> {
+        self.builder
+            .participants
+            .iter()
+            .zip(&self.builder.sigs)
+            .enumerate()
+            .filter(|(_, (party, slot))| party.weight > 0 && slot.signature.is_none())
+            .map(|(pos, _)| pos)
+            .collect()
+    }
+
+    /// Request for the signatures still pending
+    pub fn request(&self) -> SignatureRequest {
+        SignatureRequest {
+            params: self.builder.params.clone(),
+            positions: self.pending(),
+        }
+    }
+
+    /// Whether the signed weight exceeds the proven weight
+    pub fn is_ready(&self) -> bool {
+        self.builder.signed_weight > self.builder.params.proven_weight
+    }
+
+    /// Take the share of a gossip message; returns whether it added a
+    /// signature, ignoring messages other than shares
+    pub fn handle(&mut self, message: &GossipMessage) -> Result<bool, String> {
+        match &message.payload {
+            GossipPayload::Signature(share) => self.add_share(&message.sender, share),
+            _ => Ok(false),
+        }
+    }
+
+    /// Add the share `sender` delivered; returns whether it was new
+    pub fn add_share(&mut self, sender: &str, share: &SignatureShare) -> Result<bool, String> {
+        self.add_share_at(sender, sender, share, Instant::now())
+    }
+
+    /// Add the share of participant `sender` that `peer` relayed, rate
+    /// limiting the peer rather than the participant
+    pub fn add_share_from(
+        &mut self,
+        peer: &str,
+        sender: &str,
+        share: &SignatureShare,
+    ) -> Result<bool, String> {
+        self.add_share_at(peer, sender, share, Instant::now())
+    }
+
+    fn add_share_at(
+        &mut self,
+        peer: &str,
+        sender: &str,
+        share: &SignatureShare,
+        now: Instant,
+    ) -> Result<bool, String> {
+        if !self.allow(peer, now) {
+            return Err(format!("Peer {} is rate limited", peer));
+        }
+        self.add_checked(sender, share)
+    }
+
+    /// Add the shares another coordinator `peer` relayed in one message,
+    /// which counts once against its rate limit; returns how many were new
+    pub fn add_relayed(&mut self, peer: &str, shares: &[SignatureShare]) -> Result<usize, String> {
+        if !self.allow(peer, Instant::now()) {
+            return Err(format!("Peer {} is rate limited", peer));
+        }
+        let mut added = 0;
+        for share in shares {
+            // Relayed shares are authenticated by their signatures alone
+            let sender = self
+                .builder
+                .participants
+                .get(share.position)
+                .map(|party| party.public_key.clone())
+                .ok_or_else(|| format!("No participant at position {}", share.position))?;
+            if self.add_checked(&sender, share)? {
+                added += 1;
+            }
+        }
+        Ok(added)
+    }
+
+    // Check the share of participant `sender` and add it; whether it was new
+    fn add_checked(&mut self, sender: &str, share: &SignatureShare) -> Result<bool, String> {
+        if share.signature.len() > self.policy.max_signature_size {
+            return Err(format!(
+                "Signature share of {} bytes exceeds the limit of {}",
+                share.signature.len(),
+                self.policy.max_signature_size
+            ));
+        }
+        let params = &self.builder.params;
+        if share.msg != params.msg {
+            return Err("Signature share is for another message".to_string());
+        }
+        let party = self
+            .builder
+            .participants
+            .get(share.position)
+            .ok_or_else(|| format!("No participant at position {}", share.position))?;
+        if party.public_key != sender {
+            return Err(format!(
+                "Share of position {} not sent by its participant",
+                share.position
+            ));
+        }
+        if self.builder.sigs[share.position].signature.is_some() {
+            return Ok(false);
+        }
+        hybrid::check_signature_len(params.signature_mode, party.scheme, share.signature.len())?;
+        let public_key = hex::decode(&party.public_key)
+            .map_err(|e| format!("Invalid participant public key: {}", e))?;
+        if !hybrid::verify_signature(
+            params.signature_mode,
+            party.scheme,
+            &public_key,
+            &params.signing_message(),
+            &share.signature,
+        )? {
+            return Err(format!(
+                "Invalid signature share of position {}",
+                share.position
+            ));
+        }
+        self.builder
+            .add_signature(share.position, share.signature.clone())?;
+        Ok(true)
+    }
+
+    // Count a message of `peer`, whether it is within the limit
+    fn allow(&mut self, peer: &str, now: Instant) -> bool {
+        let limit = self.policy.rate_limit;
+        let window = self.windows.entry(peer.to_string()).or_insert((now, 0));
+        if now.duration_since(window.0) >= limit.window {
+            *window = (now, 0);
+        }
+        window.1 += 1;
+        window.1 <= limit.max_messages
+    }
+
+    /// Certificate over the signatures collected. The first build ends the
+    /// collection span and builds in the certificate span.
+    pub fn build(&self) -> Result<Certificate, String> {
+        let mut certificate = self
+            .spans
+            .borrow_mut()
+            .take()
+            .map(|(certificate, mut collect)| {
+                let signers = self
+                    .builder
+                    .sigs
+                    .iter()
+                    .filter(|slot| slot.signature.is_some());
+                collect.set_attribute("signers", signers.count());
+                collect.set_attribute("signed_weight", self.builder.signed_weight);
+                certificate
+            });
+        if let Some(certificate) = &mut certificate {
+            certificate.enter();
+        }
+        Ok(self.builder.build()?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Params, Participant, Verifier};
+    use crate::merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder};
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_signature_collector() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree =
+            MerkleTreeBuilder::with_hash(Hashing::new(HashAlgorithm::Keccak256, true));
+        party_tree.build(&participants).unwrap();
+        let params = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 15,
+            ..Default::default()
+        };
+        let builder =
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+        let mut collector = SignatureCollector::new(builder).with_rate_limit(RateLimit {
+            max_messages: 3,
+            window: Duration::from_secs(3600),
+        });
+
+        // Participants answer the request over gossip
+        let request = collector.request();
+        assert_eq!(request.positions, vec![0, 1, 2]);
+        let answer = |pos: usize, sequence| {
+            let share = request.respond(pos, &wallets[pos]);
+            GossipMessage::new(&wallets[pos], sequence, GossipPayload::Signature(share)).unwrap()
+        };
+        assert!(collector.handle(&answer(0, 0)).unwrap());
+        assert!(!collector.handle(&answer(0, 1)).unwrap());
+        assert!(!collector.is_ready());
+        assert_eq!(collector.request().positions, vec![1, 2]);
+
+        // Shares of others, over other messages or with bad signatures are refused
+        let share = request.respond(1, &wallets[1]);
+        assert!(collector
+            .add_share(&participants[2].public_key, &share)
+            .is_err());
+        let mut other = share.clone();
+        other.msg = b"block 8".to_vec();
+        assert!(collector
+            .add_share(&participants[1].public_key, &other)
+            .is_err());
+        let forged = request.respond(1, &wallets[2]);
+        assert!(collector
+            .add_share(&participants[1].public_key, &forged)
+            .is_err());
+
+        // Senders over the limit are refused until the window passes
+        assert!(collector
+            .add_share(&participants[1].public_key, &forged)
+            .is_err());
+        assert!(collector.handle(&answer(1, 0)).is_err());
+        let later = Instant::now() + Duration::from_secs(3600);
+        let sender = &participants[1].public_key;
+        assert!(collector
+            .add_share_at(sender, sender, &share, later)
+            .unwrap());
+        assert!(collector.is_ready());
+
+        // Peers are limited apart from the participants they relay, and
+        // oversized or misplaced shares are refused before verification
+        let mut limited = SignatureCollector::new(
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap(),
+        )
+        .with_policy(SubmissionPolicy {
+            rate_limit: RateLimit {
+                max_messages: 1,
+                window: Duration::from_secs(3600),
+            },
+            max_signature_size: share.signature.len(),
+        });
+        assert!(limited.add_share_from("peer-a", sender, &share).unwrap());
+        assert!(limited
+            .add_share_from("peer-a", sender, &share)
+            .unwrap_err()
+            .contains("rate limited"));
+        let mut oversized = share.clone();
+        oversized.signature.push(0);
+        assert!(limited
+            .add_share_from("peer-b", sender, &oversized)
+            .unwrap_err()
+            .contains("exceeds"));
+        let mut misplaced = share.clone();
+        misplaced.position = participants.len();
+        assert!(limited
+            .add_share_from("peer-c", sender, &misplaced)
+            .unwrap_err()
+            .contains("No participant"));
+        let mut truncated = request.respond(0, &wallets[0]);
+        truncated.signature.pop();
+        assert!(limited
+            .add_share_from("peer-d", &participants[0].public_key, &truncated)
+            .unwrap_err()
+            .contains("length"));
+
+        let cert = collector.build().unwrap();
+        assert!(Verifier::new(party_tree.root())
+            .verify(&cert, &params)
+            .unwrap());
+    }
+}
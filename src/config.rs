@@ -1,6 +1,8 @@
 pub const EPOCH_DURATION: u64 = 10;
 pub const BLOCK_INTERVAL: u64 = 6;
 pub const STAKING_AMOUNT: f64 = 100.00;
+// Number of blocks certified by one state proof
+pub const STATE_PROOF_INTERVAL: u64 = 16;
 
 // Maximum number of transactions to include in a single block
 pub const MAX_TXNS_PER_BLOCK: usize = 100; // Adjust as needed
@@ -0,0 +1,1019 @@
+//! Round-based BFT consensus over the weighted participants of an epoch, in
+//! the style of Tendermint. Each height runs rounds of three steps: the
+//! proposer of the round proposes a block hash, validators prevote for it,
+//! and once prevotes of more than two thirds of the weight agree on it they
+//! lock on the value and precommit it. Precommits of more than two thirds of
+//! the weight in one round commit the value.
+//!
+//! A locked validator only prevotes another value when its proposal carries
+//! a proof-of-lock: the later round in which prevotes of more than two thirds
+//! of the weight agreed on it. Proposers re-propose the last such value they
+//! saw, so validators locked in different rounds converge on the latest
+//! lock.
+//!
+//! A precommit is a signature over the certificate message of its height,
+//! round and value, so the precommits of a `Commit` are exactly the
+//! signatures a compact certificate `Builder` collects. Engines keep no timers
+//! and do no networking: they return `Output`s for the caller to broadcast and
+//! schedule, behind the `ConsensusEngine` trait so that other engines can
+//! replace `Tendermint`.
+use crate::ccok::{Builder, Certificate, Params, Participant};
+use crate::merkle::{HashDomain, Hashing};
+use crate::scheme::verify_signature;
+use crate::signer::Signer;
+use log::{debug, info, warn};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashSet};
+
+/// Step of a round
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum Step {
+    Propose,
+    Prevote,
+    Precommit,
+    /// The height is decided
+    Commit,
+}
+
+/// Kind of a vote
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+pub enum VoteKind {
+    Prevote,
+    Precommit,
+}
+
+/// Block hash proposed for a round
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Proposal {
+    pub height: u64,
+    pub round: u64,
+    pub value: [u8; 32],
+    /// Earlier round whose prevotes agreed on `value`, if the proposer
+    /// re-proposes it
+    pub valid_round: Option<u64>,
+    /// Position of the proposer among the participants
+    pub proposer: usize,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+impl Proposal {
+    /// Bytes the proposer signs
+    pub fn signing_bytes(&self) -> Result<Vec<u8>, String> {
+        let fields = (
+            "proposal",
+            self.height,
+            self.round,
+            self.value,
+            self.valid_round,
+        );
+        let encoded = bincode::serialize(&fields).map_err(|e| e.to_string())?;
+        Ok(HashDomain::Message.tagged(&encoded))
+    }
+}
+
+/// Prevote or precommit of a validator
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ConsensusVote {
+    pub kind: VoteKind,
+    pub height: u64,
+    pub round: u64,
+    /// Block hash voted for, `None` for nil
+    pub value: Option<[u8; 32]>,
+    /// Position of the voter among the participants
+    pub voter: usize,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+impl ConsensusVote {
+    /// Bytes the voter signs; a precommit for a value signs the certificate
+    /// message of the commit it makes
+    pub fn signing_bytes(&self, template: &Params) -> Result<Vec<u8>, String> {
+        if let (VoteKind::Precommit, Some(value)) = (self.kind, self.value) {
+            return Ok(commit_params(template, self.height, self.round, &value)?.signing_message());
+        }
+        let fields = (self.kind, self.height, self.round, self.value);
+        let encoded = bincode::serialize(&fields).map_err(|e| e.to_string())?;
+        Ok(HashDomain::Message.tagged(&encoded))
+    }
+}
+
+/// Certificate parameters of committing `value` in `round` of `height`:
+/// `template` with the commit as message
+pub fn commit_params(
+    template: &Params,
+    height: u64,
+    round: u64,
+    value: &[u8; 32],
+) -> Result<Params, String> {
+    let mut params = template.clone();
+    params.msg = bincode::serialize(&(height, round, value)).map_err(|e| e.to_string())?;
+    Ok(params)
+}
+
+/// Message exchanged between validators
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub enum ConsensusMessage {
+    Proposal(Proposal),
+    Vote(ConsensusVote),
+}
+
+/// Decision of a height with the precommits that made it
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Commit {
+    pub height: u64,
+    pub round: u64,
+    pub value: [u8; 32],
+    /// Precommit signatures by participant position, in position order
+    pub precommits: Vec<(usize, Vec<u8>)>,
+}
+
+impl Commit {
+    /// Certificate parameters of the commit
+    pub fn params(&self, template: &Params) -> Result<Params, String> {
+        commit_params(template, self.height, self.round, &self.value)
+    }
+
+    /// Compact certificate builder holding the precommits
+    pub fn builder(
+        &self,
+        template: &Params,
+        participants: Vec<Participant>,
+        party_tree_root: Vec<u8>,
+    ) -> Result<Builder, String> {
+        let mut builder = Builder::new(self.params(template)?, participants, party_tree_root)?;
+        for (pos, signature) in &self.precommits {
+            builder.add_signature(*pos, signature.clone())?;
+        }
+        Ok(builder)
+    }
+
+    /// Compact certificate of the commit
+    pub fn certificate(
+        &self,
+        template: &Params,
+        participants: Vec<Participant>,
+        party_tree_root: Vec<u8>,
+    ) -> Result<Certificate, String> {
+        Ok(self
+            .builder(template, participants, party_tree_root)?
+            .build()?)
+    }
+}
+
+/// Action an engine asks of its caller
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Output {
+    /// Send the message to the other validators
+    Broadcast(ConsensusMessage),
+    /// Call `on_timeout` with these arguments once the step timed out
+    Timeout { height: u64, round: u64, step: Step },
+    /// The height is decided
+    Commit(Commit),
+    /// A validator voted twice in one step for different values
+    Equivocation(ConsensusVote, ConsensusVote),
+}
+
+/// Block source of the engine
+pub trait Application {
+    /// Block hash to propose at `height`
+    fn propose(&mut self, height: u64) -> [u8; 32];
+
+    /// Whether the proposed block hash `value` is valid at `height`
+    fn validate(&self, height: u64, value: &[u8; 32]) -> bool;
+}
+
+/// Consensus engine deciding one block hash per height
+pub trait ConsensusEngine {
+    /// Height being decided
+    fn height(&self) -> u64;
+
+    /// Decision of the current height, once made
+    fn decision(&self) -> Option<&Commit>;
+
+    /// Start deciding `height`, dropping the state of the previous one
+    fn start(&mut self, height: u64) -> Result<Vec<Output>, String>;
+
+    /// Process a message from another validator
+    fn handle(&mut self, message: ConsensusMessage) -> Result<Vec<Output>, String>;
+
+    /// Process the timeout of a step the engine asked for
+    fn on_timeout(&mut self, height: u64, round: u64, step: Step) -> Result<Vec<Output>, String>;
+}
+
+/// Tendermint-style engine of one validator, or of an observer without a
+/// signer
+pub struct Tendermint<A: Application> {
+    app: A,
+    participants: Vec<Participant>,
+    total_weight: u64,
+    hashing: Hashing,
+    /// Certificate parameters precommits sign under
+    template: Params,
+    signer: Option<(usize, Box<dyn Signer>)>,
+    height: u64,
+    round: u64,
+    step: Step,
+    /// Round and value the validator is locked on
+    locked: Option<(u64, [u8; 32])>,
+    /// Latest round and value prevotes of a quorum agreed on
+    valid: Option<(u64, [u8; 32])>,
+    proposals: BTreeMap<u64, Proposal>,
+    votes: BTreeMap<(u64, VoteKind), BTreeMap<usize, ConsensusVote>>,
+    timeouts: HashSet<(u64, Step)>,
+    decision: Option<Commit>,
+}
+
+impl<A: Application> Tendermint<A> {
+    /// Engine over `participants`, with precommits signing under `template`
+    pub fn new(
+        app: A,
+        participants: Vec<Participant>,
+        hashing: Hashing,
+        template: Params,
+    ) -> Result<Self, String> {
+        let total_weight = participants.iter().map(|p| p.weight).sum();
+        if total_weight == 0 {
+            return Err("Consensus participants have no weight".to_string());
+        }
+        Ok(Self {
+            app,
+            participants,
+            total_weight,
+            hashing,
+            template,
+            signer: None,
+            height: 0,
+            round: 0,
+            step: Step::Propose,
+            locked: None,
+            valid: None,
+            proposals: BTreeMap::new(),
+            votes: BTreeMap::new(),
+            timeouts: HashSet::new(),
+            decision: None,
+        })
+    }
+
+    /// Take part as the participant at `index`, signing with `signer`
+    pub fn with_signer(mut self, index: usize, signer: Box<dyn Signer>) -> Result<Self, String> {
+        let party = self
+            .participants
+            .get(index)
+            .ok_or_else(|| format!("No participant at position {}", index))?;
+        if party.public_key != signer.public_key_hex() || party.scheme != signer.scheme() {
+            return Err(format!("Signer is not participant {}", index));
+        }
+        self.signer = Some((index, signer));
+        Ok(self)
+    }
+
+    /// Round being run
+    pub fn round(&self) -> u64 {
+        self.round
+    }
+
+    /// Step of the current round
+    pub fn step(&self) -> Step {
+        self.step
+    }
+
+    /// Position of the proposer of `round` at `height`, drawn by weight
+    pub fn proposer(&self, height: u64, round: u64) -> usize {
+        let mut seed = height.to_be_bytes().to_vec();
+        seed.extend_from_slice(&round.to_be_bytes());
+        let coin = self.hashing.hash(HashDomain::Coin, &seed);
+        let mut target = u64::from_be_bytes(coin[..8].try_into().unwrap()) % self.total_weight;
+        for (i, party) in self.participants.iter().enumerate() {
+            if target < party.weight {
+                return i;
+            }
+            target -= party.weight;
+        }
+        unreachable!("target is below the total weight")
+    }
+
+    // Whether `weight` is more than two thirds of the total
+    fn quorum(&self, weight: u64) -> bool {
+        3 * weight as u128 > 2 * self.total_weight as u128
+    }
+
+    fn verify(&self, signer: usize, bytes: &[u8], signature: &[u8]) -> Result<(), String> {
+        let party = self
+            .participants
+            .get(signer)
+            .ok_or_else(|| format!("No participant at position {}", signer))?;
+        let public_key = hex::decode(&party.public_key)
+            .map_err(|e| format!("Invalid participant public key: {}", e))?;
+        if !verify_signature(party.scheme, &public_key, bytes, signature)? {
+            return Err(format!("Invalid signature of participant {}", signer));
+        }
+        Ok(())
+    }
+
+    fn start_round(&mut self, round: u64, out: &mut Vec<Output>) -> Result<(), String> {
+        debug!("Height {} round {} started", self.height, round);
+        self.round = round;
+        self.step = Step::Propose;
+        if let Some((index, signer)) = &self.signer {
+            if *index == self.proposer(self.height, round) {
+                let (valid_round, value) = match self.valid {
+                    Some((valid_round, value)) => (Some(valid_round), value),
+                    None => (None, self.app.propose(self.height)),
+                };
+                let mut proposal = Proposal {
+                    height: self.height,
+                    round,
+                    value,
+                    valid_round,
+                    proposer: *index,
+                    signature: Vec::new(),
+                };
+                proposal.signature = signer.sign(&proposal.signing_bytes()?);
+                out.push(Output::Broadcast(ConsensusMessage::Proposal(
+                    proposal.clone(),
+                )));
+                self.proposals.insert(round, proposal);
+            }
+        }
+        self.schedule(Step::Propose, out);
+        self.advance(out)
+    }
+
+    fn schedule(&mut self, step: Step, out: &mut Vec<Output>) {
+        if self.timeouts.insert((self.round, step)) {
+            out.push(Output::Timeout {
+                height: self.height,
+                round: self.round,
+                step,
+            });
+        }
+    }
+
+    // Cast a vote of `kind` in the current round, moving to its step
+    fn vote(
+        &mut self,
+        kind: VoteKind,
+        value: Option<[u8; 32]>,
+        out: &mut Vec<Output>,
+    ) -> Result<(), String> {
+        self.step = match kind {
+            VoteKind::Prevote => Step::Prevote,
+            VoteKind::Precommit => Step::Precommit,
+        };
+        if let Some((index, signer)) = &self.signer {
+            let mut vote = ConsensusVote {
+                kind,
+                height: self.height,
+                round: self.round,
+                value,
+                voter: *index,
+                signature: Vec::new(),
+            };
+            vote.signature = signer.sign(&vote.signing_bytes(&self.template)?);
+            out.push(Output::Broadcast(ConsensusMessage::Vote(vote.clone())));
+            self.votes
+                .entry((vote.round, kind))
+                .or_default()
+                .insert(vote.voter, vote);
+        }
+        self.advance(out)
+    }
+
+    // Weight of the votes of `kind` in `round` for `value`, or for any value
+    // when `value` is `None`
+    fn weight(&self, round: u64, kind: VoteKind, value: Option<Option<[u8; 32]>>) -> u64 {
+        self.votes
+            .get(&(round, kind))
+            .into_iter()
+            .flat_map(BTreeMap::values)
+            .filter(|vote| value.map_or(true, |value| vote.value == value))
+            .map(|vote| self.participants[vote.voter].weight)
+            .sum()
+    }
+
+    // Value prevotes of a quorum agreed on in `round`, `Some(None)` for nil
+    fn polka(&self, round: u64) -> Option<Option<[u8; 32]>> {
+        self.votes
+            .get(&(round, VoteKind::Prevote))
+            .and_then(|votes| {
+                votes
+                    .values()
+                    .map(|vote| vote.value)
+                    .find(|value| self.quorum(self.weight(round, VoteKind::Prevote, Some(*value))))
+            })
+    }
+
+    // Apply the first rule that fires in the current state
+    fn advance(&mut self, out: &mut Vec<Output>) -> Result<(), String> {
+        if self.step == Step::Commit {
+            return Ok(());
+        }
+
+        // Precommits of a quorum in any round decide the height
+        let decided = self.votes.iter().find_map(|((round, kind), votes)| {
+            if *kind != VoteKind::Precommit {
+                return None;
+            }
+            votes.values().find_map(|vote| {
+                let value = vote.value?;
+                self.quorum(self.weight(*round, *kind, Some(Some(value))))
+                    .then_some((*round, value))
+            })
+        });
+        if let Some((round, value)) = decided {
+            let commit = Commit {
+                height: self.height,
+                round,
+                value,
+                precommits: self.votes[&(round, VoteKind::Precommit)]
+                    .values()
+                    .filter(|vote| vote.value == Some(value))
+                    .map(|vote| (vote.voter, vote.signature.clone()))
+                    .collect(),
+            };
+            info!(
+                "Committed {} at height {} round {}",
+                hex::encode(value),
+                self.height,
+                round
+            );
+            self.step = Step::Commit;
+            self.decision = Some(commit.clone());
+            out.push(Output::Commit(commit));
+            return Ok(());
+        }
+
+        // Votes of more than a third of the weight in a later round skip to it
+        let later = self
+            .votes
+            .keys()
+            .map(|(round, _)| *round)
+            .filter(|round| *round > self.round)
+            .find(|round| {
+                let voters: HashSet<usize> = [VoteKind::Prevote, VoteKind::Precommit]
+                    .iter()
+                    .filter_map(|kind| self.votes.get(&(*round, *kind)))
+                    .flat_map(BTreeMap::keys)
+                    .copied()
+                    .collect();
+                let weight: u64 = voters.iter().map(|i| self.participants[*i].weight).sum();
+                3 * weight as u128 > self.total_weight as u128
+            });
+        if let Some(round) = later {
+            return self.start_round(round, out);
+        }
+
+        let round = self.round;
+        match self.step {
+            Step::Propose => {
+                let Some(proposal) = self.proposals.get(&round) else {
+                    return Ok(());
+                };
+                let value = proposal.value;
+                // A lock gives way to a proof-of-lock from its round or later
+                let unlocked = match proposal.valid_round {
+                    None => self.locked.map_or(true, |(_, locked)| locked == value),
+                    Some(valid_round) => {
+                        if self.polka(valid_round) != Some(Some(value)) {
+                            return Ok(());
+                        }
+                        self.locked.map_or(true, |(locked_round, locked)| {
+                            locked_round <= valid_round || locked == value
+                        })
+                    }
+                };
+                let acceptable = unlocked && self.app.validate(self.height, &value);
+                self.vote(VoteKind::Prevote, acceptable.then_some(value), out)
+            }
+            Step::Prevote => match self.polka(round) {
+                Some(Some(value)) => {
+                    self.locked = Some((round, value));
+                    self.valid = Some((round, value));
+                    self.vote(VoteKind::Precommit, Some(value), out)
+                }
+                Some(None) => self.vote(VoteKind::Precommit, None, out),
+                None => {
+                    if self.quorum(self.weight(round, VoteKind::Prevote, None)) {
+                        self.schedule(Step::Prevote, out);
+                    }
+                    Ok(())
+                }
+            },
+            Step::Precommit => {
+                if let Some(Some(value)) = self.polka(round) {
+                    self.valid = Some((round, value));
+                }
+                if self.quorum(self.weight(round, VoteKind::Precommit, None)) {
+                    self.schedule(Step::Precommit, out);
+                }
+                Ok(())
+            }
+            Step::Commit => Ok(()),
+        }
+    }
+}
+
+impl<A: Application> ConsensusEngine for Tendermint<A> {
+    fn height(&self) -> u64 {
+        self.height
+    }
+
+    fn decision(&self) -> Option<&Commit> {
+        self.decision.as_ref()
+    }
+
+    fn start(&mut self, height: u64) -> Result<Vec<Output>, String> {
+        self.height = height;
+        self.locked = None;
+        self.valid = None;
+        self.proposals.clear();
+        self.votes.clear();
+        self.timeouts.clear();
+        self.decision = None;
+        let mut out = Vec::new();
+        self.start_round(0, &mut out)?;
+        Ok(out)
+    }
+
+    fn handle(&mut self, message: ConsensusMessage) -> Result<Vec<Output>, String> {
+        let mut out = Vec::new();
+        match message {
+            ConsensusMessage::Proposal(proposal) => {
+                if proposal.height != self.height || self.proposals.contains_key(&proposal.round) {
+                    return Ok(out);
+                }
+                let proposer = self.proposer(proposal.height, proposal.round);
+                if proposal.proposer != proposer {
+                    return Err(format!(
+                        "Participant {} is not the proposer of round {}",
+                        proposal.proposer, proposal.round
+                    ));
+                }
+                if proposal.valid_round.is_some_and(|r| r >= proposal.round) {
+                    return Err(format!(
+                        "Proof-of-lock of the proposal of round {} is not from an earlier round",
+                        proposal.round
+                    ));
+                }
+                self.verify(
+                    proposal.proposer,
+                    &proposal.signing_bytes()?,
+                    &proposal.signature,
+                )?;
+                self.proposals.insert(proposal.round, proposal);
+            }
+            ConsensusMessage::Vote(vote) => {
+                if vote.height != self.height {
+                    return Ok(out);
+                }
+                self.verify(
+                    vote.voter,
+                    &vote.signing_bytes(&self.template)?,
+                    &vote.signature,
+                )?;
+                let votes = self.votes.entry((vote.round, vote.kind)).or_default();
+                match votes.get(&vote.voter) {
+                    Some(previous) if previous.value == vote.value => return Ok(out),
+                    Some(previous) => {
+                        warn!(
+                            "Validator {} equivocated in round {} of height {}",
+                            vote.voter, vote.round, self.height
+                        );
+                        out.push(Output::Equivocation(previous.clone(), vote));
+                        return Ok(out);
+                    }
+                    None => {
+                        votes.insert(vote.voter, vote);
+                    }
+                }
+            }
+        }
+        self.advance(&mut out)?;
+        Ok(out)
+    }
+
+    fn on_timeout(&mut self, height: u64, round: u64, step: Step) -> Result<Vec<Output>, String> {
+        let mut out = Vec::new();
+        if height != self.height || round != self.round || self.step == Step::Commit {
+            return Ok(out);
+        }
+        match (step, self.step) {
+            (Step::Propose, Step::Propose) => self.vote(VoteKind::Prevote, None, &mut out)?,
+            (Step::Prevote, Step::Prevote) => self.vote(VoteKind::Precommit, None, &mut out)?,
+            (Step::Precommit, _) => self.start_round(round + 1, &mut out)?,
+            _ => {}
+        }
+        Ok(out)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::Verifier;
+    use crate::merkle::{HashAlgorithm, MerkleTreeBuilder};
+    use crate::scheme::SchemeId;
+    use crate::wallet::Wallet;
+    use std::rc::Rc;
+
+    struct Chain;
+
+    // Wallet shared between an engine and the test
+    struct Shared(Rc<Wallet>);
+
+    impl Signer for Shared {
+        fn scheme(&self) -> SchemeId {
+            self.0.scheme()
+        }
+
+        fn public_key(&self) -> Vec<u8> {
+            self.0.public_key()
+        }
+
+        fn sign(&self, msg: &[u8]) -> Vec<u8> {
+            Signer::sign(self.0.as_ref(), msg)
+        }
+    }
+
+    impl Application for Chain {
+        fn propose(&mut self, height: u64) -> [u8; 32] {
+            [height as u8; 32]
+        }
+
+        fn validate(&self, _height: u64, value: &[u8; 32]) -> bool {
+            value != &[0u8; 32]
+        }
+    }
+
+    // Deliver every broadcast to every other engine until none is left,
+    // returning the commits and the timeouts asked for
+    fn run(engines: &mut [Tendermint<Chain>], mut queue: Vec<(usize, Output)>) -> Vec<Output> {
+        let mut rest = Vec::new();
+        while let Some((from, output)) = queue.pop() {
+            match output {
+                Output::Broadcast(message) => {
+                    for (i, engine) in engines.iter_mut().enumerate() {
+                        if i != from {
+                            let outputs = engine.handle(message.clone()).unwrap();
+                            queue.extend(outputs.into_iter().map(|output| (i, output)));
+                        }
+                    }
+                }
+                other => rest.push(other),
+            }
+        }
+        rest
+    }
+
+    // Four validators of weight 10, each with its engine
+    fn setup() -> (
+        Hashing,
+        Params,
+        Vec<Rc<Wallet>>,
+        Vec<Participant>,
+        Vec<Tendermint<Chain>>,
+    ) {
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let template = Params {
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let wallets: Vec<Rc<Wallet>> = (0..4)
+            .map(|_| Rc::new(Wallet::new().expect("Failed to create wallet")))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w.as_ref(), 10))
+            .collect();
+        let engines = wallets
+            .iter()
+            .enumerate()
+            .map(|(i, wallet)| {
+                Tendermint::new(Chain, participants.clone(), hashing, template.clone())
+                    .unwrap()
+                    .with_signer(i, Box::new(Shared(wallet.clone())))
+                    .unwrap()
+            })
+            .collect();
+        (hashing, template, wallets, participants, engines)
+    }
+
+    // Proposal of `round` signed by its proposer
+    fn proposal(
+        wallets: &[Rc<Wallet>],
+        engine: &Tendermint<Chain>,
+        round: u64,
+        value: [u8; 32],
+        valid_round: Option<u64>,
+    ) -> Proposal {
+        let mut proposal = Proposal {
+            height: engine.height(),
+            round,
+            value,
+            valid_round,
+            proposer: engine.proposer(engine.height(), round),
+            signature: Vec::new(),
+        };
+        proposal.signature = Signer::sign(
+            wallets[proposal.proposer].as_ref(),
+            &proposal.signing_bytes().unwrap(),
+        );
+        proposal
+    }
+
+    // Vote of `voter` signed under `template`
+    fn vote(
+        wallets: &[Rc<Wallet>],
+        template: &Params,
+        kind: VoteKind,
+        round: u64,
+        value: Option<[u8; 32]>,
+        voter: usize,
+    ) -> ConsensusVote {
+        let mut vote = ConsensusVote {
+            kind,
+            height: 1,
+            round,
+            value,
+            voter,
+            signature: Vec::new(),
+        };
+        vote.signature = Signer::sign(
+            wallets[voter].as_ref(),
+            &vote.signing_bytes(template).unwrap(),
+        );
+        vote
+    }
+
+    // Prevotes an engine broadcast
+    fn prevotes(outputs: &[Output]) -> Vec<(u64, Option<[u8; 32]>)> {
+        outputs
+            .iter()
+            .filter_map(|output| match output {
+                Output::Broadcast(ConsensusMessage::Vote(vote))
+                    if vote.kind == VoteKind::Prevote =>
+                {
+                    Some((vote.round, vote.value))
+                }
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_tendermint_commit() {
+        let (hashing, template, wallets, participants, mut engines) = setup();
+
+        // All validators online: the first round commits the proposal
+        let mut queue = Vec::new();
+        for (i, engine) in engines.iter_mut().enumerate() {
+            queue.extend(engine.start(1).unwrap().into_iter().map(|o| (i, o)));
+        }
+        run(&mut engines, queue);
+        let commit = engines[0].decision().cloned().unwrap();
+        assert_eq!(
+            (commit.height, commit.round, commit.value),
+            (1, 0, [1u8; 32])
+        );
+        // Every validator decides the same value, each with the precommits it saw
+        assert!(engines
+            .iter()
+            .all(|e| e.decision().map(|c| (c.round, c.value)) == Some((0, commit.value))));
+        assert!(commit.precommits.len() >= 3);
+
+        // The precommits form a compact certificate of the commit
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build(&participants).unwrap();
+        let cert = commit
+            .certificate(&template, participants.clone(), party_tree.root())
+            .unwrap();
+        assert!(Verifier::new(party_tree.root())
+            .verify(&cert, &commit.params(&template).unwrap())
+            .unwrap());
+
+        // With the proposer silent, validators prevote nil on timeout and the
+        // next round commits
+        let silent = engines[0].proposer(2, 0);
+        let mut queue = Vec::new();
+        for (i, engine) in engines.iter_mut().enumerate() {
+            let outputs = engine.start(2).unwrap();
+            if i != silent {
+                queue.extend(outputs.into_iter().map(|o| (i, o)));
+            }
+        }
+        let mut timeouts = run(&mut engines, queue);
+        while engines.iter().any(|e| e.decision().is_none()) {
+            let mut queue = Vec::new();
+            for output in std::mem::take(&mut timeouts) {
+                if let Output::Timeout {
+                    height,
+                    round,
+                    step,
+                } = output
+                {
+                    for (i, engine) in engines.iter_mut().enumerate() {
+                        let outputs = engine.on_timeout(height, round, step).unwrap();
+                        queue.extend(outputs.into_iter().map(|o| (i, o)));
+                    }
+                }
+            }
+            assert!(!queue.is_empty(), "consensus stalled");
+            timeouts = run(&mut engines, queue);
+        }
+        let commit = engines[0].decision().unwrap();
+        assert_eq!(commit.value, [2u8; 32]);
+        assert!(commit.round > 0);
+
+        // A second vote of a validator for another value is reported
+        let mut vote = ConsensusVote {
+            kind: VoteKind::Prevote,
+            height: 2,
+            round: commit.round,
+            value: Some([9u8; 32]),
+            voter: 1,
+            signature: Vec::new(),
+        };
+        vote.signature = Signer::sign(wallets[1].as_ref(), &vote.signing_bytes(&template).unwrap());
+        let outputs = engines[0]
+            .handle(ConsensusMessage::Vote(vote.clone()))
+            .unwrap();
+        assert!(matches!(&outputs[..], [Output::Equivocation(_, second)] if *second == vote));
+        // Votes must be signed by their voter
+        vote.voter = 2;
+        assert!(engines[0].handle(ConsensusMessage::Vote(vote)).is_err());
+    }
+
+    #[test]
+    fn test_split_lock() {
+        let (_, template, wallets, _, mut engines) = setup();
+        let (a, b) = ([1u8; 32], [7u8; 32]);
+        // The tested validator proposes none of the first three rounds
+        let me = (0..4)
+            .find(|i| (0..3).all(|round| engines[0].proposer(1, round) != *i))
+            .unwrap();
+        let others: Vec<usize> = (0..4).filter(|i| *i != me).collect();
+        let mut engine = engines.swap_remove(me);
+
+        // Round 0: the validator alone sees prevotes of a quorum for `a` and
+        // locks on it, while the others precommit nil
+        engine.start(1).unwrap();
+        let message = ConsensusMessage::Proposal(proposal(&wallets, &engine, 0, a, None));
+        let outputs = engine.handle(message).unwrap();
+        assert_eq!(prevotes(&outputs), [(0, Some(a))]);
+        for voter in &others[..2] {
+            let prevote = vote(&wallets, &template, VoteKind::Prevote, 0, Some(a), *voter);
+            engine.handle(ConsensusMessage::Vote(prevote)).unwrap();
+        }
+        assert_eq!(engine.locked, Some((0, a)));
+        for voter in &others {
+            let precommit = vote(&wallets, &template, VoteKind::Precommit, 0, None, *voter);
+            engine.handle(ConsensusMessage::Vote(precommit)).unwrap();
+        }
+        engine.on_timeout(1, 0, Step::Precommit).unwrap();
+
+        // Round 1: the others lock on `b` without the validator, which stays
+        // locked on `a` and prevotes nil
+        let message = ConsensusMessage::Proposal(proposal(&wallets, &engine, 1, b, None));
+        let outputs = engine.handle(message).unwrap();
+        assert_eq!(prevotes(&outputs), [(1, None)]);
+        engine.on_timeout(1, 1, Step::Prevote).unwrap();
+        engine.on_timeout(1, 1, Step::Precommit).unwrap();
+        assert_eq!(engine.round(), 2);
+
+        // Round 2 re-proposes `b` with its proof-of-lock from round 1. The
+        // validator waits for the round 1 prevotes, then gives up its older
+        // lock
+        let message = ConsensusMessage::Proposal(proposal(&wallets, &engine, 2, b, Some(1)));
+        let outputs = engine.handle(message).unwrap();
+        assert!(prevotes(&outputs).is_empty());
+        let mut outputs = Vec::new();
+        for voter in &others {
+            let prevote = vote(&wallets, &template, VoteKind::Prevote, 1, Some(b), *voter);
+            outputs.extend(engine.handle(ConsensusMessage::Vote(prevote)).unwrap());
+        }
+        assert_eq!(prevotes(&outputs), [(2, Some(b))]);
+        assert_eq!(engine.locked, Some((0, a)));
+    }
+
+    #[test]
+    fn test_stale_proof_of_lock() {
+        let (_, template, wallets, _, mut engines) = setup();
+        let (a, b) = ([1u8; 32], [7u8; 32]);
+        let me = (0..4)
+            .find(|i| (0..3).all(|round| engines[0].proposer(1, round) != *i))
+            .unwrap();
+        let others: Vec<usize> = (0..4).filter(|i| *i != me).collect();
+        let mut engine = engines.swap_remove(me);
+
+        // Locked on `b` in round 1
+        engine.start(1).unwrap();
+        engine.on_timeout(1, 0, Step::Propose).unwrap();
+        engine.on_timeout(1, 0, Step::Prevote).unwrap();
+        engine.on_timeout(1, 0, Step::Precommit).unwrap();
+        engine
+            .handle(ConsensusMessage::Proposal(proposal(
+                &wallets, &engine, 1, b, None,
+            )))
+            .unwrap();
+        for voter in &others[..2] {
+            let prevote = vote(&wallets, &template, VoteKind::Prevote, 1, Some(b), *voter);
+            engine.handle(ConsensusMessage::Vote(prevote)).unwrap();
+        }
+        assert_eq!(engine.locked, Some((1, b)));
+        engine.on_timeout(1, 1, Step::Precommit).unwrap();
+
+        // A proof-of-lock for `a` from round 0 is older than the lock
+        let mut outputs = engine
+            .handle(ConsensusMessage::Proposal(proposal(
+                &wallets,
+                &engine,
+                2,
+                a,
+                Some(0),
+            )))
+            .unwrap();
+        for voter in &others {
+            let prevote = vote(&wallets, &template, VoteKind::Prevote, 0, Some(a), *voter);
+            outputs.extend(engine.handle(ConsensusMessage::Vote(prevote)).unwrap());
+        }
+        assert_eq!(prevotes(&outputs), [(2, None)]);
+        assert_eq!(engine.locked, Some((1, b)));
+    }
+
+    #[test]
+    fn test_engine_errors() {
+        let (hashing, template, wallets, participants, mut engines) = setup();
+
+        // Participants must have weight, and the signer must be one of them
+        let weightless: Vec<Participant> = participants
+            .iter()
+            .map(|p| Participant {
+                weight: 0,
+                ..p.clone()
+            })
+            .collect();
+        assert!(Tendermint::new(Chain, weightless, hashing, template.clone()).is_err());
+        let engine =
+            || Tendermint::new(Chain, participants.clone(), hashing, template.clone()).unwrap();
+        assert!(engine()
+            .with_signer(0, Box::new(Shared(wallets[1].clone())))
+            .is_err());
+        assert!(engine()
+            .with_signer(4, Box::new(Shared(wallets[0].clone())))
+            .is_err());
+
+        let engine = &mut engines[0];
+        engine.start(1).unwrap();
+        let round = 1;
+        let valid = proposal(&wallets, engine, round, [1u8; 32], None);
+
+        // Proposals must come from the proposer of their round, signed, with
+        // a proof-of-lock from an earlier round
+        let mut wrong = valid.clone();
+        wrong.proposer = (valid.proposer + 1) % 4;
+        wrong.signature = Signer::sign(
+            wallets[wrong.proposer].as_ref(),
+            &wrong.signing_bytes().unwrap(),
+        );
+        assert!(engine.handle(ConsensusMessage::Proposal(wrong)).is_err());
+        let mut forged = valid.clone();
+        forged.value = [2u8; 32];
+        assert!(engine.handle(ConsensusMessage::Proposal(forged)).is_err());
+        let mut unsigned = valid.clone();
+        unsigned.valid_round = Some(0);
+        assert!(engine.handle(ConsensusMessage::Proposal(unsigned)).is_err());
+        for valid_round in [round, round + 1] {
+            let future = proposal(&wallets, engine, round, [1u8; 32], Some(valid_round));
+            assert!(engine.handle(ConsensusMessage::Proposal(future)).is_err());
+        }
+
+        // Votes must be signed by a participant
+        let prevote = vote(&wallets, &template, VoteKind::Prevote, round, None, 1);
+        let mut unknown = prevote.clone();
+        unknown.voter = 4;
+        assert!(engine.handle(ConsensusMessage::Vote(unknown)).is_err());
+        let mut forged = prevote.clone();
+        forged.value = Some([1u8; 32]);
+        assert!(engine.handle(ConsensusMessage::Vote(forged)).is_err());
+        let mut precommit = prevote.clone();
+        precommit.kind = VoteKind::Precommit;
+        assert!(engine.handle(ConsensusMessage::Vote(precommit)).is_err());
+
+        // Messages of other heights are ignored
+        let mut other = prevote.clone();
+        other.height = 2;
+        assert!(engine
+            .handle(ConsensusMessage::Vote(other))
+            .unwrap()
+            .is_empty());
+        let mut other = valid.clone();
+        other.height = 2;
+        assert!(engine
+            .handle(ConsensusMessage::Proposal(other))
+            .unwrap()
+            .is_empty());
+        assert!(engine.on_timeout(2, 0, Step::Propose).unwrap().is_empty());
+    }
+}
@@ -0,0 +1,81 @@
+//! Cancellation and deadlines for long-running certificate work. Building and
+//! verifying check their context between reveals and while hashing, so a huge
+//! certificate can be abandoned without waiting for it to finish.
+use crate::error::CcokError;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+/// Cancellation signal and optional deadline. Clones share the signal, so
+/// cancelling any of them cancels all.
+#[derive(Debug, Clone, Default)]
+pub struct Context {
+    cancelled: Arc<AtomicBool>,
+    deadline: Option<Instant>,
+}
+
+impl Context {
+    /// Context that is never cancelled and has no deadline
+    pub fn background() -> Self {
+        Self::default()
+    }
+
+    /// Context that expires at `deadline`
+    pub fn with_deadline(deadline: Instant) -> Self {
+        Self {
+            cancelled: Arc::default(),
+            deadline: Some(deadline),
+        }
+    }
+
+    /// Context that expires `timeout` from now
+    pub fn with_timeout(timeout: Duration) -> Self {
+        Self::with_deadline(Instant::now() + timeout)
+    }
+
+    /// Deadline of the context, if any
+    pub fn deadline(&self) -> Option<Instant> {
+        self.deadline
+    }
+
+    /// Cancel the context and every clone of it
+    pub fn cancel(&self) {
+        self.cancelled.store(true, Ordering::Relaxed);
+    }
+
+    /// Whether the context was cancelled
+    pub fn is_cancelled(&self) -> bool {
+        self.cancelled.load(Ordering::Relaxed)
+    }
+
+    /// Fail if the context was cancelled or its deadline passed
+    pub fn check(&self) -> Result<(), CcokError> {
+        if self.is_cancelled() {
+            return Err(CcokError::Cancelled);
+        }
+        match self.deadline {
+            Some(deadline) if Instant::now() >= deadline => Err(CcokError::DeadlineExceeded),
+            _ => Ok(()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cancel_and_deadline() {
+        let ctx = Context::background();
+        assert!(ctx.check().is_ok());
+        let clone = ctx.clone();
+        clone.cancel();
+        assert_eq!(ctx.check(), Err(CcokError::Cancelled));
+
+        let expired = Context::with_deadline(Instant::now());
+        assert_eq!(expired.check(), Err(CcokError::DeadlineExceeded));
+        assert!(Context::with_timeout(Duration::from_secs(60))
+            .check()
+            .is_ok());
+    }
+}
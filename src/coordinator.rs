@@ -0,0 +1,333 @@
+//! Several coordinators building the same certificate, so the crash of one
+//! doesn't hold up the certificate. Each `Coordinator` collects signature
+//! shares with its own `SignatureCollector` and relays the shares it verified
+//! to the others in a `GossipPayload::Shares` message, so every coordinator
+//! ends up with the signatures any of them received. The coordinators agree
+//! without talking on a publishing order: they are ranked by the hash of the
+//! certificate message and their key, which rotates the first coordinator
+//! between certificates. A coordinator publishes once its certificate is
+//! ready and every better ranked coordinator had a slot of time to publish
+//! without announcing a `CertificateCandidate` whose certificate verifies. If
+//! several certificates get published anyway, the one of the best ranked
+//! coordinator wins.
+use crate::ccok::{Certificate, Params, Verifier};
+use crate::collector::SignatureCollector;
+use crate::gossip::{CertificateCandidate, GossipMessage, GossipPayload, SignatureShare};
+use sha3::{Digest, Sha3_256};
+use std::collections::HashSet;
+use std::time::{Duration, Instant};
+
+/// Time each coordinator is given to publish before the next one does
+pub const DEFAULT_PUBLISH_SLOT: Duration = Duration::from_secs(2);
+
+/// Coordinator keys in the order they may publish the certificate of
+/// `params`, the same on every node
+pub fn publishing_order(params: &Params, coordinators: &[String]) -> Vec<String> {
+    let msg = params.signing_message();
+    let mut order: Vec<(Vec<u8>, String)> = coordinators
+        .iter()
+        .map(|key| key.to_ascii_lowercase())
+        .collect::<HashSet<_>>()
+        .into_iter()
+        .map(|key| {
+            let mut hasher = Sha3_256::new();
+            hasher.update(&msg);
+            hasher.update(key.as_bytes());
+            (hasher.finalize().to_vec(), key)
+        })
+        .collect();
+    order.sort();
+    order.into_iter().map(|(_, key)| key).collect()
+}
+
+/// One of the coordinators building a certificate
+pub struct Coordinator {
+    collector: SignatureCollector,
+    /// Public key the coordinator gossips with, in hex
+    key: String,
+    /// Coordinators in publishing order
+    order: Vec<String>,
+    slot: Duration,
+    started: Instant,
+    /// Positions whose shares were relayed to the other coordinators
+    relayed: HashSet<usize>,
+    /// Best ranked candidate announced so far, with its rank
+    best: Option<(usize, CertificateCandidate)>,
+}
+
+impl Coordinator {
+    /// Coordinator `key` of `coordinators`, collecting into `collector`
+    pub fn new(
+        collector: SignatureCollector,
+        key: &str,
+        coordinators: &[String],
+    ) -> Result<Self, String> {
+        let order = publishing_order(&collector.builder().params, coordinators);
+        let key = key.to_ascii_lowercase();
+        if !order.contains(&key) {
+            return Err(format!("{} is not a coordinator", key));
+        }
+        Ok(Self {
+            collector,
+            key,
+            order,
+            slot: DEFAULT_PUBLISH_SLOT,
+            started: Instant::now(),
+            relayed: HashSet::new(),
+            best: None,
+        })
+    }
+
+    /// Give each coordinator `slot` to publish
+    pub fn with_slot(mut self, slot: Duration) -> Self {
+        self.slot = slot;
+        self
+    }
+
+    pub fn collector(&self) -> &SignatureCollector {
+        &self.collector
+    }
+
+    /// Coordinators in publishing order
+    pub fn order(&self) -> &[String] {
+        &self.order
+    }
+
+    /// Position of coordinator `key` in the publishing order
+    pub fn rank_of(&self, key: &str) -> Option<usize> {
+        let key = key.to_ascii_lowercase();
+        self.order.iter().position(|k| *k == key)
+    }
+
+    /// Position of this coordinator in the publishing order
+    pub fn rank(&self) -> usize {
+        self.rank_of(&self.key).unwrap_or(self.order.len())
+    }
+
+    /// Take a gossip message: the share of a participant, the shares or the
+    /// candidate of another coordinator. Returns whether it added a
+    /// signature or a better candidate, ignoring other messages. The sender's
+    /// signature is checked here, since the sender picks the coordinator rank
+    /// and the rate limit a message counts against.
+    pub fn handle(&mut self, message: &GossipMessage) -> Result<bool, String> {
+        let peer = match &message.payload {
+            GossipPayload::Signature(_) => {
+                message.verify()?;
+                return self.collector.handle(message);
+            }
+            GossipPayload::Shares(_) | GossipPayload::Candidate(_) => {
+                if message.sender.eq_ignore_ascii_case(&self.key) {
+                    return Ok(false);
+                }
+                let peer = self
+                    .rank_of(&message.sender)
+                    .ok_or_else(|| format!("{} is not a coordinator", message.sender))?;
+                message.verify()?;
+                peer
+            }
+            _ => return Ok(false),
+        };
+        match &message.payload {
+            GossipPayload::Shares(shares) => {
+                let added = self.collector.add_relayed(&message.sender, shares)?;
+                // The sender has these already
+                self.relayed
+                    .extend(shares.iter().map(|share| share.position));
+                Ok(added > 0)
+            }
+            GossipPayload::Candidate(candidate) => {
+                let builder = self.collector.builder();
+                if candidate.msg != builder.params.msg {
+                    return Err("Candidate is for another message".to_string());
+                }
+                // A coordinator holds back only for a certificate that
+                // verifies, so a bogus candidate can't stall publishing
+                let verifier = Verifier::new(builder.party_tree_root.clone());
+                if !verifier.verify(&candidate.certificate, &builder.params)? {
+                    return Err(format!(
+                        "Candidate certificate of {} doesn't verify",
+                        message.sender
+                    ));
+                }
+                Ok(self.announce(peer, candidate.clone()))
+            }
+            _ => Ok(false),
+        }
+    }
+
+    // Record the candidate of the coordinator ranked `rank`; whether it beats
+    // the best one so far
+    fn announce(&mut self, rank: usize, candidate: CertificateCandidate) -> bool {
+        if self.best.as_ref().is_some_and(|(best, _)| *best <= rank) {
+            return false;
+        }
+        self.best = Some((rank, candidate));
+        true
+    }
+
+    /// Shares collected since the last exchange, for the other coordinators
+    pub fn exchange(&mut self) -> Option<GossipPayload> {
+        let builder = self.collector.builder();
+        let shares: Vec<SignatureShare> = builder
+            .sigs
+            .iter()
+            .enumerate()
+            .filter(|(pos, _)| !self.relayed.contains(pos))
+            .filter_map(|(position, slot)| {
+                Some(SignatureShare {
+                    msg: builder.params.msg.clone(),
+                    position,
+                    signature: slot.signature.as_ref()?.as_bytes().to_vec(),
+                })
+            })
+            .collect();
+        if shares.is_empty() {
+            return None;
+        }
+        self.relayed
+            .extend(shares.iter().map(|share| share.position));
+        Some(GossipPayload::Shares(shares))
+    }
+
+    /// Whether the coordinator should publish its certificate now
+    pub fn should_publish(&self) -> bool {
+        self.should_publish_at(Instant::now())
+    }
+
+    fn should_publish_at(&self, now: Instant) -> bool {
+        let rank = self.rank();
+        self.collector.is_ready()
+            && self.best.as_ref().map_or(true, |(best, _)| *best > rank)
+            && now >= self.started + self.slot * rank as u32
+    }
+
+    /// Build the certificate to publish, and the candidate announcing it to
+    /// the other coordinators
+    pub fn publish(&mut self) -> Result<(Certificate, GossipPayload), String> {
+        let cert = self.collector.build()?;
+        let candidate = CertificateCandidate {
+            msg: self.collector.builder().params.msg.clone(),
+            certificate: cert.clone(),
+        };
+        self.announce(self.rank(), candidate.clone());
+        Ok((cert, GossipPayload::Candidate(candidate)))
+    }
+
+    /// Candidate of the best ranked coordinator that published, the one the
+    /// chain keeps
+    pub fn winner(&self) -> Option<&CertificateCandidate> {
+        self.best.as_ref().map(|(_, candidate)| candidate)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant, Verifier};
+    use crate::merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder};
+    use crate::signer::Signer;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_coordinators() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree =
+            MerkleTreeBuilder::with_hash(Hashing::new(HashAlgorithm::Keccak256, true));
+        party_tree.build(&participants).unwrap();
+        let params = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 15,
+            ..Default::default()
+        };
+        let nodes: Vec<Wallet> = (0..2).map(|_| Wallet::new().unwrap()).collect();
+        let keys: Vec<String> = nodes.iter().map(|node| node.public_key_hex()).collect();
+        let order = publishing_order(&params, &keys);
+        let mut reversed = keys.clone();
+        reversed.reverse();
+        assert_eq!(publishing_order(&params, &reversed), order);
+
+        // The coordinators, first in publishing order first
+        let slot = Duration::from_secs(60);
+        let mut coordinators: Vec<(Coordinator, &Wallet)> = order
+            .iter()
+            .map(|key| {
+                let node = nodes.iter().find(|n| n.public_key_hex() == *key).unwrap();
+                let builder =
+                    Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+                let coordinator = Coordinator::new(SignatureCollector::new(builder), key, &keys)
+                    .unwrap()
+                    .with_slot(slot);
+                (coordinator, node)
+            })
+            .collect();
+        assert_eq!(coordinators[1].0.rank(), 1);
+
+        // Participant shares reach one coordinator each, and the
+        // coordinators exchange them
+        let request = coordinators[0].0.collector().request();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            let share = request.respond(pos, wallet);
+            let message = GossipMessage::new(wallet, 0, GossipPayload::Signature(share)).unwrap();
+            assert!(coordinators[pos % 2].0.handle(&message).unwrap());
+        }
+        assert!(!coordinators[1].0.collector().is_ready());
+        for from in 0..2 {
+            let payload = coordinators[from].0.exchange().unwrap();
+            assert!(coordinators[from].0.exchange().is_none());
+            let message = GossipMessage::new(coordinators[from].1, 0, payload).unwrap();
+            assert!(coordinators[1 - from].0.handle(&message).unwrap());
+        }
+        assert!(coordinators[0].0.exchange().is_none());
+        assert!(coordinators.iter().all(|(c, _)| c.collector().is_ready()));
+
+        // Only the first coordinator publishes at once, the second after its
+        // slot unless the first announced its certificate
+        let now = Instant::now();
+        assert!(coordinators[0].0.should_publish_at(now));
+        assert!(!coordinators[1].0.should_publish_at(now));
+        assert!(coordinators[1].0.should_publish_at(now + slot));
+        let (cert, payload) = coordinators[0].0.publish().unwrap();
+        assert!(!coordinators[0].0.should_publish_at(now + slot));
+        assert!(Verifier::new(party_tree.root())
+            .verify(&cert, &params)
+            .unwrap());
+
+        // A candidate whose certificate doesn't verify is refused and holds
+        // back no one
+        let mut forged = cert.clone();
+        forged.sig_commit[0] ^= 1;
+        let forged = GossipPayload::Candidate(CertificateCandidate {
+            msg: params.msg.clone(),
+            certificate: forged,
+        });
+        let forged = GossipMessage::new(coordinators[0].1, 1, forged).unwrap();
+        assert!(coordinators[1].0.handle(&forged).is_err());
+        assert!(coordinators[1].0.should_publish_at(now + slot));
+
+        // So is a candidate the claimed coordinator didn't sign
+        let mut announcement = GossipMessage::new(coordinators[0].1, 2, payload).unwrap();
+        let signature = announcement.signature.clone();
+        announcement.signature[0] ^= 1;
+        assert!(coordinators[1].0.handle(&announcement).is_err());
+        assert!(coordinators[1].0.should_publish_at(now + slot));
+        announcement.signature = signature;
+
+        assert!(coordinators[1].0.handle(&announcement).unwrap());
+        assert!(!coordinators[1].0.should_publish_at(now + slot));
+        assert_eq!(
+            coordinators[1].0.winner().unwrap().certificate.sig_commit,
+            cert.sig_commit
+        );
+
+        // Shares and candidates of non-coordinators are refused
+        let outsider =
+            GossipMessage::new(&wallets[0], 1, GossipPayload::Shares(Vec::new())).unwrap();
+        assert!(coordinators[1].0.handle(&outsider).is_err());
+    }
+}
@@ -0,0 +1,872 @@
+//! Distributed generation of the bridge emergency key. A committee of
+//! validators jointly creates a key that `threshold` of them can recover,
+//! without any of them ever knowing it alone. Each member deals a random
+//! secret in Shamir shares over the secp256k1 scalar field, broadcasting
+//! Pedersen commitments to the coefficients of its polynomial and sending
+//! each share privately. Every member checks its share lies on the committed
+//! polynomial, so a dealer can't hand out shares of inconsistent secrets. A
+//! member receiving a share that doesn't match complains; the dealer answers
+//! by opening the share in public, and is disqualified if it can't. The
+//! group secret is the sum of the secrets of the qualified dealers, and each
+//! member's key share the sum of the shares it received from them.
+//!
+//! Pedersen commitments hide the dealt secrets whatever the computing power
+//! of an observer, so a quantum adversary learns nothing of the group key
+//! from the transcript. Their binding rests on discrete logarithms: a
+//! quantum dealer could open a commitment two ways, but only while the key
+//! generation runs.
+//!
+//! Post-quantum schemes have no practical threshold signing, so the group key
+//! is a Dilithium2 key seeded by the group secret. Signing reconstructs it:
+//! `threshold` members hand their shares to one combiner, who learns the
+//! whole secret and from then on can sign alone. Members should only join
+//! their shares for a combiner they trust with the key, once to publish the
+//! group public key in a `GroupKey` and again in an emergency, and the
+//! committee should generate a fresh key after every emergency use. The
+//! `GroupKey` proves its members against the party tree and carries the
+//! signatures of the members that approved it.
+use crate::ccok::Participant;
+use crate::merkle::{verify_proof_with, AuditPath, HashDomain, Hashing, MerkleTreeBuilder};
+use crate::scheme::{verify_signature, SchemeId};
+use crate::signer::{zeroize, Signer};
+use crate::wallet::Wallet;
+use k256::elliptic_curve::{group::GroupEncoding, Field, PrimeField};
+use k256::{schnorr, CompressedPoint, FieldBytes, ProjectivePoint, Scalar};
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Sha3_256};
+use std::collections::{BTreeMap, BTreeSet};
+use std::sync::OnceLock;
+
+const BLINDING_TAG: &[u8] = b"niropok/dkg-blinding\0";
+
+/// Bytes of a compressed commitment point
+pub const POINT_BYTES: usize = 33;
+
+// Second generator of the commitments, hashed to the curve so that nobody
+// knows its discrete logarithm to the first
+fn blinding_base() -> ProjectivePoint {
+    static BASE: OnceLock<ProjectivePoint> = OnceLock::new();
+    *BASE.get_or_init(|| {
+        (0u32..)
+            .find_map(|counter| {
+                let x = Sha3_256::new()
+                    .chain_update(BLINDING_TAG)
+                    .chain_update(counter.to_be_bytes())
+                    .finalize();
+                let key = schnorr::VerifyingKey::from_bytes(&x).ok()?;
+                Some(ProjectivePoint::from(*key.as_affine()))
+            })
+            .expect("half of all x coordinates are on the curve")
+    })
+}
+
+fn scalar(bytes: &[u8; 32]) -> Option<Scalar> {
+    Option::from(Scalar::from_repr(FieldBytes::from(*bytes)))
+}
+
+fn point(bytes: &[u8]) -> Option<ProjectivePoint> {
+    if bytes.len() != POINT_BYTES {
+        return None;
+    }
+    Option::from(ProjectivePoint::from_bytes(CompressedPoint::from_slice(
+        bytes,
+    )))
+}
+
+// Pedersen commitment to `value` blinded by `blinding`
+fn commit(value: Scalar, blinding: Scalar) -> ProjectivePoint {
+    ProjectivePoint::GENERATOR * value + blinding_base() * blinding
+}
+
+/// Committee running a key generation
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DkgConfig {
+    /// Party tree positions of the members, sorted
+    pub members: Vec<usize>,
+    /// Shares needed to recover the key
+    pub threshold: usize,
+}
+
+impl DkgConfig {
+    pub fn new(mut members: Vec<usize>, threshold: usize) -> Result<Self, String> {
+        members.sort_unstable();
+        members.dedup();
+        if members.len() > 255 {
+            return Err(format!(
+                "{} members exceed the 255 supported",
+                members.len()
+            ));
+        }
+        if threshold == 0 || threshold > members.len() {
+            return Err(format!(
+                "Threshold {} out of range for {} members",
+                threshold,
+                members.len()
+            ));
+        }
+        Ok(Self { members, threshold })
+    }
+
+    /// Share coordinate of the member at party position `position`
+    pub fn coordinate(&self, position: usize) -> Result<u8, String> {
+        self.members
+            .binary_search(&position)
+            .map(|index| index as u8 + 1)
+            .map_err(|_| format!("Position {} is not a committee member", position))
+    }
+}
+
+/// Broadcast commitments of a dealer to its polynomials
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DealerCommitment {
+    pub dealer: usize,
+    /// Compressed Pedersen commitments to the coefficients, constant term
+    /// first
+    pub commitments: Vec<Vec<u8>>,
+}
+
+/// Share sent privately to its recipient, or opened in public to answer a
+/// complaint
+#[derive(Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ShareMessage {
+    pub dealer: usize,
+    pub recipient: usize,
+    pub share: [u8; 32],
+    pub blinding: [u8; 32],
+}
+
+// Implement Debug trait for ShareMessage without leaking the share
+impl std::fmt::Debug for ShareMessage {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "ShareMessage {{ dealer: {}, recipient: {}, share: <secret> }}",
+            self.dealer, self.recipient
+        )
+    }
+}
+
+impl ShareMessage {
+    /// Whether the share lies on the polynomial `commitment` commits to, at
+    /// the recipient's coordinate
+    pub fn matches(&self, config: &DkgConfig, commitment: &DealerCommitment) -> bool {
+        let Ok(x) = config.coordinate(self.recipient) else {
+            return false;
+        };
+        let (Some(share), Some(blinding)) = (scalar(&self.share), scalar(&self.blinding)) else {
+            return false;
+        };
+        if commitment.dealer != self.dealer || commitment.commitments.len() != config.threshold {
+            return false;
+        }
+        let x = Scalar::from(x as u64);
+        let mut expected = ProjectivePoint::IDENTITY;
+        for bytes in commitment.commitments.iter().rev() {
+            let Some(coefficient) = point(bytes) else {
+                return false;
+            };
+            expected = expected * x + coefficient;
+        }
+        commit(share, blinding) == expected
+    }
+}
+
+/// Accusation of a dealer by a member whose share was missing or invalid
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Complaint {
+    pub dealer: usize,
+    pub accuser: usize,
+}
+
+/// Commitment and private shares of one dealer
+pub struct Dealing {
+    pub commitment: DealerCommitment,
+    pub shares: Vec<ShareMessage>,
+}
+
+/// Deal a fresh random secret as the member at `dealer`
+pub fn deal(config: &DkgConfig, dealer: usize) -> Result<Dealing, String> {
+    config.coordinate(dealer)?;
+    let mut rng = rand::thread_rng();
+    // Coefficients of the secret and blinding polynomials, constant term
+    // first
+    let coefficients: Vec<(Scalar, Scalar)> = (0..config.threshold)
+        .map(|_| (Scalar::random(&mut rng), Scalar::random(&mut rng)))
+        .collect();
+    let shares = config
+        .members
+        .iter()
+        .enumerate()
+        .map(|(i, &recipient)| {
+            let x = Scalar::from(i as u64 + 1);
+            let (share, blinding) = coefficients
+                .iter()
+                .rev()
+                .fold((Scalar::ZERO, Scalar::ZERO), |(s, r), (a, b)| {
+                    (s * x + *a, r * x + *b)
+                });
+            ShareMessage {
+                dealer,
+                recipient,
+                share: share.to_bytes().into(),
+                blinding: blinding.to_bytes().into(),
+            }
+        })
+        .collect();
+    let commitments = coefficients
+        .iter()
+        .map(|(a, b)| commit(*a, *b).to_bytes().to_vec())
+        .collect();
+    Ok(Dealing {
+        commitment: DealerCommitment {
+            dealer,
+            commitments,
+        },
+        shares,
+    })
+}
+
+/// Public record of a key generation, the same at every honest member
+#[derive(Debug, Clone)]
+pub struct Transcript {
+    pub config: DkgConfig,
+    pub commitments: BTreeMap<usize, DealerCommitment>,
+    pub complaints: BTreeSet<(usize, usize)>,
+    /// Shares opened in answer to complaints, by dealer and accuser
+    pub justifications: BTreeMap<(usize, usize), ShareMessage>,
+}
+
+impl Transcript {
+    pub fn new(config: DkgConfig) -> Self {
+        Self {
+            config,
+            commitments: BTreeMap::new(),
+            complaints: BTreeSet::new(),
+            justifications: BTreeMap::new(),
+        }
+    }
+
+    pub fn add_commitment(&mut self, commitment: DealerCommitment) -> Result<(), String> {
+        self.config.coordinate(commitment.dealer)?;
+        if commitment.commitments.len() != self.config.threshold {
+            return Err(format!(
+                "Dealer {} committed to {} coefficients for threshold {}",
+                commitment.dealer,
+                commitment.commitments.len(),
+                self.config.threshold
+            ));
+        }
+        if commitment
+            .commitments
+            .iter()
+            .any(|bytes| point(bytes).is_none())
+        {
+            return Err(format!(
+                "Dealer {} committed to an invalid point",
+                commitment.dealer
+            ));
+        }
+        if self.commitments.contains_key(&commitment.dealer) {
+            return Err(format!("Dealer {} committed twice", commitment.dealer));
+        }
+        self.commitments.insert(commitment.dealer, commitment);
+        Ok(())
+    }
+
+    pub fn add_complaint(&mut self, complaint: Complaint) -> Result<(), String> {
+        self.config.coordinate(complaint.accuser)?;
+        if !self.commitments.contains_key(&complaint.dealer) {
+            return Err(format!(
+                "Complaint against unknown dealer {}",
+                complaint.dealer
+            ));
+        }
+        self.complaints
+            .insert((complaint.dealer, complaint.accuser));
+        Ok(())
+    }
+
+    /// Record a share a dealer opened to answer a complaint
+    pub fn add_justification(&mut self, share: ShareMessage) -> Result<(), String> {
+        let key = (share.dealer, share.recipient);
+        if !self.complaints.contains(&key) {
+            return Err(format!(
+                "No complaint of {} against dealer {}",
+                share.recipient, share.dealer
+            ));
+        }
+        self.justifications.insert(key, share);
+        Ok(())
+    }
+
+    /// Whether every complaint against `dealer` was answered with a share
+    /// matching its commitment
+    pub fn is_qualified(&self, dealer: usize) -> bool {
+        let Some(commitment) = self.commitments.get(&dealer) else {
+            return false;
+        };
+        self.complaints
+            .range((dealer, 0)..=(dealer, usize::MAX))
+            .all(|key| {
+                self.justifications
+                    .get(key)
+                    .map_or(false, |share| share.matches(&self.config, commitment))
+            })
+    }
+
+    /// Dealers whose secrets make up the group secret
+    pub fn qualified(&self) -> Result<Vec<usize>, String> {
+        let qualified: Vec<usize> = self
+            .commitments
+            .keys()
+            .copied()
+            .filter(|&dealer| self.is_qualified(dealer))
+            .collect();
+        if qualified.len() < self.config.threshold {
+            return Err(format!(
+                "Only {} dealers qualified, {} needed",
+                qualified.len(),
+                self.config.threshold
+            ));
+        }
+        Ok(qualified)
+    }
+}
+
+/// Share of the group secret held by one member
+#[derive(Clone, PartialEq, Eq)]
+pub struct KeyShare {
+    pub position: usize,
+    pub x: u8,
+    value: [u8; 32],
+}
+
+// Implement Debug trait for KeyShare without leaking the share
+impl std::fmt::Debug for KeyShare {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "KeyShare {{ position: {}, x: {}, value: <secret> }}",
+            self.position, self.x
+        )
+    }
+}
+
+impl Drop for KeyShare {
+    fn drop(&mut self) {
+        zeroize(&mut self.value);
+    }
+}
+
+/// One committee member's side of a key generation
+#[derive(Debug, Clone)]
+pub struct DkgMember {
+    pub position: usize,
+    shares: BTreeMap<usize, ShareMessage>,
+}
+
+impl DkgMember {
+    pub fn new(position: usize) -> Self {
+        Self {
+            position,
+            shares: BTreeMap::new(),
+        }
+    }
+
+    /// Take a privately received share, or complain about it
+    pub fn receive(&mut self, transcript: &Transcript, share: ShareMessage) -> Option<Complaint> {
+        let complaint = Complaint {
+            dealer: share.dealer,
+            accuser: self.position,
+        };
+        match transcript.commitments.get(&share.dealer) {
+            Some(commitment)
+                if share.recipient == self.position
+                    && share.matches(&transcript.config, commitment) =>
+            {
+                self.shares.insert(share.dealer, share);
+                None
+            }
+            _ => Some(complaint),
+        }
+    }
+
+    /// Complaints against the dealers that committed but sent no valid share
+    pub fn missing(&self, transcript: &Transcript) -> Vec<Complaint> {
+        transcript
+            .commitments
+            .keys()
+            .filter(|dealer| !self.shares.contains_key(dealer))
+            .map(|&dealer| Complaint {
+                dealer,
+                accuser: self.position,
+            })
+            .collect()
+    }
+
+    /// Sum the shares of the qualified dealers into the member's key share,
+    /// taking the shares opened for the member in public
+    pub fn finish(&mut self, transcript: &Transcript) -> Result<KeyShare, String> {
+        for ((_, accuser), share) in &transcript.justifications {
+            if *accuser == self.position {
+                if let Some(commitment) = transcript.commitments.get(&share.dealer) {
+                    if share.matches(&transcript.config, commitment) {
+                        self.shares.insert(share.dealer, share.clone());
+                    }
+                }
+            }
+        }
+        let mut value = Scalar::ZERO;
+        for dealer in transcript.qualified()? {
+            let share = self
+                .shares
+                .get(&dealer)
+                .and_then(|share| scalar(&share.share))
+                .ok_or_else(|| format!("No share from qualified dealer {}", dealer))?;
+            value += share;
+        }
+        Ok(KeyShare {
+            position: self.position,
+            x: transcript.config.coordinate(self.position)?,
+            value: value.to_bytes().into(),
+        })
+    }
+}
+
+/// Group secret interpolated from `threshold` or more key shares
+pub fn reconstruct(shares: &[KeyShare], threshold: usize) -> Result<[u8; 32], String> {
+    let coordinates: BTreeSet<u8> = shares.iter().map(|share| share.x).collect();
+    if coordinates.len() != shares.len() || coordinates.contains(&0) {
+        return Err("Key shares must have distinct non-zero coordinates".to_string());
+    }
+    if threshold == 0 || shares.len() < threshold {
+        return Err(format!(
+            "{} key shares given, {} needed",
+            shares.len(),
+            threshold
+        ));
+    }
+    let shares = &shares[..threshold];
+    let mut secret = Scalar::ZERO;
+    for share in shares {
+        let value =
+            scalar(&share.value).ok_or_else(|| "Key share out of the scalar field".to_string())?;
+        // Lagrange coefficient of the share at zero
+        let x = Scalar::from(share.x as u64);
+        let coefficient =
+            shares
+                .iter()
+                .filter(|other| other.x != share.x)
+                .fold(Scalar::ONE, |acc, other| {
+                    let other = Scalar::from(other.x as u64);
+                    acc * other * (other - x).invert().unwrap()
+                });
+        secret += coefficient * value;
+    }
+    Ok(secret.to_bytes().into())
+}
+
+/// Emergency key of `threshold` or more joined key shares. The caller ends up
+/// holding the whole group secret, not a share of a signature: it can sign
+/// anything with the key until the committee replaces it
+pub fn group_signer(shares: &[KeyShare], threshold: usize) -> Result<Wallet, String> {
+    let seed = reconstruct(shares, threshold)?;
+    Ok(Wallet::from_seed(&seed))
+}
+
+/// Committee member with its proof of membership in the party tree
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct GroupMember {
+    pub position: usize,
+    pub participant: Participant,
+    pub path: AuditPath,
+}
+
+/// Published emergency key of a committee
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct GroupKey {
+    pub members: Vec<GroupMember>,
+    pub threshold: usize,
+    /// Dealers whose secrets make up the key
+    pub qualified: Vec<usize>,
+    /// Group public key in hex
+    pub public_key: String,
+    pub scheme: SchemeId,
+    /// Approvals of members over `signing_bytes`, by position
+    pub approvals: Vec<(usize, Vec<u8>)>,
+}
+
+impl GroupKey {
+    /// Group key of `transcript` with public key `public_key`, proving the
+    /// members in `party_tree`
+    pub fn new(
+        transcript: &Transcript,
+        participants: &[Participant],
+        party_tree: &MerkleTreeBuilder,
+        group: &dyn Signer,
+    ) -> Result<Self, String> {
+        let members = transcript
+            .config
+            .members
+            .iter()
+            .map(|&position| {
+                let participant = participants
+                    .get(position)
+                    .cloned()
+                    .ok_or_else(|| format!("No participant at position {}", position))?;
+                Ok(GroupMember {
+                    position,
+                    participant,
+                    path: party_tree.prove_leaf(position)?,
+                })
+            })
+            .collect::<Result<Vec<GroupMember>, String>>()?;
+        Ok(Self {
+            members,
+            threshold: transcript.config.threshold,
+            qualified: transcript.qualified()?,
+            public_key: group.public_key_hex(),
+            scheme: group.scheme(),
+            approvals: Vec::new(),
+        })
+    }
+
+    /// Bytes members sign to approve the key
+    pub fn signing_bytes(&self) -> Result<Vec<u8>, String> {
+        let fields = (
+            &self.members,
+            self.threshold,
+            &self.qualified,
+            &self.public_key,
+            self.scheme,
+        );
+        let encoded =
+            bincode::serialize(&fields).map_err(|e| format!("Serialization error: {}", e))?;
+        Ok(HashDomain::Message.tagged(&encoded))
+    }
+
+    /// Add the approval of the member at `position`, signed by `signer`
+    pub fn approve(&mut self, position: usize, signer: &dyn Signer) -> Result<(), String> {
+        let signature = signer.sign(&self.signing_bytes()?);
+        self.approvals.push((position, signature));
+        Ok(())
+    }
+
+    /// Check the members belong to the party tree with root `party_tree_root`
+    /// and `threshold` of the qualified ones approved the key
+    pub fn verify(&self, hashing: Hashing, party_tree_root: &[u8]) -> Result<bool, String> {
+        if !self
+            .members
+            .windows(2)
+            .all(|w| w[0].position < w[1].position)
+            || self.threshold == 0
+            || self.qualified.len() < self.threshold
+        {
+            return Ok(false);
+        }
+        let mut members = BTreeMap::new();
+        for member in &self.members {
+            let leaf = hashing.leaf_hash(&member.participant)?;
+            if !verify_proof_with(
+                hashing,
+                party_tree_root,
+                member.position,
+                &leaf,
+                &member.path,
+            ) {
+                return Ok(false);
+            }
+            members.insert(member.position, &member.participant);
+        }
+        if !self.qualified.iter().all(|q| members.contains_key(q)) {
+            return Ok(false);
+        }
+
+        let msg = self.signing_bytes()?;
+        let mut approved = BTreeSet::new();
+        for (position, signature) in &self.approvals {
+            let Some(participant) = members.get(position) else {
+                return Ok(false);
+            };
+            let public_key = hex::decode(&participant.public_key)
+                .map_err(|e| format!("Invalid public key: {}", e))?;
+            if !verify_signature(participant.scheme, &public_key, &msg, signature)? {
+                return Ok(false);
+            }
+            approved.insert(*position);
+        }
+        Ok(self
+            .qualified
+            .iter()
+            .filter(|q| approved.contains(q))
+            .count()
+            >= self.threshold)
+    }
+
+    /// Emergency signer of joined key shares, checked against the published
+    /// key so a dealer that handed out inconsistent shares is caught
+    pub fn signer(&self, shares: &[KeyShare]) -> Result<Wallet, String> {
+        let wallet = group_signer(shares, self.threshold)?;
+        if wallet.get_public_key() != self.public_key {
+            return Err("Key shares do not recover the group key".to_string());
+        }
+        Ok(wallet)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::merkle::HashAlgorithm;
+
+    // Committee of positions 0, 2, 3 and 4 out of five validators, 3-of-4
+    fn setup() -> (Vec<Wallet>, Vec<Participant>, DkgConfig) {
+        let wallets: Vec<Wallet> = (0..5).map(|_| Wallet::new().unwrap()).collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let config = DkgConfig::new(vec![4, 0, 2, 3], 3).unwrap();
+        (wallets, participants, config)
+    }
+
+    // Transcript of honest dealings by every member, with their shares
+    // delivered
+    fn run(config: &DkgConfig) -> (Transcript, Vec<KeyShare>) {
+        let dealings: Vec<Dealing> = config
+            .members
+            .iter()
+            .map(|&dealer| deal(config, dealer).unwrap())
+            .collect();
+        let mut transcript = Transcript::new(config.clone());
+        for dealing in &dealings {
+            transcript
+                .add_commitment(dealing.commitment.clone())
+                .unwrap();
+        }
+        let mut members: Vec<DkgMember> =
+            config.members.iter().map(|&p| DkgMember::new(p)).collect();
+        for dealing in &dealings {
+            for (member, share) in members.iter_mut().zip(&dealing.shares) {
+                assert!(member.receive(&transcript, share.clone()).is_none());
+            }
+        }
+        let shares = members
+            .iter_mut()
+            .map(|m| m.finish(&transcript).unwrap())
+            .collect();
+        (transcript, shares)
+    }
+
+    #[test]
+    fn test_dkg_emergency_key() {
+        let (wallets, participants, config) = setup();
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build(&participants).unwrap();
+
+        let dealings: Vec<Dealing> = config
+            .members
+            .iter()
+            .map(|&dealer| deal(&config, dealer).unwrap())
+            .collect();
+        let mut transcript = Transcript::new(config.clone());
+        for dealing in &dealings {
+            transcript
+                .add_commitment(dealing.commitment.clone())
+                .unwrap();
+        }
+        let mut members: Vec<DkgMember> =
+            config.members.iter().map(|&p| DkgMember::new(p)).collect();
+
+        // Dealer 4 sends member 2 a bad share, then opens the right one
+        for dealing in &dealings {
+            for (member, share) in members.iter_mut().zip(&dealing.shares) {
+                let mut sent = share.clone();
+                if sent.dealer == 4 && sent.recipient == 2 {
+                    sent.share[31] ^= 1;
+                }
+                if let Some(complaint) = member.receive(&transcript, sent) {
+                    transcript.add_complaint(complaint).unwrap();
+                }
+            }
+        }
+        assert!(transcript.complaints.contains(&(4, 2)));
+        assert!(!transcript.is_qualified(4));
+        transcript
+            .add_justification(dealings[3].shares[1].clone())
+            .unwrap();
+        assert!(transcript.is_qualified(4));
+
+        // Dealer 3 never answers the complaint of member 0 and is disqualified
+        transcript
+            .add_complaint(Complaint {
+                dealer: 3,
+                accuser: 0,
+            })
+            .unwrap();
+        assert_eq!(transcript.qualified().unwrap(), vec![0, 2, 4]);
+        let shares: Vec<KeyShare> = members
+            .iter_mut()
+            .map(|m| m.finish(&transcript).unwrap())
+            .collect();
+
+        // Any three shares recover the same key, two don't
+        let group = group_signer(&shares[..3], 3).unwrap();
+        assert_eq!(
+            group.get_public_key(),
+            group_signer(&shares[1..], 3).unwrap().get_public_key()
+        );
+        assert!(group_signer(&shares[..2], 3).is_err());
+
+        let mut key = GroupKey::new(&transcript, &participants, &party_tree, &group).unwrap();
+        for &position in &[0, 2] {
+            key.approve(position, &wallets[position]).unwrap();
+        }
+        assert!(!key.verify(hashing, &party_tree.root()).unwrap());
+        key.approve(4, &wallets[4]).unwrap();
+        assert!(key.verify(hashing, &party_tree.root()).unwrap());
+        assert!(!key.verify(hashing, &[0u8; 32]).unwrap());
+        assert_eq!(
+            key.signer(&[shares[0].clone(), shares[3].clone(), shares[2].clone()])
+                .unwrap()
+                .get_public_key(),
+            key.public_key
+        );
+    }
+
+    #[test]
+    fn test_share_consistency() {
+        let (_, _, config) = setup();
+        let dealing = deal(&config, 0).unwrap();
+        let mut transcript = Transcript::new(config.clone());
+        transcript
+            .add_commitment(dealing.commitment.clone())
+            .unwrap();
+        let share = &dealing.shares[1];
+        assert!(share.matches(&config, &dealing.commitment));
+
+        // Shares off the committed polynomial don't match: another point of
+        // it, another dealing's share, a changed blinding or a share outside
+        // the scalar field
+        let mut moved = share.clone();
+        moved.recipient = config.members[2];
+        assert!(!moved.matches(&config, &dealing.commitment));
+        let other = deal(&config, 0).unwrap();
+        assert!(!other.shares[1].matches(&config, &dealing.commitment));
+        let mut blinded = share.clone();
+        blinded.blinding = other.shares[1].blinding;
+        assert!(!blinded.matches(&config, &dealing.commitment));
+        let mut overflow = share.clone();
+        overflow.share = [0xff; 32];
+        assert!(!overflow.matches(&config, &dealing.commitment));
+
+        // A complaint about such a share can't be answered with it
+        let mut member = DkgMember::new(share.recipient);
+        let complaint = member
+            .receive(&transcript, other.shares[1].clone())
+            .unwrap();
+        transcript.add_complaint(complaint).unwrap();
+        transcript
+            .add_justification(other.shares[1].clone())
+            .unwrap();
+        assert!(!transcript.is_qualified(0));
+        transcript.add_justification(share.clone()).unwrap();
+        assert!(transcript.is_qualified(0));
+
+        // Nor is a share addressed to another member taken
+        let mut member = DkgMember::new(config.members[0]);
+        assert!(member.receive(&transcript, share.clone()).is_some());
+    }
+
+    #[test]
+    fn test_transcript_errors() {
+        let (_, _, config) = setup();
+        assert!(DkgConfig::new(vec![0, 1], 3).is_err());
+        assert!(DkgConfig::new(vec![0, 1], 0).is_err());
+        assert!(DkgConfig::new((0..256).collect(), 3).is_err());
+        assert_eq!(DkgConfig::new(vec![1, 0, 1], 2).unwrap().members, [0, 1]);
+        assert!(config.coordinate(1).is_err());
+        assert!(deal(&config, 1).is_err());
+
+        let dealing = deal(&config, 0).unwrap();
+        let mut transcript = Transcript::new(config.clone());
+
+        // Commitments must be from a member, to `threshold` valid points,
+        // once
+        let mut outsider = dealing.commitment.clone();
+        outsider.dealer = 1;
+        assert!(transcript.add_commitment(outsider).is_err());
+        let mut short = dealing.commitment.clone();
+        short.commitments.pop();
+        assert!(transcript.add_commitment(short).is_err());
+        let mut invalid = dealing.commitment.clone();
+        invalid.commitments[0] = vec![0xff; POINT_BYTES];
+        assert!(transcript.add_commitment(invalid).is_err());
+        transcript
+            .add_commitment(dealing.commitment.clone())
+            .unwrap();
+        assert!(transcript
+            .add_commitment(dealing.commitment.clone())
+            .is_err());
+
+        // Complaints must be by a member against a dealer that committed,
+        // and justifications must answer one
+        assert!(transcript
+            .add_complaint(Complaint {
+                dealer: 2,
+                accuser: 0
+            })
+            .is_err());
+        assert!(transcript
+            .add_complaint(Complaint {
+                dealer: 0,
+                accuser: 1
+            })
+            .is_err());
+        assert!(transcript
+            .add_justification(dealing.shares[1].clone())
+            .is_err());
+
+        // One dealer is short of the threshold
+        assert!(transcript.qualified().is_err());
+        let mut member = DkgMember::new(0);
+        assert!(member.finish(&transcript).is_err());
+    }
+
+    #[test]
+    fn test_reconstruct_errors() {
+        let (_, _, config) = setup();
+        let (_, shares) = run(&config);
+        let group = group_signer(&shares[..3], 3).unwrap();
+
+        // Shares need distinct non-zero coordinates, as many as the
+        // threshold
+        let twice = [shares[0].clone(), shares[0].clone(), shares[1].clone()];
+        assert!(reconstruct(&twice, 3).is_err());
+        let mut zero = shares[0].clone();
+        zero.x = 0;
+        assert!(reconstruct(&[zero, shares[1].clone(), shares[2].clone()], 3).is_err());
+        assert!(reconstruct(&shares[..2], 3).is_err());
+        assert!(reconstruct(&shares, 0).is_err());
+
+        // Shares of different key generations recover neither key
+        let (transcript, others) = run(&config);
+        let mixed = [shares[0].clone(), shares[1].clone(), others[2].clone()];
+        assert_ne!(
+            group_signer(&mixed, 3).unwrap().get_public_key(),
+            group.get_public_key()
+        );
+        let (wallets, participants, _) = setup();
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build(&participants).unwrap();
+        let mut key = GroupKey::new(&transcript, &participants, &party_tree, &group).unwrap();
+        assert!(key.signer(&mixed).is_err());
+        assert!(key.signer(&others[..2]).is_err());
+
+        // Approvals of non-members void the key
+        key.approve(1, &wallets[1]).unwrap();
+        assert!(!key.verify(hashing, &party_tree.root()).unwrap());
+    }
+}
@@ -0,0 +1,111 @@
+//! Versioned storage encoding of certificates. Stored certificates carry a
+//! format header so that later layout changes can still read, and migrate,
+//! the history written before them.
+use crate::ccok::Certificate;
+use bincode;
+
+/// Bare bincode certificate, as stored before envelopes were introduced
+pub const ENVELOPE_V1: u8 = 1;
+/// `MAGIC`, the format version and the bincode certificate
+pub const ENVELOPE_V2: u8 = 2;
+/// Format new certificates are stored in
+pub const CURRENT_ENVELOPE: u8 = ENVELOPE_V2;
+
+// A bare bincode certificate starts with the little-endian length of its
+// 32-byte signature commitment, so it can never start with the magic
+const MAGIC: &[u8; 4] = b"NPCE";
+
+/// Storage format of encoded certificate bytes
+pub fn envelope_version(bytes: &[u8]) -> u8 {
+    match bytes.strip_prefix(MAGIC) {
+        Some(rest) => rest.first().copied().unwrap_or(0),
+        None => ENVELOPE_V1,
+    }
+}
+
+/// Encode a certificate in the current storage format
+pub fn encode(cert: &Certificate) -> Result<Vec<u8>, String> {
+    let body = bincode::serialize(cert).map_err(|e| format!("Serialization error: {}", e))?;
+    let mut bytes = MAGIC.to_vec();
+    bytes.push(CURRENT_ENVELOPE);
+    bytes.extend_from_slice(&body);
+    Ok(bytes)
+}
+
+/// Decode a certificate stored in any known format
+pub fn decode(bytes: &[u8]) -> Result<Certificate, String> {
+    let body = match envelope_version(bytes) {
+        ENVELOPE_V1 => bytes,
+        ENVELOPE_V2 => &bytes[MAGIC.len() + 1..],
+        version => return Err(format!("Unknown certificate storage format {}", version)),
+    };
+    bincode::deserialize(body).map_err(|e| format!("Deserialization error: {}", e))
+}
+
+/// Re-encode a stored certificate in the current format. Returns `None` when
+/// it already is. Only the encoding changes: the certificate keeps its own
+/// version, since its signatures can't be redone.
+pub fn migrate(bytes: &[u8]) -> Result<Option<Vec<u8>>, String> {
+    if envelope_version(bytes) == CURRENT_ENVELOPE {
+        return Ok(None);
+    }
+    encode(&decode(bytes)?).map(Some)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Params, Participant, PARAMS_V1};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_migrate() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 20,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.msg))
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+
+        // Certificates stored before envelopes are upgraded in place
+        let legacy = bincode::serialize(&cert).unwrap();
+        assert_eq!(envelope_version(&legacy), ENVELOPE_V1);
+        let migrated = migrate(&legacy).unwrap().expect("Expected a migration");
+        assert_eq!(envelope_version(&migrated), CURRENT_ENVELOPE);
+        assert!(migrate(&migrated).unwrap().is_none());
+
+        let decoded = decode(&migrated).unwrap();
+        assert_eq!(decoded.digest().unwrap(), cert.digest().unwrap());
+        assert_eq!(decoded.version, PARAMS_V1);
+        assert!(decoded.verify(&params, &party_tree.root()).unwrap());
+        assert_eq!(
+            decode(&legacy).unwrap().digest().unwrap(),
+            cert.digest().unwrap()
+        );
+
+        // Formats from newer releases are refused rather than misread
+        let mut future = migrated.clone();
+        future[MAGIC.len()] = CURRENT_ENVELOPE + 1;
+        assert!(decode(&future).is_err());
+        assert!(migrate(&future).is_err());
+    }
+}
@@ -0,0 +1,239 @@
+use crate::merkle::{Hashing, MerkleTreeBuilder};
+use crate::scheme::SchemeId;
+use crate::signer::{generate_signer, SignatureScheme, Signer};
+use serde::{Deserialize, Serialize};
+
+/// Range of rounds a participant's one-time key tree covers
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyLifetime {
+    /// First round with a one-time key
+    pub first_round: u64,
+    /// Number of consecutive rounds covered
+    pub rounds: u64,
+}
+
+impl KeyLifetime {
+    pub fn new(first_round: u64, rounds: u64) -> Self {
+        Self {
+            first_round,
+            rounds,
+        }
+    }
+
+    /// Whether `round` has a key in this lifetime
+    pub fn contains(&self, round: u64) -> bool {
+        round >= self.first_round && round - self.first_round < self.rounds
+    }
+
+    /// Leaf index of the key for `round`
+    pub fn index(&self, round: u64) -> Result<usize, String> {
+        if !self.contains(round) {
+            return Err(format!(
+                "Round {} outside key lifetime {}..{}",
+                round,
+                self.first_round,
+                self.first_round.saturating_add(self.rounds)
+            ));
+        }
+        Ok((round - self.first_round) as usize)
+    }
+}
+
+/// Commitment a participant publishes in its party-tree leaf
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyCommitment {
+    /// Root of the Merkle tree over the one-time keys
+    pub root: Vec<u8>,
+    /// Rounds covered by the tree
+    pub lifetime: KeyLifetime,
+}
+
+/// Leaf of a one-time key tree
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct KeyLeaf {
+    round: u64,
+    scheme: SchemeId,
+    public_key: String,
+}
+
+/// Proof that a one-time public key is the committed key for a round
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct OneTimeKeyProof {
+    /// Round the key belongs to
+    pub round: u64,
+    /// The one-time public key in hex format
+    pub public_key: String,
+    /// Merkle path from the key leaf to the committed root
+    pub path: Vec<Vec<u8>>,
+}
+
+impl OneTimeKeyProof {
+    /// Verify the key is committed by `commitment` for its round, in a tree
+    /// hashed with `hashing`
+    pub fn verify(
+        &self,
+        hashing: Hashing,
+        commitment: &KeyCommitment,
+        scheme: SchemeId,
+    ) -> Result<bool, String> {
+        let index = commitment.lifetime.index(self.round)?;
+        if commitment.root.len() != 32 || self.path.iter().any(|h| h.len() != 32) {
+            return Ok(false);
+        }
+        let leaf = KeyLeaf {
+            round: self.round,
+            scheme,
+            public_key: self.public_key.clone(),
+        };
+        Ok(MerkleTreeBuilder::verify_with(
+            hashing,
+            &commitment.root,
+            &self.path,
+            &[index],
+            commitment.lifetime.rounds as usize,
+            &[hashing.leaf_hash(&leaf)?],
+        ))
+    }
+}
+
+/// A participant's one-time signing keys, one per round. Each key is erased
+/// as soon as it has signed, so compromising the participant later does not
+/// expose keys for rounds that already passed.
+pub struct EphemeralKeys {
+    scheme: SignatureScheme,
+    lifetime: KeyLifetime,
+    keys: Vec<Option<Box<dyn Signer>>>,
+    tree: MerkleTreeBuilder,
+    leaves: Vec<KeyLeaf>,
+}
+
+// Implement Debug trait for EphemeralKeys without leaking key material
+impl std::fmt::Debug for EphemeralKeys {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "EphemeralKeys {{ scheme: {:?}, lifetime: {:?}, keys: <keys> }}",
+            self.scheme, self.lifetime
+        )
+    }
+}
+
+impl EphemeralKeys {
+    /// Generate one key per round of `lifetime` and commit to them in a tree
+    /// hashed with `hashing`, that of the params the keys sign for
+    pub fn generate(
+        scheme: SignatureScheme,
+        lifetime: KeyLifetime,
+        hashing: Hashing,
+    ) -> Result<Self, String> {
+        if lifetime.rounds == 0 {
+            return Err("Key lifetime must cover at least one round".to_string());
+        }
+
+        let mut keys = Vec::with_capacity(lifetime.rounds as usize);
+        let mut leaves = Vec::with_capacity(lifetime.rounds as usize);
+        for i in 0..lifetime.rounds {
+            let signer = generate_signer(scheme)?;
+            leaves.push(KeyLeaf {
+                round: lifetime.first_round + i,
+                scheme: scheme.id(),
+                public_key: signer.public_key_hex(),
+            });
+            keys.push(Some(signer));
+        }
+
+        let mut tree = MerkleTreeBuilder::with_hash(hashing);
+        tree.build(&leaves)?;
+        Ok(Self {
+            scheme,
+            lifetime,
+            keys,
+            tree,
+            leaves,
+        })
+    }
+
+    /// Registry identifier of the one-time keys' scheme
+    pub fn scheme(&self) -> SchemeId {
+        self.scheme.id()
+    }
+
+    /// Commitment to publish in the participant's party-tree leaf
+    pub fn commitment(&self) -> KeyCommitment {
+        KeyCommitment {
+            root: self.tree.root(),
+            lifetime: self.lifetime,
+        }
+    }
+
+    /// Sign `msg` with the key of `round`, erasing the key afterwards
+    pub fn sign(&mut self, round: u64, msg: &[u8]) -> Result<(Vec<u8>, OneTimeKeyProof), String> {
+        let index = self.lifetime.index(round)?;
+        let signer = self.keys[index]
+            .take()
+            .ok_or_else(|| format!("One-time key for round {} already used", round))?;
+
+        let signature = signer.sign(msg);
+        let proof = OneTimeKeyProof {
+            round,
+            public_key: self.leaves[index].public_key.clone(),
+            path: self.tree.prove(&[index]),
+        };
+        Ok((signature, proof))
+    }
+
+    /// Erase every key for rounds before `round`
+    pub fn erase_before(&mut self, round: u64) {
+        let end = round
+            .saturating_sub(self.lifetime.first_round)
+            .min(self.lifetime.rounds);
+        for key in self.keys.iter_mut().take(end as usize) {
+            *key = None;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::merkle::HashAlgorithm;
+
+    #[test]
+    fn test_one_time_keys() {
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let mut keys = EphemeralKeys::generate(
+            SignatureScheme::Dilithium2,
+            KeyLifetime::new(10, 4),
+            hashing,
+        )
+        .expect("Failed to generate keys");
+        let commitment = keys.commitment();
+
+        let (_, proof) = keys.sign(11, b"Test message").expect("Failed to sign");
+        assert!(proof.verify(hashing, &commitment, keys.scheme()).unwrap());
+
+        // The proof does not hold for another round, scheme or hash function
+        let mut moved = proof.clone();
+        moved.round = 12;
+        assert!(!moved.verify(hashing, &commitment, keys.scheme()).unwrap());
+        assert!(!proof
+            .verify(hashing, &commitment, SignatureScheme::Dilithium3.id())
+            .unwrap());
+        let sha256 = Hashing::new(HashAlgorithm::Sha256, true);
+        assert!(!proof.verify(sha256, &commitment, keys.scheme()).unwrap());
+
+        // A lifetime ending past the last round still reports its range
+        let endless = KeyLifetime::new(u64::MAX - 1, 4);
+        assert!(endless
+            .index(0)
+            .unwrap_err()
+            .contains(&u64::MAX.to_string()));
+
+        // Keys are single use, erased once their round passed, and bounded by the lifetime
+        assert!(keys.sign(11, b"Test message").is_err());
+        keys.erase_before(13);
+        assert!(keys.sign(12, b"Test message").is_err());
+        assert!(keys.sign(13, b"Test message").is_ok());
+        assert!(keys.sign(14, b"Test message").is_err());
+    }
+}
@@ -1,11 +1,20 @@
 use crate::config::EPOCH_DURATION;
 pub struct Epoch {
     pub timestamp: u64,
+    /// Blocks per epoch
+    pub duration: u64,
 }
 
 impl Epoch {
     pub fn new() -> Self {
-        Self { timestamp: 0 }
+        Self::with_duration(EPOCH_DURATION)
+    }
+
+    pub fn with_duration(duration: u64) -> Self {
+        Self {
+            timestamp: 0,
+            duration,
+        }
     }
 
     pub fn progress(&mut self) {
@@ -17,6 +26,6 @@ impl Epoch {
     }
 
     pub fn is_end_of_epoch(&self) -> bool {
-        self.timestamp >= EPOCH_DURATION
+        self.timestamp >= self.duration
     }
 }
@@ -0,0 +1,246 @@
+//! Errors of certificate building, verification and the Merkle trees, so
+//! callers can tell failures worth retrying from fatal ones.
+use crate::merkle::HashAlgorithm;
+use crate::scheme::SchemeId;
+use std::fmt;
+
+/// Error of the builder, verifier or Merkle trees
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum CcokError {
+    /// Not enough weight has signed yet
+    InsufficientWeight { signed: u64, proven: u64 },
+    /// No participant has signed yet
+    NoSignatures,
+    /// Position outside the participant set
+    InvalidPosition(usize),
+    /// The participant has no weight and can't sign
+    ZeroWeight(usize),
+    /// The participant uses a scheme other than the one the params require
+    SchemeMismatch {
+        pos: usize,
+        scheme: SchemeId,
+        required: SchemeId,
+    },
+    /// Unknown scheme, or a key or signature of the wrong length
+    Scheme(String),
+    /// Missing, unexpected or invalid one-time key proof
+    InvalidOneTimeKey { pos: usize, reason: String },
+    /// The signature doesn't verify against the participant's key
+    InvalidSignature(usize),
+    /// The participant already signed with a different signature
+    DuplicateSignature(usize),
+    /// The streaming builder no longer accepts signatures
+    Closed,
+    /// The context of the operation was cancelled
+    Cancelled,
+    /// The deadline of the operation passed
+    DeadlineExceeded,
+    /// Params or certificate version this implementation doesn't know, or
+    /// that the verifier doesn't accept
+    UnsupportedVersion(u8),
+    /// The certificate was built for another params version
+    VersionMismatch { cert: u8, params: u8 },
+    /// The certificate was built with another hash function
+    HashMismatch {
+        cert: HashAlgorithm,
+        params: HashAlgorithm,
+    },
+    /// A revealed position is missing from the certificate
+    InvalidReveal(u64),
+    /// A Merkle proof or audit path is malformed or doesn't match its root
+    BadMerklePath(String),
+    /// Leaf index outside the tree
+    LeafOutOfRange(usize),
+    /// A tree needs at least one leaf
+    EmptyTree,
+    /// Weights overflow a 64-bit sum
+    WeightOverflow,
+    /// A public key isn't valid hex
+    InvalidPublicKey(String),
+    /// An item couldn't be serialized
+    Serialization(String),
+    /// A state proof doesn't continue the verified chain of intervals
+    InvalidStateProof(String),
+    /// The block isn't covered by a verified state proof yet
+    NotCertified(u64),
+    /// An epoch handoff doesn't continue the verified chain of epochs
+    InvalidHandoff(String),
+    /// A governance certificate doesn't enact its proposal
+    InvalidGovernance(String),
+    /// Misbehavior evidence doesn't prove any misbehavior
+    InvalidEvidence(String),
+    /// A coin of the certificate lands on no revealed position
+    UnrevealedCoin { index: u64, coin: u64 },
+    /// Params outside the range certificates are sound for
+    InvalidParams(String),
+}
+
+impl CcokError {
+    /// Whether the operation may succeed later without changing its inputs,
+    /// e.g. building once more signatures arrived
+    pub fn is_retryable(&self) -> bool {
+        matches!(
+            self,
+            CcokError::InsufficientWeight { .. } | CcokError::NoSignatures
+        )
+    }
+}
+
+impl fmt::Display for CcokError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            CcokError::InsufficientWeight { signed, proven } => {
+                write!(f, "Insufficient signed weight: {} < {}", signed, proven)
+            }
+            CcokError::NoSignatures => f.write_str("No signatures available"),
+            CcokError::InvalidPosition(pos) => write!(f, "Invalid participant position: {}", pos),
+            CcokError::ZeroWeight(pos) => write!(f, "Participant {} has zero weight", pos),
+            CcokError::SchemeMismatch {
+                pos,
+                scheme,
+                required,
+            } => write!(
+                f,
+                "Participant {} uses {:?} but params require {:?}",
+                pos, scheme, required
+            ),
+            CcokError::Scheme(reason) => f.write_str(reason),
+            CcokError::InvalidOneTimeKey { pos, reason } => {
+                write!(f, "Participant {}: {}", pos, reason)
+            }
+            CcokError::InvalidSignature(pos) => {
+                write!(f, "Invalid signature for participant {}", pos)
+            }
+            CcokError::DuplicateSignature(pos) => {
+                write!(f, "Conflicting signature for participant {}", pos)
+            }
+            CcokError::Closed => f.write_str("Streaming builder is closed"),
+            CcokError::Cancelled => f.write_str("Operation cancelled"),
+            CcokError::DeadlineExceeded => f.write_str("Deadline exceeded"),
+            CcokError::UnsupportedVersion(version) => {
+                write!(f, "Unsupported version {}", version)
+            }
+            CcokError::VersionMismatch { cert, params } => write!(
+                f,
+                "Certificate is version {} but params are version {}",
+                cert, params
+            ),
+            CcokError::HashMismatch { cert, params } => write!(
+                f,
+                "Certificate uses hash {} but params require {}",
+                cert.name(),
+                params.name()
+            ),
+            CcokError::InvalidReveal(pos) => write!(f, "Missing reveal for position {}", pos),
+            CcokError::BadMerklePath(reason) => write!(f, "Bad Merkle path: {}", reason),
+            CcokError::LeafOutOfRange(index) => write!(f, "Leaf index {} out of range", index),
+            CcokError::EmptyTree => f.write_str("Tree needs at least one leaf"),
+            CcokError::WeightOverflow => f.write_str("Weight overflow"),
+            CcokError::InvalidPublicKey(reason) => write!(f, "Invalid public key hex: {}", reason),
+            CcokError::Serialization(reason) => write!(f, "Serialization error: {}", reason),
+            CcokError::InvalidStateProof(reason) => write!(f, "Invalid state proof: {}", reason),
+            CcokError::NotCertified(block) => write!(f, "Block {} is not certified", block),
+            CcokError::InvalidHandoff(reason) => write!(f, "Invalid epoch handoff: {}", reason),
+            CcokError::InvalidGovernance(reason) => {
+                write!(f, "Invalid governance certificate: {}", reason)
+            }
+            CcokError::InvalidEvidence(reason) => write!(f, "Invalid evidence: {}", reason),
+            CcokError::UnrevealedCoin { index, coin } => {
+                write!(f, "Coin {} ({}) lands on no revealed position", index, coin)
+            }
+            CcokError::InvalidParams(reason) => write!(f, "Invalid params: {}", reason),
+        }
+    }
+}
+
+impl std::error::Error for CcokError {}
+
+impl From<CcokError> for String {
+    fn from(err: CcokError) -> Self {
+        err.to_string()
+    }
+}
+
+impl From<bincode::Error> for CcokError {
+    fn from(err: bincode::Error) -> Self {
+        CcokError::Serialization(err.to_string())
+    }
+}
+
+impl From<hex::FromHexError> for CcokError {
+    fn from(err: hex::FromHexError) -> Self {
+        CcokError::InvalidPublicKey(err.to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Params, Participant, PARAMS_V1};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_error_kinds() {
+        let wallets: Vec<Wallet> = (0..2)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 15,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+
+        // Building too early can be retried once more signatures arrive
+        builder
+            .add_signature(0, wallets[0].sign_message(&params.msg))
+            .unwrap();
+        let err = builder.build().unwrap_err();
+        assert_eq!(
+            err,
+            CcokError::InsufficientWeight {
+                signed: 10,
+                proven: 15
+            }
+        );
+        assert!(err.is_retryable());
+
+        // Bad input is not
+        let err = builder
+            .add_signature(5, wallets[1].sign_message(&params.msg))
+            .unwrap_err();
+        assert_eq!(err, CcokError::InvalidPosition(5));
+        assert!(!err.is_retryable());
+        assert_eq!(party_tree.prove_leaf(2), Err(CcokError::LeafOutOfRange(2)));
+        let mut unprovable = params.clone();
+        unprovable.proven_weight = 20;
+        let err = Builder::new(unprovable, builder.participants.clone(), party_tree.root())
+            .err()
+            .unwrap();
+        assert!(matches!(err, CcokError::InvalidParams(_)));
+        assert!(!err.is_retryable());
+
+        builder
+            .add_signature(1, wallets[1].sign_message(&params.msg))
+            .unwrap();
+        let cert = builder.build().unwrap();
+        let mut v2 = params.clone();
+        v2.version = crate::ccok::PARAMS_V2;
+        assert_eq!(
+            cert.verify(&v2, &party_tree.root()),
+            Err(CcokError::VersionMismatch { cert: 1, params: 2 })
+        );
+        let message: String = CcokError::InvalidReveal(3).into();
+        assert_eq!(message, "Missing reveal for position 3");
+    }
+}
@@ -0,0 +1,293 @@
+//! What a certificate builder does when the proven weight isn't reached by
+//! its deadline, decided by a `DeadlinePolicy` instead of an operator. The
+//! builder can fall back down a ladder of lower proven weights, each given
+//! an extension of the deadline; signatures are over the message alone, so
+//! those collected still count. Lowered certificates only verify for
+//! verifiers configured with the lowered params, so a ladder is for chains
+//! whose params admit it. A missed deadline can also raise a
+//! `Event::DeadlineMissed` alert, and if no step is reached the builder can
+//! produce an `InsufficientWeightAttestation` for governance: the signatures
+//! it did collect, which anyone can check against the participants.
+use crate::ccok::{Builder, Certificate, Params, Participant};
+use crate::error::CcokError;
+use crate::events::{Event, EventBus};
+use crate::gossip::SignatureShare;
+use crate::hybrid;
+use crate::stateproof::voters_commitment;
+use crate::streaming::{Progress, StreamingBuilder};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use tokio::time::{Duration, Instant};
+
+/// Lower proven weight to fall back to, and how much longer to wait for it
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct LadderStep {
+    pub proven_weight: u64,
+    pub extension: Duration,
+}
+
+/// What to do if the proven weight isn't reached by the deadline
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct DeadlinePolicy {
+    /// Time to reach the proven weight of the params
+    pub deadline: Duration,
+    /// Lower proven weights to try in turn, highest first
+    pub ladder: Vec<LadderStep>,
+    /// Publish an `Event::DeadlineMissed` alert when the deadline passes
+    pub alert: bool,
+    /// Attest the weight collected if no step of the ladder is reached
+    pub attest: bool,
+}
+
+impl DeadlinePolicy {
+    /// Fail unless every step lowers the proven weight of the one before,
+    /// starting from `proven_weight`
+    pub fn validate(&self, proven_weight: u64) -> Result<(), CcokError> {
+        let mut above = proven_weight;
+        for step in &self.ladder {
+            if step.proven_weight == 0 || step.proven_weight >= above {
+                return Err(CcokError::InvalidParams(format!(
+                    "ladder step to proven weight {} doesn't lower {}",
+                    step.proven_weight, above
+                )));
+            }
+            above = step.proven_weight;
+        }
+        Ok(())
+    }
+}
+
+/// Signatures a builder collected without reaching any proven weight it was
+/// allowed, for governance to act on
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct InsufficientWeightAttestation {
+    /// Params of the certificate missed
+    pub params: Params,
+    pub party_tree_root: Vec<u8>,
+    /// Weight of the attested signatures
+    pub signed_weight: u64,
+    /// Signatures made with long-lived keys, by position
+    pub shares: Vec<SignatureShare>,
+}
+
+impl InsufficientWeightAttestation {
+    /// Attestation of the signatures `builder` collected
+    pub fn of(builder: &Builder) -> Self {
+        let (shares, signed_weight) = builder
+            .sigs
+            .iter()
+            .zip(&builder.participants)
+            .enumerate()
+            .filter(|(_, (slot, _))| slot.one_time_key.is_none())
+            .filter_map(|(position, (slot, party))| {
+                let share = SignatureShare {
+                    msg: builder.params.msg.clone(),
+                    position,
+                    signature: slot.signature.as_ref()?.as_bytes().to_vec(),
+                };
+                Some((share, party.weight))
+            })
+            .fold((Vec::new(), 0u64), |(mut shares, weight), (share, w)| {
+                shares.push(share);
+                (shares, weight.saturating_add(w))
+            });
+        Self {
+            params: builder.params.clone(),
+            party_tree_root: builder.party_tree_root.clone(),
+            signed_weight,
+            shares,
+        }
+    }
+
+    /// Whether `participants` are those committed, each share is a valid
+    /// signature of a distinct participant and the signed weight is theirs,
+    /// below the proven weight
+    pub fn verify(&self, participants: &[Participant]) -> Result<bool, String> {
+        if voters_commitment(self.params.hashing(), participants)? != self.party_tree_root {
+            return Ok(false);
+        }
+        let msg = self.params.signing_message();
+        let mut positions = HashSet::new();
+        let mut weight = 0u64;
+        for share in &self.shares {
+            let party = participants
+                .get(share.position)
+                .ok_or_else(|| format!("No participant at position {}", share.position))?;
+            if share.msg != self.params.msg || !positions.insert(share.position) {
+                return Ok(false);
+            }
+            let public_key = hex::decode(&party.public_key)
+                .map_err(|e| format!("Invalid participant public key: {}", e))?;
+            if !hybrid::verify_signature(
+                self.params.signature_mode,
+                party.scheme,
+                &public_key,
+                &msg,
+                &share.signature,
+            )? {
+                return Ok(false);
+            }
+            weight = weight.saturating_add(party.weight);
+        }
+        Ok(weight == self.signed_weight && weight < self.params.proven_weight)
+    }
+}
+
+/// Result of building under a `DeadlinePolicy`
+#[derive(Debug)]
+pub enum DeadlineOutcome {
+    /// Certificate built under `params`: those of the builder, or with the
+    /// proven weight of the ladder step reached
+    Certified {
+        params: Params,
+        certificate: Certificate,
+    },
+    /// No proven weight reached, with the attestation if the policy asks for
+    /// one
+    Missed {
+        progress: Progress,
+        attestation: Option<InsufficientWeightAttestation>,
+    },
+}
+
+impl StreamingBuilder {
+    /// Build once the proven weight is reached, escalating by `policy` if it
+    /// isn't by the deadline. Alerts are published on `events`.
+    pub async fn build_by_deadline(
+        mut self,
+        policy: &DeadlinePolicy,
+        events: Option<&EventBus>,
+    ) -> Result<DeadlineOutcome, CcokError> {
+        let proven_weight = self.params().proven_weight;
+        policy.validate(proven_weight)?;
+        let mut deadline = Instant::now() + policy.deadline;
+        if self.wait_for_weight(proven_weight, deadline).await? {
+            return certify(self.finish().await?, proven_weight);
+        }
+        if let (true, Some(events)) = (policy.alert, events) {
+            events.publish(Event::deadline_missed(self.params(), &self.progress()));
+        }
+        for step in &policy.ladder {
+            deadline += step.extension;
+            if self.wait_for_weight(step.proven_weight, deadline).await? {
+                return certify(self.finish().await?, step.proven_weight);
+            }
+        }
+        let builder = self.finish().await?;
+        Ok(DeadlineOutcome::Missed {
+            progress: Progress::of(&builder),
+            attestation: policy
+                .attest
+                .then(|| InsufficientWeightAttestation::of(&builder)),
+        })
+    }
+}
+
+// Certificate of `builder` proving `proven_weight`
+fn certify(mut builder: Builder, proven_weight: u64) -> Result<DeadlineOutcome, CcokError> {
+    builder.params.proven_weight = proven_weight;
+    builder.params.validate()?;
+    Ok(DeadlineOutcome::Certified {
+        params: builder.params.clone(),
+        certificate: builder.build()?,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::Verifier;
+    use crate::merkle::{HashAlgorithm, Hashing};
+    use crate::wallet::Wallet;
+
+    #[tokio::test]
+    async fn test_deadline_policy() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let root =
+            voters_commitment(Hashing::new(HashAlgorithm::Keccak256, true), &participants).unwrap();
+        let params = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 30,
+            ..Default::default()
+        };
+        let policy = DeadlinePolicy {
+            deadline: Duration::from_millis(50),
+            ladder: vec![LadderStep {
+                proven_weight: 20,
+                extension: Duration::from_millis(50),
+            }],
+            alert: true,
+            attest: true,
+        };
+        let mut raising = policy.clone();
+        raising.ladder[0].proven_weight = 30;
+        assert!(raising.validate(params.proven_weight).is_err());
+
+        // `signers` participants sign before the deadline
+        let run = |signers: usize| {
+            let streaming = StreamingBuilder::spawn(
+                Builder::new(params.clone(), participants.clone(), root.clone()).unwrap(),
+            );
+            let sender = streaming.sender();
+            let signatures: Vec<Vec<u8>> = wallets[..signers]
+                .iter()
+                .map(|w| w.sign_message(&params.signing_message()).to_vec())
+                .collect();
+            let policy = policy.clone();
+            let events = EventBus::new();
+            let mut alerts = events.subscribe();
+            async move {
+                for (pos, signature) in signatures.into_iter().enumerate() {
+                    sender.add_signature_async(pos, signature).await.unwrap();
+                }
+                let outcome = streaming
+                    .build_by_deadline(&policy, Some(&events))
+                    .await
+                    .unwrap();
+                (outcome, alerts.try_next())
+            }
+        };
+
+        // Short of the proven weight, the builder falls back to the ladder
+        let (outcome, alert) = run(2).await;
+        let DeadlineOutcome::Certified {
+            params: lowered,
+            certificate,
+        } = outcome
+        else {
+            panic!("Expected a certificate");
+        };
+        assert_eq!(lowered.proven_weight, 20);
+        assert!(Verifier::new(root.clone())
+            .verify(&certificate, &lowered)
+            .unwrap());
+        assert_eq!(
+            alert.unwrap().kind(),
+            crate::events::EventKind::DeadlineMissed
+        );
+
+        // Short of every step, it attests the weight it collected
+        let (outcome, _) = run(1).await;
+        let DeadlineOutcome::Missed {
+            progress,
+            attestation: Some(attestation),
+        } = outcome
+        else {
+            panic!("Expected an attestation");
+        };
+        assert_eq!(progress.signed_weight, 10);
+        assert!(attestation.verify(&participants).unwrap());
+        let mut inflated = attestation.clone();
+        inflated.signed_weight = 20;
+        assert!(!inflated.verify(&participants).unwrap());
+        let mut repeated = attestation.clone();
+        repeated.shares.push(repeated.shares[0].clone());
+        assert!(!repeated.verify(&participants).unwrap());
+    }
+}
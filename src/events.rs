@@ -0,0 +1,270 @@
+//! Events pushed to WebSocket subscribers, so dashboards and relayers follow
+//! the chain without polling. The node publishes each event once on an
+//! `EventBus`; every connection holds an `EventStream` of the bus, which
+//! clients narrow by sending `{"subscribe": ["newBlock", ...]}`. Events are
+//! sent as `{"event": <kind>, "data": {...}}` with hex byte fields.
+use crate::block::Block;
+use crate::ccok::{Builder, Params};
+use crate::stateproof::StateProof;
+use crate::streaming::Progress;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use tokio::sync::broadcast;
+
+/// Events a subscriber may fall behind by before missing some
+const BUS_CAPACITY: usize = 256;
+
+/// Kind of an event, as named on the wire
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub enum EventKind {
+    NewBlock,
+    NewStateProof,
+    SignatureProgress,
+    DeadlineMissed,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "event", content = "data", rename_all = "camelCase")]
+pub enum Event {
+    /// Block the node executed
+    NewBlock {
+        height: u64,
+        hash: String,
+        parent_hash: String,
+        timestamp: u64,
+        tx_count: usize,
+        certified: bool,
+    },
+    /// State proof of an interval of blocks
+    NewStateProof {
+        first_block: u64,
+        last_block: u64,
+        block_headers_commitment: String,
+        proven_weight: u64,
+    },
+    /// Weight signed so far of the certificate over `msg`
+    SignatureProgress {
+        msg: String,
+        signers: usize,
+        signed_weight: u64,
+        proven_weight: u64,
+        ready: bool,
+    },
+    /// Certificate over `msg` that didn't reach its proven weight by the
+    /// deadline
+    DeadlineMissed {
+        msg: String,
+        signers: usize,
+        signed_weight: u64,
+        proven_weight: u64,
+    },
+}
+
+impl Event {
+    pub fn new_block(block: &Block) -> Self {
+        Event::NewBlock {
+            height: block.id as u64,
+            hash: hex::encode(block.hash),
+            parent_hash: hex::encode(block.previous_hash),
+            timestamp: block.timestamp as u64,
+            tx_count: block.txn.len() + block.txs.len(),
+            certified: block.certificate.is_some(),
+        }
+    }
+
+    pub fn new_state_proof(proof: &StateProof) -> Self {
+        Event::NewStateProof {
+            first_block: proof.message.first_block,
+            last_block: proof.message.last_block,
+            block_headers_commitment: hex::encode(&proof.message.block_headers_commitment),
+            proven_weight: proof.certificate.signed_weight,
+        }
+    }
+
+    /// Progress of the certificate `builder` collects
+    pub fn signature_progress(builder: &Builder) -> Self {
+        Event::SignatureProgress {
+            msg: hex::encode(&builder.params.msg),
+            signers: builder
+                .sigs
+                .iter()
+                .filter(|slot| slot.signature.is_some())
+                .count(),
+            signed_weight: builder.signed_weight,
+            proven_weight: builder.params.proven_weight,
+            ready: builder.signed_weight > builder.params.proven_weight,
+        }
+    }
+
+    /// Alert for the certificate of `params` missing its deadline at
+    /// `progress`
+    pub fn deadline_missed(params: &Params, progress: &Progress) -> Self {
+        Event::DeadlineMissed {
+            msg: hex::encode(&params.msg),
+            signers: progress.signatures,
+            signed_weight: progress.signed_weight,
+            proven_weight: progress.proven_weight,
+        }
+    }
+
+    pub fn kind(&self) -> EventKind {
+        match self {
+            Event::NewBlock { .. } => EventKind::NewBlock,
+            Event::NewStateProof { .. } => EventKind::NewStateProof,
+            Event::SignatureProgress { .. } => EventKind::SignatureProgress,
+            Event::DeadlineMissed { .. } => EventKind::DeadlineMissed,
+        }
+    }
+
+    /// JSON text frame of the event
+    pub fn to_json(&self) -> Result<String, String> {
+        serde_json::to_string(self).map_err(|e| format!("Serialization error: {}", e))
+    }
+}
+
+/// Message of a client choosing the kinds of events it receives
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SubscribeMessage {
+    pub subscribe: Vec<EventKind>,
+}
+
+/// Publishes node events to every stream
+#[derive(Debug, Clone)]
+pub struct EventBus {
+    sender: broadcast::Sender<Event>,
+}
+
+impl Default for EventBus {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl EventBus {
+    pub fn new() -> Self {
+        Self {
+            sender: broadcast::channel(BUS_CAPACITY).0,
+        }
+    }
+
+    /// Send `event` to the streams open, returning how many there are
+    pub fn publish(&self, event: Event) -> usize {
+        self.sender.send(event).unwrap_or(0)
+    }
+
+    /// Stream of the events published from now on, of every kind
+    pub fn subscribe(&self) -> EventStream {
+        EventStream {
+            receiver: self.sender.subscribe(),
+            kinds: None,
+            missed: 0,
+        }
+    }
+}
+
+/// Events of a bus delivered to one subscriber
+pub struct EventStream {
+    receiver: broadcast::Receiver<Event>,
+    /// Kinds delivered, all when `None`
+    kinds: Option<HashSet<EventKind>>,
+    /// Events dropped because the subscriber fell behind
+    pub missed: u64,
+}
+
+impl EventStream {
+    /// Apply a text message of the client, failing for anything but a
+    /// `SubscribeMessage`
+    pub fn handle_message(&mut self, text: &str) -> Result<(), String> {
+        let message: SubscribeMessage =
+            serde_json::from_str(text).map_err(|e| format!("Invalid subscription: {}", e))?;
+        self.kinds = Some(message.subscribe.into_iter().collect());
+        Ok(())
+    }
+
+    fn wanted(&self, event: &Event) -> bool {
+        self.kinds
+            .as_ref()
+            .map_or(true, |kinds| kinds.contains(&event.kind()))
+    }
+
+    /// Next event subscribed to, waiting for one; `None` once the bus is gone
+    pub async fn next(&mut self) -> Option<Event> {
+        loop {
+            match self.receiver.recv().await {
+                Ok(event) if self.wanted(&event) => return Some(event),
+                Ok(_) => continue,
+                Err(broadcast::error::RecvError::Lagged(missed)) => self.missed += missed,
+                Err(broadcast::error::RecvError::Closed) => return None,
+            }
+        }
+    }
+
+    /// Next event subscribed to if one is pending
+    pub fn try_next(&mut self) -> Option<Event> {
+        loop {
+            match self.receiver.try_recv() {
+                Ok(event) if self.wanted(&event) => return Some(event),
+                Ok(_) => continue,
+                Err(broadcast::error::TryRecvError::Lagged(missed)) => self.missed += missed,
+                Err(_) => return None,
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::utils::Seed;
+
+    #[test]
+    fn test_event_stream() {
+        let block = Block::new(
+            3,
+            [1u8; 32],
+            42,
+            vec![],
+            Account {
+                address: "proposer".to_string(),
+            },
+            String::new(),
+            Seed { seed: [0u8; 32] },
+            None,
+        )
+        .unwrap();
+        let bus = EventBus::new();
+        assert_eq!(bus.publish(Event::new_block(&block)), 0);
+
+        let mut all = bus.subscribe();
+        let mut progress = bus.subscribe();
+        progress
+            .handle_message(r#"{"subscribe": ["signatureProgress"]}"#)
+            .unwrap();
+        assert!(progress.handle_message(r#"{"unsubscribe": []}"#).is_err());
+        let signed = Event::SignatureProgress {
+            msg: "00".to_string(),
+            signers: 1,
+            signed_weight: 10,
+            proven_weight: 15,
+            ready: false,
+        };
+        assert_eq!(bus.publish(Event::new_block(&block)), 2);
+        bus.publish(signed.clone());
+
+        // Subscribers only get the kinds they asked for
+        assert_eq!(all.try_next().unwrap().kind(), EventKind::NewBlock);
+        assert_eq!(all.try_next().unwrap(), signed);
+        assert!(all.try_next().is_none());
+        assert_eq!(progress.try_next().unwrap(), signed);
+        assert!(progress.try_next().is_none());
+
+        let json: serde_json::Value =
+            serde_json::from_str(&Event::new_block(&block).to_json().unwrap()).unwrap();
+        assert_eq!(json["event"], "newBlock");
+        assert_eq!(json["data"]["height"], 3);
+        assert_eq!(json["data"]["parent_hash"], hex::encode([1u8; 32]));
+    }
+}
@@ -0,0 +1,431 @@
+//! Misbehavior evidence. Validators sign `Vote`s binding a certificate message
+//! to the round it is for; a validator signing two different messages in the
+//! same round double-signs. `DoubleSignEvidence` carries both signed votes and
+//! the validator's path in the party tree, so anyone holding the party tree
+//! root can check it without trusting the accuser, and an `EvidenceVerifier`
+//! turns each valid piece of evidence into at most one `Slash`.
+//!
+//! `AbsenceEvidence` proves the opposite for availability slashing: that a
+//! participant's slot in the signature tree a certificate commits to is empty.
+//! The builder of a certificate chooses which signatures it includes, so an
+//! absence shows that the signature didn't make it into one certificate, not
+//! that it was never sent; slashing policy should ask for absences from the
+//! certificates of several builders.
+use crate::ccok::{Builder, Certificate, Params, Participant, SigSlot};
+use crate::error::CcokError;
+use crate::merkle::{verify_proof_with, AuditPath, HashDomain, Hashing, MerkleTreeBuilder};
+use crate::scheme::verify_signature;
+use crate::signer::Signer;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+
+/// Message a validator signs in a round
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Vote {
+    pub round: u64,
+    /// Certificate message voted for
+    #[serde(with = "serde_bytes")]
+    pub msg: Vec<u8>,
+}
+
+impl Vote {
+    /// Bytes the validator signs
+    pub fn signing_bytes(&self) -> Result<Vec<u8>, CcokError> {
+        Ok(HashDomain::Message.tagged(&bincode::serialize(self)?))
+    }
+
+    /// Sign the vote with `signer`
+    pub fn sign(self, signer: &dyn Signer) -> Result<SignedVote, CcokError> {
+        let signature = signer.sign(&self.signing_bytes()?);
+        Ok(SignedVote {
+            vote: self,
+            signature,
+        })
+    }
+}
+
+/// Vote together with the validator's signature
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SignedVote {
+    pub vote: Vote,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+impl SignedVote {
+    /// Whether the vote was signed by `party`
+    pub fn verify(&self, party: &Participant) -> Result<bool, CcokError> {
+        let public_key = hex::decode(&party.public_key)
+            .map_err(|e| CcokError::InvalidPublicKey(e.to_string()))?;
+        verify_signature(
+            party.scheme,
+            &public_key,
+            &self.vote.signing_bytes()?,
+            &self.signature,
+        )
+        .map_err(CcokError::Scheme)
+    }
+}
+
+/// Proof that a validator signed two different messages in one round
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DoubleSignEvidence {
+    /// The offending validator
+    pub party: Participant,
+    /// Position of the validator in the party tree
+    pub index: usize,
+    /// Path of the validator's leaf to the party tree root
+    pub path: AuditPath,
+    pub first: SignedVote,
+    pub second: SignedVote,
+}
+
+impl DoubleSignEvidence {
+    /// Evidence against the participant at `index` of `party_tree`, built
+    /// over `participants`
+    pub fn new(
+        party_tree: &MerkleTreeBuilder,
+        participants: &[Participant],
+        index: usize,
+        first: SignedVote,
+        second: SignedVote,
+    ) -> Result<Self, CcokError> {
+        let party = participants
+            .get(index)
+            .ok_or(CcokError::InvalidPosition(index))?
+            .clone();
+        let evidence = Self {
+            party,
+            index,
+            path: party_tree.prove_leaf(index)?,
+            first,
+            second,
+        };
+        evidence.verify(party_tree.hash(), &party_tree.root())?;
+        Ok(evidence)
+    }
+
+    /// Round the validator double-signed in
+    pub fn round(&self) -> u64 {
+        self.first.vote.round
+    }
+
+    /// Check the evidence against the party tree with `party_tree_root`
+    pub fn verify(&self, hashing: Hashing, party_tree_root: &[u8]) -> Result<(), CcokError> {
+        if self.first.vote.round != self.second.vote.round {
+            return Err(CcokError::InvalidEvidence(format!(
+                "votes are for rounds {} and {}",
+                self.first.vote.round, self.second.vote.round
+            )));
+        }
+        if self.first.vote.msg == self.second.vote.msg {
+            return Err(CcokError::InvalidEvidence(
+                "votes are for the same message".to_string(),
+            ));
+        }
+        let leaf = hashing.leaf_hash(&self.party)?;
+        if !verify_proof_with(hashing, party_tree_root, self.index, &leaf, &self.path) {
+            return Err(CcokError::InvalidEvidence(format!(
+                "participant {} is not in the party tree",
+                self.index
+            )));
+        }
+        for vote in [&self.first, &self.second] {
+            if !vote.verify(&self.party)? {
+                return Err(CcokError::InvalidEvidence(format!(
+                    "vote of participant {} has an invalid signature",
+                    self.index
+                )));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Proof that a participant did not sign a certificate: its slot in the
+/// signature tree holds no signature
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AbsenceEvidence {
+    /// The absent participant
+    pub party: Participant,
+    /// Position of the participant in both trees
+    pub index: usize,
+    /// Path of the participant's leaf to the party tree root
+    pub party_path: AuditPath,
+    /// The empty signature slot
+    pub slot: SigSlot,
+    /// Path of the slot to the signature commitment
+    pub sig_path: AuditPath,
+}
+
+impl AbsenceEvidence {
+    /// Evidence that the participant at `index` is missing from the
+    /// certificates `builder` builds with its current signatures
+    pub fn new(builder: &Builder, index: usize) -> Result<Self, CcokError> {
+        let hashing = builder.params.hashing();
+        let mut sig_tree = MerkleTreeBuilder::with_hash(hashing);
+        sig_tree.build(&builder.sigs)?;
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build(&builder.participants)?;
+        let evidence = Self {
+            party: builder
+                .participants
+                .get(index)
+                .ok_or(CcokError::InvalidPosition(index))?
+                .clone(),
+            index,
+            party_path: party_tree.prove_leaf(index)?,
+            slot: builder.sigs[index].clone(),
+            sig_path: sig_tree.prove_leaf(index)?,
+        };
+        evidence.verify(hashing, &party_tree.root(), &sig_tree.root())?;
+        Ok(evidence)
+    }
+
+    /// Check the evidence against a party tree root and the signature
+    /// commitment of a certificate over it
+    pub fn verify(
+        &self,
+        hashing: Hashing,
+        party_tree_root: &[u8],
+        sig_commit: &[u8],
+    ) -> Result<(), CcokError> {
+        if self.slot.signature.is_some() {
+            return Err(CcokError::InvalidEvidence(format!(
+                "participant {} signed",
+                self.index
+            )));
+        }
+        if self.sig_path.total_leaves != self.party_path.total_leaves {
+            return Err(CcokError::InvalidEvidence(format!(
+                "signature tree has {} slots for {} participants",
+                self.sig_path.total_leaves, self.party_path.total_leaves
+            )));
+        }
+        let leaf = hashing.leaf_hash(&self.party)?;
+        if !verify_proof_with(
+            hashing,
+            party_tree_root,
+            self.index,
+            &leaf,
+            &self.party_path,
+        ) {
+            return Err(CcokError::InvalidEvidence(format!(
+                "participant {} is not in the party tree",
+                self.index
+            )));
+        }
+        let slot = hashing.leaf_hash(&self.slot)?;
+        if !verify_proof_with(hashing, sig_commit, self.index, &slot, &self.sig_path) {
+            return Err(CcokError::InvalidEvidence(format!(
+                "slot {} is not in the signature tree",
+                self.index
+            )));
+        }
+        Ok(())
+    }
+
+    /// Check the evidence against a certificate, which must itself verify
+    pub fn verify_certificate(
+        &self,
+        cert: &Certificate,
+        params: &Params,
+        party_tree_root: &[u8],
+    ) -> Result<(), CcokError> {
+        if !cert.verify(params, party_tree_root)? {
+            return Err(CcokError::InvalidEvidence(
+                "certificate doesn't verify".to_string(),
+            ));
+        }
+        self.verify(params.hashing(), party_tree_root, &cert.sig_commit)
+    }
+}
+
+/// Penalty the consensus layer applies for verified evidence
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Slash {
+    /// Certificate public key of the offender, in hex
+    pub public_key: String,
+    /// Weight of the offender in the party tree
+    pub weight: u64,
+    pub round: u64,
+}
+
+/// Verifies evidence against one party tree, slashing each offence once
+#[derive(Debug, Clone)]
+pub struct EvidenceVerifier {
+    hashing: Hashing,
+    party_tree_root: Vec<u8>,
+    /// Positions and rounds already slashed
+    slashed: HashSet<(usize, u64)>,
+    /// Positions and rounds already slashed for absence
+    absent: HashSet<(usize, u64)>,
+}
+
+impl EvidenceVerifier {
+    /// Verifier of the validators committed by `party_tree_root`
+    pub fn new(hashing: Hashing, party_tree_root: Vec<u8>) -> Self {
+        Self {
+            hashing,
+            party_tree_root,
+            slashed: HashSet::new(),
+            absent: HashSet::new(),
+        }
+    }
+
+    /// Verify `evidence` and return the slash it warrants, failing for
+    /// offences already slashed
+    pub fn check(&mut self, evidence: &DoubleSignEvidence) -> Result<Slash, CcokError> {
+        evidence.verify(self.hashing, &self.party_tree_root)?;
+        if !self.slashed.insert((evidence.index, evidence.round())) {
+            return Err(CcokError::InvalidEvidence(format!(
+                "participant {} was already slashed for round {}",
+                evidence.index,
+                evidence.round()
+            )));
+        }
+        Ok(Slash {
+            public_key: evidence.party.public_key.clone(),
+            weight: evidence.party.weight,
+            round: evidence.round(),
+        })
+    }
+
+    /// Verify that the participant of `evidence` is missing from `cert`, the
+    /// certificate of `round`, and return the slash it warrants, failing for
+    /// absences already slashed
+    pub fn check_absence(
+        &mut self,
+        evidence: &AbsenceEvidence,
+        cert: &Certificate,
+        params: &Params,
+        round: u64,
+    ) -> Result<Slash, CcokError> {
+        if params.hashing() != self.hashing {
+            return Err(CcokError::InvalidEvidence(
+                "certificate hashes its trees differently".to_string(),
+            ));
+        }
+        evidence.verify_certificate(cert, params, &self.party_tree_root)?;
+        if !self.absent.insert((evidence.index, round)) {
+            return Err(CcokError::InvalidEvidence(format!(
+                "participant {} was already slashed for absence in round {}",
+                evidence.index, round
+            )));
+        }
+        Ok(Slash {
+            public_key: evidence.party.public_key.clone(),
+            weight: evidence.party.weight,
+            round,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::merkle::HashAlgorithm;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_double_sign_evidence() {
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let vote = |round, msg: &[u8]| Vote {
+            round,
+            msg: msg.to_vec(),
+        };
+
+        let first = vote(7, b"block a").sign(&wallets[1]).unwrap();
+        let second = vote(7, b"block b").sign(&wallets[1]).unwrap();
+        let evidence =
+            DoubleSignEvidence::new(&party_tree, &participants, 1, first.clone(), second.clone())
+                .unwrap();
+        let mut verifier = EvidenceVerifier::new(hashing, party_tree.root());
+        let slash = verifier.check(&evidence).unwrap();
+        assert_eq!(slash.public_key, participants[1].public_key);
+        assert_eq!(slash.round, 7);
+        // The same offence is slashed once
+        assert!(verifier.check(&evidence).is_err());
+
+        // Votes of different rounds, the same message or another signer are no offence
+        let later = vote(8, b"block b").sign(&wallets[1]).unwrap();
+        assert!(
+            DoubleSignEvidence::new(&party_tree, &participants, 1, first.clone(), later).is_err()
+        );
+        assert!(DoubleSignEvidence::new(
+            &party_tree,
+            &participants,
+            1,
+            first.clone(),
+            first.clone()
+        )
+        .is_err());
+        assert!(
+            DoubleSignEvidence::new(&party_tree, &participants, 2, first, second.clone()).is_err()
+        );
+
+        // The offender must be in the party tree
+        let mut outsider = evidence.clone();
+        outsider.party.weight = 100;
+        assert!(outsider.verify(hashing, &party_tree.root()).is_err());
+    }
+
+    #[test]
+    fn test_absence_evidence() {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let mut builder = Builder::new(params.clone(), participants, root.clone()).unwrap();
+        for (pos, wallet) in wallets.iter().take(3).enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+
+        let evidence = AbsenceEvidence::new(&builder, 3).unwrap();
+        let mut verifier = EvidenceVerifier::new(params.hashing(), root.clone());
+        let slash = verifier
+            .check_absence(&evidence, &cert, &params, 5)
+            .unwrap();
+        assert_eq!(slash.public_key, evidence.party.public_key);
+        assert_eq!(slash.weight, 10);
+        assert!(verifier
+            .check_absence(&evidence, &cert, &params, 5)
+            .is_err());
+
+        // A signer is never absent, and the slot must be the one committed
+        assert!(AbsenceEvidence::new(&builder, 1).is_err());
+        let mut moved = evidence.clone();
+        moved.index = 2;
+        assert!(moved
+            .verify(params.hashing(), &root, &cert.sig_commit)
+            .is_err());
+        assert!(evidence
+            .verify(params.hashing(), &root, &[0u8; 32])
+            .is_err());
+    }
+}
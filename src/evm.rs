@@ -0,0 +1,323 @@
+//! Calldata for verifying certificates on EVM chains. Certificates must be
+//! built with `HashAlgorithm::Keccak256` so the contract can recompute every
+//! Merkle node with its native `keccak256`. The certificate is flattened into
+//! fixed-size words and byte strings, ABI-encoded as the arguments of
+//! `VERIFY_SIGNATURE`.
+//!
+//! Each reveal carries the exact preimages of its signature and participant
+//! leaves (the bincode encodings of the `SigSlot` and `Participant`); from
+//! `PARAMS_V2` on a leaf is the hash of `HashDomain::Leaf`'s tag followed by
+//! the preimage.
+use crate::ccok::{Certificate, Params};
+use crate::error::CcokError;
+use crate::merkle::HashAlgorithm;
+use crate::stateproof::StateProof;
+use sha3::{Digest, Keccak256};
+
+/// Solidity signature of the verifier function:
+/// `verify(partyRoot, message, provenWeight, version, cert)` where `cert` is
+/// `(sigCommit, signedWeight, totalSigs, reveals, sigProofs, partyProofs)` and
+/// each reveal `(position, weight, scheme, publicKey, signature, sigLeaf, partyLeaf)`
+pub const VERIFY_SIGNATURE: &str = "verify(bytes32,bytes,uint64,uint8,(bytes32,uint64,uint64,(uint64,uint64,uint16,bytes,bytes,bytes,bytes)[],bytes32[],bytes32[]))";
+
+/// Solidity signature of the state proof submission function:
+/// `submitStateProof(message, cert)` where `message` is `(firstBlock,
+/// lastBlock, blockHeadersCommitment, votersCommitment)` and `cert` is encoded
+/// as in `VERIFY_SIGNATURE`. The contract holds the params and the current
+/// voters commitment.
+pub const SUBMIT_STATE_PROOF_SIGNATURE: &str = "submitStateProof((uint64,uint64,bytes32,bytes32),(bytes32,uint64,uint64,(uint64,uint64,uint16,bytes,bytes,bytes,bytes)[],bytes32[],bytes32[]))";
+
+/// Value in the ABI encoding
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Token {
+    /// Static 32-byte word: integers, `bool` and `bytes32`
+    Word([u8; 32]),
+    /// Dynamic `bytes`
+    Bytes(Vec<u8>),
+    /// Dynamic array `T[]`
+    Array(Vec<Token>),
+    /// Tuple, dynamic if any member is
+    Tuple(Vec<Token>),
+}
+
+impl Token {
+    /// Unsigned integer word
+    pub fn uint(value: u64) -> Self {
+        let mut word = [0u8; 32];
+        word[24..].copy_from_slice(&value.to_be_bytes());
+        Token::Word(word)
+    }
+
+    /// `bytes32` word; `bytes` must not be longer than 32 bytes
+    pub fn bytes32(bytes: &[u8]) -> Result<Self, CcokError> {
+        if bytes.len() > 32 {
+            return Err(CcokError::Serialization(format!(
+                "{} bytes don't fit in bytes32",
+                bytes.len()
+            )));
+        }
+        let mut word = [0u8; 32];
+        word[..bytes.len()].copy_from_slice(bytes);
+        Ok(Token::Word(word))
+    }
+
+    fn is_dynamic(&self) -> bool {
+        match self {
+            Token::Word(_) => false,
+            Token::Bytes(_) | Token::Array(_) => true,
+            Token::Tuple(members) => members.iter().any(Token::is_dynamic),
+        }
+    }
+
+    // Size of the token in the head of its enclosing tuple
+    fn head_len(&self) -> usize {
+        match self {
+            Token::Tuple(members) if !self.is_dynamic() => {
+                members.iter().map(Token::head_len).sum()
+            }
+            _ => 32,
+        }
+    }
+
+    fn encode_into(&self, out: &mut Vec<u8>) {
+        match self {
+            Token::Word(word) => out.extend_from_slice(word),
+            Token::Bytes(bytes) => {
+                out.extend_from_slice(&word(bytes.len()));
+                out.extend_from_slice(bytes);
+                out.resize(out.len() + (32 - bytes.len() % 32) % 32, 0);
+            }
+            Token::Array(items) => {
+                out.extend_from_slice(&word(items.len()));
+                out.extend_from_slice(&encode(items));
+            }
+            Token::Tuple(members) => out.extend_from_slice(&encode(members)),
+        }
+    }
+}
+
+fn word(value: usize) -> [u8; 32] {
+    let mut word = [0u8; 32];
+    word[24..].copy_from_slice(&(value as u64).to_be_bytes());
+    word
+}
+
+/// ABI-encode `tokens` as a tuple: static values inline, dynamic ones as
+/// offsets into the tail
+pub fn encode(tokens: &[Token]) -> Vec<u8> {
+    let head_len: usize = tokens.iter().map(Token::head_len).sum();
+    let mut head = Vec::with_capacity(head_len);
+    let mut tail = Vec::new();
+    for token in tokens {
+        if token.is_dynamic() {
+            head.extend_from_slice(&word(head_len + tail.len()));
+            token.encode_into(&mut tail);
+        } else {
+            token.encode_into(&mut head);
+        }
+    }
+    head.extend_from_slice(&tail);
+    head
+}
+
+/// First four bytes of the Keccak256 hash of a function signature
+pub fn selector(signature: &str) -> [u8; 4] {
+    let hash = Keccak256::digest(signature.as_bytes());
+    [hash[0], hash[1], hash[2], hash[3]]
+}
+
+/// Calldata of `signature` called with `args`
+pub fn calldata(signature: &str, args: &[Token]) -> Vec<u8> {
+    let mut data = selector(signature).to_vec();
+    data.extend_from_slice(&encode(args));
+    data
+}
+
+/// Certificate flattened into ABI tokens
+pub fn certificate_token(cert: &Certificate) -> Result<Token, CcokError> {
+    if cert.hash != HashAlgorithm::Keccak256 {
+        return Err(CcokError::HashMismatch {
+            cert: cert.hash,
+            params: HashAlgorithm::Keccak256,
+        });
+    }
+    // The contract checks each revealed signature, not an aggregate
+    if !cert.aggregate_sig.is_empty() {
+        return Err(CcokError::Serialization(
+            "Aggregate signatures can't be verified on chain".to_string(),
+        ));
+    }
+    let reveals = cert
+        .reveal_positions
+        .iter()
+        .map(|pos| {
+            let reveal = cert
+                .reveals
+                .get(pos)
+                .ok_or(CcokError::InvalidReveal(*pos))?;
+            let signature = reveal
+                .sig_slot
+                .signature
+                .as_ref()
+                .map_or(Vec::new(), |sig| sig.as_bytes().to_vec());
+            let public_key = match &reveal.sig_slot.one_time_key {
+                Some(proof) => &proof.public_key,
+                None => &reveal.party.public_key,
+            };
+            Ok(Token::Tuple(vec![
+                Token::uint(*pos),
+                Token::uint(reveal.party.weight),
+                Token::uint(reveal.party.scheme.0 as u64),
+                Token::Bytes(hex::decode(public_key)?),
+                Token::Bytes(signature),
+                Token::Bytes(bincode::serialize(&reveal.sig_slot)?),
+                Token::Bytes(bincode::serialize(&reveal.party)?),
+            ]))
+        })
+        .collect::<Result<Vec<_>, CcokError>>()?;
+    let hashes = |proofs: Vec<Vec<u8>>| {
+        proofs
+            .iter()
+            .map(|hash| Token::bytes32(hash))
+            .collect::<Result<Vec<_>, CcokError>>()
+            .map(Token::Array)
+    };
+    Ok(Token::Tuple(vec![
+        Token::bytes32(&cert.sig_commit)?,
+        Token::uint(cert.signed_weight),
+        Token::uint(cert.total_sigs as u64),
+        Token::Array(reveals),
+        hashes(cert.sig_proof_hashes()?)?,
+        hashes(cert.party_proof_hashes()?)?,
+    ]))
+}
+
+/// Calldata verifying `cert` under `params` against `party_tree_root` on chain
+pub fn verify_calldata(
+    cert: &Certificate,
+    params: &Params,
+    party_tree_root: &[u8],
+) -> Result<Vec<u8>, CcokError> {
+    if params.hash != cert.hash {
+        return Err(CcokError::HashMismatch {
+            cert: cert.hash,
+            params: params.hash,
+        });
+    }
+    Ok(calldata(
+        VERIFY_SIGNATURE,
+        &[
+            Token::bytes32(party_tree_root)?,
+            Token::Bytes(params.msg.clone()),
+            Token::uint(params.proven_weight),
+            Token::uint(params.version as u64),
+            certificate_token(cert)?,
+        ],
+    ))
+}
+
+/// Calldata submitting a state proof to the main chain verifier contract
+pub fn state_proof_calldata(proof: &StateProof) -> Result<Vec<u8>, CcokError> {
+    let message = &proof.message;
+    Ok(calldata(
+        SUBMIT_STATE_PROOF_SIGNATURE,
+        &[
+            Token::Tuple(vec![
+                Token::uint(message.first_block),
+                Token::uint(message.last_block),
+                Token::bytes32(&message.block_headers_commitment)?,
+                Token::bytes32(&message.voters_commitment)?,
+            ]),
+            certificate_token(&proof.certificate)?,
+        ],
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::wallet::Wallet;
+
+    // Word `index` of the ABI-encoded arguments following the selector
+    fn arg_word(data: &[u8], index: usize) -> &[u8] {
+        &data[4 + 32 * index..4 + 32 * (index + 1)]
+    }
+
+    #[test]
+    fn test_calldata() {
+        // Example from the Solidity ABI specification
+        let data = calldata(
+            "sam(bytes,bool,uint256[])",
+            &[
+                Token::Bytes(b"dave".to_vec()),
+                Token::uint(1),
+                Token::Array(vec![Token::uint(1), Token::uint(2), Token::uint(3)]),
+            ],
+        );
+        let expected = "a5643bf2\
+            0000000000000000000000000000000000000000000000000000000000000060\
+            0000000000000000000000000000000000000000000000000000000000000001\
+            00000000000000000000000000000000000000000000000000000000000000a0\
+            0000000000000000000000000000000000000000000000000000000000000004\
+            6461766500000000000000000000000000000000000000000000000000000000\
+            0000000000000000000000000000000000000000000000000000000000000003\
+            0000000000000000000000000000000000000000000000000000000000000001\
+            0000000000000000000000000000000000000000000000000000000000000002\
+            0000000000000000000000000000000000000000000000000000000000000003";
+        assert_eq!(hex::encode(&data), expected);
+
+        // Certificate calldata starts with the fixed-size arguments
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let mut builder =
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        let data = verify_calldata(&cert, &params, &party_tree.root()).unwrap();
+        assert_eq!(data[..4], selector(VERIFY_SIGNATURE));
+        assert_eq!(arg_word(&data, 0), party_tree.root().as_slice());
+        assert_eq!(arg_word(&data, 2), &word(20)[..]);
+        assert_eq!(arg_word(&data, 3), &word(2)[..]);
+        let cert_offset =
+            4 + u64::from_be_bytes(arg_word(&data, 4)[24..].try_into().unwrap()) as usize;
+        assert_eq!(
+            &data[cert_offset..cert_offset + 32],
+            cert.sig_commit.as_slice()
+        );
+
+        // Certificates hashed with anything but Keccak256 can't be verified on chain
+        params.hash = HashAlgorithm::Sha256;
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        assert!(verify_calldata(&cert, &params, &party_tree.root()).is_err());
+    }
+}
@@ -0,0 +1,469 @@
+//! Fast sync: a new node starts from the latest certified state instead of
+//! replaying every block. Trusting the genesis epoch, it follows the epoch
+//! handoffs to the current validators, verifies the latest state proof they
+//! signed with `lightclient::Client::advance_to`, and checks the tip block of
+//! that interval against the certified headers. It then downloads the account
+//! state at the tip in `StateChunk`s: every account state carries its path to
+//! the tip's state root and is checked as its chunk arrives, and the assembled
+//! tree must produce the root, so no account can be left out. The fee market
+//! state, kept in the same tree, travels with its path in the first chunk,
+//! and the node charges fees by its genesis fee config. The result seeds the
+//! node's `ForkChoice`.
+use crate::block::Block;
+use crate::fees::{fee_market_key, FeeConfig, FeeMarket};
+use crate::forkchoice::ForkChoice;
+use crate::handoff::HandoffCert;
+use crate::lightclient::Client;
+use crate::merkle::{AuditPath, Hashing};
+use crate::smt::{SmtProof, SparseMerkleTree};
+use crate::state::{AccountState, ChainState};
+use crate::stateproof::StateProof;
+use serde::{Deserialize, Serialize};
+
+/// Account states per chunk unless configured
+pub const DEFAULT_CHUNK_SIZE: usize = 256;
+
+/// Account states of one chunk of a state snapshot, in key order, each with
+/// its path to the state root
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct StateChunk {
+    /// Position of the chunk in the snapshot, from 0
+    pub index: u64,
+    /// Account states by `state::account_key`
+    pub entries: Vec<([u8; 32], AccountState)>,
+    pub proofs: Vec<SmtProof>,
+    /// Fee market state with its path, in the first chunk if not the
+    /// genesis one
+    #[serde(default)]
+    pub fee_market: Option<(FeeMarket, SmtProof)>,
+}
+
+/// Chunks of `state` with up to `chunk_size` account states each, as served
+/// to syncing nodes
+pub fn state_chunks(state: &ChainState, chunk_size: usize) -> Result<Vec<StateChunk>, String> {
+    if chunk_size == 0 {
+        return Err("Chunk size must be positive".to_string());
+    }
+    let tree = state.tree();
+    let market_key = fee_market_key(tree.hashing());
+    // Every path comes from one pass over the tree
+    let mut fee_market = None;
+    let mut entries = Vec::with_capacity(tree.len());
+    let mut proofs = Vec::with_capacity(tree.len());
+    for ((key, value), proof) in tree.iter().zip(tree.prove_all()) {
+        if *key == market_key {
+            let market: FeeMarket =
+                bincode::deserialize(value).map_err(|e| format!("Deserialization error: {}", e))?;
+            fee_market = Some((market, proof));
+            continue;
+        }
+        let state: AccountState =
+            bincode::deserialize(value).map_err(|e| format!("Deserialization error: {}", e))?;
+        entries.push((*key, state));
+        proofs.push(proof);
+    }
+    let mut chunks: Vec<StateChunk> = entries
+        .chunks(chunk_size)
+        .zip(proofs.chunks(chunk_size))
+        .enumerate()
+        .map(|(index, (entries, proofs))| StateChunk {
+            index: index as u64,
+            entries: entries.to_vec(),
+            proofs: proofs.to_vec(),
+            fee_market: None,
+        })
+        .collect();
+    if fee_market.is_some() && chunks.is_empty() {
+        chunks.push(StateChunk {
+            index: 0,
+            entries: Vec::new(),
+            proofs: Vec::new(),
+            fee_market: None,
+        });
+    }
+    if let Some(chunk) = chunks.first_mut() {
+        chunk.fee_market = fee_market;
+    }
+    Ok(chunks)
+}
+
+/// Where a syncing node downloads from, e.g. a peer
+pub trait SyncSource {
+    /// Handoff certificates from epoch `from` on, in order
+    fn handoffs(&self, from: u64) -> Result<Vec<HandoffCert>, String>;
+
+    /// Latest state proof, with the last block of its interval and the
+    /// block's path to the interval's headers commitment
+    fn latest_state_proof(&self) -> Result<(StateProof, Block, AuditPath), String>;
+
+    /// Chunk `index` of the state after block `height`, `None` past the last
+    fn state_chunk(&self, height: u64, index: u64) -> Result<Option<StateChunk>, String>;
+}
+
+/// Verified state a fast-synced node continues from
+#[derive(Debug, Clone)]
+pub struct SyncedState {
+    /// Light client at the latest certified interval
+    pub client: Client,
+    /// Certified block the state is the state after
+    pub tip: Block,
+    pub state: ChainState,
+}
+
+impl SyncedState {
+    /// Fork choice continuing the chain from the synced tip
+    pub fn fork_choice(&self) -> ForkChoice {
+        ForkChoice::new(self.tip.clone(), self.state.clone())
+    }
+}
+
+/// Progress of a fast sync, fed with what the node downloads
+#[derive(Debug, Clone)]
+pub struct FastSync {
+    client: Client,
+    hashing: Hashing,
+    fees: FeeConfig,
+    tip: Option<Block>,
+    tree: SparseMerkleTree,
+    next_chunk: u64,
+    last_key: Option<[u8; 32]>,
+}
+
+impl FastSync {
+    /// Sync trusting `client`, e.g. `GenesisState::light_client`, into a
+    /// state tree hashed with `hashing`, charging fees by `fees`
+    pub fn new(client: Client, hashing: Hashing, fees: FeeConfig) -> Self {
+        Self {
+            client,
+            hashing,
+            fees,
+            tip: None,
+            tree: SparseMerkleTree::new(hashing),
+            next_chunk: 0,
+            last_key: None,
+        }
+    }
+
+    /// Light client of the sync
+    pub fn client(&self) -> &Client {
+        &self.client
+    }
+
+    /// Certified tip block, once a state proof was accepted
+    pub fn tip(&self) -> Option<&Block> {
+        self.tip.as_ref()
+    }
+
+    /// Follow the handoff of the current epoch
+    pub fn add_handoff(&mut self, cert: &HandoffCert) -> Result<(), String> {
+        Ok(self.client.advance_epoch(cert)?)
+    }
+
+    /// Accept the latest state proof of the current validators and `tip`,
+    /// the last block of its interval, whose header `path` places in it
+    pub fn add_state_proof(
+        &mut self,
+        proof: &StateProof,
+        tip: Block,
+        path: &AuditPath,
+    ) -> Result<(), String> {
+        if self.tip.is_some() {
+            return Err("State proof already accepted".to_string());
+        }
+        if tip.id as u64 != proof.message.last_block {
+            return Err(format!(
+                "Block {} does not end the interval of blocks {}..={}",
+                tip.id, proof.message.first_block, proof.message.last_block
+            ));
+        }
+        if tip.header().hash()? != tip.hash {
+            return Err(format!("Hash of tip block {} does not match", tip.id));
+        }
+        let mut client = self.client.clone();
+        client.advance_to(proof)?;
+        client.verify_header(&tip.header(), path)?;
+        self.client = client;
+        self.tip = Some(tip);
+        Ok(())
+    }
+
+    /// Check the next chunk of the state at the tip against its state root
+    pub fn add_chunk(&mut self, chunk: &StateChunk) -> Result<(), String> {
+        let tip = self
+            .tip
+            .as_ref()
+            .ok_or_else(|| "No certified state root to check chunks against".to_string())?;
+        if chunk.index != self.next_chunk {
+            return Err(format!(
+                "Chunk {} out of order, expected {}",
+                chunk.index, self.next_chunk
+            ));
+        }
+        if chunk.entries.len() != chunk.proofs.len() {
+            return Err(format!(
+                "Chunk {} has {} account states but {} proofs",
+                chunk.index,
+                chunk.entries.len(),
+                chunk.proofs.len()
+            ));
+        }
+        // Nothing of the chunk is kept unless all of it checks
+        let mut values = Vec::with_capacity(chunk.entries.len());
+        let mut last_key = self.last_key;
+        for ((key, state), proof) in chunk.entries.iter().zip(&chunk.proofs) {
+            if last_key >= Some(*key) {
+                return Err(format!(
+                    "Chunk {} account {} out of order",
+                    chunk.index,
+                    hex::encode(key)
+                ));
+            }
+            let value =
+                bincode::serialize(state).map_err(|e| format!("Serialization error: {}", e))?;
+            if !proof.verify(self.hashing, &tip.state_root, key, &value) {
+                return Err(format!(
+                    "Chunk {} account {} is not in the state of block {}",
+                    chunk.index,
+                    hex::encode(key),
+                    tip.id
+                ));
+            }
+            values.push((*key, value));
+            last_key = Some(*key);
+        }
+        if let Some((market, proof)) = &chunk.fee_market {
+            let key = fee_market_key(self.hashing);
+            let value =
+                bincode::serialize(market).map_err(|e| format!("Serialization error: {}", e))?;
+            if chunk.index != 0 || !proof.verify(self.hashing, &tip.state_root, &key, &value) {
+                return Err(format!(
+                    "Chunk {} fee market is not in the state of block {}",
+                    chunk.index, tip.id
+                ));
+            }
+            values.push((key, value));
+        }
+        for (key, value) in values {
+            self.tree.insert(key, value);
+        }
+        self.last_key = last_key;
+        self.next_chunk += 1;
+        Ok(())
+    }
+
+    /// Finish once every chunk arrived, failing if accounts are missing
+    pub fn finish(self) -> Result<SyncedState, String> {
+        let tip = self
+            .tip
+            .ok_or_else(|| "No state proof accepted".to_string())?;
+        if self.tree.root() != tip.state_root {
+            return Err(format!(
+                "State of block {} is incomplete after {} chunks",
+                tip.id, self.next_chunk
+            ));
+        }
+        Ok(SyncedState {
+            client: self.client,
+            tip,
+            state: ChainState::from_tree(self.tree, self.fees)?,
+        })
+    }
+}
+
+/// Fast sync from `source`: follow its handoffs from the epoch `client`
+/// trusts, verify its latest state proof and download the state at the tip
+pub fn fast_sync(
+    source: &dyn SyncSource,
+    client: Client,
+    hashing: Hashing,
+    fees: FeeConfig,
+) -> Result<SyncedState, String> {
+    let mut sync = FastSync::new(client, hashing, fees);
+    let from = sync.client.epoch().map_or(0, |epoch| epoch.number);
+    for cert in source.handoffs(from)? {
+        sync.add_handoff(&cert)?;
+    }
+    let (proof, tip, path) = source.latest_state_proof()?;
+    sync.add_state_proof(&proof, tip, &path)?;
+    let height = proof.message.last_block;
+    let mut index = 0;
+    while let Some(chunk) = source.state_chunk(height, index)? {
+        sync.add_chunk(&chunk)?;
+        index += 1;
+    }
+    sync.finish()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::block::BlockBuilder;
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::handoff::{Epoch, Handoff};
+    use crate::mempool::Mempool;
+    use crate::stateproof::{prove_header, voters_commitment, StateProofMessage};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    struct Peer {
+        handoffs: Vec<HandoffCert>,
+        proof: StateProof,
+        tip: Block,
+        path: AuditPath,
+        chunks: Vec<StateChunk>,
+    }
+
+    impl SyncSource for Peer {
+        fn handoffs(&self, from: u64) -> Result<Vec<HandoffCert>, String> {
+            Ok(self
+                .handoffs
+                .iter()
+                .filter(|cert| cert.handoff.from.number >= from)
+                .cloned()
+                .collect())
+        }
+
+        fn latest_state_proof(&self) -> Result<(StateProof, Block, AuditPath), String> {
+            Ok((self.proof.clone(), self.tip.clone(), self.path.clone()))
+        }
+
+        fn state_chunk(&self, height: u64, index: u64) -> Result<Option<StateChunk>, String> {
+            assert_eq!(height, self.tip.id as u64);
+            Ok(self.chunks.get(index as usize).cloned())
+        }
+    }
+
+    // Certificate of `wallets`, the voters `voters` committed by `root`, over `params`
+    fn certify(
+        params: &Params,
+        wallets: &[Wallet],
+        voters: &[Participant],
+        root: &[u8],
+    ) -> crate::ccok::Certificate {
+        let mut builder = Builder::new(params.clone(), voters.to_vec(), root.to_vec()).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        builder.build().unwrap()
+    }
+
+    #[test]
+    fn test_fast_sync() {
+        let template = Params {
+            proven_weight: 10,
+            ..Default::default()
+        };
+        let hashing = template.hashing();
+        let validators = |count: usize, number: u64| {
+            let wallets: Vec<Wallet> = (0..count).map(|_| Wallet::new().unwrap()).collect();
+            let voters: Vec<Participant> = wallets
+                .iter()
+                .map(|w| Participant::from_signer(w, 10))
+                .collect();
+            let epoch = Epoch {
+                number,
+                voters_commitment: voters_commitment(hashing, &voters).unwrap(),
+                total_weight: 10 * count as u64,
+            };
+            (wallets, voters, epoch)
+        };
+        let genesis = validators(3, 0);
+        let current = validators(2, 1);
+        let handoff = Handoff::new(genesis.2.clone(), current.2.clone()).unwrap();
+        let params = handoff.params(&template).unwrap();
+        let handoffs = vec![HandoffCert {
+            certificate: certify(
+                &params,
+                &genesis.0,
+                &genesis.1,
+                &genesis.2.voters_commitment,
+            ),
+            handoff,
+        }];
+
+        // Eight blocks after which five accounts hold funds
+        let mut state = ChainState::new(hashing);
+        for i in 0..5u64 {
+            let account = Account {
+                address: format!("account-{}", i),
+            };
+            state.credit(&account, 10 * (i + 1)).unwrap();
+        }
+        let mut blocks: Vec<Block> = Vec::new();
+        for id in 1..=8u8 {
+            let block = BlockBuilder::new(
+                blocks.last(),
+                id as usize,
+                Account {
+                    address: "proposer".to_string(),
+                },
+                String::new(),
+                Seed { seed: [id; 32] },
+            )
+            .with_state_root(state.root())
+            .build(&mut Mempool::new())
+            .unwrap();
+            blocks.push(block);
+        }
+        // The current validators certify the second interval
+        let interval = &blocks[4..];
+        let message =
+            StateProofMessage::new(hashing, interval, current.2.voters_commitment.clone()).unwrap();
+        let params = message.params(&template).unwrap();
+        let proof = StateProof {
+            certificate: certify(
+                &params,
+                &current.0,
+                &current.1,
+                &current.2.voters_commitment,
+            ),
+            message,
+        };
+        let mut peer = Peer {
+            handoffs,
+            proof,
+            tip: blocks[7].clone(),
+            path: prove_header(hashing, interval, 3).unwrap(),
+            chunks: state_chunks(&state, 2).unwrap(),
+        };
+        assert_eq!(peer.chunks.len(), 3);
+        let client = || {
+            Client::new(template.clone(), 4, genesis.2.voters_commitment.clone())
+                .with_epoch(genesis.2.clone())
+                .unwrap()
+        };
+
+        let synced = fast_sync(&peer, client(), hashing, FeeConfig::default()).unwrap();
+        assert_eq!(synced.state.root(), state.root());
+        assert_eq!(synced.client.last_certified_block(), Some(8));
+        assert_eq!(synced.client.epoch(), Some(&current.2));
+        assert_eq!(synced.fork_choice().head().hash, blocks[7].hash);
+
+        // The proof must be signed by the validators the handoffs lead to
+        let mut sync = FastSync::new(client(), hashing, FeeConfig::default());
+        assert!(sync
+            .add_state_proof(&peer.proof, peer.tip.clone(), &peer.path)
+            .is_err());
+        sync.add_handoff(&peer.handoffs[0]).unwrap();
+        // and the tip must be the certified last block
+        assert!(sync
+            .add_state_proof(&peer.proof, blocks[6].clone(), &peer.path)
+            .is_err());
+        sync.add_state_proof(&peer.proof, peer.tip.clone(), &peer.path)
+            .unwrap();
+
+        // Tampered and reordered chunks are rejected, a missing one detected
+        let mut tampered = peer.chunks[0].clone();
+        tampered.entries[1].1.balance += 1;
+        assert!(sync.add_chunk(&tampered).is_err());
+        assert!(sync.add_chunk(&peer.chunks[1]).is_err());
+        sync.add_chunk(&peer.chunks[0]).unwrap();
+        sync.add_chunk(&peer.chunks[1]).unwrap();
+        assert!(sync.finish().is_err());
+        peer.chunks.pop();
+        assert!(fast_sync(&peer, client(), hashing, FeeConfig::default()).is_err());
+    }
+}
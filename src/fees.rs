@@ -0,0 +1,211 @@
+//! Fee market of the typed transactions. Every block has a base fee each of
+//! its transactions must pay at least; the rest of a transaction's fee is a
+//! tip for the proposer. After each block the base fee moves towards the one
+//! at which blocks hold the target number of transactions, by at most
+//! `1 / change_denominator`, as in EIP-1559. The base fees paid are burnt or
+//! go to the proposer or to the registered validators by stake. The current
+//! base fee, the amount burnt and the validators sharing base fees are kept
+//! in the state tree, so the state root commits to them too. The config is
+//! part of the genesis file.
+use crate::accounts::Account;
+use crate::config::MAX_TXNS_PER_BLOCK;
+use crate::merkle::{HashDomain, Hashing};
+use serde::{Deserialize, Serialize};
+
+/// Where the base fees of a block go
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub enum FeeSink {
+    /// Taken out of circulation
+    Burn,
+    /// To the proposer, with the tips
+    #[default]
+    Proposer,
+    /// Shared by the validators registered with a `Register` transaction in
+    /// proportion to their stake
+    Validators,
+}
+
+/// Base fee adjustment of a chain
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct FeeConfig {
+    /// Base fee of the first block
+    pub initial_base_fee: u64,
+    /// Floor of the base fee
+    pub min_base_fee: u64,
+    /// Transactions per block at which the base fee holds
+    pub target_txs: u64,
+    /// Inverse of the largest change of the base fee from one block to the
+    /// next
+    pub change_denominator: u64,
+    /// Where the base fees go
+    pub sink: FeeSink,
+}
+
+impl Default for FeeConfig {
+    /// No base fee: every fee goes to the proposer
+    fn default() -> Self {
+        Self {
+            initial_base_fee: 0,
+            min_base_fee: 0,
+            target_txs: (MAX_TXNS_PER_BLOCK / 2) as u64,
+            change_denominator: 8,
+            sink: FeeSink::Proposer,
+        }
+    }
+}
+
+impl FeeConfig {
+    /// Check the target and change denominator are positive and the initial
+    /// base fee is not below the floor
+    pub fn validate(&self) -> Result<(), String> {
+        if self.target_txs == 0 || self.change_denominator == 0 {
+            return Err("Fee target and change denominator must be positive".to_string());
+        }
+        if self.initial_base_fee < self.min_base_fee {
+            return Err(format!(
+                "Initial base fee {} below the minimum {}",
+                self.initial_base_fee, self.min_base_fee
+            ));
+        }
+        Ok(())
+    }
+
+    /// Base fee of the block after one of `txs` transactions at `base_fee`.
+    /// A block above the target raises a positive base fee by at least 1, so
+    /// small base fees don't get stuck where the change rounds to zero.
+    pub fn next_base_fee(&self, base_fee: u64, txs: usize) -> u64 {
+        let target = self.target_txs.max(1) as u128;
+        let txs = txs as u128;
+        let base = base_fee as u128;
+        let denominator = self.change_denominator.max(1) as u128;
+        let next = if txs == target || base == 0 {
+            base
+        } else if txs > target {
+            base + (base * (txs - target) / target / denominator).max(1)
+        } else {
+            base - base * (target - txs) / target / denominator
+        };
+        u64::try_from(next)
+            .unwrap_or(u64::MAX)
+            .max(self.min_base_fee)
+    }
+
+    /// Fee market before the first block
+    pub fn genesis(&self) -> FeeMarket {
+        FeeMarket {
+            base_fee: self.initial_base_fee,
+            burnt: 0,
+            validators: Vec::new(),
+        }
+    }
+}
+
+/// Fee market state, as kept in the state tree
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct FeeMarket {
+    /// Base fee of the next block
+    pub base_fee: u64,
+    /// Base fees burnt so far
+    pub burnt: u64,
+    /// Registered validators sharing base fees, by address, kept only for
+    /// `FeeSink::Validators`. Validators without stake are dropped when a
+    /// block settles and register again to share fees.
+    pub validators: Vec<Account>,
+}
+
+/// Key of the fee market in the state tree, apart from every account key
+pub fn fee_market_key(hashing: Hashing) -> [u8; 32] {
+    hashing.hash(HashDomain::State, b"fee-market")
+}
+
+/// Shares of `amount` for `weights` in proportion to their weight, rounded
+/// down; the remainder is returned apart
+pub fn split_by_weight(amount: u64, weights: &[(Account, u64)]) -> (Vec<(Account, u64)>, u64) {
+    let total: u128 = weights.iter().map(|(_, weight)| *weight as u128).sum();
+    if total == 0 {
+        return (Vec::new(), amount);
+    }
+    let shares: Vec<(Account, u64)> = weights
+        .iter()
+        .map(|(account, weight)| {
+            let share = amount as u128 * *weight as u128 / total;
+            (account.clone(), share as u64)
+        })
+        .collect();
+    let paid: u64 = shares.iter().map(|(_, share)| share).sum();
+    (shares, amount - paid)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_base_fee_adjustment() {
+        let config = FeeConfig {
+            initial_base_fee: 800,
+            min_base_fee: 100,
+            target_txs: 10,
+            change_denominator: 8,
+            sink: FeeSink::Burn,
+        };
+        config.validate().unwrap();
+
+        // Full blocks raise the base fee by an eighth, empty ones lower it
+        assert_eq!(config.next_base_fee(800, 10), 800);
+        assert_eq!(config.next_base_fee(800, 20), 900);
+        assert_eq!(config.next_base_fee(800, 0), 700);
+        assert_eq!(config.next_base_fee(100, 0), 100);
+        assert_eq!(FeeConfig::default().next_base_fee(0, 100), 0);
+
+        // Small base fees still rise when the change rounds to zero
+        let low = FeeConfig {
+            min_base_fee: 1,
+            ..config
+        };
+        assert_eq!(low.next_base_fee(7, 11), 8);
+        assert_eq!(low.next_base_fee(7, 10), 7);
+        assert_eq!(low.next_base_fee(7, 9), 7);
+        assert_eq!(config.next_base_fee(u64::MAX, 20), u64::MAX);
+    }
+
+    #[test]
+    fn test_fee_config_errors() {
+        let config = FeeConfig {
+            initial_base_fee: 800,
+            min_base_fee: 100,
+            target_txs: 10,
+            change_denominator: 8,
+            sink: FeeSink::Burn,
+        };
+        let below = FeeConfig {
+            initial_base_fee: 50,
+            ..config
+        };
+        assert!(below.validate().is_err());
+        let no_target = FeeConfig {
+            target_txs: 0,
+            ..config
+        };
+        assert!(no_target.validate().is_err());
+        let no_denominator = FeeConfig {
+            change_denominator: 0,
+            ..config
+        };
+        assert!(no_denominator.validate().is_err());
+    }
+
+    #[test]
+    fn test_split_by_weight() {
+        // Shares follow the weights, the remainder is left over
+        let account = |address: &str| Account {
+            address: address.to_string(),
+        };
+        let (shares, rest) = split_by_weight(10, &[(account("a"), 1), (account("b"), 2)]);
+        assert_eq!(shares, vec![(account("a"), 3), (account("b"), 6)]);
+        assert_eq!(rest, 1);
+        assert_eq!(split_by_weight(10, &[]), (Vec::new(), 10));
+        assert_eq!(split_by_weight(10, &[(account("a"), 0)]), (Vec::new(), 10));
+    }
+}
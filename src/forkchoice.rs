@@ -0,0 +1,336 @@
+//! Fork choice of the node. `ForkChoice` keeps every block that extends a
+//! known one together with the account state after it, and follows the
+//! heaviest chain: the one whose block certificates together carry the most
+//! signed weight, the longer one on ties, and the one seen first after that.
+//! When a block makes another branch the heaviest, the head moves there: the
+//! state is the one after the new head, the typed transactions of the
+//! retracted blocks go back to the `TxPool` and those of the applied blocks
+//! leave it. Each move is reported as a `ForkEvent`, which the relayer
+//! follows to drop state proofs of intervals that are no longer canonical.
+use crate::block::{Block, BlockHeader};
+use crate::mempool::TxPool;
+use crate::state::ChainState;
+use crate::tx::SignedTx;
+use log::info;
+use std::collections::HashMap;
+
+/// Move of the canonical head
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ForkEvent {
+    /// The head moved to a child of the previous head
+    NewHead { header: BlockHeader },
+    /// The head moved to another branch: the blocks above `common_ancestor`
+    /// were retracted and `applied` took their place, both lowest first
+    Reorg {
+        common_ancestor: u64,
+        retracted: Vec<BlockHeader>,
+        applied: Vec<BlockHeader>,
+    },
+}
+
+// Known block with the state after it and the weight of its chain
+#[derive(Debug, Clone)]
+struct Entry {
+    block: Block,
+    state: ChainState,
+    weight: u128,
+}
+
+/// Tracks competing branches and picks the heaviest certified chain
+#[derive(Debug, Clone)]
+pub struct ForkChoice {
+    blocks: HashMap<[u8; 32], Entry>,
+    head: [u8; 32],
+}
+
+impl ForkChoice {
+    /// Fork choice starting at `genesis`, with `state` the state after it
+    pub fn new(genesis: Block, state: ChainState) -> Self {
+        let head = genesis.hash;
+        let weight = chain_weight(0, &genesis);
+        let mut blocks = HashMap::new();
+        blocks.insert(
+            head,
+            Entry {
+                block: genesis,
+                state,
+                weight,
+            },
+        );
+        Self { blocks, head }
+    }
+
+    /// Head of the canonical chain
+    pub fn head(&self) -> &Block {
+        &self.blocks[&self.head].block
+    }
+
+    /// State after the head
+    pub fn state(&self) -> &ChainState {
+        &self.blocks[&self.head].state
+    }
+
+    /// Whether the block `hash` is known
+    pub fn contains(&self, hash: &[u8; 32]) -> bool {
+        self.blocks.contains_key(hash)
+    }
+
+    /// Signed weight of the certificates of the chain ending at block `hash`
+    pub fn weight(&self, hash: &[u8; 32]) -> Option<u128> {
+        self.blocks.get(hash).map(|entry| entry.weight)
+    }
+
+    /// Canonical chain from the first known block to the head
+    pub fn canonical(&self) -> Vec<&Block> {
+        let mut chain: Vec<&Block> = self.ancestry(self.head).collect();
+        chain.reverse();
+        chain
+    }
+
+    // Blocks from `hash` back to the first known block
+    fn ancestry(&self, hash: [u8; 32]) -> impl Iterator<Item = &Block> + '_ {
+        std::iter::successors(self.blocks.get(&hash), move |entry| {
+            self.blocks.get(&entry.block.previous_hash)
+        })
+        .map(|entry| &entry.block)
+    }
+
+    /// Add a block verified by consensus. It must extend a known block and
+    /// produce its state root. Returns how the head moved, `None` if the
+    /// block joined a lighter branch or was known already.
+    pub fn add_block(
+        &mut self,
+        block: Block,
+        pool: &mut TxPool,
+    ) -> Result<Option<ForkEvent>, String> {
+        if self.blocks.contains_key(&block.hash) {
+            return Ok(None);
+        }
+        if block.header().hash()? != block.hash {
+            return Err(format!("Block {} does not match its hash", block.id));
+        }
+        let parent = self.blocks.get(&block.previous_hash).ok_or_else(|| {
+            format!(
+                "Parent {} of block {} is unknown",
+                hex::encode(block.previous_hash),
+                block.id
+            )
+        })?;
+        if block.id != parent.block.id + 1 {
+            return Err(format!(
+                "Block {} does not follow its parent {}",
+                block.id, parent.block.id
+            ));
+        }
+        let mut state = parent.state.clone();
+        state.apply_block(&block)?;
+        let weight = chain_weight(parent.weight, &block);
+
+        let hash = block.hash;
+        let head = &self.blocks[&self.head];
+        let heavier = (weight, block.id) > (head.weight, head.block.id);
+        let extends_head = block.previous_hash == self.head;
+        self.blocks.insert(
+            hash,
+            Entry {
+                block,
+                state,
+                weight,
+            },
+        );
+        if !heavier {
+            return Ok(None);
+        }
+        if extends_head {
+            self.head = hash;
+            let block = self.head();
+            pool.remove(&block.txs);
+            return Ok(Some(ForkEvent::NewHead {
+                header: block.header(),
+            }));
+        }
+        Ok(Some(self.reorg(hash, pool)))
+    }
+
+    // Move the head to `tip` on another branch
+    fn reorg(&mut self, tip: [u8; 32], pool: &mut TxPool) -> ForkEvent {
+        let mut retracted: Vec<&Block> = Vec::new();
+        let mut applied: Vec<&Block> = Vec::new();
+        // Step down the higher branch until both reach the common ancestor
+        let common_ancestor = {
+            let mut old = self.ancestry(self.head).peekable();
+            let mut new = self.ancestry(tip).peekable();
+            loop {
+                match (old.peek(), new.peek()) {
+                    (Some(a), Some(b)) if a.hash == b.hash => break a.id as u64,
+                    (Some(a), Some(b)) if a.id >= b.id => retracted.push(old.next().unwrap()),
+                    (_, Some(_)) => applied.push(new.next().unwrap()),
+                    // Every block descends from genesis, so branches always meet
+                    _ => unreachable!("branches without a common ancestor"),
+                }
+            }
+        };
+        retracted.reverse();
+        applied.reverse();
+
+        let retracted_txs: Vec<SignedTx> = retracted
+            .iter()
+            .flat_map(|block| block.txs.iter().cloned())
+            .collect();
+        pool.restore(&retracted_txs);
+        for block in &applied {
+            pool.remove(&block.txs);
+        }
+        info!(
+            "Reorg at block {}: {} blocks retracted, {} applied",
+            common_ancestor,
+            retracted.len(),
+            applied.len()
+        );
+        let event = ForkEvent::Reorg {
+            common_ancestor,
+            retracted: retracted.iter().map(|block| block.header()).collect(),
+            applied: applied.iter().map(|block| block.header()).collect(),
+        };
+        self.head = tip;
+        event
+    }
+}
+
+// Weight of the chain of `block` on a parent chain weighing `parent_weight`
+fn chain_weight(parent_weight: u128, block: &Block) -> u128 {
+    parent_weight
+        + block
+            .certificate
+            .as_ref()
+            .map_or(0, |cert| cert.signed_weight as u128)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::block::BlockBuilder;
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::mempool::{Mempool, PoolConfig};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::signer::Signer;
+    use crate::tx::{Payment, UnsignedTx};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_fork_choice() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let alice = Account {
+            address: wallet.public_key_hex(),
+        };
+        let proposer = Account {
+            address: "proposer".to_string(),
+        };
+        let params = Params {
+            msg: b"block".to_vec(),
+            proven_weight: 5,
+            ..Default::default()
+        };
+        let participants = vec![Participant::from_signer(&wallet, 10)];
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+        builder
+            .add_signature(0, wallet.sign_message(&params.signing_message()))
+            .unwrap();
+        let cert = builder.build().unwrap();
+
+        let mut state = ChainState::new(params.hashing());
+        state.credit(&alice, 100).unwrap();
+        // Child of `parent` applying `txs` to `state`
+        let block = |parent: &Block, seed: u8, state: &ChainState, txs: Vec<SignedTx>| {
+            let root = state.clone().apply_txs(&txs, &proposer).unwrap();
+            BlockBuilder::new(
+                Some(parent),
+                seed as usize,
+                proposer.clone(),
+                String::new(),
+                Seed { seed: [seed; 32] },
+            )
+            .with_txs(txs)
+            .with_state_root(root)
+        };
+        let genesis = BlockBuilder::new(
+            None,
+            0,
+            proposer.clone(),
+            String::new(),
+            Seed { seed: [0u8; 32] },
+        )
+        .with_state_root(state.root())
+        .build(&mut Mempool::new())
+        .unwrap();
+        let mut forks = ForkChoice::new(genesis.clone(), state.clone());
+        let mut pool = TxPool::new(PoolConfig::default());
+        let payment = UnsignedTx::new(
+            &wallet,
+            0,
+            1,
+            Payment {
+                recipient: proposer.clone(),
+                amount: 30,
+            },
+        )
+        .sign(&wallet)
+        .unwrap();
+        pool.add(payment.clone()).unwrap();
+
+        // An uncertified block with the payment extends the head
+        let a = block(&genesis, 1, &state, vec![payment.clone()])
+            .build(&mut Mempool::new())
+            .unwrap();
+        let event = forks.add_block(a.clone(), &mut pool).unwrap();
+        assert_eq!(event, Some(ForkEvent::NewHead { header: a.header() }));
+        assert!(pool.is_empty());
+        assert_eq!(forks.state().account(&alice).nonce, 1);
+
+        // A certified sibling is heavier: the payment returns to the pool
+        let b = block(&genesis, 2, &state, Vec::new())
+            .with_certificate(cert)
+            .build(&mut Mempool::new())
+            .unwrap();
+        let event = forks.add_block(b.clone(), &mut pool).unwrap();
+        assert_eq!(
+            event,
+            Some(ForkEvent::Reorg {
+                common_ancestor: 1,
+                retracted: vec![a.header()],
+                applied: vec![b.header()],
+            })
+        );
+        assert_eq!(forks.head().hash, b.hash);
+        assert_eq!(forks.weight(&b.hash), Some(10));
+        assert!(pool.contains(&payment.hash().unwrap()));
+        assert_eq!(forks.state().account(&alice).nonce, 0);
+        let canonical: Vec<[u8; 32]> = forks.canonical().iter().map(|b| b.hash).collect();
+        assert_eq!(canonical, vec![genesis.hash, b.hash]);
+
+        // Extending the lighter branch doesn't move the head
+        let c = block(&a, 3, &forks.blocks[&a.hash].state, Vec::new())
+            .build(&mut Mempool::new())
+            .unwrap();
+        assert_eq!(forks.add_block(c, &mut pool).unwrap(), None);
+        assert_eq!(forks.head().hash, b.hash);
+
+        // Blocks of unknown parents or with a wrong state root are rejected
+        let unknown = block(&b, 4, &state, Vec::new())
+            .build(&mut Mempool::new())
+            .unwrap();
+        let orphan = block(&unknown, 5, &state, Vec::new())
+            .build(&mut Mempool::new())
+            .unwrap();
+        assert!(forks.add_block(orphan, &mut pool).is_err());
+        let wrong = block(&b, 6, &state, Vec::new())
+            .with_state_root([1u8; 32])
+            .build(&mut Mempool::new())
+            .unwrap();
+        assert!(forks.add_block(wrong, &mut pool).is_err());
+    }
+}
@@ -1,5 +1,26 @@
+//! Genesis of the chain. `GenesisFile` is the schema of `genesis.json`: the
+//! chain ID, epoch length, certificate params preset, the validators of epoch
+//! 0 with their weights and signature schemes, the fee market config, and the
+//! initial balances and stake of accounts, optionally with the state root they
+//! must produce.
+//! `GenesisFile::load` reads and checks it, and `GenesisFile::state` turns it
+//! into the `GenesisState` every node starts from: the participants and party
+//! tree root of the genesis validators, the initial `ChainState`, and the
+//! genesis `Epoch` light clients trust.
+use crate::accounts::Account;
+use crate::ccok::{KeyLayout, Params, Participant, SecurityLevel};
+use crate::config::{EPOCH_DURATION, STATE_PROOF_INTERVAL};
+use crate::fees::FeeConfig;
+use crate::handoff::Epoch;
+use crate::lightclient::Client;
+use crate::nodeconfig::{proven_weight, DEFAULT_PROVEN_WEIGHT_FRACTION};
+use crate::scheme::{lookup_scheme, SchemeId};
+use crate::state::ChainState;
+use crate::stateproof::voters_commitment;
 use crate::transaction::Transaction;
 use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::path::Path;
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
 pub struct Genesis {
@@ -12,10 +33,203 @@ impl Genesis {
     }
 }
 
+fn default_epoch_length() -> u64 {
+    EPOCH_DURATION
+}
+
+fn default_proven_weight_fraction() -> f64 {
+    DEFAULT_PROVEN_WEIGHT_FRACTION
+}
+
+/// Validator of the genesis epoch
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct GenesisValidator {
+    /// Public key in hex
+    pub public_key: String,
+    pub weight: u64,
+    /// Registry identifier of the key's signature scheme
+    #[serde(default)]
+    pub scheme: SchemeId,
+}
+
+/// Account funded at genesis
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct GenesisAccount {
+    pub address: String,
+    #[serde(default)]
+    pub balance: u64,
+    /// Balance locked as validator stake
+    #[serde(default)]
+    pub stake: u64,
+}
+
+/// Schema of `genesis.json`
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct GenesisFile {
+    pub chain_id: u64,
+    /// Blocks per epoch
+    #[serde(default = "default_epoch_length")]
+    pub epoch_length: u64,
+    /// Preset of the certificate params
+    pub security_level: SecurityLevel,
+    /// Fraction of the validator weight certificates prove
+    #[serde(default = "default_proven_weight_fraction")]
+    pub proven_weight_fraction: f64,
+    pub validators: Vec<GenesisValidator>,
+    /// Base fee market, none by default
+    #[serde(default)]
+    pub fees: FeeConfig,
+    #[serde(default)]
+    pub accounts: Vec<GenesisAccount>,
+    /// Hex state root the accounts must produce, checked when set
+    #[serde(default)]
+    pub state_root: Option<String>,
+}
+
+/// State every node starts the chain from
+#[derive(Debug, Clone)]
+pub struct GenesisState {
+    pub chain_id: u64,
+    pub epoch_length: u64,
+    /// Certificate params of the genesis validators, with an empty message
+    pub params: Params,
+    /// Genesis validators in party tree order
+    pub participants: Vec<Participant>,
+    pub party_tree_root: Vec<u8>,
+    pub state: ChainState,
+    /// Epoch 0, the trust anchor of light clients
+    pub epoch: Epoch,
+}
+
+impl GenesisFile {
+    /// Read and check the genesis file at `path`
+    pub fn load(path: impl AsRef<Path>) -> Result<Self, String> {
+        let path = path.as_ref();
+        let text = std::fs::read_to_string(path)
+            .map_err(|e| format!("Failed to read genesis {}: {}", path.display(), e))?;
+        let genesis: Self =
+            serde_json::from_str(&text).map_err(|e| format!("Invalid genesis: {}", e))?;
+        genesis.validate()?;
+        Ok(genesis)
+    }
+
+    /// Check the fields on their own: a positive epoch length, a fraction in
+    /// (0, 1], validators with distinct hex keys of registered schemes and
+    /// positive weights, and a valid fee config
+    pub fn validate(&self) -> Result<(), String> {
+        if self.epoch_length == 0 {
+            return Err("Genesis epoch_length must be positive".to_string());
+        }
+        if !(self.proven_weight_fraction > 0.0 && self.proven_weight_fraction <= 1.0) {
+            return Err(format!(
+                "Genesis proven_weight_fraction {} must be in (0, 1]",
+                self.proven_weight_fraction
+            ));
+        }
+        if self.validators.is_empty() {
+            return Err("Genesis has no validators".to_string());
+        }
+        let mut keys = HashSet::new();
+        for validator in &self.validators {
+            let key = validator.public_key.to_ascii_lowercase();
+            hex::decode(&key)
+                .map_err(|e| format!("Invalid validator key {}: {}", validator.public_key, e))?;
+            lookup_scheme(validator.scheme)?;
+            if validator.weight == 0 {
+                return Err(format!("Validator {} has no weight", validator.public_key));
+            }
+            if !keys.insert(key) {
+                return Err(format!("Validator {} listed twice", validator.public_key));
+            }
+        }
+        self.fees
+            .validate()
+            .map_err(|e| format!("Invalid genesis fees: {}", e))
+    }
+
+    /// Genesis state of the file, failing if its accounts don't produce
+    /// `state_root`
+    pub fn state(&self) -> Result<GenesisState, String> {
+        self.validate()?;
+        let participants: Vec<Participant> = self
+            .validators
+            .iter()
+            .map(|validator| Participant {
+                public_key: validator.public_key.to_ascii_lowercase(),
+                weight: validator.weight,
+                scheme: validator.scheme,
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            })
+            .collect();
+        let total_weight = participants
+            .iter()
+            .try_fold(0u64, |total, party| total.checked_add(party.weight))
+            .ok_or_else(|| "Genesis validator weight overflows".to_string())?;
+        let params = Params::preset(
+            self.security_level,
+            Vec::new(),
+            proven_weight(total_weight, self.proven_weight_fraction),
+        );
+        params.validate()?;
+        let hashing = params.hashing();
+        let party_tree_root = voters_commitment(hashing, &participants)?;
+
+        let mut state = ChainState::new(hashing).with_fees(self.fees)?;
+        for account in &self.accounts {
+            let address = Account {
+                address: account.address.clone(),
+            };
+            state.credit(&address, account.balance)?;
+            state.bond(&address, account.stake)?;
+        }
+        if let Some(expected) = &self.state_root {
+            let root = hex::encode(state.root());
+            if !root.eq_ignore_ascii_case(expected) {
+                return Err(format!(
+                    "Genesis state root {} does not match {}",
+                    root, expected
+                ));
+            }
+        }
+        Ok(GenesisState {
+            chain_id: self.chain_id,
+            epoch_length: self.epoch_length,
+            params,
+            epoch: Epoch {
+                number: 0,
+                voters_commitment: party_tree_root.clone(),
+                total_weight,
+            },
+            participants,
+            party_tree_root,
+            state,
+        })
+    }
+}
+
+impl GenesisState {
+    /// Light client trusting the genesis validators, following state proofs
+    /// and epoch handoffs from epoch 0
+    pub fn light_client(&self) -> Result<Client, String> {
+        Ok(Client::new(
+            self.params.clone(),
+            STATE_PROOF_INTERVAL,
+            self.party_tree_root.clone(),
+        )
+        .with_epoch(self.epoch.clone())?)
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
     use crate::accounts::Account;
+    use crate::signer::Signer;
     use crate::transaction::TransactionType;
     use crate::wallet::Wallet;
 
@@ -61,4 +275,72 @@ mod tests {
         );
         assert_eq!(deserialized.stake_txn.txn_type, genesis.stake_txn.txn_type);
     }
+
+    #[test]
+    fn test_genesis_file() {
+        let wallets: Vec<Wallet> = (0..3).map(|_| Wallet::new().unwrap()).collect();
+        let validators: Vec<serde_json::Value> = wallets
+            .iter()
+            .enumerate()
+            .map(|(i, wallet)| {
+                serde_json::json!({
+                    "public_key": wallet.public_key_hex(),
+                    "weight": 10 * (i + 1),
+                    "scheme": wallet.scheme(),
+                })
+            })
+            .collect();
+        let mut json = serde_json::json!({
+            "chain_id": 7,
+            "epoch_length": 20,
+            "security_level": "Security128",
+            "validators": validators,
+            "accounts": [{ "address": "alice", "balance": 500, "stake": 100 }],
+        });
+        let path = std::env::temp_dir().join(format!("genesis-{}.json", std::process::id()));
+        std::fs::write(&path, json.to_string()).unwrap();
+        let genesis = GenesisFile::load(&path).unwrap();
+        let state = genesis.state().unwrap();
+        assert_eq!(state.epoch.total_weight, 60);
+        assert_eq!(state.params.proven_weight, 40);
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .enumerate()
+            .map(|(i, wallet)| Participant::from_signer(wallet, 10 * (i as u64 + 1)))
+            .collect();
+        assert_eq!(
+            state.party_tree_root,
+            voters_commitment(state.params.hashing(), &participants).unwrap()
+        );
+        let alice = Account {
+            address: "alice".to_string(),
+        };
+        assert_eq!(state.state.account(&alice).stake, 100);
+        assert_eq!(state.state.fees(), &FeeConfig::default());
+        let client = state.light_client().unwrap();
+        assert_eq!(client.epoch(), Some(&state.epoch));
+
+        // The state root is checked when given
+        json["state_root"] = hex::encode(state.state.root()).into();
+        let genesis: GenesisFile = serde_json::from_value(json.clone()).unwrap();
+        assert!(genesis.state().is_ok());
+        json["state_root"] = hex::encode([0u8; 32]).into();
+        let genesis: GenesisFile = serde_json::from_value(json.clone()).unwrap();
+        assert!(genesis.state().is_err());
+
+        // The fee config is checked, and sets the initial base fee
+        json.as_object_mut().unwrap().remove("state_root");
+        json["fees"] = serde_json::json!({ "initial_base_fee": 5, "min_base_fee": 9 });
+        let genesis: GenesisFile = serde_json::from_value(json.clone()).unwrap();
+        assert!(genesis.validate().is_err());
+        json["fees"]["min_base_fee"] = 1.into();
+        let genesis: GenesisFile = serde_json::from_value(json.clone()).unwrap();
+        assert_eq!(genesis.state().unwrap().state.base_fee(), 5);
+        json.as_object_mut().unwrap().remove("fees");
+
+        json["validators"][1]["weight"] = 0.into();
+        std::fs::write(&path, json.to_string()).unwrap();
+        assert!(GenesisFile::load(&path).is_err());
+        std::fs::remove_file(&path).unwrap();
+    }
 }
@@ -0,0 +1,299 @@
+//! Signed gossip between validators and certificate builders. Gossipsub
+//! authenticates the peer that published a message with its libp2p key, which
+//! says nothing about the validator it speaks for and is lost once another
+//! peer relays it. A `GossipMessage` is therefore also signed with the
+//! sender's post-quantum `Signer`, so blocks, consensus votes and certificate
+//! signature shares can be attributed to a participant whichever peer
+//! delivered them. A `GossipFilter` drops duplicates and messages of senders
+//! outside the participant set before they reach the node.
+use crate::block::Block;
+use crate::ccok::{Certificate, Params, Participant};
+use crate::consensus::ConsensusMessage;
+use crate::merkle::HashDomain;
+use crate::scheme::{verify_signature, SchemeId};
+use crate::signer::Signer;
+use crate::tx::SignedTx;
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Sha3_256};
+use std::collections::{HashSet, VecDeque};
+
+// Prefix of encoded gossip messages, telling them apart from the JSON and
+// bincode messages exchanged on the older topics
+const MAGIC: &[u8; 4] = b"NPGM";
+
+/// Gossipsub topic a message is published on
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum GossipTopic {
+    Blocks,
+    Transactions,
+    Consensus,
+    Signatures,
+}
+
+impl GossipTopic {
+    pub const ALL: [GossipTopic; 4] = [
+        GossipTopic::Blocks,
+        GossipTopic::Transactions,
+        GossipTopic::Consensus,
+        GossipTopic::Signatures,
+    ];
+
+    /// Gossipsub topic name
+    pub fn name(&self) -> &'static str {
+        match self {
+            GossipTopic::Blocks => "signed_blocks",
+            GossipTopic::Transactions => "signed_transactions",
+            GossipTopic::Consensus => "consensus",
+            GossipTopic::Signatures => "cert_signatures",
+        }
+    }
+}
+
+/// Signature of a participant over certificate params, sent to the builder
+/// coordinator
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SignatureShare {
+    /// Message of the certificate params signed
+    #[serde(with = "serde_bytes")]
+    pub msg: Vec<u8>,
+    /// Position of the signer among the participants
+    pub position: usize,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+/// Certificate a coordinator built and is publishing, announced to the other
+/// coordinators building it, which verify it before holding back
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CertificateCandidate {
+    /// Message of the certificate params
+    #[serde(with = "serde_bytes")]
+    pub msg: Vec<u8>,
+    pub certificate: Certificate,
+}
+
+/// Coordinator request for signatures over certificate params
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SignatureRequest {
+    pub params: Params,
+    /// Positions asked to sign, every participant when empty
+    pub positions: Vec<usize>,
+}
+
+impl SignatureRequest {
+    /// Whether the participant at `position` is asked to sign
+    pub fn is_for(&self, position: usize) -> bool {
+        self.positions.is_empty() || self.positions.contains(&position)
+    }
+
+    /// Answer of the participant at `position`, signing with `signer`
+    pub fn respond(&self, position: usize, signer: &dyn Signer) -> SignatureShare {
+        SignatureShare {
+            msg: self.params.msg.clone(),
+            position,
+            signature: signer.sign_certificate(&self.params),
+        }
+    }
+}
+
+/// Content of a gossip message
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum GossipPayload {
+    Block(Block),
+    Transaction(SignedTx),
+    Consensus(ConsensusMessage),
+    SignatureRequest(SignatureRequest),
+    Signature(SignatureShare),
+    /// Shares a coordinator collected, relayed to the other coordinators
+    Shares(Vec<SignatureShare>),
+    Candidate(CertificateCandidate),
+}
+
+impl GossipPayload {
+    /// Topic the payload is published on
+    pub fn topic(&self) -> GossipTopic {
+        match self {
+            GossipPayload::Block(_) => GossipTopic::Blocks,
+            GossipPayload::Transaction(_) => GossipTopic::Transactions,
+            GossipPayload::Consensus(_) => GossipTopic::Consensus,
+            GossipPayload::SignatureRequest(_)
+            | GossipPayload::Signature(_)
+            | GossipPayload::Shares(_)
+            | GossipPayload::Candidate(_) => GossipTopic::Signatures,
+        }
+    }
+}
+
+/// Gossip payload signed by its sender
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct GossipMessage {
+    /// Public key of the sender in hex
+    pub sender: String,
+    pub scheme: SchemeId,
+    /// Counter of the sender's messages, so repeated payloads get new ids
+    pub sequence: u64,
+    pub payload: GossipPayload,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+impl GossipMessage {
+    /// Message of `payload` signed by `signer`
+    pub fn new(signer: &dyn Signer, sequence: u64, payload: GossipPayload) -> Result<Self, String> {
+        let mut message = Self {
+            sender: signer.public_key_hex(),
+            scheme: signer.scheme(),
+            sequence,
+            payload,
+            signature: Vec::new(),
+        };
+        message.signature = signer.sign(&message.signing_bytes()?);
+        Ok(message)
+    }
+
+    /// Bytes the sender signs
+    pub fn signing_bytes(&self) -> Result<Vec<u8>, String> {
+        let fields = (&self.sender, self.scheme, self.sequence, &self.payload);
+        let encoded =
+            bincode::serialize(&fields).map_err(|e| format!("Serialization error: {}", e))?;
+        Ok(HashDomain::Message.tagged(&encoded))
+    }
+
+    /// Message id, the hash of the signed bytes
+    pub fn id(&self) -> Result<[u8; 32], String> {
+        Ok(Sha3_256::digest(self.signing_bytes()?).into())
+    }
+
+    /// Topic the message is published on
+    pub fn topic(&self) -> GossipTopic {
+        self.payload.topic()
+    }
+
+    /// Check the sender's signature
+    pub fn verify(&self) -> Result<(), String> {
+        let public_key =
+            hex::decode(&self.sender).map_err(|e| format!("Invalid sender public key: {}", e))?;
+        if !verify_signature(
+            self.scheme,
+            &public_key,
+            &self.signing_bytes()?,
+            &self.signature,
+        )? {
+            return Err("Invalid gossip message signature".to_string());
+        }
+        Ok(())
+    }
+
+    /// Bytes published on the network
+    pub fn encode(&self) -> Result<Vec<u8>, String> {
+        let body = bincode::serialize(self).map_err(|e| format!("Serialization error: {}", e))?;
+        let mut bytes = MAGIC.to_vec();
+        bytes.extend_from_slice(&body);
+        Ok(bytes)
+    }
+
+    /// Decode published bytes, failing for anything not encoded by `encode`
+    pub fn decode(bytes: &[u8]) -> Result<Self, String> {
+        let body = bytes
+            .strip_prefix(MAGIC)
+            .ok_or_else(|| "Not a gossip message".to_string())?;
+        bincode::deserialize(body).map_err(|e| format!("Deserialization error: {}", e))
+    }
+}
+
+/// Admits each valid gossip message once
+#[derive(Debug, Clone)]
+pub struct GossipFilter {
+    /// Public keys allowed to send, any sender when `None`
+    senders: Option<HashSet<String>>,
+    /// Ids of the messages seen, oldest first
+    seen: VecDeque<[u8; 32]>,
+    seen_ids: HashSet<[u8; 32]>,
+    capacity: usize,
+}
+
+impl GossipFilter {
+    /// Filter remembering the last `capacity` message ids
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            senders: None,
+            seen: VecDeque::new(),
+            seen_ids: HashSet::new(),
+            capacity,
+        }
+    }
+
+    /// Only admit messages of `participants`
+    pub fn with_senders(mut self, participants: &[Participant]) -> Self {
+        self.senders = Some(participants.iter().map(|p| p.public_key.clone()).collect());
+        self
+    }
+
+    /// Whether `message` is new; fails for invalid messages and unknown
+    /// senders
+    pub fn accept(&mut self, message: &GossipMessage) -> Result<bool, String> {
+        if let Some(senders) = &self.senders {
+            if !senders.contains(&message.sender) {
+                return Err(format!("Unknown gossip sender {}", message.sender));
+            }
+        }
+        let id = message.id()?;
+        if self.seen_ids.contains(&id) {
+            return Ok(false);
+        }
+        message.verify()?;
+        self.seen_ids.insert(id);
+        self.seen.push_back(id);
+        while self.seen.len() > self.capacity {
+            if let Some(oldest) = self.seen.pop_front() {
+                self.seen_ids.remove(&oldest);
+            }
+        }
+        Ok(true)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_gossip_filter() {
+        let validator = Wallet::new().expect("Failed to create wallet");
+        let outsider = Wallet::new().expect("Failed to create wallet");
+        let share = |position| {
+            GossipPayload::Signature(SignatureShare {
+                msg: b"block 7".to_vec(),
+                position,
+                signature: vec![1, 2, 3],
+            })
+        };
+        let message = GossipMessage::new(&validator, 0, share(0)).unwrap();
+        assert_eq!(message.topic(), GossipTopic::Signatures);
+
+        // Messages survive the network and are admitted once
+        let received = GossipMessage::decode(&message.encode().unwrap()).unwrap();
+        assert_eq!(received.id().unwrap(), message.id().unwrap());
+        let mut filter =
+            GossipFilter::new(2).with_senders(&[Participant::from_signer(&validator, 1)]);
+        assert!(filter.accept(&received).unwrap());
+        assert!(!filter.accept(&received).unwrap());
+        assert!(GossipMessage::decode(b"{\"json\": true}").is_err());
+
+        // Forged and foreign messages are rejected
+        let mut forged = message.clone();
+        forged.payload = share(1);
+        assert!(filter.accept(&forged).is_err());
+        let foreign = GossipMessage::new(&outsider, 0, share(1)).unwrap();
+        assert!(GossipFilter::new(2).accept(&foreign).unwrap());
+        assert!(filter.accept(&foreign).is_err());
+
+        // Only the last ids are remembered
+        for sequence in 1..=2 {
+            let next = GossipMessage::new(&validator, sequence, share(0)).unwrap();
+            assert!(filter.accept(&next).unwrap());
+        }
+        assert!(filter.accept(&message).unwrap());
+    }
+}
@@ -0,0 +1,528 @@
+//! Governance. A `Proposal` changes a certificate param, freezes the validator
+//! set or pauses the bridge, and is enacted only once the validators of the
+//! current epoch certified its hash with two thirds of their weight, as for an
+//! epoch handoff. The `GovernanceCert` reaches the sidechain in a
+//! `GovernanceTx`, and the main chain vault checks it with a light client, so
+//! a certified pause stops bridge releases too. Proposals are numbered and
+//! enacted in order, each at most once.
+use crate::block::Block;
+use crate::ccok::{Certificate, Params, Purpose, Verifier};
+use crate::error::CcokError;
+use crate::handoff::Epoch;
+use crate::merkle::HashDomain;
+use crate::tx::{SignedTx, TxBody};
+use crate::validatorset::ValidatorSet;
+use log::warn;
+use serde::{Deserialize, Serialize};
+
+/// Certificate param a proposal can change
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum GovernedParam {
+    SecurityParam,
+    CompressionLevel,
+    WeightPrecision,
+}
+
+/// What a proposal enacts
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub enum ProposalAction {
+    /// Set a param of the certificate template
+    ParamChange { param: GovernedParam, value: u64 },
+    /// Freeze the validator set, ignoring registrations, or unfreeze it
+    FreezeValidators(bool),
+    /// Pause the bridge vault's releases, or resume them
+    PauseBridge(bool),
+}
+
+/// Numbered governance proposal
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Proposal {
+    pub id: u64,
+    pub action: ProposalAction,
+}
+
+impl Proposal {
+    /// Digest of the proposal under the hash of `template`
+    pub fn hash(&self, template: &Params) -> Result<[u8; 32], CcokError> {
+        let bytes = bincode::serialize(self)?;
+        Ok(template.hashing().hash(HashDomain::Message, &bytes))
+    }
+
+    /// Certificate params of the proposal: `template` with the proposal hash
+    /// as message and the proven weight of `epoch`, for the governance
+    /// purpose if the template is bound to a chain
+    pub fn params(&self, template: &Params, epoch: &Epoch) -> Result<Params, CcokError> {
+        let mut params = template.clone();
+        params.msg = self.hash(template)?.to_vec();
+        params.proven_weight = epoch.proven_weight();
+        if params.chain_id.is_some() {
+            params.purpose = Some(Purpose::Governance);
+        }
+        Ok(params)
+    }
+
+    /// `template` with the param change of the proposal, if it is one. The
+    /// change must leave valid params for the certificates of `epoch`.
+    pub fn apply(&self, template: &Params, epoch: &Epoch) -> Result<Params, CcokError> {
+        let ProposalAction::ParamChange { param, value } = self.action else {
+            return Ok(template.clone());
+        };
+        let out_of_range = || {
+            CcokError::InvalidGovernance(format!(
+                "proposal {} sets {:?} to {}, out of range",
+                self.id, param, value
+            ))
+        };
+        let mut params = template.clone();
+        match param {
+            GovernedParam::SecurityParam => {
+                params.security_param = value.try_into().map_err(|_| out_of_range())?
+            }
+            GovernedParam::CompressionLevel => {
+                params.compression_level = value.try_into().map_err(|_| out_of_range())?
+            }
+            GovernedParam::WeightPrecision => {
+                params.weight_precision = value.try_into().map_err(|_| out_of_range())?
+            }
+        }
+        self.params(&params, epoch)?.validate()?;
+        Ok(params)
+    }
+}
+
+/// Certificate of the validators of an epoch over a proposal
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct GovernanceCert {
+    pub proposal: Proposal,
+    pub certificate: Certificate,
+}
+
+impl GovernanceCert {
+    /// Check that the validators of `trusted` certified the proposal
+    pub fn verify(&self, trusted: &Epoch, template: &Params) -> Result<(), CcokError> {
+        let params = self.proposal.params(template, trusted)?;
+        if !Verifier::new(trusted.voters_commitment.clone()).verify(&self.certificate, &params)? {
+            return Err(CcokError::InvalidGovernance(format!(
+                "certificate of proposal {} does not verify for epoch {}",
+                self.proposal.id, trusted.number
+            )));
+        }
+        Ok(())
+    }
+}
+
+/// State of the enacted proposals
+#[derive(Debug, Clone)]
+pub struct Governance {
+    /// Params of the certificates, apart from their message and proven weight
+    pub template: Params,
+    pub validators_frozen: bool,
+    pub bridge_paused: bool,
+    /// Id the next proposal enacted must have at least
+    pub next_proposal: u64,
+}
+
+impl Governance {
+    /// Nothing enacted yet, certificates under `template`
+    pub fn new(template: Params) -> Self {
+        Self {
+            template,
+            validators_frozen: false,
+            bridge_paused: false,
+            next_proposal: 0,
+        }
+    }
+
+    /// Enact the proposal of `cert`, certified by the validators of `epoch`
+    pub fn enact(&mut self, cert: &GovernanceCert, epoch: &Epoch) -> Result<(), CcokError> {
+        let proposal = &cert.proposal;
+        if proposal.id < self.next_proposal {
+            return Err(CcokError::InvalidGovernance(format!(
+                "proposal {} already enacted or superseded",
+                proposal.id
+            )));
+        }
+        cert.verify(epoch, &self.template)?;
+        let template = proposal.apply(&self.template, epoch)?;
+        match proposal.action {
+            ProposalAction::ParamChange { .. } => self.template = template,
+            ProposalAction::FreezeValidators(frozen) => self.validators_frozen = frozen,
+            ProposalAction::PauseBridge(paused) => self.bridge_paused = paused,
+        }
+        self.next_proposal = proposal.id + 1;
+        Ok(())
+    }
+
+    /// Enact the proposal of a verified governance transaction, certified by
+    /// the validators of `epoch`, freezing `validators` if it says so;
+    /// returns whether it was one
+    pub fn apply_tx(
+        &mut self,
+        tx: &SignedTx,
+        epoch: &Epoch,
+        validators: &mut ValidatorSet,
+    ) -> Result<bool, String> {
+        let TxBody::Governance(governance) = &tx.tx.body else {
+            return Ok(false);
+        };
+        self.enact(&governance.cert()?, epoch)?;
+        validators.set_frozen(self.validators_frozen);
+        Ok(true)
+    }
+
+    /// Enact the proposals of a block applied to the state, before
+    /// `ValidatorSet::apply_block` so a freeze covers the registrations of
+    /// its block; returns how many it enacted. The state only checks that a
+    /// governance transaction decodes, so one with a forged, stale or
+    /// replayed certificate is skipped, leaving the block valid.
+    pub fn apply_block(
+        &mut self,
+        block: &Block,
+        epoch: &Epoch,
+        validators: &mut ValidatorSet,
+    ) -> usize {
+        let mut enacted = 0;
+        for (i, tx) in block.txs.iter().enumerate() {
+            match self.apply_tx(tx, epoch, validators) {
+                Ok(true) => enacted += 1,
+                Ok(false) => {}
+                Err(e) => warn!(
+                    "Skipping governance transaction {} of block {}: {}",
+                    i, block.id, e
+                ),
+            }
+        }
+        enacted
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::bridge::{withdrawal_params, Vault, Withdrawal, WithdrawalBatch};
+    use crate::ccok::{Builder, Participant};
+    use crate::lightclient::Client;
+    use crate::signer::Signer;
+    use crate::stateproof::voters_commitment;
+    use crate::tx::{GovernanceTx, Payment, UnsignedTx};
+    use crate::utils::Seed;
+    use crate::validatorset::ValidatorConfig;
+    use crate::wallet::Wallet;
+
+    // Three validators of weight 10 and their epoch
+    fn setup() -> (Vec<Wallet>, Vec<Participant>, Epoch) {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let voters: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let epoch = Epoch {
+            number: 0,
+            voters_commitment: voters_commitment(Params::default().hashing(), &voters).unwrap(),
+            total_weight: 30,
+        };
+        (wallets, voters, epoch)
+    }
+
+    // Certificate of every validator of `epoch` over `proposal`
+    fn certify(
+        wallets: &[Wallet],
+        voters: &[Participant],
+        epoch: &Epoch,
+        template: &Params,
+        id: u64,
+        action: ProposalAction,
+    ) -> GovernanceCert {
+        let proposal = Proposal { id, action };
+        let params = proposal.params(template, epoch).unwrap();
+        let mut builder = Builder::new(
+            params.clone(),
+            voters.to_vec(),
+            epoch.voters_commitment.clone(),
+        )
+        .unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_certificate(&params))
+                .unwrap();
+        }
+        GovernanceCert {
+            proposal,
+            certificate: builder.build().unwrap(),
+        }
+    }
+
+    fn governance_tx(wallet: &Wallet, nonce: u64, cert: &GovernanceCert) -> SignedTx {
+        UnsignedTx::new(wallet, nonce, 0, GovernanceTx::new(cert).unwrap())
+            .sign(wallet)
+            .unwrap()
+    }
+
+    fn block(txs: Vec<SignedTx>) -> Block {
+        let mut block = Block::new(
+            1,
+            [0u8; 32],
+            0,
+            vec![],
+            Account {
+                address: "proposer".to_string(),
+            },
+            String::new(),
+            Seed { seed: [0u8; 32] },
+            None,
+        )
+        .unwrap();
+        block.txs = txs;
+        block
+    }
+
+    #[test]
+    fn test_governance() {
+        let template = Params::default();
+        let (wallets, voters, epoch) = setup();
+
+        // A certified pause is enacted
+        let pause = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            0,
+            ProposalAction::PauseBridge(true),
+        );
+        let mut governance = Governance::new(template.clone());
+        governance.enact(&pause, &epoch).unwrap();
+        assert!(governance.bridge_paused);
+        assert_eq!(governance.next_proposal, 1);
+
+        // A param change updates the template, carried in a transaction
+        let change = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            1,
+            ProposalAction::ParamChange {
+                param: GovernedParam::SecurityParam,
+                value: 256,
+            },
+        );
+        let tx = governance_tx(&wallets[0], 0, &change);
+        tx.tx.body.check().unwrap();
+        let mut validators = ValidatorSet::new(ValidatorConfig::default());
+        assert!(governance.apply_tx(&tx, &epoch, &mut validators).unwrap());
+        assert_eq!(governance.template.security_param, 256);
+        assert!(!validators.is_frozen());
+
+        // A freeze in a block freezes the validator set, under the changed
+        // template
+        let freeze = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &governance.template,
+            2,
+            ProposalAction::FreezeValidators(true),
+        );
+        let block = block(vec![governance_tx(&wallets[0], 1, &freeze)]);
+        assert_eq!(governance.apply_block(&block, &epoch, &mut validators), 1);
+        assert!(validators.is_frozen());
+        assert!(governance.validators_frozen);
+        assert_eq!(governance.next_proposal, 3);
+    }
+
+    #[test]
+    fn test_enact_errors() {
+        let template = Params::default();
+        let (wallets, voters, epoch) = setup();
+        let pause = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            1,
+            ProposalAction::PauseBridge(true),
+        );
+        let mut governance = Governance::new(template.clone());
+        governance.enact(&pause, &epoch).unwrap();
+
+        // Replayed and superseded proposals are refused
+        assert!(governance.enact(&pause, &epoch).is_err());
+        let stale = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            0,
+            ProposalAction::PauseBridge(false),
+        );
+        assert!(governance.enact(&stale, &epoch).is_err());
+        assert!(governance.bridge_paused);
+
+        // The certificate covers its proposal only
+        let mut swapped = pause.clone();
+        swapped.proposal = Proposal {
+            id: 2,
+            action: ProposalAction::FreezeValidators(true),
+        };
+        assert!(governance.enact(&swapped, &epoch).is_err());
+
+        // Nor does it pass for another epoch's validators
+        let (_, _, other) = setup();
+        let resume = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            2,
+            ProposalAction::PauseBridge(false),
+        );
+        assert!(governance.enact(&resume, &other).is_err());
+        assert!(governance.bridge_paused);
+        assert_eq!(governance.next_proposal, 2);
+    }
+
+    #[test]
+    fn test_param_change_errors() {
+        let template = Params::default();
+        let (wallets, voters, epoch) = setup();
+        let mut governance = Governance::new(template.clone());
+        let change = |id: u64, param: GovernedParam, value: u64| {
+            certify(
+                &wallets,
+                &voters,
+                &epoch,
+                &template,
+                id,
+                ProposalAction::ParamChange { param, value },
+            )
+        };
+
+        // Values that don't fit the param, or leave invalid params, are
+        // refused without enacting anything
+        for (id, param, value) in [
+            (0, GovernedParam::CompressionLevel, 256),
+            (1, GovernedParam::SecurityParam, u64::MAX),
+            (2, GovernedParam::SecurityParam, 0),
+            (3, GovernedParam::WeightPrecision, 1 << 8),
+        ] {
+            let err = governance
+                .enact(&change(id, param, value), &epoch)
+                .unwrap_err();
+            assert!(matches!(
+                err,
+                CcokError::InvalidGovernance(_) | CcokError::InvalidParams(_)
+            ));
+        }
+        assert_eq!(governance.template.security_param, template.security_param);
+        assert_eq!(governance.next_proposal, 0);
+    }
+
+    #[test]
+    fn test_apply_block_skips_invalid() {
+        let template = Params::default();
+        let (wallets, voters, epoch) = setup();
+        let mut governance = Governance::new(template.clone());
+        let mut validators = ValidatorSet::new(ValidatorConfig::default());
+        let pause = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            0,
+            ProposalAction::PauseBridge(true),
+        );
+        let freeze = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            1,
+            ProposalAction::FreezeValidators(true),
+        );
+        let mut forged = freeze.clone();
+        forged.proposal.action = ProposalAction::FreezeValidators(false);
+
+        // Other transactions aren't governance
+        let payment = UnsignedTx::new(
+            &wallets[0],
+            0,
+            0,
+            Payment {
+                recipient: Account {
+                    address: "bob".to_string(),
+                },
+                amount: 1,
+            },
+        )
+        .sign(&wallets[0])
+        .unwrap();
+        assert!(!governance
+            .apply_tx(&payment, &epoch, &mut validators)
+            .unwrap());
+
+        // A replayed and a forged certificate are skipped, the rest enacted
+        let block = block(vec![
+            governance_tx(&wallets[0], 1, &pause),
+            governance_tx(&wallets[0], 2, &pause),
+            governance_tx(&wallets[0], 3, &forged),
+            payment,
+            governance_tx(&wallets[0], 4, &freeze),
+        ]);
+        assert_eq!(governance.apply_block(&block, &epoch, &mut validators), 2);
+        assert!(governance.bridge_paused);
+        assert!(validators.is_frozen());
+        assert_eq!(governance.next_proposal, 2);
+    }
+
+    #[test]
+    fn test_vault_pause() {
+        let template = Params::default();
+        let (wallets, voters, epoch) = setup();
+        let pause = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            0,
+            ProposalAction::PauseBridge(true),
+        );
+        let freeze = certify(
+            &wallets,
+            &voters,
+            &epoch,
+            &template,
+            1,
+            ProposalAction::FreezeValidators(true),
+        );
+
+        // The vault honors a pause its light client verifies, once, and no
+        // other proposal
+        let client = Client::new(template.clone(), 4, epoch.voters_commitment.clone())
+            .with_epoch(epoch.clone())
+            .unwrap();
+        let mut vault = Vault::new(epoch.clone(), template.clone());
+        assert!(vault.enact(&client, &freeze).is_err());
+        vault.enact(&client, &pause).unwrap();
+        assert!(vault.paused);
+        assert!(vault.enact(&client, &pause).is_err());
+
+        let withdrawal = Withdrawal {
+            nonce: 0,
+            sender: Account {
+                address: wallets[0].public_key_hex(),
+            },
+            recipient: "0xbob".to_string(),
+            amount: 1,
+        };
+        let batch =
+            WithdrawalBatch::new(withdrawal_params(&template, &epoch), vec![withdrawal]).unwrap();
+        let err = vault
+            .release(&pause.certificate, batch.root(), &batch.prove(0).unwrap())
+            .unwrap_err();
+        assert!(err.contains("paused"));
+    }
+}
@@ -0,0 +1,460 @@
+//! gRPC services of `proto/node.proto`, over the servers tonic generates from
+//! it in `build.rs`. `NodeService` serves block headers and state proofs,
+//! with server streams following new ones as the node publishes them, and
+//! `CertService` exposes the signature collection of the certificate builder.
+//! `GrpcServer` implements both over the node's chain and its
+//! `SignatureCollector`; niropokd serves it next to JSON-RPC and WebSocket.
+use crate::block::Block;
+use crate::ccok::{self, Verifier};
+use crate::collector::SignatureCollector;
+use crate::events::{Event, EventStream};
+use crate::gossip;
+use crate::proto::cert_service_server::CertService;
+use crate::proto::node_service_server::NodeService;
+use crate::proto::{
+    BlockHeader, BuildCertRequest, Certificate, HeightRequest, SignatureShare, StateProof,
+    SubmitSignatureResponse, SubscribeRequest, VerifyCertRequest, VerifyCertResponse,
+};
+use crate::rpc::ChainView;
+use crate::stateproof;
+use futures::Stream;
+use std::collections::VecDeque;
+use std::pin::Pin;
+use std::sync::{Arc, Mutex};
+use tokio::sync::broadcast;
+use tonic::{Request, Response, Status};
+
+pub use crate::proto::cert_service_server::CertServiceServer;
+pub use crate::proto::node_service_server::NodeServiceServer;
+
+/// Items a subscriber may fall behind by before missing some
+const STREAM_CAPACITY: usize = 64;
+
+/// Server stream of a subscription call
+pub type ItemStream<M> = Pin<Box<dyn Stream<Item = Result<M, Status>> + Send>>;
+
+/// Item of a server stream, ordered by height
+pub trait Streamed: Clone {
+    fn height(&self) -> u64;
+}
+
+impl Streamed for BlockHeader {
+    fn height(&self) -> u64 {
+        self.height
+    }
+}
+
+impl Streamed for StateProof {
+    fn height(&self) -> u64 {
+        self.message
+            .as_ref()
+            .map_or(0, |message| message.last_block)
+    }
+}
+
+/// Server stream of the items the node had at subscription, followed by the
+/// ones it publishes later
+pub struct Subscription<M: Streamed> {
+    backlog: VecDeque<M>,
+    live: broadcast::Receiver<M>,
+    /// Lowest height still to send
+    next: u64,
+}
+
+impl<M: Streamed> Subscription<M> {
+    // Items below `next` were in the backlog already
+    fn fresh(&mut self, item: M) -> Option<M> {
+        if item.height() < self.next {
+            return None;
+        }
+        self.next = item.height() + 1;
+        Some(item)
+    }
+
+    /// Next item, waiting for the node to publish one; `None` once the
+    /// server shut down
+    pub async fn next(&mut self) -> Option<M> {
+        if let Some(item) = self.backlog.pop_front() {
+            return Some(item);
+        }
+        loop {
+            match self.live.recv().await {
+                Ok(item) => {
+                    if let Some(item) = self.fresh(item) {
+                        return Some(item);
+                    }
+                }
+                Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                Err(broadcast::error::RecvError::Closed) => return None,
+            }
+        }
+    }
+
+    /// Next item if one is pending
+    pub fn try_next(&mut self) -> Option<M> {
+        if let Some(item) = self.backlog.pop_front() {
+            return Some(item);
+        }
+        loop {
+            match self.live.try_recv() {
+                Ok(item) => {
+                    if let Some(item) = self.fresh(item) {
+                        return Some(item);
+                    }
+                }
+                Err(broadcast::error::TryRecvError::Lagged(_)) => continue,
+                Err(_) => return None,
+            }
+        }
+    }
+}
+
+impl<M: Streamed + Send + 'static> Subscription<M> {
+    /// The subscription as a gRPC server stream
+    pub fn into_stream(self) -> ItemStream<M> {
+        Box::pin(futures::stream::unfold(
+            self,
+            |mut subscription| async move {
+                let item = subscription.next().await?;
+                Some((Ok(item), subscription))
+            },
+        ))
+    }
+}
+
+/// Both services over the chain of a node and the certificate it collects
+pub struct GrpcServer<C: ChainView> {
+    chain: Arc<Mutex<C>>,
+    collector: Mutex<Option<SignatureCollector>>,
+    blocks: broadcast::Sender<BlockHeader>,
+    state_proofs: broadcast::Sender<StateProof>,
+}
+
+impl<C: ChainView> GrpcServer<C> {
+    pub fn new(chain: Arc<Mutex<C>>) -> Self {
+        Self {
+            chain,
+            collector: Mutex::new(None),
+            blocks: broadcast::channel(STREAM_CAPACITY).0,
+            state_proofs: broadcast::channel(STREAM_CAPACITY).0,
+        }
+    }
+
+    /// Collect the signatures submitted into `collector`, replacing the
+    /// previous collection
+    pub fn collect(&self, collector: SignatureCollector) {
+        *self.collector.lock().unwrap() = Some(collector);
+    }
+
+    /// Send a block the node executed to the block subscribers
+    pub fn publish_block(&self, block: &Block) {
+        // Nobody may be subscribed
+        let _ = self.blocks.send(BlockHeader::from(block));
+    }
+
+    /// Send a state proof the node built or received to its subscribers
+    pub fn publish_state_proof(&self, proof: &stateproof::StateProof) {
+        let _ = self.state_proofs.send(StateProof::from(proof));
+    }
+
+    /// Publish the blocks and state proofs announced on `events` as the chain
+    /// records them, until the bus is gone
+    pub async fn follow(&self, mut events: EventStream) {
+        while let Some(event) = events.next().await {
+            match event {
+                Event::NewBlock { height, .. } => {
+                    let block = self.chain.lock().unwrap().block(height);
+                    if let Some(block) = block {
+                        self.publish_block(&block);
+                    }
+                }
+                Event::NewStateProof { last_block, .. } => {
+                    let proof = self.chain.lock().unwrap().state_proof(last_block);
+                    if let Some(proof) = proof {
+                        self.publish_state_proof(&proof);
+                    }
+                }
+                _ => {}
+            }
+        }
+    }
+
+    /// Blocks from `from_height` on
+    pub fn block_subscription(&self, from_height: u64) -> Subscription<BlockHeader> {
+        // Subscribe before reading the chain so that no block falls in between
+        let live = self.blocks.subscribe();
+        let chain = self.chain.lock().unwrap();
+        let mut backlog = VecDeque::new();
+        let mut next = from_height;
+        while let Some(block) = chain.block(next) {
+            backlog.push_back(BlockHeader::from(&block));
+            next += 1;
+        }
+        Subscription {
+            backlog,
+            live,
+            next,
+        }
+    }
+
+    /// State proofs of the intervals from the one holding `from_height` on
+    pub fn state_proof_subscription(&self, from_height: u64) -> Subscription<StateProof> {
+        let live = self.state_proofs.subscribe();
+        let chain = self.chain.lock().unwrap();
+        let mut backlog = VecDeque::new();
+        let mut next = from_height;
+        while let Some(proof) = chain.state_proof(next) {
+            next = proof.message.last_block + 1;
+            backlog.push_back(StateProof::from(&proof));
+        }
+        Subscription {
+            backlog,
+            live,
+            next,
+        }
+    }
+}
+
+fn no_collection() -> Status {
+    Status::failed_precondition("No certificate is being collected")
+}
+
+#[tonic::async_trait]
+impl<C: ChainView + Send + 'static> NodeService for GrpcServer<C> {
+    type SubscribeBlocksStream = ItemStream<BlockHeader>;
+    type SubscribeStateProofsStream = ItemStream<StateProof>;
+
+    async fn get_block(
+        &self,
+        request: Request<HeightRequest>,
+    ) -> Result<Response<BlockHeader>, Status> {
+        let height = request.into_inner().height;
+        let block = self.chain.lock().unwrap().block(height);
+        block
+            .map(|block| Response::new(BlockHeader::from(&block)))
+            .ok_or_else(|| Status::not_found(format!("No block at height {}", height)))
+    }
+
+    async fn get_state_proof(
+        &self,
+        request: Request<HeightRequest>,
+    ) -> Result<Response<StateProof>, Status> {
+        let height = request.into_inner().height;
+        let proof = self.chain.lock().unwrap().state_proof(height);
+        proof
+            .map(|proof| Response::new(StateProof::from(&proof)))
+            .ok_or_else(|| Status::not_found(format!("No state proof of block {}", height)))
+    }
+
+    async fn subscribe_blocks(
+        &self,
+        request: Request<SubscribeRequest>,
+    ) -> Result<Response<Self::SubscribeBlocksStream>, Status> {
+        let subscription = self.block_subscription(request.into_inner().from_height);
+        Ok(Response::new(subscription.into_stream()))
+    }
+
+    async fn subscribe_state_proofs(
+        &self,
+        request: Request<SubscribeRequest>,
+    ) -> Result<Response<Self::SubscribeStateProofsStream>, Status> {
+        let subscription = self.state_proof_subscription(request.into_inner().from_height);
+        Ok(Response::new(subscription.into_stream()))
+    }
+}
+
+#[tonic::async_trait]
+impl<C: ChainView + Send + 'static> CertService for GrpcServer<C> {
+    async fn submit_signature(
+        &self,
+        request: Request<SignatureShare>,
+    ) -> Result<Response<SubmitSignatureResponse>, Status> {
+        let share = gossip::SignatureShare::try_from(request.into_inner())
+            .map_err(Status::invalid_argument)?;
+        let mut collector = self.collector.lock().unwrap();
+        let collector = collector.as_mut().ok_or_else(no_collection)?;
+        // The signature authenticates the share, so it counts as sent by the
+        // participant at its position
+        let sender = collector
+            .builder()
+            .participants
+            .get(share.position)
+            .map(|party| party.public_key.clone())
+            .ok_or_else(|| {
+                Status::invalid_argument(format!("No participant at position {}", share.position))
+            })?;
+        let added = collector
+            .add_share(&sender, &share)
+            .map_err(Status::invalid_argument)?;
+        Ok(Response::new(SubmitSignatureResponse {
+            added,
+            signed_weight: collector.builder().signed_weight,
+            ready: collector.is_ready(),
+        }))
+    }
+
+    async fn build_cert(
+        &self,
+        _request: Request<BuildCertRequest>,
+    ) -> Result<Response<Certificate>, Status> {
+        let collector = self.collector.lock().unwrap();
+        let cert = collector
+            .as_ref()
+            .ok_or_else(no_collection)?
+            .build()
+            .map_err(Status::failed_precondition)?;
+        Ok(Response::new(Certificate::from(&cert)))
+    }
+
+    async fn verify_cert(
+        &self,
+        request: Request<VerifyCertRequest>,
+    ) -> Result<Response<VerifyCertResponse>, Status> {
+        let request = request.into_inner();
+        let cert: ccok::Certificate = request
+            .certificate
+            .ok_or_else(|| Status::invalid_argument("Missing certificate"))?
+            .try_into()
+            .map_err(Status::invalid_argument)?;
+        let params: ccok::Params = request
+            .params
+            .ok_or_else(|| Status::invalid_argument("Missing params"))?
+            .try_into()
+            .map_err(Status::invalid_argument)?;
+        let valid = Verifier::new(request.party_tree_root)
+            .verify(&cert, &params)
+            .map_err(|e| Status::invalid_argument(e.to_string()))?;
+        Ok(Response::new(VerifyCertResponse { valid }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::blockchain::Blockchain;
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::events::EventBus;
+    use crate::merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+    use futures::{FutureExt, StreamExt};
+    use tonic::Code;
+
+    #[tokio::test]
+    async fn test_grpc_services() {
+        let node = Wallet::new().expect("Failed to create wallet");
+        let proposer = crate::accounts::Account {
+            address: node.get_public_key().to_string(),
+        };
+        let blockchain = Arc::new(Mutex::new(Blockchain::new(node)));
+        let block = |id| {
+            Block::new(
+                id,
+                [0u8; 32],
+                0,
+                vec![],
+                proposer.clone(),
+                String::new(),
+                Seed {
+                    seed: [id as u8; 32],
+                },
+                None,
+            )
+            .unwrap()
+        };
+        blockchain.lock().unwrap().chain.push(block(1));
+        let server = GrpcServer::new(Arc::clone(&blockchain));
+
+        // Unary calls
+        let header = server
+            .get_block(Request::new(HeightRequest { height: 1 }))
+            .await
+            .unwrap()
+            .into_inner();
+        let parsed = crate::block::BlockHeader::try_from(header).unwrap();
+        assert_eq!(parsed, block(1).header());
+        let missing = server
+            .get_block(Request::new(HeightRequest { height: 2 }))
+            .await
+            .unwrap_err();
+        assert_eq!(missing.code(), Code::NotFound);
+
+        // Subscribers get the blocks the node had, then new ones once each
+        let mut blocks = server
+            .subscribe_blocks(Request::new(SubscribeRequest { from_height: 1 }))
+            .await
+            .unwrap()
+            .into_inner();
+        server.publish_block(&block(1));
+        server.publish_block(&block(2));
+        assert_eq!(blocks.next().await.unwrap().unwrap().height, 1);
+        assert_eq!(blocks.next().await.unwrap().unwrap().height, 2);
+        assert!(blocks.next().now_or_never().is_none());
+
+        // Blocks announced on the event bus are published once on the chain
+        let mut followed = server.block_subscription(2);
+        let bus = EventBus::new();
+        let events = bus.subscribe();
+        blockchain.lock().unwrap().chain.push(block(2));
+        bus.publish(Event::new_block(&block(2)));
+        bus.publish(Event::new_block(&block(3)));
+        drop(bus);
+        server.follow(events).await;
+        assert_eq!(followed.try_next().unwrap().height, 2);
+        assert!(followed.try_next().is_none());
+
+        // Signatures are collected and the certificate verified
+        let wallets: Vec<Wallet> = (0..2)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree =
+            MerkleTreeBuilder::with_hash(Hashing::new(HashAlgorithm::Keccak256, true));
+        party_tree.build(&participants).unwrap();
+        let params = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 15,
+            ..Default::default()
+        };
+        let unready = server
+            .build_cert(Request::new(BuildCertRequest {}))
+            .await
+            .unwrap_err();
+        assert_eq!(unready.code(), Code::FailedPrecondition);
+        server.collect(SignatureCollector::new(
+            Builder::new(params.clone(), participants, party_tree.root()).unwrap(),
+        ));
+        for (position, wallet) in wallets.iter().enumerate() {
+            let share = SignatureShare {
+                msg: params.msg.clone(),
+                position: position as u64,
+                signature: wallet.sign_message(&params.signing_message()).to_vec(),
+            };
+            let response = server
+                .submit_signature(Request::new(share))
+                .await
+                .unwrap()
+                .into_inner();
+            assert!(response.added);
+        }
+        let cert = server
+            .build_cert(Request::new(BuildCertRequest {}))
+            .await
+            .unwrap()
+            .into_inner();
+        let verify = VerifyCertRequest {
+            certificate: Some(cert),
+            params: Some(crate::proto::Params::from(&params)),
+            party_tree_root: party_tree.root(),
+        };
+        let response = server
+            .verify_cert(Request::new(verify))
+            .await
+            .unwrap()
+            .into_inner();
+        assert!(response.valid);
+    }
+}
@@ -0,0 +1,158 @@
+//! Half-aggregation of BIP-340 Schnorr signatures. The signatures of many
+//! keys over one message fold into their nonces and a single 32-byte scalar
+//! `s = z_0 s_0 + z_1 s_1 + ...`, where the randomizers `z_i` hash every
+//! nonce and key before them, so no signer can cancel out another's. Unlike
+//! MuSig2, the signers don't interact: anyone holding the signatures can
+//! aggregate any subset of them, which the coins of a certificate only pick
+//! after signing.
+//!
+//! k256's BIP-340 signer signs the SHA-256 digest of its message, so that
+//! digest is the message of the challenges here.
+use k256::elliptic_curve::{ops::Reduce, PrimeField};
+use k256::{schnorr, FieldBytes, ProjectivePoint, Scalar, U256};
+use sha2::{Digest, Sha256};
+
+/// Bytes of the nonce a half-aggregated signature keeps
+pub const NONCE_BYTES: usize = 32;
+
+/// Bytes of an aggregate signature
+pub const AGGREGATE_BYTES: usize = 32;
+
+const CHALLENGE_TAG: &[u8] = b"BIP0340/challenge";
+const RANDOMIZER_TAG: &[u8] = b"HalfAgg/randomizer";
+
+/// BIP-340 tagged hash of `data`
+fn tagged_hash(tag: &[u8], data: &[u8]) -> [u8; 32] {
+    let tag = Sha256::digest(tag);
+    let mut hasher = Sha256::new();
+    hasher.update(tag);
+    hasher.update(tag);
+    hasher.update(data);
+    hasher.finalize().into()
+}
+
+fn reduce(hash: [u8; 32]) -> Scalar {
+    <Scalar as Reduce<U256>>::reduce_bytes(&FieldBytes::from(hash))
+}
+
+/// Point of an x-only key or nonce, with even y
+fn lift_x(bytes: &[u8], what: &str) -> Result<ProjectivePoint, String> {
+    let point = schnorr::VerifyingKey::from_bytes(bytes)
+        .map_err(|e| format!("Invalid Schnorr {}: {}", what, e))?;
+    Ok(ProjectivePoint::from(*point.as_affine()))
+}
+
+/// Nonce of a BIP-340 signature: the x coordinate of its `R`
+pub fn nonce(signature: &[u8]) -> Result<&[u8], String> {
+    if signature.len() != 2 * NONCE_BYTES {
+        return Err(format!(
+            "Invalid Schnorr signature length: {}",
+            signature.len()
+        ));
+    }
+    Ok(&signature[..NONCE_BYTES])
+}
+
+/// Randomizers of `(public_key, nonce)` entries over `digest`, the first one
+/// being 1
+fn randomizers(entries: &[(&[u8], &[u8])], digest: &[u8]) -> Vec<Scalar> {
+    let mut transcript = Vec::new();
+    entries
+        .iter()
+        .enumerate()
+        .map(|(i, (public_key, nonce))| {
+            transcript.extend_from_slice(nonce);
+            transcript.extend_from_slice(public_key);
+            transcript.extend_from_slice(digest);
+            if i == 0 {
+                Scalar::ONE
+            } else {
+                reduce(tagged_hash(RANDOMIZER_TAG, &transcript))
+            }
+        })
+        .collect()
+}
+
+/// Aggregate of `(public_key, signature)` entries over `msg`, each signature
+/// checked beforehand
+pub fn aggregate(entries: &[(&[u8], &[u8])], msg: &[u8]) -> Result<Vec<u8>, String> {
+    let nonces = entries
+        .iter()
+        .map(|(public_key, signature)| Ok((*public_key, nonce(signature)?)))
+        .collect::<Result<Vec<_>, String>>()?;
+    let digest = Sha256::digest(msg);
+    let mut s = Scalar::ZERO;
+    for ((_, signature), z) in entries.iter().zip(randomizers(&nonces, &digest)) {
+        let bytes: [u8; 32] = signature[NONCE_BYTES..].try_into().unwrap();
+        let s_i = Option::<Scalar>::from(Scalar::from_repr(FieldBytes::from(bytes)))
+            .ok_or_else(|| "Invalid Schnorr signature scalar".to_string())?;
+        s += z * s_i;
+    }
+    Ok(s.to_bytes().to_vec())
+}
+
+/// Verify `aggregate` over `msg` for `(public_key, nonce)` entries, in the
+/// order they were aggregated
+pub fn verify(entries: &[(&[u8], &[u8])], msg: &[u8], aggregate: &[u8]) -> Result<bool, String> {
+    let bytes: [u8; AGGREGATE_BYTES] = aggregate
+        .try_into()
+        .map_err(|_| format!("Invalid aggregate signature length: {}", aggregate.len()))?;
+    let Some(s) = Option::<Scalar>::from(Scalar::from_repr(FieldBytes::from(bytes))) else {
+        return Ok(false);
+    };
+    let digest = Sha256::digest(msg);
+    let mut expected = ProjectivePoint::IDENTITY;
+    for ((public_key, nonce), z) in entries.iter().zip(randomizers(entries, &digest)) {
+        if nonce.len() != NONCE_BYTES {
+            return Err(format!("Invalid Schnorr nonce length: {}", nonce.len()));
+        }
+        let challenge = reduce(tagged_hash(
+            CHALLENGE_TAG,
+            &[*nonce, *public_key, &digest[..]].concat(),
+        ));
+        let point = lift_x(nonce, "nonce")? + lift_x(public_key, "public key")? * challenge;
+        expected += point * z;
+    }
+    Ok(ProjectivePoint::GENERATOR * s == expected)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::signer::{SchnorrSigner, Signer};
+
+    #[test]
+    fn test_half_aggregation() {
+        let signers: Vec<SchnorrSigner> = (0..3).map(|_| SchnorrSigner::new().unwrap()).collect();
+        let msg = b"Test message";
+        let keys: Vec<Vec<u8>> = signers.iter().map(|s| s.public_key()).collect();
+        let sigs: Vec<Vec<u8>> = signers.iter().map(|s| s.sign(msg)).collect();
+        let signed: Vec<(&[u8], &[u8])> = keys
+            .iter()
+            .zip(&sigs)
+            .map(|(k, s)| (&k[..], &s[..]))
+            .collect();
+        let nonces: Vec<(&[u8], &[u8])> = keys
+            .iter()
+            .zip(&sigs)
+            .map(|(k, s)| (&k[..], nonce(s).unwrap()))
+            .collect();
+
+        // The aggregate verifies for its nonces and message only
+        let agg = aggregate(&signed, msg).unwrap();
+        assert_eq!(agg.len(), AGGREGATE_BYTES);
+        assert!(verify(&nonces, msg, &agg).unwrap());
+        assert!(!verify(&nonces, b"Other message", &agg).unwrap());
+        assert!(!verify(&nonces[1..], msg, &agg).unwrap());
+        let mut swapped = nonces.clone();
+        swapped.swap(0, 1);
+        assert!(!verify(&swapped, msg, &agg).unwrap());
+        let mut tampered = agg.clone();
+        tampered[31] ^= 1;
+        assert!(!verify(&nonces, msg, &tampered).unwrap());
+        assert!(verify(&nonces, msg, &agg[1..]).is_err());
+
+        // A single signature aggregates to its own scalar
+        assert_eq!(aggregate(&signed[..1], msg).unwrap(), sigs[0][32..]);
+    }
+}
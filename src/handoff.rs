@@ -0,0 +1,210 @@
+//! Epoch handoffs. At the end of an epoch the outgoing validators build a
+//! compact certificate over a `Handoff`, committing to the party tree root and
+//! total weight of the incoming validators. Starting from a trusted genesis
+//! `Epoch`, a verifier follows the `HandoffCert`s one epoch at a time; the
+//! certificate of each must outweigh two thirds of the outgoing total weight,
+//! which the previous handoff certified.
+use crate::ccok::{Certificate, Params, Verifier};
+use crate::error::CcokError;
+use crate::merkle::HashDomain;
+use crate::validatorset::EpochValidators;
+use serde::{Deserialize, Serialize};
+
+/// Validators of an epoch as committed by a handoff
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Epoch {
+    /// Epoch number, starting at 0 for genesis
+    pub number: u64,
+    /// Party tree root of the epoch's validators
+    pub voters_commitment: Vec<u8>,
+    /// Total weight of the epoch's validators
+    pub total_weight: u64,
+}
+
+impl From<&EpochValidators> for Epoch {
+    fn from(validators: &EpochValidators) -> Self {
+        Self {
+            number: validators.epoch,
+            voters_commitment: validators.root.clone(),
+            total_weight: validators.total_weight(),
+        }
+    }
+}
+
+impl Epoch {
+    /// Weight a handoff certificate of the epoch must prove: two thirds of
+    /// the total
+    pub fn proven_weight(&self) -> u64 {
+        (self.total_weight as u128 * 2 / 3) as u64
+    }
+}
+
+/// Message the outgoing validators sign
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Handoff {
+    /// The outgoing epoch
+    pub from: Epoch,
+    /// The incoming epoch
+    pub to: Epoch,
+}
+
+impl Handoff {
+    /// Handoff from `from` to the epoch right after it
+    pub fn new(from: Epoch, to: Epoch) -> Result<Self, CcokError> {
+        if to.number != from.number + 1 {
+            return Err(CcokError::InvalidHandoff(format!(
+                "epoch {} does not follow epoch {}",
+                to.number, from.number
+            )));
+        }
+        if to.total_weight == 0 {
+            return Err(CcokError::InvalidHandoff(format!(
+                "epoch {} has no weight",
+                to.number
+            )));
+        }
+        Ok(Self { from, to })
+    }
+
+    /// Certificate params of the handoff: `template` with the handoff digest
+    /// as message and the proven weight of the outgoing epoch
+    pub fn params(&self, template: &Params) -> Result<Params, CcokError> {
+        let bytes = bincode::serialize(self)?;
+        let mut params = template.clone();
+        params.msg = template
+            .hashing()
+            .hash(HashDomain::Message, &bytes)
+            .to_vec();
+        params.proven_weight = self.from.proven_weight();
+        Ok(params)
+    }
+}
+
+/// Certificate of the outgoing validators over a handoff
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HandoffCert {
+    pub handoff: Handoff,
+    pub certificate: Certificate,
+}
+
+impl HandoffCert {
+    /// Check that the validators of `trusted` handed over to the incoming epoch
+    pub fn verify(&self, trusted: &Epoch, template: &Params) -> Result<(), CcokError> {
+        let handoff = Handoff::new(self.handoff.from.clone(), self.handoff.to.clone())?;
+        if handoff.from != *trusted {
+            return Err(CcokError::InvalidHandoff(format!(
+                "handoff is from another epoch {} than the trusted one",
+                handoff.from.number
+            )));
+        }
+        let params = handoff.params(template)?;
+        if !Verifier::new(trusted.voters_commitment.clone()).verify(&self.certificate, &params)? {
+            return Err(CcokError::InvalidHandoff(format!(
+                "certificate of epoch {} does not verify",
+                trusted.number
+            )));
+        }
+        Ok(())
+    }
+}
+
+/// Follows handoffs from a trusted epoch
+#[derive(Debug, Clone)]
+pub struct HandoffVerifier {
+    /// Params of the certificates, apart from their message and proven weight
+    pub template: Params,
+    /// Latest verified epoch
+    pub epoch: Epoch,
+}
+
+impl HandoffVerifier {
+    /// Verifier trusting `epoch`, usually genesis
+    pub fn new(template: Params, epoch: Epoch) -> Self {
+        Self { template, epoch }
+    }
+
+    /// Accept the handoff of the current epoch and move on to the next one
+    pub fn advance(&mut self, cert: &HandoffCert) -> Result<(), CcokError> {
+        cert.verify(&self.epoch, &self.template)?;
+        self.epoch = cert.handoff.to.clone();
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant};
+    use crate::stateproof::voters_commitment;
+    use crate::wallet::Wallet;
+
+    // Validators of `number` with 3 wallets of weight 10
+    fn epoch(template: &Params, number: u64) -> (Vec<Wallet>, Vec<Participant>, Epoch) {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let voters: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let epoch = Epoch {
+            number,
+            voters_commitment: voters_commitment(template.hashing(), &voters).unwrap(),
+            total_weight: 30,
+        };
+        (wallets, voters, epoch)
+    }
+
+    // Handoff from `from` signed by the first `signers` of its wallets
+    fn sign(
+        template: &Params,
+        from: &(Vec<Wallet>, Vec<Participant>, Epoch),
+        to: &Epoch,
+        signers: usize,
+    ) -> HandoffCert {
+        let handoff = Handoff::new(from.2.clone(), to.clone()).unwrap();
+        let params = handoff.params(template).unwrap();
+        let mut builder = Builder::new(
+            params.clone(),
+            from.1.clone(),
+            from.2.voters_commitment.clone(),
+        )
+        .unwrap();
+        for (i, wallet) in from.0.iter().take(signers).enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        HandoffCert {
+            handoff,
+            certificate: builder.build().unwrap(),
+        }
+    }
+
+    #[test]
+    fn test_handoff_chain() {
+        let template = Params::default();
+        let genesis = epoch(&template, 0);
+        let first = epoch(&template, 1);
+        let second = epoch(&template, 2);
+
+        let mut verifier = HandoffVerifier::new(template.clone(), genesis.2.clone());
+        let next = sign(&template, &first, &second.2, 3);
+        // Handoffs are followed in order only
+        assert!(verifier.advance(&next).is_err());
+        verifier
+            .advance(&sign(&template, &genesis, &first.2, 3))
+            .unwrap();
+        assert_eq!(verifier.epoch, first.2);
+
+        // The incoming epoch is bound by the certificate
+        let mut inflated = next.clone();
+        inflated.handoff.to.total_weight = 1;
+        assert!(verifier.advance(&inflated).is_err());
+        verifier.advance(&next).unwrap();
+        assert_eq!(verifier.epoch.number, 2);
+
+        // Epochs can't be skipped
+        assert!(Handoff::new(genesis.2.clone(), second.2.clone()).is_err());
+    }
+}
@@ -1,5 +1,6 @@
 use crate::accounts::Account;
 use crate::config::EPOCH_DURATION;
+use log::trace;
 use rand::Rng;
 use serde::{Deserialize, Serialize};
 use sha3::{Digest, Sha3_256};
@@ -23,6 +24,11 @@ pub struct HashChainMessage {
 
 impl HashChain {
     pub fn new() -> Self {
+        Self::with_length(EPOCH_DURATION)
+    }
+
+    /// Hash chain covering epochs of `length` blocks
+    pub fn with_length(length: u64) -> Self {
         let mut hasher = Sha3_256::new();
         let mut hash_chain = vec![];
 
@@ -33,7 +39,7 @@ impl HashChain {
         let initial_hash_hex: String = hex::encode(&initial_hash);
         hash_chain.push(initial_hash_hex);
 
-        for i in 0..EPOCH_DURATION + 1 {
+        for i in 0..length + 1 {
             let last_hash_bytes =
                 hex::decode(hash_chain.last().unwrap()).expect("Invalid hex string");
 
@@ -42,7 +48,7 @@ impl HashChain {
             hasher.update(&last_hash_bytes);
             let current_hash = hasher.finalize();
             let current_hash_hex = hex::encode(&current_hash);
-            println!("Computed hash: {}, index {}", current_hash_hex, i);
+            trace!("Computed hash: {}, index {}", current_hash_hex, i);
             hash_chain.push(current_hash_hex);
         }
         HashChain { hash_chain }
@@ -56,12 +62,17 @@ impl HashChain {
     }
 }
 
-pub fn verify_hash_chain_index(commitment: String, index: u64, received_hash: String) -> bool {
+pub fn verify_hash_chain_index(
+    commitment: String,
+    index: u64,
+    received_hash: String,
+    length: u64,
+) -> bool {
     // Decode the received hash from hex to bytes
     let mut current_hash_bytes = hex::decode(&received_hash).expect("Invalid hex string");
 
-    // Hash the received hash (EPOCH_DURATION - index) times
-    for _ in (EPOCH_DURATION - index + 1)..(EPOCH_DURATION + 1) {
+    // Hash the received hash (length - index) times
+    for _ in (length - index + 1)..(length + 1) {
         let mut hasher = Sha3_256::new();
         hasher.update(&current_hash_bytes);
         current_hash_bytes = hasher.finalize().to_vec();
@@ -0,0 +1,346 @@
+//! Hierarchical deterministic keys. A validator keeps one master seed and
+//! derives a key per purpose and epoch from it along a path such as
+//! `m/7797'/2'/14'`, so certificate keys can be rotated every epoch without
+//! storing each one. Derivation follows BIP32's hardened derivation with
+//! SHA3-512 in place of HMAC-SHA512; as post-quantum public keys can't be
+//! derived from a parent public key, every step is hardened. The identity key
+//! of the validator signs a `KeyLink` for each derived key, which proves the
+//! key belongs to the registered identity.
+use crate::merkle::HashDomain;
+use crate::scheme::{verify_signature, SchemeId};
+use crate::signer::{zeroize, DilithiumSigner, ExportableSigner, SignatureScheme};
+use crate::wallet::Wallet;
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Sha3_512};
+use std::fmt;
+use std::str::FromStr;
+
+/// Offset of hardened child indices
+pub const HARDENED: u32 = 1 << 31;
+/// First path component of the node's keys
+pub const PURPOSE_ROOT: u32 = 7797;
+// Shortest master seed accepted, as in BIP32
+const MIN_SEED_LEN: usize = 16;
+
+/// What a derived key signs
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum KeyPurpose {
+    /// Long-lived key registered for the validator
+    Identity,
+    /// Consensus votes and gossip
+    Consensus,
+    /// Compact certificate signatures
+    Certificate,
+}
+
+impl KeyPurpose {
+    pub fn index(&self) -> u32 {
+        match self {
+            KeyPurpose::Identity => 0,
+            KeyPurpose::Consensus => 1,
+            KeyPurpose::Certificate => 2,
+        }
+    }
+}
+
+/// Path of hardened child indices from the master key
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DerivationPath(pub Vec<u32>);
+
+impl DerivationPath {
+    /// Path `m/7797'/<purpose>'/<epoch>'` of a key of the node
+    pub fn for_key(purpose: KeyPurpose, epoch: u32) -> Result<Self, String> {
+        if epoch >= HARDENED {
+            return Err(format!("Epoch {} out of derivation range", epoch));
+        }
+        Ok(Self(vec![
+            PURPOSE_ROOT + HARDENED,
+            purpose.index() + HARDENED,
+            epoch + HARDENED,
+        ]))
+    }
+}
+
+impl FromStr for DerivationPath {
+    type Err = String;
+
+    fn from_str(path: &str) -> Result<Self, String> {
+        let mut parts = path.split('/');
+        if parts.next() != Some("m") {
+            return Err(format!("Derivation path {} doesn't start at m", path));
+        }
+        parts
+            .map(|part| {
+                let index = part
+                    .strip_suffix('\'')
+                    .ok_or_else(|| format!("Non-hardened derivation step {}", part))?;
+                match index.parse::<u32>() {
+                    Ok(index) if index < HARDENED => Ok(index + HARDENED),
+                    _ => Err(format!("Invalid derivation step {}", part)),
+                }
+            })
+            .collect::<Result<Vec<u32>, String>>()
+            .map(Self)
+    }
+}
+
+impl fmt::Display for DerivationPath {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "m")?;
+        for index in &self.0 {
+            write!(f, "/{}'", index - HARDENED)?;
+        }
+        Ok(())
+    }
+}
+
+/// Key seed with the chain code its children are derived with, both zeroized
+/// when the key is dropped
+#[derive(Clone)]
+pub struct ExtendedKey {
+    seed: [u8; 32],
+    chain_code: [u8; 32],
+    pub depth: u8,
+}
+
+// Implement Debug trait for ExtendedKey without leaking the seed
+impl fmt::Debug for ExtendedKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "ExtendedKey {{ depth: {}, seed: <seed> }}", self.depth)
+    }
+}
+
+impl Drop for ExtendedKey {
+    fn drop(&mut self) {
+        zeroize(&mut self.seed);
+        zeroize(&mut self.chain_code);
+    }
+}
+
+impl ExtendedKey {
+    /// Master key of a seed of at least 16 bytes
+    pub fn master(seed: &[u8]) -> Result<Self, String> {
+        if seed.len() < MIN_SEED_LEN {
+            return Err(format!("Master seed of {} bytes is too short", seed.len()));
+        }
+        let digest = Sha3_512::new()
+            .chain_update(b"NIROPoK master seed")
+            .chain_update(seed)
+            .finalize();
+        Ok(Self::split(digest.into(), 0))
+    }
+
+    // Key of the two halves of `digest`, which is zeroized
+    fn split(mut digest: [u8; 64], depth: u8) -> Self {
+        let key = Self {
+            seed: digest[..32].try_into().unwrap(),
+            chain_code: digest[32..].try_into().unwrap(),
+            depth,
+        };
+        zeroize(&mut digest);
+        key
+    }
+
+    /// Hardened child `index`
+    pub fn child(&self, index: u32) -> Result<Self, String> {
+        if index < HARDENED {
+            return Err(format!("Child {} is not hardened", index));
+        }
+        let depth = self
+            .depth
+            .checked_add(1)
+            .ok_or_else(|| "Derivation path too deep".to_string())?;
+        let digest = Sha3_512::new()
+            .chain_update(self.chain_code)
+            .chain_update([0u8])
+            .chain_update(self.seed)
+            .chain_update(index.to_be_bytes())
+            .finalize();
+        Ok(Self::split(digest.into(), depth))
+    }
+
+    /// Key at `path` below this one. Each intermediate key is zeroized once
+    /// its child is derived.
+    pub fn derive(&self, path: &DerivationPath) -> Result<Self, String> {
+        let Some((&first, rest)) = path.0.split_first() else {
+            return Ok(self.clone());
+        };
+        rest.iter()
+            .try_fold(self.child(first)?, |key, &index| key.child(index))
+    }
+
+    /// Signer with the keypair of this key. Only schemes with a seeded key
+    /// generation can be derived.
+    pub fn signer(&self, scheme: SignatureScheme) -> Result<Box<dyn ExportableSigner>, String> {
+        match scheme {
+            SignatureScheme::Dilithium2 => Ok(Box::new(Wallet::from_seed(&self.seed))),
+            SignatureScheme::Dilithium3 => Ok(Box::new(DilithiumSigner::from_seed(&self.seed))),
+            other => Err(format!("{:?} keys can't be derived from a seed", other)),
+        }
+    }
+}
+
+/// Statement of an identity key that a derived key belongs to it
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyLink {
+    /// Identity public key in hex
+    pub identity: String,
+    pub identity_scheme: SchemeId,
+    pub purpose: KeyPurpose,
+    pub epoch: u32,
+    /// Derived public key in hex
+    pub public_key: String,
+    pub scheme: SchemeId,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+impl KeyLink {
+    /// Bytes the identity key signs
+    pub fn signing_bytes(&self) -> Result<Vec<u8>, String> {
+        let fields = (
+            &self.identity,
+            self.identity_scheme,
+            self.purpose,
+            self.epoch,
+            &self.public_key,
+            self.scheme,
+        );
+        let encoded =
+            bincode::serialize(&fields).map_err(|e| format!("Serialization error: {}", e))?;
+        Ok(HashDomain::Message.tagged(&encoded))
+    }
+
+    /// Check the link was signed by `identity`
+    pub fn verify(&self, identity: &str) -> Result<bool, String> {
+        if self.identity != identity {
+            return Ok(false);
+        }
+        let public_key =
+            hex::decode(&self.identity).map_err(|e| format!("Invalid identity key: {}", e))?;
+        verify_signature(
+            self.identity_scheme,
+            &public_key,
+            &self.signing_bytes()?,
+            &self.signature,
+        )
+    }
+}
+
+/// Keys of a validator derived from its master seed
+#[derive(Debug, Clone)]
+pub struct HdWallet {
+    master: ExtendedKey,
+    scheme: SignatureScheme,
+}
+
+impl HdWallet {
+    pub fn new(seed: &[u8], scheme: SignatureScheme) -> Result<Self, String> {
+        Ok(Self {
+            master: ExtendedKey::master(seed)?,
+            scheme,
+        })
+    }
+
+    /// Key of `purpose` for `epoch`
+    pub fn key(
+        &self,
+        purpose: KeyPurpose,
+        epoch: u32,
+    ) -> Result<Box<dyn ExportableSigner>, String> {
+        self.master
+            .derive(&DerivationPath::for_key(purpose, epoch)?)?
+            .signer(self.scheme)
+    }
+
+    /// Identity key, registered once for the validator
+    pub fn identity(&self) -> Result<Box<dyn ExportableSigner>, String> {
+        self.key(KeyPurpose::Identity, 0)
+    }
+
+    /// Link of the key of `purpose` for `epoch` to the identity key
+    pub fn link(&self, purpose: KeyPurpose, epoch: u32) -> Result<KeyLink, String> {
+        let identity = self.identity()?;
+        let key = self.key(purpose, epoch)?;
+        let mut link = KeyLink {
+            identity: identity.public_key_hex(),
+            identity_scheme: identity.scheme(),
+            purpose,
+            epoch,
+            public_key: key.public_key_hex(),
+            scheme: key.scheme(),
+            signature: Vec::new(),
+        };
+        link.signature = identity.sign(&link.signing_bytes()?);
+        Ok(link)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hd_derivation() {
+        let path: DerivationPath = "m/7797'/2'/14'".parse().unwrap();
+        assert_eq!(
+            path,
+            DerivationPath::for_key(KeyPurpose::Certificate, 14).unwrap()
+        );
+        assert_eq!(path.to_string(), "m/7797'/2'/14'");
+        assert!("m/7797/2'".parse::<DerivationPath>().is_err());
+        assert!("7797'".parse::<DerivationPath>().is_err());
+        assert!(ExtendedKey::master(b"short").is_err());
+        let master = ExtendedKey::master(&[7u8; 32]).unwrap();
+        assert_eq!(
+            master.derive(&DerivationPath(Vec::new())).unwrap().seed,
+            master.seed
+        );
+        let child = master.derive(&path).unwrap();
+        assert_eq!(child.depth, 3);
+        assert_eq!(
+            child.seed,
+            master
+                .child(path.0[0])
+                .unwrap()
+                .derive(&DerivationPath(path.0[1..].to_vec()))
+                .unwrap()
+                .seed
+        );
+
+        // Derivation is deterministic and separates purposes and epochs
+        let seed = [7u8; 32];
+        let hd = HdWallet::new(&seed, SignatureScheme::Dilithium2).unwrap();
+        let again = HdWallet::new(&seed, SignatureScheme::Dilithium2).unwrap();
+        let key = hd.key(KeyPurpose::Certificate, 14).unwrap();
+        assert_eq!(
+            key.public_key(),
+            again.key(KeyPurpose::Certificate, 14).unwrap().public_key()
+        );
+        assert_ne!(
+            key.public_key(),
+            hd.key(KeyPurpose::Certificate, 15).unwrap().public_key()
+        );
+        assert_ne!(
+            key.public_key(),
+            hd.key(KeyPurpose::Consensus, 14).unwrap().public_key()
+        );
+        assert!(HdWallet::new(&seed, SignatureScheme::Falcon512)
+            .unwrap()
+            .identity()
+            .is_err());
+
+        // Rotated keys are linked to the registered identity
+        let identity = hd.identity().unwrap().public_key_hex();
+        let link = hd.link(KeyPurpose::Certificate, 14).unwrap();
+        assert_eq!(link.public_key, key.public_key_hex());
+        assert!(link.verify(&identity).unwrap());
+        let other = HdWallet::new(&[8u8; 32], SignatureScheme::Dilithium2).unwrap();
+        assert!(!link
+            .verify(&other.identity().unwrap().public_key_hex())
+            .unwrap());
+        let mut forged = link.clone();
+        forged.epoch = 15;
+        assert!(!forged.verify(&identity).unwrap());
+    }
+}
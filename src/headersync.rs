@@ -0,0 +1,352 @@
+//! Header-only mode for relayers and light-client servers. Such a node keeps
+//! no transactions or account state: for every certified interval it stores
+//! the block headers, the state proof and the voters commitment the proof
+//! hands over to. `HeaderSync` accepts an interval once its light client
+//! verifies the state proof and the headers chain to the previous interval
+//! and match the proof's headers commitment. `HeaderStore` serves the proofs
+//! to relayers and header paths to light clients. Under its `Retention`
+//! policy it prunes the headers and proofs of old intervals, but it keeps
+//! every voters commitment, so the chain of trust can still be shown.
+use crate::block::BlockHeader;
+use crate::certstore::{proof_epoch, Retention};
+use crate::config::STATE_PROOF_INTERVAL;
+use crate::lightclient::Client;
+use crate::merkle::{AuditPath, MerkleTreeBuilder};
+use crate::stateproof::{headers_commitment, StateProof};
+use crate::store::{KvStore, WriteBatch};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+// Key prefixes, apart from the chain and certificate store data
+const HEADER: u8 = b'h';
+const PROOF: u8 = b'q';
+const VOTERS: u8 = b'v';
+
+fn key(prefix: u8, number: u64) -> Vec<u8> {
+    let mut key = vec![prefix];
+    key.extend_from_slice(&number.to_be_bytes());
+    key
+}
+
+fn key_number(key: &[u8]) -> Result<u64, String> {
+    key.get(1..9)
+        .and_then(|bytes| bytes.try_into().ok())
+        .map(u64::from_be_bytes)
+        .ok_or_else(|| "Invalid header store key".to_string())
+}
+
+fn encode<T: Serialize>(value: &T) -> Result<Vec<u8>, String> {
+    bincode::serialize(value).map_err(|e| format!("Serialization error: {}", e))
+}
+
+fn decode<T: DeserializeOwned>(bytes: &[u8]) -> Result<T, String> {
+    bincode::deserialize(bytes).map_err(|e| format!("Deserialization error: {}", e))
+}
+
+/// Interval holding block `height`, as numbered by `certstore::proof_epoch`
+pub fn interval_of(height: u64) -> u64 {
+    height.div_ceil(STATE_PROOF_INTERVAL)
+}
+
+/// Headers, state proofs and voters commitments of certified intervals
+pub struct HeaderStore<S: KvStore> {
+    backend: S,
+    retention: Retention,
+}
+
+impl<S: KvStore> HeaderStore<S> {
+    pub fn new(backend: S, retention: Retention) -> Self {
+        Self { backend, retention }
+    }
+
+    pub fn backend(&self) -> &S {
+        &self.backend
+    }
+
+    /// Store a certified interval: its headers, proof and voters commitment
+    pub fn put_interval(
+        &mut self,
+        proof: &StateProof,
+        headers: &[BlockHeader],
+    ) -> Result<(), String> {
+        let interval = proof_epoch(proof);
+        let mut batch = WriteBatch::new();
+        for header in headers {
+            batch.put(key(HEADER, header.height), encode(header)?);
+        }
+        batch.put(key(PROOF, interval), encode(proof)?);
+        batch.put(
+            key(VOTERS, interval),
+            proof.message.voters_commitment.clone(),
+        );
+        self.backend.write(batch)
+    }
+
+    pub fn header(&self, height: u64) -> Result<Option<BlockHeader>, String> {
+        self.backend
+            .get(&key(HEADER, height))?
+            .map(|bytes| decode(&bytes))
+            .transpose()
+    }
+
+    /// Headers of heights `from..to` kept, in order
+    pub fn headers(&self, from: u64, to: u64) -> Result<Vec<BlockHeader>, String> {
+        self.backend
+            .range(&key(HEADER, from), &key(HEADER, to))?
+            .iter()
+            .map(|(_, value)| decode(value))
+            .collect()
+    }
+
+    /// Highest header kept
+    pub fn latest_height(&self) -> Result<Option<u64>, String> {
+        match self.backend.scan(&[HEADER])?.last() {
+            Some((key, _)) => Ok(Some(key_number(key)?)),
+            None => Ok(None),
+        }
+    }
+
+    pub fn proof(&self, interval: u64) -> Result<Option<StateProof>, String> {
+        self.backend
+            .get(&key(PROOF, interval))?
+            .map(|bytes| decode(&bytes))
+            .transpose()
+    }
+
+    /// Proofs of the intervals after `interval`, oldest first, e.g. for a
+    /// relayer catching up
+    pub fn proofs_after(&self, interval: u64) -> Result<Vec<StateProof>, String> {
+        self.backend
+            .range(&key(PROOF, interval.saturating_add(1)), &[PROOF + 1])?
+            .iter()
+            .map(|(_, value)| decode(value))
+            .collect()
+    }
+
+    /// Voters commitment the proof of `interval` handed over to
+    pub fn voters(&self, interval: u64) -> Result<Option<Vec<u8>>, String> {
+        self.backend.get(&key(VOTERS, interval))
+    }
+
+    /// Last interval stored
+    pub fn latest_interval(&self) -> Result<Option<u64>, String> {
+        match self.backend.scan(&[VOTERS])?.last() {
+            Some((key, _)) => Ok(Some(key_number(key)?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Header of block `height` with its path to the headers commitment of
+    /// its interval, for a light client's `verify_header`; `None` once pruned
+    pub fn prove_header(&self, height: u64) -> Result<Option<(BlockHeader, AuditPath)>, String> {
+        let Some(proof) = self.proof(interval_of(height))? else {
+            return Ok(None);
+        };
+        let (first, last) = (proof.message.first_block, proof.message.last_block);
+        let headers = self.headers(first, last + 1)?;
+        if headers.len() as u64 != last - first + 1 || height < first {
+            return Ok(None);
+        }
+        let mut tree = MerkleTreeBuilder::with_hash(proof.certificate.hashing());
+        tree.build(&headers)?;
+        let index = (height - first) as usize;
+        Ok(Some((headers[index].clone(), tree.prove_leaf(index)?)))
+    }
+
+    /// Delete the headers and proofs of the intervals the retention policy
+    /// drops, in one batch; returns how many intervals were pruned
+    pub fn prune(&mut self) -> Result<usize, String> {
+        let Some(latest) = self.latest_interval()? else {
+            return Ok(0);
+        };
+        let mut batch = WriteBatch::new();
+        let mut pruned = 0;
+        for (proof_key, value) in self.backend.scan(&[PROOF])? {
+            let interval = key_number(&proof_key)?;
+            if self.retention.keeps(interval, latest) {
+                continue;
+            }
+            let proof: StateProof = decode(&value)?;
+            for height in proof.message.first_block..=proof.message.last_block {
+                batch.delete(key(HEADER, height));
+            }
+            batch.delete(proof_key);
+            pruned += 1;
+        }
+        self.backend.write(batch)?;
+        Ok(pruned)
+    }
+
+    /// Prune and reclaim the space of the pruned intervals
+    pub fn compact(&mut self) -> Result<usize, String> {
+        let pruned = self.prune()?;
+        self.backend.compact()?;
+        Ok(pruned)
+    }
+}
+
+/// Follows the chain headers-only, verifying every interval before storing it
+pub struct HeaderSync<S: KvStore> {
+    client: Client,
+    store: HeaderStore<S>,
+}
+
+impl<S: KvStore> HeaderSync<S> {
+    /// Sync trusting `client`, e.g. `GenesisState::light_client` or the
+    /// client of a fast sync, into `store`
+    pub fn new(client: Client, store: HeaderStore<S>) -> Self {
+        Self { client, store }
+    }
+
+    pub fn client(&self) -> &Client {
+        &self.client
+    }
+
+    pub fn store(&self) -> &HeaderStore<S> {
+        &self.store
+    }
+
+    pub fn store_mut(&mut self) -> &mut HeaderStore<S> {
+        &mut self.store
+    }
+
+    /// Verify the next interval's state proof and `headers`, its headers in
+    /// order, and store them
+    pub fn add_interval(
+        &mut self,
+        proof: &StateProof,
+        headers: &[BlockHeader],
+    ) -> Result<(), String> {
+        let (first, last) = (proof.message.first_block, proof.message.last_block);
+        if first > last || headers.len() as u64 != last - first + 1 {
+            return Err(format!(
+                "{} headers for the interval of blocks {}..={}",
+                headers.len(),
+                first,
+                last
+            ));
+        }
+        let mut parent = self.store.header(first - 1)?;
+        for (header, height) in headers.iter().zip(first..) {
+            if header.height != height {
+                return Err(format!(
+                    "Header of block {} where block {} was expected",
+                    header.height, height
+                ));
+            }
+            if let Some(parent) = &parent {
+                if header.parent_hash != parent.hash()? {
+                    return Err(format!(
+                        "Header of block {} does not follow its parent",
+                        height
+                    ));
+                }
+            }
+            parent = Some(header.clone());
+        }
+        if headers_commitment(proof.certificate.hashing(), headers)?
+            != proof.message.block_headers_commitment
+        {
+            return Err(format!(
+                "Headers of blocks {}..={} are not the certified ones",
+                first, last
+            ));
+        }
+        let mut client = self.client.clone();
+        client.advance(proof)?;
+        self.store.put_interval(proof, headers)?;
+        self.client = client;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::block::{Block, BlockBuilder};
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::mempool::Mempool;
+    use crate::stateproof::{voters_commitment, StateProofMessage};
+    use crate::store::MemoryStore;
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_header_sync() {
+        let template = Params {
+            proven_weight: 5,
+            ..Default::default()
+        };
+        let hashing = template.hashing();
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let voters = vec![Participant::from_signer(&wallet, 10)];
+        let root = voters_commitment(hashing, &voters).unwrap();
+
+        let mut blocks: Vec<Block> = Vec::new();
+        for id in 1..=3 * STATE_PROOF_INTERVAL as usize {
+            let block = BlockBuilder::new(
+                blocks.last(),
+                id,
+                Account {
+                    address: "proposer".to_string(),
+                },
+                String::new(),
+                Seed {
+                    seed: [id as u8; 32],
+                },
+            )
+            .build(&mut Mempool::new())
+            .unwrap();
+            blocks.push(block);
+        }
+        let intervals: Vec<(StateProof, Vec<BlockHeader>)> = blocks
+            .chunks(STATE_PROOF_INTERVAL as usize)
+            .map(|interval| {
+                let message = StateProofMessage::new(hashing, interval, root.clone()).unwrap();
+                let params = message.params(&template).unwrap();
+                let mut builder =
+                    Builder::new(params.clone(), voters.clone(), root.clone()).unwrap();
+                builder
+                    .add_signature(0, wallet.sign_message(&params.signing_message()))
+                    .unwrap();
+                let proof = StateProof {
+                    message,
+                    certificate: builder.build().unwrap(),
+                };
+                (proof, interval.iter().map(Block::header).collect())
+            })
+            .collect();
+
+        let client = Client::new(template.clone(), STATE_PROOF_INTERVAL, root.clone());
+        let store = HeaderStore::new(MemoryStore::new(), Retention::KeepLastEpochs(2));
+        let mut sync = HeaderSync::new(client, store);
+        // Intervals are followed in order, with their certified headers
+        let (proof, headers) = &intervals[1];
+        assert!(sync.add_interval(proof, headers).is_err());
+        let (proof, headers) = &intervals[0];
+        let mut forged = headers.clone();
+        forged[3].timestamp += 1;
+        assert!(sync.add_interval(proof, &forged).is_err());
+        assert!(sync.add_interval(proof, &headers[1..]).is_err());
+        for (proof, headers) in &intervals {
+            sync.add_interval(proof, headers).unwrap();
+        }
+        assert_eq!(sync.client().last_certified_block(), Some(48));
+        assert_eq!(sync.store().latest_height().unwrap(), Some(48));
+        assert_eq!(sync.store().proofs_after(1).unwrap().len(), 2);
+
+        // Stored headers are served with paths a light client accepts
+        let (header, path) = sync.store().prove_header(20).unwrap().unwrap();
+        assert_eq!(header, blocks[19].header());
+        sync.client().verify_header(&header, &path).unwrap();
+
+        // Pruning drops old headers and proofs but keeps voters commitments
+        assert_eq!(sync.store_mut().prune().unwrap(), 1);
+        assert!(sync.store().header(16).unwrap().is_none());
+        assert!(sync.store().proof(1).unwrap().is_none());
+        assert!(sync.store().prove_header(3).unwrap().is_none());
+        assert_eq!(sync.store().voters(1).unwrap(), Some(root.clone()));
+        assert!(sync.store().header(17).unwrap().is_some());
+    }
+}
@@ -0,0 +1,290 @@
+//! Hybrid signatures. A participant of `SignatureScheme::Dilithium3Schnorr`
+//! holds a Dilithium3 and a Schnorr key, and signs with both: forging its
+//! signature takes breaking both schemes. `Params::signature_mode` chooses
+//! what reveals must carry. `Hybrid` requires both signatures, `PostQuantum`
+//! only the Dilithium3 one and `Classical` only the Schnorr one. `Aggregate`
+//! takes Schnorr signatures too, but reveals keep only their nonces and the
+//! certificate carries the half-aggregate of the rest. Unset, each
+//! participant signs with its own scheme, both halves for hybrid keys.
+use crate::ccok::SerializableSignature;
+use crate::halfagg::NONCE_BYTES;
+use crate::scheme::{lookup_scheme, SchemeId};
+use crate::signer::{SignatureScheme, SCHNORR_PUBLIC_KEY_BYTES, SCHNORR_SIGNATURE_BYTES};
+use crystals_dilithium::dilithium3;
+use serde::{Deserialize, Serialize};
+
+/// Signatures reveals must carry
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum SignatureMode {
+    /// Schnorr signatures, of Schnorr or hybrid participants
+    Classical,
+    /// Post-quantum signatures: the Dilithium3 half of hybrid participants
+    PostQuantum,
+    /// Both signatures of hybrid participants
+    Hybrid,
+    /// Schnorr signatures, half-aggregated into the certificate
+    Aggregate,
+}
+
+impl SignatureMode {
+    /// Identifier in encoded params
+    pub fn id(self) -> u8 {
+        match self {
+            SignatureMode::Classical => 1,
+            SignatureMode::PostQuantum => 2,
+            SignatureMode::Hybrid => 3,
+            SignatureMode::Aggregate => 4,
+        }
+    }
+
+    /// Mode of an id, `None` for 0 or an unknown id
+    pub fn from_id(id: u8) -> Option<Self> {
+        [
+            SignatureMode::Classical,
+            SignatureMode::PostQuantum,
+            SignatureMode::Hybrid,
+            SignatureMode::Aggregate,
+        ]
+        .into_iter()
+        .find(|mode| mode.id() == id)
+    }
+}
+
+/// Signature of a hybrid participant. Either half is empty when the signature
+/// mode doesn't ask for it.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct HybridSig {
+    /// Dilithium3 signature
+    pub post_quantum: Vec<u8>,
+    /// Schnorr signature
+    pub classical: Vec<u8>,
+}
+
+impl HybridSig {
+    pub fn new(post_quantum: Vec<u8>, classical: Vec<u8>) -> Self {
+        Self {
+            post_quantum,
+            classical,
+        }
+    }
+
+    pub fn classical(classical: Vec<u8>) -> Self {
+        Self::new(Vec::new(), classical)
+    }
+
+    pub fn post_quantum(post_quantum: Vec<u8>) -> Self {
+        Self::new(post_quantum, Vec::new())
+    }
+
+    /// The Dilithium3 signature followed by the Schnorr one
+    pub fn to_bytes(&self) -> Vec<u8> {
+        [&self.post_quantum[..], &self.classical[..]].concat()
+    }
+
+    /// Split a signature back into its halves, told apart by length
+    pub fn from_bytes(bytes: &[u8]) -> Result<Self, String> {
+        match bytes.len() {
+            len if len == dilithium3::SIGNBYTES + SCHNORR_SIGNATURE_BYTES => {
+                let (post_quantum, classical) = bytes.split_at(dilithium3::SIGNBYTES);
+                Ok(Self::new(post_quantum.to_vec(), classical.to_vec()))
+            }
+            len if len == dilithium3::SIGNBYTES => Ok(Self::post_quantum(bytes.to_vec())),
+            SCHNORR_SIGNATURE_BYTES => Ok(Self::classical(bytes.to_vec())),
+            len => Err(format!("Invalid hybrid signature length: {}", len)),
+        }
+    }
+}
+
+impl From<HybridSig> for SerializableSignature {
+    fn from(sig: HybridSig) -> Self {
+        SerializableSignature::from(sig.to_bytes())
+    }
+}
+
+/// Scheme a participant of `scheme` signs with under `mode`: one half of a
+/// hybrid key in the classical, aggregate and post-quantum modes. Fails if
+/// the mode doesn't admit the scheme.
+pub fn signing_scheme(mode: Option<SignatureMode>, scheme: SchemeId) -> Result<SchemeId, String> {
+    let hybrid = scheme == SignatureScheme::Dilithium3Schnorr.id();
+    let classical = scheme == SignatureScheme::Schnorr.id();
+    match mode {
+        None => Ok(scheme),
+        Some(SignatureMode::Hybrid) if hybrid => Ok(scheme),
+        Some(SignatureMode::Classical | SignatureMode::Aggregate) if hybrid || classical => {
+            Ok(SignatureScheme::Schnorr.id())
+        }
+        Some(SignatureMode::PostQuantum) if hybrid => Ok(SignatureScheme::Dilithium3.id()),
+        Some(SignatureMode::PostQuantum) if !classical => Ok(scheme),
+        Some(mode) => Err(format!("Scheme {:?} can't sign in {:?} mode", scheme, mode)),
+    }
+}
+
+/// Key out of `public_key` of a `scheme` participant that signs under `mode`
+pub fn signing_key(
+    mode: Option<SignatureMode>,
+    scheme: SchemeId,
+    public_key: &[u8],
+) -> Result<&[u8], String> {
+    let signing = signing_scheme(mode, scheme)?;
+    if signing == scheme {
+        return Ok(public_key);
+    }
+    lookup_scheme(scheme)?.check_public_key_len(public_key.len())?;
+    let (post_quantum, classical) =
+        public_key.split_at(public_key.len() - SCHNORR_PUBLIC_KEY_BYTES);
+    if signing == SignatureScheme::Schnorr.id() {
+        Ok(classical)
+    } else {
+        Ok(post_quantum)
+    }
+}
+
+/// Check the length of a `scheme` participant's signature under `mode`
+pub fn check_signature_len(
+    mode: Option<SignatureMode>,
+    scheme: SchemeId,
+    len: usize,
+) -> Result<(), String> {
+    lookup_scheme(signing_scheme(mode, scheme)?)?.check_signature_len(len)
+}
+
+/// Check the length of a `scheme` participant's signature under some mode,
+/// for decoders that don't know the params. A Schnorr nonce stands for the
+/// signature in the aggregate mode.
+pub fn check_any_signature_len(scheme: SchemeId, len: usize) -> Result<(), String> {
+    let hybrid = scheme == SignatureScheme::Dilithium3Schnorr.id();
+    let half = [dilithium3::SIGNBYTES, SCHNORR_SIGNATURE_BYTES].contains(&len);
+    if half && hybrid {
+        return Ok(());
+    }
+    if len == NONCE_BYTES && (hybrid || scheme == SignatureScheme::Schnorr.id()) {
+        return Ok(());
+    }
+    check_signature_len(None, scheme, len)
+}
+
+/// Verify a `scheme` participant's signature with the key `mode` picks
+pub fn verify_signature(
+    mode: Option<SignatureMode>,
+    scheme: SchemeId,
+    public_key: &[u8],
+    msg: &[u8],
+    signature: &[u8],
+) -> Result<bool, String> {
+    let key = signing_key(mode, scheme, public_key)?;
+    crate::scheme::verify_signature(signing_scheme(mode, scheme)?, key, msg, signature)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant, Verifier};
+    use crate::merkle::{HashAlgorithm, Hashing};
+    use crate::signer::{DilithiumSigner, HybridSigner, Signer};
+    use crate::stateproof::voters_commitment;
+
+    #[test]
+    fn test_hybrid_certificates() {
+        let signers: Vec<HybridSigner> = (0..3).map(|_| HybridSigner::new().unwrap()).collect();
+        let participants: Vec<Participant> = signers
+            .iter()
+            .map(|signer| Participant::from_signer(signer, 40))
+            .collect();
+        let hybrid = SignatureScheme::Dilithium3Schnorr.id();
+        let public_key = signers[0].public_key();
+        let msg = b"Test message";
+
+        // The registry verifies both halves of a hybrid signature
+        let sig = signers[0].sign_hybrid(None, msg);
+        assert!(
+            crate::scheme::verify_signature(hybrid, &public_key, msg, &sig.to_bytes()).unwrap()
+        );
+        let mut forged = sig.clone();
+        forged.classical = signers[1].sign_hybrid(None, msg).classical;
+        assert!(
+            !crate::scheme::verify_signature(hybrid, &public_key, msg, &forged.to_bytes()).unwrap()
+        );
+        let half = HybridSig::post_quantum(sig.post_quantum.clone()).to_bytes();
+        assert!(crate::scheme::verify_signature(hybrid, &public_key, msg, &half).is_err());
+        assert_eq!(
+            HybridSig::from_bytes(&half).unwrap().classical,
+            Vec::<u8>::new()
+        );
+
+        // A Dilithium-only participant can't sign in classical or hybrid mode
+        let dilithium = DilithiumSigner::new().unwrap().scheme();
+        assert!(signing_scheme(Some(SignatureMode::Classical), dilithium).is_err());
+        assert!(signing_scheme(Some(SignatureMode::Hybrid), dilithium).is_err());
+        assert_eq!(
+            signing_scheme(Some(SignatureMode::PostQuantum), dilithium),
+            Ok(dilithium)
+        );
+
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let root = voters_commitment(hashing, &participants).unwrap();
+        for mode in [
+            None,
+            Some(SignatureMode::Classical),
+            Some(SignatureMode::PostQuantum),
+            Some(SignatureMode::Hybrid),
+            Some(SignatureMode::Aggregate),
+        ] {
+            let params = crate::ccok::Params {
+                msg: msg.to_vec(),
+                proven_weight: 60,
+                security_param: 16,
+                scheme: Some(hybrid),
+                signature_mode: mode,
+                ..Default::default()
+            };
+            let message = params.signing_message();
+            let mut builder = Builder::new(params.clone(), participants.clone(), root.clone())
+                .unwrap()
+                .with_verify_workers(1)
+                .unwrap();
+            // A signature with the halves of another mode is refused
+            let other = match mode {
+                Some(SignatureMode::Classical | SignatureMode::Aggregate) => None,
+                _ => Some(SignatureMode::Classical),
+            };
+            assert!(builder
+                .add_signature(0, signers[0].sign_hybrid(other, &message))
+                .is_err());
+            for (i, signer) in signers.iter().enumerate() {
+                builder
+                    .add_signature(i, signer.sign_hybrid(mode, &message))
+                    .unwrap();
+            }
+            let cert = builder.build().unwrap();
+            assert!(Verifier::new(root.clone()).verify(&cert, &params).unwrap());
+
+            // Verified in another mode, the reveals carry the wrong halves
+            let mut other_params = params.clone();
+            other_params.signature_mode = other;
+            assert!(!Verifier::new(root.clone())
+                .verify(&cert, &other_params)
+                .unwrap_or(false));
+
+            // Aggregated, the reveals keep the nonces, which pass only with a
+            // matching aggregate
+            if mode == Some(SignatureMode::Aggregate) {
+                assert!(cert.reveals.values().all(|reveal| reveal
+                    .sig_slot
+                    .signature
+                    .as_ref()
+                    .is_some_and(|sig| sig.as_bytes().len() == NONCE_BYTES)));
+                other_params.signature_mode = Some(SignatureMode::Classical);
+                assert!(!Verifier::new(root.clone())
+                    .verify(&cert, &other_params)
+                    .unwrap_or(false));
+                let mut tampered = cert.clone();
+                tampered.aggregate_sig[31] ^= 1;
+                assert!(!Verifier::new(root.clone())
+                    .verify(&tampered, &params)
+                    .unwrap());
+            } else {
+                assert!(cert.aggregate_sig.is_empty());
+            }
+        }
+    }
+}
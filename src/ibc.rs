@@ -0,0 +1,484 @@
+//! IBC-style packet commitments. The chain keeps its packet commitments,
+//! receipts and acknowledgements in a sparse Merkle tree under ICS-24 paths,
+//! e.g. `commitments/ports/{port}/channels/{channel}/sequences/{sequence}`.
+//! Values are hashed as ICS-04 specifies, so a Cosmos relayer can compare them
+//! with its own. The tree root is the `commitment_root` of every block header.
+//! A certified header commits to it, so a `PacketProof` carries the header and
+//! its path to the interval's headers commitment, plus the commitment's path
+//! to the root. A counterparty's light client checks both.
+use crate::block::BlockHeader;
+use crate::lightclient::Client;
+use crate::merkle::{AuditPath, HashDomain, Hashing};
+use crate::smt::{SmtAbsenceProof, SmtProof, SparseMerkleTree};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+/// Path of the commitment of a sent packet
+pub fn packet_commitment_path(port: &str, channel: &str, sequence: u64) -> String {
+    format!(
+        "commitments/ports/{}/channels/{}/sequences/{}",
+        port, channel, sequence
+    )
+}
+
+/// Path of the receipt of a received packet
+pub fn packet_receipt_path(port: &str, channel: &str, sequence: u64) -> String {
+    format!(
+        "receipts/ports/{}/channels/{}/sequences/{}",
+        port, channel, sequence
+    )
+}
+
+/// Path of the acknowledgement of a received packet
+pub fn packet_ack_path(port: &str, channel: &str, sequence: u64) -> String {
+    format!(
+        "acks/ports/{}/channels/{}/sequences/{}",
+        port, channel, sequence
+    )
+}
+
+/// Path of the next sequence sent on a channel
+pub fn next_sequence_send_path(port: &str, channel: &str) -> String {
+    format!("nextSequenceSend/ports/{}/channels/{}", port, channel)
+}
+
+/// Value of a packet receipt, as in ibc-go
+pub const RECEIPT: &[u8] = &[1];
+
+/// Packet sent from a port and channel to a counterparty's
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Packet {
+    pub sequence: u64,
+    pub source_port: String,
+    pub source_channel: String,
+    pub destination_port: String,
+    pub destination_channel: String,
+    pub data: Vec<u8>,
+    /// Counterparty height from which the packet times out, 0 for none
+    pub timeout_height: u64,
+    /// Counterparty time in nanoseconds from which the packet times out, 0
+    /// for none
+    pub timeout_timestamp: u64,
+}
+
+impl Packet {
+    /// ICS-04 commitment: the SHA-256 of the timeout timestamp, the timeout
+    /// revision number and height, all big-endian, and the SHA-256 of the data.
+    /// The sidechain has a single revision, 0.
+    pub fn commitment(&self) -> [u8; 32] {
+        let mut hasher = Sha256::new();
+        hasher.update(self.timeout_timestamp.to_be_bytes());
+        hasher.update(0u64.to_be_bytes());
+        hasher.update(self.timeout_height.to_be_bytes());
+        hasher.update(Sha256::digest(&self.data));
+        hasher.finalize().into()
+    }
+
+    pub fn commitment_path(&self) -> String {
+        packet_commitment_path(&self.source_port, &self.source_channel, self.sequence)
+    }
+
+    pub fn receipt_path(&self) -> String {
+        packet_receipt_path(
+            &self.destination_port,
+            &self.destination_channel,
+            self.sequence,
+        )
+    }
+
+    pub fn ack_path(&self) -> String {
+        packet_ack_path(
+            &self.destination_port,
+            &self.destination_channel,
+            self.sequence,
+        )
+    }
+
+    /// Whether the packet timed out at counterparty `height` and `timestamp`
+    pub fn timed_out(&self, height: u64, timestamp: u64) -> bool {
+        (self.timeout_height != 0 && height >= self.timeout_height)
+            || (self.timeout_timestamp != 0 && timestamp >= self.timeout_timestamp)
+    }
+}
+
+/// ICS-04 commitment of an acknowledgement, its SHA-256
+pub fn ack_commitment(ack: &[u8]) -> [u8; 32] {
+    Sha256::digest(ack).into()
+}
+
+/// Sparse Merkle path of a commitment proof
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub enum CommitmentWitness {
+    /// The path holds the value
+    Present(SmtProof),
+    /// The path is empty
+    Absent(SmtAbsenceProof),
+}
+
+/// Proof of the value at a path under a commitment root
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CommitmentProof {
+    pub path: String,
+    /// Value at the path, `None` if it is empty
+    pub value: Option<Vec<u8>>,
+    pub proof: CommitmentWitness,
+}
+
+impl CommitmentProof {
+    /// Check the value at the path against `root`
+    pub fn verify(&self, hashing: Hashing, root: &[u8; 32]) -> bool {
+        let key = path_key(hashing, &self.path);
+        match (&self.proof, &self.value) {
+            (CommitmentWitness::Present(proof), Some(value)) => {
+                proof.verify(hashing, root, &key, value)
+            }
+            (CommitmentWitness::Absent(proof), None) => proof.verify(hashing, root, &key),
+            _ => false,
+        }
+    }
+}
+
+/// Key of `path` in the commitment tree
+pub fn path_key(hashing: Hashing, path: &str) -> [u8; 32] {
+    hashing.hash(HashDomain::Leaf, path.as_bytes())
+}
+
+/// Packet commitments, receipts and acknowledgements of the chain
+#[derive(Debug, Clone)]
+pub struct CommitmentStore {
+    tree: SparseMerkleTree,
+}
+
+impl CommitmentStore {
+    pub fn new(hashing: Hashing) -> Self {
+        Self {
+            tree: SparseMerkleTree::new(hashing),
+        }
+    }
+
+    pub fn hashing(&self) -> Hashing {
+        self.tree.hashing()
+    }
+
+    /// Commitment root, committed in block headers
+    pub fn root(&self) -> [u8; 32] {
+        self.tree.root()
+    }
+
+    pub fn get(&self, path: &str) -> Option<&[u8]> {
+        self.tree.get(&path_key(self.hashing(), path))
+    }
+
+    pub fn set(&mut self, path: &str, value: Vec<u8>) {
+        self.tree.insert(path_key(self.hashing(), path), value);
+    }
+
+    pub fn delete(&mut self, path: &str) {
+        self.tree.remove(&path_key(self.hashing(), path));
+    }
+
+    /// Next sequence to send on a channel, starting at 1
+    pub fn next_sequence_send(&self, port: &str, channel: &str) -> u64 {
+        self.get(&next_sequence_send_path(port, channel))
+            .and_then(|bytes| bytes.try_into().ok())
+            .map_or(1, u64::from_be_bytes)
+    }
+
+    /// Commit to `packet`, which must carry its channel's next sequence
+    pub fn send_packet(&mut self, packet: &Packet) -> Result<(), String> {
+        let (port, channel) = (&packet.source_port, &packet.source_channel);
+        let next = self.next_sequence_send(port, channel);
+        if packet.sequence != next {
+            return Err(format!(
+                "Packet sequence {} on {}/{}, expected {}",
+                packet.sequence, port, channel, next
+            ));
+        }
+        self.set(&packet.commitment_path(), packet.commitment().to_vec());
+        self.set(
+            &next_sequence_send_path(port, channel),
+            (next + 1).to_be_bytes().to_vec(),
+        );
+        Ok(())
+    }
+
+    /// Record receiving `packet` at `height` and `timestamp` of this chain
+    pub fn receive_packet(
+        &mut self,
+        packet: &Packet,
+        height: u64,
+        timestamp: u64,
+    ) -> Result<(), String> {
+        if packet.timed_out(height, timestamp) {
+            return Err(format!("Packet {} timed out", packet.sequence));
+        }
+        let path = packet.receipt_path();
+        if self.get(&path).is_some() {
+            return Err(format!("Packet {} already received", packet.sequence));
+        }
+        self.set(&path, RECEIPT.to_vec());
+        Ok(())
+    }
+
+    /// Commit to the acknowledgement of a received packet
+    pub fn write_ack(&mut self, packet: &Packet, ack: &[u8]) -> Result<(), String> {
+        if self.get(&packet.receipt_path()).is_none() {
+            return Err(format!("Packet {} was not received", packet.sequence));
+        }
+        let path = packet.ack_path();
+        if self.get(&path).is_some() {
+            return Err(format!("Packet {} already acknowledged", packet.sequence));
+        }
+        self.set(&path, ack_commitment(ack).to_vec());
+        Ok(())
+    }
+
+    /// Drop the commitment of a sent packet once it was acknowledged or timed
+    /// out on the counterparty
+    pub fn delete_packet_commitment(&mut self, packet: &Packet) -> Result<(), String> {
+        let path = packet.commitment_path();
+        if self.get(&path) != Some(&packet.commitment()[..]) {
+            return Err(format!("No commitment to packet {}", packet.sequence));
+        }
+        self.delete(&path);
+        Ok(())
+    }
+
+    /// Prove the value at `path`, or that it is empty
+    pub fn prove(&self, path: &str) -> Result<CommitmentProof, String> {
+        let key = path_key(self.hashing(), path);
+        let (value, proof) = match self.tree.get(&key) {
+            Some(value) => (
+                Some(value.to_vec()),
+                CommitmentWitness::Present(self.tree.prove(&key)?),
+            ),
+            None => (
+                None,
+                CommitmentWitness::Absent(self.tree.prove_absence(&key)?),
+            ),
+        };
+        Ok(CommitmentProof {
+            path: path.to_string(),
+            value,
+            proof,
+        })
+    }
+}
+
+/// Commitment proof at a certified header, as sent to the counterparty
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PacketProof {
+    pub header: BlockHeader,
+    /// Path of the header to its interval's headers commitment
+    pub header_path: AuditPath,
+    pub commitment: CommitmentProof,
+}
+
+impl PacketProof {
+    pub fn new(
+        header: BlockHeader,
+        header_path: AuditPath,
+        store: &CommitmentStore,
+        path: &str,
+    ) -> Result<Self, String> {
+        if store.root() != header.commitment_root {
+            return Err(format!(
+                "Commitment store is not the one of block {}",
+                header.height
+            ));
+        }
+        Ok(Self {
+            header,
+            header_path,
+            commitment: store.prove(path)?,
+        })
+    }
+
+    /// Check that the header is certified for `client` and commits to the
+    /// value at `path`, `None` for an empty path
+    pub fn verify(
+        &self,
+        client: &Client,
+        hashing: Hashing,
+        path: &str,
+        value: Option<&[u8]>,
+    ) -> Result<(), String> {
+        client.verify_header(&self.header, &self.header_path)?;
+        let proof = &self.commitment;
+        if proof.path != path || proof.value.as_deref() != value {
+            return Err(format!("Proof is not for the expected value at {}", path));
+        }
+        if !proof.verify(hashing, &self.header.commitment_root) {
+            return Err(format!(
+                "Invalid commitment proof at {} for block {}",
+                path, self.header.height
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Check that the sidechain committed to sending `packet`
+pub fn verify_packet_commitment(
+    client: &Client,
+    hashing: Hashing,
+    proof: &PacketProof,
+    packet: &Packet,
+) -> Result<(), String> {
+    proof.verify(
+        client,
+        hashing,
+        &packet.commitment_path(),
+        Some(&packet.commitment()),
+    )
+}
+
+/// Check that the sidechain acknowledged `packet` with `ack`
+pub fn verify_packet_ack(
+    client: &Client,
+    hashing: Hashing,
+    proof: &PacketProof,
+    packet: &Packet,
+    ack: &[u8],
+) -> Result<(), String> {
+    proof.verify(
+        client,
+        hashing,
+        &packet.ack_path(),
+        Some(&ack_commitment(ack)),
+    )
+}
+
+/// Check that the sidechain had not received `packet` at a header past its
+/// timeout, so the sender can time it out
+pub fn verify_packet_timeout(
+    client: &Client,
+    hashing: Hashing,
+    proof: &PacketProof,
+    packet: &Packet,
+) -> Result<(), String> {
+    if !packet.timed_out(proof.header.height, proof.header.timestamp) {
+        return Err(format!(
+            "Packet {} has not timed out at block {}",
+            packet.sequence, proof.header.height
+        ));
+    }
+    proof.verify(client, hashing, &packet.receipt_path(), None)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::block::{Block, BlockBuilder};
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::config::STATE_PROOF_INTERVAL;
+    use crate::mempool::Mempool;
+    use crate::stateproof::{prove_header, voters_commitment, StateProof, StateProofMessage};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_packet_proofs() {
+        let template = Params {
+            proven_weight: 5,
+            ..Default::default()
+        };
+        let hashing = template.hashing();
+        let packet = |sequence: u64| Packet {
+            sequence,
+            source_port: "transfer".to_string(),
+            source_channel: "channel-0".to_string(),
+            destination_port: "transfer".to_string(),
+            destination_channel: "channel-7".to_string(),
+            data: format!("packet {}", sequence).into_bytes(),
+            timeout_height: 10,
+            timeout_timestamp: 0,
+        };
+
+        // The sidechain sends two packets and receives one
+        let mut store = CommitmentStore::new(hashing);
+        assert!(store.send_packet(&packet(2)).is_err());
+        store.send_packet(&packet(1)).unwrap();
+        store.send_packet(&packet(2)).unwrap();
+        let incoming = packet(5);
+        store.receive_packet(&incoming, 3, 0).unwrap();
+        assert!(store.receive_packet(&incoming, 3, 0).is_err());
+        store.write_ack(&incoming, b"ok").unwrap();
+        assert!(store.receive_packet(&packet(6), 10, 0).is_err());
+
+        // Blocks commit to the store, and the interval gets certified
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let voters = vec![Participant::from_signer(&wallet, 10)];
+        let root = voters_commitment(hashing, &voters).unwrap();
+        let mut blocks: Vec<Block> = Vec::new();
+        for id in 1..=STATE_PROOF_INTERVAL as usize {
+            let block = BlockBuilder::new(
+                blocks.last(),
+                id,
+                Account {
+                    address: "proposer".to_string(),
+                },
+                String::new(),
+                Seed {
+                    seed: [id as u8; 32],
+                },
+            )
+            .with_commitment_root(store.root())
+            .build(&mut Mempool::new())
+            .unwrap();
+            blocks.push(block);
+        }
+        let message = StateProofMessage::new(hashing, &blocks, root.clone()).unwrap();
+        let params = message.params(&template).unwrap();
+        let mut builder = Builder::new(params.clone(), voters, root.clone()).unwrap();
+        builder
+            .add_signature(0, wallet.sign_message(&params.signing_message()))
+            .unwrap();
+        let proof = StateProof {
+            message,
+            certificate: builder.build().unwrap(),
+        };
+        let mut client = Client::new(template.clone(), STATE_PROOF_INTERVAL, root);
+        client.advance(&proof).unwrap();
+
+        // The counterparty checks commitments, acks and timeouts
+        let at = |index: usize, path: &str| {
+            PacketProof::new(
+                blocks[index].header(),
+                prove_header(hashing, &blocks, index).unwrap(),
+                &store,
+                path,
+            )
+            .unwrap()
+        };
+        let sent = at(3, &packet(2).commitment_path());
+        verify_packet_commitment(&client, hashing, &sent, &packet(2)).unwrap();
+        assert!(verify_packet_commitment(&client, hashing, &sent, &packet(1)).is_err());
+        let mut forged = packet(2);
+        forged.data = b"forged".to_vec();
+        assert!(verify_packet_commitment(&client, hashing, &sent, &forged).is_err());
+        let acked = at(3, &incoming.ack_path());
+        verify_packet_ack(&client, hashing, &acked, &incoming, b"ok").unwrap();
+        assert!(verify_packet_ack(&client, hashing, &acked, &incoming, b"error").is_err());
+
+        let missing = packet(6);
+        let early = at(3, &missing.receipt_path());
+        assert!(verify_packet_timeout(&client, hashing, &early, &missing).is_err());
+        let late = at(11, &missing.receipt_path());
+        verify_packet_timeout(&client, hashing, &late, &missing).unwrap();
+        let received = at(11, &incoming.receipt_path());
+        assert!(verify_packet_timeout(&client, hashing, &received, &incoming).is_err());
+
+        // Acknowledged packets stop being committed
+        store.delete_packet_commitment(&packet(1)).unwrap();
+        assert!(store.delete_packet_commitment(&packet(1)).is_err());
+        assert!(PacketProof::new(
+            blocks[0].header(),
+            prove_header(hashing, &blocks, 0).unwrap(),
+            &store,
+            &packet(2).commitment_path(),
+        )
+        .is_err());
+    }
+}
@@ -0,0 +1,410 @@
+//! Interactive verification, for channels where a verifier can talk to the
+//! prover, e.g. between two sidechains. The `Prover` first commits to its
+//! signatures; the `Challenger` then draws fresh coins over one or more
+//! rounds, and the prover answers each round with the reveals its coins land
+//! on. A prover can't grind coins it only sees after committing, so the
+//! coins need only the statistical soundness of the challenger rather than
+//! the security parameter of the params, and a session moves fewer reveals
+//! than a certificate. Messages are length-prefixed bincode frames over any
+//! `Read + Write` stream.
+use crate::ccok::{Builder, Params, Reveal, SigSlot, MAX_COINS};
+use crate::error::CcokError;
+use crate::logging::VERIFIER;
+use crate::merkle::MerkleTreeBuilder;
+use crate::remotesigner::{read_frame, write_frame};
+use log::debug;
+use rand::Rng;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::io::{Read, Write};
+
+/// Bits of soundness of a challenger unless configured otherwise: a prover
+/// without the weight it claims passes with probability at most 2^-64
+pub const DEFAULT_SOUNDNESS: u32 = 64;
+
+/// What the prover commits to before seeing any coin
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Commitment {
+    /// Root of the signature tree
+    pub sig_commit: Vec<u8>,
+    pub signed_weight: u64,
+    /// Number of slots of the signature tree. The roots don't bind it: a
+    /// carried odd node hashes the same in trees of several sizes, so any of
+    /// those sizes verifies the same proofs. That leaves the revealed leaves
+    /// and their positions bound by both roots, which is what soundness needs.
+    pub total_sigs: usize,
+}
+
+/// Answer to the coins of one round
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Response {
+    /// Reveals the coins land on, in position order
+    pub reveals: Vec<(u64, Reveal)>,
+    /// Multiproof of the revealed slots in the signature tree
+    pub sig_proofs: Vec<Vec<u8>>,
+    /// Multiproof of the revealed participants in the party tree
+    pub party_proofs: Vec<Vec<u8>>,
+}
+
+/// Message of the prover
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum ProverMessage {
+    Commit(Commitment),
+    Response(Response),
+}
+
+/// Message of the challenger
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum ChallengerMessage {
+    /// Coins of a round, each in `[0, signed_weight)`
+    Challenge(Vec<u64>),
+    /// Outcome of the session, after the last round or the first failure
+    Verdict(bool),
+}
+
+/// Proves the signatures collected by a builder
+pub struct Prover<'a> {
+    builder: &'a Builder,
+    sigs: Vec<SigSlot>,
+    sig_tree: MerkleTreeBuilder,
+    party_tree: MerkleTreeBuilder,
+    // Signed positions and the end of their weight range, in position order
+    ends: Vec<(usize, u64)>,
+}
+
+impl<'a> Prover<'a> {
+    /// Prover of the signatures of `builder`, which must reach its proven weight
+    pub fn new(builder: &'a Builder) -> Result<Self, CcokError> {
+        builder.params.validate()?;
+        if builder.signed_weight < builder.params.proven_weight {
+            return Err(CcokError::InsufficientWeight {
+                signed: builder.signed_weight,
+                proven: builder.params.proven_weight,
+            });
+        }
+        // Weight ranges follow the positions, whatever order signatures came in
+        let mut sigs = builder.sigs.clone();
+        let mut ends = Vec::new();
+        let mut acc = 0u64;
+        for (pos, (slot, party)) in sigs.iter_mut().zip(&builder.participants).enumerate() {
+            slot.accumulated_weight = acc;
+            if slot.signature.is_some() {
+                acc = acc
+                    .checked_add(party.weight)
+                    .ok_or(CcokError::WeightOverflow)?;
+                ends.push((pos, acc));
+            }
+        }
+        let hashing = builder.params.hashing();
+        let mut sig_tree = MerkleTreeBuilder::with_hash(hashing);
+        sig_tree.build(&sigs)?;
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree.build(&builder.participants)?;
+        Ok(Self {
+            builder,
+            sigs,
+            sig_tree,
+            party_tree,
+            ends,
+        })
+    }
+
+    pub fn commitment(&self) -> Commitment {
+        Commitment {
+            sig_commit: self.sig_tree.root(),
+            signed_weight: self.builder.signed_weight,
+            total_sigs: self.sigs.len(),
+        }
+    }
+
+    /// Reveal the positions `coins` land on
+    pub fn respond(&self, coins: &[u64]) -> Result<Response, CcokError> {
+        let mut reveals = BTreeMap::new();
+        for (index, &coin) in coins.iter().enumerate() {
+            let i = self.ends.partition_point(|&(_, end)| end <= coin);
+            let Some(&(pos, _)) = self.ends.get(i) else {
+                return Err(CcokError::UnrevealedCoin {
+                    index: index as u64,
+                    coin,
+                });
+            };
+            reveals.entry(pos as u64).or_insert_with(|| Reveal {
+                sig_slot: self.sigs[pos].clone(),
+                party: self.builder.participants[pos].clone(),
+                public_key: self.builder.revealed_key(pos).cloned(),
+            });
+        }
+        let positions: Vec<usize> = reveals.keys().map(|&pos| pos as usize).collect();
+        Ok(Response {
+            sig_proofs: self.sig_tree.prove(&positions),
+            party_proofs: self.party_tree.prove(&positions),
+            reveals: reveals.into_iter().collect(),
+        })
+    }
+
+    /// Run a session over `stream`, answering challenges until the
+    /// challenger's verdict
+    pub fn run(&self, stream: &mut (impl Read + Write)) -> Result<bool, String> {
+        write_frame(stream, &ProverMessage::Commit(self.commitment()))?;
+        loop {
+            match read_frame(stream)? {
+                ChallengerMessage::Challenge(coins) => {
+                    let response = self.respond(&coins)?;
+                    write_frame(stream, &ProverMessage::Response(response))?;
+                }
+                ChallengerMessage::Verdict(accepted) => return Ok(accepted),
+            }
+        }
+    }
+}
+
+/// Verifies a prover by challenging it
+pub struct Challenger<'a> {
+    params: &'a Params,
+    party_tree_root: &'a [u8],
+    soundness: u32,
+    rounds: usize,
+}
+
+impl<'a> Challenger<'a> {
+    /// Challenger of provers of `params` over the party tree `party_tree_root`,
+    /// drawing every coin in a single round
+    pub fn new(params: &'a Params, party_tree_root: &'a [u8]) -> Self {
+        Self {
+            params,
+            party_tree_root,
+            soundness: DEFAULT_SOUNDNESS,
+            rounds: 1,
+        }
+    }
+
+    /// Accept a cheating prover with probability at most 2^-`bits`
+    pub fn with_soundness(mut self, bits: u32) -> Self {
+        self.soundness = bits;
+        self
+    }
+
+    /// Spread the coins over `rounds` rounds, so a failing prover is caught
+    /// before the last
+    pub fn with_rounds(mut self, rounds: usize) -> Self {
+        self.rounds = rounds.max(1);
+        self
+    }
+
+    /// Coins a session over `signed_weight` draws: each lands on a cheater's
+    /// signature with probability at most `proven_weight / signed_weight`
+    pub fn num_coins(&self, signed_weight: u64) -> Result<usize, CcokError> {
+        let ratio = signed_weight as f64 / self.params.proven_weight as f64;
+        let coins = (self.soundness as f64 / ratio.log2()).ceil();
+        if signed_weight <= self.params.proven_weight || coins > MAX_COINS as f64 {
+            return Err(CcokError::InsufficientWeight {
+                signed: signed_weight,
+                proven: self.params.proven_weight,
+            });
+        }
+        Ok(std::cmp::max(1, coins as usize))
+    }
+
+    /// Fresh coins of a round
+    pub fn challenge(&self, signed_weight: u64, count: usize) -> Vec<u64> {
+        let mut rng = rand::thread_rng();
+        (0..count)
+            .map(|_| rng.gen_range(0..signed_weight))
+            .collect()
+    }
+
+    /// Check the answer to `coins` of the prover committed to `commitment`:
+    /// every coin lands on a reveal, every reveal on a coin, and the
+    /// reveals are signed and in both trees
+    pub fn check_response(
+        &self,
+        commitment: &Commitment,
+        coins: &[u64],
+        response: &Response,
+    ) -> Result<bool, CcokError> {
+        let reveals = &response.reveals;
+        if let Some(pair) = reveals.windows(2).find(|pair| pair[0].0 >= pair[1].0) {
+            return Err(CcokError::InvalidReveal(pair[1].0));
+        }
+        if let Some((pos, _)) = reveals
+            .iter()
+            .find(|(pos, _)| *pos >= commitment.total_sigs as u64)
+        {
+            return Err(CcokError::InvalidReveal(*pos));
+        }
+        let mut landed = vec![false; reveals.len()];
+        for (index, &coin) in coins.iter().enumerate() {
+            let range = |reveal: &Reveal| {
+                let start = reveal.sig_slot.accumulated_weight;
+                start
+                    .checked_add(reveal.party.weight)
+                    .map(|end| start <= coin && coin < end)
+            };
+            let Some(i) = reveals
+                .iter()
+                .position(|(_, reveal)| range(reveal) == Some(true))
+            else {
+                debug!(target: VERIFIER, "Coin {} lands on no reveal", index);
+                return Ok(false);
+            };
+            landed[i] = true;
+        }
+        if landed.contains(&false) {
+            debug!(target: VERIFIER, "Reveal no coin landed on");
+            return Ok(false);
+        }
+        for (pos, reveal) in reveals {
+            if !reveal.verify(self.params, *pos)? {
+                return Ok(false);
+            }
+        }
+
+        let hashing = self.params.hashing();
+        let positions: Vec<usize> = reveals.iter().map(|(pos, _)| *pos as usize).collect();
+        let sig_leaves = reveals
+            .iter()
+            .map(|(_, reveal)| hashing.leaf_hash(&reveal.sig_slot))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        let party_leaves = reveals
+            .iter()
+            .map(|(_, reveal)| hashing.leaf_hash(&reveal.party))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        if !MerkleTreeBuilder::verify_with(
+            hashing,
+            &commitment.sig_commit,
+            &response.sig_proofs,
+            &positions,
+            commitment.total_sigs,
+            &sig_leaves,
+        ) {
+            debug!(target: VERIFIER, "Signature Merkle proof verification failed");
+            return Ok(false);
+        }
+        if !MerkleTreeBuilder::verify_with(
+            hashing,
+            self.party_tree_root,
+            &response.party_proofs,
+            &positions,
+            commitment.total_sigs,
+            &party_leaves,
+        ) {
+            debug!(target: VERIFIER, "Participant Merkle proof verification failed");
+            return Ok(false);
+        }
+        Ok(true)
+    }
+
+    /// Run a session over `stream` and tell the prover the verdict
+    pub fn run(&self, stream: &mut (impl Read + Write)) -> Result<bool, String> {
+        let commitment = match read_frame(stream)? {
+            ProverMessage::Commit(commitment) => commitment,
+            ProverMessage::Response(_) => return Err("Expected a commitment".to_string()),
+        };
+        let result = self.challenge_rounds(stream, &commitment);
+        let accepted = matches!(result, Ok(true));
+        write_frame(stream, &ChallengerMessage::Verdict(accepted))?;
+        result
+    }
+
+    fn challenge_rounds(
+        &self,
+        stream: &mut (impl Read + Write),
+        commitment: &Commitment,
+    ) -> Result<bool, String> {
+        self.params.validate()?;
+        if commitment.signed_weight < self.params.proven_weight {
+            debug!(target: VERIFIER,
+                "Weight check failed: {} < {}",
+                commitment.signed_weight, self.params.proven_weight
+            );
+            return Ok(false);
+        }
+        let coins = self.num_coins(commitment.signed_weight)?;
+        let per_round = coins.div_ceil(self.rounds);
+        let mut remaining = coins;
+        while remaining > 0 {
+            let challenge = self.challenge(commitment.signed_weight, per_round.min(remaining));
+            remaining -= challenge.len();
+            write_frame(stream, &ChallengerMessage::Challenge(challenge.clone()))?;
+            let response = match read_frame(stream)? {
+                ProverMessage::Response(response) => response,
+                ProverMessage::Commit(_) => return Err("Expected a response".to_string()),
+            };
+            if !self.check_response(commitment, &challenge, &response)? {
+                return Ok(false);
+            }
+        }
+        Ok(true)
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::ccok::{num_coins, Participant, SecurityLevel};
+    use crate::wallet::Wallet;
+    use std::os::unix::net::UnixStream;
+
+    #[test]
+    fn test_interactive_session() {
+        let wallets: Vec<Wallet> = (0..6)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params::preset(SecurityLevel::Security128, b"Test message".to_vec(), 20);
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let mut builder = Builder::new(params.clone(), participants, root.clone()).unwrap();
+        // Signatures in any order give position-ordered weight ranges
+        for (pos, wallet) in wallets.iter().enumerate().skip(1).rev() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let prover = Prover::new(&builder).unwrap();
+        let challenger = Challenger::new(&params, &root).with_rounds(3);
+        assert!(challenger.num_coins(50).unwrap() < num_coins(&params, 50));
+
+        let (mut prover_end, mut challenger_end) = UnixStream::pair().unwrap();
+        let (proved, verified) = std::thread::scope(|scope| {
+            let proving = scope.spawn(|| prover.run(&mut prover_end));
+            let verified = challenger.run(&mut challenger_end);
+            (proving.join().unwrap(), verified)
+        });
+        assert_eq!(proved, Ok(true));
+        assert_eq!(verified, Ok(true));
+
+        // Tampered or incomplete answers are rejected
+        let commitment = prover.commitment();
+        let coins = challenger.challenge(commitment.signed_weight, 4);
+        let response = prover.respond(&coins).unwrap();
+        assert!(challenger
+            .check_response(&commitment, &coins, &response)
+            .unwrap());
+        let mut dropped = response.clone();
+        dropped.reveals.pop();
+        assert!(!challenger
+            .check_response(&commitment, &coins, &dropped)
+            .unwrap());
+        let mut forged = response.clone();
+        forged.reveals[0].1.sig_slot.accumulated_weight += 1;
+        assert!(!challenger
+            .check_response(&commitment, &coins, &forged)
+            .unwrap());
+        let mut recommitted = commitment.clone();
+        recommitted.sig_commit[0] ^= 1;
+        assert!(!challenger
+            .check_response(&recommitted, &coins, &response)
+            .unwrap());
+
+        // Provers short of the proven weight are turned away
+        let mut weak = Builder::new(params.clone(), builder.participants.clone(), root).unwrap();
+        weak.add_signature(0, wallets[0].sign_message(&params.signing_message()))
+            .unwrap();
+        assert!(Prover::new(&weak).is_err());
+    }
+}
@@ -0,0 +1,568 @@
+//! Human readable JSON export of certificates: byte fields are hex strings
+//! and 64-bit integers are decimal strings, which JavaScript tooling can't
+//! otherwise represent exactly.
+use crate::ccok::{self, SerializableSignature};
+use crate::ephemeral;
+use crate::hybrid;
+use crate::merkle::{CompressedProofSet, HashAlgorithm};
+use crate::scheme::{lookup_scheme, SchemeId};
+use crate::sumtree;
+use crate::vrf;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+// Length of every Merkle root and proof node
+const NODE_LEN: usize = 32;
+
+/// JSON form of a `Certificate`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct CertificateJson {
+    pub sig_commit: String,
+    pub signed_weight: String,
+    pub total_sigs: String,
+    pub reveals: Vec<RevealJson>,
+    pub sig_proofs: Vec<String>,
+    pub party_proofs: Vec<String>,
+    pub reveal_positions: Vec<String>,
+    pub reveal_indices: Vec<String>,
+    pub schemes: Vec<u16>,
+    pub compressed_sig_proofs: Option<String>,
+    pub compressed_party_proofs: Option<String>,
+    pub hash: String,
+    pub version: u8,
+    pub party_sum_proofs: Option<Vec<SumPathJson>>,
+    /// Empty before params version 4
+    #[serde(default)]
+    pub coin_seed: String,
+    /// Signature sum tree paths, from params version 5
+    #[serde(default)]
+    pub sig_sum_proofs: Option<Vec<SumPathJson>>,
+    /// Half-aggregate of the signatures, in the aggregate signature mode
+    #[serde(default)]
+    pub aggregate_sig: String,
+}
+
+/// JSON form of a `SumPath`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SumPathJson {
+    pub total_leaves: String,
+    pub siblings: Vec<SumNodeJson>,
+}
+
+impl From<&sumtree::SumPath> for SumPathJson {
+    fn from(path: &sumtree::SumPath) -> Self {
+        Self {
+            total_leaves: path.total_leaves.to_string(),
+            siblings: path
+                .siblings
+                .iter()
+                .map(|node| SumNodeJson {
+                    hash: hex::encode(node.hash),
+                    sum: node.sum.to_string(),
+                })
+                .collect(),
+        }
+    }
+}
+
+/// JSON form of a `SumNode`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SumNodeJson {
+    pub hash: String,
+    pub sum: String,
+}
+
+/// JSON form of a `Reveal` and its position
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RevealJson {
+    pub position: String,
+    pub signature: Option<String>,
+    pub accumulated_weight: String,
+    pub one_time_key: Option<OneTimeKeyJson>,
+    pub party: ParticipantJson,
+    #[serde(default)]
+    pub public_key: Option<String>,
+}
+
+/// JSON form of a `Participant`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ParticipantJson {
+    pub public_key: String,
+    pub weight: String,
+    pub scheme: u16,
+    pub key_commitment: Option<KeyCommitmentJson>,
+    pub vrf_key: Option<VrfKeyJson>,
+    #[serde(default)]
+    pub key_layout: ccok::KeyLayout,
+}
+
+/// JSON form of a `KeyCommitment`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct KeyCommitmentJson {
+    pub root: String,
+    pub first_round: String,
+    pub rounds: String,
+}
+
+/// JSON form of a `VrfPublicKey`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct VrfKeyJson {
+    pub root: String,
+    pub first_round: String,
+    pub rounds: String,
+}
+
+/// JSON form of a `OneTimeKeyProof`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct OneTimeKeyJson {
+    pub round: String,
+    pub public_key: String,
+    pub path: Vec<String>,
+}
+
+fn parse_u64(field: &str, value: &str) -> Result<u64, String> {
+    value
+        .parse()
+        .map_err(|e| format!("Invalid {} {:?}: {}", field, value, e))
+}
+
+fn parse_hex(field: &str, value: &str) -> Result<Vec<u8>, String> {
+    hex::decode(value).map_err(|e| format!("Invalid hex in {}: {}", field, e))
+}
+
+// A Merkle root or proof node
+fn parse_node(field: &str, value: &str) -> Result<Vec<u8>, String> {
+    let node = parse_hex(field, value)?;
+    if node.len() != NODE_LEN {
+        return Err(format!(
+            "Invalid {} length: {} (expected {})",
+            field,
+            node.len(),
+            NODE_LEN
+        ));
+    }
+    Ok(node)
+}
+
+fn parse_nodes(field: &str, values: &[String]) -> Result<Vec<Vec<u8>>, String> {
+    values
+        .iter()
+        .map(|value| parse_node(field, value))
+        .collect()
+}
+
+fn parse_compressed(field: &str, value: &str) -> Result<CompressedProofSet, String> {
+    let nodes = parse_hex(field, value)?;
+    if nodes.len() % NODE_LEN != 0 {
+        return Err(format!(
+            "Invalid {} length: {} is not a multiple of {}",
+            field,
+            nodes.len(),
+            NODE_LEN
+        ));
+    }
+    Ok(CompressedProofSet { nodes })
+}
+
+// A public key of `scheme`, kept in hex as in `Participant`
+fn parse_public_key(field: &str, value: &str, scheme: SchemeId) -> Result<String, String> {
+    let key = parse_hex(field, value)?;
+    lookup_scheme(scheme)?.check_public_key_len(key.len())?;
+    Ok(value.to_lowercase())
+}
+
+fn parse_sum_path(path: &SumPathJson) -> Result<sumtree::SumPath, String> {
+    let total_leaves = parse_u64("sum path leaf count", &path.total_leaves)?;
+    let siblings = path
+        .siblings
+        .iter()
+        .map(|node| {
+            let mut hash = [0u8; NODE_LEN];
+            hash.copy_from_slice(&parse_node("sum node hash", &node.hash)?);
+            Ok(sumtree::SumNode {
+                hash,
+                sum: parse_u64("sum node weight", &node.sum)?,
+            })
+        })
+        .collect::<Result<Vec<_>, String>>()?;
+    Ok(sumtree::SumPath {
+        total_leaves: usize::try_from(total_leaves)
+            .map_err(|_| format!("Invalid sum path leaf count {}", total_leaves))?,
+        siblings,
+    })
+}
+
+fn parse_hash(value: &str) -> Result<HashAlgorithm, String> {
+    HashAlgorithm::ALL
+        .into_iter()
+        .find(|hash| hash.name() == value)
+        .ok_or_else(|| format!("Unknown hash algorithm {:?}", value))
+}
+
+impl From<&ccok::Participant> for ParticipantJson {
+    fn from(party: &ccok::Participant) -> Self {
+        Self {
+            public_key: party.public_key.clone(),
+            weight: party.weight.to_string(),
+            scheme: party.scheme.0,
+            key_commitment: party
+                .key_commitment
+                .as_ref()
+                .map(|commitment| KeyCommitmentJson {
+                    root: hex::encode(&commitment.root),
+                    first_round: commitment.lifetime.first_round.to_string(),
+                    rounds: commitment.lifetime.rounds.to_string(),
+                }),
+            vrf_key: party.vrf_key.as_ref().map(|key| VrfKeyJson {
+                root: hex::encode(&key.root),
+                first_round: key.lifetime.first_round.to_string(),
+                rounds: key.lifetime.rounds.to_string(),
+            }),
+            key_layout: party.key_layout,
+        }
+    }
+}
+
+impl TryFrom<ParticipantJson> for ccok::Participant {
+    type Error = String;
+
+    fn try_from(party: ParticipantJson) -> Result<Self, String> {
+        let scheme = SchemeId(party.scheme);
+        let key_commitment = party
+            .key_commitment
+            .map(|commitment| -> Result<_, String> {
+                Ok(ephemeral::KeyCommitment {
+                    root: parse_node("key commitment root", &commitment.root)?,
+                    lifetime: ephemeral::KeyLifetime::new(
+                        parse_u64("first round", &commitment.first_round)?,
+                        parse_u64("rounds", &commitment.rounds)?,
+                    ),
+                })
+            })
+            .transpose()?;
+        let vrf_key = party
+            .vrf_key
+            .map(|key| -> Result<_, String> {
+                Ok(vrf::VrfPublicKey {
+                    root: parse_node("VRF key root", &key.root)?,
+                    lifetime: ephemeral::KeyLifetime::new(
+                        parse_u64("first round", &key.first_round)?,
+                        parse_u64("rounds", &key.rounds)?,
+                    ),
+                })
+            })
+            .transpose()?;
+        // Participants committing to a key digest carry the digest
+        let public_key = match party.key_layout {
+            ccok::KeyLayout::InLeaf => parse_public_key("public key", &party.public_key, scheme)?,
+            ccok::KeyLayout::InReveal => {
+                parse_node("public key digest", &party.public_key)?;
+                party.public_key.to_lowercase()
+            }
+        };
+        Ok(Self {
+            public_key,
+            weight: parse_u64("weight", &party.weight)?,
+            scheme,
+            key_commitment,
+            vrf_key,
+            key_layout: party.key_layout,
+        })
+    }
+}
+
+impl RevealJson {
+    /// JSON form of the reveal at `position`
+    pub fn new(position: u64, reveal: &ccok::Reveal) -> Self {
+        let slot = &reveal.sig_slot;
+        Self {
+            position: position.to_string(),
+            signature: slot.signature.as_ref().map(|s| hex::encode(s.as_bytes())),
+            accumulated_weight: slot.accumulated_weight.to_string(),
+            one_time_key: slot.one_time_key.as_ref().map(|proof| OneTimeKeyJson {
+                round: proof.round.to_string(),
+                public_key: proof.public_key.clone(),
+                path: proof.path.iter().map(hex::encode).collect(),
+            }),
+            party: ParticipantJson::from(&reveal.party),
+            public_key: reveal.public_key.clone(),
+        }
+    }
+
+    /// Position and reveal, with every field checked
+    pub fn parse(self) -> Result<(u64, ccok::Reveal), String> {
+        let position = parse_u64("position", &self.position)?;
+        let party = ccok::Participant::try_from(self.party)?;
+        lookup_scheme(party.scheme)?;
+        let signature = self
+            .signature
+            .map(|sig| -> Result<SerializableSignature, String> {
+                let sig = parse_hex("signature", &sig)?;
+                hybrid::check_any_signature_len(party.scheme, sig.len())?;
+                Ok(sig.into())
+            })
+            .transpose()?;
+        let one_time_key = self
+            .one_time_key
+            .map(|proof| -> Result<_, String> {
+                Ok(ephemeral::OneTimeKeyProof {
+                    round: parse_u64("one-time key round", &proof.round)?,
+                    public_key: parse_public_key(
+                        "one-time public key",
+                        &proof.public_key,
+                        party.scheme,
+                    )?,
+                    path: parse_nodes("one-time key path node", &proof.path)?,
+                })
+            })
+            .transpose()?;
+        let sig_slot = ccok::SigSlot {
+            signature,
+            accumulated_weight: parse_u64("accumulated weight", &self.accumulated_weight)?,
+            one_time_key,
+        };
+        let public_key = self
+            .public_key
+            .map(|key| parse_public_key("revealed public key", &key, party.scheme))
+            .transpose()?;
+        Ok((
+            position,
+            ccok::Reveal {
+                sig_slot,
+                party,
+                public_key,
+            },
+        ))
+    }
+}
+
+impl From<&ccok::Certificate> for CertificateJson {
+    fn from(cert: &ccok::Certificate) -> Self {
+        Self {
+            sig_commit: hex::encode(&cert.sig_commit),
+            signed_weight: cert.signed_weight.to_string(),
+            total_sigs: cert.total_sigs.to_string(),
+            reveals: cert
+                .reveals
+                .iter()
+                .map(|(pos, reveal)| RevealJson::new(*pos, reveal))
+                .collect(),
+            sig_proofs: cert.sig_proofs.iter().map(hex::encode).collect(),
+            party_proofs: cert.party_proofs.iter().map(hex::encode).collect(),
+            reveal_positions: cert.reveal_positions.iter().map(u64::to_string).collect(),
+            reveal_indices: cert.reveal_indices.iter().map(u64::to_string).collect(),
+            schemes: cert.schemes.iter().map(|s| s.0).collect(),
+            compressed_sig_proofs: cert
+                .compressed_sig_proofs
+                .as_ref()
+                .map(|p| hex::encode(&p.nodes)),
+            compressed_party_proofs: cert
+                .compressed_party_proofs
+                .as_ref()
+                .map(|p| hex::encode(&p.nodes)),
+            hash: cert.hash.name().to_string(),
+            version: cert.version,
+            party_sum_proofs: cert
+                .party_sum_proofs
+                .as_ref()
+                .map(|paths| paths.iter().map(SumPathJson::from).collect()),
+            coin_seed: hex::encode(&cert.coin_seed),
+            sig_sum_proofs: cert
+                .sig_sum_proofs
+                .as_ref()
+                .map(|paths| paths.iter().map(SumPathJson::from).collect()),
+            aggregate_sig: hex::encode(&cert.aggregate_sig),
+        }
+    }
+}
+
+impl TryFrom<CertificateJson> for ccok::Certificate {
+    type Error = String;
+
+    fn try_from(cert: CertificateJson) -> Result<Self, String> {
+        let mut reveals = BTreeMap::new();
+        for reveal in cert.reveals {
+            let (pos, reveal) = reveal.parse()?;
+            if reveals.insert(pos, reveal).is_some() {
+                return Err(format!("Duplicate reveal at position {}", pos));
+            }
+        }
+        let parse_all = |field: &str, values: &[String]| -> Result<Vec<u64>, String> {
+            values.iter().map(|value| parse_u64(field, value)).collect()
+        };
+        let total_sigs = parse_u64("total sigs", &cert.total_sigs)?;
+        Ok(Self {
+            sig_commit: parse_node("signature commitment", &cert.sig_commit)?,
+            signed_weight: parse_u64("signed weight", &cert.signed_weight)?,
+            total_sigs: usize::try_from(total_sigs)
+                .map_err(|_| format!("Invalid total sigs {}", total_sigs))?,
+            reveals,
+            sig_proofs: parse_nodes("signature proof", &cert.sig_proofs)?,
+            party_proofs: parse_nodes("participant proof", &cert.party_proofs)?,
+            reveal_positions: parse_all("reveal position", &cert.reveal_positions)?,
+            reveal_indices: parse_all("reveal index", &cert.reveal_indices)?,
+            schemes: cert.schemes.into_iter().map(SchemeId).collect(),
+            compressed_sig_proofs: cert
+                .compressed_sig_proofs
+                .map(|p| parse_compressed("compressed signature proofs", &p))
+                .transpose()?,
+            compressed_party_proofs: cert
+                .compressed_party_proofs
+                .map(|p| parse_compressed("compressed participant proofs", &p))
+                .transpose()?,
+            hash: parse_hash(&cert.hash)?,
+            version: cert.version,
+            party_sum_proofs: cert
+                .party_sum_proofs
+                .map(|paths| paths.iter().map(parse_sum_path).collect())
+                .transpose()?,
+            coin_seed: if cert.coin_seed.is_empty() {
+                Vec::new()
+            } else {
+                parse_node("coin seed", &cert.coin_seed)?
+            },
+            sig_sum_proofs: cert
+                .sig_sum_proofs
+                .map(|paths| paths.iter().map(parse_sum_path).collect())
+                .transpose()?,
+            aggregate_sig: if cert.aggregate_sig.is_empty() {
+                Vec::new()
+            } else {
+                parse_node("aggregate signature", &cert.aggregate_sig)?
+            },
+        })
+    }
+}
+
+impl ccok::Certificate {
+    /// Pretty-printed JSON export of the certificate
+    pub fn to_json(&self) -> Result<String, String> {
+        serde_json::to_string_pretty(&CertificateJson::from(self))
+            .map_err(|e| format!("JSON serialization error: {}", e))
+    }
+
+    /// Parse a JSON export, checking the length of every hash, key and signature
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        let cert: CertificateJson =
+            serde_json::from_str(json).map_err(|e| format!("Invalid certificate JSON: {}", e))?;
+        cert.try_into()
+    }
+}
+
+impl ccok::Reveal {
+    /// JSON export of the reveal at `position`
+    pub fn to_json(&self, position: u64) -> Result<String, String> {
+        serde_json::to_string_pretty(&RevealJson::new(position, self))
+            .map_err(|e| format!("JSON serialization error: {}", e))
+    }
+
+    /// Parse a JSON export into the position and reveal
+    pub fn from_json(json: &str) -> Result<(u64, Self), String> {
+        let reveal: RevealJson =
+            serde_json::from_str(json).map_err(|e| format!("Invalid reveal JSON: {}", e))?;
+        reveal.parse()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant, PARAMS_V1};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::wallet::Wallet;
+
+    fn build_certificate() -> (ccok::Certificate, ccok::Params, Vec<u8>) {
+        let wallets: Vec<Wallet> = (0..4)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, u64::MAX / 8))
+            .collect();
+        let params = ccok::Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: u64::MAX / 4,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.msg))
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+        (cert, params, party_tree.root())
+    }
+
+    #[test]
+    fn test_json_round_trip() {
+        let (cert, params, root) = build_certificate();
+        let json = cert.to_json().unwrap();
+
+        // Weights beyond 2^53 survive as strings
+        let value: serde_json::Value = serde_json::from_str(&json).unwrap();
+        assert_eq!(
+            value["signed_weight"],
+            serde_json::Value::String(cert.signed_weight.to_string())
+        );
+        assert_eq!(value["sig_commit"], hex::encode(&cert.sig_commit));
+
+        let decoded = ccok::Certificate::from_json(&json).unwrap();
+        assert_eq!(decoded.digest().unwrap(), cert.digest().unwrap());
+        assert!(decoded.verify(&params, &root).unwrap());
+
+        let (pos, reveal) = cert.reveals.iter().next().unwrap();
+        let (decoded_pos, decoded) =
+            ccok::Reveal::from_json(&reveal.to_json(*pos).unwrap()).unwrap();
+        assert_eq!(decoded_pos, *pos);
+        assert_eq!(decoded.party.public_key, reveal.party.public_key);
+    }
+
+    #[test]
+    fn test_json_validation() {
+        let (cert, _, _) = build_certificate();
+        let valid = CertificateJson::from(&cert);
+        let reject = |edit: &dyn Fn(&mut CertificateJson)| {
+            let mut json = valid.clone();
+            edit(&mut json);
+            ccok::Certificate::try_from(json).unwrap_err()
+        };
+
+        assert!(reject(&|c| c.sig_commit.truncate(62)).contains("length"));
+        assert!(reject(&|c| c.sig_commit.replace_range(0..2, "zz")).contains("hex"));
+        assert!(reject(&|c| c.signed_weight = "-1".to_string()).contains("signed weight"));
+        assert!(reject(&|c| c.hash = "md5".to_string()).contains("hash"));
+        assert!(
+            reject(&|c| c.reveals[0].signature.as_mut().unwrap().truncate(10))
+                .contains("signature")
+        );
+        assert!(reject(&|c| c.reveals[0].party.public_key.push_str("00")).contains("public key"));
+        assert!(reject(&|c| c.reveals[0].party.scheme = 0x7fff).contains("Unknown"));
+        assert!(reject(&|c| {
+            let duplicate = c.reveals[0].clone();
+            c.reveals.push(duplicate);
+        })
+        .contains("Duplicate"));
+        if !valid.sig_proofs.is_empty() {
+            assert!(reject(&|c| c.sig_proofs[0].push_str("00")).contains("length"));
+        }
+
+        // Unknown fields are rejected too
+        let mut value = serde_json::to_value(&valid).unwrap();
+        value["extra"] = serde_json::Value::Bool(true);
+        assert!(ccok::Certificate::from_json(&value.to_string()).is_err());
+    }
+}
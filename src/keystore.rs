@@ -0,0 +1,415 @@
+//! Encrypted keystore of a validator. Each key is a JSON file in the keystore
+//! directory holding the secret key sealed with AES-256-GCM under a key
+//! derived from a passphrase with Argon2id. The scheme and public key are
+//! stored in the clear, so keys can be listed without the passphrase, and are
+//! bound to the ciphertext as associated data so they can't be swapped.
+//!
+//! Decrypted key material and derived encryption keys are zeroized as soon
+//! as they are used, and unlocked signers wipe their secret key when dropped,
+//! which locks them again. Key files are created readable by their owner
+//! only, and the KDF costs a file asks for are bounded, so a crafted file
+//! can't make unlocking it take all memory.
+use crate::scheme::SchemeId;
+use crate::signer::{import_signer, zeroize, ExportableSigner, SignatureScheme};
+use crate::wallet::Wallet;
+use aes_gcm::aead::{Aead, KeyInit, Payload};
+use aes_gcm::{Aes256Gcm, Nonce};
+use argon2::{Algorithm, Argon2, Version};
+use rand::RngCore;
+use serde::{Deserialize, Serialize};
+use std::fs::OpenOptions;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+const KEYFILE_VERSION: u8 = 1;
+const SALT_LEN: usize = 16;
+const NONCE_LEN: usize = 12;
+/// Most memory, in KiB, a key file may make the KDF use: 1 GiB
+pub const MAX_M_COST: u32 = 1024 * 1024;
+/// Most passes over the memory a key file may ask for
+pub const MAX_T_COST: u32 = 16;
+/// Most lanes a key file may ask for
+pub const MAX_P_COST: u32 = 16;
+
+/// Argon2id cost of deriving the encryption key
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KdfParams {
+    /// Memory in KiB
+    pub m_cost: u32,
+    /// Passes over the memory
+    pub t_cost: u32,
+    /// Lanes
+    pub p_cost: u32,
+}
+
+impl Default for KdfParams {
+    fn default() -> Self {
+        Self {
+            m_cost: 64 * 1024,
+            t_cost: 3,
+            p_cost: 1,
+        }
+    }
+}
+
+impl KdfParams {
+    /// Check the costs are positive, within Argon2's limits and at most
+    /// `MAX_M_COST`, `MAX_T_COST` and `MAX_P_COST`
+    pub fn validate(&self) -> Result<(), String> {
+        if self.t_cost == 0 || self.p_cost == 0 || self.m_cost < 8 * self.p_cost {
+            return Err(format!(
+                "Invalid key derivation costs: m {} t {} p {}",
+                self.m_cost, self.t_cost, self.p_cost
+            ));
+        }
+        if self.m_cost > MAX_M_COST || self.t_cost > MAX_T_COST || self.p_cost > MAX_P_COST {
+            return Err(format!(
+                "Key derivation costs m {} t {} p {} above the limits m {} t {} p {}",
+                self.m_cost, self.t_cost, self.p_cost, MAX_M_COST, MAX_T_COST, MAX_P_COST
+            ));
+        }
+        Ok(())
+    }
+
+    // AES-256 key of `passphrase`
+    fn derive(&self, passphrase: &str, salt: &[u8]) -> Result<[u8; 32], String> {
+        let params = argon2::Params::new(self.m_cost, self.t_cost, self.p_cost, Some(32))
+            .map_err(|e| format!("Invalid key derivation params: {}", e))?;
+        let mut key = [0u8; 32];
+        Argon2::new(Algorithm::Argon2id, Version::V0x13, params)
+            .hash_password_into(passphrase.as_bytes(), salt, &mut key)
+            .map_err(|e| format!("Key derivation failed: {}", e))?;
+        Ok(key)
+    }
+}
+
+/// Encrypted key as stored on disk
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyFile {
+    pub version: u8,
+    pub scheme: SchemeId,
+    /// Public key in hex
+    pub public_key: String,
+    pub kdf: KdfParams,
+    /// Argon2id salt in hex
+    pub salt: String,
+    /// AES-GCM nonce in hex
+    pub nonce: String,
+    /// Sealed secret key in hex
+    pub ciphertext: String,
+}
+
+impl KeyFile {
+    /// Seal the secret key of `signer` under `passphrase`
+    pub fn seal(
+        signer: &dyn ExportableSigner,
+        passphrase: &str,
+        kdf: KdfParams,
+    ) -> Result<Self, String> {
+        kdf.validate()?;
+        let mut salt = [0u8; SALT_LEN];
+        let mut nonce = [0u8; NONCE_LEN];
+        rand::thread_rng().fill_bytes(&mut salt);
+        rand::thread_rng().fill_bytes(&mut nonce);
+        let mut file = Self {
+            version: KEYFILE_VERSION,
+            scheme: signer.scheme(),
+            public_key: signer.public_key_hex(),
+            kdf,
+            salt: hex::encode(salt),
+            nonce: hex::encode(nonce),
+            ciphertext: String::new(),
+        };
+        let mut secret = signer.export_secret();
+        let ciphertext = file.cipher(passphrase).and_then(|cipher| {
+            cipher
+                .encrypt(
+                    Nonce::from_slice(&nonce),
+                    Payload {
+                        msg: &secret,
+                        aad: &file.associated_data(),
+                    },
+                )
+                .map_err(|_| "Key encryption failed".to_string())
+        });
+        zeroize(&mut secret);
+        let ciphertext = ciphertext?;
+        file.ciphertext = hex::encode(ciphertext);
+        Ok(file)
+    }
+
+    /// Signer of the sealed key; fails for a wrong passphrase, a file that
+    /// was tampered with or one asking for KDF costs out of bounds
+    pub fn open(&self, passphrase: &str) -> Result<Box<dyn ExportableSigner>, String> {
+        if self.version != KEYFILE_VERSION {
+            return Err(format!("Unsupported key file version {}", self.version));
+        }
+        self.kdf.validate()?;
+        let scheme = SignatureScheme::from_id(self.scheme)
+            .ok_or_else(|| format!("Unknown signature scheme {:?}", self.scheme))?;
+        let nonce = hex::decode(&self.nonce).map_err(|e| format!("Invalid nonce: {}", e))?;
+        if nonce.len() != NONCE_LEN {
+            return Err(format!("Invalid nonce length: {}", nonce.len()));
+        }
+        let ciphertext =
+            hex::decode(&self.ciphertext).map_err(|e| format!("Invalid ciphertext: {}", e))?;
+        let mut secret = self
+            .cipher(passphrase)?
+            .decrypt(
+                Nonce::from_slice(&nonce),
+                Payload {
+                    msg: &ciphertext,
+                    aad: &self.associated_data(),
+                },
+            )
+            .map_err(|_| "Wrong passphrase or corrupted key file".to_string())?;
+        let signer = import_signer(scheme, &secret);
+        zeroize(&mut secret);
+        let signer = signer?;
+        if signer.public_key_hex() != self.public_key {
+            return Err("Key file public key does not match its secret key".to_string());
+        }
+        Ok(signer)
+    }
+
+    fn cipher(&self, passphrase: &str) -> Result<Aes256Gcm, String> {
+        let salt = hex::decode(&self.salt).map_err(|e| format!("Invalid salt: {}", e))?;
+        let mut key = self.kdf.derive(passphrase, &salt)?;
+        let cipher =
+            Aes256Gcm::new_from_slice(&key).map_err(|e| format!("Invalid encryption key: {}", e));
+        zeroize(&mut key);
+        cipher
+    }
+
+    // Fields authenticated along with the secret key
+    fn associated_data(&self) -> Vec<u8> {
+        let mut aad = vec![self.version];
+        aad.extend_from_slice(&self.scheme.0.to_be_bytes());
+        aad.extend_from_slice(self.public_key.as_bytes());
+        aad
+    }
+}
+
+/// Directory of key files, one per key name
+#[derive(Debug, Clone)]
+pub struct Keystore {
+    dir: PathBuf,
+    kdf: KdfParams,
+}
+
+impl Keystore {
+    /// Keystore in `dir`, created if missing
+    pub fn open(dir: impl AsRef<Path>) -> Result<Self, String> {
+        let dir = dir.as_ref().to_path_buf();
+        std::fs::create_dir_all(&dir)
+            .map_err(|e| format!("Failed to create keystore {}: {}", dir.display(), e))?;
+        Ok(Self {
+            dir,
+            kdf: KdfParams::default(),
+        })
+    }
+
+    /// Derive the keys of new key files with `kdf`
+    pub fn with_kdf(mut self, kdf: KdfParams) -> Self {
+        self.kdf = kdf;
+        self
+    }
+
+    fn path(&self, name: &str) -> Result<PathBuf, String> {
+        let valid = !name.is_empty()
+            && name
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+        if !valid {
+            return Err(format!("Invalid key name {:?}", name));
+        }
+        Ok(self.dir.join(format!("{}.json", name)))
+    }
+
+    /// Store the key of `signer` as `name`, which must not exist yet. The
+    /// file is created exclusively, so a key is never overwritten, and on
+    /// Unix with mode 0600.
+    pub fn create(
+        &self,
+        name: &str,
+        passphrase: &str,
+        signer: &dyn ExportableSigner,
+    ) -> Result<KeyFile, String> {
+        let path = self.path(name)?;
+        if path.exists() {
+            return Err(format!("Key {} already exists", name));
+        }
+        let file = KeyFile::seal(signer, passphrase, self.kdf)?;
+        let json = serde_json::to_string_pretty(&file)
+            .map_err(|e| format!("Serialization error: {}", e))?;
+        let mut options = OpenOptions::new();
+        options.write(true).create_new(true);
+        #[cfg(unix)]
+        std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+        let mut out = options.open(&path).map_err(|e| match e.kind() {
+            std::io::ErrorKind::AlreadyExists => format!("Key {} already exists", name),
+            _ => format!("Failed to create key {}: {}", path.display(), e),
+        })?;
+        if let Err(e) = out.write_all(json.as_bytes()).and_then(|_| out.sync_all()) {
+            let _ = std::fs::remove_file(&path);
+            return Err(format!("Failed to write key {}: {}", path.display(), e));
+        }
+        Ok(file)
+    }
+
+    /// Key file of `name`, without decrypting it
+    pub fn key_file(&self, name: &str) -> Result<KeyFile, String> {
+        let path = self.path(name)?;
+        let json = std::fs::read_to_string(&path)
+            .map_err(|e| format!("Failed to read key {}: {}", path.display(), e))?;
+        serde_json::from_str(&json).map_err(|e| format!("Invalid key file {}: {}", name, e))
+    }
+
+    /// Names of the keys stored, sorted
+    pub fn list(&self) -> Result<Vec<String>, String> {
+        let entries = std::fs::read_dir(&self.dir)
+            .map_err(|e| format!("Failed to read keystore {}: {}", self.dir.display(), e))?;
+        let mut names: Vec<String> = entries
+            .filter_map(|entry| entry.ok())
+            .filter_map(|entry| {
+                let name = entry.file_name().into_string().ok()?;
+                name.strip_suffix(".json").map(str::to_string)
+            })
+            .collect();
+        names.sort();
+        Ok(names)
+    }
+
+    /// Signer of the key `name`
+    pub fn unlock(
+        &self,
+        name: &str,
+        passphrase: &str,
+    ) -> Result<Box<dyn ExportableSigner>, String> {
+        self.key_file(name)?.open(passphrase)
+    }
+
+    /// Wallet of the Dilithium2 key `name`, the node key
+    pub fn unlock_wallet(&self, name: &str, passphrase: &str) -> Result<Wallet, String> {
+        let file = self.key_file(name)?;
+        if file.scheme != SignatureScheme::Dilithium2.id() {
+            return Err(format!("Key {} is not a Dilithium2 key", name));
+        }
+        let signer = file.open(passphrase)?;
+        let mut secret = signer.export_secret();
+        let wallet = Wallet::from_bytes(&secret);
+        zeroize(&mut secret);
+        wallet
+    }
+
+    /// Sign `msg` with the key `name`, which is only decrypted for the call
+    pub fn sign(&self, name: &str, passphrase: &str, msg: &[u8]) -> Result<Vec<u8>, String> {
+        Ok(self.unlock(name, passphrase)?.sign(msg))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::scheme::verify_signature;
+    use crate::signer::{FalconSigner, Signer};
+
+    #[test]
+    fn test_keystore() {
+        let dir = std::env::temp_dir().join(format!("niropok-keystore-{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        let fast = KdfParams {
+            m_cost: 64,
+            t_cost: 1,
+            p_cost: 1,
+        };
+        let keystore = Keystore::open(&dir).unwrap().with_kdf(fast);
+
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let falcon = FalconSigner::new().unwrap();
+        keystore.create("node", "hunter2", &wallet).unwrap();
+        let file = keystore
+            .create("cert-key", "correct horse", &falcon)
+            .unwrap();
+        assert!(keystore.create("node", "other", &wallet).is_err());
+        assert!(keystore.create("../escape", "other", &wallet).is_err());
+        assert_eq!(keystore.list().unwrap(), vec!["cert-key", "node"]);
+        assert_eq!(file.public_key, falcon.public_key_hex());
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = std::fs::metadata(dir.join("node.json"))
+                .unwrap()
+                .permissions()
+                .mode();
+            assert_eq!(mode & 0o777, 0o600);
+        }
+
+        // Keys come back only with their passphrase
+        let unlocked = keystore.unlock_wallet("node", "hunter2").unwrap();
+        assert_eq!(unlocked.get_public_key(), wallet.get_public_key());
+        assert!(keystore.unlock("node", "hunter3").is_err());
+        assert!(keystore.unlock_wallet("cert-key", "correct horse").is_err());
+        let signature = keystore.sign("cert-key", "correct horse", b"msg").unwrap();
+        assert!(
+            verify_signature(falcon.scheme(), &falcon.public_key(), b"msg", &signature).unwrap()
+        );
+
+        // The clear fields are authenticated
+        let mut swapped = keystore.key_file("cert-key").unwrap();
+        swapped.public_key = wallet.get_public_key();
+        assert!(swapped.open("correct horse").is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_kdf_bounds() {
+        let falcon = FalconSigner::new().unwrap();
+        let fast = KdfParams {
+            m_cost: 64,
+            t_cost: 1,
+            p_cost: 1,
+        };
+        fast.validate().unwrap();
+        KdfParams::default().validate().unwrap();
+
+        // A file asking for costs beyond the bounds is refused before
+        // deriving anything
+        let file = KeyFile::seal(&falcon, "pass", fast).unwrap();
+        let costly = [
+            KdfParams {
+                m_cost: u32::MAX,
+                ..fast
+            },
+            KdfParams {
+                t_cost: MAX_T_COST + 1,
+                ..fast
+            },
+            KdfParams {
+                p_cost: MAX_P_COST + 1,
+                m_cost: 8 * (MAX_P_COST + 1),
+                ..fast
+            },
+        ];
+        for kdf in costly {
+            let mut tampered = file.clone();
+            tampered.kdf = kdf;
+            let err = tampered.open("pass").err().unwrap();
+            assert!(err.contains("above the limits"), "{}", err);
+        }
+
+        // So are costs Argon2 can't run with, when reading or sealing
+        let invalid = [
+            KdfParams { t_cost: 0, ..fast },
+            KdfParams { p_cost: 0, ..fast },
+            KdfParams { m_cost: 4, ..fast },
+        ];
+        for kdf in invalid {
+            let mut tampered = file.clone();
+            tampered.kdf = kdf;
+            assert!(tampered.open("pass").is_err());
+            assert!(KeyFile::seal(&falcon, "pass", kdf).is_err());
+        }
+        assert!(file.open("pass").is_ok());
+    }
+}
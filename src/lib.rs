@@ -1,20 +1,83 @@
 pub mod accounts;
+pub mod aggregate;
+pub mod algorand;
+pub mod anchor;
 pub mod block;
 pub mod blockchain;
+pub mod bridge;
+pub mod canonical;
+pub mod cbor;
 pub mod ccok;
+pub mod certmutate;
+pub mod certstore;
+pub mod cli;
+pub mod collector;
 pub mod config;
+pub mod consensus;
+pub mod context;
+pub mod coordinator;
+pub mod dkg;
+pub mod envelope;
+pub mod error;
+pub mod escalation;
+pub mod evidence;
+pub mod events;
+pub mod evm;
+pub mod ephemeral;
 pub mod epoch;
+pub mod fastsync;
+pub mod fees;
+pub mod forkchoice;
 pub mod genesis;
+pub mod halfagg;
+pub mod handoff;
+pub mod gossip;
+pub mod governance;
+pub mod grpc;
 pub mod hashchain;
+pub mod hdkey;
+pub mod headersync;
+pub mod hybrid;
+pub mod ibc;
+pub mod interactive;
+pub mod json;
+pub mod keystore;
+pub mod lightclient;
+pub mod logging;
 pub mod mempool;
 pub mod merkle;
+pub mod messages;
+pub mod metrics;
+pub mod msgpack;
 pub mod networking;
+pub mod nodeconfig;
 pub mod p2p;
+pub mod proto;
+pub mod relayer;
+pub mod remotesigner;
+pub mod rpc;
+pub mod scheme;
+pub mod signer;
+pub mod simulation;
+pub mod smt;
+pub mod snapshot;
+pub mod sortition;
+pub mod state;
+pub mod stateproof;
+pub mod store;
+pub mod streaming;
+pub mod sumtree;
+pub mod telemetry;
+pub mod testvectors;
 pub mod transaction;
+pub mod tx;
 pub mod utils;
 pub mod validator;
+pub mod validatorset;
+pub mod vrf;
 pub mod wallet;
+pub mod witness;
 
 
-pub use ccok::{Builder, Certificate, Params, Participant};
-pub use merkle::MerkleTreeBuilder;
+pub use ccok::{Builder, Certificate, Params, Participant, Verifier};
+pub use merkle::{verify_proof, AuditPath, MerkleTreeBuilder};
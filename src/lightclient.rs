@@ -0,0 +1,368 @@
+//! Light client following the sidechain through its state proofs. Starting
+//! from the genesis voters commitment it verifies every interval in turn, and
+//! can then check that a transaction was included in a certified block, or the
+//! state of an account after it, without downloading any block. Given the
+//! genesis `Epoch` it also follows epoch handoffs, trusting each incoming
+//! validator set only once the outgoing one certified it, and can then skip
+//! ahead to the latest interval the current validators signed, or check
+//! their governance certificates. It refuses withdrawals while their circuit
+//! breaker certificates halt the bridge.
+use crate::block::{BlockHeader, TxProof};
+use crate::bridge::{BreakerCert, BridgeState, CircuitBreaker, WithdrawalProof};
+use crate::ccok::{Certificate, Params, Verifier};
+use crate::error::CcokError;
+use crate::governance::GovernanceCert;
+use crate::handoff::{Epoch, HandoffCert, HandoffVerifier};
+use crate::merkle::{verify_proof_with, AuditPath, Hashing};
+use crate::state::AccountProof;
+use crate::stateproof::{StateProof, StateProofMessage, StateProofVerifier};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+/// Proof that a transaction is part of a block certified by a state proof
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TxInclusionProof {
+    /// Header of the block holding the transaction
+    pub header: BlockHeader,
+    /// Path of the header to the headers commitment of its interval
+    pub header_path: AuditPath,
+    /// Hash of the transaction
+    pub tx_hash: [u8; 32],
+    /// Path of the transaction to the header's transaction root
+    pub tx_proof: TxProof,
+}
+
+/// Light client tracking the certified intervals of the sidechain
+#[derive(Debug, Clone)]
+pub struct Client {
+    verifier: StateProofVerifier,
+    /// Certified intervals, keyed by their first block
+    intervals: BTreeMap<u64, StateProofMessage>,
+    /// Epoch handoffs followed so far, if an epoch is trusted
+    handoffs: Option<HandoffVerifier>,
+    breaker: CircuitBreaker,
+}
+
+impl Client {
+    /// Client trusting `genesis_voters` to sign the first interval of
+    /// `interval` blocks, with certificates under the params `template`
+    pub fn new(template: Params, interval: u64, genesis_voters: Vec<u8>) -> Self {
+        Self {
+            verifier: StateProofVerifier::new(template, interval, genesis_voters, 1),
+            intervals: BTreeMap::new(),
+            handoffs: None,
+            breaker: CircuitBreaker::new(),
+        }
+    }
+
+    /// Trust `epoch`, whose validators must be the current voters, to follow
+    /// epoch handoffs from
+    pub fn with_epoch(mut self, epoch: Epoch) -> Result<Self, CcokError> {
+        if epoch.voters_commitment != self.verifier.voters_commitment {
+            return Err(CcokError::InvalidHandoff(format!(
+                "epoch {} is not the current voter set",
+                epoch.number
+            )));
+        }
+        self.handoffs = Some(HandoffVerifier::new(self.verifier.template.clone(), epoch));
+        Ok(self)
+    }
+
+    /// Latest verified epoch
+    pub fn epoch(&self) -> Option<&Epoch> {
+        self.handoffs.as_ref().map(|handoffs| &handoffs.epoch)
+    }
+
+    /// Verify the handoff of the current epoch and make its incoming
+    /// validators the voters of the next interval
+    pub fn advance_epoch(&mut self, cert: &HandoffCert) -> Result<(), CcokError> {
+        let handoffs = self
+            .handoffs
+            .as_mut()
+            .ok_or_else(|| CcokError::InvalidHandoff("no trusted epoch".to_string()))?;
+        if handoffs.epoch.voters_commitment != self.verifier.voters_commitment {
+            return Err(CcokError::InvalidHandoff(format!(
+                "voters changed since epoch {}",
+                handoffs.epoch.number
+            )));
+        }
+        handoffs.advance(cert)?;
+        self.verifier.voters_commitment = cert.handoff.to.voters_commitment.clone();
+        Ok(())
+    }
+
+    // Trusted epoch whose validators are still the current voters, those
+    // governance certificates are checked against
+    fn governing_epoch(&self) -> Result<&Epoch, CcokError> {
+        let epoch = self
+            .epoch()
+            .ok_or_else(|| CcokError::InvalidGovernance("no trusted epoch".to_string()))?;
+        if epoch.voters_commitment != self.verifier.voters_commitment {
+            return Err(CcokError::InvalidGovernance(format!(
+                "voters changed since epoch {}",
+                epoch.number
+            )));
+        }
+        Ok(epoch)
+    }
+
+    /// Check that the validators of the trusted epoch, still the current
+    /// voters, certified the proposal of `cert`
+    pub fn verify_governance(&self, cert: &GovernanceCert) -> Result<(), CcokError> {
+        cert.verify(self.governing_epoch()?, &self.verifier.template)
+    }
+
+    /// Halt or resume the bridge as the breaker message of `cert`, certified
+    /// by the validators of the trusted epoch, says
+    pub fn apply_breaker(&mut self, cert: &BreakerCert) -> Result<BridgeState, CcokError> {
+        cert.verify(self.governing_epoch()?, &self.verifier.template)?;
+        self.breaker
+            .apply(&cert.message)
+            .map_err(CcokError::InvalidGovernance)
+    }
+
+    /// State of the bridge after the breaker certificates applied
+    pub fn bridge_state(&self) -> BridgeState {
+        self.breaker.state()
+    }
+
+    /// Check a withdrawal proven part of a batch the validators of the trusted
+    /// epoch, still the current voters, certified with `cert` under `params`,
+    /// unless the bridge is halted. The params must prove two thirds of the
+    /// epoch's weight, so a certificate of a few of them doesn't do.
+    pub fn verify_withdrawal(
+        &self,
+        cert: &Certificate,
+        params: &Params,
+        proof: &WithdrawalProof,
+    ) -> Result<(), String> {
+        self.breaker.check()?;
+        let epoch = self.governing_epoch()?;
+        if params.proven_weight < epoch.proven_weight() {
+            return Err(format!(
+                "Withdrawal params prove weight {}, epoch {} needs {}",
+                params.proven_weight,
+                epoch.number,
+                epoch.proven_weight()
+            ));
+        }
+        if !Verifier::new(epoch.voters_commitment.clone()).verify(cert, params)? {
+            return Err("Invalid withdrawal certificate".to_string());
+        }
+        proof.verify(params)
+    }
+
+    /// Party tree root of the voters expected to sign the next interval
+    pub fn voters_commitment(&self) -> &[u8] {
+        &self.verifier.voters_commitment
+    }
+
+    /// Last block covered by a verified state proof
+    pub fn last_certified_block(&self) -> Option<u64> {
+        self.intervals.values().next_back().map(|m| m.last_block)
+    }
+
+    /// Verify the state proof of the next interval and move on to its voters
+    pub fn advance(&mut self, proof: &StateProof) -> Result<(), CcokError> {
+        self.verifier.advance(proof)?;
+        self.intervals
+            .insert(proof.message.first_block, proof.message.clone());
+        Ok(())
+    }
+
+    /// Verify the state proof of a later interval, skipping the ones in
+    /// between, as fast sync does. This needs a trusted epoch whose voters
+    /// are still the current ones: its handoff certified who signs the
+    /// intervals of the epoch, so the skipped proofs add nothing.
+    pub fn advance_to(&mut self, proof: &StateProof) -> Result<(), CcokError> {
+        let epoch = self
+            .epoch()
+            .ok_or_else(|| CcokError::InvalidHandoff("no trusted epoch".to_string()))?;
+        if epoch.voters_commitment != self.verifier.voters_commitment {
+            return Err(CcokError::InvalidHandoff(format!(
+                "voters changed since epoch {}",
+                epoch.number
+            )));
+        }
+        let first = proof.message.first_block;
+        if first < self.verifier.next_block || (first - 1) % self.verifier.interval != 0 {
+            return Err(CcokError::InvalidStateProof(format!(
+                "interval starting at block {} does not follow block {}",
+                first,
+                self.verifier.next_block - 1
+            )));
+        }
+        let mut verifier = self.verifier.clone();
+        verifier.next_block = first;
+        verifier.advance(proof)?;
+        self.verifier = verifier;
+        self.intervals.insert(first, proof.message.clone());
+        Ok(())
+    }
+
+    /// Check that `header` is the header of a certified block
+    pub fn verify_header(&self, header: &BlockHeader, path: &AuditPath) -> Result<(), CcokError> {
+        let id = header.height;
+        let message = self
+            .intervals
+            .range(..=id)
+            .next_back()
+            .map(|(_, message)| message)
+            .filter(|message| id <= message.last_block)
+            .ok_or(CcokError::NotCertified(id))?;
+
+        let hashing = self.verifier.template.hashing();
+        let leaf = hashing.leaf_hash(header)?;
+        let index = (id - message.first_block) as usize;
+        let blocks = (message.last_block - message.first_block + 1) as usize;
+        if path.total_leaves != blocks
+            || !verify_proof_with(
+                hashing,
+                &message.block_headers_commitment,
+                index,
+                &leaf,
+                path,
+            )
+        {
+            return Err(CcokError::BadMerklePath(format!(
+                "header of block {} is not certified",
+                id
+            )));
+        }
+        Ok(())
+    }
+
+    /// Check that a transaction is included in a certified block
+    pub fn verify_tx(&self, proof: &TxInclusionProof) -> Result<(), CcokError> {
+        self.verify_header(&proof.header, &proof.header_path)?;
+        if !proof.tx_proof.verify(&proof.header.tx_root, &proof.tx_hash) {
+            return Err(CcokError::BadMerklePath(format!(
+                "transaction is not in block {}",
+                proof.header.height
+            )));
+        }
+        Ok(())
+    }
+
+    /// Check an account state against the state root of a certified block,
+    /// with `hashing` the hash function of the state tree
+    pub fn verify_account(
+        &self,
+        header: &BlockHeader,
+        header_path: &AuditPath,
+        hashing: Hashing,
+        proof: &AccountProof,
+    ) -> Result<(), CcokError> {
+        self.verify_header(header, header_path)?;
+        if !proof.verify(hashing, &header.state_root) {
+            return Err(CcokError::BadMerklePath(format!(
+                "state of {} is not in block {}",
+                proof.account.address, header.height
+            )));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::block::Block;
+    use crate::ccok::{Builder, Participant};
+    use crate::stateproof::{prove_header, voters_commitment};
+    use crate::transaction::{Transaction, TransactionType};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_follow_and_verify_tx() {
+        let template = Params {
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let hashing = template.hashing();
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let voters: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let genesis = voters_commitment(hashing, &voters).unwrap();
+
+        // Four blocks, the third holding two transactions
+        let mut sender = Wallet::new().expect("Failed to create wallet");
+        let account = Account {
+            address: sender.get_public_key().to_string(),
+        };
+        let txns: Vec<Transaction> = (0..2)
+            .map(|i| {
+                Transaction::new(
+                    &mut sender,
+                    account.clone(),
+                    account.clone(),
+                    1.0 + i as f64,
+                    0,
+                    TransactionType::TRANSACTION,
+                )
+                .unwrap()
+            })
+            .collect();
+        let blocks: Vec<Block> = (1..=4)
+            .map(|id| {
+                let txn = if id == 3 { txns.clone() } else { vec![] };
+                Block::new(
+                    id,
+                    [0u8; 32],
+                    id,
+                    txn,
+                    account.clone(),
+                    String::new(),
+                    Seed { seed: [0u8; 32] },
+                    None,
+                )
+                .unwrap()
+            })
+            .collect();
+
+        // The same voters keep signing
+        let message = StateProofMessage::new(hashing, &blocks, genesis.clone()).unwrap();
+        let params = message.params(&template).unwrap();
+        let mut builder = Builder::new(params.clone(), voters, genesis.clone()).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let proof = StateProof {
+            message,
+            certificate: builder.build().unwrap(),
+        };
+
+        let mut client = Client::new(template, 4, genesis.clone());
+        let inclusion = TxInclusionProof {
+            header: blocks[2].header(),
+            header_path: prove_header(hashing, &blocks, 2).unwrap(),
+            tx_hash: txns[1].hash,
+            tx_proof: blocks[2].prove_transaction(1).unwrap(),
+        };
+        assert_eq!(
+            client.verify_tx(&inclusion),
+            Err(CcokError::NotCertified(3))
+        );
+
+        client.advance(&proof).unwrap();
+        assert_eq!(client.last_certified_block(), Some(4));
+        assert_eq!(client.voters_commitment(), genesis.as_slice());
+        client.verify_tx(&inclusion).unwrap();
+
+        // Transactions and headers that weren't certified are rejected
+        let mut other_tx = inclusion.clone();
+        other_tx.tx_hash = txns[0].hash;
+        assert!(client.verify_tx(&other_tx).is_err());
+        let mut other_header = inclusion.clone();
+        other_header.header.timestamp += 1;
+        assert!(client.verify_tx(&other_header).is_err());
+    }
+}
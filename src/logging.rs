@@ -0,0 +1,230 @@
+//! Structured logging. Subsystems log through the `log` facade with a target:
+//! the certificate `Builder` and `Verifier` use `BUILDER` and `VERIFIER`, and
+//! the consensus and p2p modules their module path, whose last segment is
+//! their subsystem name. `Logger` filters records by the level configured for
+//! their subsystem, writes them to stderr as text or JSON lines, and redacts
+//! key material from messages. The node installs it from the `[logging]`
+//! section of its config.
+use crate::nodeconfig::LoggingConfig;
+use log::{LevelFilter, Log, Metadata, Record};
+use serde::{Deserialize, Serialize};
+use std::borrow::Cow;
+use std::collections::BTreeMap;
+use std::io::Write;
+use std::str::FromStr;
+
+/// Target of the logs of certificate builders
+pub const BUILDER: &str = "builder";
+/// Target of the logs of certificate verification
+pub const VERIFIER: &str = "verifier";
+
+/// Hex runs longer than this are redacted: hashes and addresses are kept,
+/// while keys and signatures of every scheme are longer
+pub const REDACT_HEX_LEN: usize = 128;
+
+/// Output format of log lines
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LogFormat {
+    /// `<time> <LEVEL> <target>: <message>`
+    #[default]
+    Text,
+    /// One JSON object per line with `time`, `level`, `target` and `message`
+    Json,
+}
+
+/// Level of a config value: off, error, warn, info, debug or trace
+pub fn parse_level(level: &str) -> Result<LevelFilter, String> {
+    LevelFilter::from_str(level).map_err(|_| format!("Invalid log level {}", level))
+}
+
+/// Replace every hex run longer than `REDACT_HEX_LEN` with its length
+pub fn redact(message: &str) -> Cow<'_, str> {
+    let bytes = message.as_bytes();
+    let mut out = String::new();
+    let (mut copied, mut i) = (0, 0);
+    while i < bytes.len() {
+        let start = i;
+        while i < bytes.len() && bytes[i].is_ascii_hexdigit() {
+            i += 1;
+        }
+        if i - start > REDACT_HEX_LEN {
+            out.push_str(&message[copied..start]);
+            out.push_str(&format!("<redacted {} bytes>", (i - start) / 2));
+            copied = i;
+        }
+        if i == start {
+            i += 1;
+        }
+    }
+    if copied == 0 {
+        return Cow::Borrowed(message);
+    }
+    out.push_str(&message[copied..]);
+    Cow::Owned(out)
+}
+
+/// Logger with a level per subsystem
+#[derive(Debug, Clone)]
+pub struct Logger {
+    level: LevelFilter,
+    levels: BTreeMap<String, LevelFilter>,
+    format: LogFormat,
+    redact: bool,
+}
+
+impl Logger {
+    pub fn new(config: &LoggingConfig) -> Result<Self, String> {
+        let levels = config
+            .levels
+            .iter()
+            .map(|(subsystem, level)| Ok((subsystem.clone(), parse_level(level)?)))
+            .collect::<Result<_, String>>()?;
+        Ok(Self {
+            level: parse_level(&config.level)?,
+            levels,
+            format: config.format,
+            redact: config.redact,
+        })
+    }
+
+    /// Level of the records of `target`. A subsystem matches the target
+    /// itself, the modules under it and the module it ends; the longest match
+    /// wins, and targets no subsystem matches get the default level.
+    pub fn level(&self, target: &str) -> LevelFilter {
+        self.levels
+            .iter()
+            .filter(|(subsystem, _)| {
+                let subsystem = subsystem.as_str();
+                target == subsystem
+                    || target
+                        .strip_prefix(subsystem)
+                        .map_or(false, |rest| rest.starts_with("::"))
+                    || target
+                        .strip_suffix(subsystem)
+                        .map_or(false, |rest| rest.ends_with("::"))
+            })
+            .max_by_key(|(subsystem, _)| subsystem.len())
+            .map_or(self.level, |(_, &level)| level)
+    }
+
+    /// Most verbose level of any subsystem
+    pub fn max_level(&self) -> LevelFilter {
+        self.levels.values().copied().fold(self.level, Ord::max)
+    }
+
+    /// Line of a record, without the newline
+    pub fn format(&self, record: &Record) -> String {
+        let message = record.args().to_string();
+        let message = if self.redact {
+            redact(&message).into_owned()
+        } else {
+            message
+        };
+        let time = chrono::Utc::now().to_rfc3339_opts(chrono::SecondsFormat::Millis, true);
+        match self.format {
+            LogFormat::Text => format!(
+                "{} {:<5} {}: {}",
+                time,
+                record.level(),
+                record.target(),
+                message
+            ),
+            LogFormat::Json => serde_json::json!({
+                "time": time,
+                "level": record.level().as_str().to_lowercase(),
+                "target": record.target(),
+                "message": message,
+            })
+            .to_string(),
+        }
+    }
+}
+
+impl Log for Logger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= self.level(metadata.target())
+    }
+
+    fn log(&self, record: &Record) {
+        if self.enabled(record.metadata()) {
+            let _ = writeln!(std::io::stderr(), "{}", self.format(record));
+        }
+    }
+
+    fn flush(&self) {
+        let _ = std::io::stderr().flush();
+    }
+}
+
+/// Install the logger of `config` as the global logger. `RUST_LOG`, when
+/// set to a level, overrides the default level of the config.
+pub fn init(config: &LoggingConfig) -> Result<(), String> {
+    let mut logger = Logger::new(config)?;
+    if let Ok(level) = std::env::var("RUST_LOG") {
+        logger.level = parse_level(&level)?;
+    }
+    let max_level = logger.max_level();
+    log::set_boxed_logger(Box::new(logger))
+        .map_err(|e| format!("Failed to install logger: {}", e))?;
+    log::set_max_level(max_level);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use log::Level;
+
+    #[test]
+    fn test_logger() {
+        let mut config = LoggingConfig::default();
+        config.level = "warn".to_string();
+        config.levels.insert("p2p".to_string(), "error".to_string());
+        config
+            .levels
+            .insert(VERIFIER.to_string(), "debug".to_string());
+        config
+            .levels
+            .insert("niropokd::p2p::peers".to_string(), "trace".to_string());
+        let logger = Logger::new(&config).unwrap();
+        assert_eq!(logger.level(VERIFIER), LevelFilter::Debug);
+        assert_eq!(logger.level(BUILDER), LevelFilter::Warn);
+        assert_eq!(logger.level("niropokd::p2p"), LevelFilter::Error);
+        assert_eq!(logger.level("p2p::gossip"), LevelFilter::Error);
+        assert_eq!(logger.level("niropokd::p2p::peers"), LevelFilter::Trace);
+        assert_eq!(logger.level("libp2p_gossipsub"), LevelFilter::Warn);
+        assert_eq!(logger.max_level(), LevelFilter::Trace);
+
+        // Keys and signatures are redacted, hashes kept
+        let hash = "ab".repeat(32);
+        let key = "cd".repeat(1312);
+        let line = format!("block {} signed by {}.", hash, key);
+        assert_eq!(
+            redact(&line),
+            format!("block {} signed by <redacted 1312 bytes>.", hash)
+        );
+        assert!(matches!(redact(&hash), Cow::Borrowed(_)));
+
+        config.format = LogFormat::Json;
+        let logger = Logger::new(&config).unwrap();
+        let metadata = Metadata::builder()
+            .level(Level::Debug)
+            .target(VERIFIER)
+            .build();
+        assert!(logger.enabled(&metadata));
+        let line = logger.format(
+            &Record::builder()
+                .args(format_args!("verified with {}", key))
+                .metadata(metadata)
+                .build(),
+        );
+        let json: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(json["level"], "debug");
+        assert_eq!(json["target"], VERIFIER);
+        assert_eq!(json["message"], "verified with <redacted 1312 bytes>");
+
+        config.levels.insert("p2p".to_string(), "loud".to_string());
+        assert!(Logger::new(&config).is_err());
+    }
+}
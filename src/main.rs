@@ -17,21 +17,84 @@ use tokio::{
 };
 
 mod accounts;
+mod aggregate;
+mod algorand;
+mod anchor;
 mod block;
 mod blockchain;
+mod bridge;
+mod canonical;
+mod cbor;
 mod ccok;
+mod certmutate;
+mod certstore;
+mod cli;
+mod collector;
 mod config;
+mod consensus;
+mod context;
+mod coordinator;
+mod dkg;
+mod envelope;
+mod error;
+mod escalation;
+mod evidence;
+mod events;
+mod evm;
+mod ephemeral;
 mod epoch;
+mod fastsync;
+mod fees;
+mod forkchoice;
 mod genesis;
+mod halfagg;
+mod handoff;
+mod gossip;
+mod governance;
+mod grpc;
 mod hashchain;
+mod hdkey;
+mod headersync;
+mod hybrid;
+mod ibc;
+mod interactive;
+mod json;
+mod keystore;
+mod lightclient;
+mod logging;
 mod mempool;
 mod merkle;
+mod messages;
+mod metrics;
+mod msgpack;
 mod networking;
+mod nodeconfig;
 mod p2p;
+mod proto;
+mod relayer;
+mod remotesigner;
+mod rpc;
+mod scheme;
+mod signer;
+mod simulation;
+mod smt;
+mod snapshot;
+mod sortition;
+mod state;
+mod stateproof;
+mod store;
+mod streaming;
+mod sumtree;
+mod telemetry;
+mod testvectors;
 mod transaction;
+mod tx;
 mod utils;
 mod validator;
+mod validatorset;
+mod vrf;
 mod wallet;
+mod witness;
 
 use accounts::Account;
 use blockchain::Blockchain;
@@ -39,22 +102,73 @@ use config::*;
 use genesis::Genesis;
 use hashchain::HashChain;
 use hashchain::HashChainCom;
-use log::info;
+use log::{error, info};
 use transaction::{Transaction, TransactionType};
 use utils::Seed;
 use crate::utils::TpsTracker;
 
 #[tokio::main]
 async fn main() {
-    pretty_env_logger::init();
-    info!("Starting the new Peer, {}", p2p::PEER_ID.clone());
     let (epoch_sender, mut epoch_rcv) = mpsc::unbounded_channel::<bool>();
     let (mining_sender, mut mining_rcv) = mpsc::unbounded_channel::<bool>();
     let (genesis_sender, mut genesis_rcv) = mpsc::unbounded_channel::<bool>();
     let (rpc_sender, mut rpc_rcv) = mpsc::unbounded_channel::<Transaction>();
 
-    let wallet = wallet::Wallet::new().unwrap();
-    let blockchain = Arc::new(Mutex::new(Blockchain::new(wallet)));
+    // niropokd --config <file>, or NIROPOK_CONFIG; without one the node runs
+    // with the defaults
+    let mut args = std::env::args().skip(1);
+    let config_path = match (args.next().as_deref(), args.next()) {
+        (Some("--config"), Some(path)) => Some(path),
+        (None, _) => std::env::var("NIROPOK_CONFIG").ok(),
+        _ => panic!("Usage: niropokd [--config <file>]"),
+    };
+    let config = match &config_path {
+        Some(path) => nodeconfig::NodeConfig::load(path).expect("Failed to load config"),
+        None => nodeconfig::NodeConfig::default(),
+    };
+    logging::init(&config.logging).expect("Failed to install logger");
+    if let Some(path) = &config.telemetry.traces_file {
+        let exporter =
+            telemetry::FileExporter::open(path, "niropokd").expect("Failed to open traces file");
+        telemetry::set_exporter(Arc::new(exporter));
+    }
+    info!("Starting the new Peer, {}", p2p::PEER_ID.clone());
+
+    // Validators keep the node key in an encrypted keystore; without one
+    // the node runs with a fresh key held in memory only
+    let keystore_dir = config
+        .keys
+        .keystore
+        .clone()
+        .or_else(|| std::env::var("NIROPOK_KEYSTORE").ok().map(Into::into));
+    let wallet = match keystore_dir {
+        Some(dir) => {
+            let name = &config.keys.name;
+            let passphrase = std::env::var(&config.keys.passphrase_env).unwrap_or_else(|_| {
+                panic!("{} must be set with a keystore", config.keys.passphrase_env)
+            });
+            let keystore = keystore::Keystore::open(&dir).expect("Failed to open keystore");
+            if !keystore.list().unwrap().contains(name) {
+                let wallet = wallet::Wallet::new().unwrap();
+                keystore
+                    .create(name, &passphrase, &wallet)
+                    .expect("Failed to store node key");
+                info!("Created node key in keystore {}", dir.display());
+            }
+            keystore
+                .unlock_wallet(name, &passphrase)
+                .expect("Failed to unlock node key")
+        }
+        None => wallet::Wallet::new().unwrap(),
+    };
+    let mut node = Blockchain::new(wallet);
+    node.configure(&config.consensus);
+    if let Some(path) = config.storage.chain_path() {
+        std::fs::create_dir_all(path.parent().unwrap()).expect("Failed to create data directory");
+        node.open_store(&path).expect("Failed to open chain store");
+        info!("Persisting the chain to {}", path.display());
+    }
+    let blockchain = Arc::new(Mutex::new(node));
 
     // --- Initialize TPS Tracker ---
     let tps_tracker = Arc::new(Mutex::new(TpsTracker {
@@ -72,7 +186,9 @@ async fn main() {
 
     let mut stdin: tokio::io::Lines<BufReader<tokio::io::Stdin>> = BufReader::new(stdin()).lines();
 
-    let listen_addr: Multiaddr = "/ip4/0.0.0.0/tcp/0"
+    let listen_addr: Multiaddr = config
+        .network
+        .listen
         .parse()
         .expect("Failed to parse listen address");
 
@@ -80,6 +196,16 @@ async fn main() {
         .listen_on(listen_addr)
         .expect("Failed to listen on address");
 
+    for peer in &config.network.peers {
+        match peer.parse::<Multiaddr>() {
+            Ok(addr) => match swarm.dial(addr) {
+                Ok(()) => info!("Dialing peer {}", peer),
+                Err(e) => error!("Failed to dial peer {}: {}", peer, e),
+            },
+            Err(e) => error!("Invalid peer address {}: {}", peer, e),
+        }
+    }
+
     // Genesis event is just a simple event for registering the first nodes and update the state for their stake value - it should change in the future
     let genesis_sender_clone = genesis_sender.clone();
     spawn(async move {
@@ -101,6 +227,7 @@ async fn main() {
 
     let mut planner = periodic::Planner::new();
     planner.start();
+    let block_interval = config.consensus.block_interval;
     spawn(async move {
         sleep(Duration::from_secs(15)).await;
         info!("sending mining event");
@@ -111,14 +238,46 @@ async fn main() {
                     .send(true)
                     .expect("can't send mining event")
             },
-            periodic::Every::new(Duration::from_secs(BLOCK_INTERVAL)),
+            periodic::Every::new(Duration::from_secs(block_interval)),
         );
     });
 
     // Spawn RPC server to receive transactions via HTTP POST requests
+    let rpc_config = config.rpc.clone();
     let rpc_sender_clone = rpc_sender.clone();
     tokio::spawn(async move {
-        networking::start_rpc_server(rpc_sender_clone).await;
+        networking::start_rpc_server(rpc_sender_clone, rpc_config.tx_addr()).await;
+    });
+
+    // Spawn the JSON-RPC server of the chain and certificate methods
+    let json_rpc = Arc::new(Mutex::new(
+        rpc::RpcServer::new(Arc::clone(&blockchain)).with_policy(config.submission.policy()),
+    ));
+    let json_rpc_addr = config.rpc.json_rpc_addr();
+    let max_request_bytes = config.submission.max_request_bytes;
+    tokio::spawn(async move {
+        networking::start_json_rpc_server(json_rpc, json_rpc_addr, max_request_bytes).await;
+    });
+
+    // Spawn the WebSocket server pushing chain events
+    let events = blockchain.lock().unwrap().events.clone();
+    let ws_addr = config.rpc.ws_addr();
+    tokio::spawn(async move {
+        networking::start_ws_server(events, ws_addr).await;
+    });
+
+    // Spawn the gRPC server of the node and certificate services
+    let grpc = Arc::new(grpc::GrpcServer::new(Arc::clone(&blockchain)));
+    let grpc_events = blockchain.lock().unwrap().events.clone();
+    let grpc_addr = config.rpc.grpc_addr();
+    tokio::spawn(async move {
+        networking::start_grpc_server(grpc, grpc_events, grpc_addr).await;
+    });
+
+    // Spawn the Prometheus metrics endpoint
+    let metrics_addr = config.rpc.metrics_addr();
+    tokio::spawn(async move {
+        networking::start_metrics_server(metrics_addr).await;
     });
 
     // --- Add this block for TPS reporting ---
@@ -168,8 +327,30 @@ async fn main() {
         if let Some(event) = evt {
             match event {
                 EventType::Command(cmd) => {
-                    // TODO: handle commands
-                    info!("command: {:?}", cmd);
+                    let mut words = cmd.split_whitespace();
+                    match (words.next(), words.next()) {
+                        (Some("snapshot"), Some(path)) => {
+                            let result = blockchain
+                                .lock()
+                                .unwrap()
+                                .snapshot()
+                                .and_then(|snapshot| snapshot.save(path));
+                            match result {
+                                Ok(()) => info!("Snapshot written to {}", path),
+                                Err(e) => error!("Failed to write snapshot: {}", e),
+                            }
+                        }
+                        (Some("restore"), Some(path)) => {
+                            let result = snapshot::Snapshot::load(path)
+                                .and_then(|snapshot| blockchain.lock().unwrap().restore(snapshot));
+                            match result {
+                                Ok(()) => info!("Restored snapshot {}", path),
+                                Err(e) => error!("Failed to restore snapshot: {}", e),
+                            }
+                        }
+                        // TODO: handle other commands
+                        _ => info!("command: {:?}", cmd),
+                    }
                 }
 
                 EventType::Genesis => {
@@ -201,6 +382,7 @@ async fn main() {
                         .behaviour_mut()
                         .gossipsub
                         .publish(p2p::GENESIS_TOPIC.clone(), serialized);
+                    metrics::METRICS.p2p_messages_published.inc(p2p::GENESIS_TOPIC.hash().as_str());
                     info!("test: {:?}", test);
                 }
 
@@ -211,7 +393,7 @@ async fn main() {
                     let my_address = Account {
                         address: blockchain.wallet.get_public_key().to_string(),
                     };
-                    let hash_chain = HashChain::new();
+                    let hash_chain = HashChain::with_length(blockchain.epoch.duration);
 
                     // Commitment is the last hash in the hash chain
                     let commitment = hash_chain.hash_chain.last().unwrap();
@@ -229,6 +411,7 @@ async fn main() {
                         .gossipsub
                         .publish(p2p::HASH_CHAIN_TOPIC.clone(), json.as_bytes())
                         .unwrap();
+                    metrics::METRICS.p2p_messages_published.inc(p2p::HASH_CHAIN_TOPIC.hash().as_str());
                     blockchain.epoch.progress();
                     blockchain.hash_chain = hash_chain.clone();
                     info!("Epoch: {}", blockchain.epoch.timestamp);
@@ -250,7 +433,7 @@ async fn main() {
 
                     if blockchain_guard.epoch.timestamp == 1 {
                         next_seed = Some(blockchain_guard.new_epoch());
-                    } else if (blockchain_guard.epoch.timestamp % EPOCH_DURATION) != 0 {
+                    } else if (blockchain_guard.epoch.timestamp % blockchain_guard.epoch.duration) != 0 {
                         next_seed = Some(blockchain_guard.get_next_seed());
                     } else if blockchain_guard.epoch.is_end_of_epoch() || blockchain_guard.epoch.timestamp == 0
                     {
@@ -284,6 +467,7 @@ async fn main() {
                             .gossipsub
                             .publish(p2p::TRANSACTION_TOPIC.clone(), json.into_bytes())
                             .unwrap();
+                        metrics::METRICS.p2p_messages_published.inc(p2p::TRANSACTION_TOPIC.hash().as_str());
                         info!("RPC transaction processed and relayed: {:?}", txn.hash);
                     }
                 }
@@ -310,7 +494,7 @@ async fn main() {
                 .bright_green()
             );
             let hash_chain_index = blockchain.hash_chain.get_hash(
-                EPOCH_DURATION as usize - blockchain.epoch.timestamp as usize + 1,
+                blockchain.epoch.duration as usize - blockchain.epoch.timestamp as usize + 1,
                 proposer.clone(),
             );
             // --- Fetch Transactions from Mempool ---
@@ -339,6 +523,7 @@ async fn main() {
                 .gossipsub
                 .publish(p2p::BLOCK_TOPIC.clone(), json.as_bytes())
                 .unwrap();
+            metrics::METRICS.p2p_messages_published.inc(p2p::BLOCK_TOPIC.hash().as_str());
 
             info!("📩 Block proposed: {:?}", new_block.id);
         }
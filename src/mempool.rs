@@ -1,5 +1,10 @@
+use crate::config::MAX_TXNS_PER_BLOCK;
 use crate::transaction::Transaction;
+use crate::tx::SignedTx;
 use serde::{Deserialize, Serialize};
+use std::cmp::Reverse;
+use std::collections::{BTreeMap, BinaryHeap, HashMap};
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Mempool {
     pub transactions: Vec<Transaction>,
@@ -42,3 +47,316 @@ impl Mempool {
         self.transactions.clear();
     }
 }
+
+/// Why a transaction left the pool without being included in a block
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum EvictionReason {
+    /// Replaced by a transaction with the same nonce and a higher fee
+    Replaced,
+    /// Dropped for a higher-fee transaction while the pool was full
+    PoolFull,
+    /// Its nonce was used by a transaction included in a block
+    Stale,
+}
+
+/// Called for every transaction evicted from a `TxPool`
+pub type EvictionCallback = Box<dyn Fn(&SignedTx, EvictionReason) + Send + Sync>;
+
+/// Size limits of a `TxPool`
+#[derive(Debug, Clone)]
+pub struct PoolConfig {
+    /// Transactions held in total
+    pub max_txs: usize,
+    /// Transactions held per sender
+    pub max_per_sender: usize,
+}
+
+impl Default for PoolConfig {
+    fn default() -> Self {
+        Self {
+            max_txs: 10 * MAX_TXNS_PER_BLOCK,
+            max_per_sender: 16,
+        }
+    }
+}
+
+/// Pool of typed transactions, reaped by fee while keeping each sender's
+/// transactions in nonce order
+pub struct TxPool {
+    config: PoolConfig,
+    /// Pending transactions of every sender, by nonce
+    senders: HashMap<String, BTreeMap<u64, SignedTx>>,
+    /// Next nonce of every sender with included transactions
+    next_nonce: HashMap<String, u64>,
+    /// Sender and nonce of every pending transaction
+    hashes: HashMap<[u8; 32], (String, u64)>,
+    callbacks: Vec<EvictionCallback>,
+}
+
+impl TxPool {
+    pub fn new(config: PoolConfig) -> Self {
+        Self {
+            config,
+            senders: HashMap::new(),
+            next_nonce: HashMap::new(),
+            hashes: HashMap::new(),
+            callbacks: Vec::new(),
+        }
+    }
+
+    /// Register a callback notified of evicted transactions
+    pub fn on_evict(&mut self, callback: EvictionCallback) {
+        self.callbacks.push(callback);
+    }
+
+    /// Number of pending transactions
+    pub fn len(&self) -> usize {
+        self.hashes.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.hashes.is_empty()
+    }
+
+    pub fn contains(&self, hash: &[u8; 32]) -> bool {
+        self.hashes.contains_key(hash)
+    }
+
+    /// Next nonce expected from `sender`
+    pub fn next_nonce(&self, sender: &str) -> u64 {
+        self.next_nonce.get(sender).copied().unwrap_or(0)
+    }
+
+    /// Add a verified transaction, returning its hash
+    pub fn add(&mut self, tx: SignedTx) -> Result<[u8; 32], String> {
+        let hash = tx.hash()?;
+        if self.hashes.contains_key(&hash) {
+            return Err("Transaction already in the pool".to_string());
+        }
+        let sender = tx.tx.sender.address.clone();
+        let nonce = tx.tx.nonce;
+        if nonce < self.next_nonce(&sender) {
+            return Err(format!(
+                "Nonce {} already used, expected at least {}",
+                nonce,
+                self.next_nonce(&sender)
+            ));
+        }
+
+        let pending = self.senders.get(&sender);
+        if let Some(existing) = pending.and_then(|txs| txs.get(&nonce)) {
+            if tx.tx.fee <= existing.tx.fee {
+                return Err(format!(
+                    "Nonce {} is pending with a fee of at least {}",
+                    nonce, tx.tx.fee
+                ));
+            }
+            self.evict(&sender, nonce, EvictionReason::Replaced);
+        } else {
+            if pending.map_or(0, BTreeMap::len) >= self.config.max_per_sender {
+                return Err(format!("Too many pending transactions from {}", sender));
+            }
+            if self.len() >= self.config.max_txs {
+                let (lowest_sender, lowest_nonce, lowest_fee) = self
+                    .lowest_fee()
+                    .ok_or_else(|| "Transaction pool is full".to_string())?;
+                if tx.tx.fee <= lowest_fee {
+                    return Err(format!(
+                        "Transaction pool is full, fee must exceed {}",
+                        lowest_fee
+                    ));
+                }
+                self.evict(&lowest_sender, lowest_nonce, EvictionReason::PoolFull);
+            }
+        }
+
+        self.hashes.insert(hash, (sender.clone(), nonce));
+        self.senders.entry(sender).or_default().insert(nonce, tx);
+        Ok(hash)
+    }
+
+    // Pending transaction with the lowest fee, a sender's last on ties
+    fn lowest_fee(&self) -> Option<(String, u64, u64)> {
+        self.senders
+            .iter()
+            .flat_map(|(sender, txs)| {
+                txs.iter()
+                    .map(move |(nonce, tx)| (tx.tx.fee, Reverse(*nonce), sender))
+            })
+            .min()
+            .map(|(fee, Reverse(nonce), sender)| (sender.clone(), nonce, fee))
+    }
+
+    fn evict(&mut self, sender: &str, nonce: u64, reason: EvictionReason) {
+        if let Some(tx) = self.take(sender, nonce) {
+            for callback in &self.callbacks {
+                callback(&tx, reason);
+            }
+        }
+    }
+
+    fn take(&mut self, sender: &str, nonce: u64) -> Option<SignedTx> {
+        let txs = self.senders.get_mut(sender)?;
+        let tx = txs.remove(&nonce)?;
+        if txs.is_empty() {
+            self.senders.remove(sender);
+        }
+        self.hashes
+            .retain(|_, entry| !(entry.0 == sender && entry.1 == nonce));
+        Some(tx)
+    }
+
+    /// Up to `limit` transactions for the next block, highest fee first among
+    /// the transactions whose nonce follows the sender's last one. The
+    /// transactions stay in the pool until they are removed.
+    pub fn reap(&self, limit: usize) -> Vec<SignedTx> {
+        // Head of every sender's run of consecutive nonces
+        let mut heads = BinaryHeap::new();
+        let mut runs = HashMap::new();
+        for (sender, txs) in &self.senders {
+            let next = self.next_nonce(sender);
+            let run = txs
+                .range(next..)
+                .enumerate()
+                .take_while(move |(i, (nonce, _))| **nonce == next + *i as u64)
+                .map(|(_, (_, tx))| tx);
+            let mut run = run.peekable();
+            if let Some(tx) = run.peek() {
+                heads.push((tx.tx.fee, Reverse(sender.clone())));
+            }
+            runs.insert(sender.clone(), run);
+        }
+
+        let mut reaped = Vec::new();
+        while reaped.len() < limit {
+            let Some((_, Reverse(sender))) = heads.pop() else {
+                break;
+            };
+            let run = runs.get_mut(&sender).unwrap();
+            reaped.push(run.next().unwrap().clone());
+            if let Some(tx) = run.peek() {
+                heads.push((tx.tx.fee, Reverse(sender)));
+            }
+        }
+        reaped
+    }
+
+    /// Remove transactions included in a block and evict the pending ones
+    /// whose nonce they used
+    pub fn remove(&mut self, included: &[SignedTx]) {
+        for tx in included {
+            let sender = &tx.tx.sender.address;
+            let next = self.next_nonce(sender).max(tx.tx.nonce + 1);
+            self.next_nonce.insert(sender.clone(), next);
+            if let Ok(hash) = tx.hash() {
+                if self.hashes.contains_key(&hash) {
+                    self.take(sender, tx.tx.nonce);
+                }
+            }
+        }
+        let stale: Vec<(String, u64)> = self
+            .senders
+            .iter()
+            .flat_map(|(sender, txs)| {
+                let next = self.next_nonce(sender);
+                txs.range(..next)
+                    .map(move |(nonce, _)| (sender.clone(), *nonce))
+            })
+            .collect();
+        for (sender, nonce) in stale {
+            self.evict(&sender, nonce, EvictionReason::Stale);
+        }
+    }
+
+    /// Return the transactions of blocks retracted by a reorg to the pool,
+    /// rewinding the next nonce of their senders. Transactions the pool has
+    /// no room for are dropped.
+    pub fn restore(&mut self, retracted: &[SignedTx]) {
+        for tx in retracted {
+            let sender = &tx.tx.sender.address;
+            if tx.tx.nonce < self.next_nonce(sender) {
+                self.next_nonce.insert(sender.clone(), tx.tx.nonce);
+            }
+        }
+        for tx in retracted {
+            let _ = self.add(tx.clone());
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::signer::Signer;
+    use crate::tx::{Payment, UnsignedTx};
+    use crate::wallet::Wallet;
+    use std::sync::{Arc, Mutex};
+
+    fn payment(wallet: &Wallet, nonce: u64, fee: u64) -> SignedTx {
+        UnsignedTx::new(
+            wallet,
+            nonce,
+            fee,
+            Payment {
+                recipient: Account {
+                    address: "bob".to_string(),
+                },
+                amount: 1,
+            },
+        )
+        .sign(wallet)
+        .unwrap()
+    }
+
+    #[test]
+    fn test_tx_pool() {
+        let alice = Wallet::new().expect("Failed to create wallet");
+        let carol = Wallet::new().expect("Failed to create wallet");
+        let mut pool = TxPool::new(PoolConfig {
+            max_txs: 4,
+            max_per_sender: 3,
+        });
+        let evicted = Arc::new(Mutex::new(Vec::new()));
+        let log = evicted.clone();
+        pool.on_evict(Box::new(move |tx, reason| {
+            log.lock().unwrap().push((tx.tx.nonce, tx.tx.fee, reason))
+        }));
+
+        pool.add(payment(&alice, 0, 1)).unwrap();
+        pool.add(payment(&alice, 1, 9)).unwrap();
+        pool.add(payment(&carol, 0, 5)).unwrap();
+        // Alice's high-fee transaction waits for her first one
+        let fees: Vec<u64> = pool.reap(10).iter().map(|tx| tx.tx.fee).collect();
+        assert_eq!(fees, vec![5, 1, 9]);
+        assert_eq!(pool.reap(1)[0].tx.fee, 5);
+
+        // Same nonce needs a higher fee and replaces the pending one
+        assert!(pool.add(payment(&alice, 0, 1)).is_err());
+        pool.add(payment(&alice, 0, 2)).unwrap();
+        // A full pool drops its lowest fee for a higher one
+        pool.add(payment(&carol, 1, 6)).unwrap();
+        assert!(pool.add(payment(&carol, 2, 2)).is_err());
+        pool.add(payment(&carol, 2, 3)).unwrap();
+        assert_eq!(pool.len(), 4);
+        assert!(pool.add(payment(&carol, 3, 7)).is_err());
+
+        // Included transactions advance the nonces and evict stale ones
+        let block = pool.reap(2);
+        pool.remove(&block);
+        assert_eq!(pool.next_nonce(&carol.public_key_hex()), 2);
+        pool.remove(&[payment(&alice, 1, 0)]);
+        pool.remove(&[payment(&carol, 2, 0)]);
+        assert!(pool.is_empty());
+        assert!(pool.add(payment(&alice, 1, 9)).is_err());
+        assert_eq!(
+            *evicted.lock().unwrap(),
+            vec![
+                (0, 1, EvictionReason::Replaced),
+                (0, 2, EvictionReason::PoolFull),
+                (1, 9, EvictionReason::Stale),
+                (2, 3, EvictionReason::Stale),
+            ]
+        );
+    }
+}
@@ -1,6 +1,13 @@
-use rs_merkle::{Hasher, MerkleProof, MerkleTree};
-use serde::Serialize;
-use sha3::{Digest, Keccak256};
+use crate::context::Context;
+use crate::error::CcokError;
+use crate::metrics::METRICS;
+use rayon::prelude::*;
+use rs_merkle::Hasher;
+use serde::{Deserialize, Serialize};
+use sha2::Sha256;
+use sha3::digest::Output;
+use sha3::{Digest, Keccak256, Sha3_512};
+use std::cell::RefCell;
 
 /// Custom hasher using Keccak256 (SHA3)
 #[derive(Default, Clone)]
@@ -16,46 +23,598 @@ impl Hasher for CustomHasher {
     }
 }
 
+/// Hash function of the Merkle trees and coin flips. Tree nodes are 32 bytes,
+/// so SHA3-512 digests are truncated to their first half.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(into = "u8", try_from = "u8")]
+pub enum HashAlgorithm {
+    #[default]
+    Keccak256,
+    Sha256,
+    Sha3_512,
+    Blake3,
+}
+
+impl HashAlgorithm {
+    /// Every supported hash function
+    pub const ALL: [HashAlgorithm; 4] = [
+        HashAlgorithm::Keccak256,
+        HashAlgorithm::Sha256,
+        HashAlgorithm::Sha3_512,
+        HashAlgorithm::Blake3,
+    ];
+
+    /// Identifier committed in params and certificates
+    pub fn id(&self) -> u8 {
+        match self {
+            HashAlgorithm::Keccak256 => 1,
+            HashAlgorithm::Sha256 => 2,
+            HashAlgorithm::Sha3_512 => 3,
+            HashAlgorithm::Blake3 => 4,
+        }
+    }
+
+    /// Look up a hash function by identifier
+    pub fn from_id(id: u8) -> Result<Self, String> {
+        Self::ALL
+            .into_iter()
+            .find(|hash| hash.id() == id)
+            .ok_or_else(|| format!("Unknown hash algorithm id: {}", id))
+    }
+
+    /// Human readable name
+    pub fn name(&self) -> &'static str {
+        match self {
+            HashAlgorithm::Keccak256 => "keccak256",
+            HashAlgorithm::Sha256 => "sha256",
+            HashAlgorithm::Sha3_512 => "sha3-512",
+            HashAlgorithm::Blake3 => "blake3",
+        }
+    }
+
+    /// Hash `data` to a 32-byte digest
+    pub fn hash(&self, data: &[u8]) -> [u8; 32] {
+        self.digest(&[], &[data])
+    }
+
+    /// Hash the concatenation of `parts` without copying them together
+    pub fn hash_parts(&self, parts: &[&[u8]]) -> [u8; 32] {
+        self.digest(&[], parts)
+    }
+
+    // Hash `prefix` followed by `parts`, streamed into a hasher on the stack
+    fn digest(&self, prefix: &[u8], parts: &[&[u8]]) -> [u8; 32] {
+        match self {
+            HashAlgorithm::Keccak256 => digest_parts::<Keccak256>(prefix, parts).into(),
+            HashAlgorithm::Sha256 => digest_parts::<Sha256>(prefix, parts).into(),
+            HashAlgorithm::Sha3_512 => {
+                let mut out = [0u8; 32];
+                out.copy_from_slice(&digest_parts::<Sha3_512>(prefix, parts)[..32]);
+                out
+            }
+            HashAlgorithm::Blake3 => {
+                let mut hasher = blake3::Hasher::new();
+                hasher.update(prefix);
+                for part in parts {
+                    hasher.update(part);
+                }
+                hasher.finalize().into()
+            }
+        }
+    }
+}
+
+fn digest_parts<D: Digest>(prefix: &[u8], parts: &[&[u8]]) -> Output<D> {
+    let mut hasher = D::new();
+    hasher.update(prefix);
+    for part in parts {
+        hasher.update(part);
+    }
+    hasher.finalize()
+}
+
+impl From<HashAlgorithm> for u8 {
+    fn from(hash: HashAlgorithm) -> Self {
+        hash.id()
+    }
+}
+
+impl TryFrom<u8> for HashAlgorithm {
+    type Error = String;
+
+    fn try_from(id: u8) -> Result<Self, Self::Error> {
+        Self::from_id(id)
+    }
+}
+
+/// Purpose of a hash invocation, so that a hash computed for one purpose can
+/// never be passed off as one computed for another
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HashDomain {
+    /// Merkle leaves
+    Leaf,
+    /// Internal Merkle nodes
+    Node,
+    /// Coin flips selecting the reveals
+    Coin,
+    /// Messages participants sign
+    Message,
+    /// Coins picking the reveals an aggregate proof opens
+    Opening,
+    /// Messages participants sign, bound to a chain, round and purpose
+    Binding,
+    /// Seeds the coins of a certificate derive from
+    CoinSeed,
+    /// Public keys participants commit to by digest
+    PublicKey,
+    /// Keys of state tree entries other than accounts
+    State,
+}
+
+impl HashDomain {
+    /// Tag prefixed to the hashed data
+    pub fn tag(&self) -> &'static [u8] {
+        match self {
+            HashDomain::Leaf => b"niropok/leaf\0",
+            HashDomain::Node => b"niropok/node\0",
+            HashDomain::Coin => b"niropok/coin\0",
+            HashDomain::Message => b"niropok/msg\0",
+            HashDomain::Opening => b"niropok/open\0",
+            HashDomain::Binding => b"niropok/bind\0",
+            HashDomain::CoinSeed => b"niropok/seed\0",
+            HashDomain::PublicKey => b"niropok/pk\0",
+            HashDomain::State => b"niropok/state\0",
+        }
+    }
+
+    /// Prefix `data` with the domain tag
+    pub fn tagged(&self, data: &[u8]) -> Vec<u8> {
+        let mut tagged = self.tag().to_vec();
+        tagged.extend_from_slice(data);
+        tagged
+    }
+}
+
+/// Hash function together with whether its inputs are domain separated.
+/// Certificates from before domain separation use untagged hashes.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct Hashing {
+    /// The hash function
+    pub algorithm: HashAlgorithm,
+    /// Whether every input is prefixed with its `HashDomain` tag
+    pub domains: bool,
+}
+
+impl Hashing {
+    /// Hashing with `algorithm`, domain separated if `domains` is set
+    pub fn new(algorithm: HashAlgorithm, domains: bool) -> Self {
+        Self { algorithm, domains }
+    }
+
+    /// Hash `data` for `domain`
+    pub fn hash(&self, domain: HashDomain, data: &[u8]) -> [u8; 32] {
+        self.hash_parts(domain, &[data])
+    }
+
+    /// Hash the concatenation of `parts` for `domain`, without copying them
+    /// or the domain tag together
+    pub fn hash_parts(&self, domain: HashDomain, parts: &[&[u8]]) -> [u8; 32] {
+        let tag: &[u8] = if self.domains { domain.tag() } else { &[] };
+        self.algorithm.digest(tag, parts)
+    }
+
+    /// Parent of two tree nodes; a node without a sibling is carried up
+    pub fn hash_pair(&self, left: &[u8; 32], right: Option<&[u8; 32]>) -> [u8; 32] {
+        match right {
+            Some(right) => self.hash_parts(HashDomain::Node, &[left, right]),
+            None => *left,
+        }
+    }
+
+    /// Leaf hash of a serializable item, serialized into a buffer reused by
+    /// every leaf hash of the thread
+    pub fn leaf_hash<T: Serialize>(&self, item: &T) -> Result<[u8; 32], CcokError> {
+        LEAF_BUFFER.with(|buffer| match buffer.try_borrow_mut() {
+            Ok(mut buffer) => {
+                buffer.clear();
+                bincode::serialize_into(&mut *buffer, item)?;
+                let hash = self.hash(HashDomain::Leaf, &buffer);
+                // Don't hold on to the buffer of an unusually large item
+                if buffer.capacity() > MAX_LEAF_BUFFER {
+                    *buffer = Vec::new();
+                }
+                Ok(hash)
+            }
+            // An item hashing leaves while it is serialized gets its own buffer
+            Err(_) => Ok(self.hash(HashDomain::Leaf, &bincode::serialize(item)?)),
+        })
+    }
+}
+
+// Capacity above which a thread's leaf buffer is released after use
+const MAX_LEAF_BUFFER: usize = 64 * 1024;
+
+thread_local! {
+    static LEAF_BUFFER: RefCell<Vec<u8>> = RefCell::new(Vec::new());
+}
+
+impl From<HashAlgorithm> for Hashing {
+    fn from(algorithm: HashAlgorithm) -> Self {
+        Self::new(algorithm, false)
+    }
+}
+
+/// Leaf hash of a serializable item
+pub fn leaf_hash<T: Serialize>(item: &T) -> Result<[u8; 32], CcokError> {
+    Hashing::default().leaf_hash(item)
+}
+
+/// Audit path proving a single leaf's membership in a tree
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct AuditPath {
+    /// Number of leaves in the tree, fixing where odd nodes are carried up
+    pub total_leaves: usize,
+    /// Sibling hashes from the leaf up to the root
+    pub siblings: Vec<Vec<u8>>,
+}
+
+/// Verify that `leaf` is the leaf at `index` of the tree with root `root`
+pub fn verify_proof(root: &[u8], index: usize, leaf: &[u8; 32], path: &AuditPath) -> bool {
+    verify_proof_with(Hashing::default(), root, index, leaf, path)
+}
+
+/// Verify an audit path of a tree built with `hash`
+pub fn verify_proof_with(
+    hash: impl Into<Hashing>,
+    root: &[u8],
+    index: usize,
+    leaf: &[u8; 32],
+    path: &AuditPath,
+) -> bool {
+    if index >= path.total_leaves {
+        return false;
+    }
+    let hash = hash.into();
+    let mut siblings = path.siblings.iter();
+    let mut node = *leaf;
+    let mut index = index;
+    let mut len = path.total_leaves;
+    while len > 1 {
+        // The last node of an odd layer has no sibling and is carried up
+        if index ^ 1 < len {
+            let sibling: [u8; 32] = match siblings.next().map(|s| s.as_slice().try_into()) {
+                Some(Ok(sibling)) => sibling,
+                _ => return false,
+            };
+            node = if index % 2 == 0 {
+                hash.hash_pair(&node, Some(&sibling))
+            } else {
+                hash.hash_pair(&sibling, Some(&node))
+            };
+        }
+        index /= 2;
+        len = (len + 1) / 2;
+    }
+    siblings.next().is_none() && node.as_slice() == root
+}
+
+/// Multiproof hashes packed into one byte string. A multiproof holds every
+/// internal node shared by the proven positions once; packing the nodes also
+/// drops the length prefix each hash carries when serialized on its own.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CompressedProofSet {
+    /// Concatenated 32-byte node hashes, in multiproof order
+    #[serde(with = "serde_bytes")]
+    pub nodes: Vec<u8>,
+}
+
+impl CompressedProofSet {
+    /// Pack multiproof hashes
+    pub fn from_hashes(hashes: &[Vec<u8>]) -> Result<Self, CcokError> {
+        let mut nodes = Vec::with_capacity(hashes.len() * 32);
+        for hash in hashes {
+            if hash.len() != 32 {
+                return Err(CcokError::BadMerklePath(format!(
+                    "invalid proof hash length {}",
+                    hash.len()
+                )));
+            }
+            nodes.extend_from_slice(hash);
+        }
+        Ok(Self { nodes })
+    }
+
+    /// Unpack the multiproof hashes
+    pub fn hashes(&self) -> Result<Vec<Vec<u8>>, CcokError> {
+        if self.nodes.len() % 32 != 0 {
+            return Err(CcokError::BadMerklePath(format!(
+                "invalid compressed proof length {}",
+                self.nodes.len()
+            )));
+        }
+        Ok(self.nodes.chunks(32).map(|node| node.to_vec()).collect())
+    }
+
+    /// Number of node hashes
+    pub fn len(&self) -> usize {
+        self.nodes.len() / 32
+    }
+
+    /// Whether the set holds no hashes
+    pub fn is_empty(&self) -> bool {
+        self.nodes.is_empty()
+    }
+
+    /// Verify the leaves at sorted `positions` against `root` of a tree built with `hash`
+    pub fn verify(
+        &self,
+        hash: impl Into<Hashing>,
+        root: &[u8],
+        positions: &[usize],
+        total_leaves: usize,
+        leaves: &[[u8; 32]],
+    ) -> bool {
+        match self.hashes() {
+            Ok(hashes) => {
+                MerkleTreeBuilder::verify_with(hash, root, &hashes, positions, total_leaves, leaves)
+            }
+            Err(_) => false,
+        }
+    }
+}
+
+/// Leaves fed one at a time to a tree build, so a large set is never
+/// serialized, or even held, as a whole
+pub trait LeafSource {
+    /// Call `f` with the index and serialized bytes of every leaf, in order.
+    /// The bytes are only valid for the call.
+    fn for_each_leaf(
+        &mut self,
+        f: &mut dyn FnMut(usize, &[u8]) -> Result<(), CcokError>,
+    ) -> Result<(), CcokError>;
+}
+
+impl<T: Serialize> LeafSource for &[T] {
+    fn for_each_leaf(
+        &mut self,
+        f: &mut dyn FnMut(usize, &[u8]) -> Result<(), CcokError>,
+    ) -> Result<(), CcokError> {
+        // One buffer serves every item in turn
+        let mut buffer = Vec::new();
+        for (i, item) in self.iter().enumerate() {
+            buffer.clear();
+            bincode::serialize_into(&mut buffer, item)?;
+            f(i, &buffer)?;
+        }
+        Ok(())
+    }
+}
+
+// Leaves hashed between two checks of the build context
+const CONTEXT_CHECK_INTERVAL: usize = 256;
+
+/// Merkle tree with the same shape as `rs_merkle::MerkleTree`: the last node
+/// of an odd-sized layer is carried up unchanged. All layers are kept so single
+/// leaves can be updated or appended in O(log n).
 pub struct MerkleTreeBuilder {
-    tree: MerkleTree<CustomHasher>,
+    layers: Vec<Vec<[u8; 32]>>,
+    hash: Hashing,
 }
 
 impl MerkleTreeBuilder {
     /// Create a new empty Merkle tree
     pub fn new() -> Self {
+        Self::with_hash(Hashing::default())
+    }
+
+    /// Create a new empty Merkle tree hashed with `hash`
+    pub fn with_hash(hash: impl Into<Hashing>) -> Self {
         Self {
-            tree: MerkleTree::new(),
+            layers: vec![Vec::new()],
+            hash: hash.into(),
         }
     }
 
+    /// Hash function of the tree
+    pub fn hash(&self) -> Hashing {
+        self.hash
+    }
+
     /// Build a Merkle tree from a list of serializable items
-    pub fn build<T: Serialize>(&mut self, items: &[T]) -> Result<(), String> {
+    pub fn build<T: Serialize>(&mut self, items: &[T]) -> Result<(), CcokError> {
+        self.build_with_context(&Context::background(), items)
+    }
+
+    /// Build a Merkle tree, giving up once `ctx` is cancelled or expires
+    pub fn build_with_context<T: Serialize>(
+        &mut self,
+        ctx: &Context,
+        items: &[T],
+    ) -> Result<(), CcokError> {
+        self.build_from_source(ctx, &mut &items[..])
+    }
+
+    /// Build a Merkle tree from the serialized leaves of `source`, hashing
+    /// each as it is fed so only the 32-byte leaf hashes are held
+    pub fn build_from_source(
+        &mut self,
+        ctx: &Context,
+        source: &mut impl LeafSource,
+    ) -> Result<(), CcokError> {
+        let _timer = METRICS.tree_build_seconds.start_timer();
+        let mut leaves: Vec<[u8; 32]> = Vec::new();
+        source.for_each_leaf(&mut |i, bytes| {
+            if i % CONTEXT_CHECK_INTERVAL == 0 {
+                ctx.check()?;
+            }
+            leaves.push(self.hash.hash(HashDomain::Leaf, bytes));
+            Ok(())
+        })?;
+
+        self.set_leaves(leaves);
+        while self.layers.last().map_or(false, |layer| layer.len() > 1) {
+            ctx.check()?;
+            let layer = self.layers.last().unwrap();
+            let parents = layer
+                .chunks(2)
+                .map(|pair| self.hash.hash_pair(&pair[0], pair.get(1)))
+                .collect();
+            self.layers.push(parents);
+        }
+        Ok(())
+    }
+
+    /// Build the same tree as `build`, hashing the leaves and every layer
+    /// across the threads of the current rayon pool
+    pub fn build_parallel<T: Serialize + Sync>(&mut self, items: &[T]) -> Result<(), CcokError> {
+        self.build_parallel_with_context(&Context::background(), items)
+    }
+
+    /// Build the tree in parallel, giving up once `ctx` is cancelled or expires
+    pub fn build_parallel_with_context<T: Serialize + Sync>(
+        &mut self,
+        ctx: &Context,
+        items: &[T],
+    ) -> Result<(), CcokError> {
+        let _timer = METRICS.tree_build_seconds.start_timer();
+        let hash = self.hash;
+        // Chunks keep the output in leaf order whichever thread hashes them
         let leaves: Vec<[u8; 32]> = items
-            .iter()
-            .map(|item| {
-                let bytes =
-                    bincode::serialize(item).map_err(|e| format!("Serialization error: {}", e))?;
-                Ok(CustomHasher::hash(&bytes))
+            .par_chunks(CONTEXT_CHECK_INTERVAL)
+            .map(|chunk| {
+                ctx.check()?;
+                chunk
+                    .iter()
+                    .map(|item| hash.leaf_hash(item))
+                    .collect::<Result<Vec<_>, CcokError>>()
             })
-            .collect::<Result<Vec<_>, String>>()?;
+            .collect::<Result<Vec<_>, CcokError>>()?
+            .concat();
 
-        self.tree = MerkleTree::<CustomHasher>::from_leaves(&leaves);
+        self.set_leaves(leaves);
+        while self.layers.last().map_or(false, |layer| layer.len() > 1) {
+            ctx.check()?;
+            let layer = self.layers.last().unwrap();
+            let parents = layer
+                .par_chunks(2)
+                .with_min_len(CONTEXT_CHECK_INTERVAL)
+                .map(|pair| hash.hash_pair(&pair[0], pair.get(1)))
+                .collect();
+            self.layers.push(parents);
+        }
         Ok(())
     }
 
+    // Start the layers from `leaves`, with room for every layer above them
+    fn set_leaves(&mut self, leaves: Vec<[u8; 32]>) {
+        let mut layers = Vec::with_capacity(tree_height(leaves.len()));
+        layers.push(leaves);
+        self.layers = layers;
+    }
+
+    /// Number of leaves in the tree
+    pub fn len(&self) -> usize {
+        self.layers[0].len()
+    }
+
+    /// Whether the tree has no leaves
+    pub fn is_empty(&self) -> bool {
+        self.layers[0].is_empty()
+    }
+
+    /// Replace the leaf at `index`, recomputing only its path to the root
+    pub fn update<T: Serialize>(&mut self, index: usize, item: &T) -> Result<(), CcokError> {
+        if index >= self.len() {
+            return Err(CcokError::LeafOutOfRange(index));
+        }
+        self.layers[0][index] = self.hash.leaf_hash(item)?;
+        self.recompute_path(index);
+        Ok(())
+    }
+
+    /// Append a leaf, recomputing only the rightmost path to the root
+    pub fn append<T: Serialize>(&mut self, item: &T) -> Result<(), CcokError> {
+        self.layers[0].push(self.hash.leaf_hash(item)?);
+        // Make room for the new rightmost parents, growing a layer on top
+        // whenever the current top has two nodes
+        let mut level = 1;
+        while level < self.layers.len() || self.layers[level - 1].len() > 1 {
+            if level == self.layers.len() {
+                self.layers.push(Vec::new());
+            }
+            let parent = (self.layers[level - 1].len() - 1) / 2;
+            if parent == self.layers[level].len() {
+                self.layers[level].push([0u8; 32]);
+            }
+            level += 1;
+        }
+        self.recompute_path(self.len() - 1);
+        Ok(())
+    }
+
+    // Recompute the parents of leaf `index` up to the root
+    fn recompute_path(&mut self, mut index: usize) {
+        for level in 1..self.layers.len() {
+            let left = index & !1;
+            let (below, above) = self.layers.split_at_mut(level);
+            let children = &below[level - 1];
+            index /= 2;
+            above[0][index] = self.hash.hash_pair(&children[left], children.get(left + 1));
+        }
+    }
+
     /// Get the root hash of the Merkle tree
     pub fn root(&self) -> Vec<u8> {
-        self.tree.root().unwrap_or_default().to_vec()
+        match self.layers.last() {
+            Some(top) if top.len() == 1 => top[0].to_vec(),
+            _ => vec![0u8; 32],
+        }
     }
 
     /// Generate Merkle proofs for given positions
     pub fn prove(&self, positions: &[usize]) -> Vec<Vec<u8>> {
-        let proof = self.tree.proof(positions);
+        // Same layout as rs_merkle multiproofs: per layer, the siblings that are
+        // not themselves known, bottom-up
+        let mut indices = positions.to_vec();
+        let mut proof = Vec::new();
+        for layer in &self.layers {
+            for index in indices.iter().map(|i| i ^ 1) {
+                if !indices.contains(&index) {
+                    if let Some(hash) = layer.get(index) {
+                        proof.push(hash.to_vec());
+                    }
+                }
+            }
+            indices = indices.iter().map(|i| i / 2).collect();
+            indices.dedup();
+        }
         proof
-            .proof_hashes()
-            .iter()
-            .map(|hash| hash.to_vec())
-            .collect()
+    }
+
+    /// Generate a multiproof for the given positions as a packed proof set
+    pub fn prove_compressed(&self, positions: &[usize]) -> CompressedProofSet {
+        CompressedProofSet {
+            nodes: self.prove(positions).concat(),
+        }
+    }
+
+    /// Generate the audit path of the leaf at `index`
+    pub fn prove_leaf(&self, index: usize) -> Result<AuditPath, CcokError> {
+        if index >= self.len() {
+            return Err(CcokError::LeafOutOfRange(index));
+        }
+        let mut siblings = Vec::new();
+        let mut index = index;
+        for layer in &self.layers[..self.layers.len() - 1] {
+            if let Some(sibling) = layer.get(index ^ 1) {
+                siblings.push(sibling.to_vec());
+            }
+            index /= 2;
+        }
+        Ok(AuditPath {
+            total_leaves: self.len(),
+            siblings,
+        })
     }
 
     /// Verify a Merkle proof
@@ -66,22 +625,153 @@ impl MerkleTreeBuilder {
         total_leaves: usize,
         leaves: &[[u8; 32]],
     ) -> bool {
-        let proof = MerkleProof::<CustomHasher>::new(
-            proof_hashes
-                .iter()
-                .map(|h| {
-                    let mut hash = [0u8; 32];
-                    hash.copy_from_slice(h);
-                    hash
+        Self::verify_with(
+            Hashing::default(),
+            root,
+            proof_hashes,
+            positions,
+            total_leaves,
+            leaves,
+        )
+    }
+
+    /// Verify a Merkle proof of a tree built with `hash`
+    pub fn verify_with(
+        hash: impl Into<Hashing>,
+        root: &[u8],
+        proof_hashes: &[Vec<u8>],
+        positions: &[usize],
+        total_leaves: usize,
+        leaves: &[[u8; 32]],
+    ) -> bool {
+        let proof: Option<Vec<[u8; 32]>> = proof_hashes
+            .iter()
+            .map(|h| h.as_slice().try_into().ok())
+            .collect();
+        match proof {
+            Some(proof) => multiproof_root(hash.into(), &proof, positions, total_leaves, leaves)
+                .map_or(false, |computed| computed.as_slice() == root),
+            None => false,
+        }
+    }
+
+    /// Audit paths of every leaf a multiproof covers, in the order of
+    /// `positions`, if the multiproof proves the leaves under `root`
+    pub fn expand_proof(
+        hash: impl Into<Hashing>,
+        root: &[u8],
+        proof_hashes: &[Vec<u8>],
+        positions: &[usize],
+        total_leaves: usize,
+        leaves: &[[u8; 32]],
+    ) -> Option<Vec<AuditPath>> {
+        let proof: Vec<[u8; 32]> = proof_hashes
+            .iter()
+            .map(|h| h.as_slice().try_into().ok())
+            .collect::<Option<_>>()?;
+        let layers = multiproof_layers(hash.into(), &proof, positions, total_leaves, leaves)?;
+        if layers.last()?[0].1.as_slice() != root {
+            return None;
+        }
+        positions
+            .iter()
+            .map(|&position| {
+                let mut siblings = Vec::new();
+                let (mut index, mut len) = (position, total_leaves);
+                for layer in &layers[..layers.len() - 1] {
+                    if index ^ 1 < len {
+                        let i = layer
+                            .binary_search_by_key(&(index ^ 1), |(index, _)| *index)
+                            .ok()?;
+                        siblings.push(layer[i].1.to_vec());
+                    }
+                    index /= 2;
+                    len = (len + 1) / 2;
+                }
+                Some(AuditPath {
+                    total_leaves,
+                    siblings,
                 })
-                .collect(),
-        );
+            })
+            .collect()
+    }
+}
+
+// Number of layers of a tree with `leaves` leaves
+fn tree_height(leaves: usize) -> usize {
+    leaves.next_power_of_two().trailing_zeros() as usize + 1
+}
 
-        let mut root_hash = [0u8; 32];
-        root_hash.copy_from_slice(root);
+// Root implied by a multiproof in the layout of `MerkleTreeBuilder::prove`
+fn multiproof_root(
+    hash: Hashing,
+    proof: &[[u8; 32]],
+    positions: &[usize],
+    total_leaves: usize,
+    leaves: &[[u8; 32]],
+) -> Option<[u8; 32]> {
+    Some(multiproof_layers(hash, proof, positions, total_leaves, leaves)?.last()?[0].1)
+}
+
+// Nodes a multiproof makes known on every layer, sorted by index, from the
+// leaves with their proven siblings up to the root
+fn multiproof_layers(
+    hash: Hashing,
+    proof: &[[u8; 32]],
+    positions: &[usize],
+    total_leaves: usize,
+    leaves: &[[u8; 32]],
+) -> Option<Vec<Vec<(usize, [u8; 32])>>> {
+    if positions.is_empty()
+        || positions.len() != leaves.len()
+        || positions.windows(2).any(|w| w[0] >= w[1])
+        || positions[positions.len() - 1] >= total_leaves
+    {
+        return None;
+    }
+
+    let mut nodes: Vec<(usize, [u8; 32])> = positions
+        .iter()
+        .copied()
+        .zip(leaves.iter().copied())
+        .collect();
+    let mut proof = proof.iter();
+    let mut layers = Vec::new();
+    let mut len = total_leaves;
+    while len > 1 {
+        // Add the siblings the proof provides for this layer
+        let known: Vec<usize> = nodes.iter().map(|(index, _)| *index).collect();
+        for sibling in known.iter().map(|index| index ^ 1) {
+            if sibling < len && !known.contains(&sibling) {
+                nodes.push((sibling, *proof.next()?));
+            }
+        }
+        nodes.sort_by_key(|(index, _)| *index);
+
+        let mut parents = Vec::with_capacity(nodes.len() / 2 + 1);
+        let mut k = 0;
+        while k < nodes.len() {
+            let (index, left) = nodes[k];
+            match nodes.get(k + 1) {
+                Some((next, right)) if index % 2 == 0 && *next == index + 1 => {
+                    parents.push((index / 2, hash.hash_pair(&left, Some(right))));
+                    k += 2;
+                }
+                _ => {
+                    parents.push((index / 2, hash.hash_pair(&left, None)));
+                    k += 1;
+                }
+            }
+        }
+        layers.push(std::mem::replace(&mut nodes, parents));
+        len = (len + 1) / 2;
+    }
 
-        proof.verify(root_hash, positions, leaves, total_leaves)
+    if proof.next().is_some() {
+        return None;
     }
+    layers.push(nodes);
+    Some(layers)
 }
 
 impl Default for MerkleTreeBuilder {
@@ -89,3 +779,278 @@ impl Default for MerkleTreeBuilder {
         Self::new()
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_incremental_updates_match_rebuild() {
+        let mut items: Vec<u64> = (0..5).collect();
+        let mut tree = MerkleTreeBuilder::new();
+        tree.build(&items).unwrap();
+
+        // Grow through several odd and power-of-two sizes, updating along the way
+        for i in 5..19u64 {
+            tree.append(&i).unwrap();
+            items.push(i);
+            let index = (i as usize * 7) % items.len();
+            tree.update(index, &(i * 100)).unwrap();
+            items[index] = i * 100;
+
+            let mut rebuilt = MerkleTreeBuilder::new();
+            rebuilt.build(&items).unwrap();
+            assert_eq!(tree.root(), rebuilt.root());
+        }
+        assert!(tree.update(items.len(), &0u64).is_err());
+
+        // Proofs from the updated tree still verify
+        let positions = [1, 6, 7, 18];
+        let leaves: Vec<[u8; 32]> = positions
+            .iter()
+            .map(|&p| leaf_hash(&items[p]).unwrap())
+            .collect();
+        assert!(MerkleTreeBuilder::verify(
+            &tree.root(),
+            &tree.prove(&positions),
+            &positions,
+            items.len(),
+            &leaves,
+        ));
+
+        // Appending to an empty tree
+        let mut tree = MerkleTreeBuilder::new();
+        tree.append(&1u64).unwrap();
+        tree.append(&2u64).unwrap();
+        let mut rebuilt = MerkleTreeBuilder::new();
+        rebuilt.build(&[1u64, 2]).unwrap();
+        assert_eq!(tree.root(), rebuilt.root());
+    }
+
+    #[test]
+    fn test_parallel_build() {
+        for hash in HashAlgorithm::ALL {
+            let hashing = Hashing::new(hash, true);
+            for size in [0, 1, 2, 3, 255, 256, 257, 1000] {
+                let items: Vec<u64> = (0..size).collect();
+                let mut sequential = MerkleTreeBuilder::with_hash(hashing);
+                sequential.build(&items).unwrap();
+                let mut parallel = MerkleTreeBuilder::with_hash(hashing);
+                parallel.build_parallel(&items).unwrap();
+                assert_eq!(parallel.layers, sequential.layers);
+            }
+        }
+
+        let ctx = Context::background();
+        ctx.cancel();
+        let mut tree = MerkleTreeBuilder::new();
+        assert_eq!(
+            tree.build_parallel_with_context(&ctx, &[1u64, 2]),
+            Err(CcokError::Cancelled)
+        );
+    }
+
+    #[test]
+    fn test_hash_algorithms() {
+        let items: Vec<u64> = (0..7).collect();
+        let positions = [2, 5];
+        let mut roots = Vec::new();
+        for hash in HashAlgorithm::ALL {
+            assert_eq!(HashAlgorithm::from_id(hash.id()).unwrap(), hash);
+
+            let mut tree = MerkleTreeBuilder::with_hash(hash);
+            tree.build(&items).unwrap();
+            let leaves: Vec<[u8; 32]> = positions
+                .iter()
+                .map(|&p| Hashing::from(hash).leaf_hash(&items[p]).unwrap())
+                .collect();
+            let proof = tree.prove(&positions);
+            assert!(MerkleTreeBuilder::verify_with(
+                hash,
+                &tree.root(),
+                &proof,
+                &positions,
+                items.len(),
+                &leaves
+            ));
+            let path = tree.prove_leaf(5).unwrap();
+            assert!(verify_proof_with(hash, &tree.root(), 5, &leaves[1], &path));
+            roots.push(tree.root());
+        }
+        roots.dedup();
+        assert_eq!(roots.len(), HashAlgorithm::ALL.len());
+        assert!(HashAlgorithm::from_id(0).is_err());
+    }
+
+    #[test]
+    fn test_leaf_source() {
+        // Leaves already serialized, e.g. streamed from a file
+        struct Encoded(Vec<Vec<u8>>);
+        impl LeafSource for Encoded {
+            fn for_each_leaf(
+                &mut self,
+                f: &mut dyn FnMut(usize, &[u8]) -> Result<(), CcokError>,
+            ) -> Result<(), CcokError> {
+                for (i, bytes) in self.0.iter().enumerate() {
+                    f(i, bytes)?;
+                }
+                Ok(())
+            }
+        }
+
+        let items: Vec<u64> = (0..300).collect();
+        let hashing = Hashing::new(HashAlgorithm::Sha256, true);
+        let mut expected = MerkleTreeBuilder::with_hash(hashing);
+        expected.build(&items).unwrap();
+        let mut source = Encoded(
+            items
+                .iter()
+                .map(|i| bincode::serialize(i).unwrap())
+                .collect(),
+        );
+        let mut tree = MerkleTreeBuilder::with_hash(hashing);
+        tree.build_from_source(&Context::background(), &mut source)
+            .unwrap();
+        assert_eq!(tree.root(), expected.root());
+        assert_eq!(tree.prove_leaf(299), expected.prove_leaf(299));
+
+        let ctx = Context::background();
+        ctx.cancel();
+        assert_eq!(
+            tree.build_from_source(&ctx, &mut source),
+            Err(CcokError::Cancelled)
+        );
+    }
+
+    #[test]
+    fn test_hash_parts() {
+        for hash in HashAlgorithm::ALL {
+            assert_eq!(hash.hash_parts(&[b"ab", b"", b"c"]), hash.hash(b"abc"));
+            for domains in [false, true] {
+                let hashing = Hashing::new(hash, domains);
+                let tagged = if domains {
+                    HashDomain::Coin.tagged(b"abc")
+                } else {
+                    b"abc".to_vec()
+                };
+                assert_eq!(
+                    hashing.hash_parts(HashDomain::Coin, &[b"a", b"bc"]),
+                    hash.hash(&tagged)
+                );
+
+                // Reused leaf buffers hash like fresh serializations, even after
+                // a large item
+                let big = vec![7u8; 2 * MAX_LEAF_BUFFER];
+                for item in [vec![1u8, 2, 3], big, vec![4]] {
+                    let bytes = bincode::serialize(&item).unwrap();
+                    assert_eq!(
+                        hashing.leaf_hash(&item).unwrap(),
+                        hashing.hash(HashDomain::Leaf, &bytes)
+                    );
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn test_domain_separation() {
+        let items: Vec<u64> = (0..6).collect();
+        let positions = [1, 4];
+        let separated = Hashing::new(HashAlgorithm::Keccak256, true);
+
+        let mut legacy_tree = MerkleTreeBuilder::new();
+        legacy_tree.build(&items).unwrap();
+        let mut tree = MerkleTreeBuilder::with_hash(separated);
+        tree.build(&items).unwrap();
+        assert_ne!(tree.root(), legacy_tree.root());
+
+        let leaves: Vec<[u8; 32]> = positions
+            .iter()
+            .map(|&p| separated.leaf_hash(&items[p]).unwrap())
+            .collect();
+        let proof = tree.prove(&positions);
+        assert!(MerkleTreeBuilder::verify_with(
+            separated,
+            &tree.root(),
+            &proof,
+            &positions,
+            items.len(),
+            &leaves
+        ));
+        // A leaf hash can't be passed off as an internal node
+        assert_ne!(
+            separated.hash(HashDomain::Leaf, b"data"),
+            separated.hash(HashDomain::Node, b"data")
+        );
+        assert!(!MerkleTreeBuilder::verify_with(
+            HashAlgorithm::Keccak256,
+            &tree.root(),
+            &proof,
+            &positions,
+            items.len(),
+            &leaves
+        ));
+    }
+
+    #[test]
+    fn test_audit_path() {
+        for size in 1..=9u64 {
+            let items: Vec<u64> = (0..size).collect();
+            let mut tree = MerkleTreeBuilder::new();
+            tree.build(&items).unwrap();
+            let root = tree.root();
+
+            for (index, item) in items.iter().enumerate() {
+                let leaf = leaf_hash(item).unwrap();
+                let path = tree.prove_leaf(index).unwrap();
+                assert!(verify_proof(&root, index, &leaf, &path));
+
+                // The path is bound to the leaf and its position
+                let other = leaf_hash(&(size + 1)).unwrap();
+                assert!(!verify_proof(&root, index, &other, &path));
+                if size > 1 {
+                    let moved = (index + 1) % items.len();
+                    assert!(!verify_proof(&root, moved, &leaf, &path));
+                }
+            }
+            assert!(tree.prove_leaf(items.len()).is_err());
+        }
+    }
+
+    #[test]
+    fn test_expand_proof() {
+        let items: Vec<u64> = (0..11).collect();
+        let mut tree = MerkleTreeBuilder::new();
+        tree.build(&items).unwrap();
+        let root = tree.root();
+
+        // A multiproof expands into the audit paths of each of its leaves
+        let positions = [0, 3, 4, 10];
+        let leaves: Vec<[u8; 32]> = positions
+            .iter()
+            .map(|&i| leaf_hash(&items[i]).unwrap())
+            .collect();
+        let proof = tree.prove(&positions);
+        let paths = MerkleTreeBuilder::expand_proof(
+            Hashing::default(),
+            &root,
+            &proof,
+            &positions,
+            items.len(),
+            &leaves,
+        )
+        .unwrap();
+        for (&index, path) in positions.iter().zip(&paths) {
+            assert_eq!(path, &tree.prove_leaf(index).unwrap());
+        }
+        assert!(MerkleTreeBuilder::expand_proof(
+            Hashing::default(),
+            &[0u8; 32],
+            &proof,
+            &positions,
+            items.len(),
+            &leaves,
+        )
+        .is_none());
+    }
+}
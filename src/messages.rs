@@ -0,0 +1,147 @@
+//! Certificates over several messages at once, e.g. a block header, its state
+//! root and the hash of the next validator set. The messages are committed in
+//! a Merkle tree whose root is the signed `Params::msg`, so one certificate
+//! covers all of them and each can be proven on its own.
+use crate::ccok::Params;
+use crate::error::CcokError;
+use crate::merkle::{verify_proof_with, AuditPath, MerkleTreeBuilder};
+use serde::{Deserialize, Serialize};
+
+/// Batch of messages certified together
+pub struct MessageBatch {
+    params: Params,
+    messages: Vec<Vec<u8>>,
+    tree: MerkleTreeBuilder,
+}
+
+/// Proof that a message is part of the batch a certificate was signed over
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct MessageProof {
+    /// Position of the message in the batch
+    pub index: usize,
+    /// The message
+    #[serde(with = "serde_bytes")]
+    pub message: Vec<u8>,
+    /// Merkle path from the message to the batch root
+    pub path: AuditPath,
+}
+
+impl MessageBatch {
+    /// Commit to `messages` with the hashing of `params`, whose message is
+    /// replaced by the batch root
+    pub fn new(mut params: Params, messages: Vec<Vec<u8>>) -> Result<Self, CcokError> {
+        if messages.is_empty() {
+            return Err(CcokError::EmptyTree);
+        }
+        let mut tree = MerkleTreeBuilder::with_hash(params.hashing());
+        tree.build(&messages)?;
+        params.msg = tree.root();
+        Ok(Self {
+            params,
+            messages,
+            tree,
+        })
+    }
+
+    /// Params to build and verify the certificate over the batch with
+    pub fn params(&self) -> &Params {
+        &self.params
+    }
+
+    /// Root of the batch, the message participants sign
+    pub fn root(&self) -> &[u8] {
+        &self.params.msg
+    }
+
+    /// Messages of the batch, in order
+    pub fn messages(&self) -> &[Vec<u8>] {
+        &self.messages
+    }
+
+    /// Prove that the message at `index` is part of the batch
+    pub fn prove(&self, index: usize) -> Result<MessageProof, CcokError> {
+        let message = self
+            .messages
+            .get(index)
+            .ok_or(CcokError::LeafOutOfRange(index))?;
+        Ok(MessageProof {
+            index,
+            message: message.clone(),
+            path: self.tree.prove_leaf(index)?,
+        })
+    }
+}
+
+impl MessageProof {
+    /// Check the message against the batch root signed under `params`. A
+    /// certificate verified with the same params then covers the message.
+    pub fn verify(&self, params: &Params) -> Result<(), CcokError> {
+        let hashing = params.hashing();
+        let leaf = hashing.leaf_hash(&self.message)?;
+        if !verify_proof_with(hashing, &params.msg, self.index, &leaf, &self.path) {
+            return Err(CcokError::BadMerklePath(format!(
+                "message {} is not in the batch",
+                self.index
+            )));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant};
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_message_batch_certificate() {
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params {
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+
+        let messages = vec![
+            b"block header".to_vec(),
+            b"state root".to_vec(),
+            b"validator set hash".to_vec(),
+        ];
+        let batch = MessageBatch::new(params, messages.clone()).unwrap();
+        let params = batch.params().clone();
+
+        // One certificate over the batch root covers every message
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let cert = builder.build().unwrap();
+        assert!(cert.verify(&params, &party_tree.root()).unwrap());
+        for (i, message) in messages.iter().enumerate() {
+            let proof = batch.prove(i).unwrap();
+            assert_eq!(&proof.message, message);
+            proof.verify(&params).unwrap();
+        }
+
+        // Messages outside the batch or at another position don't verify
+        let mut forged = batch.prove(1).unwrap();
+        forged.message = b"other state root".to_vec();
+        assert!(forged.verify(&params).is_err());
+        let mut moved = batch.prove(1).unwrap();
+        moved.index = 2;
+        assert!(moved.verify(&params).is_err());
+        assert_eq!(batch.prove(3), Err(CcokError::LeafOutOfRange(3)));
+    }
+}
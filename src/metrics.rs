@@ -0,0 +1,272 @@
+//! Prometheus metrics of the node. The builder, the verifier, the Merkle
+//! trees and the gossip layer record into the process-wide `METRICS`, and
+//! the node daemon serves `Metrics::render`, the Prometheus text exposition
+//! format, on GET /metrics. Message rates are counters; Prometheus derives
+//! the rates with `rate()`.
+use once_cell::sync::Lazy;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::time::Instant;
+
+/// Upper bounds in seconds of the latency histogram buckets
+pub const LATENCY_BUCKETS: [f64; 12] = [
+    0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 10.0,
+];
+
+/// Metrics of the process
+pub static METRICS: Lazy<Metrics> = Lazy::new(Metrics::default);
+
+/// Value that only goes up
+#[derive(Debug, Default)]
+pub struct Counter(AtomicU64);
+
+impl Counter {
+    pub fn inc(&self) {
+        self.add(1);
+    }
+
+    pub fn add(&self, n: u64) {
+        self.0.fetch_add(n, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> u64 {
+        self.0.load(Ordering::Relaxed)
+    }
+}
+
+/// Value that is set
+#[derive(Debug, Default)]
+pub struct Gauge(AtomicU64);
+
+impl Gauge {
+    pub fn set(&self, value: u64) {
+        self.0.store(value, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> u64 {
+        self.0.load(Ordering::Relaxed)
+    }
+}
+
+/// Counters keyed by the value of one label, e.g. the gossip topic
+#[derive(Debug, Default)]
+pub struct CounterVec(Mutex<BTreeMap<String, u64>>);
+
+impl CounterVec {
+    pub fn inc(&self, label: &str) {
+        *self.0.lock().unwrap().entry(label.to_string()).or_default() += 1;
+    }
+
+    pub fn get(&self, label: &str) -> u64 {
+        self.0.lock().unwrap().get(label).copied().unwrap_or(0)
+    }
+}
+
+#[derive(Debug, Default)]
+struct HistogramState {
+    // Observations at most each bound of `LATENCY_BUCKETS`, not cumulated
+    buckets: [u64; LATENCY_BUCKETS.len()],
+    sum: f64,
+    count: u64,
+}
+
+/// Distribution of latencies in seconds over `LATENCY_BUCKETS`
+#[derive(Debug, Default)]
+pub struct Histogram(Mutex<HistogramState>);
+
+impl Histogram {
+    pub fn observe(&self, seconds: f64) {
+        let mut state = self.0.lock().unwrap();
+        if let Some(i) = LATENCY_BUCKETS.iter().position(|&bound| seconds <= bound) {
+            state.buckets[i] += 1;
+        }
+        state.sum += seconds;
+        state.count += 1;
+    }
+
+    /// Timer that observes the time until it is dropped
+    pub fn start_timer(&self) -> HistogramTimer<'_> {
+        HistogramTimer {
+            histogram: self,
+            start: Instant::now(),
+        }
+    }
+
+    /// Number of observations
+    pub fn count(&self) -> u64 {
+        self.0.lock().unwrap().count
+    }
+}
+
+/// Observes its lifetime into a histogram
+pub struct HistogramTimer<'a> {
+    histogram: &'a Histogram,
+    start: Instant,
+}
+
+impl Drop for HistogramTimer<'_> {
+    fn drop(&mut self) {
+        self.histogram.observe(self.start.elapsed().as_secs_f64());
+    }
+}
+
+/// Every metric the node exports
+#[derive(Debug, Default)]
+pub struct Metrics {
+    /// Signatures builders accepted
+    pub signatures_collected: Counter,
+    /// Signed and proven weight of the certificate that last got a signature
+    pub signed_weight: Gauge,
+    pub proven_weight: Gauge,
+    pub cert_build_seconds: Histogram,
+    pub cert_verify_seconds: Histogram,
+    pub tree_build_seconds: Histogram,
+    /// Gossip messages by topic
+    pub p2p_messages_received: CounterVec,
+    pub p2p_messages_published: CounterVec,
+}
+
+impl Metrics {
+    /// Record a signature accepted by the builder of a certificate
+    pub fn record_signature(&self, signed_weight: u64, proven_weight: u64) {
+        self.signatures_collected.inc();
+        self.signed_weight.set(signed_weight);
+        self.proven_weight.set(proven_weight);
+    }
+
+    /// The metrics in the Prometheus text exposition format
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        counter(
+            &mut out,
+            "niropok_signatures_collected_total",
+            "Signatures accepted by certificate builders",
+            &self.signatures_collected,
+        );
+        gauge(
+            &mut out,
+            "niropok_signed_weight",
+            "Weight signed so far of the certificate being built",
+            &self.signed_weight,
+        );
+        gauge(
+            &mut out,
+            "niropok_proven_weight",
+            "Weight the certificate being built must prove",
+            &self.proven_weight,
+        );
+        histogram(
+            &mut out,
+            "niropok_cert_build_seconds",
+            "Time to build a certificate",
+            &self.cert_build_seconds,
+        );
+        histogram(
+            &mut out,
+            "niropok_cert_verify_seconds",
+            "Time to verify a certificate",
+            &self.cert_verify_seconds,
+        );
+        histogram(
+            &mut out,
+            "niropok_tree_build_seconds",
+            "Time to build a Merkle tree",
+            &self.tree_build_seconds,
+        );
+        counter_vec(
+            &mut out,
+            "niropok_p2p_messages_received_total",
+            "Gossip messages received, by topic",
+            &self.p2p_messages_received,
+        );
+        counter_vec(
+            &mut out,
+            "niropok_p2p_messages_published_total",
+            "Gossip messages published, by topic",
+            &self.p2p_messages_published,
+        );
+        out
+    }
+}
+
+// Writing to a `String` can't fail, so the results below are ignored
+
+fn header(out: &mut String, name: &str, help: &str, kind: &str) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} {}", name, kind);
+}
+
+fn counter(out: &mut String, name: &str, help: &str, counter: &Counter) {
+    header(out, name, help, "counter");
+    let _ = writeln!(out, "{} {}", name, counter.get());
+}
+
+fn gauge(out: &mut String, name: &str, help: &str, gauge: &Gauge) {
+    header(out, name, help, "gauge");
+    let _ = writeln!(out, "{} {}", name, gauge.get());
+}
+
+fn counter_vec(out: &mut String, name: &str, help: &str, counters: &CounterVec) {
+    header(out, name, help, "counter");
+    for (topic, count) in counters.0.lock().unwrap().iter() {
+        let _ = writeln!(out, "{}{{topic=\"{}\"}} {}", name, escape(topic), count);
+    }
+}
+
+fn histogram(out: &mut String, name: &str, help: &str, histogram: &Histogram) {
+    header(out, name, help, "histogram");
+    let state = histogram.0.lock().unwrap();
+    let mut cumulative = 0;
+    for (bound, count) in LATENCY_BUCKETS.iter().zip(&state.buckets) {
+        cumulative += count;
+        let _ = writeln!(out, "{}_bucket{{le=\"{}\"}} {}", name, bound, cumulative);
+    }
+    let _ = writeln!(out, "{}_bucket{{le=\"+Inf\"}} {}", name, state.count);
+    let _ = writeln!(out, "{}_sum {}", name, state.sum);
+    let _ = writeln!(out, "{}_count {}", name, state.count);
+}
+
+// Escape a label value
+fn escape(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_metrics() {
+        let metrics = Metrics::default();
+        metrics.record_signature(30, 60);
+        metrics.record_signature(50, 60);
+        metrics.cert_build_seconds.observe(0.003);
+        metrics.cert_build_seconds.observe(20.0);
+        drop(metrics.tree_build_seconds.start_timer());
+        metrics.p2p_messages_received.inc("block");
+        metrics.p2p_messages_received.inc("block");
+        metrics.p2p_messages_received.inc("say \"hi\"");
+        assert_eq!(metrics.signatures_collected.get(), 2);
+        assert_eq!(metrics.p2p_messages_received.get("block"), 2);
+        assert_eq!(metrics.tree_build_seconds.count(), 1);
+
+        let text = metrics.render();
+        assert!(text.contains("# TYPE niropok_signatures_collected_total counter\n"));
+        assert!(text.contains("\nniropok_signatures_collected_total 2\n"));
+        assert!(text.contains("\nniropok_signed_weight 50\n"));
+        // Buckets are cumulative and +Inf counts every observation
+        assert!(text.contains("\nniropok_cert_build_seconds_bucket{le=\"0.0025\"} 0\n"));
+        assert!(text.contains("\nniropok_cert_build_seconds_bucket{le=\"0.005\"} 1\n"));
+        assert!(text.contains("\nniropok_cert_build_seconds_bucket{le=\"10\"} 1\n"));
+        assert!(text.contains("\nniropok_cert_build_seconds_bucket{le=\"+Inf\"} 2\n"));
+        assert!(text.contains("\nniropok_cert_build_seconds_count 2\n"));
+        assert!(text.contains("\nniropok_p2p_messages_received_total{topic=\"block\"} 2\n"));
+        assert!(text.contains("{topic=\"say \\\"hi\\\"\"} 1\n"));
+        assert!(text.ends_with('\n'));
+    }
+}
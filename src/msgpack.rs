@@ -0,0 +1,388 @@
+use crate::canonical::{from_value_exact, to_value, Value};
+use crate::ccok::{Certificate, Params, Participant, Reveal};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+// Nesting limit when decoding untrusted input
+const MAX_DEPTH: usize = 64;
+
+/// Canonical msgpack encoding: map keys sorted, integers and lengths in their
+/// shortest form, no floats. Equal items always encode to the same bytes.
+pub trait Msgpack: Serialize + DeserializeOwned {
+    /// Canonical msgpack bytes of the item
+    fn to_msgpack(&self) -> Result<Vec<u8>, String> {
+        to_vec(self)
+    }
+
+    /// Decode canonical msgpack bytes, rejecting any other encoding
+    fn from_msgpack(bytes: &[u8]) -> Result<Self, String> {
+        from_slice(bytes)
+    }
+}
+
+impl Msgpack for Certificate {}
+impl Msgpack for Reveal {}
+impl Msgpack for Participant {}
+impl Msgpack for Params {}
+
+/// Encode a serializable item as canonical msgpack
+pub fn to_vec<T: Serialize + ?Sized>(item: &T) -> Result<Vec<u8>, String> {
+    let mut out = Vec::new();
+    encode(&to_value(item)?, &mut out);
+    Ok(out)
+}
+
+/// Decode an item from canonical msgpack. Unknown or missing fields are
+/// rejected too, so the bytes are exactly the encoding of the returned item.
+pub fn from_slice<T: Serialize + DeserializeOwned>(bytes: &[u8]) -> Result<T, String> {
+    from_value_exact(decode(bytes)?)
+}
+
+/// Append the canonical encoding of `value` to `out`
+pub fn encode(value: &Value, out: &mut Vec<u8>) {
+    match value {
+        Value::Nil => out.push(0xc0),
+        Value::Bool(false) => out.push(0xc2),
+        Value::Bool(true) => out.push(0xc3),
+        Value::UInt(v) => match *v {
+            0..=0x7f => out.push(*v as u8),
+            0x80..=0xff => {
+                out.push(0xcc);
+                out.push(*v as u8);
+            }
+            0x100..=0xffff => {
+                out.push(0xcd);
+                out.extend_from_slice(&(*v as u16).to_be_bytes());
+            }
+            0x1_0000..=0xffff_ffff => {
+                out.push(0xce);
+                out.extend_from_slice(&(*v as u32).to_be_bytes());
+            }
+            _ => {
+                out.push(0xcf);
+                out.extend_from_slice(&v.to_be_bytes());
+            }
+        },
+        Value::Int(v) => {
+            if *v >= -32 {
+                out.push(*v as i8 as u8);
+            } else if *v >= i8::MIN as i64 {
+                out.push(0xd0);
+                out.push(*v as i8 as u8);
+            } else if *v >= i16::MIN as i64 {
+                out.push(0xd1);
+                out.extend_from_slice(&(*v as i16).to_be_bytes());
+            } else if *v >= i32::MIN as i64 {
+                out.push(0xd2);
+                out.extend_from_slice(&(*v as i32).to_be_bytes());
+            } else {
+                out.push(0xd3);
+                out.extend_from_slice(&v.to_be_bytes());
+            }
+        }
+        Value::Str(s) => {
+            header(out, s.len(), Some(0xa0), 32, [0xd9, 0xda, 0xdb]);
+            out.extend_from_slice(s.as_bytes());
+        }
+        Value::Bin(b) => {
+            header(out, b.len(), None, 0, [0xc4, 0xc5, 0xc6]);
+            out.extend_from_slice(b);
+        }
+        Value::Array(items) => {
+            header(out, items.len(), Some(0x90), 16, [0, 0xdc, 0xdd]);
+            for item in items {
+                encode(item, out);
+            }
+        }
+        Value::Map(entries) => {
+            header(out, entries.len(), Some(0x80), 16, [0, 0xde, 0xdf]);
+            for (key, value) in entries {
+                encode(key, out);
+                encode(value, out);
+            }
+        }
+    }
+}
+
+// Length header: the fix form below `fix_limit`, then the 8 (if the type has
+// one), 16 and 32 bit forms
+fn header(out: &mut Vec<u8>, len: usize, fix: Option<u8>, fix_limit: usize, markers: [u8; 3]) {
+    match fix {
+        Some(fix) if len < fix_limit => out.push(fix | len as u8),
+        _ if len <= 0xff && markers[0] != 0 => out.extend_from_slice(&[markers[0], len as u8]),
+        _ if len <= 0xffff => {
+            out.push(markers[1]);
+            out.extend_from_slice(&(len as u16).to_be_bytes());
+        }
+        _ => {
+            out.push(markers[2]);
+            out.extend_from_slice(&(len as u32).to_be_bytes());
+        }
+    }
+}
+
+/// Decode canonical msgpack, rejecting trailing bytes, floats, extension
+/// types, unsorted or duplicate map keys and non-minimal encodings
+pub fn decode(bytes: &[u8]) -> Result<Value, String> {
+    let mut reader = Reader { bytes, pos: 0 };
+    let value = reader.value(0)?;
+    if reader.pos != bytes.len() {
+        return Err(format!(
+            "Trailing bytes after msgpack value at offset {}",
+            reader.pos
+        ));
+    }
+    // Any value with a shorter encoding than the one read is not canonical
+    let mut canonical = Vec::with_capacity(bytes.len());
+    encode(&value, &mut canonical);
+    if canonical != bytes {
+        return Err("Msgpack encoding is not canonical".to_string());
+    }
+    Ok(value)
+}
+
+struct Reader<'a> {
+    bytes: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Result<&'a [u8], String> {
+        if self.bytes.len() - self.pos < len {
+            return Err("Unexpected end of msgpack input".to_string());
+        }
+        let slice = &self.bytes[self.pos..self.pos + len];
+        self.pos += len;
+        Ok(slice)
+    }
+
+    fn uint(&mut self, size: usize) -> Result<u64, String> {
+        Ok(self
+            .take(size)?
+            .iter()
+            .fold(0u64, |acc, b| (acc << 8) | *b as u64))
+    }
+
+    fn int(&mut self, size: usize) -> Result<i64, String> {
+        let raw = self.uint(size)?;
+        let shift = 64 - 8 * size as u32;
+        Ok(((raw << shift) as i64) >> shift)
+    }
+
+    fn value(&mut self, depth: usize) -> Result<Value, String> {
+        if depth > MAX_DEPTH {
+            return Err("Msgpack value nested too deeply".to_string());
+        }
+        let marker = self.take(1)?[0];
+        let value = match marker {
+            0x00..=0x7f => Value::UInt(marker as u64),
+            0x80..=0x8f => self.map((marker & 0x0f) as usize, depth)?,
+            0x90..=0x9f => self.array((marker & 0x0f) as usize, depth)?,
+            0xa0..=0xbf => self.string((marker & 0x1f) as usize)?,
+            0xc0 => Value::Nil,
+            0xc2 => Value::Bool(false),
+            0xc3 => Value::Bool(true),
+            0xc4 | 0xc5 | 0xc6 => {
+                let len = self.uint(1 << (marker - 0xc4))? as usize;
+                Value::Bin(self.take(len)?.to_vec())
+            }
+            0xca | 0xcb => return Err("Floats are not allowed in canonical msgpack".to_string()),
+            0xcc..=0xcf => Value::UInt(self.uint(1 << (marker - 0xcc))?),
+            0xd0..=0xd3 => Value::int(self.int(1 << (marker - 0xd0))?),
+            0xd9..=0xdb => {
+                let len = self.uint(1 << (marker - 0xd9))? as usize;
+                self.string(len)?
+            }
+            0xdc | 0xdd => {
+                let len = self.uint(2 << (marker - 0xdc))? as usize;
+                self.array(len, depth)?
+            }
+            0xde | 0xdf => {
+                let len = self.uint(2 << (marker - 0xde))? as usize;
+                self.map(len, depth)?
+            }
+            0xe0..=0xff => Value::Int(marker as i8 as i64),
+            _ => return Err(format!("Unsupported msgpack marker 0x{:02x}", marker)),
+        };
+        Ok(value)
+    }
+
+    fn string(&mut self, len: usize) -> Result<Value, String> {
+        let bytes = self.take(len)?;
+        String::from_utf8(bytes.to_vec())
+            .map(Value::Str)
+            .map_err(|e| format!("Invalid UTF-8 in msgpack string: {}", e))
+    }
+
+    fn array(&mut self, len: usize, depth: usize) -> Result<Value, String> {
+        // Every item takes at least one byte, which bounds the allocation
+        let mut items = Vec::with_capacity(len.min(self.bytes.len() - self.pos));
+        for _ in 0..len {
+            items.push(self.value(depth + 1)?);
+        }
+        Ok(Value::Array(items))
+    }
+
+    fn map(&mut self, len: usize, depth: usize) -> Result<Value, String> {
+        let mut entries: Vec<(Value, Value)> =
+            Vec::with_capacity(len.min(self.bytes.len() - self.pos));
+        for _ in 0..len {
+            let key = self.value(depth + 1)?;
+            if let Some((last, _)) = entries.last() {
+                if *last >= key {
+                    return Err("Msgpack map keys are not sorted".to_string());
+                }
+            }
+            let value = self.value(depth + 1)?;
+            entries.push((key, value));
+        }
+        Ok(Value::Map(entries))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Purpose};
+    use crate::hybrid::SignatureMode;
+    use crate::merkle::{HashAlgorithm, MerkleTreeBuilder};
+    use crate::scheme::SchemeId;
+    use crate::wallet::Wallet;
+    use rand::Rng;
+
+    fn random_params(rng: &mut impl Rng) -> Params {
+        let len = rng.gen_range(0..300);
+        let bits = rng.gen_range(0..64);
+        Params {
+            msg: (0..len).map(|_| rng.gen()).collect(),
+            proven_weight: rng.gen_range(0..u64::MAX >> bits),
+            security_param: rng.gen(),
+            scheme: rng.gen_bool(0.5).then(|| SchemeId(rng.gen())),
+            round: rng.gen_bool(0.5).then(|| rng.gen()),
+            hash: HashAlgorithm::ALL[rng.gen_range(0..HashAlgorithm::ALL.len())],
+            version: rng.gen_range(1..=2),
+            compression_level: rng.gen(),
+            chain_id: rng.gen_bool(0.5).then(|| rng.gen()),
+            purpose: Purpose::from_id(rng.gen_range(0..4)),
+            weight_precision: rng.gen_range(0..=64),
+            signature_mode: SignatureMode::from_id(rng.gen_range(0..5)),
+        }
+    }
+
+    #[test]
+    fn test_encoding_is_canonical() {
+        // Shortest forms at every size boundary
+        let cases: Vec<(Value, usize)> = vec![
+            (Value::UInt(0x7f), 1),
+            (Value::UInt(0x80), 2),
+            (Value::UInt(0x1_0000), 5),
+            (Value::Int(-32), 1),
+            (Value::Int(-33), 2),
+            (Value::Str("a".repeat(31)), 32),
+            (Value::Str("a".repeat(32)), 34),
+            (Value::Array(vec![Value::Nil; 16]), 19),
+        ];
+        for (value, len) in cases {
+            let mut out = Vec::new();
+            encode(&value, &mut out);
+            assert_eq!(out.len(), len, "{:?}", value);
+            assert_eq!(decode(&out).unwrap(), value);
+        }
+
+        // Non-minimal integers, floats, unsorted keys and trailing bytes
+        assert!(decode(&[0xcc, 0x05]).is_err());
+        assert!(decode(&[0xd0, 0x05]).is_err());
+        assert!(decode(&[0xcb, 0, 0, 0, 0, 0, 0, 0, 0]).is_err());
+        assert!(decode(&[0x82, 0x02, 0xc0, 0x01, 0xc0]).is_err());
+        assert!(decode(&[0x82, 0x01, 0xc0, 0x01, 0xc0]).is_err());
+        assert!(decode(&[0xc0, 0xc0]).is_err());
+        assert!(decode(&[0xdd, 0xff, 0xff, 0xff, 0xff]).is_err());
+    }
+
+    #[test]
+    fn test_params_round_trip() {
+        let mut rng = rand::thread_rng();
+        for _ in 0..200 {
+            let params = random_params(&mut rng);
+            let bytes = params.to_msgpack().unwrap();
+            let decoded = Params::from_msgpack(&bytes).unwrap();
+            assert_eq!(decoded.msg, params.msg);
+            assert_eq!(decoded.proven_weight, params.proven_weight);
+            assert_eq!(decoded.security_param, params.security_param);
+            assert_eq!(decoded.scheme, params.scheme);
+            assert_eq!(decoded.round, params.round);
+            assert_eq!(decoded.hash, params.hash);
+            assert_eq!(decoded.version, params.version);
+            assert_eq!(decoded.to_msgpack().unwrap(), bytes);
+
+            // Corrupted input is rejected or decodes to something that
+            // re-encodes to exactly the same bytes
+            let mut corrupted = bytes.clone();
+            let index = rng.gen_range(0..corrupted.len());
+            corrupted[index] ^= 1 << rng.gen_range(0..8);
+            if let Ok(other) = Params::from_msgpack(&corrupted) {
+                assert_eq!(other.to_msgpack().unwrap(), corrupted);
+            }
+            assert!(Params::from_msgpack(&bytes[..index]).is_err());
+        }
+    }
+
+    #[test]
+    fn test_certificate_round_trip() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 25,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let mut builder =
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .expect("Failed to add signature");
+        }
+        let mut cert = builder.build().expect("Failed to build certificate");
+        cert.compress_proofs().expect("Failed to compress proofs");
+
+        let params = Params::from_msgpack(&params.to_msgpack().unwrap()).unwrap();
+        let bytes = cert.to_msgpack().unwrap();
+        let decoded = Certificate::from_msgpack(&bytes).unwrap();
+        assert_eq!(decoded.to_msgpack().unwrap(), bytes);
+        assert_eq!(decoded.digest().unwrap(), cert.digest().unwrap());
+        assert!(decoded.verify(&params, &party_tree.root()).unwrap());
+
+        for reveal in decoded.reveals.values() {
+            let bytes = reveal.to_msgpack().unwrap();
+            assert_eq!(
+                Reveal::from_msgpack(&bytes).unwrap().to_msgpack().unwrap(),
+                bytes
+            );
+        }
+        for party in &participants {
+            let bytes = party.to_msgpack().unwrap();
+            assert_eq!(
+                Participant::from_msgpack(&bytes).unwrap().public_key,
+                party.public_key
+            );
+        }
+
+        // Random bytes never panic the decoder
+        let mut rng = rand::thread_rng();
+        for _ in 0..500 {
+            let len = rng.gen_range(0..64);
+            let noise: Vec<u8> = (0..len).map(|_| rng.gen()).collect();
+            let _ = Certificate::from_msgpack(&noise);
+        }
+    }
+}
@@ -1,9 +1,20 @@
+use crate::events::{EventBus, EventStream};
+use crate::grpc::{CertServiceServer, GrpcServer, NodeServiceServer};
+use crate::metrics::METRICS;
+use crate::rpc::{ChainView, RpcServer};
 use crate::transaction::Transaction;
-use log::info;
+use futures::{SinkExt, StreamExt};
+use log::{info, warn};
+use std::net::SocketAddr;
+use std::sync::{Arc, Mutex};
 use tokio::sync::mpsc::UnboundedSender;
+use tonic::transport::server::TcpIncoming;
+use tonic::transport::Server;
 use warp::Filter;
 
-pub async fn start_rpc_server(rpc_sender: UnboundedSender<Transaction>) {
+/// Accept transactions on POST /rpc/transaction at `addr`; port 0 binds an
+/// ephemeral port
+pub async fn start_rpc_server(rpc_sender: UnboundedSender<Transaction>, addr: SocketAddr) {
     // Define the RPC route on POST /rpc/transaction
     let rpc_route = warp::post()
         .and(warp::path("rpc"))
@@ -19,10 +30,139 @@ pub async fn start_rpc_server(rpc_sender: UnboundedSender<Transaction>) {
             }
         });
 
-    // Bind to an ephemeral port
     let (addr, server) = warp::serve(rpc_route)
-        .try_bind_ephemeral(([127, 0, 0, 1], 0))
-        .expect("Failed to bind ephemeral RPC port");
+        .try_bind_ephemeral(addr)
+        .expect("Failed to bind RPC port");
     info!("RPC server running on {}", addr);
     server.await;
 }
+
+/// Serve the JSON-RPC methods of `rpc` on POST /jsonrpc at `addr`, refusing
+/// bodies over `max_request_bytes`. Submissions are rate limited by client IP.
+pub async fn start_json_rpc_server<C: ChainView + Send + 'static>(
+    rpc: Arc<Mutex<RpcServer<C>>>,
+    addr: SocketAddr,
+    max_request_bytes: u64,
+) {
+    let rpc_route = warp::post()
+        .and(warp::path("jsonrpc"))
+        .and(warp::addr::remote())
+        .and(warp::body::content_length_limit(max_request_bytes))
+        .and(warp::body::bytes())
+        .map(
+            move |client: Option<SocketAddr>, body: warp::hyper::body::Bytes| {
+                let body = String::from_utf8_lossy(&body).into_owned();
+                let peer =
+                    client.map_or_else(|| "unknown".to_string(), |client| client.ip().to_string());
+                match rpc.lock().unwrap().handle_from(&peer, &body) {
+                    Some(response) => warp::http::Response::builder()
+                        .header("content-type", "application/json")
+                        .body(response),
+                    None => warp::http::Response::builder()
+                        .status(warp::http::StatusCode::NO_CONTENT)
+                        .body(String::new()),
+                }
+            },
+        );
+
+    let (addr, server) = warp::serve(rpc_route)
+        .try_bind_ephemeral(addr)
+        .expect("Failed to bind JSON-RPC port");
+    info!("JSON-RPC server running on {}", addr);
+    server.await;
+}
+
+/// Serve the gRPC `NodeService` and `CertService` of `grpc` at `addr`,
+/// streaming the blocks and state proofs announced on `events`
+pub async fn start_grpc_server<C: ChainView + Send + 'static>(
+    grpc: Arc<GrpcServer<C>>,
+    events: EventBus,
+    addr: SocketAddr,
+) {
+    let listener = tokio::net::TcpListener::bind(addr)
+        .await
+        .expect("Failed to bind gRPC port");
+    info!(
+        "gRPC server running on {}",
+        listener.local_addr().expect("Failed to read gRPC address")
+    );
+    let incoming =
+        TcpIncoming::from_listener(listener, true, None).expect("Failed to accept gRPC clients");
+
+    let stream = events.subscribe();
+    let follower = Arc::clone(&grpc);
+    tokio::spawn(async move { follower.follow(stream).await });
+
+    Server::builder()
+        .add_service(NodeServiceServer::from_arc(Arc::clone(&grpc)))
+        .add_service(CertServiceServer::from_arc(grpc))
+        .serve_with_incoming(incoming)
+        .await
+        .expect("gRPC server failed");
+}
+
+/// Push the events of `events` to WebSocket clients of GET /ws at `addr`
+pub async fn start_ws_server(events: EventBus, addr: SocketAddr) {
+    let ws_route = warp::path("ws")
+        .and(warp::ws())
+        .map(move |ws: warp::ws::Ws| {
+            let stream = events.subscribe();
+            ws.on_upgrade(move |socket| serve_events(socket, stream))
+        });
+
+    let (addr, server) = warp::serve(ws_route)
+        .try_bind_ephemeral(addr)
+        .expect("Failed to bind WebSocket port");
+    info!("WebSocket server running on {}", addr);
+    server.await;
+}
+
+/// Serve the Prometheus metrics of the node on GET /metrics at `addr`
+pub async fn start_metrics_server(addr: SocketAddr) {
+    let metrics_route = warp::get().and(warp::path("metrics")).map(|| {
+        warp::http::Response::builder()
+            .header("content-type", "text/plain; version=0.0.4")
+            .body(METRICS.render())
+    });
+
+    let (addr, server) = warp::serve(metrics_route)
+        .try_bind_ephemeral(addr)
+        .expect("Failed to bind metrics port");
+    info!("Metrics server running on {}", addr);
+    server.await;
+}
+
+// Send the events of one connection until either side closes it
+async fn serve_events(socket: warp::ws::WebSocket, mut events: EventStream) {
+    let (mut sink, mut client) = socket.split();
+    loop {
+        tokio::select! {
+            message = client.next() => match message {
+                Some(Ok(message)) if !message.is_close() => {
+                    let Ok(text) = message.to_str() else { continue };
+                    if let Err(e) = events.handle_message(text) {
+                        let reply = serde_json::json!({ "error": e }).to_string();
+                        if sink.send(warp::ws::Message::text(reply)).await.is_err() {
+                            break;
+                        }
+                    }
+                }
+                _ => break,
+            },
+            event = events.next() => {
+                let Some(event) = event else { break };
+                match event.to_json() {
+                    Ok(text) => {
+                        if sink.send(warp::ws::Message::text(text)).await.is_err() {
+                            break;
+                        }
+                    }
+                    Err(e) => warn!("Failed to encode event: {}", e),
+                }
+            }
+        }
+    }
+    if events.missed > 0 {
+        warn!("WebSocket client missed {} events", events.missed);
+    }
+}
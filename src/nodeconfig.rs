@@ -0,0 +1,389 @@
+//! Configuration of the `niropokd` node, read from a TOML or YAML file by its
+//! extension. Every section and field is optional and defaults to the values
+//! the node used before it was configurable: an ephemeral key, ephemeral
+//! ports on localhost and no storage, with certificates over two thirds of
+//! the stake.
+use crate::certstore::Retention;
+use crate::collector::{RateLimit, SubmissionPolicy, DEFAULT_MAX_SIGNATURE_SIZE};
+use crate::config::{BLOCK_INTERVAL, EPOCH_DURATION};
+use crate::logging::{self, LogFormat};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::net::{IpAddr, Ipv4Addr, SocketAddr};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+/// Node key
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct KeyConfig {
+    /// Keystore directory; without one the node runs with a fresh key held
+    /// in memory only
+    pub keystore: Option<PathBuf>,
+    /// Name of the node key in the keystore, created if missing
+    pub name: String,
+    /// Environment variable holding the keystore passphrase
+    pub passphrase_env: String,
+}
+
+impl Default for KeyConfig {
+    fn default() -> Self {
+        Self {
+            keystore: None,
+            name: "node".to_string(),
+            passphrase_env: "NIROPOK_KEY_PASSPHRASE".to_string(),
+        }
+    }
+}
+
+/// Peer-to-peer network
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct NetworkConfig {
+    /// Multiaddress to listen on
+    pub listen: String,
+    /// Multiaddresses of peers dialed at startup, besides those found by mDNS
+    pub peers: Vec<String>,
+}
+
+impl Default for NetworkConfig {
+    fn default() -> Self {
+        Self {
+            listen: "/ip4/0.0.0.0/tcp/0".to_string(),
+            peers: Vec::new(),
+        }
+    }
+}
+
+/// RPC listeners; port 0 binds an ephemeral port
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct RpcConfig {
+    pub host: IpAddr,
+    /// Transaction submission, POST /rpc/transaction
+    pub tx_port: u16,
+    /// JSON-RPC, POST /jsonrpc
+    pub json_rpc_port: u16,
+    /// Event subscriptions, GET /ws
+    pub ws_port: u16,
+    /// gRPC `NodeService` and `CertService`
+    pub grpc_port: u16,
+    /// Prometheus metrics, GET /metrics
+    pub metrics_port: u16,
+}
+
+impl Default for RpcConfig {
+    fn default() -> Self {
+        Self {
+            host: IpAddr::V4(Ipv4Addr::LOCALHOST),
+            tx_port: 0,
+            json_rpc_port: 0,
+            ws_port: 0,
+            grpc_port: 0,
+            metrics_port: 0,
+        }
+    }
+}
+
+impl RpcConfig {
+    pub fn tx_addr(&self) -> SocketAddr {
+        SocketAddr::new(self.host, self.tx_port)
+    }
+
+    pub fn json_rpc_addr(&self) -> SocketAddr {
+        SocketAddr::new(self.host, self.json_rpc_port)
+    }
+
+    pub fn ws_addr(&self) -> SocketAddr {
+        SocketAddr::new(self.host, self.ws_port)
+    }
+
+    pub fn grpc_addr(&self) -> SocketAddr {
+        SocketAddr::new(self.host, self.grpc_port)
+    }
+
+    pub fn metrics_addr(&self) -> SocketAddr {
+        SocketAddr::new(self.host, self.metrics_port)
+    }
+}
+
+/// Block production and certificates
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct ConsensusConfig {
+    /// Blocks per epoch
+    pub epoch_length: u64,
+    /// Seconds between blocks
+    pub block_interval: u64,
+    /// Fraction of the validator stake a block certificate must prove
+    pub proven_weight_fraction: f64,
+}
+
+/// Fraction of the stake certificates prove unless configured
+pub const DEFAULT_PROVEN_WEIGHT_FRACTION: f64 = 2.0 / 3.0;
+
+impl Default for ConsensusConfig {
+    fn default() -> Self {
+        Self {
+            epoch_length: EPOCH_DURATION,
+            block_interval: BLOCK_INTERVAL,
+            proven_weight_fraction: DEFAULT_PROVEN_WEIGHT_FRACTION,
+        }
+    }
+}
+
+impl ConsensusConfig {
+    /// Weight a certificate must prove out of `total_weight`
+    pub fn proven_weight(&self, total_weight: u64) -> u64 {
+        proven_weight(total_weight, self.proven_weight_fraction)
+    }
+}
+
+/// `fraction` of `total_weight`, rounded up so the certificate never proves
+/// less than the fraction, but kept below the total as params require
+pub fn proven_weight(total_weight: u64, fraction: f64) -> u64 {
+    ((total_weight as f64 * fraction).ceil() as u64).min(total_weight.saturating_sub(1))
+}
+
+/// What a node stores of the chain
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum StorageMode {
+    /// Blocks, certificates and account state
+    #[default]
+    Full,
+    /// Headers, state proofs and voters commitments only, enough for relayer
+    /// and light-client duties
+    Headers,
+}
+
+/// Persistence of blocks and certificates
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct StorageConfig {
+    /// Directory of the chain store; nothing is persisted without one
+    pub data_dir: Option<PathBuf>,
+    pub mode: StorageMode,
+    /// Intervals whose headers and proofs a header node keeps; all if unset
+    pub keep_intervals: Option<u64>,
+}
+
+impl StorageConfig {
+    /// Log file of the chain store
+    pub fn chain_path(&self) -> Option<PathBuf> {
+        self.data_dir.as_ref().map(|dir| dir.join("chain.log"))
+    }
+
+    /// Log file of the header store of a header node
+    pub fn headers_path(&self) -> Option<PathBuf> {
+        self.data_dir.as_ref().map(|dir| dir.join("headers.log"))
+    }
+
+    /// Pruning of the header store
+    pub fn retention(&self) -> Retention {
+        self.keep_intervals
+            .map_or(Retention::KeepAll, Retention::KeepLastEpochs)
+    }
+}
+
+/// Log output
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct LoggingConfig {
+    /// Level of subsystems not in `levels`: off, error, warn, info, debug or
+    /// trace
+    pub level: String,
+    /// Level by subsystem, e.g. `builder`, `verifier`, `consensus` or `p2p`
+    pub levels: BTreeMap<String, String>,
+    pub format: LogFormat,
+    /// Replace keys and signatures in messages by their length
+    pub redact: bool,
+}
+
+impl Default for LoggingConfig {
+    fn default() -> Self {
+        Self {
+            level: "info".to_string(),
+            levels: BTreeMap::new(),
+            format: LogFormat::Text,
+            redact: true,
+        }
+    }
+}
+
+/// Limits on signature submissions to the certificates the node collects
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SubmissionConfig {
+    /// Submissions each peer may make per window
+    pub max_messages: u32,
+    pub window_secs: u64,
+    /// Largest signature in bytes
+    pub max_signature_size: usize,
+    /// Largest JSON-RPC request body in bytes
+    pub max_request_bytes: u64,
+}
+
+impl Default for SubmissionConfig {
+    fn default() -> Self {
+        let policy = SubmissionPolicy::default();
+        Self {
+            max_messages: policy.rate_limit.max_messages,
+            window_secs: policy.rate_limit.window.as_secs(),
+            max_signature_size: DEFAULT_MAX_SIGNATURE_SIZE,
+            max_request_bytes: 1 << 20,
+        }
+    }
+}
+
+impl SubmissionConfig {
+    pub fn policy(&self) -> SubmissionPolicy {
+        SubmissionPolicy {
+            rate_limit: RateLimit {
+                max_messages: self.max_messages,
+                window: Duration::from_secs(self.window_secs),
+            },
+            max_signature_size: self.max_signature_size,
+        }
+    }
+}
+
+/// Tracing of the state proof pipeline
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct TelemetryConfig {
+    /// File spans are appended to as OTLP/JSON lines; no spans are recorded
+    /// without one
+    pub traces_file: Option<PathBuf>,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct NodeConfig {
+    pub keys: KeyConfig,
+    pub network: NetworkConfig,
+    pub rpc: RpcConfig,
+    pub consensus: ConsensusConfig,
+    pub storage: StorageConfig,
+    pub logging: LoggingConfig,
+    pub telemetry: TelemetryConfig,
+    pub submission: SubmissionConfig,
+}
+
+impl NodeConfig {
+    /// Config of a `.yaml` or `.yml` file, or else of a TOML file
+    pub fn load(path: impl AsRef<Path>) -> Result<Self, String> {
+        let path = path.as_ref();
+        let text = std::fs::read_to_string(path)
+            .map_err(|e| format!("Failed to read config {}: {}", path.display(), e))?;
+        let yaml = path
+            .extension()
+            .map_or(false, |ext| ext == "yaml" || ext == "yml");
+        let config: Self = if yaml {
+            serde_yaml::from_str(&text).map_err(|e| format!("Invalid config: {}", e))?
+        } else {
+            toml::from_str(&text).map_err(|e| format!("Invalid config: {}", e))?
+        };
+        config.validate()?;
+        Ok(config)
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        let consensus = &self.consensus;
+        if consensus.epoch_length == 0 || consensus.block_interval == 0 {
+            return Err("Epoch length and block interval must be positive".to_string());
+        }
+        if !(consensus.proven_weight_fraction > 0.0 && consensus.proven_weight_fraction < 1.0) {
+            return Err(format!(
+                "Proven weight fraction {} not in (0, 1)",
+                consensus.proven_weight_fraction
+            ));
+        }
+        if self.keys.name.is_empty() {
+            return Err("Node key name is empty".to_string());
+        }
+        if self.storage.keep_intervals == Some(0) {
+            return Err("Header nodes must keep at least one interval".to_string());
+        }
+        logging::Logger::new(&self.logging)?;
+        let submission = &self.submission;
+        if submission.max_messages == 0 || submission.window_secs == 0 {
+            return Err("Submission rate limit must be positive".to_string());
+        }
+        if submission.max_signature_size == 0 || submission.max_request_bytes == 0 {
+            return Err("Submission size limits must be positive".to_string());
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_node_config() {
+        let path = std::env::temp_dir().join(format!("niropokd-{}.toml", std::process::id()));
+        std::fs::write(
+            &path,
+            r#"
+[keys]
+keystore = "/var/lib/niropok/keys"
+
+[network]
+peers = ["/ip4/10.0.0.2/tcp/4001"]
+
+[rpc]
+json_rpc_port = 8545
+
+[consensus]
+epoch_length = 20
+proven_weight_fraction = 0.75
+
+[logging]
+format = "json"
+
+[logging.levels]
+verifier = "debug"
+"#,
+        )
+        .unwrap();
+        let config = NodeConfig::load(&path).unwrap();
+        assert_eq!(config.keys.name, "node");
+        assert_eq!(config.network.listen, NetworkConfig::default().listen);
+        assert_eq!(config.network.peers.len(), 1);
+        assert_eq!(config.rpc.json_rpc_addr().port(), 8545);
+        assert_eq!(config.rpc.tx_addr().port(), 0);
+        assert_eq!(config.consensus.epoch_length, 20);
+        assert_eq!(config.consensus.block_interval, BLOCK_INTERVAL);
+        assert_eq!(config.consensus.proven_weight(300), 225);
+        assert_eq!(ConsensusConfig::default().proven_weight(300), 200);
+        assert_eq!(proven_weight(3, 0.9), 2);
+        assert!(config.storage.chain_path().is_none());
+        assert_eq!(config.storage.mode, StorageMode::Full);
+        assert_eq!(config.storage.retention(), Retention::KeepAll);
+        assert_eq!(config.logging.format, LogFormat::Json);
+        assert_eq!(config.logging.levels["verifier"], "debug");
+        assert!(config.logging.redact);
+        assert_eq!(config.submission.policy(), SubmissionPolicy::default());
+
+        // Typos and out of range values are refused
+        std::fs::write(&path, "[consensus]\nepoch_lenght = 20\n").unwrap();
+        assert!(NodeConfig::load(&path).is_err());
+        std::fs::write(&path, "[consensus]\nproven_weight_fraction = 1.5\n").unwrap();
+        assert!(NodeConfig::load(&path).is_err());
+        std::fs::write(&path, "[consensus]\nproven_weight_fraction = 1.0\n").unwrap();
+        assert!(NodeConfig::load(&path).is_err());
+        std::fs::write(&path, "[logging]\nlevel = \"loud\"\n").unwrap();
+        assert!(NodeConfig::load(&path).is_err());
+        std::fs::write(&path, "[submission]\nmax_messages = 0\n").unwrap();
+        assert!(NodeConfig::load(&path).is_err());
+        std::fs::write(&path, "[storage]\nmode = \"headers\"\nkeep_intervals = 0\n").unwrap();
+        assert!(NodeConfig::load(&path).is_err());
+        std::fs::write(&path, "[storage]\nmode = \"headers\"\nkeep_intervals = 4\n").unwrap();
+        let storage = NodeConfig::load(&path).unwrap().storage;
+        assert_eq!(storage.mode, StorageMode::Headers);
+        assert_eq!(storage.retention(), Retention::KeepLastEpochs(4));
+        std::fs::remove_file(&path).unwrap();
+    }
+}
@@ -2,7 +2,9 @@ use crate::accounts::Account;
 use crate::block::Block;
 use crate::blockchain::Blockchain;
 use crate::genesis::Genesis;
+use crate::gossip::{GossipFilter, GossipMessage, GossipTopic};
 use crate::hashchain::{verify_hash_chain_index, HashChainCom, HashChainMessage};
+use crate::metrics::METRICS;
 use crate::transaction::Transaction;
 use crate::validator::Validator;
 use crate::utils::TpsTracker;
@@ -23,6 +25,7 @@ use log::{info, warn};
 use once_cell::sync::Lazy;
 use serde::{Deserialize, Serialize};
 use serde_json;
+use std::collections::VecDeque;
 use std::sync::{Arc, Mutex};
 
 pub static KEYS: Lazy<identity::Keypair> = Lazy::new(|| identity::Keypair::generate_ed25519());
@@ -36,6 +39,26 @@ pub static HASH_CHAIN_TOPIC: Lazy<Topic> = Lazy::new(|| Topic::new("hash_chains"
 pub static HASH_CHAIN_MESSAGE_TOPIC: Lazy<Topic> = Lazy::new(|| Topic::new("hash_chain_messages"));
 pub static BLOCK_SIGNATURE_TOPIC: Lazy<Topic> = Lazy::new(|| Topic::new("block_signatures"));
 
+/// Number of gossip message ids remembered to drop duplicates
+const GOSSIP_SEEN_CAPACITY: usize = 10_000;
+
+/// Filter of the signed gossip topics
+pub static GOSSIP_FILTER: Lazy<Mutex<GossipFilter>> =
+    Lazy::new(|| Mutex::new(GossipFilter::new(GOSSIP_SEEN_CAPACITY)));
+/// Signed gossip messages received and not yet taken by the node
+pub static GOSSIP_INBOX: Lazy<Mutex<VecDeque<GossipMessage>>> =
+    Lazy::new(|| Mutex::new(VecDeque::new()));
+
+/// Gossipsub topic of a signed gossip topic
+pub fn gossip_topic(topic: GossipTopic) -> Topic {
+    Topic::new(topic.name())
+}
+
+/// Take the signed gossip messages received so far
+pub fn take_gossip() -> Vec<GossipMessage> {
+    GOSSIP_INBOX.lock().unwrap().drain(..).collect()
+}
+
 #[derive(Debug, Serialize, Deserialize)]
 pub struct ChainRequest {
     pub from_peer_id: PeerId,
@@ -141,8 +164,22 @@ impl AppBehaviour {
             .gossipsub
             .subscribe(&HASH_CHAIN_MESSAGE_TOPIC)
             .unwrap();
+        for topic in GossipTopic::ALL {
+            behaviour.gossipsub.subscribe(&gossip_topic(topic)).unwrap();
+        }
         behaviour
     }
+
+    /// Publish a signed gossip message on its topic
+    pub fn publish_gossip(&mut self, message: &GossipMessage) -> Result<(), String> {
+        GOSSIP_FILTER.lock().unwrap().accept(message)?;
+        self.gossipsub
+            .publish(gossip_topic(message.topic()), message.encode()?)
+            .map_err(|e| format!("Failed to publish gossip message: {}", e))?;
+        METRICS.p2p_messages_published.inc(message.topic().name());
+        Ok(())
+    }
+
     pub fn handle_event(&mut self, event: P2PEvent, blockchain: Arc<Mutex<Blockchain>>, tps_tracker: Arc<Mutex<TpsTracker>>) {
         match event {
             P2PEvent::Gossipsub(event) => self.handle_gossipsub_event(event, blockchain, tps_tracker),
@@ -157,6 +194,7 @@ impl AppBehaviour {
                 message_id: _,
                 message,
             } => {
+                METRICS.p2p_messages_received.inc(message.topic.as_str());
                 let data = &message.data;
                 let source = message.source.unwrap_or(propagation_source);
                 self.process_message(data, source, blockchain, tps_tracker);
@@ -166,6 +204,16 @@ impl AppBehaviour {
     }
 
     fn process_message(&mut self, data: &[u8], source: PeerId, blockchain: Arc<Mutex<Blockchain>>, tps_tracker: Arc<Mutex<TpsTracker>>) {
+        // Signed gossip is checked and left to the node
+        if let Ok(message) = GossipMessage::decode(data) {
+            match GOSSIP_FILTER.lock().unwrap().accept(&message) {
+                Ok(true) => GOSSIP_INBOX.lock().unwrap().push_back(message),
+                Ok(false) => {}
+                Err(e) => warn!("Dropped gossip message from {:?}: {}", source, e),
+            }
+            return;
+        }
+
         let mut blockchain = blockchain.lock().unwrap();
 
         if let Ok(genesis) = bincode::deserialize::<Genesis>(data) {
@@ -209,7 +257,9 @@ impl AppBehaviour {
                     .gossipsub
                     .publish(TRANSACTION_TOPIC.clone(), json.into_bytes())
                 {
-                    eprintln!("Failed to publish transaction: {}", e);
+                    warn!("Failed to publish transaction: {}", e);
+                } else {
+                    METRICS.p2p_messages_published.inc(TRANSACTION_TOPIC.hash().as_str());
                 }
             }
         }
@@ -258,6 +308,7 @@ impl AppBehaviour {
                         self.gossipsub
                             .publish(BLOCK_SIGNATURE_TOPIC.clone(), json.into_bytes())
                             .unwrap();
+                        METRICS.p2p_messages_published.inc(BLOCK_SIGNATURE_TOPIC.hash().as_str());
                     }
                 }
             } else {
@@ -290,6 +341,7 @@ impl AppBehaviour {
                 validator_commitment.hash_chain_index.clone(),
                 msg.epoch as u64,
                 received_commitment.clone(),
+                blockchain.epoch.duration,
             ) {
                 info!("Received valid hash chain message");
                 blockchain
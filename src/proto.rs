@@ -0,0 +1,668 @@
+//! Protobuf messages of `proto/ccok.proto` and `proto/node.proto`, generated
+//! by prost from `build.rs`, and their conversions to and from the
+//! certificate and chain types.
+use crate::block;
+use crate::ccok::{self, PARAMS_V1};
+use crate::ephemeral;
+use crate::gossip;
+use crate::hybrid::SignatureMode;
+use crate::merkle::{CompressedProofSet, HashAlgorithm};
+use crate::scheme::SchemeId;
+use crate::stateproof;
+use crate::sumtree;
+use crate::vrf;
+use prost::Message;
+use std::collections::BTreeMap;
+
+/// Generated code, in modules named after the proto packages as prost
+/// refers across them
+pub mod niropok {
+    pub mod ccok {
+        pub mod v1 {
+            tonic::include_proto!("niropok.ccok.v1");
+        }
+    }
+
+    pub mod node {
+        pub mod v1 {
+            tonic::include_proto!("niropok.node.v1");
+        }
+    }
+}
+
+pub use niropok::ccok::v1::*;
+pub use niropok::node::v1::*;
+
+fn scheme_from_proto(scheme: u32) -> Result<SchemeId, String> {
+    u16::try_from(scheme)
+        .map(SchemeId)
+        .map_err(|_| format!("Invalid scheme id {}", scheme))
+}
+
+// Unset (zero) hash and version fields select the defaults, as they do for
+// serde encoded params and certificates
+fn hash_from_proto(id: u32) -> Result<HashAlgorithm, String> {
+    match id {
+        0 => Ok(HashAlgorithm::default()),
+        id => u8::try_from(id)
+            .map_err(|_| format!("Unknown hash algorithm id {}", id))
+            .and_then(HashAlgorithm::from_id),
+    }
+}
+
+fn version_from_proto(version: u32) -> Result<u8, String> {
+    match version {
+        0 => Ok(PARAMS_V1),
+        version => u8::try_from(version).map_err(|_| format!("Unknown params version {}", version)),
+    }
+}
+
+fn purpose_from_proto(purpose: u32) -> Result<Option<ccok::Purpose>, String> {
+    match purpose {
+        0 => Ok(None),
+        purpose => u8::try_from(purpose)
+            .ok()
+            .and_then(ccok::Purpose::from_id)
+            .map(Some)
+            .ok_or_else(|| format!("Unknown purpose {}", purpose)),
+    }
+}
+
+fn signature_mode_from_proto(mode: u32) -> Result<Option<SignatureMode>, String> {
+    match mode {
+        0 => Ok(None),
+        mode => u8::try_from(mode)
+            .ok()
+            .and_then(SignatureMode::from_id)
+            .map(Some)
+            .ok_or_else(|| format!("Unknown signature mode {}", mode)),
+    }
+}
+
+fn key_layout_from_proto(layout: u32) -> Result<ccok::KeyLayout, String> {
+    match layout {
+        0 => Ok(ccok::KeyLayout::InLeaf),
+        1 => Ok(ccok::KeyLayout::InReveal),
+        layout => Err(format!("Unknown key layout {}", layout)),
+    }
+}
+
+impl From<&ccok::Params> for Params {
+    fn from(params: &ccok::Params) -> Self {
+        Self {
+            msg: params.msg.clone(),
+            proven_weight: params.proven_weight,
+            security_param: params.security_param,
+            scheme: params.scheme.map(|s| s.0 as u32),
+            round: params.round,
+            hash: params.hash.id() as u32,
+            version: params.version as u32,
+            compression_level: params.compression_level as u32,
+            chain_id: params.chain_id,
+            purpose: params.purpose.map_or(0, |purpose| purpose.id() as u32),
+            weight_precision: params.weight_precision as u32,
+            signature_mode: params.signature_mode.map_or(0, |mode| mode.id() as u32),
+        }
+    }
+}
+
+impl TryFrom<Params> for ccok::Params {
+    type Error = String;
+
+    fn try_from(params: Params) -> Result<Self, String> {
+        Ok(Self {
+            msg: params.msg,
+            proven_weight: params.proven_weight,
+            security_param: params.security_param,
+            scheme: params.scheme.map(scheme_from_proto).transpose()?,
+            round: params.round,
+            hash: hash_from_proto(params.hash)?,
+            version: version_from_proto(params.version)?,
+            compression_level: u8::try_from(params.compression_level)
+                .map_err(|_| format!("Unknown compression level {}", params.compression_level))?,
+            chain_id: params.chain_id,
+            purpose: purpose_from_proto(params.purpose)?,
+            weight_precision: u8::try_from(params.weight_precision)
+                .map_err(|_| format!("Unknown weight precision {}", params.weight_precision))?,
+            signature_mode: signature_mode_from_proto(params.signature_mode)?,
+        })
+    }
+}
+
+impl From<&ephemeral::KeyCommitment> for KeyCommitment {
+    fn from(commitment: &ephemeral::KeyCommitment) -> Self {
+        Self {
+            root: commitment.root.clone(),
+            lifetime: Some(KeyLifetime {
+                first_round: commitment.lifetime.first_round,
+                rounds: commitment.lifetime.rounds,
+            }),
+        }
+    }
+}
+
+impl TryFrom<KeyCommitment> for ephemeral::KeyCommitment {
+    type Error = String;
+
+    fn try_from(commitment: KeyCommitment) -> Result<Self, String> {
+        let lifetime = commitment
+            .lifetime
+            .ok_or_else(|| "Key commitment without lifetime".to_string())?;
+        Ok(Self {
+            root: commitment.root,
+            lifetime: ephemeral::KeyLifetime::new(lifetime.first_round, lifetime.rounds),
+        })
+    }
+}
+
+impl From<&vrf::VrfPublicKey> for VrfPublicKey {
+    fn from(key: &vrf::VrfPublicKey) -> Self {
+        Self {
+            root: key.root.clone(),
+            lifetime: Some(KeyLifetime {
+                first_round: key.lifetime.first_round,
+                rounds: key.lifetime.rounds,
+            }),
+        }
+    }
+}
+
+impl TryFrom<VrfPublicKey> for vrf::VrfPublicKey {
+    type Error = String;
+
+    fn try_from(key: VrfPublicKey) -> Result<Self, String> {
+        let lifetime = key
+            .lifetime
+            .ok_or_else(|| "VRF public key without lifetime".to_string())?;
+        Ok(Self {
+            root: key.root,
+            lifetime: ephemeral::KeyLifetime::new(lifetime.first_round, lifetime.rounds),
+        })
+    }
+}
+
+impl From<&ccok::Participant> for Participant {
+    fn from(party: &ccok::Participant) -> Self {
+        Self {
+            public_key: party.public_key.clone(),
+            weight: party.weight,
+            scheme: party.scheme.0 as u32,
+            key_commitment: party.key_commitment.as_ref().map(KeyCommitment::from),
+            vrf_key: party.vrf_key.as_ref().map(VrfPublicKey::from),
+            key_layout: match party.key_layout {
+                ccok::KeyLayout::InLeaf => 0,
+                ccok::KeyLayout::InReveal => 1,
+            },
+        }
+    }
+}
+
+impl TryFrom<Participant> for ccok::Participant {
+    type Error = String;
+
+    fn try_from(party: Participant) -> Result<Self, String> {
+        Ok(Self {
+            public_key: party.public_key,
+            weight: party.weight,
+            scheme: scheme_from_proto(party.scheme)?,
+            key_commitment: party.key_commitment.map(TryInto::try_into).transpose()?,
+            vrf_key: party.vrf_key.map(TryInto::try_into).transpose()?,
+            key_layout: key_layout_from_proto(party.key_layout)?,
+        })
+    }
+}
+
+impl From<&ephemeral::OneTimeKeyProof> for OneTimeKeyProof {
+    fn from(proof: &ephemeral::OneTimeKeyProof) -> Self {
+        Self {
+            round: proof.round,
+            public_key: proof.public_key.clone(),
+            path: proof.path.clone(),
+        }
+    }
+}
+
+impl From<OneTimeKeyProof> for ephemeral::OneTimeKeyProof {
+    fn from(proof: OneTimeKeyProof) -> Self {
+        Self {
+            round: proof.round,
+            public_key: proof.public_key,
+            path: proof.path,
+        }
+    }
+}
+
+impl From<&ccok::SigSlot> for SigSlot {
+    fn from(slot: &ccok::SigSlot) -> Self {
+        Self {
+            signature: slot.signature.as_ref().map(|s| s.as_bytes().to_vec()),
+            accumulated_weight: slot.accumulated_weight,
+            one_time_key: slot.one_time_key.as_ref().map(OneTimeKeyProof::from),
+        }
+    }
+}
+
+impl From<SigSlot> for ccok::SigSlot {
+    fn from(slot: SigSlot) -> Self {
+        Self {
+            signature: slot.signature.map(Into::into),
+            accumulated_weight: slot.accumulated_weight,
+            one_time_key: slot.one_time_key.map(Into::into),
+        }
+    }
+}
+
+impl From<&ccok::Reveal> for Reveal {
+    fn from(reveal: &ccok::Reveal) -> Self {
+        Self {
+            sig_slot: Some(SigSlot::from(&reveal.sig_slot)),
+            party: Some(Participant::from(&reveal.party)),
+            public_key: reveal.public_key.clone().unwrap_or_default(),
+        }
+    }
+}
+
+impl TryFrom<Reveal> for ccok::Reveal {
+    type Error = String;
+
+    fn try_from(reveal: Reveal) -> Result<Self, String> {
+        let sig_slot = reveal
+            .sig_slot
+            .ok_or_else(|| "Reveal without signature slot".to_string())?;
+        let party = reveal
+            .party
+            .ok_or_else(|| "Reveal without participant".to_string())?;
+        Ok(Self {
+            sig_slot: sig_slot.into(),
+            party: party.try_into()?,
+            public_key: Some(reveal.public_key).filter(|key| !key.is_empty()),
+        })
+    }
+}
+
+impl From<&sumtree::SumPath> for SumPath {
+    fn from(path: &sumtree::SumPath) -> Self {
+        Self {
+            total_leaves: path.total_leaves as u64,
+            siblings: path
+                .siblings
+                .iter()
+                .map(|node| SumNode {
+                    hash: node.hash.to_vec(),
+                    sum: node.sum,
+                })
+                .collect(),
+        }
+    }
+}
+
+impl TryFrom<SumPath> for sumtree::SumPath {
+    type Error = String;
+
+    fn try_from(path: SumPath) -> Result<Self, String> {
+        let siblings =
+            path.siblings
+                .into_iter()
+                .map(|node| {
+                    let hash = node.hash.as_slice().try_into().map_err(|_| {
+                        format!("Invalid sum node hash length: {}", node.hash.len())
+                    })?;
+                    Ok(sumtree::SumNode {
+                        hash,
+                        sum: node.sum,
+                    })
+                })
+                .collect::<Result<Vec<_>, String>>()?;
+        Ok(Self {
+            total_leaves: usize::try_from(path.total_leaves)
+                .map_err(|_| format!("Invalid sum path leaf count {}", path.total_leaves))?,
+            siblings,
+        })
+    }
+}
+
+impl From<&ccok::Certificate> for Certificate {
+    fn from(cert: &ccok::Certificate) -> Self {
+        Self {
+            sig_commit: cert.sig_commit.clone(),
+            signed_weight: cert.signed_weight,
+            total_sigs: cert.total_sigs as u64,
+            reveals: cert
+                .reveals
+                .iter()
+                .map(|(pos, reveal)| (*pos, Reveal::from(reveal)))
+                .collect(),
+            sig_proofs: cert.sig_proofs.clone(),
+            party_proofs: cert.party_proofs.clone(),
+            reveal_positions: cert.reveal_positions.clone(),
+            reveal_indices: cert.reveal_indices.clone(),
+            schemes: cert.schemes.iter().map(|s| s.0 as u32).collect(),
+            compressed_sig_proofs: cert.compressed_sig_proofs.as_ref().map(|p| p.nodes.clone()),
+            compressed_party_proofs: cert
+                .compressed_party_proofs
+                .as_ref()
+                .map(|p| p.nodes.clone()),
+            hash: cert.hash.id() as u32,
+            version: cert.version as u32,
+            party_sum_proofs: cert
+                .party_sum_proofs
+                .iter()
+                .flatten()
+                .map(SumPath::from)
+                .collect(),
+            coin_seed: cert.coin_seed.clone(),
+            sig_sum_proofs: cert
+                .sig_sum_proofs
+                .iter()
+                .flatten()
+                .map(SumPath::from)
+                .collect(),
+            aggregate_sig: cert.aggregate_sig.clone(),
+        }
+    }
+}
+
+impl TryFrom<Certificate> for ccok::Certificate {
+    type Error = String;
+
+    fn try_from(cert: Certificate) -> Result<Self, String> {
+        let total_sigs = usize::try_from(cert.total_sigs)
+            .map_err(|_| format!("Invalid signature count {}", cert.total_sigs))?;
+        let reveals = cert
+            .reveals
+            .into_iter()
+            .map(|(pos, reveal)| Ok((pos, reveal.try_into()?)))
+            .collect::<Result<BTreeMap<u64, ccok::Reveal>, String>>()?;
+        let schemes = cert
+            .schemes
+            .into_iter()
+            .map(scheme_from_proto)
+            .collect::<Result<Vec<SchemeId>, String>>()?;
+        Ok(Self {
+            sig_commit: cert.sig_commit,
+            signed_weight: cert.signed_weight,
+            total_sigs,
+            reveals,
+            sig_proofs: cert.sig_proofs,
+            party_proofs: cert.party_proofs,
+            reveal_positions: cert.reveal_positions,
+            reveal_indices: cert.reveal_indices,
+            schemes,
+            compressed_sig_proofs: cert
+                .compressed_sig_proofs
+                .map(|nodes| CompressedProofSet { nodes }),
+            compressed_party_proofs: cert
+                .compressed_party_proofs
+                .map(|nodes| CompressedProofSet { nodes }),
+            hash: hash_from_proto(cert.hash)?,
+            version: version_from_proto(cert.version)?,
+            // Certificates always reveal someone, so no paths means none were included
+            party_sum_proofs: if cert.party_sum_proofs.is_empty() {
+                None
+            } else {
+                Some(
+                    cert.party_sum_proofs
+                        .into_iter()
+                        .map(TryInto::try_into)
+                        .collect::<Result<Vec<_>, String>>()?,
+                )
+            },
+            coin_seed: cert.coin_seed,
+            sig_sum_proofs: if cert.sig_sum_proofs.is_empty() {
+                None
+            } else {
+                Some(
+                    cert.sig_sum_proofs
+                        .into_iter()
+                        .map(TryInto::try_into)
+                        .collect::<Result<Vec<_>, String>>()?,
+                )
+            },
+            aggregate_sig: cert.aggregate_sig,
+        })
+    }
+}
+
+impl ccok::Certificate {
+    /// Protobuf encoding of the certificate
+    pub fn to_proto(&self) -> Vec<u8> {
+        Certificate::from(self).encode_to_vec()
+    }
+
+    /// Decode a certificate from its protobuf encoding
+    pub fn from_proto(bytes: &[u8]) -> Result<Self, String> {
+        Certificate::decode(bytes)
+            .map_err(|e| e.to_string())?
+            .try_into()
+    }
+}
+
+impl ccok::Params {
+    /// Protobuf encoding of the params
+    pub fn to_proto(&self) -> Vec<u8> {
+        Params::from(self).encode_to_vec()
+    }
+
+    /// Decode params from their protobuf encoding
+    pub fn from_proto(bytes: &[u8]) -> Result<Self, String> {
+        Params::decode(bytes).map_err(|e| e.to_string())?.try_into()
+    }
+}
+
+impl ccok::Participant {
+    /// Protobuf encoding of the participant
+    pub fn to_proto(&self) -> Vec<u8> {
+        Participant::from(self).encode_to_vec()
+    }
+
+    /// Decode a participant from its protobuf encoding
+    pub fn from_proto(bytes: &[u8]) -> Result<Self, String> {
+        Participant::decode(bytes)
+            .map_err(|e| e.to_string())?
+            .try_into()
+    }
+}
+
+impl From<&block::Block> for BlockHeader {
+    fn from(block: &block::Block) -> Self {
+        let header = block.header();
+        Self {
+            height: header.height,
+            parent_hash: header.parent_hash.to_vec(),
+            timestamp: header.timestamp,
+            tx_root: header.tx_root.to_vec(),
+            state_root: header.state_root.to_vec(),
+            validator_root: header.validator_root.to_vec(),
+            seed: header.seed.to_vec(),
+            hash: block.hash.to_vec(),
+            commitment_root: header.commitment_root.to_vec(),
+        }
+    }
+}
+
+// A 32-byte hash field
+fn hash_field(name: &str, bytes: Vec<u8>) -> Result<[u8; 32], String> {
+    bytes
+        .try_into()
+        .map_err(|bytes: Vec<u8>| format!("Invalid {} length: {}", name, bytes.len()))
+}
+
+impl TryFrom<BlockHeader> for block::BlockHeader {
+    type Error = String;
+
+    /// Header of the message, checked against the hash it carries
+    fn try_from(header: BlockHeader) -> Result<Self, String> {
+        let parsed = Self {
+            height: header.height,
+            parent_hash: hash_field("parent hash", header.parent_hash)?,
+            timestamp: header.timestamp,
+            tx_root: hash_field("transaction root", header.tx_root)?,
+            state_root: hash_field("state root", header.state_root)?,
+            validator_root: hash_field("validator root", header.validator_root)?,
+            commitment_root: hash_field("commitment root", header.commitment_root)?,
+            seed: hash_field("seed", header.seed)?,
+        };
+        if parsed.hash()?.as_slice() != header.hash {
+            return Err(format!(
+                "Header hash of block {} does not match",
+                header.height
+            ));
+        }
+        Ok(parsed)
+    }
+}
+
+impl From<&stateproof::StateProof> for StateProof {
+    fn from(proof: &stateproof::StateProof) -> Self {
+        let message = &proof.message;
+        Self {
+            message: Some(StateProofMessage {
+                first_block: message.first_block,
+                last_block: message.last_block,
+                block_headers_commitment: message.block_headers_commitment.clone(),
+                voters_commitment: message.voters_commitment.clone(),
+            }),
+            certificate: Some(Certificate::from(&proof.certificate)),
+        }
+    }
+}
+
+impl TryFrom<StateProof> for stateproof::StateProof {
+    type Error = String;
+
+    fn try_from(proof: StateProof) -> Result<Self, String> {
+        let message = proof
+            .message
+            .ok_or_else(|| "State proof without message".to_string())?;
+        let certificate = proof
+            .certificate
+            .ok_or_else(|| "State proof without certificate".to_string())?;
+        Ok(Self {
+            message: stateproof::StateProofMessage {
+                first_block: message.first_block,
+                last_block: message.last_block,
+                block_headers_commitment: message.block_headers_commitment,
+                voters_commitment: message.voters_commitment,
+            },
+            certificate: certificate.try_into()?,
+        })
+    }
+}
+
+impl From<&gossip::SignatureShare> for SignatureShare {
+    fn from(share: &gossip::SignatureShare) -> Self {
+        Self {
+            msg: share.msg.clone(),
+            position: share.position as u64,
+            signature: share.signature.clone(),
+        }
+    }
+}
+
+impl TryFrom<SignatureShare> for gossip::SignatureShare {
+    type Error = String;
+
+    fn try_from(share: SignatureShare) -> Result<Self, String> {
+        Ok(Self {
+            msg: share.msg,
+            position: usize::try_from(share.position)
+                .map_err(|_| format!("Invalid position {}", share.position))?,
+            signature: share.signature,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, PARAMS_V2};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_params_wire_format() {
+        let params = ccok::Params {
+            msg: b"hi".to_vec(),
+            proven_weight: 300,
+            scheme: Some(SchemeId(0)),
+            ..Default::default()
+        };
+        // Bytes as produced by protoc generated code for the same message
+        let expected = [
+            0x0a, 0x02, b'h', b'i', 0x10, 0xac, 0x02, 0x18, 0x80, 0x01, 0x20, 0x00, 0x30, 0x01,
+            0x38, 0x02,
+        ];
+        assert_eq!(params.to_proto(), expected);
+
+        let decoded = ccok::Params::from_proto(&expected).unwrap();
+        assert_eq!(decoded.msg, params.msg);
+        assert_eq!(decoded.proven_weight, 300);
+        assert_eq!(decoded.scheme, Some(SchemeId(0)));
+        assert_eq!(decoded.round, None);
+        assert_eq!(decoded.version, PARAMS_V2);
+
+        // Unknown fields are skipped; truncated input and unknown hashes fail
+        let mut extended = expected.to_vec();
+        extended.extend_from_slice(&[0x78, 0x05, 0x82, 0x01, 0x01, 0xff]);
+        assert_eq!(
+            Params::decode(&extended[..]).unwrap(),
+            Params::from(&params)
+        );
+        assert!(ccok::Params::from_proto(&expected[..5]).is_err());
+        assert!(ccok::Params::from_proto(&[0x30, 0x09]).is_err());
+
+        // Defaults are omitted and decode back to the defaults
+        assert!(Params::default().encode_to_vec().is_empty());
+        let legacy = ccok::Params::from_proto(&[]).unwrap();
+        assert_eq!(legacy.version, PARAMS_V1);
+        assert_eq!(legacy.hash, HashAlgorithm::Keccak256);
+    }
+
+    #[test]
+    fn test_certificate_round_trip() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<ccok::Participant> = wallets
+            .iter()
+            .map(|w| ccok::Participant::from_signer(w, 10))
+            .collect();
+        let params = ccok::Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 25,
+            hash: HashAlgorithm::Sha256,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let mut builder =
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap();
+        for (pos, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+        let mut compressed = cert.clone();
+        compressed
+            .compress_proofs()
+            .expect("Failed to compress proofs");
+
+        let params = ccok::Params::from_proto(&params.to_proto()).unwrap();
+        for cert in [cert, compressed] {
+            let bytes = cert.to_proto();
+            let decoded = ccok::Certificate::from_proto(&bytes).unwrap();
+            assert_eq!(decoded.to_proto(), bytes);
+            assert_eq!(decoded.digest().unwrap(), cert.digest().unwrap());
+            assert!(decoded.verify(&params, &party_tree.root()).unwrap());
+        }
+
+        for party in &participants {
+            let decoded = ccok::Participant::from_proto(&party.to_proto()).unwrap();
+            assert_eq!(decoded.public_key, party.public_key);
+            assert_eq!(decoded.scheme, party.scheme);
+        }
+    }
+}
@@ -0,0 +1,870 @@
+//! Relays state proofs from the sidechain to the main chain. Proofs arrive on
+//! a channel as intervals are certified and are handed to a `ChainSubmitter`,
+//! retrying with backoff until the main chain accepts them. `EvmSubmitter`
+//! submits to an EVM contract over JSON-RPC, replacing a transaction that
+//! isn't mined by one with the same nonce and a higher gas price, and only
+//! counts a proof relayed once its transaction is mined without reverting. A relayer following the node's
+//! `ForkEvent`s skips proofs of intervals a reorg made orphaned. While a
+//! certified circuit breaker halts the bridge, proofs are held back and
+//! relayed once it resumes.
+use crate::block::BlockHeader;
+use crate::bridge::BridgeState;
+use crate::evm::state_proof_calldata;
+use crate::forkchoice::ForkEvent;
+use crate::stateproof::{headers_commitment, StateProof, StateProofMessage};
+use crate::telemetry;
+use futures::future::BoxFuture;
+use log::{info, warn};
+use serde_json::{json, Value};
+use std::collections::BTreeMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::time::Duration;
+use tokio::sync::mpsc;
+
+/// Submits state proofs to a main chain
+pub trait ChainSubmitter: Send + Sync {
+    /// Submit `proof`, returning the main-chain transaction id. `attempt`
+    /// counts from 0 and lets submitters raise their fees on retries.
+    fn submit<'a>(
+        &'a self,
+        proof: &'a StateProof,
+        attempt: u32,
+    ) -> BoxFuture<'a, Result<String, String>>;
+}
+
+/// Retry behaviour of a relayer
+#[derive(Debug, Clone)]
+pub struct RelayerConfig {
+    /// Submissions of one proof before giving up on it
+    pub max_attempts: u32,
+    /// Delay before the first retry, doubled on every further one
+    pub retry_delay: Duration,
+    /// Upper bound of the retry delay
+    pub max_retry_delay: Duration,
+}
+
+impl Default for RelayerConfig {
+    fn default() -> Self {
+        Self {
+            max_attempts: 5,
+            retry_delay: Duration::from_secs(2),
+            max_retry_delay: Duration::from_secs(60),
+        }
+    }
+}
+
+/// Relays every new state proof through a `ChainSubmitter`
+pub struct Relayer<S: ChainSubmitter> {
+    submitter: S,
+    config: RelayerConfig,
+    last_relayed: Option<u64>,
+    /// Canonical headers above the last relayed block, by height
+    canonical: BTreeMap<u64, BlockHeader>,
+    bridge: BridgeState,
+    /// Proofs held back while the bridge is halted
+    held: Vec<StateProof>,
+}
+
+impl<S: ChainSubmitter> Relayer<S> {
+    /// Relayer submitting through `submitter`
+    pub fn new(submitter: S, config: RelayerConfig) -> Self {
+        Self {
+            submitter,
+            config,
+            last_relayed: None,
+            canonical: BTreeMap::new(),
+            bridge: BridgeState::Running,
+            held: Vec::new(),
+        }
+    }
+
+    /// Follow the state of the bridge, as its verified breaker certificates
+    /// left it
+    pub fn set_bridge_state(&mut self, state: BridgeState) {
+        self.bridge = state;
+    }
+
+    /// Proofs held back while the bridge is halted
+    pub fn held(&self) -> &[StateProof] {
+        &self.held
+    }
+
+    /// Relay the proofs held back while the bridge was halted, in order,
+    /// returning the transaction ids of those relayed. A proof failing to
+    /// relay is held again with the ones after it.
+    pub async fn relay_held(&mut self) -> Result<Vec<String>, String> {
+        let mut txs = Vec::new();
+        let mut pending = std::mem::take(&mut self.held).into_iter();
+        while let Some(proof) = pending.next() {
+            match self.relay(&proof).await {
+                Ok(Some(tx)) => txs.push(tx),
+                Ok(None) => {}
+                Err(e) => {
+                    self.held.push(proof);
+                    self.held.extend(pending);
+                    return Err(e);
+                }
+            }
+        }
+        Ok(txs)
+    }
+
+    /// Last block covered by a relayed proof
+    pub fn last_relayed(&self) -> Option<u64> {
+        self.last_relayed
+    }
+
+    /// Track the canonical headers through a move of the node's head
+    pub fn on_fork_event(&mut self, event: &ForkEvent) {
+        let applied = match event {
+            ForkEvent::NewHead { header } => std::slice::from_ref(header),
+            ForkEvent::Reorg {
+                common_ancestor,
+                applied,
+                ..
+            } => {
+                self.canonical.split_off(&(common_ancestor + 1));
+                applied
+            }
+        };
+        for header in applied {
+            if self.last_relayed < Some(header.height) {
+                self.canonical.insert(header.height, header.clone());
+            }
+        }
+    }
+
+    /// Whether `proof` commits to headers other than the canonical ones of
+    /// its interval. Intervals with untracked headers count as canonical.
+    pub fn is_orphaned(&self, proof: &StateProof) -> Result<bool, String> {
+        let (first, last) = (proof.message.first_block, proof.message.last_block);
+        let headers: Vec<BlockHeader> = self
+            .canonical
+            .range(first..=last)
+            .map(|(_, header)| header.clone())
+            .collect();
+        if first > last || headers.len() as u64 != last - first + 1 {
+            return Ok(false);
+        }
+        let hashing = proof.certificate.hashing();
+        Ok(headers_commitment(hashing, &headers)? != proof.message.block_headers_commitment)
+    }
+
+    /// Submit `proof`, retrying failed submissions. Returns the transaction
+    /// id, or `None` if the interval was already relayed, is orphaned or is
+    /// held back while the bridge is halted.
+    pub async fn relay(&mut self, proof: &StateProof) -> Result<Option<String>, String> {
+        if self.last_relayed >= Some(proof.message.last_block) {
+            return Ok(None);
+        }
+        if self.bridge != BridgeState::Running {
+            warn!(
+                "Bridge halted, holding state proof of blocks {}..={}",
+                proof.message.first_block, proof.message.last_block
+            );
+            if !self.held.iter().any(|held| held.message == proof.message) {
+                self.held.push(proof.clone());
+            }
+            return Ok(None);
+        }
+        if self.is_orphaned(proof)? {
+            warn!(
+                "Skipping orphaned state proof of blocks {}..={}",
+                proof.message.first_block, proof.message.last_block
+            );
+            return Ok(None);
+        }
+        let mut span = telemetry::detached("relay", None);
+        span.set_attribute("first_block", proof.message.first_block);
+        span.set_attribute("last_block", proof.message.last_block);
+        let mut delay = self.config.retry_delay;
+        let mut attempt = 0;
+        loop {
+            let mut submit = telemetry::detached("submit", span.context());
+            submit.set_attribute("attempt", attempt);
+            let result =
+                telemetry::instrument(&submit, self.submitter.submit(proof, attempt)).await;
+            if let Err(e) = &result {
+                submit.set_attribute("error", e);
+            }
+            drop(submit);
+            match result {
+                Ok(tx) => {
+                    info!(
+                        "Relayed state proof of blocks {}..={} in {}",
+                        proof.message.first_block, proof.message.last_block, tx
+                    );
+                    self.last_relayed = Some(proof.message.last_block);
+                    self.canonical = self.canonical.split_off(&(proof.message.last_block + 1));
+                    return Ok(Some(tx));
+                }
+                Err(e) if attempt + 1 < self.config.max_attempts => {
+                    warn!(
+                        "Submitting state proof of blocks {}..={} failed, retrying: {}",
+                        proof.message.first_block, proof.message.last_block, e
+                    );
+                    tokio::time::sleep(delay).await;
+                    delay = (delay * 2).min(self.config.max_retry_delay);
+                    attempt += 1;
+                }
+                Err(e) => {
+                    return Err(format!(
+                        "Giving up on state proof of blocks {}..={} after {} attempts: {}",
+                        proof.message.first_block,
+                        proof.message.last_block,
+                        attempt + 1,
+                        e
+                    ))
+                }
+            }
+        }
+    }
+
+    /// Relay proofs from `proofs` until the channel closes
+    pub async fn run(mut self, mut proofs: mpsc::Receiver<StateProof>) {
+        while let Some(proof) = proofs.recv().await {
+            if let Err(e) = self.relay(&proof).await {
+                warn!("{}", e);
+            }
+        }
+    }
+
+    /// Relay proofs from `proofs` like `run`, following the head moves on
+    /// `forks` to skip orphaned intervals
+    pub async fn follow(
+        mut self,
+        mut proofs: mpsc::Receiver<StateProof>,
+        mut forks: mpsc::Receiver<ForkEvent>,
+    ) {
+        loop {
+            tokio::select! {
+                // Head moves first, so proofs are checked against the latest head
+                biased;
+                Some(event) = forks.recv() => self.on_fork_event(&event),
+                proof = proofs.recv() => {
+                    let Some(proof) = proof else {
+                        break;
+                    };
+                    if let Err(e) = self.relay(&proof).await {
+                        warn!("{}", e);
+                    }
+                }
+            }
+        }
+    }
+}
+
+/// Gas limits of EVM submissions
+#[derive(Debug, Clone)]
+pub struct GasPolicy {
+    /// Percentage of the estimated gas to send as gas limit
+    pub limit_percent: u64,
+    /// Percentage the gas price is raised by on every retry
+    pub bump_percent: u64,
+    /// Highest gas price in wei the relayer pays
+    pub max_gas_price: u128,
+}
+
+impl Default for GasPolicy {
+    fn default() -> Self {
+        Self {
+            limit_percent: 120,
+            bump_percent: 15,
+            max_gas_price: 500_000_000_000,
+        }
+    }
+}
+
+impl GasPolicy {
+    /// Gas price of submission `attempt` from the node's current `price`
+    pub fn gas_price(&self, price: u128, attempt: u32) -> Result<u128, String> {
+        let bumped = price.saturating_mul(100 + self.bump_percent as u128 * attempt as u128) / 100;
+        if price > self.max_gas_price {
+            return Err(format!(
+                "Gas price {} exceeds the maximum {}",
+                price, self.max_gas_price
+            ));
+        }
+        Ok(bumped.min(self.max_gas_price))
+    }
+}
+
+/// Longest a JSON-RPC call may take, connecting included
+pub const RPC_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Longest an `EvmSubmitter` waits for a transaction to be mined before the
+/// next attempt replaces it
+pub const RECEIPT_TIMEOUT: Duration = Duration::from_secs(120);
+
+/// Interval between receipt polls
+pub const RECEIPT_POLL: Duration = Duration::from_secs(2);
+
+/// Endpoint answering EVM JSON-RPC calls
+pub trait EvmRpc: Send + Sync {
+    /// Call `method`, returning its result
+    fn call<'a>(&'a self, method: &'a str, params: Value) -> BoxFuture<'a, Result<Value, String>>;
+}
+
+/// Submits state proofs to an EVM verifier contract over JSON-RPC. The
+/// transactions are sent with `eth_sendTransaction`, so the endpoint must
+/// hold the key of `from`, e.g. a local node or a signing proxy.
+pub struct EvmSubmitter<R: EvmRpc = JsonRpc> {
+    rpc: R,
+    contract: String,
+    from: String,
+    gas: GasPolicy,
+    receipt_timeout: Duration,
+    receipt_poll: Duration,
+    /// Transactions sent for the proof being relayed
+    pending: Mutex<Option<Pending>>,
+}
+
+// Transactions sent for one proof, all with the same nonce, each replacing
+// the one before
+#[derive(Debug, Clone)]
+struct Pending {
+    message: StateProofMessage,
+    nonce: u128,
+    gas_price: u128,
+    hashes: Vec<String>,
+}
+
+/// JSON-RPC client of an EVM node
+pub struct JsonRpc {
+    client: reqwest::Client,
+    url: String,
+    next_id: AtomicU64,
+}
+
+impl JsonRpc {
+    /// Client of the node at `url`, giving up on a call after `RPC_TIMEOUT`
+    pub fn new(url: &str) -> Self {
+        let client = reqwest::Client::builder()
+            .timeout(RPC_TIMEOUT)
+            .build()
+            .expect("the default TLS backend initializes");
+        Self {
+            client,
+            url: url.to_string(),
+            next_id: AtomicU64::new(1),
+        }
+    }
+
+    /// Call `method`, returning its result
+    pub async fn call(&self, method: &str, params: Value) -> Result<Value, String> {
+        let request = json!({
+            "jsonrpc": "2.0",
+            "id": self.next_id.fetch_add(1, Ordering::Relaxed),
+            "method": method,
+            "params": params,
+        });
+        let response: Value = self
+            .client
+            .post(&self.url)
+            .json(&request)
+            .send()
+            .await
+            .map_err(|e| format!("{} request failed: {}", method, e))?
+            .json()
+            .await
+            .map_err(|e| format!("Invalid {} response: {}", method, e))?;
+        if let Some(error) = response.get("error") {
+            return Err(format!("{} failed: {}", method, error));
+        }
+        response
+            .get("result")
+            .cloned()
+            .ok_or_else(|| format!("{} returned no result", method))
+    }
+}
+
+impl EvmRpc for JsonRpc {
+    fn call<'a>(&'a self, method: &'a str, params: Value) -> BoxFuture<'a, Result<Value, String>> {
+        Box::pin(JsonRpc::call(self, method, params))
+    }
+}
+
+// Parse a JSON-RPC hex quantity
+fn parse_quantity(value: &Value) -> Result<u128, String> {
+    let hex = value
+        .as_str()
+        .and_then(|s| s.strip_prefix("0x"))
+        .ok_or_else(|| format!("Invalid quantity: {}", value))?;
+    u128::from_str_radix(hex, 16).map_err(|e| format!("Invalid quantity {}: {}", value, e))
+}
+
+impl EvmSubmitter {
+    /// Submitter calling `contract` from `from` through the node at `rpc_url`
+    pub fn new(rpc_url: &str, contract: &str, from: &str, gas: GasPolicy) -> Self {
+        Self::with_rpc(JsonRpc::new(rpc_url), contract, from, gas)
+    }
+}
+
+impl<R: EvmRpc> EvmSubmitter<R> {
+    /// Submitter calling `contract` from `from` through `rpc`
+    pub fn with_rpc(rpc: R, contract: &str, from: &str, gas: GasPolicy) -> Self {
+        Self {
+            rpc,
+            contract: contract.to_string(),
+            from: from.to_string(),
+            gas,
+            receipt_timeout: RECEIPT_TIMEOUT,
+            receipt_poll: RECEIPT_POLL,
+            pending: Mutex::new(None),
+        }
+    }
+
+    /// Wait up to `timeout` for a transaction to be mined, polling every
+    /// `poll`
+    pub fn with_receipt_wait(mut self, timeout: Duration, poll: Duration) -> Self {
+        self.receipt_timeout = timeout;
+        self.receipt_poll = poll;
+        self
+    }
+
+    async fn send(&self, proof: &StateProof, attempt: u32) -> Result<String, String> {
+        let data = {
+            let _span = telemetry::span("serialize");
+            state_proof_calldata(proof)?
+        };
+        // A proof sent before keeps its nonce, so the new transaction
+        // replaces the old instead of queueing behind it
+        let pending = self
+            .pending
+            .lock()
+            .unwrap()
+            .clone()
+            .filter(|pending| pending.message == proof.message);
+        if let Some(pending) = &pending {
+            // An earlier transaction may have been mined since
+            if let Some(hash) = self.mined(&pending.hashes).await? {
+                return Ok(hash);
+            }
+        }
+        let nonce = match &pending {
+            Some(pending) => pending.nonce,
+            None => parse_quantity(
+                &self
+                    .rpc
+                    .call("eth_getTransactionCount", json!([self.from, "pending"]))
+                    .await?,
+            )?,
+        };
+        let mut tx = json!({
+            "from": self.from,
+            "to": self.contract,
+            "data": format!("0x{}", hex::encode(data)),
+            "nonce": format!("0x{:x}", nonce),
+        });
+        let estimate = parse_quantity(&self.rpc.call("eth_estimateGas", json!([tx])).await?)?;
+        let mut price = self.gas.gas_price(
+            parse_quantity(&self.rpc.call("eth_gasPrice", json!([])).await?)?,
+            attempt,
+        )?;
+        // A replacement must outbid the transaction it replaces
+        if let Some(pending) = &pending {
+            let outbid = pending
+                .gas_price
+                .saturating_mul(100 + self.gas.bump_percent as u128)
+                / 100;
+            price = price.max(outbid).min(self.gas.max_gas_price);
+        }
+        tx["gas"] = json!(format!(
+            "0x{:x}",
+            estimate * self.gas.limit_percent as u128 / 100
+        ));
+        tx["gasPrice"] = json!(format!("0x{:x}", price));
+        let hash = self.rpc.call("eth_sendTransaction", json!([tx])).await?;
+        let hash = hash
+            .as_str()
+            .map(str::to_string)
+            .ok_or_else(|| format!("Invalid transaction hash: {}", hash))?;
+        let mut hashes = pending.map(|pending| pending.hashes).unwrap_or_default();
+        hashes.push(hash.clone());
+        *self.pending.lock().unwrap() = Some(Pending {
+            message: proof.message.clone(),
+            nonce,
+            gas_price: price,
+            hashes: hashes.clone(),
+        });
+
+        let deadline = tokio::time::Instant::now() + self.receipt_timeout;
+        loop {
+            if let Some(hash) = self.mined(&hashes).await? {
+                return Ok(hash);
+            }
+            if tokio::time::Instant::now() >= deadline {
+                return Err(format!(
+                    "Transaction {} not mined within {:?}",
+                    hash, self.receipt_timeout
+                ));
+            }
+            tokio::time::sleep(self.receipt_poll).await;
+        }
+    }
+
+    // The one of `hashes` that was mined, if any. A mined transaction ends
+    // the pending submission, and fails it if it reverted.
+    async fn mined(&self, hashes: &[String]) -> Result<Option<String>, String> {
+        for hash in hashes {
+            let receipt = self
+                .rpc
+                .call("eth_getTransactionReceipt", json!([hash]))
+                .await?;
+            if receipt.is_null() {
+                continue;
+            }
+            *self.pending.lock().unwrap() = None;
+            return match parse_quantity(&receipt["status"])? {
+                1 => Ok(Some(hash.clone())),
+                _ => Err(format!("Transaction {} reverted", hash)),
+            };
+        }
+        Ok(None)
+    }
+}
+
+impl<R: EvmRpc> ChainSubmitter for EvmSubmitter<R> {
+    fn submit<'a>(
+        &'a self,
+        proof: &'a StateProof,
+        attempt: u32,
+    ) -> BoxFuture<'a, Result<String, String>> {
+        Box::pin(self.send(proof, attempt))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bridge::HaltReason;
+    use crate::ccok::{Builder, Params, Participant};
+    use crate::stateproof::{voters_commitment, StateProofMessage};
+    use crate::wallet::Wallet;
+    use std::sync::atomic::AtomicU32;
+    use std::sync::Arc;
+
+    // Submitter failing the first `failures` submissions
+    struct FlakySubmitter {
+        failures: u32,
+        calls: Arc<AtomicU32>,
+    }
+
+    impl ChainSubmitter for FlakySubmitter {
+        fn submit<'a>(
+            &'a self,
+            proof: &'a StateProof,
+            attempt: u32,
+        ) -> BoxFuture<'a, Result<String, String>> {
+            let call = self.calls.fetch_add(1, Ordering::SeqCst);
+            Box::pin(async move {
+                assert_eq!(attempt, call);
+                if call < self.failures {
+                    Err("connection refused".to_string())
+                } else {
+                    Ok(format!("0x{:x}", proof.message.last_block))
+                }
+            })
+        }
+    }
+
+    // Node whose transactions are mined only when a test says so
+    #[derive(Default)]
+    struct FakeNode {
+        nonce: u128,
+        gas_price: u128,
+        sent: Vec<Value>,
+        receipts: BTreeMap<String, Value>,
+    }
+
+    impl FakeNode {
+        fn mine(&mut self, hash: &str, status: &str) {
+            self.receipts
+                .insert(hash.to_string(), json!({ "status": status }));
+        }
+    }
+
+    impl EvmRpc for Mutex<FakeNode> {
+        fn call<'a>(
+            &'a self,
+            method: &'a str,
+            params: Value,
+        ) -> BoxFuture<'a, Result<Value, String>> {
+            let mut node = self.lock().unwrap();
+            let result = match method {
+                "eth_getTransactionCount" => json!(format!("0x{:x}", node.nonce)),
+                "eth_estimateGas" => json!("0x5208"),
+                "eth_gasPrice" => json!(format!("0x{:x}", node.gas_price)),
+                "eth_sendTransaction" => {
+                    node.sent.push(params[0].clone());
+                    json!(format!("0x{:x}", node.sent.len()))
+                }
+                "eth_getTransactionReceipt" => node
+                    .receipts
+                    .get(params[0].as_str().unwrap())
+                    .cloned()
+                    .unwrap_or(Value::Null),
+                _ => unreachable!("unexpected call {}", method),
+            };
+            Box::pin(async move { Ok(result) })
+        }
+    }
+
+    fn evm_submitter() -> EvmSubmitter<Mutex<FakeNode>> {
+        let node = FakeNode {
+            nonce: 5,
+            gas_price: 100,
+            ..Default::default()
+        };
+        EvmSubmitter::with_rpc(
+            Mutex::new(node),
+            "0xcontract",
+            "0xrelayer",
+            GasPolicy::default(),
+        )
+        .with_receipt_wait(Duration::from_millis(5), Duration::from_millis(1))
+    }
+
+    fn state_proof() -> StateProof {
+        let wallets: Vec<Wallet> = (0..2)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let voters: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let template = Params {
+            proven_weight: 10,
+            ..Default::default()
+        };
+        let root = voters_commitment(template.hashing(), &voters).unwrap();
+        let message = StateProofMessage {
+            first_block: 1,
+            last_block: 16,
+            block_headers_commitment: vec![1u8; 32],
+            voters_commitment: root.clone(),
+        };
+        let params = message.params(&template).unwrap();
+        let mut builder = Builder::new(params.clone(), voters, root).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        StateProof {
+            message,
+            certificate: builder.build().unwrap(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_relay_retries() {
+        let proof = state_proof();
+        let config = RelayerConfig {
+            max_attempts: 3,
+            retry_delay: Duration::from_millis(1),
+            max_retry_delay: Duration::from_millis(2),
+        };
+
+        // Transient failures are retried, and a relayed interval is not sent again
+        let calls = Arc::new(AtomicU32::new(0));
+        let submitter = FlakySubmitter {
+            failures: 2,
+            calls: calls.clone(),
+        };
+        let mut relayer = Relayer::new(submitter, config.clone());
+        assert_eq!(
+            relayer.relay(&proof).await.unwrap(),
+            Some("0x10".to_string())
+        );
+        assert_eq!(relayer.relay(&proof).await.unwrap(), None);
+        assert_eq!(calls.load(Ordering::SeqCst), 3);
+        assert_eq!(relayer.last_relayed(), Some(16));
+
+        // Submissions stop after `max_attempts`
+        let calls = Arc::new(AtomicU32::new(0));
+        let submitter = FlakySubmitter {
+            failures: 3,
+            calls: calls.clone(),
+        };
+        let mut relayer = Relayer::new(submitter, config);
+        assert!(relayer.relay(&proof).await.is_err());
+        assert_eq!(calls.load(Ordering::SeqCst), 3);
+        assert_eq!(relayer.last_relayed(), None);
+
+        let gas = GasPolicy::default();
+        assert_eq!(gas.gas_price(100, 0).unwrap(), 100);
+        assert_eq!(gas.gas_price(100, 2).unwrap(), 130);
+        assert!(gas.gas_price(gas.max_gas_price + 1, 0).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_hold_while_halted() {
+        let proof = state_proof();
+        let calls = Arc::new(AtomicU32::new(0));
+        let submitter = FlakySubmitter {
+            failures: 0,
+            calls: calls.clone(),
+        };
+        let mut relayer = Relayer::new(submitter, RelayerConfig::default());
+
+        // Halted, proofs are held back until the bridge resumes
+        let halted = BridgeState::Halted {
+            sequence: 0,
+            reason: HaltReason::Emergency,
+        };
+        relayer.set_bridge_state(halted);
+        // A proof passed again while held is held once
+        for _ in 0..2 {
+            assert_eq!(relayer.relay(&proof).await.unwrap(), None);
+        }
+        assert_eq!(relayer.held().len(), 1);
+        assert_eq!(calls.load(Ordering::SeqCst), 0);
+        relayer.set_bridge_state(BridgeState::Running);
+        assert_eq!(
+            relayer.relay_held().await.unwrap(),
+            vec!["0x10".to_string()]
+        );
+        assert!(relayer.held().is_empty());
+        assert_eq!(relayer.last_relayed(), Some(16));
+
+        // A proof failing to relay after the resume stays held
+        let submitter = FlakySubmitter {
+            failures: 1,
+            calls: Arc::new(AtomicU32::new(0)),
+        };
+        let config = RelayerConfig {
+            max_attempts: 1,
+            ..RelayerConfig::default()
+        };
+        let mut relayer = Relayer::new(submitter, config);
+        relayer.set_bridge_state(halted);
+        relayer.relay(&proof).await.unwrap();
+        relayer.set_bridge_state(BridgeState::Running);
+        assert!(relayer.relay_held().await.is_err());
+        assert_eq!(relayer.held().len(), 1);
+        assert_eq!(relayer.last_relayed(), None);
+    }
+
+    #[tokio::test]
+    async fn test_orphaned_proofs() {
+        let header = |height: u64, seed: u8| BlockHeader {
+            height,
+            parent_hash: [0u8; 32],
+            timestamp: height,
+            tx_root: [0u8; 32],
+            state_root: [0u8; 32],
+            validator_root: [0u8; 32],
+            commitment_root: [0u8; 32],
+            seed: [seed; 32],
+        };
+        let calls = Arc::new(AtomicU32::new(0));
+        let submitter = FlakySubmitter {
+            failures: 0,
+            calls: calls.clone(),
+        };
+        let mut relayer = Relayer::new(submitter, RelayerConfig::default());
+        let headers: Vec<BlockHeader> = (1..=16).map(|height| header(height, 0)).collect();
+        for header in &headers {
+            relayer.on_fork_event(&ForkEvent::NewHead {
+                header: header.clone(),
+            });
+        }
+
+        // A proof of other headers is skipped
+        let mut proof = state_proof();
+        assert!(relayer.is_orphaned(&proof).unwrap());
+        assert_eq!(relayer.relay(&proof).await.unwrap(), None);
+        assert_eq!(calls.load(Ordering::SeqCst), 0);
+
+        // Until a reorg makes its headers canonical
+        let hashing = proof.certificate.hashing();
+        proof.message.block_headers_commitment = headers_commitment(hashing, &headers).unwrap();
+        assert!(!relayer.is_orphaned(&proof).unwrap());
+        relayer.on_fork_event(&ForkEvent::Reorg {
+            common_ancestor: 9,
+            retracted: headers[9..].to_vec(),
+            applied: (10..=16).map(|height| header(height, 1)).collect(),
+        });
+        assert!(relayer.is_orphaned(&proof).unwrap());
+        relayer.on_fork_event(&ForkEvent::Reorg {
+            common_ancestor: 9,
+            retracted: Vec::new(),
+            applied: headers[9..].to_vec(),
+        });
+        assert_eq!(
+            relayer.relay(&proof).await.unwrap(),
+            Some("0x10".to_string())
+        );
+        assert_eq!(calls.load(Ordering::SeqCst), 1);
+    }
+
+    #[tokio::test]
+    async fn test_evm_replace_by_fee() {
+        let proof = state_proof();
+        let submitter = evm_submitter();
+
+        // An unmined transaction fails the attempt; the retry replaces it
+        // with the same nonce at a higher price, and succeeds once mined
+        assert!(submitter.submit(&proof, 0).await.is_err());
+        submitter.rpc.lock().unwrap().nonce = 6;
+        submitter.rpc.lock().unwrap().mine("0x2", "0x1");
+        assert_eq!(submitter.submit(&proof, 1).await.unwrap(), "0x2");
+        let node = submitter.rpc.lock().unwrap();
+        let sent: Vec<(&Value, u128)> = node
+            .sent
+            .iter()
+            .map(|tx| (&tx["nonce"], parse_quantity(&tx["gasPrice"]).unwrap()))
+            .collect();
+        assert_eq!(sent, [(&json!("0x5"), 100), (&json!("0x5"), 115)]);
+        assert_eq!(node.sent[0]["gas"], json!("0x6270"));
+        drop(node);
+
+        // The next proof takes a fresh nonce
+        let mut next = proof.clone();
+        next.message.first_block = 17;
+        next.message.last_block = 32;
+        submitter.rpc.lock().unwrap().mine("0x3", "0x1");
+        assert_eq!(submitter.submit(&next, 0).await.unwrap(), "0x3");
+        assert_eq!(submitter.rpc.lock().unwrap().sent[2]["nonce"], json!("0x6"));
+    }
+
+    #[tokio::test]
+    async fn test_evm_receipts() {
+        let proof = state_proof();
+
+        // A replaced transaction mined after all is the one relayed, and
+        // nothing more is sent
+        let submitter = evm_submitter();
+        assert!(submitter.submit(&proof, 0).await.is_err());
+        submitter.rpc.lock().unwrap().mine("0x1", "0x1");
+        assert_eq!(submitter.submit(&proof, 1).await.unwrap(), "0x1");
+        assert_eq!(submitter.rpc.lock().unwrap().sent.len(), 1);
+
+        // A reverted transaction fails the submission, and the retry sends
+        // from a fresh nonce
+        let submitter = evm_submitter();
+        submitter.rpc.lock().unwrap().mine("0x1", "0x0");
+        let err = submitter.submit(&proof, 0).await.unwrap_err();
+        assert!(err.contains("reverted"));
+        submitter.rpc.lock().unwrap().nonce = 6;
+        submitter.rpc.lock().unwrap().mine("0x2", "0x1");
+        assert_eq!(submitter.submit(&proof, 1).await.unwrap(), "0x2");
+        assert_eq!(submitter.rpc.lock().unwrap().sent[1]["nonce"], json!("0x6"));
+
+        // The relayer retries through replacements until one is mined
+        let submitter = evm_submitter();
+        submitter.rpc.lock().unwrap().mine("0x3", "0x1");
+        let config = RelayerConfig {
+            max_attempts: 3,
+            retry_delay: Duration::from_millis(1),
+            max_retry_delay: Duration::from_millis(2),
+        };
+        let mut relayer = Relayer::new(submitter, config);
+        assert_eq!(
+            relayer.relay(&proof).await.unwrap(),
+            Some("0x3".to_string())
+        );
+    }
+}
@@ -0,0 +1,577 @@
+//! Signing by keys held outside the node, in an HSM or a separate signing
+//! daemon. A `RemoteSigner` may fail or time out, unlike a local `Signer`, so
+//! it signs under a `Context` whose deadline bounds the request. It is asked
+//! to sign certificate params, never raw bytes: the daemon derives the
+//! domain-separated message itself, so a compromised node can't have it sign
+//! arbitrary data. `UnixSocketSigner` talks to a `SignerDaemon` over a Unix
+//! socket with length-prefixed bincode frames; the daemon serves the keys it
+//! unlocked from its keystore by name. `Builder::sign_with` lets a
+//! certificate builder collect the signature of a participant from any
+//! remote signer.
+//!
+//! The daemon only signs params bound to a chain, purpose and round, and
+//! keeps a high-water mark of the latest round each key signed for each
+//! chain and purpose. It refuses an older round, or another message in the
+//! same round, so a compromised node can't make a validator equivocate.
+use crate::ccok::{Builder, KeyLayout, Params, Participant, Purpose, PARAMS_V2};
+use crate::context::Context;
+use crate::hybrid;
+use crate::scheme::SchemeId;
+use crate::signer::{ExportableSigner, Signer};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::Duration;
+
+/// Largest frame accepted, above the size of any signature or message signed
+const MAX_FRAME: usize = 1 << 20;
+
+/// Signer whose key is held elsewhere
+pub trait RemoteSigner {
+    fn scheme(&self) -> SchemeId;
+
+    fn public_key(&self) -> Vec<u8>;
+
+    /// Sign for the certificate of `params`, failing if the signer can't be
+    /// reached before `ctx` expires
+    fn sign_certificate(&self, ctx: &Context, params: &Params) -> Result<Vec<u8>, String>;
+
+    fn public_key_hex(&self) -> String {
+        hex::encode(self.public_key())
+    }
+}
+
+// Local keys are remote signers that never fail
+impl<S: Signer> RemoteSigner for S {
+    fn scheme(&self) -> SchemeId {
+        Signer::scheme(self)
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        Signer::public_key(self)
+    }
+
+    fn sign_certificate(&self, ctx: &Context, params: &Params) -> Result<Vec<u8>, String> {
+        ctx.check()?;
+        Ok(Signer::sign_certificate(self, params))
+    }
+}
+
+impl Participant {
+    /// Participant signing with `signer`
+    pub fn from_remote(signer: &dyn RemoteSigner, weight: u64) -> Self {
+        Self {
+            public_key: signer.public_key_hex(),
+            weight,
+            scheme: signer.scheme(),
+            key_commitment: None,
+            vrf_key: None,
+            key_layout: KeyLayout::InLeaf,
+        }
+    }
+}
+
+impl Builder {
+    /// Have `signer` sign for the participant at `pos` before `ctx` expires.
+    /// The signature is checked first, as a remote signer is not trusted to
+    /// use the right key.
+    pub fn sign_with(
+        &mut self,
+        ctx: &Context,
+        pos: usize,
+        signer: &dyn RemoteSigner,
+    ) -> Result<(), String> {
+        let party = self
+            .participants
+            .get(pos)
+            .ok_or_else(|| format!("No participant at position {}", pos))?;
+        let public_key = signer.public_key();
+        if !party.commits_to_key(self.params.hashing(), &public_key)
+            || party.scheme != signer.scheme()
+        {
+            return Err(format!("Signer is not the participant at position {}", pos));
+        }
+        let signature = signer.sign_certificate(ctx, &self.params)?;
+        if !hybrid::verify_signature(
+            self.params.signature_mode,
+            signer.scheme(),
+            &public_key,
+            &self.params.signing_message(),
+            &signature,
+        )? {
+            return Err(format!("Remote signature of position {} is invalid", pos));
+        }
+        Ok(self.add_signature(pos, signature)?)
+    }
+}
+
+/// Request to a signer daemon
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum SignerRequest {
+    PublicKey {
+        key: String,
+    },
+    /// Sign for the certificate of `params`
+    Sign {
+        key: String,
+        params: Params,
+    },
+}
+
+/// Answer of a signer daemon
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum SignerResponse {
+    PublicKey {
+        scheme: SchemeId,
+        #[serde(with = "serde_bytes")]
+        public_key: Vec<u8>,
+    },
+    Signature(#[serde(with = "serde_bytes")] Vec<u8>),
+    Error(String),
+}
+
+/// Write `message` as a length-prefixed frame
+pub fn write_frame<T: Serialize>(stream: &mut impl Write, message: &T) -> Result<(), String> {
+    let body = bincode::serialize(message).map_err(|e| format!("Serialization error: {}", e))?;
+    stream
+        .write_all(&(body.len() as u32).to_be_bytes())
+        .and_then(|_| stream.write_all(&body))
+        .and_then(|_| stream.flush())
+        .map_err(|e| format!("Failed to write frame: {}", e))
+}
+
+/// Read a frame written by `write_frame`
+pub fn read_frame<T: serde::de::DeserializeOwned>(stream: &mut impl Read) -> Result<T, String> {
+    let mut len = [0u8; 4];
+    stream
+        .read_exact(&mut len)
+        .map_err(|e| format!("Failed to read frame: {}", e))?;
+    let len = u32::from_be_bytes(len) as usize;
+    if len > MAX_FRAME {
+        return Err(format!("Frame of {} bytes is too large", len));
+    }
+    let mut body = vec![0u8; len];
+    stream
+        .read_exact(&mut body)
+        .map_err(|e| format!("Failed to read frame: {}", e))?;
+    bincode::deserialize(&body).map_err(|e| format!("Deserialization error: {}", e))
+}
+
+/// Latest round a key signed for one chain and purpose, and the message it
+/// signed in it
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HighWaterMark {
+    pub key: String,
+    pub chain_id: u64,
+    pub purpose: Purpose,
+    pub round: u64,
+    #[serde(with = "serde_bytes")]
+    pub msg: Vec<u8>,
+}
+
+/// Signing daemon serving named keys
+#[derive(Default)]
+pub struct SignerDaemon {
+    keys: HashMap<String, Box<dyn ExportableSigner>>,
+    marks: Mutex<HashMap<(String, u64, Purpose), HighWaterMark>>,
+    /// File the marks are kept in across restarts
+    marks_path: Option<PathBuf>,
+}
+
+impl SignerDaemon {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Keep the high-water marks in the file at `path`, starting from the
+    /// marks it already holds
+    pub fn with_marks(mut self, path: impl AsRef<Path>) -> Result<Self, String> {
+        let path = path.as_ref();
+        if path.exists() {
+            let failed = |e: String| format!("Failed to load marks {}: {}", path.display(), e);
+            let bytes = std::fs::read(path).map_err(|e| failed(e.to_string()))?;
+            let marks: Vec<HighWaterMark> =
+                serde_json::from_slice(&bytes).map_err(|e| failed(e.to_string()))?;
+            let table = self.marks.get_mut().unwrap();
+            for mark in marks {
+                table.insert((mark.key.clone(), mark.chain_id, mark.purpose), mark);
+            }
+        }
+        self.marks_path = Some(path.to_path_buf());
+        Ok(self)
+    }
+
+    /// High-water marks of the keys, one per key, chain and purpose
+    pub fn marks(&self) -> Vec<HighWaterMark> {
+        let mut marks: Vec<HighWaterMark> = self.marks.lock().unwrap().values().cloned().collect();
+        marks.sort_by(|a, b| {
+            (&a.key, a.chain_id, a.purpose.id()).cmp(&(&b.key, b.chain_id, b.purpose.id()))
+        });
+        marks
+    }
+
+    // Raise the mark of `key` to the round of `params`, refusing older
+    // rounds and other messages in the marked round. The new mark is saved
+    // before anything is signed under it.
+    fn advance_mark(&self, key: &str, params: &Params) -> Result<(), String> {
+        let Some((chain_id, purpose, Some(round))) = params.binding() else {
+            return Err("Params must be bound to a chain, purpose and round".to_string());
+        };
+        if params.version < PARAMS_V2 {
+            return Err(format!(
+                "Params version {} does not bind the signed message",
+                params.version
+            ));
+        }
+        let msg = params.signing_message();
+        let mut marks = self.marks.lock().unwrap();
+        let entry = (key.to_string(), chain_id, purpose);
+        if let Some(mark) = marks.get(&entry) {
+            if round < mark.round {
+                return Err(format!(
+                    "Round {} is older than round {} key {} signed for {:?}",
+                    round, mark.round, key, purpose
+                ));
+            }
+            if round == mark.round {
+                if mark.msg != msg {
+                    return Err(format!(
+                        "Key {} already signed another message in round {} for {:?}",
+                        key, round, purpose
+                    ));
+                }
+                return Ok(());
+            }
+        }
+        let previous = marks.insert(
+            entry.clone(),
+            HighWaterMark {
+                key: key.to_string(),
+                chain_id,
+                purpose,
+                round,
+                msg,
+            },
+        );
+        if let Err(e) = self.save_marks(&marks) {
+            match previous {
+                Some(previous) => marks.insert(entry, previous),
+                None => marks.remove(&entry),
+            };
+            return Err(e);
+        }
+        Ok(())
+    }
+
+    // Write `marks` to the marks file, replacing it by a rename so a crash
+    // leaves either the old or the new marks
+    fn save_marks(
+        &self,
+        marks: &HashMap<(String, u64, Purpose), HighWaterMark>,
+    ) -> Result<(), String> {
+        let Some(path) = &self.marks_path else {
+            return Ok(());
+        };
+        let failed = |e: std::io::Error| format!("Failed to save marks {}: {}", path.display(), e);
+        let marks: Vec<&HighWaterMark> = marks.values().collect();
+        let bytes =
+            serde_json::to_vec(&marks).map_err(|e| format!("Serialization error: {}", e))?;
+        let saved = path.with_extension("tmp");
+        let mut file = std::fs::File::create(&saved).map_err(failed)?;
+        file.write_all(&bytes)
+            .and_then(|_| file.sync_all())
+            .map_err(failed)?;
+        std::fs::rename(&saved, path).map_err(failed)
+    }
+
+    /// Serve `signer` as `name`
+    pub fn add_key(&mut self, name: &str, signer: Box<dyn ExportableSigner>) {
+        self.keys.insert(name.to_string(), signer);
+    }
+
+    /// Answer one request, signing only past the key's high-water mark
+    pub fn handle(&self, request: SignerRequest) -> SignerResponse {
+        let key = match &request {
+            SignerRequest::PublicKey { key } | SignerRequest::Sign { key, .. } => key,
+        };
+        let Some(signer) = self.keys.get(key) else {
+            return SignerResponse::Error(format!("Unknown key {}", key));
+        };
+        match request {
+            SignerRequest::PublicKey { .. } => SignerResponse::PublicKey {
+                scheme: signer.scheme(),
+                public_key: signer.public_key(),
+            },
+            SignerRequest::Sign { key, params } => match self.advance_mark(&key, &params) {
+                Ok(()) => SignerResponse::Signature(signer.sign_certificate(&params)),
+                Err(e) => SignerResponse::Error(e),
+            },
+        }
+    }
+
+    /// Answer the requests of one connection until the client closes it
+    pub fn serve_connection(&self, stream: &mut (impl Read + Write)) -> Result<(), String> {
+        loop {
+            let request = match read_frame(stream) {
+                Ok(request) => request,
+                // The client hung up
+                Err(_) => return Ok(()),
+            };
+            write_frame(stream, &self.handle(request))?;
+        }
+    }
+
+    /// Serve the clients of `listener`, one thread per connection
+    #[cfg(unix)]
+    pub fn serve(self, listener: std::os::unix::net::UnixListener) -> Result<(), String> {
+        let daemon = std::sync::Arc::new(self);
+        for stream in listener.incoming() {
+            let mut stream = stream.map_err(|e| format!("Failed to accept connection: {}", e))?;
+            let daemon = std::sync::Arc::clone(&daemon);
+            std::thread::spawn(move || {
+                if let Err(e) = daemon.serve_connection(&mut stream) {
+                    log::warn!("Signer connection failed: {}", e);
+                }
+            });
+        }
+        Ok(())
+    }
+}
+
+/// Remote signer of a key served by a `SignerDaemon` on a Unix socket
+#[cfg(unix)]
+#[derive(Debug, Clone)]
+pub struct UnixSocketSigner {
+    path: std::path::PathBuf,
+    key: String,
+    timeout: Duration,
+    scheme: SchemeId,
+    public_key: Vec<u8>,
+}
+
+#[cfg(unix)]
+impl UnixSocketSigner {
+    /// Signer of the key `key` of the daemon at `path`, giving up on a
+    /// request after `timeout`
+    pub fn connect(
+        path: impl AsRef<std::path::Path>,
+        key: &str,
+        timeout: Duration,
+    ) -> Result<Self, String> {
+        let mut signer = Self {
+            path: path.as_ref().to_path_buf(),
+            key: key.to_string(),
+            timeout,
+            scheme: SchemeId::default(),
+            public_key: Vec::new(),
+        };
+        match signer.request(
+            &Context::with_timeout(timeout),
+            &SignerRequest::PublicKey {
+                key: key.to_string(),
+            },
+        )? {
+            SignerResponse::PublicKey { scheme, public_key } => {
+                signer.scheme = scheme;
+                signer.public_key = public_key;
+                Ok(signer)
+            }
+            other => Err(unexpected(other)),
+        }
+    }
+
+    // Send `request`, waiting for the answer until the signer timeout or the
+    // deadline of `ctx`, whichever comes first
+    fn request(&self, ctx: &Context, request: &SignerRequest) -> Result<SignerResponse, String> {
+        ctx.check()?;
+        let timeout = match ctx.deadline() {
+            Some(deadline) => self
+                .timeout
+                .min(deadline.saturating_duration_since(std::time::Instant::now())),
+            None => self.timeout,
+        };
+        let failed =
+            |e: std::io::Error| format!("Signer {} unreachable: {}", self.path.display(), e);
+        let mut stream = std::os::unix::net::UnixStream::connect(&self.path).map_err(failed)?;
+        stream.set_read_timeout(Some(timeout)).map_err(failed)?;
+        stream.set_write_timeout(Some(timeout)).map_err(failed)?;
+        write_frame(&mut stream, request)?;
+        read_frame(&mut stream)
+    }
+}
+
+#[cfg(unix)]
+impl RemoteSigner for UnixSocketSigner {
+    fn scheme(&self) -> SchemeId {
+        self.scheme
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        self.public_key.clone()
+    }
+
+    fn sign_certificate(&self, ctx: &Context, params: &Params) -> Result<Vec<u8>, String> {
+        match self.request(
+            ctx,
+            &SignerRequest::Sign {
+                key: self.key.clone(),
+                params: params.clone(),
+            },
+        )? {
+            SignerResponse::Signature(signature) => Ok(signature),
+            other => Err(unexpected(other)),
+        }
+    }
+}
+
+fn unexpected(response: SignerResponse) -> String {
+    match response {
+        SignerResponse::Error(e) => format!("Signer refused: {}", e),
+        other => format!("Unexpected signer response {:?}", other),
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::ccok::{Params, Verifier, PARAMS_V1};
+    use crate::merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder};
+    use crate::scheme::verify_signature;
+    use crate::wallet::Wallet;
+    use std::os::unix::net::UnixListener;
+
+    #[test]
+    fn test_remote_signer() {
+        let path = std::env::temp_dir().join(format!("niropok-signer-{}.sock", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let listener = UnixListener::bind(&path).unwrap();
+        let mut daemon = SignerDaemon::new();
+        daemon.add_key("validator", Box::new(Wallet::new().unwrap()));
+        std::thread::spawn(move || daemon.serve(listener));
+
+        let remote = UnixSocketSigner::connect(&path, "validator", Duration::from_secs(5)).unwrap();
+        assert!(UnixSocketSigner::connect(&path, "missing", Duration::from_secs(5)).is_err());
+        let local = Wallet::new().unwrap();
+        let participants = vec![
+            Participant::from_remote(&remote, 10),
+            Participant::from_remote(&local, 10),
+        ];
+        let mut party_tree =
+            MerkleTreeBuilder::with_hash(Hashing::new(HashAlgorithm::Keccak256, true));
+        party_tree.build(&participants).unwrap();
+        let params = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 15,
+            ..Default::default()
+        }
+        .bind(1, 7, Purpose::StateProof);
+
+        // Remote and local keys sign alike, each only for its own position
+        let ctx = Context::with_timeout(Duration::from_secs(5));
+        let mut builder = Builder::new(params.clone(), participants, party_tree.root()).unwrap();
+        assert!(builder.sign_with(&ctx, 1, &remote).is_err());
+
+        // Nothing is signed once the context has expired
+        let expired = Context::with_deadline(std::time::Instant::now());
+        assert!(builder.sign_with(&expired, 0, &remote).is_err());
+        assert!(builder.sign_with(&expired, 1, &local).is_err());
+
+        builder.sign_with(&ctx, 0, &remote).unwrap();
+        builder.sign_with(&ctx, 1, &local).unwrap();
+        let cert = builder.build().unwrap();
+        assert!(Verifier::new(party_tree.root())
+            .verify(&cert, &params)
+            .unwrap());
+        std::fs::remove_file(&path).unwrap();
+    }
+
+    #[test]
+    fn test_high_water_mark() {
+        let path = std::env::temp_dir().join(format!("niropok-marks-{}.json", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let daemon = || {
+            let mut daemon = SignerDaemon::new().with_marks(&path).unwrap();
+            daemon.add_key("validator", Box::new(Wallet::from_seed(&[7u8; 32])));
+            daemon.add_key("other", Box::new(Wallet::from_seed(&[8u8; 32])));
+            daemon
+        };
+        let sign = |daemon: &SignerDaemon, key: &str, params: &Params| match daemon.handle(
+            SignerRequest::Sign {
+                key: key.to_string(),
+                params: params.clone(),
+            },
+        ) {
+            SignerResponse::Signature(signature) => Ok(signature),
+            other => Err(unexpected(other)),
+        };
+        let block = |msg: &[u8], round| {
+            Params {
+                msg: msg.to_vec(),
+                proven_weight: 15,
+                ..Default::default()
+            }
+            .bind(1, round, Purpose::StateProof)
+        };
+
+        // Params must be bound to a chain, purpose and round, in a version
+        // that signs the binding
+        let signer = daemon();
+        let unbound = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 15,
+            ..Default::default()
+        };
+        assert!(sign(&signer, "validator", &unbound).is_err());
+        let mut no_round = block(b"block 7", 7);
+        no_round.round = None;
+        assert!(sign(&signer, "validator", &no_round).is_err());
+        let legacy = Params {
+            version: PARAMS_V1,
+            ..block(b"block 7", 7)
+        };
+        assert!(sign(&signer, "validator", &legacy).is_err());
+        assert!(signer.marks().is_empty());
+
+        // Signing raises the mark; the same request signs again, but not
+        // another message in the round or an older round
+        let signature = sign(&signer, "validator", &block(b"block 7", 7)).unwrap();
+        let wallet = Wallet::from_seed(&[7u8; 32]);
+        assert!(verify_signature(
+            Signer::scheme(&wallet),
+            &Signer::public_key(&wallet),
+            &block(b"block 7", 7).signing_message(),
+            &signature
+        )
+        .unwrap());
+        sign(&signer, "validator", &block(b"block 7", 7)).unwrap();
+        assert!(sign(&signer, "validator", &block(b"fork 7", 7)).is_err());
+        assert!(sign(&signer, "validator", &block(b"block 6", 6)).is_err());
+        sign(&signer, "validator", &block(b"block 9", 9)).unwrap();
+        assert!(sign(&signer, "validator", &block(b"block 8", 8)).is_err());
+
+        // Marks are per key, chain and purpose
+        sign(&signer, "other", &block(b"block 8", 8)).unwrap();
+        sign(
+            &signer,
+            "validator",
+            &block(b"block 8", 8).bind(2, 8, Purpose::StateProof),
+        )
+        .unwrap();
+        sign(
+            &signer,
+            "validator",
+            &block(b"block 8", 8).bind(1, 8, Purpose::Commit),
+        )
+        .unwrap();
+        assert_eq!(signer.marks().len(), 4);
+
+        // and survive a restart
+        let restarted = daemon();
+        assert_eq!(restarted.marks(), signer.marks());
+        assert!(sign(&restarted, "validator", &block(b"fork 9", 9)).is_err());
+        sign(&restarted, "validator", &block(b"block 10", 10)).unwrap();
+        std::fs::remove_file(&path).unwrap();
+    }
+}
@@ -0,0 +1,460 @@
+//! JSON-RPC 2.0 interface of a node. External tools and wallets submit
+//! signature shares to the certificate being collected, build and verify
+//! certificates, and read blocks and state proofs. `RpcServer::handle` takes
+//! the raw request body, single or batched, and returns the response body;
+//! `networking::start_json_rpc_server` serves it over HTTP through
+//! `handle_from`, which rate limits submissions by the client address. Byte fields are
+//! hex strings and certificates use their JSON export (`json.rs`).
+use crate::block::Block;
+use crate::blockchain::Blockchain;
+use crate::ccok::{Certificate, Params, Verifier};
+use crate::collector::{SignatureCollector, SubmissionPolicy};
+use crate::gossip::SignatureShare;
+use crate::json::CertificateJson;
+use crate::stateproof::StateProof;
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::sync::{Arc, Mutex};
+
+pub const JSONRPC_VERSION: &str = "2.0";
+
+/// Invalid JSON
+pub const PARSE_ERROR: i64 = -32700;
+/// JSON that is not a request
+pub const INVALID_REQUEST: i64 = -32600;
+pub const METHOD_NOT_FOUND: i64 = -32601;
+pub const INVALID_PARAMS: i64 = -32602;
+/// The method failed
+pub const SERVER_ERROR: i64 = -32000;
+
+/// Request of a client; without an id it is a notification and gets no
+/// response
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RpcRequest {
+    pub jsonrpc: String,
+    pub method: String,
+    #[serde(default)]
+    pub params: Value,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<Value>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RpcError {
+    pub code: i64,
+    pub message: String,
+}
+
+impl RpcError {
+    fn new(code: i64, message: impl Into<String>) -> Self {
+        Self {
+            code,
+            message: message.into(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RpcResponse {
+    pub jsonrpc: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub result: Option<Value>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<RpcError>,
+    pub id: Value,
+}
+
+impl RpcResponse {
+    fn new(id: Value, outcome: Result<Value, RpcError>) -> Self {
+        let (result, error) = match outcome {
+            Ok(result) => (Some(result), None),
+            Err(error) => (None, Some(error)),
+        };
+        Self {
+            jsonrpc: JSONRPC_VERSION.to_string(),
+            result,
+            error,
+            id,
+        }
+    }
+}
+
+/// Blocks and state proofs served by the node
+pub trait ChainView {
+    /// Block at `height`
+    fn block(&self, height: u64) -> Option<Block>;
+
+    /// State proof of the interval holding block `height`
+    fn state_proof(&self, height: u64) -> Option<StateProof>;
+}
+
+impl ChainView for Blockchain {
+    fn block(&self, height: u64) -> Option<Block> {
+        self.chain
+            .iter()
+            .find(|block| block.id as u64 == height)
+            .cloned()
+    }
+
+    fn state_proof(&self, height: u64) -> Option<StateProof> {
+        self.state_proofs
+            .iter()
+            .find(|proof| (proof.message.first_block..=proof.message.last_block).contains(&height))
+            .cloned()
+    }
+}
+
+#[derive(Deserialize)]
+struct SubmitSignatureParams {
+    position: usize,
+    /// Certificate message signed, in hex
+    msg: String,
+    signature: String,
+}
+
+#[derive(Deserialize)]
+struct VerifyCertParams {
+    certificate: CertificateJson,
+    params: Params,
+    /// Party tree root in hex
+    party_tree_root: String,
+}
+
+#[derive(Deserialize)]
+struct HeightParams {
+    height: u64,
+}
+
+/// JSON-RPC methods of a node over its chain and the certificate it collects
+pub struct RpcServer<C: ChainView> {
+    chain: Arc<Mutex<C>>,
+    collector: Option<SignatureCollector>,
+    policy: Option<SubmissionPolicy>,
+}
+
+impl<C: ChainView> RpcServer<C> {
+    pub fn new(chain: Arc<Mutex<C>>) -> Self {
+        Self {
+            chain,
+            collector: None,
+            policy: None,
+        }
+    }
+
+    /// Take submissions to every collection under `policy`, instead of the
+    /// policy of each collector
+    pub fn with_policy(mut self, policy: SubmissionPolicy) -> Self {
+        self.policy = Some(policy);
+        self
+    }
+
+    /// Collect the signatures submitted into `collector`, replacing the
+    /// previous collection
+    pub fn collect(&mut self, collector: SignatureCollector) {
+        self.collector = Some(match self.policy {
+            Some(policy) => collector.with_policy(policy),
+            None => collector,
+        });
+    }
+
+    /// Response body to the request body `body`. Submissions are rate
+    /// limited by the participant they are for.
+    pub fn handle(&mut self, body: &str) -> Option<String> {
+        self.respond(None, body)
+    }
+
+    /// Response body to the request body `body` that `peer` sent; its
+    /// submissions are rate limited together
+    pub fn handle_from(&mut self, peer: &str, body: &str) -> Option<String> {
+        self.respond(Some(peer), body)
+    }
+
+    fn respond(&mut self, peer: Option<&str>, body: &str) -> Option<String> {
+        let value: Value = match serde_json::from_str(body) {
+            Ok(value) => value,
+            Err(e) => {
+                let error = RpcError::new(PARSE_ERROR, e.to_string());
+                return Some(json!(RpcResponse::new(Value::Null, Err(error))).to_string());
+            }
+        };
+        let response = match value {
+            Value::Array(batch) if !batch.is_empty() => {
+                let responses: Vec<RpcResponse> = batch
+                    .into_iter()
+                    .filter_map(|r| self.call_from(peer, r))
+                    .collect();
+                if responses.is_empty() {
+                    return None;
+                }
+                json!(responses)
+            }
+            request => json!(self.call_from(peer, request)?),
+        };
+        Some(response.to_string())
+    }
+
+    /// Response to one request, `None` for notifications
+    pub fn call(&mut self, request: Value) -> Option<RpcResponse> {
+        self.call_from(None, request)
+    }
+
+    fn call_from(&mut self, peer: Option<&str>, request: Value) -> Option<RpcResponse> {
+        let request: RpcRequest = match serde_json::from_value(request) {
+            Ok(request) => request,
+            Err(e) => {
+                let error = RpcError::new(INVALID_REQUEST, e.to_string());
+                return Some(RpcResponse::new(Value::Null, Err(error)));
+            }
+        };
+        let outcome = if request.jsonrpc != JSONRPC_VERSION {
+            Err(RpcError::new(
+                INVALID_REQUEST,
+                "Unsupported JSON-RPC version",
+            ))
+        } else {
+            self.dispatch(peer, &request.method, request.params)
+        };
+        request.id.map(|id| RpcResponse::new(id, outcome))
+    }
+
+    fn dispatch(
+        &mut self,
+        peer: Option<&str>,
+        method: &str,
+        params: Value,
+    ) -> Result<Value, RpcError> {
+        match method {
+            "cc_submitSignature" => self.submit_signature(peer, parse(params)?),
+            "cc_buildCert" => self.build_cert(),
+            "cc_verifyCert" => verify_cert(parse(params)?),
+            "chain_getBlock" => {
+                let HeightParams { height } = parse(params)?;
+                let block = self.chain.lock().unwrap().block(height);
+                Ok(json!(block))
+            }
+            "chain_getStateProof" => {
+                let HeightParams { height } = parse(params)?;
+                let proof = self.chain.lock().unwrap().state_proof(height);
+                Ok(proof.map_or(Value::Null, |proof| state_proof_json(&proof)))
+            }
+            _ => Err(RpcError::new(
+                METHOD_NOT_FOUND,
+                format!("Unknown method {}", method),
+            )),
+        }
+    }
+
+    fn collector(&mut self) -> Result<&mut SignatureCollector, RpcError> {
+        self.collector
+            .as_mut()
+            .ok_or_else(|| RpcError::new(SERVER_ERROR, "No certificate is being collected"))
+    }
+
+    fn submit_signature(
+        &mut self,
+        peer: Option<&str>,
+        params: SubmitSignatureParams,
+    ) -> Result<Value, RpcError> {
+        let collector = self.collector()?;
+        // Oversized signatures aren't even decoded
+        let max_signature_size = collector.policy().max_signature_size;
+        if params.signature.len() > 2 * max_signature_size {
+            return Err(RpcError::new(
+                INVALID_PARAMS,
+                format!("Signature exceeds {} bytes", max_signature_size),
+            ));
+        }
+        let share = SignatureShare {
+            msg: parse_hex(&params.msg)?,
+            position: params.position,
+            signature: parse_hex(&params.signature)?,
+        };
+        // The signature authenticates the share, so it counts as sent by the
+        // participant at its position
+        let sender = collector
+            .builder()
+            .participants
+            .get(share.position)
+            .map(|party| party.public_key.clone())
+            .ok_or_else(|| {
+                RpcError::new(
+                    INVALID_PARAMS,
+                    format!("No participant at position {}", share.position),
+                )
+            })?;
+        let added = collector
+            .add_share_from(peer.unwrap_or(&sender), &sender, &share)
+            .map_err(|e| RpcError::new(SERVER_ERROR, e))?;
+        Ok(json!({
+            "added": added,
+            "signed_weight": collector.builder().signed_weight.to_string(),
+            "ready": collector.is_ready(),
+        }))
+    }
+
+    fn build_cert(&mut self) -> Result<Value, RpcError> {
+        let cert = self
+            .collector()?
+            .build()
+            .map_err(|e| RpcError::new(SERVER_ERROR, e))?;
+        Ok(json!(CertificateJson::from(&cert)))
+    }
+}
+
+fn verify_cert(params: VerifyCertParams) -> Result<Value, RpcError> {
+    let cert =
+        Certificate::try_from(params.certificate).map_err(|e| RpcError::new(INVALID_PARAMS, e))?;
+    let root = parse_hex(&params.party_tree_root)?;
+    let valid = Verifier::new(root)
+        .verify(&cert, &params.params)
+        .map_err(|e| RpcError::new(SERVER_ERROR, e.to_string()))?;
+    Ok(json!(valid))
+}
+
+fn state_proof_json(proof: &StateProof) -> Value {
+    let message = &proof.message;
+    json!({
+        "message": {
+            "first_block": message.first_block,
+            "last_block": message.last_block,
+            "block_headers_commitment": hex::encode(&message.block_headers_commitment),
+            "voters_commitment": hex::encode(&message.voters_commitment),
+        },
+        "certificate": CertificateJson::from(&proof.certificate),
+    })
+}
+
+fn parse<T: DeserializeOwned>(params: Value) -> Result<T, RpcError> {
+    serde_json::from_value(params).map_err(|e| RpcError::new(INVALID_PARAMS, e.to_string()))
+}
+
+fn parse_hex(value: &str) -> Result<Vec<u8>, RpcError> {
+    hex::decode(value).map_err(|e| RpcError::new(INVALID_PARAMS, format!("Invalid hex: {}", e)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, Participant};
+    use crate::collector::RateLimit;
+    use crate::merkle::{HashAlgorithm, Hashing, MerkleTreeBuilder};
+    use crate::wallet::Wallet;
+    use std::time::Duration;
+
+    #[test]
+    fn test_rpc_server() {
+        let wallets: Vec<Wallet> = (0..2)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let mut party_tree =
+            MerkleTreeBuilder::with_hash(Hashing::new(HashAlgorithm::Keccak256, true));
+        party_tree.build(&participants).unwrap();
+        let params = Params {
+            msg: b"block 7".to_vec(),
+            proven_weight: 15,
+            ..Default::default()
+        };
+        let chain = Arc::new(Mutex::new(Blockchain::new(
+            Wallet::new().expect("Failed to create wallet"),
+        )));
+        let mut server = RpcServer::new(chain);
+        let mut call = |method: &str, params: Value| -> RpcResponse {
+            let request = json!({"jsonrpc": "2.0", "method": method, "params": params, "id": 1});
+            serde_json::from_str(&server.handle(&request.to_string()).unwrap()).unwrap()
+        };
+
+        // Nothing is collected yet and unknown methods fail
+        assert!(call("cc_buildCert", Value::Null).error.is_some());
+        let unknown = call("cc_unknown", Value::Null);
+        assert_eq!(unknown.error.unwrap().code, METHOD_NOT_FOUND);
+        // Missing blocks are a null result
+        let missing = call("chain_getBlock", json!({"height": 5}));
+        assert!(missing.result.is_none() && missing.error.is_none());
+        assert_eq!(
+            call("chain_getBlock", json!({})).error.unwrap().code,
+            INVALID_PARAMS
+        );
+        drop(call);
+
+        server.collect(SignatureCollector::new(
+            Builder::new(params.clone(), participants.clone(), party_tree.root()).unwrap(),
+        ));
+        let mut call = |method: &str, params: Value| -> RpcResponse {
+            let request = json!({"jsonrpc": "2.0", "method": method, "params": params, "id": 1});
+            serde_json::from_str(&server.handle(&request.to_string()).unwrap()).unwrap()
+        };
+        for (position, wallet) in wallets.iter().enumerate() {
+            let signature = wallet.sign_message(&params.signing_message());
+            let submitted = call(
+                "cc_submitSignature",
+                json!({
+                    "position": position,
+                    "msg": hex::encode(&params.msg),
+                    "signature": hex::encode(signature),
+                }),
+            );
+            assert_eq!(submitted.result.unwrap()["added"], json!(true));
+        }
+        let cert = call("cc_buildCert", Value::Null).result.unwrap();
+        let verified = call(
+            "cc_verifyCert",
+            json!({
+                "certificate": cert,
+                "params": params,
+                "party_tree_root": hex::encode(party_tree.root()),
+            }),
+        );
+        assert_eq!(verified.result, Some(json!(true)));
+
+        // Notifications get no response, batches one per request
+        let notification = json!({"jsonrpc": "2.0", "method": "cc_buildCert"});
+        assert!(server.handle(&notification.to_string()).is_none());
+        let batch = json!([
+            notification,
+            {"jsonrpc": "2.0", "method": "chain_getStateProof", "params": {"height": 1}, "id": "a"},
+        ]);
+        let responses: Vec<RpcResponse> =
+            serde_json::from_str(&server.handle(&batch.to_string()).unwrap()).unwrap();
+        assert_eq!(responses.len(), 1);
+        assert_eq!(responses[0].id, json!("a"));
+        let invalid: RpcResponse = serde_json::from_str(&server.handle("{").unwrap()).unwrap();
+        assert_eq!(invalid.error.unwrap().code, PARSE_ERROR);
+
+        // Under the server's policy a client is limited across positions, and
+        // oversized signatures are refused before decoding
+        let mut server = server.with_policy(SubmissionPolicy {
+            rate_limit: RateLimit {
+                max_messages: 1,
+                window: Duration::from_secs(3600),
+            },
+            max_signature_size: 64,
+        });
+        server.collect(SignatureCollector::new(
+            Builder::new(params.clone(), participants, party_tree.root()).unwrap(),
+        ));
+        let mut submit = |position: usize, signature: String| -> RpcError {
+            let request = json!({
+                "jsonrpc": "2.0",
+                "method": "cc_submitSignature",
+                "params": {"position": position, "msg": hex::encode(&params.msg), "signature": signature},
+                "id": 1,
+            });
+            let response = server
+                .handle_from("10.0.0.9", &request.to_string())
+                .unwrap();
+            serde_json::from_str::<RpcResponse>(&response)
+                .unwrap()
+                .error
+                .unwrap()
+        };
+        let oversized = submit(0, "00".repeat(65));
+        assert_eq!(oversized.code, INVALID_PARAMS);
+        assert!(submit(0, "00".repeat(64)).message.contains("length"));
+        assert!(submit(1, "00".repeat(64)).message.contains("rate limited"));
+    }
+}
@@ -0,0 +1,230 @@
+use crate::signer::SignatureScheme;
+use once_cell::sync::Lazy;
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Keccak256};
+use std::collections::HashMap;
+use std::sync::RwLock;
+
+/// Verification routine of a registered scheme: (public key, message, signature)
+pub type VerifyFn = fn(&[u8], &[u8], &[u8]) -> Result<bool, String>;
+
+/// Abstract identifier of a signature scheme, committed in participant leaves
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord, Serialize, Deserialize)]
+pub struct SchemeId(pub u16);
+
+impl Default for SchemeId {
+    fn default() -> Self {
+        SignatureScheme::Dilithium2.id()
+    }
+}
+
+impl From<SignatureScheme> for SchemeId {
+    fn from(scheme: SignatureScheme) -> Self {
+        scheme.id()
+    }
+}
+
+/// Registry entry describing a signature scheme
+#[derive(Debug, Clone)]
+pub struct SchemeInfo {
+    /// Identifier committed in participant leaves
+    pub id: SchemeId,
+    /// Human readable scheme name
+    pub name: String,
+    /// Verification routine
+    pub verify: VerifyFn,
+    /// Public key length in bytes
+    pub pk_size: usize,
+    /// Signature length in bytes (an upper bound when `fixed_sig_size` is false)
+    pub sig_size: usize,
+    /// Whether every signature is exactly `sig_size` bytes
+    pub fixed_sig_size: bool,
+}
+
+impl SchemeInfo {
+    /// Check a signature length is acceptable for this scheme
+    pub fn check_signature_len(&self, len: usize) -> Result<(), String> {
+        let valid = if self.fixed_sig_size {
+            len == self.sig_size
+        } else {
+            len > 0 && len <= self.sig_size
+        };
+        if !valid {
+            return Err(format!(
+                "Invalid signature length for {}: {}",
+                self.name, len
+            ));
+        }
+        Ok(())
+    }
+
+    /// Check a public key length is acceptable for this scheme
+    pub fn check_public_key_len(&self, len: usize) -> Result<(), String> {
+        if len != self.pk_size {
+            return Err(format!(
+                "Invalid public key length for {}: {}",
+                self.name, len
+            ));
+        }
+        Ok(())
+    }
+
+    /// Verify a signature with this scheme, after checking the key and
+    /// signature lengths
+    pub fn verify_signature(
+        &self,
+        public_key: &[u8],
+        msg: &[u8],
+        signature: &[u8],
+    ) -> Result<bool, String> {
+        self.check_public_key_len(public_key.len())?;
+        self.check_signature_len(signature.len())?;
+        (self.verify)(public_key, msg, signature)
+    }
+}
+
+static REGISTRY: Lazy<RwLock<HashMap<SchemeId, SchemeInfo>>> = Lazy::new(|| {
+    let registry = SignatureScheme::ALL
+        .iter()
+        .map(|scheme| (scheme.id(), scheme.info()))
+        .collect();
+    RwLock::new(registry)
+});
+
+/// High bit of every custom scheme identifier, which no built-in scheme has
+pub const CUSTOM_SCHEME_BIT: u16 = 0x8000;
+
+/// Derive the identifier of a custom scheme from its name. Custom identifiers
+/// have the high bit set so they never collide with the built-in schemes. The
+/// other 15 bits hash the name, so two names collide with odds of 1 in 32768;
+/// schemes whose derived ids clash register with `register_scheme_with_id`.
+pub fn scheme_id_for(name: &str) -> SchemeId {
+    let hash = Keccak256::digest(name.as_bytes());
+    SchemeId(u16::from_le_bytes([hash[0], hash[1]]) | CUSTOM_SCHEME_BIT)
+}
+
+/// Register a custom fixed-size signature scheme; the identifier is derived
+/// from `name` so that every node registering the same scheme agrees on it.
+pub fn register_scheme(
+    name: &str,
+    verify: VerifyFn,
+    pk_size: usize,
+    sig_size: usize,
+) -> Result<SchemeId, String> {
+    register_scheme_with_id(scheme_id_for(name), name, verify, pk_size, sig_size)
+}
+
+/// Register a custom fixed-size signature scheme under an explicit `id`,
+/// which must have `CUSTOM_SCHEME_BIT` set. Fails if the id or the name is
+/// already registered.
+pub fn register_scheme_with_id(
+    id: SchemeId,
+    name: &str,
+    verify: VerifyFn,
+    pk_size: usize,
+    sig_size: usize,
+) -> Result<SchemeId, String> {
+    if id.0 & CUSTOM_SCHEME_BIT == 0 {
+        return Err(format!(
+            "Custom scheme id {:?} for {} lacks the custom bit",
+            id, name
+        ));
+    }
+    let mut registry = REGISTRY.write().map_err(|_| "Scheme registry poisoned")?;
+    if let Some(existing) = registry.get(&id) {
+        return Err(format!(
+            "Scheme id {:?} for {} already registered as {}",
+            id, name, existing.name
+        ));
+    }
+    if let Some(existing) = registry.values().find(|info| info.name == name) {
+        return Err(format!(
+            "Scheme {} already registered with id {:?}",
+            name, existing.id
+        ));
+    }
+    registry.insert(
+        id,
+        SchemeInfo {
+            id,
+            name: name.to_string(),
+            verify,
+            pk_size,
+            sig_size,
+            fixed_sig_size: true,
+        },
+    );
+    Ok(id)
+}
+
+/// Look up a registered scheme
+pub fn lookup_scheme(id: SchemeId) -> Result<SchemeInfo, String> {
+    let registry = REGISTRY.read().map_err(|_| "Scheme registry poisoned")?;
+    registry
+        .get(&id)
+        .cloned()
+        .ok_or_else(|| format!("Unknown signature scheme {:?}", id))
+}
+
+/// Verify a signature by dispatching through the registry
+pub fn verify_signature(
+    id: SchemeId,
+    public_key: &[u8],
+    msg: &[u8],
+    signature: &[u8],
+) -> Result<bool, String> {
+    lookup_scheme(id)?.verify_signature(public_key, msg, signature)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Toy scheme: the signature is the Keccak256 hash of public key and message
+    fn toy_verify(public_key: &[u8], msg: &[u8], signature: &[u8]) -> Result<bool, String> {
+        let mut hasher = Keccak256::new();
+        hasher.update(public_key);
+        hasher.update(msg);
+        Ok(hasher.finalize().as_slice() == signature)
+    }
+
+    #[test]
+    fn test_builtin_schemes_registered() {
+        for scheme in SignatureScheme::ALL {
+            let info = lookup_scheme(scheme.id()).expect("Built-in scheme missing");
+            assert_eq!(info.pk_size, scheme.public_key_len());
+            assert_eq!(info.sig_size, scheme.signature_len());
+        }
+    }
+
+    #[test]
+    fn test_register_custom_scheme() {
+        let id = register_scheme("toy-keccak", toy_verify, 32, 32).expect("Failed to register");
+        assert_eq!(id, scheme_id_for("toy-keccak"));
+        assert!(register_scheme("toy-keccak", toy_verify, 32, 32).is_err());
+
+        let pk = [7u8; 32];
+        let mut hasher = Keccak256::new();
+        hasher.update(pk);
+        hasher.update(b"Test message");
+        let sig = hasher.finalize().to_vec();
+
+        assert!(verify_signature(id, &pk, b"Test message", &sig).unwrap());
+        assert!(!verify_signature(id, &pk, b"Other message", &sig).unwrap());
+        assert!(verify_signature(id, &pk[..31], b"Test message", &sig).is_err());
+        assert!(lookup_scheme(scheme_id_for("unregistered")).is_err());
+
+        // Schemes of clashing derived ids register with explicit ones
+        assert!(register_scheme_with_id(id, "toy-keccak-2", toy_verify, 32, 32).is_err());
+        assert!(register_scheme_with_id(SchemeId(1), "toy-keccak-2", toy_verify, 32, 32).is_err());
+        let explicit = SchemeId(id.0 ^ 1);
+        assert_eq!(
+            register_scheme_with_id(explicit, "toy-keccak-2", toy_verify, 32, 32),
+            Ok(explicit)
+        );
+        assert!(verify_signature(explicit, &pk, b"Test message", &sig).unwrap());
+        assert!(
+            register_scheme_with_id(SchemeId(id.0 ^ 2), "toy-keccak", toy_verify, 32, 32).is_err()
+        );
+    }
+}
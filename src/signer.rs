@@ -0,0 +1,1018 @@
+use crate::ccok::Params;
+use crate::hybrid::{HybridSig, SignatureMode};
+use crate::scheme::{SchemeId, SchemeInfo, VerifyFn};
+use crystals_dilithium::{dilithium2, dilithium3};
+use k256::schnorr;
+use k256::schnorr::signature::{Signer as _, Verifier as _};
+use pqcrypto_falcon::{falcon1024, falcon512};
+use pqcrypto_mldsa::mldsa65;
+use pqcrypto_sphincsplus::{sphincssha2128fsimple, sphincssha2128ssimple};
+use pqcrypto_traits::sign::{DetachedSignature as _, PublicKey as _, SecretKey as _};
+use rand::Rng;
+use serde::{Deserialize, Serialize};
+use std::sync::atomic::{compiler_fence, Ordering};
+
+/// Built-in signature schemes a certificate participant can sign with. Each one
+/// is pre-registered in the scheme registry under its `id()`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum SignatureScheme {
+    /// CRYSTALS-Dilithium2, the scheme used by node wallets
+    Dilithium2,
+    /// CRYSTALS-Dilithium3, the round-3 scheme rather than the FIPS 204
+    /// ML-DSA-65 standard, whose signatures differ
+    Dilithium3,
+    /// Falcon-512, compact lattice signatures
+    Falcon512,
+    /// Falcon-1024
+    Falcon1024,
+    /// SPHINCS+-SHA2-128s-simple, stateless hash-based signatures (small variant)
+    SphincsSha2128s,
+    /// SPHINCS+-SHA2-128f-simple (fast variant)
+    SphincsSha2128f,
+    /// BIP-340 Schnorr over secp256k1, classical only
+    Schnorr,
+    /// Dilithium3 and Schnorr keys signing together; a signature holds both
+    /// and verifies only if both do
+    Dilithium3Schnorr,
+    /// ML-DSA-65, the FIPS 204 standard of the Dilithium3 parameter set
+    MlDsa65,
+}
+
+impl SignatureScheme {
+    /// Every built-in scheme
+    pub const ALL: [SignatureScheme; 9] = [
+        SignatureScheme::Dilithium2,
+        SignatureScheme::Dilithium3,
+        SignatureScheme::Falcon512,
+        SignatureScheme::Falcon1024,
+        SignatureScheme::SphincsSha2128s,
+        SignatureScheme::SphincsSha2128f,
+        SignatureScheme::Schnorr,
+        SignatureScheme::Dilithium3Schnorr,
+        SignatureScheme::MlDsa65,
+    ];
+
+    /// Registry identifier of the scheme
+    pub fn id(&self) -> SchemeId {
+        match self {
+            SignatureScheme::Dilithium2 => SchemeId(1),
+            SignatureScheme::Dilithium3 => SchemeId(2),
+            SignatureScheme::Falcon512 => SchemeId(3),
+            SignatureScheme::Falcon1024 => SchemeId(4),
+            SignatureScheme::SphincsSha2128s => SchemeId(5),
+            SignatureScheme::SphincsSha2128f => SchemeId(6),
+            SignatureScheme::Schnorr => SchemeId(7),
+            SignatureScheme::Dilithium3Schnorr => SchemeId(8),
+            SignatureScheme::MlDsa65 => SchemeId(9),
+        }
+    }
+
+    /// Whether forging a signature takes more than a quantum computer
+    pub fn is_post_quantum(&self) -> bool {
+        *self != SignatureScheme::Schnorr
+    }
+
+    /// Built-in scheme with the given registry identifier
+    pub fn from_id(id: SchemeId) -> Option<Self> {
+        SignatureScheme::ALL.into_iter().find(|s| s.id() == id)
+    }
+
+    /// Built-in scheme with the given registry name
+    pub fn from_name(name: &str) -> Option<Self> {
+        SignatureScheme::ALL.into_iter().find(|s| s.name() == name)
+    }
+
+    /// Registry name of the scheme
+    pub fn name(&self) -> &'static str {
+        match self {
+            SignatureScheme::Dilithium2 => "dilithium2",
+            SignatureScheme::Dilithium3 => "dilithium3",
+            SignatureScheme::Falcon512 => "falcon512",
+            SignatureScheme::Falcon1024 => "falcon1024",
+            SignatureScheme::SphincsSha2128s => "sphincs-sha2-128s",
+            SignatureScheme::SphincsSha2128f => "sphincs-sha2-128f",
+            SignatureScheme::Schnorr => "schnorr-secp256k1",
+            SignatureScheme::Dilithium3Schnorr => "dilithium3-schnorr",
+            SignatureScheme::MlDsa65 => "ml-dsa-65",
+        }
+    }
+
+    /// Registry entry for the scheme
+    pub fn info(&self) -> SchemeInfo {
+        let verify: VerifyFn = match self {
+            SignatureScheme::Dilithium2 => {
+                |pk, msg, sig| SignatureScheme::Dilithium2.verify(pk, msg, sig)
+            }
+            SignatureScheme::Dilithium3 => {
+                |pk, msg, sig| SignatureScheme::Dilithium3.verify(pk, msg, sig)
+            }
+            SignatureScheme::Falcon512 => {
+                |pk, msg, sig| SignatureScheme::Falcon512.verify(pk, msg, sig)
+            }
+            SignatureScheme::Falcon1024 => {
+                |pk, msg, sig| SignatureScheme::Falcon1024.verify(pk, msg, sig)
+            }
+            SignatureScheme::SphincsSha2128s => {
+                |pk, msg, sig| SignatureScheme::SphincsSha2128s.verify(pk, msg, sig)
+            }
+            SignatureScheme::SphincsSha2128f => {
+                |pk, msg, sig| SignatureScheme::SphincsSha2128f.verify(pk, msg, sig)
+            }
+            SignatureScheme::Schnorr => {
+                |pk, msg, sig| SignatureScheme::Schnorr.verify(pk, msg, sig)
+            }
+            SignatureScheme::Dilithium3Schnorr => {
+                |pk, msg, sig| SignatureScheme::Dilithium3Schnorr.verify(pk, msg, sig)
+            }
+            SignatureScheme::MlDsa65 => {
+                |pk, msg, sig| SignatureScheme::MlDsa65.verify(pk, msg, sig)
+            }
+        };
+        SchemeInfo {
+            id: self.id(),
+            name: self.name().to_string(),
+            verify,
+            pk_size: self.public_key_len(),
+            sig_size: self.signature_len(),
+            fixed_sig_size: !matches!(
+                self,
+                SignatureScheme::Falcon512 | SignatureScheme::Falcon1024
+            ),
+        }
+    }
+
+    /// Length in bytes of a public key for this scheme
+    pub fn public_key_len(&self) -> usize {
+        match self {
+            SignatureScheme::Dilithium2 => dilithium2::PUBLICKEYBYTES,
+            SignatureScheme::Dilithium3 => dilithium3::PUBLICKEYBYTES,
+            SignatureScheme::Falcon512 => falcon512::public_key_bytes(),
+            SignatureScheme::Falcon1024 => falcon1024::public_key_bytes(),
+            SignatureScheme::SphincsSha2128s => sphincssha2128ssimple::public_key_bytes(),
+            SignatureScheme::SphincsSha2128f => sphincssha2128fsimple::public_key_bytes(),
+            SignatureScheme::Schnorr => SCHNORR_PUBLIC_KEY_BYTES,
+            SignatureScheme::Dilithium3Schnorr => {
+                dilithium3::PUBLICKEYBYTES + SCHNORR_PUBLIC_KEY_BYTES
+            }
+            SignatureScheme::MlDsa65 => mldsa65::public_key_bytes(),
+        }
+    }
+
+    /// Length in bytes of a signature for this scheme (an upper bound for Falcon,
+    /// whose signatures are variable-length)
+    pub fn signature_len(&self) -> usize {
+        match self {
+            SignatureScheme::Dilithium2 => dilithium2::SIGNBYTES,
+            SignatureScheme::Dilithium3 => dilithium3::SIGNBYTES,
+            SignatureScheme::Falcon512 => falcon512::signature_bytes(),
+            SignatureScheme::Falcon1024 => falcon1024::signature_bytes(),
+            SignatureScheme::SphincsSha2128s => sphincssha2128ssimple::signature_bytes(),
+            SignatureScheme::SphincsSha2128f => sphincssha2128fsimple::signature_bytes(),
+            SignatureScheme::Schnorr => SCHNORR_SIGNATURE_BYTES,
+            SignatureScheme::Dilithium3Schnorr => dilithium3::SIGNBYTES + SCHNORR_SIGNATURE_BYTES,
+            SignatureScheme::MlDsa65 => mldsa65::signature_bytes(),
+        }
+    }
+
+    /// Verify `signature` over `msg` against a raw public key. Callers normally go
+    /// through `scheme::verify_signature`, which also checks the signature length.
+    pub fn verify(&self, public_key: &[u8], msg: &[u8], signature: &[u8]) -> Result<bool, String> {
+        if public_key.len() != self.public_key_len() {
+            return Err(format!(
+                "Invalid public key length for {:?}: {}",
+                self,
+                public_key.len()
+            ));
+        }
+
+        match self {
+            SignatureScheme::Dilithium2 => {
+                let sig: dilithium2::Signature = signature
+                    .try_into()
+                    .map_err(|_| "Invalid signature length")?;
+                Ok(dilithium2::PublicKey::from_bytes(public_key).verify(msg, &sig))
+            }
+            SignatureScheme::Dilithium3 => {
+                let sig: dilithium3::Signature = signature
+                    .try_into()
+                    .map_err(|_| "Invalid signature length")?;
+                Ok(dilithium3::PublicKey::from_bytes(public_key).verify(msg, &sig))
+            }
+            SignatureScheme::Falcon512 => {
+                let pk = falcon512::PublicKey::from_bytes(public_key)
+                    .map_err(|e| format!("Invalid Falcon public key: {}", e))?;
+                let sig = falcon512::DetachedSignature::from_bytes(signature)
+                    .map_err(|e| format!("Invalid Falcon signature: {}", e))?;
+                Ok(falcon512::verify_detached_signature(&sig, msg, &pk).is_ok())
+            }
+            SignatureScheme::Falcon1024 => {
+                let pk = falcon1024::PublicKey::from_bytes(public_key)
+                    .map_err(|e| format!("Invalid Falcon public key: {}", e))?;
+                let sig = falcon1024::DetachedSignature::from_bytes(signature)
+                    .map_err(|e| format!("Invalid Falcon signature: {}", e))?;
+                Ok(falcon1024::verify_detached_signature(&sig, msg, &pk).is_ok())
+            }
+            SignatureScheme::SphincsSha2128s => {
+                let pk = sphincssha2128ssimple::PublicKey::from_bytes(public_key)
+                    .map_err(|e| format!("Invalid SPHINCS+ public key: {}", e))?;
+                let sig = sphincssha2128ssimple::DetachedSignature::from_bytes(signature)
+                    .map_err(|e| format!("Invalid SPHINCS+ signature: {}", e))?;
+                Ok(sphincssha2128ssimple::verify_detached_signature(&sig, msg, &pk).is_ok())
+            }
+            SignatureScheme::SphincsSha2128f => {
+                let pk = sphincssha2128fsimple::PublicKey::from_bytes(public_key)
+                    .map_err(|e| format!("Invalid SPHINCS+ public key: {}", e))?;
+                let sig = sphincssha2128fsimple::DetachedSignature::from_bytes(signature)
+                    .map_err(|e| format!("Invalid SPHINCS+ signature: {}", e))?;
+                Ok(sphincssha2128fsimple::verify_detached_signature(&sig, msg, &pk).is_ok())
+            }
+            SignatureScheme::Schnorr => {
+                let pk = schnorr::VerifyingKey::from_bytes(public_key)
+                    .map_err(|e| format!("Invalid Schnorr public key: {}", e))?;
+                let sig = schnorr::Signature::try_from(signature)
+                    .map_err(|e| format!("Invalid Schnorr signature: {}", e))?;
+                Ok(pk.verify(msg, &sig).is_ok())
+            }
+            SignatureScheme::Dilithium3Schnorr => {
+                let (pq_key, classical_key) = public_key.split_at(dilithium3::PUBLICKEYBYTES);
+                let sig = HybridSig::from_bytes(signature)?;
+                if sig.post_quantum.is_empty() || sig.classical.is_empty() {
+                    return Err("Hybrid signature lacks a half".to_string());
+                }
+                let pq = SignatureScheme::Dilithium3.verify(pq_key, msg, &sig.post_quantum)?;
+                let classical =
+                    SignatureScheme::Schnorr.verify(classical_key, msg, &sig.classical)?;
+                Ok(pq && classical)
+            }
+            SignatureScheme::MlDsa65 => {
+                let pk = mldsa65::PublicKey::from_bytes(public_key)
+                    .map_err(|e| format!("Invalid ML-DSA public key: {}", e))?;
+                let sig = mldsa65::DetachedSignature::from_bytes(signature)
+                    .map_err(|e| format!("Invalid ML-DSA signature: {}", e))?;
+                Ok(mldsa65::verify_detached_signature(&sig, msg, &pk).is_ok())
+            }
+        }
+    }
+}
+
+/// Length in bytes of an x-only BIP-340 public key
+pub const SCHNORR_PUBLIC_KEY_BYTES: usize = 32;
+
+/// Length in bytes of a BIP-340 signature
+pub const SCHNORR_SIGNATURE_BYTES: usize = 64;
+
+/// Generate a fresh signer for any supported scheme
+pub fn generate_signer(scheme: SignatureScheme) -> Result<Box<dyn Signer>, String> {
+    match scheme {
+        SignatureScheme::Dilithium2 => Ok(Box::new(crate::wallet::Wallet::new()?)),
+        SignatureScheme::Dilithium3 => Ok(Box::new(DilithiumSigner::new()?)),
+        SignatureScheme::Falcon512 | SignatureScheme::Falcon1024 => {
+            Ok(Box::new(FalconSigner::with_scheme(scheme)?))
+        }
+        SignatureScheme::SphincsSha2128s | SignatureScheme::SphincsSha2128f => {
+            Ok(Box::new(SphincsPlusSigner::with_scheme(scheme)?))
+        }
+        SignatureScheme::Schnorr => Ok(Box::new(SchnorrSigner::new()?)),
+        SignatureScheme::Dilithium3Schnorr => Ok(Box::new(HybridSigner::new()?)),
+        SignatureScheme::MlDsa65 => Ok(Box::new(MlDsaSigner::new()?)),
+    }
+}
+
+/// Common interface for signing on behalf of a certificate participant
+pub trait Signer {
+    /// Registry identifier of the scheme produced signatures belong to
+    fn scheme(&self) -> SchemeId;
+
+    /// Raw public key bytes
+    fn public_key(&self) -> Vec<u8>;
+
+    /// Sign a message, returning the raw signature bytes
+    fn sign(&self, msg: &[u8]) -> Vec<u8>;
+
+    /// Sign for the certificate of `params`. The signer derives the
+    /// domain-separated message itself, so callers can't sign a raw or
+    /// wrongly tagged one.
+    fn sign_certificate(&self, params: &Params) -> Vec<u8> {
+        self.sign(&params.signing_message())
+    }
+
+    /// Public key in the hex format used by `Participant`
+    fn public_key_hex(&self) -> String {
+        hex::encode(self.public_key())
+    }
+}
+
+/// Signer backed by a Dilithium3 keypair
+pub struct DilithiumSigner {
+    keypair: dilithium3::Keypair,
+}
+
+// Implement Debug trait for DilithiumSigner without leaking the secret key
+impl std::fmt::Debug for DilithiumSigner {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "DilithiumSigner {{ keypair: <keypair> }}")
+    }
+}
+
+impl DilithiumSigner {
+    pub fn new() -> Result<Self, String> {
+        let seed = rand::thread_rng().gen::<[u8; 32]>();
+        Ok(Self::from_seed(&seed))
+    }
+
+    /// Deterministically derive the keypair from a 32-byte seed
+    pub fn from_seed(seed: &[u8; 32]) -> Self {
+        Self {
+            keypair: dilithium3::Keypair::generate(Some(seed)),
+        }
+    }
+}
+
+impl Signer for DilithiumSigner {
+    fn scheme(&self) -> SchemeId {
+        SignatureScheme::Dilithium3.id()
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        self.keypair.public.to_bytes().to_vec()
+    }
+
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        self.keypair.sign(msg).to_vec()
+    }
+}
+
+/// Signer backed by an ML-DSA-65 keypair
+pub struct MlDsaSigner {
+    public: mldsa65::PublicKey,
+    secret: mldsa65::SecretKey,
+}
+
+// Implement Debug trait for MlDsaSigner without leaking the secret key
+impl std::fmt::Debug for MlDsaSigner {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "MlDsaSigner {{ secret: <secret> }}")
+    }
+}
+
+impl MlDsaSigner {
+    pub fn new() -> Result<Self, String> {
+        let (public, secret) = mldsa65::keypair();
+        Ok(Self { public, secret })
+    }
+}
+
+impl Signer for MlDsaSigner {
+    fn scheme(&self) -> SchemeId {
+        SignatureScheme::MlDsa65.id()
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        self.public.as_bytes().to_vec()
+    }
+
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        mldsa65::detached_sign(msg, &self.secret)
+            .as_bytes()
+            .to_vec()
+    }
+}
+
+enum FalconKeys {
+    Falcon512(falcon512::PublicKey, falcon512::SecretKey),
+    Falcon1024(falcon1024::PublicKey, falcon1024::SecretKey),
+}
+
+/// Signer backed by a Falcon-512 or Falcon-1024 keypair
+pub struct FalconSigner {
+    keys: FalconKeys,
+}
+
+// Implement Debug trait for FalconSigner without leaking the secret key
+impl std::fmt::Debug for FalconSigner {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "FalconSigner {{ scheme: {:?}, keys: <keys> }}",
+            self.scheme()
+        )
+    }
+}
+
+impl FalconSigner {
+    /// Generate a Falcon-512 keypair
+    pub fn new() -> Result<Self, String> {
+        Self::with_scheme(SignatureScheme::Falcon512)
+    }
+
+    /// Generate a keypair for the given Falcon parameter set
+    pub fn with_scheme(scheme: SignatureScheme) -> Result<Self, String> {
+        let keys = match scheme {
+            SignatureScheme::Falcon512 => {
+                let (pk, sk) = falcon512::keypair();
+                FalconKeys::Falcon512(pk, sk)
+            }
+            SignatureScheme::Falcon1024 => {
+                let (pk, sk) = falcon1024::keypair();
+                FalconKeys::Falcon1024(pk, sk)
+            }
+            other => return Err(format!("{:?} is not a Falcon scheme", other)),
+        };
+        Ok(Self { keys })
+    }
+}
+
+impl Signer for FalconSigner {
+    fn scheme(&self) -> SchemeId {
+        match self.keys {
+            FalconKeys::Falcon512(..) => SignatureScheme::Falcon512.id(),
+            FalconKeys::Falcon1024(..) => SignatureScheme::Falcon1024.id(),
+        }
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        match &self.keys {
+            FalconKeys::Falcon512(pk, _) => pk.as_bytes().to_vec(),
+            FalconKeys::Falcon1024(pk, _) => pk.as_bytes().to_vec(),
+        }
+    }
+
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        match &self.keys {
+            FalconKeys::Falcon512(_, sk) => falcon512::detached_sign(msg, sk).as_bytes().to_vec(),
+            FalconKeys::Falcon1024(_, sk) => falcon1024::detached_sign(msg, sk).as_bytes().to_vec(),
+        }
+    }
+}
+
+enum SphincsKeys {
+    Sha2128s(
+        sphincssha2128ssimple::PublicKey,
+        sphincssha2128ssimple::SecretKey,
+    ),
+    Sha2128f(
+        sphincssha2128fsimple::PublicKey,
+        sphincssha2128fsimple::SecretKey,
+    ),
+}
+
+/// Signer backed by a SPHINCS+ keypair, relying on hash functions only
+pub struct SphincsPlusSigner {
+    keys: SphincsKeys,
+}
+
+// Implement Debug trait for SphincsPlusSigner without leaking the secret key
+impl std::fmt::Debug for SphincsPlusSigner {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "SphincsPlusSigner {{ scheme: {:?}, keys: <keys> }}",
+            self.scheme()
+        )
+    }
+}
+
+impl SphincsPlusSigner {
+    /// Generate a SPHINCS+-SHA2-128s keypair
+    pub fn new() -> Result<Self, String> {
+        Self::with_scheme(SignatureScheme::SphincsSha2128s)
+    }
+
+    /// Generate a keypair for the given SPHINCS+ parameter set
+    pub fn with_scheme(scheme: SignatureScheme) -> Result<Self, String> {
+        let keys = match scheme {
+            SignatureScheme::SphincsSha2128s => {
+                let (pk, sk) = sphincssha2128ssimple::keypair();
+                SphincsKeys::Sha2128s(pk, sk)
+            }
+            SignatureScheme::SphincsSha2128f => {
+                let (pk, sk) = sphincssha2128fsimple::keypair();
+                SphincsKeys::Sha2128f(pk, sk)
+            }
+            other => return Err(format!("{:?} is not a SPHINCS+ scheme", other)),
+        };
+        Ok(Self { keys })
+    }
+}
+
+impl Signer for SphincsPlusSigner {
+    fn scheme(&self) -> SchemeId {
+        match self.keys {
+            SphincsKeys::Sha2128s(..) => SignatureScheme::SphincsSha2128s.id(),
+            SphincsKeys::Sha2128f(..) => SignatureScheme::SphincsSha2128f.id(),
+        }
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        match &self.keys {
+            SphincsKeys::Sha2128s(pk, _) => pk.as_bytes().to_vec(),
+            SphincsKeys::Sha2128f(pk, _) => pk.as_bytes().to_vec(),
+        }
+    }
+
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        match &self.keys {
+            SphincsKeys::Sha2128s(_, sk) => sphincssha2128ssimple::detached_sign(msg, sk)
+                .as_bytes()
+                .to_vec(),
+            SphincsKeys::Sha2128f(_, sk) => sphincssha2128fsimple::detached_sign(msg, sk)
+                .as_bytes()
+                .to_vec(),
+        }
+    }
+}
+
+/// Signer backed by a BIP-340 Schnorr key over secp256k1
+pub struct SchnorrSigner {
+    /// Secret key, `None` once wiped
+    secret: Option<schnorr::SigningKey>,
+    public: schnorr::VerifyingKey,
+}
+
+// Implement Debug trait for SchnorrSigner without leaking the secret key
+impl std::fmt::Debug for SchnorrSigner {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "SchnorrSigner {{ secret: <secret> }}")
+    }
+}
+
+impl SchnorrSigner {
+    pub fn new() -> Result<Self, String> {
+        Self::from_secret(&rand::thread_rng().gen::<[u8; 32]>())
+    }
+
+    /// Signer of a 32-byte secret key, which must be a valid scalar
+    pub fn from_secret(secret: &[u8]) -> Result<Self, String> {
+        let secret = schnorr::SigningKey::from_bytes(secret)
+            .map_err(|e| format!("Invalid Schnorr secret key: {}", e))?;
+        Ok(Self {
+            public: *secret.verifying_key(),
+            secret: Some(secret),
+        })
+    }
+}
+
+impl Signer for SchnorrSigner {
+    fn scheme(&self) -> SchemeId {
+        SignatureScheme::Schnorr.id()
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        self.public.to_bytes().to_vec()
+    }
+
+    /// Panics once the secret key is wiped, rather than giving a signature
+    /// that can't verify
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        let secret = self
+            .secret
+            .as_ref()
+            .expect("SchnorrSigner used to sign after its secret key was wiped");
+        secret.sign(msg).to_bytes().to_vec()
+    }
+}
+
+/// Signer holding a Dilithium3 and a Schnorr key, signing with both. `sign`
+/// gives signatures of `SignatureScheme::Dilithium3Schnorr`; `sign_hybrid`
+/// gives the halves a `SignatureMode` asks for.
+#[derive(Debug)]
+pub struct HybridSigner {
+    post_quantum: DilithiumSigner,
+    classical: SchnorrSigner,
+}
+
+impl HybridSigner {
+    pub fn new() -> Result<Self, String> {
+        Ok(Self::from_parts(
+            DilithiumSigner::new()?,
+            SchnorrSigner::new()?,
+        ))
+    }
+
+    pub fn from_parts(post_quantum: DilithiumSigner, classical: SchnorrSigner) -> Self {
+        Self {
+            post_quantum,
+            classical,
+        }
+    }
+
+    /// Signature on `msg` with the keys `mode` requires, both when unset
+    pub fn sign_hybrid(&self, mode: Option<SignatureMode>, msg: &[u8]) -> HybridSig {
+        match mode {
+            Some(SignatureMode::Classical | SignatureMode::Aggregate) => {
+                HybridSig::classical(self.classical.sign(msg))
+            }
+            Some(SignatureMode::PostQuantum) => {
+                HybridSig::post_quantum(self.post_quantum.sign(msg))
+            }
+            Some(SignatureMode::Hybrid) | None => {
+                HybridSig::new(self.post_quantum.sign(msg), self.classical.sign(msg))
+            }
+        }
+    }
+}
+
+impl Signer for HybridSigner {
+    fn scheme(&self) -> SchemeId {
+        SignatureScheme::Dilithium3Schnorr.id()
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        [self.post_quantum.public_key(), self.classical.public_key()].concat()
+    }
+
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        self.sign_hybrid(None, msg).to_bytes()
+    }
+
+    // Only the halves the signature mode asks for
+    fn sign_certificate(&self, params: &Params) -> Vec<u8> {
+        self.sign_hybrid(params.signature_mode, &params.signing_message())
+            .to_bytes()
+    }
+}
+
+/// Overwrite `bytes` with zeros. The writes are volatile, so they aren't
+/// optimized out as dead stores to memory about to be freed.
+pub fn zeroize(bytes: &mut [u8]) {
+    for byte in bytes.iter_mut() {
+        // SAFETY: `byte` is a valid, aligned reference
+        unsafe { std::ptr::write_volatile(byte, 0) };
+    }
+    compiler_fence(Ordering::SeqCst);
+}
+
+// Zero a pqcrypto secret key, whose bytes aren't public. The key types wrap
+// a byte array, valid when all zero, and being `Copy` own nothing else.
+fn wipe<K: pqcrypto_traits::sign::SecretKey + Copy>(key: &mut K) {
+    // SAFETY: the slice covers exactly the key, borrowed mutably
+    let bytes = unsafe {
+        std::slice::from_raw_parts_mut(key as *mut K as *mut u8, std::mem::size_of::<K>())
+    };
+    zeroize(bytes);
+}
+
+/// Signer whose secret key can be exported, so it can be stored encrypted.
+/// Such keys are plain data and can be shared across threads.
+///
+/// Signing runs in the scheme implementations, which are constant time with
+/// respect to the secret key; this crate only copies key bytes around, and
+/// wipes them: every signer zeroizes its secret key when dropped.
+pub trait ExportableSigner: Signer + Send + Sync {
+    /// Key material read back by `import_signer`
+    fn export_secret(&self) -> Vec<u8>;
+
+    /// Wipe the secret key from memory. Signatures made after are worthless,
+    /// and a Schnorr signer refuses to make them.
+    fn zeroize(&mut self);
+}
+
+impl ExportableSigner for DilithiumSigner {
+    fn export_secret(&self) -> Vec<u8> {
+        self.keypair.to_bytes().to_vec()
+    }
+
+    fn zeroize(&mut self) {
+        zeroize(&mut self.keypair.secret.bytes);
+    }
+}
+
+impl ExportableSigner for MlDsaSigner {
+    fn export_secret(&self) -> Vec<u8> {
+        [self.public.as_bytes(), self.secret.as_bytes()].concat()
+    }
+
+    fn zeroize(&mut self) {
+        wipe(&mut self.secret);
+    }
+}
+
+impl ExportableSigner for FalconSigner {
+    fn export_secret(&self) -> Vec<u8> {
+        match &self.keys {
+            FalconKeys::Falcon512(pk, sk) => [pk.as_bytes(), sk.as_bytes()].concat(),
+            FalconKeys::Falcon1024(pk, sk) => [pk.as_bytes(), sk.as_bytes()].concat(),
+        }
+    }
+
+    fn zeroize(&mut self) {
+        match &mut self.keys {
+            FalconKeys::Falcon512(_, sk) => wipe(sk),
+            FalconKeys::Falcon1024(_, sk) => wipe(sk),
+        }
+    }
+}
+
+impl ExportableSigner for SphincsPlusSigner {
+    fn export_secret(&self) -> Vec<u8> {
+        match &self.keys {
+            SphincsKeys::Sha2128s(pk, sk) => [pk.as_bytes(), sk.as_bytes()].concat(),
+            SphincsKeys::Sha2128f(pk, sk) => [pk.as_bytes(), sk.as_bytes()].concat(),
+        }
+    }
+
+    fn zeroize(&mut self) {
+        match &mut self.keys {
+            SphincsKeys::Sha2128s(_, sk) => wipe(sk),
+            SphincsKeys::Sha2128f(_, sk) => wipe(sk),
+        }
+    }
+}
+
+impl ExportableSigner for SchnorrSigner {
+    fn export_secret(&self) -> Vec<u8> {
+        let secret = self
+            .secret
+            .as_ref()
+            .map_or([0; 32], |secret| secret.to_bytes().into());
+        [self.public_key(), secret.to_vec()].concat()
+    }
+
+    fn zeroize(&mut self) {
+        // The key wipes itself when dropped
+        self.secret = None;
+    }
+}
+
+impl ExportableSigner for HybridSigner {
+    fn export_secret(&self) -> Vec<u8> {
+        [
+            self.post_quantum.export_secret(),
+            self.classical.export_secret(),
+        ]
+        .concat()
+    }
+
+    fn zeroize(&mut self) {
+        self.post_quantum.zeroize();
+        self.classical.zeroize();
+    }
+}
+
+impl Drop for DilithiumSigner {
+    fn drop(&mut self) {
+        self.zeroize();
+    }
+}
+
+impl Drop for MlDsaSigner {
+    fn drop(&mut self) {
+        self.zeroize();
+    }
+}
+
+impl Drop for FalconSigner {
+    fn drop(&mut self) {
+        self.zeroize();
+    }
+}
+
+impl Drop for SphincsPlusSigner {
+    fn drop(&mut self) {
+        self.zeroize();
+    }
+}
+
+impl Drop for SchnorrSigner {
+    fn drop(&mut self) {
+        self.zeroize();
+    }
+}
+
+/// Fresh key pair of `scheme` whose secret key can be exported
+pub fn generate_exportable_signer(
+    scheme: SignatureScheme,
+) -> Result<Box<dyn ExportableSigner>, String> {
+    match scheme {
+        SignatureScheme::Dilithium2 => Ok(Box::new(crate::wallet::Wallet::new()?)),
+        SignatureScheme::Dilithium3 => Ok(Box::new(DilithiumSigner::new()?)),
+        SignatureScheme::Falcon512 | SignatureScheme::Falcon1024 => {
+            Ok(Box::new(FalconSigner::with_scheme(scheme)?))
+        }
+        SignatureScheme::SphincsSha2128s | SignatureScheme::SphincsSha2128f => {
+            Ok(Box::new(SphincsPlusSigner::with_scheme(scheme)?))
+        }
+        SignatureScheme::Schnorr => Ok(Box::new(SchnorrSigner::new()?)),
+        SignatureScheme::Dilithium3Schnorr => Ok(Box::new(HybridSigner::new()?)),
+        SignatureScheme::MlDsa65 => Ok(Box::new(MlDsaSigner::new()?)),
+    }
+}
+
+// Public and secret key of exported key material
+fn split_keys<P: pqcrypto_traits::sign::PublicKey, S: pqcrypto_traits::sign::SecretKey>(
+    secret: &[u8],
+    public_key_len: usize,
+) -> Result<(P, S), String> {
+    let (pk, sk) = secret.split_at(public_key_len.min(secret.len()));
+    let pk = P::from_bytes(pk).map_err(|e| format!("Invalid public key: {}", e))?;
+    let sk = S::from_bytes(sk).map_err(|e| format!("Invalid secret key: {}", e))?;
+    Ok((pk, sk))
+}
+
+/// Signer of the key material `export_secret` gave for `scheme`
+pub fn import_signer(
+    scheme: SignatureScheme,
+    secret: &[u8],
+) -> Result<Box<dyn ExportableSigner>, String> {
+    let pk_len = scheme.public_key_len();
+    match scheme {
+        SignatureScheme::Dilithium2 => Ok(Box::new(crate::wallet::Wallet::from_bytes(secret)?)),
+        SignatureScheme::Dilithium3 => {
+            if secret.len() != dilithium3::PUBLICKEYBYTES + dilithium3::SECRETKEYBYTES {
+                return Err(format!("Invalid Dilithium3 key length: {}", secret.len()));
+            }
+            Ok(Box::new(DilithiumSigner {
+                keypair: dilithium3::Keypair::from_bytes(secret),
+            }))
+        }
+        SignatureScheme::Falcon512 => {
+            let (pk, sk) = split_keys(secret, pk_len)?;
+            Ok(Box::new(FalconSigner {
+                keys: FalconKeys::Falcon512(pk, sk),
+            }))
+        }
+        SignatureScheme::Falcon1024 => {
+            let (pk, sk) = split_keys(secret, pk_len)?;
+            Ok(Box::new(FalconSigner {
+                keys: FalconKeys::Falcon1024(pk, sk),
+            }))
+        }
+        SignatureScheme::SphincsSha2128s => {
+            let (pk, sk) = split_keys(secret, pk_len)?;
+            Ok(Box::new(SphincsPlusSigner {
+                keys: SphincsKeys::Sha2128s(pk, sk),
+            }))
+        }
+        SignatureScheme::SphincsSha2128f => {
+            let (pk, sk) = split_keys(secret, pk_len)?;
+            Ok(Box::new(SphincsPlusSigner {
+                keys: SphincsKeys::Sha2128f(pk, sk),
+            }))
+        }
+        SignatureScheme::Schnorr => Ok(Box::new(import_schnorr(secret)?)),
+        SignatureScheme::Dilithium3Schnorr => {
+            let pq_len = dilithium3::PUBLICKEYBYTES + dilithium3::SECRETKEYBYTES;
+            if secret.len() != pq_len + 2 * SCHNORR_PUBLIC_KEY_BYTES {
+                return Err(format!("Invalid hybrid key length: {}", secret.len()));
+            }
+            let (post_quantum, classical) = secret.split_at(pq_len);
+            Ok(Box::new(HybridSigner::from_parts(
+                DilithiumSigner {
+                    keypair: dilithium3::Keypair::from_bytes(post_quantum),
+                },
+                import_schnorr(classical)?,
+            )))
+        }
+        SignatureScheme::MlDsa65 => {
+            let (public, secret) = split_keys(secret, pk_len)?;
+            Ok(Box::new(MlDsaSigner { public, secret }))
+        }
+    }
+}
+
+// Schnorr signer of its exported public and secret key
+fn import_schnorr(secret: &[u8]) -> Result<SchnorrSigner, String> {
+    if secret.len() != 2 * SCHNORR_PUBLIC_KEY_BYTES {
+        return Err(format!("Invalid Schnorr key length: {}", secret.len()));
+    }
+    let (public_key, secret) = secret.split_at(SCHNORR_PUBLIC_KEY_BYTES);
+    let signer = SchnorrSigner::from_secret(secret)?;
+    if signer.public_key() != public_key {
+        return Err("Schnorr public key doesn't match the secret key".to_string());
+    }
+    Ok(signer)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::scheme::verify_signature;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_dilithium_signer_roundtrip() {
+        let signer = DilithiumSigner::new().expect("Failed to create signer");
+        let msg = b"Test message";
+        let sig = signer.sign(msg);
+
+        assert_eq!(sig.len(), SignatureScheme::Dilithium3.signature_len());
+        assert!(verify_signature(signer.scheme(), &signer.public_key(), msg, &sig).unwrap());
+        assert!(!verify_signature(
+            signer.scheme(),
+            &signer.public_key(),
+            b"Other message",
+            &sig
+        )
+        .unwrap());
+    }
+
+    #[test]
+    fn test_ml_dsa_signer_roundtrip() {
+        let signer = MlDsaSigner::new().expect("Failed to create signer");
+        let msg = b"Test message";
+        let sig = signer.sign(msg);
+
+        assert_eq!(sig.len(), SignatureScheme::MlDsa65.signature_len());
+        assert!(verify_signature(signer.scheme(), &signer.public_key(), msg, &sig).unwrap());
+        assert!(!verify_signature(
+            signer.scheme(),
+            &signer.public_key(),
+            b"Other message",
+            &sig
+        )
+        .unwrap());
+
+        // Dilithium3 keys have the same size, but not the same scheme
+        let dilithium = DilithiumSigner::new().unwrap();
+        assert!(!verify_signature(
+            signer.scheme(),
+            &dilithium.public_key(),
+            msg,
+            &dilithium.sign(msg)
+        )
+        .unwrap_or(false));
+    }
+
+    #[test]
+    fn test_falcon_signer_roundtrip() {
+        for scheme in [SignatureScheme::Falcon512, SignatureScheme::Falcon1024] {
+            let signer = FalconSigner::with_scheme(scheme).expect("Failed to create signer");
+            let msg = b"Test message";
+            let sig = signer.sign(msg);
+
+            assert_eq!(signer.scheme(), scheme.id());
+            assert!(sig.len() <= scheme.signature_len());
+            assert!(scheme.verify(&signer.public_key(), msg, &sig).unwrap());
+            assert!(!scheme
+                .verify(&signer.public_key(), b"Other message", &sig)
+                .unwrap());
+        }
+        assert!(FalconSigner::with_scheme(SignatureScheme::Dilithium2).is_err());
+    }
+
+    #[test]
+    fn test_sphincs_signer_roundtrip() {
+        let signer = SphincsPlusSigner::new().expect("Failed to create signer");
+        let msg = b"Test message";
+        let sig = signer.sign(msg);
+
+        assert_eq!(sig.len(), SignatureScheme::SphincsSha2128s.signature_len());
+        assert!(verify_signature(signer.scheme(), &signer.public_key(), msg, &sig).unwrap());
+        assert!(!verify_signature(
+            signer.scheme(),
+            &signer.public_key(),
+            b"Other message",
+            &sig
+        )
+        .unwrap());
+    }
+
+    #[test]
+    fn test_zeroize() {
+        let mut signers: Vec<Box<dyn ExportableSigner>> = vec![Box::new(Wallet::new().unwrap())];
+        for scheme in [
+            SignatureScheme::Dilithium3,
+            SignatureScheme::Falcon512,
+            SignatureScheme::SphincsSha2128f,
+            SignatureScheme::Schnorr,
+            SignatureScheme::MlDsa65,
+        ] {
+            signers.push(generate_exportable_signer(scheme).unwrap());
+        }
+        for signer in &mut signers {
+            let public_key = signer.public_key();
+            let secret = signer.export_secret();
+            assert!(secret[public_key.len()..].iter().any(|&b| b != 0));
+            signer.zeroize();
+            // The secret key is gone, the public key kept
+            let wiped = signer.export_secret();
+            assert_eq!(wiped[..public_key.len()], public_key[..]);
+            assert!(wiped[public_key.len()..].iter().all(|&b| b == 0));
+        }
+
+        // A wiped Schnorr key can't sign at all
+        let mut schnorr = SchnorrSigner::new().unwrap();
+        schnorr.zeroize();
+        let signed = std::panic::catch_unwind(|| schnorr.sign(b"Test message"));
+        assert!(signed.is_err());
+
+        let mut bytes = [7u8; 40];
+        zeroize(&mut bytes);
+        assert_eq!(bytes, [0; 40]);
+    }
+
+    #[test]
+    fn test_scheme_mismatch_is_rejected() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let sig = Signer::sign(&wallet, b"Test message");
+
+        // A Dilithium2 signature must not be accepted as Dilithium3
+        assert!(verify_signature(
+            SignatureScheme::Dilithium3.id(),
+            &Signer::public_key(&wallet),
+            b"Test message",
+            &sig
+        )
+        .is_err());
+    }
+}
@@ -0,0 +1,408 @@
+//! Randomized simulation of the builder and verifier. A `Scenario` draws a
+//! participant set from a weight distribution, lets some participants drop
+//! out and some submit adversarial signatures, and runs the result through
+//! `Builder` and `Verifier`, checking invariants that hold for every input:
+//! signed and accumulated weights match the accepted signatures, a
+//! certificate is built exactly when the signed weight covers the proven
+//! weight, and it verifies exactly when none of its reveals is adversarial.
+//! Participants share a small pool of keys, so sets of a million
+//! participants cost a handful of signatures. `fuzz` runs random scenarios
+//! from a seed, for the CI of chains building on the certificates.
+use crate::ccok::{
+    Builder, Certificate, Params, Participant, SerializableSignature, PARAMS_V2, PARAMS_V3,
+};
+use crate::error::CcokError;
+use crate::merkle::{HashAlgorithm, MerkleTreeBuilder};
+use crate::nodeconfig::proven_weight;
+use crate::signer::Signer;
+use crate::wallet::Wallet;
+use rand::rngs::StdRng;
+use rand::seq::SliceRandom;
+use rand::{Rng, SeedableRng};
+use std::time::{Duration, Instant};
+
+/// How participant weights are drawn
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum WeightDistribution {
+    /// Every participant has the same weight
+    Uniform(u64),
+    /// Weights drawn uniformly from `1..=max`
+    Random { max: u64 },
+    /// Weight `max / rank^exponent` of the participant of each rank, shuffled
+    Zipf { max: u64, exponent: f64 },
+    /// A few participants holding most of the weight
+    Whales {
+        whales: usize,
+        whale_weight: u64,
+        weight: u64,
+    },
+}
+
+impl WeightDistribution {
+    fn weights(&self, rng: &mut StdRng, count: usize) -> Vec<u64> {
+        let mut weights: Vec<u64> = match *self {
+            WeightDistribution::Uniform(weight) => vec![weight.max(1); count],
+            WeightDistribution::Random { max } => {
+                (0..count).map(|_| rng.gen_range(1..=max.max(1))).collect()
+            }
+            WeightDistribution::Zipf { max, exponent } => (1..=count)
+                .map(|rank| ((max as f64 / (rank as f64).powf(exponent)) as u64).max(1))
+                .collect(),
+            WeightDistribution::Whales {
+                whales,
+                whale_weight,
+                weight,
+            } => (0..count)
+                .map(|i| if i < whales { whale_weight } else { weight }.max(1))
+                .collect(),
+        };
+        weights.shuffle(rng);
+        weights
+    }
+}
+
+/// One randomized run of the builder and verifier
+#[derive(Debug, Clone, PartialEq)]
+pub struct Scenario {
+    pub seed: u64,
+    pub participants: usize,
+    /// Distinct keys the participants share
+    pub keys: usize,
+    pub weights: WeightDistribution,
+    /// Fraction of participants that don't sign
+    pub dropout: f64,
+    /// Fraction of signers submitting a signature over another message
+    pub adversarial: f64,
+    /// Fraction of the total weight the certificate proves
+    pub proven_fraction: f64,
+    /// Whether the builder verifies signatures before accepting them
+    pub verify_signatures: bool,
+    pub hash: HashAlgorithm,
+    pub version: u8,
+}
+
+impl Default for Scenario {
+    fn default() -> Self {
+        Self {
+            seed: 0,
+            participants: 100,
+            keys: 8,
+            weights: WeightDistribution::Uniform(10),
+            dropout: 0.1,
+            adversarial: 0.0,
+            proven_fraction: 0.5,
+            verify_signatures: false,
+            hash: HashAlgorithm::Keccak256,
+            version: PARAMS_V2,
+        }
+    }
+}
+
+impl Scenario {
+    /// Random scenario of up to `max_participants`
+    pub fn random(rng: &mut StdRng, max_participants: usize) -> Self {
+        let weights = match rng.gen_range(0..4) {
+            0 => WeightDistribution::Uniform(rng.gen_range(1..1000)),
+            1 => WeightDistribution::Random {
+                max: rng.gen_range(1..1_000_000),
+            },
+            2 => WeightDistribution::Zipf {
+                max: rng.gen_range(1..1_000_000),
+                exponent: rng.gen_range(0.5..2.0),
+            },
+            _ => WeightDistribution::Whales {
+                whales: rng.gen_range(1..4),
+                whale_weight: rng.gen_range(1000..1_000_000),
+                weight: rng.gen_range(1..100),
+            },
+        };
+        Self {
+            seed: rng.gen(),
+            participants: rng.gen_range(2..=max_participants.max(2)),
+            keys: rng.gen_range(1..8),
+            weights,
+            dropout: rng.gen_range(0.0..0.5),
+            adversarial: if rng.gen_bool(0.5) {
+                rng.gen_range(0.0..0.2)
+            } else {
+                0.0
+            },
+            proven_fraction: rng.gen_range(0.1..0.7),
+            verify_signatures: rng.gen_bool(0.5),
+            hash: HashAlgorithm::ALL[rng.gen_range(0..HashAlgorithm::ALL.len())],
+            version: rng.gen_range(1..=PARAMS_V2),
+        }
+    }
+}
+
+/// What a scenario produced, once every invariant held
+#[derive(Debug, Clone, PartialEq)]
+pub struct Outcome {
+    pub total_weight: u64,
+    pub proven_weight: u64,
+    /// Weight of the signatures the builder accepted
+    pub signed_weight: u64,
+    /// Reveals of the certificate, if one was built
+    pub reveals: Option<usize>,
+    /// Whether the certificate verified
+    pub verified: bool,
+    pub build_time: Duration,
+    pub verify_time: Duration,
+}
+
+// What a participant submitted
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Behavior {
+    Absent,
+    Honest,
+    Adversarial,
+}
+
+fn violation(scenario: &Scenario, what: String) -> String {
+    format!("Invariant violated (seed {}): {}", scenario.seed, what)
+}
+
+/// Run a scenario, failing with the first invariant it violates
+pub fn simulate(scenario: &Scenario) -> Result<Outcome, String> {
+    let mut rng = StdRng::seed_from_u64(scenario.seed);
+    let wallets: Vec<Wallet> = (0..scenario.keys.max(1))
+        .map(|_| Wallet::from_seed(&rng.gen()))
+        .collect();
+    let weights = scenario.weights.weights(&mut rng, scenario.participants);
+    let keys: Vec<usize> = (0..scenario.participants)
+        .map(|_| rng.gen_range(0..wallets.len()))
+        .collect();
+    let participants: Vec<Participant> = keys
+        .iter()
+        .zip(&weights)
+        .map(|(&key, &weight)| Participant::from_signer(&wallets[key], weight))
+        .collect();
+    let total_weight = weights
+        .iter()
+        .try_fold(0u64, |acc, &w| acc.checked_add(w))
+        .ok_or(CcokError::WeightOverflow)?;
+    let params = Params {
+        msg: format!("simulation {}", scenario.seed).into_bytes(),
+        proven_weight: proven_weight(total_weight, scenario.proven_fraction).max(1),
+        security_param: 128,
+        scheme: None,
+        round: None,
+        hash: scenario.hash,
+        version: scenario.version,
+        compression_level: 0,
+        chain_id: None,
+        purpose: None,
+        weight_precision: 0,
+        signature_mode: None,
+    };
+
+    // One honest and one adversarial signature per key
+    let other = Params {
+        msg: b"another message".to_vec(),
+        ..params.clone()
+    };
+    let honest: Vec<SerializableSignature> = wallets
+        .iter()
+        .map(|w| w.sign(&params.signing_message()).into())
+        .collect();
+    let forged: Vec<SerializableSignature> = wallets
+        .iter()
+        .map(|w| w.sign(&other.signing_message()).into())
+        .collect();
+    let behaviors: Vec<Behavior> = (0..scenario.participants)
+        .map(|_| {
+            if rng.gen_bool(scenario.dropout.clamp(0.0, 1.0)) {
+                Behavior::Absent
+            } else if rng.gen_bool(scenario.adversarial.clamp(0.0, 1.0)) {
+                Behavior::Adversarial
+            } else {
+                Behavior::Honest
+            }
+        })
+        .collect();
+
+    let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+    party_tree.build(&participants)?;
+    let root = party_tree.root();
+    let mut builder = Builder::new(params.clone(), participants, root.clone())?;
+    if scenario.verify_signatures {
+        builder = builder.with_verify_workers(4)?;
+    }
+    let start = Instant::now();
+    let batch = behaviors
+        .iter()
+        .enumerate()
+        .filter_map(|(pos, behavior)| match behavior {
+            Behavior::Absent => None,
+            Behavior::Honest => Some((pos, honest[keys[pos]].clone())),
+            Behavior::Adversarial => Some((pos, forged[keys[pos]].clone())),
+        })
+        .collect::<Vec<_>>();
+    let positions: Vec<usize> = batch.iter().map(|(pos, _)| *pos).collect();
+    let results = builder.add_signatures(batch);
+
+    // Accepted signatures, and the weights they account for
+    let mut expected_weight = 0u64;
+    for (pos, result) in positions.iter().zip(&results) {
+        let rejected = scenario.verify_signatures && behaviors[*pos] == Behavior::Adversarial;
+        match (result, rejected) {
+            (Ok(()), false) => expected_weight += weights[*pos],
+            (Err(CcokError::InvalidSignature(_)), true) => {}
+            (result, _) => {
+                return Err(violation(
+                    scenario,
+                    format!("signature of {} gave {:?}", pos, result),
+                ))
+            }
+        }
+    }
+    if builder.signed_weight != expected_weight {
+        return Err(violation(
+            scenario,
+            format!(
+                "signed weight {} for accepted weight {}",
+                builder.signed_weight, expected_weight
+            ),
+        ));
+    }
+    let mut acc = 0u64;
+    for (pos, slot) in builder.sigs.iter().enumerate() {
+        if slot.accumulated_weight != acc {
+            return Err(violation(
+                scenario,
+                format!(
+                    "slot {} accumulates {}, not {}",
+                    pos, slot.accumulated_weight, acc
+                ),
+            ));
+        }
+        if slot.signature.is_some() {
+            acc += weights[pos];
+        }
+    }
+
+    let cert = match builder.build() {
+        Ok(cert) if builder.signed_weight >= params.proven_weight => cert,
+        Ok(_) => {
+            return Err(violation(
+                scenario,
+                "certificate built below the proven weight".to_string(),
+            ))
+        }
+        Err(CcokError::InsufficientWeight { .. }) => {
+            // Only version 3 refuses certificates whose coins exceed the cap
+            if builder.signed_weight >= params.proven_weight && params.version < PARAMS_V3 {
+                return Err(violation(
+                    scenario,
+                    "enough weight signed but no certificate built".to_string(),
+                ));
+            }
+            return Ok(Outcome {
+                total_weight,
+                proven_weight: params.proven_weight,
+                signed_weight: builder.signed_weight,
+                reveals: None,
+                verified: false,
+                build_time: start.elapsed(),
+                verify_time: Duration::ZERO,
+            });
+        }
+        Err(e) => return Err(violation(scenario, format!("build failed: {}", e))),
+    };
+    let build_time = start.elapsed();
+
+    let start = Instant::now();
+    let verified = accepts(&cert, &params, &root);
+    let verify_time = start.elapsed();
+    let forged_reveal = cert
+        .reveals
+        .keys()
+        .any(|&pos| behaviors[pos as usize] == Behavior::Adversarial);
+    if verified == forged_reveal {
+        return Err(violation(
+            scenario,
+            format!(
+                "certificate {} with {} adversarial reveals",
+                if verified { "verified" } else { "failed" },
+                if forged_reveal { "some" } else { "no" }
+            ),
+        ));
+    }
+    // A certificate with one of its revealed signatures tampered never verifies
+    if verified {
+        let mut tampered = cert.clone();
+        let reveal = tampered.reveals.values_mut().next().unwrap();
+        let mut bytes = reveal
+            .sig_slot
+            .signature
+            .as_ref()
+            .unwrap()
+            .as_bytes()
+            .to_vec();
+        bytes[0] ^= 1;
+        reveal.sig_slot.signature = Some(bytes.into());
+        if accepts(&tampered, &params, &root) {
+            return Err(violation(
+                scenario,
+                "tampered certificate verified".to_string(),
+            ));
+        }
+    }
+
+    Ok(Outcome {
+        total_weight,
+        proven_weight: params.proven_weight,
+        signed_weight: builder.signed_weight,
+        reveals: Some(cert.reveals.len()),
+        verified,
+        build_time,
+        verify_time,
+    })
+}
+
+// Whether the verifier accepts, counting errors as rejections
+fn accepts(cert: &Certificate, params: &Params, root: &[u8]) -> bool {
+    matches!(cert.verify(params, root), Ok(true))
+}
+
+/// Run `runs` random scenarios of up to `max_participants` drawn from `seed`
+pub fn fuzz(seed: u64, runs: usize, max_participants: usize) -> Result<Vec<Outcome>, String> {
+    let mut rng = StdRng::seed_from_u64(seed);
+    (0..runs)
+        .map(|_| simulate(&Scenario::random(&mut rng, max_participants)))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_simulation() {
+        let outcome = simulate(&Scenario::default()).unwrap();
+        assert!(outcome.verified);
+        assert!(outcome.signed_weight >= outcome.proven_weight);
+
+        // Checked signatures keep adversaries out of the certificate
+        let checked = Scenario {
+            adversarial: 0.3,
+            verify_signatures: true,
+            weights: WeightDistribution::Zipf {
+                max: 1000,
+                exponent: 1.0,
+            },
+            ..Scenario::default()
+        };
+        assert!(simulate(&checked).unwrap().verified);
+
+        // Too many dropouts build no certificate
+        let dropped = Scenario {
+            dropout: 0.9,
+            proven_fraction: 0.6,
+            ..Scenario::default()
+        };
+        assert_eq!(simulate(&dropped).unwrap().reveals, None);
+
+        assert_eq!(fuzz(7, 8, 64).unwrap().len(), 8);
+    }
+}
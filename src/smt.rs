@@ -0,0 +1,442 @@
+//! Sparse Merkle tree over 256-bit keys. Leaves sit on the path given by the
+//! bits of their key, most significant first, but a subtree holding a single
+//! leaf is replaced by that leaf and an empty subtree hashes to zero, so the
+//! tree is only as deep as needed to tell its keys apart.
+//!
+//! The root depends on the key-value pairs only: inserting keys in any order,
+//! or inserting and then removing a key, gives the same root as building the
+//! tree from its final contents. Hash with domain separation so that leaves
+//! and internal nodes can't be confused.
+//!
+//! The tree caches the hash of every internal node by the prefix of its
+//! path, so an insertion or removal rehashes only the nodes on the path of
+//! its key, and roots and proofs are read off the cache.
+use crate::error::CcokError;
+use crate::merkle::{HashDomain, Hashing};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+
+/// Hash of an empty subtree
+pub const EMPTY: [u8; 32] = [0u8; 32];
+
+// Bit `depth` of `key`, most significant first
+fn bit(key: &[u8; 32], depth: usize) -> bool {
+    key[depth / 8] >> (7 - depth % 8) & 1 == 1
+}
+
+// Lowest and highest keys starting with the first `depth` bits of `key`
+fn prefix_range(key: &[u8; 32], depth: usize) -> ([u8; 32], [u8; 32]) {
+    let (mut low, mut high) = (*key, *key);
+    if depth < 256 {
+        let mask = 0xffu8 >> (depth % 8);
+        low[depth / 8] &= !mask;
+        high[depth / 8] |= mask;
+        low[depth / 8 + 1..].fill(0);
+        high[depth / 8 + 1..].fill(0xff);
+    }
+    (low, high)
+}
+
+// Child of the node at `depth` on the path of `key`, on the side of `right`
+fn child(key: &[u8; 32], depth: usize, right: bool) -> [u8; 32] {
+    let (mut prefix, _) = prefix_range(key, depth);
+    if right {
+        prefix[depth / 8] |= 0x80 >> (depth % 8);
+    }
+    prefix
+}
+
+/// Hash of the leaf holding `value` under `key`
+pub fn leaf_hash(hashing: Hashing, key: &[u8; 32], value: &[u8]) -> [u8; 32] {
+    leaf_node(hashing, key, &hashing.hash(HashDomain::Leaf, value))
+}
+
+fn leaf_node(hashing: Hashing, key: &[u8; 32], value_hash: &[u8; 32]) -> [u8; 32] {
+    let mut bytes = key.to_vec();
+    bytes.extend_from_slice(value_hash);
+    hashing.hash(HashDomain::Leaf, &bytes)
+}
+
+// Fold `hash` at depth `siblings.len()` on the path of `key` up to the root
+fn fold(hashing: Hashing, key: &[u8; 32], mut hash: [u8; 32], siblings: &[[u8; 32]]) -> [u8; 32] {
+    for (depth, sibling) in siblings.iter().enumerate().rev() {
+        hash = if bit(key, depth) {
+            node_hash(hashing, sibling, &hash)
+        } else {
+            node_hash(hashing, &hash, sibling)
+        };
+    }
+    hash
+}
+
+fn node_hash(hashing: Hashing, left: &[u8; 32], right: &[u8; 32]) -> [u8; 32] {
+    let mut bytes = left.to_vec();
+    bytes.extend_from_slice(right);
+    hashing.hash(HashDomain::Node, &bytes)
+}
+
+/// Proof that a key holds a value in a tree
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SmtProof {
+    /// Siblings on the path of the key, from the root down
+    pub siblings: Vec<[u8; 32]>,
+}
+
+impl SmtProof {
+    /// Check that `key` holds `value` in the tree with `root`
+    pub fn verify(&self, hashing: Hashing, root: &[u8; 32], key: &[u8; 32], value: &[u8]) -> bool {
+        if self.siblings.len() > 256 {
+            return false;
+        }
+        fold(hashing, key, leaf_hash(hashing, key, value), &self.siblings) == *root
+    }
+}
+
+/// Proof that a key is not in a tree: the path of the key ends in an empty
+/// subtree or in a leaf of another key
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SmtAbsenceProof {
+    /// Siblings on the path of the key, from the root down
+    pub siblings: Vec<[u8; 32]>,
+    /// Key and value hash of the leaf ending the path, if any
+    pub leaf: Option<([u8; 32], [u8; 32])>,
+}
+
+impl SmtAbsenceProof {
+    /// Check that `key` is not in the tree with `root`
+    pub fn verify(&self, hashing: Hashing, root: &[u8; 32], key: &[u8; 32]) -> bool {
+        let depth = self.siblings.len();
+        if depth > 256 {
+            return false;
+        }
+        let end = match &self.leaf {
+            None => EMPTY,
+            Some((other, value_hash)) => {
+                if other == key || (0..depth).any(|d| bit(other, d) != bit(key, d)) {
+                    return false;
+                }
+                leaf_node(hashing, other, value_hash)
+            }
+        };
+        fold(hashing, key, end, &self.siblings) == *root
+    }
+}
+
+/// Sparse Merkle tree mapping 256-bit keys to byte strings
+#[derive(Debug, Clone, Default)]
+pub struct SparseMerkleTree {
+    hashing: Hashing,
+    leaves: BTreeMap<[u8; 32], Vec<u8>>,
+    /// Hashes of the subtrees holding two leaves or more, by depth and the
+    /// lowest key of their range
+    nodes: HashMap<(usize, [u8; 32]), [u8; 32]>,
+}
+
+impl SparseMerkleTree {
+    /// Empty tree hashed with `hashing`
+    pub fn new(hashing: Hashing) -> Self {
+        Self {
+            hashing,
+            leaves: BTreeMap::new(),
+            nodes: HashMap::new(),
+        }
+    }
+
+    /// Hash function of the tree
+    pub fn hashing(&self) -> Hashing {
+        self.hashing
+    }
+
+    /// Number of keys in the tree
+    pub fn len(&self) -> usize {
+        self.leaves.len()
+    }
+
+    /// Whether the tree holds no key
+    pub fn is_empty(&self) -> bool {
+        self.leaves.is_empty()
+    }
+
+    /// Value under `key`
+    pub fn get(&self, key: &[u8; 32]) -> Option<&[u8]> {
+        self.leaves.get(key).map(Vec::as_slice)
+    }
+
+    /// Keys and values in key order
+    pub fn iter(&self) -> impl Iterator<Item = (&[u8; 32], &[u8])> {
+        self.leaves
+            .iter()
+            .map(|(key, value)| (key, value.as_slice()))
+    }
+
+    /// Set the value under `key`, returning the previous one
+    pub fn insert(&mut self, key: [u8; 32], value: Vec<u8>) -> Option<Vec<u8>> {
+        let previous = self.leaves.insert(key, value);
+        self.rehash(&key);
+        previous
+    }
+
+    /// Remove `key`, returning its value
+    pub fn remove(&mut self, key: &[u8; 32]) -> Option<Vec<u8>> {
+        let previous = self.leaves.remove(key)?;
+        self.rehash(key);
+        Some(previous)
+    }
+
+    /// Root of the tree, `EMPTY` without keys
+    pub fn root(&self) -> [u8; 32] {
+        self.subtree(&[0u8; 32], 0)
+    }
+
+    // Up to two leaves of the subtree at `depth` on the path of `key`
+    fn leaves_under(&self, key: &[u8; 32], depth: usize) -> Vec<(&[u8; 32], &Vec<u8>)> {
+        let (low, high) = prefix_range(key, depth);
+        self.leaves.range(low..=high).take(2).collect()
+    }
+
+    // Hash of the subtree at `depth` on the path of `key`
+    fn subtree(&self, key: &[u8; 32], depth: usize) -> [u8; 32] {
+        match self.leaves_under(key, depth)[..] {
+            [] => EMPTY,
+            [(key, value)] => leaf_hash(self.hashing, key, value),
+            _ => self.nodes[&(depth, prefix_range(key, depth).0)],
+        }
+    }
+
+    // Rehash the nodes on the path of `key` after its leaf changed, from the
+    // bottom up, and drop those left with fewer than two leaves
+    fn rehash(&mut self, key: &[u8; 32]) {
+        let mut depth = 0;
+        while self.leaves_under(key, depth).len() > 1 {
+            depth += 1;
+        }
+        for stale in depth..=256 {
+            if self
+                .nodes
+                .remove(&(stale, prefix_range(key, stale).0))
+                .is_none()
+            {
+                break;
+            }
+        }
+        for depth in (0..depth).rev() {
+            let left = self.subtree(&child(key, depth, false), depth + 1);
+            let right = self.subtree(&child(key, depth, true), depth + 1);
+            self.nodes.insert(
+                (depth, prefix_range(key, depth).0),
+                node_hash(self.hashing, &left, &right),
+            );
+        }
+    }
+
+    /// Prove the value under `key`
+    pub fn prove(&self, key: &[u8; 32]) -> Result<SmtProof, CcokError> {
+        if !self.leaves.contains_key(key) {
+            return Err(CcokError::BadMerklePath(format!(
+                "key {} is not in the tree",
+                hex::encode(key)
+            )));
+        }
+        let (siblings, _) = self.path(key);
+        Ok(SmtProof { siblings })
+    }
+
+    /// Proofs of every key in key order, in a single pass over the tree
+    /// instead of one per key
+    pub fn prove_all(&self) -> Vec<SmtProof> {
+        let leaves: Vec<(&[u8; 32], &Vec<u8>)> = self.leaves.iter().collect();
+        let (_, mut proofs) = self.prove_subtree(&leaves, 0);
+        for proof in &mut proofs {
+            proof.siblings.reverse();
+        }
+        proofs
+    }
+
+    // Hash of the subtree at `depth` holding `leaves`, as `subtree` gives it,
+    // and the proofs of its leaves below `depth`, siblings from the bottom up
+    fn prove_subtree(
+        &self,
+        leaves: &[(&[u8; 32], &Vec<u8>)],
+        depth: usize,
+    ) -> ([u8; 32], Vec<SmtProof>) {
+        match leaves {
+            [] => (EMPTY, Vec::new()),
+            [(key, value)] => (
+                leaf_hash(self.hashing, key, value),
+                vec![SmtProof {
+                    siblings: Vec::new(),
+                }],
+            ),
+            _ => {
+                let split = leaves.partition_point(|(key, _)| !bit(key, depth));
+                let (left, right) = leaves.split_at(split);
+                let (left_hash, mut left_proofs) = self.prove_subtree(left, depth + 1);
+                let (right_hash, mut right_proofs) = self.prove_subtree(right, depth + 1);
+                for proof in &mut left_proofs {
+                    proof.siblings.push(right_hash);
+                }
+                for proof in &mut right_proofs {
+                    proof.siblings.push(left_hash);
+                }
+                left_proofs.append(&mut right_proofs);
+                (
+                    node_hash(self.hashing, &left_hash, &right_hash),
+                    left_proofs,
+                )
+            }
+        }
+    }
+
+    /// Prove that `key` is not in the tree
+    pub fn prove_absence(&self, key: &[u8; 32]) -> Result<SmtAbsenceProof, CcokError> {
+        if self.leaves.contains_key(key) {
+            return Err(CcokError::BadMerklePath(format!(
+                "key {} is in the tree",
+                hex::encode(key)
+            )));
+        }
+        let (siblings, end) = self.path(key);
+        Ok(SmtAbsenceProof {
+            siblings,
+            leaf: end.map(|(other, value)| (*other, self.hashing.hash(HashDomain::Leaf, value))),
+        })
+    }
+
+    // Siblings on the path of `key` down to the subtree holding at most one
+    // leaf, and that leaf
+    fn path(&self, key: &[u8; 32]) -> (Vec<[u8; 32]>, Option<(&[u8; 32], &Vec<u8>)>) {
+        let mut siblings = Vec::new();
+        let mut depth = 0;
+        loop {
+            match self.leaves_under(key, depth)[..] {
+                [] => return (siblings, None),
+                [leaf] => return (siblings, Some(leaf)),
+                _ => {
+                    let sibling = child(key, depth, !bit(key, depth));
+                    siblings.push(self.subtree(&sibling, depth + 1));
+                    depth += 1;
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::merkle::HashAlgorithm;
+
+    #[test]
+    fn test_sparse_merkle_tree() {
+        let hashing = Hashing::new(HashAlgorithm::Sha256, true);
+        let keys: Vec<[u8; 32]> = (0..20u8)
+            .map(|i| hashing.hash(HashDomain::Leaf, &[i]))
+            .collect();
+        let mut tree = SparseMerkleTree::new(hashing);
+        assert_eq!(tree.root(), EMPTY);
+        for (i, key) in keys.iter().enumerate() {
+            tree.insert(*key, vec![i as u8]);
+        }
+
+        // Every key is proven against the root, under its own value only
+        let root = tree.root();
+        for (i, key) in keys.iter().enumerate() {
+            let proof = tree.prove(key).unwrap();
+            assert!(proof.verify(hashing, &root, key, &[i as u8]));
+            assert!(!proof.verify(hashing, &root, key, &[i as u8 + 1]));
+        }
+        assert!(tree.prove(&[0u8; 32]).is_err());
+        // Proving every key at once gives the same proofs
+        let all: Vec<SmtProof> = tree
+            .iter()
+            .map(|(key, _)| tree.prove(key).unwrap())
+            .collect();
+        assert_eq!(tree.prove_all(), all);
+        assert!(SparseMerkleTree::new(hashing).prove_all().is_empty());
+
+        // Absent keys are proven absent, present ones are not
+        for absent in [[0u8; 32], hashing.hash(HashDomain::Leaf, &[100])] {
+            let proof = tree.prove_absence(&absent).unwrap();
+            assert!(proof.verify(hashing, &root, &absent));
+            assert!(!proof.verify(hashing, &root, &keys[0]));
+        }
+        assert!(tree.prove_absence(&keys[0]).is_err());
+        let empty = SparseMerkleTree::new(hashing);
+        assert!(empty
+            .prove_absence(&keys[0])
+            .unwrap()
+            .verify(hashing, &EMPTY, &keys[0]));
+
+        // The root depends on the contents, not on the insertion order
+        let mut reversed = SparseMerkleTree::new(hashing);
+        for (i, key) in keys.iter().enumerate().rev() {
+            reversed.insert(*key, vec![i as u8]);
+        }
+        assert_eq!(reversed.root(), root);
+        assert_eq!(tree.insert(keys[3], vec![99]), Some(vec![3]));
+        assert_ne!(tree.root(), root);
+        tree.insert(keys[3], vec![3]);
+        // Removing a key restores the root of the tree without it
+        let extra = hashing.hash(HashDomain::Leaf, &[200]);
+        tree.insert(extra, vec![1]);
+        assert_eq!(tree.remove(&extra), Some(vec![1]));
+        assert_eq!(tree.root(), root);
+        for key in &keys {
+            tree.remove(key);
+        }
+        assert_eq!(tree.root(), EMPTY);
+        assert!(tree.nodes.is_empty());
+    }
+
+    #[test]
+    fn test_cached_nodes() {
+        let hashing = Hashing::new(HashAlgorithm::Sha256, true);
+        // Keys sharing long prefixes, so removals collapse deep paths
+        let mut keys: Vec<[u8; 32]> = (0..8u8)
+            .map(|i| {
+                let mut key = [0xaa; 32];
+                key[31] = i;
+                key
+            })
+            .collect();
+        keys.extend((0..40u8).map(|i| hashing.hash(HashDomain::Leaf, &[i])));
+
+        // After every insertion and removal the cached root and proofs match
+        // those of a tree built from the contents
+        let mut tree = SparseMerkleTree::new(hashing);
+        let check = |tree: &SparseMerkleTree| {
+            let mut rebuilt = SparseMerkleTree::new(hashing);
+            for (key, value) in tree.iter() {
+                rebuilt.leaves.insert(*key, value.to_vec());
+            }
+            let leaves: Vec<(&[u8; 32], &Vec<u8>)> = rebuilt.leaves.iter().collect();
+            let (root, proofs) = rebuilt.prove_subtree(&leaves, 0);
+            assert_eq!(tree.root(), root);
+            assert_eq!(tree.prove_all().len(), proofs.len());
+            for (key, value) in tree.iter() {
+                assert!(tree.prove(key).unwrap().verify(hashing, &root, key, value));
+            }
+        };
+        for (i, key) in keys.iter().enumerate() {
+            tree.insert(*key, vec![i as u8]);
+            check(&tree);
+        }
+        for (i, key) in keys.iter().enumerate().step_by(3) {
+            tree.insert(*key, vec![i as u8, 1]);
+            check(&tree);
+        }
+        assert_eq!(tree.remove(&[0xbb; 32]), None);
+        for key in keys.iter().rev().step_by(2) {
+            tree.remove(key);
+            check(&tree);
+            assert!(tree
+                .prove_absence(key)
+                .unwrap()
+                .verify(hashing, &tree.root(), key));
+        }
+        for key in &keys {
+            tree.remove(key);
+        }
+        assert!(tree.nodes.is_empty());
+    }
+}
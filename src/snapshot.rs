@@ -0,0 +1,231 @@
+//! Snapshots of a node, so that a new node can start from a recent height
+//! instead of replaying every block. `Blockchain::snapshot` captures the
+//! account state, the validator set, the tip block and the latest certified
+//! state proofs; `Blockchain::restore` installs them on a fresh node. The file
+//! holds a magic, a format version, the bincode body and its checksum.
+use crate::accounts::{Account, State};
+use crate::block::Block;
+use crate::blockchain::Blockchain;
+use crate::ccok::Certificate;
+use crate::hashchain::HashChainCom;
+use crate::stateproof::StateProof;
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Sha3_256};
+use std::collections::HashMap;
+use std::path::Path;
+
+const MAGIC: &[u8; 4] = b"NPSS";
+const SNAPSHOT_VERSION: u8 = 1;
+/// State proofs carried by a snapshot, the latest ones
+pub const SNAPSHOT_PROOFS: usize = 4;
+
+/// Accounts and balances of a `State`, sorted so that equal states give
+/// equal snapshots
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StateSnapshot {
+    pub accounts: Vec<Account>,
+    pub balances: Vec<(Account, f64)>,
+}
+
+impl From<&State> for StateSnapshot {
+    fn from(state: &State) -> Self {
+        Self {
+            accounts: state.accounts.clone(),
+            balances: sorted(&state.balances),
+        }
+    }
+}
+
+impl From<StateSnapshot> for State {
+    fn from(snapshot: StateSnapshot) -> Self {
+        State {
+            accounts: snapshot.accounts,
+            balances: snapshot.balances.into_iter().collect(),
+        }
+    }
+}
+
+// Entries of a map in key order
+fn sorted<K: Clone + Ord, V: Clone>(map: &HashMap<K, V>) -> Vec<(K, V)> {
+    let mut entries: Vec<(K, V)> = map.iter().map(|(k, v)| (k.clone(), v.clone())).collect();
+    entries.sort_by(|a, b| a.0.cmp(&b.0));
+    entries
+}
+
+/// State of a node at the height of its tip block
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Snapshot {
+    /// Last block executed, the parent of the next one
+    pub tip: Block,
+    pub state: StateSnapshot,
+    pub validators: StateSnapshot,
+    pub hash_chain_com: Vec<(String, HashChainCom)>,
+    pub next_block_hash: Vec<(Account, String)>,
+    pub epoch_timestamp: u64,
+    /// Latest state proofs, oldest first
+    pub state_proofs: Vec<StateProof>,
+    pub last_certificate: Option<(usize, Certificate)>,
+}
+
+impl Snapshot {
+    /// Height of the snapshot
+    pub fn height(&self) -> u64 {
+        self.tip.id as u64
+    }
+
+    /// Check the snapshot is consistent before it is restored
+    pub fn validate(&self) -> Result<(), String> {
+        if self.tip.header().hash()? != self.tip.hash {
+            return Err(format!("Hash of tip block {} does not match", self.tip.id));
+        }
+        if let Some(proof) = self
+            .state_proofs
+            .iter()
+            .find(|proof| proof.message.last_block > self.height())
+        {
+            return Err(format!(
+                "State proof of block {} is past the snapshot height {}",
+                proof.message.last_block,
+                self.height()
+            ));
+        }
+        Ok(())
+    }
+
+    pub fn encode(&self) -> Result<Vec<u8>, String> {
+        let body = bincode::serialize(self).map_err(|e| format!("Serialization error: {}", e))?;
+        let mut bytes = MAGIC.to_vec();
+        bytes.push(SNAPSHOT_VERSION);
+        bytes.extend_from_slice(&body);
+        bytes.extend_from_slice(&Sha3_256::digest(&body));
+        Ok(bytes)
+    }
+
+    pub fn decode(bytes: &[u8]) -> Result<Self, String> {
+        let rest = bytes
+            .strip_prefix(MAGIC)
+            .ok_or_else(|| "Not a snapshot".to_string())?;
+        match rest.first() {
+            Some(&SNAPSHOT_VERSION) => {}
+            Some(version) => return Err(format!("Unsupported snapshot version {}", version)),
+            None => return Err("Truncated snapshot".to_string()),
+        }
+        if rest.len() < 33 {
+            return Err("Truncated snapshot".to_string());
+        }
+        let (body, checksum) = rest[1..].split_at(rest.len() - 33);
+        if Sha3_256::digest(body).as_slice() != checksum {
+            return Err("Snapshot checksum does not match".to_string());
+        }
+        bincode::deserialize(body).map_err(|e| format!("Deserialization error: {}", e))
+    }
+
+    /// Write the snapshot to `path`
+    pub fn save(&self, path: impl AsRef<Path>) -> Result<(), String> {
+        let path = path.as_ref();
+        std::fs::write(path, self.encode()?)
+            .map_err(|e| format!("Failed to write snapshot {}: {}", path.display(), e))
+    }
+
+    /// Read the snapshot at `path`
+    pub fn load(path: impl AsRef<Path>) -> Result<Self, String> {
+        let path = path.as_ref();
+        let bytes = std::fs::read(path)
+            .map_err(|e| format!("Failed to read snapshot {}: {}", path.display(), e))?;
+        Self::decode(&bytes)
+    }
+}
+
+impl Blockchain {
+    /// Snapshot of the node at its tip
+    pub fn snapshot(&self) -> Result<Snapshot, String> {
+        let tip = self
+            .chain
+            .last()
+            .cloned()
+            .ok_or_else(|| "No block to snapshot".to_string())?;
+        let skip = self.state_proofs.len().saturating_sub(SNAPSHOT_PROOFS);
+        Ok(Snapshot {
+            tip,
+            state: StateSnapshot::from(&self.state),
+            validators: StateSnapshot::from(&self.validator.state),
+            hash_chain_com: sorted(&self.validator.hash_chain_com),
+            next_block_hash: sorted(&self.validator.next_block_hash),
+            epoch_timestamp: self.epoch.timestamp,
+            state_proofs: self.state_proofs[skip..].to_vec(),
+            last_certificate: self.last_certificate.clone(),
+        })
+    }
+
+    /// Continue from `snapshot`, replacing the chain and state of the node.
+    /// The wallet, mempool and the node's own hash chain are kept.
+    pub fn restore(&mut self, snapshot: Snapshot) -> Result<(), String> {
+        snapshot.validate()?;
+        self.chain = vec![snapshot.tip];
+        self.state = snapshot.state.into();
+        self.validator.state = snapshot.validators.into();
+        self.validator.hash_chain_com = snapshot.hash_chain_com.into_iter().collect();
+        self.validator.next_block_hash = snapshot.next_block_hash.into_iter().collect();
+        self.epoch.timestamp = snapshot.epoch_timestamp;
+        self.state_proofs = snapshot.state_proofs;
+        self.last_certificate = snapshot.last_certificate;
+        self.pending_signatures.clear();
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_snapshot_restore() {
+        let mut node = Blockchain::new(Wallet::new().expect("Failed to create wallet"));
+        assert!(node.snapshot().is_err());
+        let proposer = Account {
+            address: "proposer".to_string(),
+        };
+        for id in 1..=3 {
+            let parent = node.chain.last().map_or([0u8; 32], |block| block.hash);
+            let block = Block::new(
+                id,
+                parent,
+                id,
+                vec![],
+                proposer.clone(),
+                String::new(),
+                Seed {
+                    seed: [id as u8; 32],
+                },
+                None,
+            )
+            .unwrap();
+            node.execute_block(block);
+        }
+        node.state.balances.insert(proposer.clone(), 42.0);
+        node.validator.state.stake(proposer.clone(), 32.0);
+        node.epoch.timestamp = 7;
+
+        let path = std::env::temp_dir().join(format!("niropok-snapshot-{}", std::process::id()));
+        node.snapshot().unwrap().save(&path).unwrap();
+        let mut fresh = Blockchain::new(Wallet::new().expect("Failed to create wallet"));
+        fresh.restore(Snapshot::load(&path).unwrap()).unwrap();
+        std::fs::remove_file(&path).unwrap();
+        assert_eq!(fresh.get_latest_block_id(), 3);
+        assert_eq!(fresh.chain[0].hash, node.chain[2].hash);
+        assert_eq!(fresh.state, node.state);
+        assert_eq!(fresh.validator.state, node.validator.state);
+        assert_eq!(fresh.epoch.timestamp, 7);
+
+        // Corrupted and inconsistent snapshots are refused
+        let mut bytes = node.snapshot().unwrap().encode().unwrap();
+        let last = bytes.len() - 40;
+        bytes[last] ^= 1;
+        assert!(Snapshot::decode(&bytes).is_err());
+        let mut forged = node.snapshot().unwrap();
+        forged.tip.id = 9;
+        assert!(fresh.restore(forged).is_err());
+    }
+}
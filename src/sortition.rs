@@ -0,0 +1,306 @@
+//! Weighted sortition of a per-round signing committee. Each participant
+//! evaluates a VRF on the round input and holds a seat when the output falls
+//! below a threshold proportional to its weight, so only about
+//! `expected_size` participants need to sign. The certificate is then built
+//! over the committee tree, and the selection proofs let anyone check the
+//! committee against the full participant set.
+use crate::ccok::{Builder, Params, Participant};
+use crate::merkle::{verify_proof_with, AuditPath, Hashing, MerkleTreeBuilder};
+use crate::vrf::{VrfKey, VrfProof};
+use serde::{Deserialize, Serialize};
+
+const INPUT_TAG: &[u8] = b"niropok/sortition\0";
+
+/// Parameters of one round's sortition
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SortitionParams {
+    /// Round the committee signs for
+    pub round: u64,
+    /// Public randomness of the round, e.g. the previous block hash
+    pub seed: Vec<u8>,
+    /// Expected committee size
+    pub expected_size: u64,
+    /// Total weight of the full participant set
+    pub total_weight: u64,
+}
+
+impl SortitionParams {
+    /// Message every participant evaluates its VRF on
+    pub fn input(&self) -> Vec<u8> {
+        let mut input = INPUT_TAG.to_vec();
+        input.extend_from_slice(&self.round.to_le_bytes());
+        input.extend_from_slice(&self.expected_size.to_le_bytes());
+        input.extend_from_slice(&self.total_weight.to_le_bytes());
+        input.extend_from_slice(&self.seed);
+        input
+    }
+
+    /// Selection threshold for `weight`: the probability of a seat, which is
+    /// `expected_size * weight / total_weight` capped at 1, scaled to 2^64
+    pub fn threshold(&self, weight: u64) -> u128 {
+        if self.total_weight == 0 {
+            return 0;
+        }
+        let scaled = (self.expected_size as u128 * weight as u128) << 64;
+        (scaled / self.total_weight as u128).min(1u128 << 64)
+    }
+
+    /// Whether a participant of `weight` with VRF `output` holds a seat
+    pub fn is_selected(&self, weight: u64, output: &[u8; 32]) -> bool {
+        let mut bytes = [0u8; 8];
+        bytes.copy_from_slice(&output[..8]);
+        (u64::from_le_bytes(bytes) as u128) < self.threshold(weight)
+    }
+}
+
+/// Seat of a participant that won the sortition
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Selection {
+    /// Position of the participant in the full participant set
+    pub index: usize,
+    /// The selected participant
+    pub participant: Participant,
+    /// VRF output on the sortition input
+    pub output: [u8; 32],
+    /// VRF proof of `output` under the participant's VRF key
+    pub proof: VrfProof,
+    /// Membership of the participant in the full party tree
+    pub path: AuditPath,
+}
+
+impl Selection {
+    /// Run the sortition for the participant at `index` of `party_tree`.
+    /// Returns `None` when the participant isn't selected.
+    pub fn try_select(
+        params: &SortitionParams,
+        key: &VrfKey,
+        index: usize,
+        participant: &Participant,
+        party_tree: &MerkleTreeBuilder,
+    ) -> Result<Option<Self>, String> {
+        if participant.vrf_key.as_ref() != Some(&key.public_key()) {
+            return Err(format!("VRF key does not match participant {}", index));
+        }
+        let (output, proof) = key.prove(params.round, &params.input())?;
+        if !params.is_selected(participant.weight, &output) {
+            return Ok(None);
+        }
+        Ok(Some(Self {
+            index,
+            participant: participant.clone(),
+            output,
+            proof,
+            path: party_tree.prove_leaf(index)?,
+        }))
+    }
+
+    /// Check the selection proof and the participant's membership
+    pub fn verify(
+        &self,
+        params: &SortitionParams,
+        party_tree_root: &[u8],
+        hashing: Hashing,
+    ) -> Result<(), String> {
+        let party = &self.participant;
+        let leaf = hashing.leaf_hash(party)?;
+        if !verify_proof_with(hashing, party_tree_root, self.index, &leaf, &self.path) {
+            return Err(format!(
+                "Participant {} is not in the party tree",
+                self.index
+            ));
+        }
+        let vrf_key = party
+            .vrf_key
+            .as_ref()
+            .ok_or_else(|| format!("Participant {} has no VRF key", self.index))?;
+        if self.proof.round != params.round
+            || vrf_key.verify(&params.input(), &self.proof)? != self.output
+        {
+            return Err(format!(
+                "Invalid selection proof for participant {}",
+                self.index
+            ));
+        }
+        if !params.is_selected(party.weight, &self.output) {
+            return Err(format!("Participant {} was not selected", self.index));
+        }
+        Ok(())
+    }
+}
+
+/// Committee of one round, ordered by position in the full participant set
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Committee {
+    /// Sortition the committee was selected by
+    pub params: SortitionParams,
+    /// Selected participants
+    pub members: Vec<Selection>,
+}
+
+impl Committee {
+    /// Committee from the selections collected for a round
+    pub fn new(params: SortitionParams, mut members: Vec<Selection>) -> Result<Self, String> {
+        members.sort_by_key(|member| member.index);
+        if let Some(pair) = members
+            .windows(2)
+            .find(|pair| pair[0].index == pair[1].index)
+        {
+            return Err(format!("Participant {} selected twice", pair[0].index));
+        }
+        Ok(Self { params, members })
+    }
+
+    /// Committee participants, in committee order
+    pub fn participants(&self) -> Vec<Participant> {
+        self.members
+            .iter()
+            .map(|member| member.participant.clone())
+            .collect()
+    }
+
+    /// Leader of the round: the member with the lowest VRF output. With a
+    /// small `expected_size` this is a verifiable weighted leader election.
+    pub fn leader(&self) -> Option<&Selection> {
+        self.members.iter().min_by_key(|member| member.output)
+    }
+
+    /// Total weight of the committee
+    pub fn weight(&self) -> u64 {
+        self.members
+            .iter()
+            .map(|member| member.participant.weight)
+            .sum()
+    }
+
+    /// Party tree over the committee, which certificates are built against
+    pub fn party_tree(&self, hashing: Hashing) -> Result<MerkleTreeBuilder, String> {
+        let mut tree = MerkleTreeBuilder::with_hash(hashing);
+        tree.build(&self.participants())?;
+        Ok(tree)
+    }
+
+    /// Builder collecting the committee's signatures. `params.proven_weight`
+    /// is relative to the committee weight.
+    pub fn builder(&self, params: Params) -> Result<Builder, String> {
+        if self.members.is_empty() {
+            return Err("Empty committee".to_string());
+        }
+        let root = self.party_tree(params.hashing())?.root();
+        Ok(Builder::new(params, self.participants(), root)?)
+    }
+
+    /// Check every selection against the full party tree and return the root
+    /// of the committee tree to verify the certificate with
+    pub fn verify(&self, party_tree_root: &[u8], hashing: Hashing) -> Result<Vec<u8>, String> {
+        if self
+            .members
+            .windows(2)
+            .any(|pair| pair[0].index >= pair[1].index)
+        {
+            return Err("Committee members are not ordered".to_string());
+        }
+        for member in &self.members {
+            member.verify(&self.params, party_tree_root, hashing)?;
+        }
+        Ok(self.party_tree(hashing)?.root())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ephemeral::KeyLifetime;
+    use crate::merkle::HashAlgorithm;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_committee_certificate() {
+        let wallets: Vec<Wallet> = (0..40)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let vrf_keys: Vec<VrfKey> = (0..wallets.len())
+            .map(|_| VrfKey::generate(KeyLifetime::new(0, 8)).unwrap())
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .zip(&vrf_keys)
+            .enumerate()
+            .map(|(i, (w, key))| {
+                Participant::from_signer(w, 10 + i as u64).with_vrf_key(key.public_key())
+            })
+            .collect();
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let mut party_tree = MerkleTreeBuilder::with_hash(hashing);
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let sortition = SortitionParams {
+            round: 3,
+            seed: b"previous block hash".to_vec(),
+            expected_size: 10,
+            total_weight: participants.iter().map(|p| p.weight).sum(),
+        };
+
+        let selections: Vec<Selection> = vrf_keys
+            .iter()
+            .zip(&participants)
+            .enumerate()
+            .filter_map(|(i, (key, party))| {
+                Selection::try_select(&sortition, key, i, party, &party_tree).unwrap()
+            })
+            .collect();
+        assert!(!selections.is_empty() && selections.len() < participants.len());
+        let committee = Committee::new(sortition.clone(), selections).unwrap();
+        let committee_root = committee.verify(&party_tree.root(), hashing).unwrap();
+        let leader = committee.leader().unwrap();
+        assert!(committee.members.iter().all(|m| leader.output <= m.output));
+
+        // The committee signs; the certificate verifies against its tree
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: committee.weight() / 2,
+            ..Default::default()
+        };
+        let mut builder = committee.builder(params.clone()).unwrap();
+        for (pos, member) in committee.members.iter().enumerate() {
+            builder
+                .add_signature(
+                    pos,
+                    wallets[member.index].sign_message(&params.signing_message()),
+                )
+                .expect("Failed to add signature");
+        }
+        let cert = builder.build().expect("Failed to build certificate");
+        assert!(cert.verify(&params, &committee_root).unwrap());
+
+        // Selections can't be forged, moved or reused for another round
+        let mut forged = committee.clone();
+        forged.members[0].index = (forged.members[0].index + 1) % participants.len();
+        assert!(forged.verify(&party_tree.root(), hashing).is_err());
+        let mut replayed = committee.clone();
+        replayed.params.round += 1;
+        assert!(replayed.verify(&party_tree.root(), hashing).is_err());
+        let mut ground = committee.clone();
+        ground.members[0].output = [0; 32];
+        assert!(ground.verify(&party_tree.root(), hashing).is_err());
+        assert!(
+            Selection::try_select(&sortition, &vrf_keys[1], 0, &participants[0], &party_tree)
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_threshold() {
+        let params = SortitionParams {
+            round: 0,
+            seed: Vec::new(),
+            expected_size: 2,
+            total_weight: 100,
+        };
+        assert_eq!(params.threshold(0), 0);
+        assert_eq!(params.threshold(25), 1u128 << 63);
+        assert_eq!(params.threshold(100), 1u128 << 64);
+        assert!(params.is_selected(100, &[0xff; 32]));
+        assert!(!params.is_selected(25, &[0xff; 32]));
+    }
+}
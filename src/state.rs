@@ -0,0 +1,638 @@
+//! Account state of the typed transactions: balance, nonce and stake of every
+//! account, kept in a sparse Merkle tree keyed by the hash of the address.
+//! The tree root is the state root of the block headers, so a light client
+//! holding a certified header can check any account with an `AccountProof`.
+//! Transactions pay the base fee of the `fees` market and tip the proposer;
+//! each block settles its base fees and adjusts the base fee for the next.
+use crate::accounts::Account;
+use crate::block::Block;
+use crate::fees::{fee_market_key, split_by_weight, FeeConfig, FeeMarket, FeeSink};
+use crate::merkle::{HashDomain, Hashing};
+use crate::smt::{SmtAbsenceProof, SmtProof, SparseMerkleTree};
+use crate::tx::{SignedTx, TxBody, TxVerifier};
+use serde::{Deserialize, Serialize};
+
+/// State of one account
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct AccountState {
+    /// Spendable balance
+    pub balance: u64,
+    /// Nonce of the account's next transaction
+    pub nonce: u64,
+    /// Balance locked as validator stake
+    pub stake: u64,
+}
+
+/// Key of `account` in the state tree
+pub fn account_key(hashing: Hashing, account: &Account) -> [u8; 32] {
+    hashing.hash(HashDomain::Leaf, account.address.as_bytes())
+}
+
+/// Path of an account in the state tree
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub enum AccountWitness {
+    /// The account is in the tree
+    Present(SmtProof),
+    /// The account is not, so its state is zero
+    Absent(SmtAbsenceProof),
+}
+
+/// Proof of an account's state under a state root
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct AccountProof {
+    pub account: Account,
+    pub state: AccountState,
+    pub proof: AccountWitness,
+}
+
+impl AccountProof {
+    /// Check the account state against `state_root`
+    pub fn verify(&self, hashing: Hashing, state_root: &[u8; 32]) -> bool {
+        let key = account_key(hashing, &self.account);
+        match &self.proof {
+            AccountWitness::Present(proof) => match bincode::serialize(&self.state) {
+                Ok(value) => proof.verify(hashing, state_root, &key, &value),
+                Err(_) => false,
+            },
+            AccountWitness::Absent(proof) => {
+                self.state == AccountState::default() && proof.verify(hashing, state_root, &key)
+            }
+        }
+    }
+}
+
+/// Account state machine applying the typed transactions of blocks
+#[derive(Debug, Clone)]
+pub struct ChainState {
+    tree: SparseMerkleTree,
+    verifier: TxVerifier,
+    fees: FeeConfig,
+    /// Previous values of the keys written since `atomically` began, to undo
+    /// them if it fails
+    journal: Option<Vec<([u8; 32], Option<Vec<u8>>)>>,
+}
+
+fn add(value: u64, amount: u64) -> Result<u64, String> {
+    value
+        .checked_add(amount)
+        .ok_or_else(|| "Amount overflow".to_string())
+}
+
+fn sub(value: u64, amount: u64, what: &str) -> Result<u64, String> {
+    value
+        .checked_sub(amount)
+        .ok_or_else(|| format!("Insufficient {}: {} < {}", what, value, amount))
+}
+
+impl ChainState {
+    /// Empty state hashed with `hashing`
+    pub fn new(hashing: Hashing) -> Self {
+        Self {
+            tree: SparseMerkleTree::new(hashing),
+            verifier: TxVerifier::new(),
+            fees: FeeConfig::default(),
+            journal: None,
+        }
+    }
+
+    /// State held by `tree`, e.g. assembled from a verified snapshot, charging
+    /// fees by the market `fees` of its chain
+    pub fn from_tree(tree: SparseMerkleTree, fees: FeeConfig) -> Result<Self, String> {
+        Self {
+            tree,
+            verifier: TxVerifier::new(),
+            fees: FeeConfig::default(),
+            journal: None,
+        }
+        .with_fees(fees)
+    }
+
+    /// Check transaction signatures with `verifier`
+    pub fn with_verifier(mut self, verifier: TxVerifier) -> Self {
+        self.verifier = verifier;
+        self
+    }
+
+    /// Charge fees by the market `fees`, as the genesis file sets it
+    pub fn with_fees(mut self, fees: FeeConfig) -> Result<Self, String> {
+        fees.validate()?;
+        self.fees = fees;
+        Ok(self)
+    }
+
+    /// Fee market config of the chain
+    pub fn fees(&self) -> &FeeConfig {
+        &self.fees
+    }
+
+    /// Fee market state, the genesis one before the first block
+    pub fn fee_market(&self) -> FeeMarket {
+        self.tree
+            .get(&fee_market_key(self.hashing()))
+            .and_then(|value| bincode::deserialize(value).ok())
+            .unwrap_or_else(|| self.fees.genesis())
+    }
+
+    /// Base fee transactions of the next block must pay
+    pub fn base_fee(&self) -> u64 {
+        self.fee_market().base_fee
+    }
+
+    // The genesis market is left out, like zero accounts
+    fn set_fee_market(&mut self, market: FeeMarket) -> Result<(), String> {
+        let key = fee_market_key(self.hashing());
+        if market == self.fees.genesis() {
+            self.write(key, None);
+            return Ok(());
+        }
+        let value =
+            bincode::serialize(&market).map_err(|e| format!("Serialization error: {}", e))?;
+        self.write(key, Some(value));
+        Ok(())
+    }
+
+    // Set or remove the value under `key`, journaling the previous one
+    fn write(&mut self, key: [u8; 32], value: Option<Vec<u8>>) {
+        let previous = match value {
+            Some(value) => self.tree.insert(key, value),
+            None => self.tree.remove(&key),
+        };
+        if let Some(journal) = &mut self.journal {
+            journal.push((key, previous));
+        }
+    }
+
+    // Run `f`, undoing its writes if it fails. Only the keys written are
+    // restored, so a failed block costs no more than the writes it made.
+    fn atomically<T>(
+        &mut self,
+        f: impl FnOnce(&mut Self) -> Result<T, String>,
+    ) -> Result<T, String> {
+        let outer = self.journal.replace(Vec::new());
+        let result = f(self);
+        let journal = std::mem::replace(&mut self.journal, outer).unwrap_or_default();
+        match &result {
+            Ok(_) => {
+                if let Some(outer) = &mut self.journal {
+                    outer.extend(journal);
+                }
+            }
+            Err(_) => {
+                for (key, previous) in journal.into_iter().rev() {
+                    match previous {
+                        Some(value) => self.tree.insert(key, value),
+                        None => self.tree.remove(&key),
+                    };
+                }
+            }
+        }
+        result
+    }
+
+    /// Hash function of the state tree
+    pub fn hashing(&self) -> Hashing {
+        self.tree.hashing()
+    }
+
+    /// Tree of the account states, keyed by `account_key`
+    pub fn tree(&self) -> &SparseMerkleTree {
+        &self.tree
+    }
+
+    /// State root, committed in block headers
+    pub fn root(&self) -> [u8; 32] {
+        self.tree.root()
+    }
+
+    /// State of `account`, zero if it never received anything
+    pub fn account(&self, account: &Account) -> AccountState {
+        self.tree
+            .get(&account_key(self.hashing(), account))
+            .and_then(|value| bincode::deserialize(value).ok())
+            .unwrap_or_default()
+    }
+
+    // Zero states are removed, so the root doesn't depend on accounts that
+    // only ever held nothing
+    fn set(&mut self, account: &Account, state: AccountState) -> Result<(), String> {
+        let key = account_key(self.hashing(), account);
+        if state == AccountState::default() {
+            self.write(key, None);
+            return Ok(());
+        }
+        let value =
+            bincode::serialize(&state).map_err(|e| format!("Serialization error: {}", e))?;
+        self.write(key, Some(value));
+        Ok(())
+    }
+
+    /// Credit `amount` to `account`, e.g. from genesis or a bridge deposit
+    pub fn credit(&mut self, account: &Account, amount: u64) -> Result<(), String> {
+        let mut state = self.account(account);
+        state.balance = add(state.balance, amount)?;
+        self.set(account, state)
+    }
+
+    /// Lock `amount` as stake of `account` outside a transaction, e.g. at
+    /// genesis
+    pub fn bond(&mut self, account: &Account, amount: u64) -> Result<(), String> {
+        let mut state = self.account(account);
+        state.stake = add(state.stake, amount)?;
+        self.set(account, state)
+    }
+
+    /// Burn up to `amount` of the stake of `account`, e.g. for verified
+    /// misbehavior evidence, returning the amount burnt
+    pub fn slash(&mut self, account: &Account, amount: u64) -> Result<u64, String> {
+        let mut state = self.account(account);
+        let burnt = amount.min(state.stake);
+        state.stake -= burnt;
+        self.set(account, state)?;
+        Ok(burnt)
+    }
+
+    /// Apply a verified transaction, paying its tip above the base fee to
+    /// `proposer`. `apply_txs` settles the base fee with the block's.
+    pub fn apply_tx(&mut self, tx: &SignedTx, proposer: &Account) -> Result<(), String> {
+        let unsigned = &tx.tx;
+        let sender = &unsigned.sender;
+        let base_fee = self.base_fee();
+        if unsigned.fee < base_fee {
+            return Err(format!(
+                "Fee {} of {} below the base fee {}",
+                unsigned.fee, sender.address, base_fee
+            ));
+        }
+        let mut state = self.account(sender);
+        if unsigned.nonce != state.nonce {
+            return Err(format!(
+                "Nonce {} of {} out of order, expected {}",
+                unsigned.nonce, sender.address, state.nonce
+            ));
+        }
+        state.nonce += 1;
+        state.balance = sub(state.balance, unsigned.fee, "balance")?;
+        match &unsigned.body {
+            TxBody::Payment(payment) => {
+                state.balance = sub(state.balance, payment.amount, "balance")?;
+                self.set(sender, state)?;
+                self.credit(&payment.recipient, payment.amount)?;
+            }
+            TxBody::Stake(stake) => {
+                state.balance = sub(state.balance, stake.amount, "balance")?;
+                state.stake = add(state.stake, stake.amount)?;
+                self.set(sender, state)?;
+            }
+            TxBody::Unstake(unstake) => {
+                state.stake = sub(state.stake, unstake.amount, "stake")?;
+                state.balance = add(state.balance, unstake.amount)?;
+                self.set(sender, state)?;
+            }
+            TxBody::Register(_) => {
+                // Registrations are tracked by the validator set, and by the
+                // fee market when validators share base fees
+                self.set(sender, state)?;
+                if self.fees.sink == FeeSink::Validators {
+                    let mut market = self.fee_market();
+                    if let Err(i) = market.validators.binary_search(sender) {
+                        market.validators.insert(i, sender.clone());
+                        self.set_fee_market(market)?;
+                    }
+                }
+            }
+            TxBody::Governance(_) => {
+                // Enacted by governance
+                self.set(sender, state)?;
+            }
+            TxBody::BridgeWithdraw(withdraw) => {
+                // Burnt here, released by the main chain vault
+                state.balance = sub(state.balance, withdraw.amount, "balance")?;
+                self.set(sender, state)?;
+            }
+        }
+        self.credit(proposer, unsigned.fee - base_fee)
+    }
+
+    /// Apply `txs`, those of one block, in order, all or none, then settle
+    /// their base fees; returns the new state root
+    pub fn apply_txs(&mut self, txs: &[SignedTx], proposer: &Account) -> Result<[u8; 32], String> {
+        self.verifier.verify_all(txs)?;
+        self.atomically(|state| {
+            for tx in txs {
+                state.apply_tx(tx, proposer)?;
+            }
+            state.settle_fees(txs.len(), proposer)?;
+            Ok(state.root())
+        })
+    }
+
+    // Burn or pay out the base fees of a block of `txs` transactions, and
+    // adjust the base fee for the next block
+    fn settle_fees(&mut self, txs: usize, proposer: &Account) -> Result<(), String> {
+        let mut market = self.fee_market();
+        let base_fees = market
+            .base_fee
+            .checked_mul(txs as u64)
+            .ok_or_else(|| "Amount overflow".to_string())?;
+        match self.fees.sink {
+            FeeSink::Burn => market.burnt = add(market.burnt, base_fees)?,
+            FeeSink::Proposer => self.credit(proposer, base_fees)?,
+            FeeSink::Validators => {
+                // Validators left without stake stop sharing fees, so the
+                // list can't grow with accounts that unstaked
+                market
+                    .validators
+                    .retain(|validator| self.account(validator).stake > 0);
+                let stakes: Vec<(Account, u64)> = market
+                    .validators
+                    .iter()
+                    .map(|validator| (validator.clone(), self.account(validator).stake))
+                    .collect();
+                let (shares, rest) = split_by_weight(base_fees, &stakes);
+                for (validator, share) in shares {
+                    self.credit(&validator, share)?;
+                }
+                self.credit(proposer, rest)?;
+            }
+        }
+        market.base_fee = self.fees.next_base_fee(market.base_fee, txs);
+        self.set_fee_market(market)
+    }
+
+    /// Apply the typed transactions of `block`, failing unless the result is
+    /// the state root of its header
+    pub fn apply_block(&mut self, block: &Block) -> Result<[u8; 32], String> {
+        self.atomically(|state| {
+            let root = state.apply_txs(&block.txs, &block.proposer_address)?;
+            if root != block.state_root {
+                return Err(format!(
+                    "State root {} of block {} does not match {}",
+                    hex::encode(block.state_root),
+                    block.id,
+                    hex::encode(root)
+                ));
+            }
+            Ok(root)
+        })
+    }
+
+    /// Prove the state of `account` under the current root, zero for
+    /// accounts not in the tree
+    pub fn get_proof(&self, account: &Account) -> Result<AccountProof, String> {
+        let key = account_key(self.hashing(), account);
+        let proof = if self.tree.get(&key).is_some() {
+            AccountWitness::Present(self.tree.prove(&key)?)
+        } else {
+            AccountWitness::Absent(self.tree.prove_absence(&key)?)
+        };
+        Ok(AccountProof {
+            account: account.clone(),
+            state: self.account(account),
+            proof,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::block::BlockBuilder;
+    use crate::mempool::Mempool;
+    use crate::merkle::HashAlgorithm;
+    use crate::signer::Signer;
+    use crate::tx::{Payment, Register, Stake, UnsignedTx};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_apply_block() {
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let alice = Account {
+            address: wallet.public_key_hex(),
+        };
+        let bob = Account {
+            address: "bob".to_string(),
+        };
+        let proposer = Account {
+            address: "proposer".to_string(),
+        };
+        let mut state = ChainState::new(hashing);
+        state.credit(&alice, 100).unwrap();
+
+        let txs = vec![
+            UnsignedTx::new(
+                &wallet,
+                0,
+                1,
+                Payment {
+                    recipient: bob.clone(),
+                    amount: 30,
+                },
+            )
+            .sign(&wallet)
+            .unwrap(),
+            UnsignedTx::new(&wallet, 1, 1, Stake { amount: 50 })
+                .sign(&wallet)
+                .unwrap(),
+        ];
+        // The proposer computes the state root on a copy of the state
+        let root = state.clone().apply_txs(&txs, &proposer).unwrap();
+        let block = BlockBuilder::new(
+            None,
+            0,
+            proposer.clone(),
+            String::new(),
+            Seed { seed: [0u8; 32] },
+        )
+        .with_txs(txs.clone())
+        .with_state_root(root)
+        .build(&mut Mempool::new())
+        .unwrap();
+
+        // A block claiming another root leaves the state untouched
+        let before = state.root();
+        let mut wrong = block.clone();
+        wrong.state_root = [1u8; 32];
+        assert!(state.apply_block(&wrong).is_err());
+        assert_eq!(state.account(&alice).nonce, 0);
+        assert_eq!(state.root(), before);
+
+        // So does a transaction failing after others applied
+        let overdraft = UnsignedTx::new(
+            &wallet,
+            1,
+            1,
+            Payment {
+                recipient: bob.clone(),
+                amount: 1000,
+            },
+        )
+        .sign(&wallet)
+        .unwrap();
+        assert!(state
+            .apply_txs(&[txs[0].clone(), overdraft], &proposer)
+            .is_err());
+        assert_eq!(state.root(), before);
+        assert_eq!(state.account(&bob), AccountState::default());
+
+        assert_eq!(state.apply_block(&block).unwrap(), root);
+        assert_eq!(
+            state.account(&alice),
+            AccountState {
+                balance: 18,
+                nonce: 2,
+                stake: 50,
+            }
+        );
+        assert_eq!(state.account(&proposer).balance, 2);
+        // Replaying the block fails on the nonces
+        assert!(state.clone().apply_txs(&txs, &proposer).is_err());
+
+        // Balances are proven against the root of the header
+        let proof = state.get_proof(&bob).unwrap();
+        assert_eq!(proof.state.balance, 30);
+        assert!(proof.verify(hashing, &block.header().state_root));
+        let mut inflated = proof.clone();
+        inflated.state.balance = 31;
+        assert!(!inflated.verify(hashing, &block.header().state_root));
+        let carol = Account {
+            address: "carol".to_string(),
+        };
+        let absent = state.get_proof(&carol).unwrap();
+        assert!(absent.verify(hashing, &block.header().state_root));
+        let mut claimed = absent.clone();
+        claimed.state.balance = 1;
+        assert!(!claimed.verify(hashing, &block.header().state_root));
+    }
+
+    #[test]
+    fn test_block_fees() {
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let account = |address: &str| Account {
+            address: address.to_string(),
+        };
+        let alice = account(&wallet.public_key_hex());
+        let proposer = account("proposer");
+        let fees = FeeConfig {
+            initial_base_fee: 4,
+            min_base_fee: 1,
+            target_txs: 1,
+            change_denominator: 2,
+            sink: FeeSink::Validators,
+        };
+        assert!(ChainState::new(hashing)
+            .with_fees(FeeConfig {
+                target_txs: 0,
+                ..fees
+            })
+            .is_err());
+        let mut state = ChainState::new(hashing).with_fees(fees).unwrap();
+        state.credit(&alice, 100).unwrap();
+        let pay = |nonce: u64, fee: u64| {
+            UnsignedTx::new(
+                &wallet,
+                nonce,
+                fee,
+                Payment {
+                    recipient: account("bob"),
+                    amount: 10,
+                },
+            )
+            .sign(&wallet)
+            .unwrap()
+        };
+
+        // Fees below the base fee are refused
+        assert!(state.clone().apply_txs(&[pay(0, 3)], &proposer).is_err());
+
+        // Two validators staking 1 and 3 register, sharing the base fees of
+        // their own block, which is above the target and raises the base fee
+        let validators: Vec<Wallet> = (0..2)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let registrations: Vec<SignedTx> = validators
+            .iter()
+            .zip([1, 3])
+            .map(|(validator, stake)| {
+                let address = account(&validator.public_key_hex());
+                state.credit(&address, 4).unwrap();
+                state.bond(&address, stake).unwrap();
+                UnsignedTx::new(
+                    validator,
+                    0,
+                    4,
+                    Register {
+                        public_key: validator.public_key_hex(),
+                        scheme: validator.scheme(),
+                    },
+                )
+                .sign(validator)
+                .unwrap()
+            })
+            .collect();
+        state.apply_txs(&registrations, &proposer).unwrap();
+        let (v1, v2) = (
+            account(&validators[0].public_key_hex()),
+            account(&validators[1].public_key_hex()),
+        );
+        let mut registered = vec![v1.clone(), v2.clone()];
+        registered.sort();
+        assert_eq!(state.fee_market().validators, registered);
+        assert_eq!(state.account(&v1).balance, 2);
+        assert_eq!(state.account(&v2).balance, 6);
+        assert_eq!(state.base_fee(), 6);
+
+        // The proposer gets the tips, the validators the base fees by stake
+        let txs = vec![pay(0, 7), pay(1, 7)];
+        let root = state.clone().apply_txs(&txs, &proposer).unwrap();
+        let block = BlockBuilder::new(
+            None,
+            0,
+            proposer.clone(),
+            String::new(),
+            Seed { seed: [0u8; 32] },
+        )
+        .with_txs(txs.clone())
+        .with_state_root(root)
+        .build(&mut Mempool::new())
+        .unwrap();
+        let mut burning = ChainState::from_tree(
+            state.tree().clone(),
+            FeeConfig {
+                sink: FeeSink::Burn,
+                ..fees
+            },
+        )
+        .unwrap();
+        assert_eq!(state.apply_block(&block).unwrap(), root);
+        assert_eq!(state.account(&alice).balance, 66);
+        assert_eq!(state.account(&proposer).balance, 2);
+        assert_eq!(state.account(&v1).balance, 5);
+        assert_eq!(state.account(&v2).balance, 15);
+        assert_eq!(state.base_fee(), 9);
+
+        // Burnt fees are committed in the state root
+        assert!(burning.apply_block(&block).is_err());
+        burning.apply_txs(&txs, &proposer).unwrap();
+        assert_eq!(burning.fee_market().burnt, 12);
+        assert_eq!(burning.account(&proposer).balance, 2);
+        let chunks = crate::fastsync::state_chunks(&burning, 8).unwrap();
+        let (market, proof) = chunks[0].fee_market.clone().unwrap();
+        assert_eq!(market, burning.fee_market());
+        assert!(proof.verify(
+            hashing,
+            &burning.root(),
+            &fee_market_key(hashing),
+            &bincode::serialize(&market).unwrap()
+        ));
+
+        // A validator whose stake is gone no longer shares base fees
+        state.slash(&v1, 1).unwrap();
+        state.apply_txs(&[pay(2, 9)], &proposer).unwrap();
+        assert_eq!(state.fee_market().validators, vec![v2.clone()]);
+        assert_eq!(state.account(&v1).balance, 5);
+        assert_eq!(state.account(&v2).balance, 24);
+    }
+}
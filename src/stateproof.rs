@@ -0,0 +1,284 @@
+//! State proofs: every `STATE_PROOF_INTERVAL` blocks the current voters sign a
+//! commitment to the interval's block headers together with the commitment to
+//! the voters of the next interval and a compact certificate is built over it.
+//! Each proof is verified against the voters committed by the one before, so a
+//! main chain holding the first voters commitment can follow the sidechain one
+//! interval at a time.
+use crate::block::{Block, BlockHeader};
+use crate::ccok::{Certificate, Params, Participant, Verifier};
+use crate::config::STATE_PROOF_INTERVAL;
+use crate::error::CcokError;
+use crate::merkle::{AuditPath, HashDomain, Hashing, MerkleTreeBuilder};
+use serde::{Deserialize, Serialize};
+
+/// Message signed by the voters of an interval
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct StateProofMessage {
+    /// First block of the interval
+    pub first_block: u64,
+    /// Last block of the interval
+    pub last_block: u64,
+    /// Merkle root over the headers of the interval's blocks, in order
+    pub block_headers_commitment: Vec<u8>,
+    /// Party tree root of the voters signing the next interval
+    pub voters_commitment: Vec<u8>,
+}
+
+impl StateProofMessage {
+    /// Message for consecutive `blocks` of one interval, handing over to the
+    /// voters committed by `voters_commitment`
+    pub fn new(
+        hashing: Hashing,
+        blocks: &[Block],
+        voters_commitment: Vec<u8>,
+    ) -> Result<Self, CcokError> {
+        let first = blocks.first().ok_or(CcokError::EmptyTree)?;
+        if let Some(pos) = blocks
+            .windows(2)
+            .position(|pair| pair[1].id != pair[0].id + 1)
+        {
+            return Err(CcokError::InvalidStateProof(format!(
+                "block {} does not follow block {}",
+                blocks[pos + 1].id,
+                blocks[pos].id
+            )));
+        }
+        let tree = header_tree(hashing, blocks)?;
+        Ok(Self {
+            first_block: first.id as u64,
+            last_block: first.id as u64 + blocks.len() as u64 - 1,
+            block_headers_commitment: tree.root(),
+            voters_commitment,
+        })
+    }
+
+    /// Digest of the message, the `msg` of the certificate params
+    pub fn digest(&self, hashing: Hashing) -> Result<Vec<u8>, CcokError> {
+        let bytes = bincode::serialize(self)?;
+        Ok(hashing.hash(HashDomain::Message, &bytes).to_vec())
+    }
+
+    /// Certificate params of the message: `template` with the message digest
+    pub fn params(&self, template: &Params) -> Result<Params, CcokError> {
+        let mut params = template.clone();
+        params.msg = self.digest(template.hashing())?;
+        Ok(params)
+    }
+}
+
+// Merkle tree over the headers of `blocks`
+fn header_tree(hashing: Hashing, blocks: &[Block]) -> Result<MerkleTreeBuilder, CcokError> {
+    let headers: Vec<BlockHeader> = blocks.iter().map(Block::header).collect();
+    let mut tree = MerkleTreeBuilder::with_hash(hashing);
+    tree.build(&headers)?;
+    Ok(tree)
+}
+
+/// Headers commitment of an interval of `headers`, as signed in its message
+pub fn headers_commitment(hashing: Hashing, headers: &[BlockHeader]) -> Result<Vec<u8>, CcokError> {
+    let mut tree = MerkleTreeBuilder::with_hash(hashing);
+    tree.build(headers)?;
+    Ok(tree.root())
+}
+
+/// Path of the header of `blocks[index]` to the interval's headers commitment
+pub fn prove_header(
+    hashing: Hashing,
+    blocks: &[Block],
+    index: usize,
+) -> Result<AuditPath, CcokError> {
+    header_tree(hashing, blocks)?.prove_leaf(index)
+}
+
+/// Whether the voters sign a state proof after block `block_id`; intervals
+/// start at block 1
+pub fn is_interval_end(block_id: usize) -> bool {
+    block_id as u64 % STATE_PROOF_INTERVAL == 0
+}
+
+/// Commitment to a voter set, the root of its party tree
+pub fn voters_commitment(hashing: Hashing, voters: &[Participant]) -> Result<Vec<u8>, CcokError> {
+    let mut tree = MerkleTreeBuilder::with_hash(hashing);
+    tree.build(voters)?;
+    Ok(tree.root())
+}
+
+/// Certificate of one interval together with the message it signs
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StateProof {
+    /// The signed interval
+    pub message: StateProofMessage,
+    /// Certificate of the interval's voters over the message
+    pub certificate: Certificate,
+}
+
+impl StateProof {
+    /// Verify the proof was signed by the voters committed by
+    /// `voters_commitment`, under the params `template`
+    pub fn verify(&self, voters_commitment: &[u8], template: &Params) -> Result<bool, CcokError> {
+        let params = self.message.params(template)?;
+        Verifier::new(voters_commitment.to_vec()).verify(&self.certificate, &params)
+    }
+}
+
+/// Follows a chain of state proofs from a trusted voters commitment
+#[derive(Debug, Clone)]
+pub struct StateProofVerifier {
+    /// Params of the certificates, apart from their message
+    pub template: Params,
+    /// Number of blocks of every interval
+    pub interval: u64,
+    /// Voters expected to sign the next interval
+    pub voters_commitment: Vec<u8>,
+    /// First block of the next interval
+    pub next_block: u64,
+}
+
+impl StateProofVerifier {
+    /// Verifier trusting `voters_commitment` to sign the interval starting at `next_block`
+    pub fn new(
+        template: Params,
+        interval: u64,
+        voters_commitment: Vec<u8>,
+        next_block: u64,
+    ) -> Self {
+        Self {
+            template,
+            interval,
+            voters_commitment,
+            next_block,
+        }
+    }
+
+    /// Accept the proof of the next interval and move on to the voters it commits to
+    pub fn advance(&mut self, proof: &StateProof) -> Result<(), CcokError> {
+        let message = &proof.message;
+        if message.first_block != self.next_block {
+            return Err(CcokError::InvalidStateProof(format!(
+                "interval starts at block {}, expected {}",
+                message.first_block, self.next_block
+            )));
+        }
+        if message.last_block + 1 != self.next_block + self.interval {
+            return Err(CcokError::InvalidStateProof(format!(
+                "interval ends at block {}, expected {}",
+                message.last_block,
+                self.next_block + self.interval - 1
+            )));
+        }
+        if !proof.verify(&self.voters_commitment, &self.template)? {
+            return Err(CcokError::InvalidStateProof(format!(
+                "certificate of blocks {}..={} does not verify",
+                message.first_block, message.last_block
+            )));
+        }
+        self.voters_commitment = message.voters_commitment.clone();
+        self.next_block = message.last_block + 1;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::ccok::Builder;
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    // Consecutive empty blocks `first..first + count`
+    fn blocks(first: usize, count: usize) -> Vec<Block> {
+        (first..first + count)
+            .map(|id| {
+                Block::new(
+                    id,
+                    [id as u8; 32],
+                    id,
+                    vec![],
+                    Account {
+                        address: "proposer".to_string(),
+                    },
+                    String::new(),
+                    Seed { seed: [0u8; 32] },
+                    None,
+                )
+                .unwrap()
+            })
+            .collect()
+    }
+
+    // Voters signing `message` under `template`
+    fn prove(
+        template: &Params,
+        wallets: &[Wallet],
+        voters: &[Participant],
+        message: StateProofMessage,
+    ) -> StateProof {
+        let params = message.params(template).unwrap();
+        let root = voters_commitment(template.hashing(), voters).unwrap();
+        let mut builder = Builder::new(params.clone(), voters.to_vec(), root).unwrap();
+        for (i, wallet) in wallets.iter().enumerate() {
+            builder
+                .add_signature(i, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        StateProof {
+            message,
+            certificate: builder.build().unwrap(),
+        }
+    }
+
+    #[test]
+    fn test_state_proof_chain() {
+        let template = Params {
+            proven_weight: 20,
+            ..Default::default()
+        };
+        let hashing = template.hashing();
+        let sets: Vec<(Vec<Wallet>, Vec<Participant>)> = (0..3)
+            .map(|_| {
+                let wallets: Vec<Wallet> = (0..3)
+                    .map(|_| Wallet::new().expect("Failed to create wallet"))
+                    .collect();
+                let voters = wallets
+                    .iter()
+                    .map(|w| Participant::from_signer(w, 10))
+                    .collect();
+                (wallets, voters)
+            })
+            .collect();
+        let commitments: Vec<Vec<u8>> = sets
+            .iter()
+            .map(|(_, voters)| voters_commitment(hashing, voters).unwrap())
+            .collect();
+
+        // Each interval is signed by the voters the previous one handed over to
+        let first = StateProofMessage::new(hashing, &blocks(1, 4), commitments[1].clone()).unwrap();
+        let first = prove(&template, &sets[0].0, &sets[0].1, first);
+        let second =
+            StateProofMessage::new(hashing, &blocks(5, 4), commitments[2].clone()).unwrap();
+        let second = prove(&template, &sets[1].0, &sets[1].1, second);
+
+        let mut verifier = StateProofVerifier::new(template.clone(), 4, commitments[0].clone(), 1);
+        // The second interval can't be accepted before the first
+        assert!(verifier.advance(&second).is_err());
+        verifier.advance(&first).unwrap();
+        assert_eq!(verifier.voters_commitment, commitments[1]);
+        // Nor an interval signed by voters other than the committed ones
+        let forged =
+            StateProofMessage::new(hashing, &blocks(5, 4), commitments[2].clone()).unwrap();
+        let forged = prove(&template, &sets[2].0, &sets[2].1, forged);
+        assert!(verifier.advance(&forged).is_err());
+        verifier.advance(&second).unwrap();
+        assert_eq!(verifier.next_block, 9);
+
+        // A changed header breaks the signed commitment
+        let mut tampered = second.clone();
+        tampered.message.block_headers_commitment[0] ^= 1;
+        assert!(!tampered.verify(&commitments[1], &template).unwrap());
+
+        let mut gap = blocks(1, 4);
+        gap.remove(2);
+        assert!(StateProofMessage::new(hashing, &gap, commitments[1].clone()).is_err());
+    }
+}
@@ -0,0 +1,502 @@
+//! Persistent storage of the node. A `KvStore` is an ordered key-value
+//! backend with atomic batch writes: `MemoryStore` keeps everything in memory
+//! for tests and light clients, and `FileStore` appends every batch to a log
+//! file, replayed when the node restarts. `ChainStore` lays out the node's
+//! data on top of either one: blocks, certificates and state snapshots keyed
+//! by height and participant sets keyed by epoch, under big-endian keys so
+//! that iteration follows the chain.
+use crate::block::Block;
+use crate::ccok::{Certificate, Participant};
+use crate::envelope;
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+use sha3::{Digest, Sha3_256};
+use std::collections::BTreeMap;
+use std::fs::{File, OpenOptions};
+use std::io::{Read, Write};
+use std::ops::Bound;
+use std::path::{Path, PathBuf};
+
+/// Writes applied together or not at all
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct WriteBatch {
+    /// Keys in order of writing, with their value or `None` to delete
+    ops: Vec<(Vec<u8>, Option<Vec<u8>>)>,
+}
+
+impl WriteBatch {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn put(&mut self, key: impl Into<Vec<u8>>, value: impl Into<Vec<u8>>) {
+        self.ops.push((key.into(), Some(value.into())));
+    }
+
+    pub fn delete(&mut self, key: impl Into<Vec<u8>>) {
+        self.ops.push((key.into(), None));
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.ops.is_empty()
+    }
+
+    pub fn len(&self) -> usize {
+        self.ops.len()
+    }
+
+    // Apply the batch to an in-memory map
+    fn apply(self, data: &mut BTreeMap<Vec<u8>, Vec<u8>>) {
+        for (key, value) in self.ops {
+            match value {
+                Some(value) => data.insert(key, value),
+                None => data.remove(&key),
+            };
+        }
+    }
+}
+
+/// Ordered key-value backend
+pub trait KvStore {
+    fn get(&self, key: &[u8]) -> Result<Option<Vec<u8>>, String>;
+
+    /// Apply every write of `batch` atomically
+    fn write(&mut self, batch: WriteBatch) -> Result<(), String>;
+
+    /// Entries with a key starting with `prefix`, in key order
+    fn scan(&self, prefix: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>, String>;
+
+    /// Entries with a key in `start..end`, in key order
+    fn range(&self, start: &[u8], end: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>, String>;
+
+    fn put(&mut self, key: &[u8], value: &[u8]) -> Result<(), String> {
+        let mut batch = WriteBatch::new();
+        batch.put(key, value);
+        self.write(batch)
+    }
+
+    fn delete(&mut self, key: &[u8]) -> Result<(), String> {
+        let mut batch = WriteBatch::new();
+        batch.delete(key);
+        self.write(batch)
+    }
+
+    /// Reclaim the space of deleted and overwritten entries
+    fn compact(&mut self) -> Result<(), String> {
+        Ok(())
+    }
+}
+
+// Entries of `data` under `prefix`
+fn scan_map(data: &BTreeMap<Vec<u8>, Vec<u8>>, prefix: &[u8]) -> Vec<(Vec<u8>, Vec<u8>)> {
+    data.range::<[u8], _>((Bound::Included(prefix), Bound::Unbounded))
+        .take_while(|(key, _)| key.starts_with(prefix))
+        .map(|(key, value)| (key.clone(), value.clone()))
+        .collect()
+}
+
+fn range_map(
+    data: &BTreeMap<Vec<u8>, Vec<u8>>,
+    start: &[u8],
+    end: &[u8],
+) -> Vec<(Vec<u8>, Vec<u8>)> {
+    if start >= end {
+        return Vec::new();
+    }
+    data.range::<[u8], _>((Bound::Included(start), Bound::Excluded(end)))
+        .map(|(key, value)| (key.clone(), value.clone()))
+        .collect()
+}
+
+/// Backend holding the entries in memory
+#[derive(Debug, Clone, Default)]
+pub struct MemoryStore {
+    data: BTreeMap<Vec<u8>, Vec<u8>>,
+}
+
+impl MemoryStore {
+    pub fn new() -> Self {
+        Self::default()
+    }
+}
+
+impl KvStore for MemoryStore {
+    fn get(&self, key: &[u8]) -> Result<Option<Vec<u8>>, String> {
+        Ok(self.data.get(key).cloned())
+    }
+
+    fn write(&mut self, batch: WriteBatch) -> Result<(), String> {
+        batch.apply(&mut self.data);
+        Ok(())
+    }
+
+    fn scan(&self, prefix: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>, String> {
+        Ok(scan_map(&self.data, prefix))
+    }
+
+    fn range(&self, start: &[u8], end: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>, String> {
+        Ok(range_map(&self.data, start, end))
+    }
+}
+
+// Length and checksum before each batch of the log
+const RECORD_HEADER: usize = 8;
+
+/// Backend appending each batch to a log file and serving reads from memory
+pub struct FileStore {
+    path: PathBuf,
+    file: File,
+    data: BTreeMap<Vec<u8>, Vec<u8>>,
+}
+
+impl FileStore {
+    /// Open the log at `path`, creating it if missing. A batch cut short by
+    /// a crash is dropped, as it was never acknowledged.
+    pub fn open(path: impl AsRef<Path>) -> Result<Self, String> {
+        let path = path.as_ref().to_path_buf();
+        let mut file = OpenOptions::new()
+            .read(true)
+            .append(true)
+            .create(true)
+            .open(&path)
+            .map_err(|e| format!("Failed to open store {}: {}", path.display(), e))?;
+        let mut log = Vec::new();
+        file.read_to_end(&mut log)
+            .map_err(|e| format!("Failed to read store {}: {}", path.display(), e))?;
+
+        let mut data = BTreeMap::new();
+        let mut offset = 0;
+        while let Some((len, batch)) = Self::read_record(&log[offset..]) {
+            offset += RECORD_HEADER + len;
+            batch.apply(&mut data);
+        }
+        if offset < log.len() {
+            file.set_len(offset as u64)
+                .map_err(|e| format!("Failed to truncate store {}: {}", path.display(), e))?;
+        }
+        Ok(Self { path, file, data })
+    }
+
+    /// Path of the log file
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Size of the log file in bytes
+    pub fn log_size(&self) -> Result<u64, String> {
+        self.file
+            .metadata()
+            .map(|metadata| metadata.len())
+            .map_err(|e| format!("Failed to read store {}: {}", self.path.display(), e))
+    }
+
+    // Log record of a batch
+    fn record(batch: &WriteBatch) -> Result<Vec<u8>, String> {
+        let body = bincode::serialize(batch).map_err(|e| format!("Serialization error: {}", e))?;
+        let mut record = Vec::with_capacity(RECORD_HEADER + body.len());
+        record.extend_from_slice(&(body.len() as u32).to_be_bytes());
+        record.extend_from_slice(&Sha3_256::digest(&body)[..4]);
+        record.extend_from_slice(&body);
+        Ok(record)
+    }
+
+    // Body length and batch of the record starting `log`, if complete
+    fn read_record(log: &[u8]) -> Option<(usize, WriteBatch)> {
+        if log.len() < RECORD_HEADER {
+            return None;
+        }
+        let len = u32::from_be_bytes(log[..4].try_into().unwrap()) as usize;
+        let body = log.get(RECORD_HEADER..RECORD_HEADER + len)?;
+        if Sha3_256::digest(body)[..4] != log[4..RECORD_HEADER] {
+            return None;
+        }
+        Some((len, bincode::deserialize(body).ok()?))
+    }
+}
+
+impl KvStore for FileStore {
+    fn get(&self, key: &[u8]) -> Result<Option<Vec<u8>>, String> {
+        Ok(self.data.get(key).cloned())
+    }
+
+    fn write(&mut self, batch: WriteBatch) -> Result<(), String> {
+        if batch.is_empty() {
+            return Ok(());
+        }
+        let record = Self::record(&batch)?;
+        self.file
+            .write_all(&record)
+            .and_then(|_| self.file.sync_data())
+            .map_err(|e| format!("Failed to write store {}: {}", self.path.display(), e))?;
+        batch.apply(&mut self.data);
+        Ok(())
+    }
+
+    fn scan(&self, prefix: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>, String> {
+        Ok(scan_map(&self.data, prefix))
+    }
+
+    fn range(&self, start: &[u8], end: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>, String> {
+        Ok(range_map(&self.data, start, end))
+    }
+
+    /// Rewrite the log as a single batch of the live entries. The new log
+    /// replaces the old one by a rename, so a crash leaves either of them.
+    fn compact(&mut self) -> Result<(), String> {
+        let mut batch = WriteBatch::new();
+        for (key, value) in &self.data {
+            batch.put(key.clone(), value.clone());
+        }
+        let compacted = self.path.with_extension("compact");
+        let failed =
+            |e: std::io::Error| format!("Failed to compact store {}: {}", self.path.display(), e);
+        let mut file = File::create(&compacted).map_err(failed)?;
+        file.write_all(&Self::record(&batch)?)
+            .and_then(|_| file.sync_all())
+            .map_err(failed)?;
+        std::fs::rename(&compacted, &self.path).map_err(failed)?;
+        self.file = OpenOptions::new()
+            .read(true)
+            .append(true)
+            .open(&self.path)
+            .map_err(failed)?;
+        Ok(())
+    }
+}
+
+// Key prefixes of the chain data
+const BLOCK: u8 = b'b';
+const CERTIFICATE: u8 = b'c';
+const PARTICIPANTS: u8 = b'p';
+const SNAPSHOT: u8 = b's';
+
+fn key(prefix: u8, number: u64) -> Vec<u8> {
+    let mut key = vec![prefix];
+    key.extend_from_slice(&number.to_be_bytes());
+    key
+}
+
+// Height or epoch of a key
+fn key_number(key: &[u8]) -> Result<u64, String> {
+    key.get(1..9)
+        .and_then(|bytes| bytes.try_into().ok())
+        .map(u64::from_be_bytes)
+        .ok_or_else(|| "Invalid store key".to_string())
+}
+
+fn encode<T: Serialize>(value: &T) -> Result<Vec<u8>, String> {
+    bincode::serialize(value).map_err(|e| format!("Serialization error: {}", e))
+}
+
+fn decode<T: DeserializeOwned>(bytes: &[u8]) -> Result<T, String> {
+    bincode::deserialize(bytes).map_err(|e| format!("Deserialization error: {}", e))
+}
+
+/// Chain data of a node over a backend
+pub struct ChainStore<S: KvStore> {
+    backend: S,
+}
+
+/// Writes to a `ChainStore` committed together
+#[derive(Debug, Default)]
+pub struct ChainBatch {
+    batch: WriteBatch,
+}
+
+impl ChainBatch {
+    pub fn put_block(&mut self, block: &Block) -> Result<(), String> {
+        self.batch.put(key(BLOCK, block.id as u64), encode(block)?);
+        Ok(())
+    }
+
+    pub fn put_certificate(&mut self, height: u64, cert: &Certificate) -> Result<(), String> {
+        self.batch
+            .put(key(CERTIFICATE, height), envelope::encode(cert)?);
+        Ok(())
+    }
+
+    pub fn put_participants(
+        &mut self,
+        epoch: u64,
+        participants: &[Participant],
+    ) -> Result<(), String> {
+        self.batch
+            .put(key(PARTICIPANTS, epoch), encode(&participants)?);
+        Ok(())
+    }
+
+    pub fn put_snapshot(&mut self, height: u64, snapshot: &[u8]) {
+        self.batch.put(key(SNAPSHOT, height), snapshot);
+    }
+
+    pub fn delete_block(&mut self, height: u64) {
+        self.batch.delete(key(BLOCK, height));
+    }
+
+    pub fn delete_certificate(&mut self, height: u64) {
+        self.batch.delete(key(CERTIFICATE, height));
+    }
+
+    pub fn delete_snapshot(&mut self, height: u64) {
+        self.batch.delete(key(SNAPSHOT, height));
+    }
+}
+
+impl<S: KvStore> ChainStore<S> {
+    pub fn new(backend: S) -> Self {
+        Self { backend }
+    }
+
+    pub fn backend(&self) -> &S {
+        &self.backend
+    }
+
+    /// Commit every write of `batch` atomically
+    pub fn commit(&mut self, batch: ChainBatch) -> Result<(), String> {
+        self.backend.write(batch.batch)
+    }
+
+    /// Store a block and its certificate together
+    pub fn put_certified_block(&mut self, block: &Block) -> Result<(), String> {
+        let mut batch = ChainBatch::default();
+        batch.put_block(block)?;
+        if let Some(cert) = &block.certificate {
+            batch.put_certificate(block.id as u64, cert)?;
+        }
+        self.commit(batch)
+    }
+
+    pub fn block(&self, height: u64) -> Result<Option<Block>, String> {
+        self.get(key(BLOCK, height), decode)
+    }
+
+    pub fn certificate(&self, height: u64) -> Result<Option<Certificate>, String> {
+        self.get(key(CERTIFICATE, height), envelope::decode)
+    }
+
+    pub fn participants(&self, epoch: u64) -> Result<Option<Vec<Participant>>, String> {
+        self.get(key(PARTICIPANTS, epoch), decode)
+    }
+
+    pub fn snapshot(&self, height: u64) -> Result<Option<Vec<u8>>, String> {
+        self.get(key(SNAPSHOT, height), |bytes| Ok(bytes.to_vec()))
+    }
+
+    /// Highest block stored
+    pub fn latest_height(&self) -> Result<Option<u64>, String> {
+        match self.backend.scan(&[BLOCK])?.last() {
+            Some((key, _)) => Ok(Some(key_number(key)?)),
+            None => Ok(None),
+        }
+    }
+
+    /// Blocks of heights `from..to`, in order
+    pub fn blocks(&self, from: u64, to: u64) -> Result<Vec<Block>, String> {
+        self.backend
+            .range(&key(BLOCK, from), &key(BLOCK, to))?
+            .iter()
+            .map(|(_, value)| decode(value))
+            .collect()
+    }
+
+    /// Certificates with their heights, in order
+    pub fn certificates(&self) -> Result<Vec<(u64, Certificate)>, String> {
+        self.backend
+            .scan(&[CERTIFICATE])?
+            .iter()
+            .map(|(key, value)| Ok((key_number(key)?, envelope::decode(value)?)))
+            .collect()
+    }
+
+    /// Latest snapshot at or below `height`, with its height
+    pub fn snapshot_at(&self, height: u64) -> Result<Option<(u64, Vec<u8>)>, String> {
+        let end = key(SNAPSHOT, height.saturating_add(1));
+        match self.backend.range(&[SNAPSHOT], &end)?.pop() {
+            Some((key, value)) => Ok(Some((key_number(&key)?, value))),
+            None => Ok(None),
+        }
+    }
+
+    fn get<T>(
+        &self,
+        key: Vec<u8>,
+        decode: impl Fn(&[u8]) -> Result<T, String>,
+    ) -> Result<Option<T>, String> {
+        self.backend
+            .get(&key)?
+            .map(|bytes| decode(&bytes))
+            .transpose()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::accounts::Account;
+    use crate::utils::Seed;
+
+    fn block(id: usize) -> Block {
+        Block::new(
+            id,
+            [0u8; 32],
+            0,
+            vec![],
+            Account {
+                address: "proposer".to_string(),
+            },
+            String::new(),
+            Seed {
+                seed: [id as u8; 32],
+            },
+            None,
+        )
+        .unwrap()
+    }
+
+    // Writes the chain data and checks it is read back
+    fn check_store<S: KvStore>(store: &mut ChainStore<S>) {
+        let mut batch = ChainBatch::default();
+        for id in [1, 2, 3, 256] {
+            batch.put_block(&block(id)).unwrap();
+        }
+        batch.put_snapshot(2, b"state at 2");
+        batch.put_participants(1, &[]).unwrap();
+        store.commit(batch).unwrap();
+
+        assert_eq!(store.block(2).unwrap().unwrap().hash, block(2).hash);
+        assert!(store.block(4).unwrap().is_none());
+        assert_eq!(store.latest_height().unwrap(), Some(256));
+        let ids: Vec<usize> = store.blocks(2, 300).unwrap().iter().map(|b| b.id).collect();
+        assert_eq!(ids, vec![2, 3, 256]);
+        assert_eq!(
+            store.snapshot_at(100).unwrap(),
+            Some((2, b"state at 2".to_vec()))
+        );
+        assert!(store.snapshot_at(1).unwrap().is_none());
+        assert!(store.participants(1).unwrap().unwrap().is_empty());
+
+        let mut batch = ChainBatch::default();
+        batch.delete_block(256);
+        store.commit(batch).unwrap();
+        assert_eq!(store.latest_height().unwrap(), Some(3));
+    }
+
+    #[test]
+    fn test_chain_store() {
+        check_store(&mut ChainStore::new(MemoryStore::new()));
+
+        let path = std::env::temp_dir().join(format!("niropok-store-{}.log", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        check_store(&mut ChainStore::new(FileStore::open(&path).unwrap()));
+
+        // The log is replayed on open, dropping a torn last batch
+        let mut log = OpenOptions::new().append(true).open(&path).unwrap();
+        log.write_all(&[0, 0, 1, 0, 1]).unwrap();
+        let mut reopened = ChainStore::new(FileStore::open(&path).unwrap());
+        assert_eq!(reopened.latest_height().unwrap(), Some(3));
+        assert_eq!(reopened.snapshot(2).unwrap(), Some(b"state at 2".to_vec()));
+        reopened.put_certified_block(&block(4)).unwrap();
+        let reopened = ChainStore::new(FileStore::open(&path).unwrap());
+        assert_eq!(reopened.latest_height().unwrap(), Some(4));
+        std::fs::remove_file(&path).unwrap();
+    }
+}
@@ -0,0 +1,526 @@
+use crate::ccok::{Builder, Certificate, Params, SerializableSignature};
+use crate::context::Context;
+use crate::ephemeral::OneTimeKeyProof;
+use crate::error::CcokError;
+use tokio::sync::{mpsc, oneshot, watch};
+use tokio::task::JoinHandle;
+use tokio::time::{interval, sleep_until, Duration, Instant};
+
+/// Submissions queued for the builder task before submitters have to wait
+pub const SUBMISSION_BUFFER: usize = 256;
+
+// How often a wait checks its context for cancellation
+const CANCEL_POLL: Duration = Duration::from_millis(10);
+
+/// Snapshot of the signatures collected so far
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Progress {
+    /// Total weight of the accepted signatures
+    pub signed_weight: u64,
+    /// Weight the certificate has to prove
+    pub proven_weight: u64,
+    /// Number of accepted signatures
+    pub signatures: usize,
+    /// Number of participants
+    pub participants: usize,
+}
+
+impl Progress {
+    /// Progress of the signatures `builder` collected
+    pub fn of(builder: &Builder) -> Self {
+        Self {
+            signed_weight: builder.signed_weight,
+            proven_weight: builder.params.proven_weight,
+            signatures: builder
+                .sigs
+                .iter()
+                .filter(|s| s.signature.is_some())
+                .count(),
+            participants: builder.participants.len(),
+        }
+    }
+
+    /// Whether enough weight has signed to build the certificate
+    pub fn threshold_reached(&self) -> bool {
+        self.signed_weight >= self.proven_weight
+    }
+}
+
+/// When `StreamingBuilder::build_when_ready` finalizes the certificate
+#[derive(Debug, Clone, Copy, Default)]
+pub struct ReadyPolicy {
+    /// Signed weight required beyond the proven weight before building
+    pub margin: u64,
+    /// Keep accepting signatures for this long once the margin is reached, so
+    /// the certificate carries as much signed weight as possible; see
+    /// `Builder::estimate_cert_size` for how this affects the certificate size
+    pub linger: Option<Duration>,
+    /// Give up waiting after this long; the certificate is still built if
+    /// the proven weight was reached without the margin
+    pub deadline: Option<Duration>,
+}
+
+/// A signature submitted by a remote participant
+#[derive(Debug)]
+struct Submission {
+    pos: usize,
+    signature: SerializableSignature,
+    one_time_key: Option<OneTimeKeyProof>,
+    reply: oneshot::Sender<Result<(), CcokError>>,
+}
+
+enum Command {
+    Add(Submission),
+    Finish(oneshot::Sender<Builder>),
+}
+
+/// Cloneable handle for submitting signatures to a `StreamingBuilder`
+#[derive(Clone)]
+pub struct SignatureSender {
+    commands: mpsc::Sender<Command>,
+}
+
+impl SignatureSender {
+    /// Submit a participant's signature; resolves once the builder accepted or rejected it
+    pub async fn add_signature_async(
+        &self,
+        pos: usize,
+        signature: impl Into<SerializableSignature>,
+    ) -> Result<(), CcokError> {
+        self.submit(pos, signature.into(), None).await
+    }
+
+    /// Submit a signature made with a participant's one-time key
+    pub async fn add_one_time_signature_async(
+        &self,
+        pos: usize,
+        signature: impl Into<SerializableSignature>,
+        proof: OneTimeKeyProof,
+    ) -> Result<(), CcokError> {
+        self.submit(pos, signature.into(), Some(proof)).await
+    }
+
+    async fn submit(
+        &self,
+        pos: usize,
+        signature: SerializableSignature,
+        one_time_key: Option<OneTimeKeyProof>,
+    ) -> Result<(), CcokError> {
+        let (reply, accepted) = oneshot::channel();
+        self.commands
+            .send(Command::Add(Submission {
+                pos,
+                signature,
+                one_time_key,
+                reply,
+            }))
+            .await
+            .map_err(|_| CcokError::Closed)?;
+        accepted.await.map_err(|_| CcokError::Closed)?
+    }
+}
+
+/// Builder that collects signatures from remote participants on a background
+/// task, so a coordinator can build as soon as the proven weight is crossed.
+/// At most `SUBMISSION_BUFFER` submissions wait for the task, so a flood of
+/// them holds up the submitters instead of growing memory.
+pub struct StreamingBuilder {
+    params: Params,
+    commands: mpsc::Sender<Command>,
+    progress: watch::Receiver<Progress>,
+    task: JoinHandle<()>,
+}
+
+impl StreamingBuilder {
+    /// Move `builder` onto a background task; must be called within a tokio runtime
+    pub fn spawn(builder: Builder) -> Self {
+        let (commands, mut receiver) = mpsc::channel(SUBMISSION_BUFFER);
+        let (progress_tx, progress) = watch::channel(Progress::of(&builder));
+        let params = builder.params.clone();
+
+        let task = tokio::spawn(async move {
+            let mut builder = builder;
+            while let Some(command) = receiver.recv().await {
+                match command {
+                    Command::Add(sub) => {
+                        let result = match sub.one_time_key {
+                            Some(proof) => {
+                                builder.add_one_time_signature(sub.pos, sub.signature, proof)
+                            }
+                            None => builder.add_signature(sub.pos, sub.signature),
+                        };
+                        if result.is_ok() {
+                            progress_tx.send_replace(Progress::of(&builder));
+                        }
+                        let _ = sub.reply.send(result);
+                    }
+                    Command::Finish(reply) => {
+                        let _ = reply.send(builder);
+                        return;
+                    }
+                }
+            }
+        });
+
+        Self {
+            params,
+            commands,
+            progress,
+            task,
+        }
+    }
+
+    /// Params of the certificate being built
+    pub fn params(&self) -> &Params {
+        &self.params
+    }
+
+    /// Handle for submitting signatures, e.g. from network handlers
+    pub fn sender(&self) -> SignatureSender {
+        SignatureSender {
+            commands: self.commands.clone(),
+        }
+    }
+
+    /// Current accumulated signed weight
+    pub fn progress(&self) -> Progress {
+        *self.progress.borrow()
+    }
+
+    /// Wait until enough weight has signed to build the certificate
+    pub async fn wait_for_threshold(&mut self) -> Result<Progress, CcokError> {
+        self.progress
+            .wait_for(|p| p.threshold_reached())
+            .await
+            .map(|p| *p)
+            .map_err(|_| CcokError::Closed)
+    }
+
+    /// Build as soon as the signed weight exceeds the proven weight by
+    /// `policy.margin`, instead of waiting for every participant. Fails with
+    /// the error of `ctx` once it is cancelled or expires, even past the
+    /// proven weight.
+    pub async fn build_when_ready(
+        mut self,
+        ctx: &Context,
+        policy: ReadyPolicy,
+    ) -> Result<Certificate, CcokError> {
+        let deadline = policy.deadline.map(|d| Instant::now() + d);
+        let margin = policy.margin;
+
+        let ready = self
+            .wait_until(ctx, deadline, |p| {
+                p.signed_weight >= p.proven_weight.saturating_add(margin)
+            })
+            .await?;
+        ctx.check()?;
+        if !ready && !self.progress().threshold_reached() {
+            let progress = self.progress();
+            return Err(CcokError::InsufficientWeight {
+                signed: progress.signed_weight,
+                proven: progress.proven_weight,
+            });
+        }
+
+        if let (true, Some(linger)) = (ready, policy.linger) {
+            let linger_end = Instant::now() + linger;
+            let linger_end = deadline.map_or(linger_end, |d| d.min(linger_end));
+            self.wait_until(ctx, Some(linger_end), |p| p.signatures == p.participants)
+                .await?;
+            ctx.check()?;
+        }
+
+        self.build().await
+    }
+
+    /// Wait until `weight` has signed; returns false if `deadline` passed
+    /// first
+    pub async fn wait_for_weight(
+        &mut self,
+        weight: u64,
+        deadline: Instant,
+    ) -> Result<bool, CcokError> {
+        self.wait_until(&Context::background(), Some(deadline), |p| {
+            p.signed_weight >= weight
+        })
+        .await
+    }
+
+    // Wait for `cond`; returns false if `deadline` or the deadline of `ctx`
+    // passed first, or `ctx` was cancelled
+    async fn wait_until(
+        &mut self,
+        ctx: &Context,
+        deadline: Option<Instant>,
+        cond: impl FnMut(&Progress) -> bool,
+    ) -> Result<bool, CcokError> {
+        let deadline = match (deadline, ctx.deadline().map(Instant::from_std)) {
+            (Some(a), Some(b)) => Some(a.min(b)),
+            (a, b) => a.or(b),
+        };
+        let expired = async {
+            match deadline {
+                Some(deadline) => sleep_until(deadline).await,
+                None => std::future::pending().await,
+            }
+        };
+        let wait = self.progress.wait_for(cond);
+        tokio::pin!(expired, wait);
+        let mut poll = interval(CANCEL_POLL);
+        loop {
+            tokio::select! {
+                result = &mut wait => {
+                    return result.map(|_| true).map_err(|_| CcokError::Closed);
+                }
+                _ = &mut expired => return Ok(false),
+                _ = poll.tick() => {
+                    if ctx.is_cancelled() {
+                        return Ok(false);
+                    }
+                }
+            }
+        }
+    }
+
+    /// Stop accepting signatures and return the underlying builder
+    pub async fn finish(self) -> Result<Builder, CcokError> {
+        let (reply, builder) = oneshot::channel();
+        self.commands
+            .send(Command::Finish(reply))
+            .await
+            .map_err(|_| CcokError::Closed)?;
+        let builder = builder.await.map_err(|_| CcokError::Closed)?;
+        let _ = self.task.await;
+        Ok(builder)
+    }
+
+    /// Stop accepting signatures and build the certificate
+    pub async fn build(self) -> Result<Certificate, CcokError> {
+        self.finish().await?.build()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{KeyLayout, Params, Participant, PARAMS_V1};
+    use crate::merkle::MerkleTreeBuilder;
+    use crate::signer::SignatureScheme;
+    use crate::wallet::Wallet;
+
+    // Spawn a streaming builder over `n` participants of weight 10
+    fn create_streaming(
+        n: usize,
+        proven_weight: u64,
+    ) -> (StreamingBuilder, Vec<Wallet>, Params, Vec<u8>) {
+        let wallets: Vec<Wallet> = (0..n)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant {
+                public_key: w.get_public_key(),
+                weight: 10,
+                scheme: SignatureScheme::Dilithium2.id(),
+                key_commitment: None,
+                vrf_key: None,
+                key_layout: KeyLayout::InLeaf,
+            })
+            .collect();
+        let mut party_tree = MerkleTreeBuilder::new();
+        party_tree
+            .build(&participants)
+            .expect("Failed to build party tree");
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight,
+            version: PARAMS_V1,
+            ..Default::default()
+        };
+        let root = party_tree.root();
+
+        let streaming = StreamingBuilder::spawn(
+            Builder::new(params.clone(), participants, root.clone()).unwrap(),
+        );
+        (streaming, wallets, params, root)
+    }
+
+    #[tokio::test]
+    async fn test_streaming_builder() {
+        let (mut streaming, wallets, params, root) = create_streaming(4, 30);
+        let msg = params.msg.clone();
+        assert_eq!(streaming.progress().signed_weight, 0);
+        // Remote participants submit concurrently
+        let handles: Vec<_> = wallets
+            .into_iter()
+            .enumerate()
+            .take(3)
+            .map(|(pos, wallet)| {
+                let sender = streaming.sender();
+                let sig = wallet.sign_message(&msg);
+                tokio::spawn(async move { sender.add_signature_async(pos, sig).await })
+            })
+            .collect();
+        for handle in handles {
+            handle.await.unwrap().expect("Signature rejected");
+        }
+
+        // Conflicting signatures are rejected back to the submitter
+        let dup = Wallet::new().unwrap().sign_message(&msg);
+        assert_eq!(
+            streaming.sender().add_signature_async(0, dup).await,
+            Err(CcokError::DuplicateSignature(0))
+        );
+
+        let progress = streaming.wait_for_threshold().await.unwrap();
+        assert_eq!(progress.signed_weight, 30);
+        assert_eq!(progress.signatures, 3);
+
+        let sender = streaming.sender();
+        let cert = streaming
+            .build()
+            .await
+            .expect("Failed to build certificate");
+        assert!(cert.verify(&params, &root).unwrap());
+
+        // The builder no longer accepts signatures once finished
+        let late = Wallet::new().unwrap().sign_message(&msg);
+        assert_eq!(
+            sender.add_signature_async(3, late).await,
+            Err(CcokError::Closed)
+        );
+    }
+
+    #[tokio::test]
+    async fn test_build_when_ready() {
+        let (streaming, wallets, params, root) = create_streaming(4, 20);
+        let sender = streaming.sender();
+        let policy = ReadyPolicy {
+            margin: 10,
+            ..Default::default()
+        };
+        let build = tokio::spawn(async move {
+            streaming
+                .build_when_ready(&Context::background(), policy)
+                .await
+        });
+
+        for (pos, wallet) in wallets.iter().enumerate().take(3) {
+            sender
+                .add_signature_async(pos, wallet.sign_message(&params.msg))
+                .await
+                .expect("Signature rejected");
+        }
+
+        // Built once 30 > 20 + 10 without waiting for the fourth participant
+        let cert = build.await.unwrap().expect("Failed to build certificate");
+        assert_eq!(cert.signed_weight, 30);
+        assert!(cert.verify(&params, &root).unwrap());
+    }
+
+    #[tokio::test]
+    async fn test_build_when_ready_linger_and_deadline() {
+        // Signatures arriving while lingering are included
+        let (streaming, wallets, params, root) = create_streaming(4, 20);
+        let sender = streaming.sender();
+        for (pos, wallet) in wallets.iter().enumerate().take(2) {
+            sender
+                .add_signature_async(pos, wallet.sign_message(&params.msg))
+                .await
+                .unwrap();
+        }
+        let policy = ReadyPolicy {
+            linger: Some(Duration::from_secs(5)),
+            ..Default::default()
+        };
+        let build = tokio::spawn(async move {
+            streaming
+                .build_when_ready(&Context::background(), policy)
+                .await
+        });
+        for (pos, wallet) in wallets.iter().enumerate().skip(2) {
+            sender
+                .add_signature_async(pos, wallet.sign_message(&params.msg))
+                .await
+                .unwrap();
+        }
+        let cert = build.await.unwrap().expect("Failed to build certificate");
+        assert_eq!(cert.signed_weight, 40);
+        assert!(cert.verify(&params, &root).unwrap());
+
+        // A deadline without enough weight fails
+        let (streaming, wallets, params, _) = create_streaming(4, 20);
+        streaming
+            .sender()
+            .add_signature_async(0, wallets[0].sign_message(&params.msg))
+            .await
+            .unwrap();
+        let policy = ReadyPolicy {
+            deadline: Some(Duration::from_millis(50)),
+            ..Default::default()
+        };
+        assert!(streaming
+            .build_when_ready(&Context::background(), policy)
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_build_when_ready_context() {
+        // A cancelled context stops the wait, though the weight will never
+        // be reached
+        let (streaming, _, _, _) = create_streaming(4, 20);
+        let ctx = Context::background();
+        let cancel = ctx.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+            cancel.cancel();
+        });
+        assert_eq!(
+            streaming
+                .build_when_ready(&ctx, ReadyPolicy::default())
+                .await
+                .err(),
+            Some(CcokError::Cancelled)
+        );
+
+        // An expiring context fails the build even past the proven weight,
+        // unlike the policy deadline
+        let (streaming, wallets, params, _) = create_streaming(4, 20);
+        let sender = streaming.sender();
+        for (pos, wallet) in wallets.iter().enumerate().take(2) {
+            sender
+                .add_signature_async(pos, wallet.sign_message(&params.msg))
+                .await
+                .unwrap();
+        }
+        let policy = ReadyPolicy {
+            margin: 10,
+            ..Default::default()
+        };
+        let ctx = Context::with_timeout(std::time::Duration::from_millis(50));
+        assert_eq!(
+            streaming.build_when_ready(&ctx, policy).await.err(),
+            Some(CcokError::DeadlineExceeded)
+        );
+    }
+
+    #[tokio::test]
+    async fn test_submission_buffer() {
+        // More submissions than the buffer holds all get an answer; a
+        // resubmitted signature is accepted again
+        let (streaming, wallets, params, _) = create_streaming(4, 20);
+        let sig = wallets[0].sign_message(&params.msg);
+        let handles: Vec<_> = (0..SUBMISSION_BUFFER * 2)
+            .map(|_| {
+                let sender = streaming.sender();
+                let sig = sig.clone();
+                tokio::spawn(async move { sender.add_signature_async(0, sig).await })
+            })
+            .collect();
+        for handle in handles {
+            handle.await.unwrap().expect("Signature rejected");
+        }
+        assert_eq!(streaming.progress().signatures, 1);
+    }
+}
@@ -0,0 +1,300 @@
+//! Merkle sum tree over the participant set. Every node commits to the sum
+//! of the weights below it, so the root fixes the total weight, and the audit
+//! path of a participant proves both its membership and the weight of the
+//! participants before it. From `PARAMS_V5` the signature tree is a sum
+//! tree too, over the signed weight of each slot, so the signature commitment
+//! fixes the signed weight.
+use crate::ccok::{Participant, SigSlot};
+use crate::error::CcokError;
+use crate::merkle::{HashDomain, Hashing};
+use serde::{Deserialize, Serialize};
+
+/// Leaf of a sum tree: one participant or signature slot, encoded with
+/// explicit boundaries
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct WeightedLeaf {
+    /// Position of the participant in the set
+    pub index: u64,
+    /// Weight of the participant
+    pub weight: u64,
+    /// Key material of the participant: its scheme, public key and any
+    /// committed one-time or VRF keys; the leaf hash of a signature slot
+    pub key: Vec<u8>,
+}
+
+impl WeightedLeaf {
+    /// Leaf of the participant at `index`
+    pub fn from_participant(index: usize, party: &Participant) -> Result<Self, CcokError> {
+        let public_key = hex::decode(&party.public_key)?;
+        let key = bincode::serialize(&(
+            party.scheme,
+            public_key,
+            &party.key_commitment,
+            &party.vrf_key,
+            party.key_layout,
+        ))?;
+        Ok(Self {
+            index: index as u64,
+            weight: party.weight,
+            key,
+        })
+    }
+
+    /// Leaf of the signature slot at `index`, of signed weight `weight`: the
+    /// participant weight if the slot is signed, else 0
+    pub fn from_sig_slot(
+        hashing: Hashing,
+        index: usize,
+        slot: &SigSlot,
+        weight: u64,
+    ) -> Result<Self, CcokError> {
+        Ok(Self {
+            index: index as u64,
+            weight,
+            key: hashing.leaf_hash(slot)?.to_vec(),
+        })
+    }
+
+    /// Bytes the leaf hash is computed over: index, weight and the
+    /// length-prefixed key
+    pub fn encode(&self) -> Vec<u8> {
+        let mut bytes = Vec::with_capacity(20 + self.key.len());
+        bytes.extend_from_slice(&self.index.to_le_bytes());
+        bytes.extend_from_slice(&self.weight.to_le_bytes());
+        bytes.extend_from_slice(&(self.key.len() as u32).to_le_bytes());
+        bytes.extend_from_slice(&self.key);
+        bytes
+    }
+
+    /// Sum tree node of the leaf
+    pub fn node(&self, hashing: Hashing) -> SumNode {
+        SumNode {
+            hash: hashing.hash(HashDomain::Leaf, &self.encode()),
+            sum: self.weight,
+        }
+    }
+}
+
+/// Node of a sum tree: its hash and the total weight below it
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SumNode {
+    /// Hash committing to the subtree and its weights
+    pub hash: [u8; 32],
+    /// Total weight of the leaves below the node
+    pub sum: u64,
+}
+
+impl SumNode {
+    /// Parent of two nodes; a node without a sibling is carried up
+    pub fn parent(
+        hashing: Hashing,
+        left: &SumNode,
+        right: Option<&SumNode>,
+    ) -> Result<Self, CcokError> {
+        let right = match right {
+            Some(right) => right,
+            None => return Ok(*left),
+        };
+        let sum = left
+            .sum
+            .checked_add(right.sum)
+            .ok_or(CcokError::WeightOverflow)?;
+        let mut data = Vec::with_capacity(80);
+        data.extend_from_slice(&left.hash);
+        data.extend_from_slice(&left.sum.to_le_bytes());
+        data.extend_from_slice(&right.hash);
+        data.extend_from_slice(&right.sum.to_le_bytes());
+        Ok(Self {
+            hash: hashing.hash(HashDomain::Node, &data),
+            sum,
+        })
+    }
+}
+
+/// Audit path of one leaf in a sum tree
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SumPath {
+    /// Number of leaves in the tree
+    pub total_leaves: usize,
+    /// Sibling nodes from the leaf up to the root
+    pub siblings: Vec<SumNode>,
+}
+
+impl SumPath {
+    /// Verify `leaf` against `root` and return the total weight of the
+    /// participants before it, so the leaf owns the weight range
+    /// `offset..offset + leaf.weight`
+    pub fn verify(
+        &self,
+        hashing: Hashing,
+        root: &SumNode,
+        leaf: &WeightedLeaf,
+    ) -> Result<u64, CcokError> {
+        let invalid = || CcokError::BadMerklePath(format!("sum tree path of leaf {}", leaf.index));
+        let mut index = usize::try_from(leaf.index).map_err(|_| invalid())?;
+        if index >= self.total_leaves {
+            return Err(invalid());
+        }
+        let mut siblings = self.siblings.iter();
+        let mut node = leaf.node(hashing);
+        let mut offset = 0u64;
+        let mut len = self.total_leaves;
+        while len > 1 {
+            if index ^ 1 < len {
+                let sibling = siblings.next().ok_or_else(invalid)?;
+                node = if index % 2 == 0 {
+                    SumNode::parent(hashing, &node, Some(sibling))?
+                } else {
+                    offset = offset.checked_add(sibling.sum).ok_or_else(invalid)?;
+                    SumNode::parent(hashing, sibling, Some(&node))?
+                };
+            }
+            index /= 2;
+            len = (len + 1) / 2;
+        }
+        if siblings.next().is_some() || node != *root {
+            return Err(invalid());
+        }
+        Ok(offset)
+    }
+}
+
+/// Merkle sum tree with the shape of `MerkleTreeBuilder`
+#[derive(Debug, Clone)]
+pub struct SumTree {
+    layers: Vec<Vec<SumNode>>,
+    hashing: Hashing,
+}
+
+impl SumTree {
+    /// Build the tree over `leaves`, which must be in index order
+    pub fn build(hashing: Hashing, leaves: &[WeightedLeaf]) -> Result<Self, CcokError> {
+        if leaves.is_empty() {
+            return Err(CcokError::EmptyTree);
+        }
+        if let Some(pos) = leaves
+            .iter()
+            .enumerate()
+            .position(|(i, leaf)| leaf.index != i as u64)
+        {
+            return Err(CcokError::LeafOutOfRange(pos));
+        }
+        let mut layers = vec![leaves
+            .iter()
+            .map(|leaf| leaf.node(hashing))
+            .collect::<Vec<_>>()];
+        while layers.last().map_or(false, |layer| layer.len() > 1) {
+            let parents = layers
+                .last()
+                .unwrap()
+                .chunks(2)
+                .map(|pair| SumNode::parent(hashing, &pair[0], pair.get(1)))
+                .collect::<Result<Vec<_>, CcokError>>()?;
+            layers.push(parents);
+        }
+        Ok(Self { layers, hashing })
+    }
+
+    /// Build the tree over a participant set
+    pub fn from_participants(
+        hashing: Hashing,
+        participants: &[Participant],
+    ) -> Result<Self, CcokError> {
+        let leaves = participants
+            .iter()
+            .enumerate()
+            .map(|(i, party)| WeightedLeaf::from_participant(i, party))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        Self::build(hashing, &leaves)
+    }
+
+    /// Number of leaves in the tree
+    pub fn len(&self) -> usize {
+        self.layers[0].len()
+    }
+
+    /// Whether the tree has no leaves
+    pub fn is_empty(&self) -> bool {
+        self.layers[0].is_empty()
+    }
+
+    /// Hash function of the tree
+    pub fn hashing(&self) -> Hashing {
+        self.hashing
+    }
+
+    /// Root node, committing to the tree and its total weight
+    pub fn root(&self) -> SumNode {
+        self.layers.last().unwrap()[0]
+    }
+
+    /// Total weight of all leaves
+    pub fn total_weight(&self) -> u64 {
+        self.root().sum
+    }
+
+    /// Generate the audit path of the leaf at `index`
+    pub fn prove(&self, index: usize) -> Result<SumPath, CcokError> {
+        if index >= self.len() {
+            return Err(CcokError::LeafOutOfRange(index));
+        }
+        let mut siblings = Vec::new();
+        let mut index = index;
+        for layer in &self.layers[..self.layers.len() - 1] {
+            if let Some(sibling) = layer.get(index ^ 1) {
+                siblings.push(*sibling);
+            }
+            index /= 2;
+        }
+        Ok(SumPath {
+            total_leaves: self.len(),
+            siblings,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::merkle::HashAlgorithm;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_sum_paths() {
+        let participants: Vec<Participant> = (0..7)
+            .map(|i| {
+                let wallet = Wallet::new().expect("Failed to create wallet");
+                Participant::from_signer(&wallet, 10 * (i + 1))
+            })
+            .collect();
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let tree = SumTree::from_participants(hashing, &participants).unwrap();
+        assert_eq!(tree.total_weight(), 280);
+
+        // Every path proves membership and the weight before the leaf
+        let mut offset = 0;
+        for (i, party) in participants.iter().enumerate() {
+            let leaf = WeightedLeaf::from_participant(i, party).unwrap();
+            let path = tree.prove(i).unwrap();
+            assert_eq!(path.verify(hashing, &tree.root(), &leaf).unwrap(), offset);
+            offset += party.weight;
+
+            let mut heavier = leaf.clone();
+            heavier.weight += 1;
+            assert!(path.verify(hashing, &tree.root(), &heavier).is_err());
+            let mut moved = leaf.clone();
+            moved.index = (moved.index + 1) % 7;
+            assert!(path.verify(hashing, &tree.root(), &moved).is_err());
+        }
+
+        // The root commits to the total weight
+        let leaf = WeightedLeaf::from_participant(0, &participants[0]).unwrap();
+        let mut understated = tree.root();
+        understated.sum -= 1;
+        assert!(tree
+            .prove(0)
+            .unwrap()
+            .verify(hashing, &understated, &leaf)
+            .is_err());
+    }
+}
@@ -0,0 +1,359 @@
+//! Tracing of the state proof pipeline in the OpenTelemetry data model.
+//! Signature collection, the certificate build and its tree builds, coin
+//! derivation and reveal assembly, and the relayer's serialization and
+//! submissions each run in a `Span`; spans of one certificate share a trace
+//! id, so operators can see where the time of a slow certificate went.
+//!
+//! Spans are only recorded once an exporter is installed with `set_exporter`;
+//! until then they are inert. `FileExporter` appends spans as OTLP/JSON lines,
+//! which the OpenTelemetry collector's `otlpjsonfile` receiver reads. Sync
+//! code nests spans on the current thread with `span`; async code, which may
+//! move between threads, starts `detached` spans and runs futures in them
+//! with `instrument`.
+use once_cell::sync::Lazy;
+use serde_json::{json, Value};
+use std::cell::RefCell;
+use std::fs::{File, OpenOptions};
+use std::future::Future;
+use std::io::Write;
+use std::path::Path;
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+static EXPORTER: Lazy<RwLock<Option<Arc<dyn SpanExporter>>>> = Lazy::new(|| RwLock::new(None));
+
+thread_local! {
+    // Spans entered on this thread, innermost last
+    static CURRENT: RefCell<Vec<SpanContext>> = RefCell::new(Vec::new());
+}
+
+tokio::task_local! {
+    // Span the future of the current task runs in
+    static TASK_SPAN: SpanContext;
+}
+
+/// Identity of a span and its trace
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct SpanContext {
+    pub trace_id: [u8; 16],
+    pub span_id: [u8; 8],
+}
+
+impl SpanContext {
+    /// W3C `traceparent` header of the span, for propagating it to peers
+    pub fn traceparent(&self) -> String {
+        format!(
+            "00-{}-{}-01",
+            hex::encode(self.trace_id),
+            hex::encode(self.span_id)
+        )
+    }
+
+    /// Context of a W3C `traceparent` header
+    pub fn from_traceparent(header: &str) -> Result<Self, String> {
+        let invalid = || format!("Invalid traceparent {}", header);
+        let parts: Vec<&str> = header.split('-').collect();
+        let [version, trace_id, span_id, _flags] = parts[..] else {
+            return Err(invalid());
+        };
+        if version != "00" {
+            return Err(invalid());
+        }
+        let trace_id = hex::decode(trace_id)
+            .ok()
+            .and_then(|id| id.try_into().ok())
+            .ok_or_else(invalid)?;
+        let span_id = hex::decode(span_id)
+            .ok()
+            .and_then(|id| id.try_into().ok())
+            .ok_or_else(invalid)?;
+        Ok(Self { trace_id, span_id })
+    }
+}
+
+/// A finished span
+#[derive(Debug, Clone, PartialEq)]
+pub struct SpanData {
+    pub name: &'static str,
+    pub context: SpanContext,
+    pub parent_span_id: Option<[u8; 8]>,
+    pub start: SystemTime,
+    pub end: SystemTime,
+    pub attributes: Vec<(&'static str, String)>,
+}
+
+impl SpanData {
+    /// The span as an OTLP/JSON span
+    pub fn to_otlp(&self) -> Value {
+        let nanos = |time: SystemTime| {
+            time.duration_since(UNIX_EPOCH)
+                .map_or(0, |elapsed| elapsed.as_nanos())
+                .to_string()
+        };
+        let attributes: Vec<Value> = self
+            .attributes
+            .iter()
+            .map(|(key, value)| json!({ "key": key, "value": { "stringValue": value } }))
+            .collect();
+        json!({
+            "traceId": hex::encode(self.context.trace_id),
+            "spanId": hex::encode(self.context.span_id),
+            "parentSpanId": self.parent_span_id.map(hex::encode).unwrap_or_default(),
+            "name": self.name,
+            // SPAN_KIND_INTERNAL
+            "kind": 1,
+            "startTimeUnixNano": nanos(self.start),
+            "endTimeUnixNano": nanos(self.end),
+            "attributes": attributes,
+        })
+    }
+}
+
+/// OTLP/JSON trace export request of spans from `service`
+pub fn otlp_request(service: &str, spans: &[SpanData]) -> Value {
+    json!({
+        "resourceSpans": [{
+            "resource": {
+                "attributes": [{ "key": "service.name", "value": { "stringValue": service } }],
+            },
+            "scopeSpans": [{
+                "scope": { "name": "niropok" },
+                "spans": spans.iter().map(SpanData::to_otlp).collect::<Vec<_>>(),
+            }],
+        }],
+    })
+}
+
+/// Receives spans as they finish
+pub trait SpanExporter: Send + Sync {
+    fn export(&self, span: SpanData);
+}
+
+/// Install `exporter`, recording spans from now on
+pub fn set_exporter(exporter: Arc<dyn SpanExporter>) {
+    *EXPORTER.write().unwrap() = Some(exporter);
+}
+
+/// Keeps spans in memory
+#[derive(Debug, Default)]
+pub struct MemoryExporter(Mutex<Vec<SpanData>>);
+
+impl MemoryExporter {
+    /// Spans finished so far of the trace `trace_id`
+    pub fn spans(&self, trace_id: [u8; 16]) -> Vec<SpanData> {
+        self.0
+            .lock()
+            .unwrap()
+            .iter()
+            .filter(|span| span.context.trace_id == trace_id)
+            .cloned()
+            .collect()
+    }
+}
+
+impl SpanExporter for MemoryExporter {
+    fn export(&self, span: SpanData) {
+        self.0.lock().unwrap().push(span);
+    }
+}
+
+/// Appends every span to a file as an OTLP/JSON line
+pub struct FileExporter {
+    service: String,
+    file: Mutex<File>,
+}
+
+impl FileExporter {
+    pub fn open(path: impl AsRef<Path>, service: &str) -> Result<Self, String> {
+        let path = path.as_ref();
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .map_err(|e| format!("Failed to open {}: {}", path.display(), e))?;
+        Ok(Self {
+            service: service.to_string(),
+            file: Mutex::new(file),
+        })
+    }
+}
+
+impl SpanExporter for FileExporter {
+    fn export(&self, span: SpanData) {
+        let line = otlp_request(&self.service, &[span]).to_string();
+        // Tracing must not fail the pipeline it traces
+        let _ = writeln!(self.file.lock().unwrap(), "{}", line);
+    }
+}
+
+/// A span in progress, finished and exported when dropped
+pub struct Span {
+    data: Option<SpanData>,
+    entered: bool,
+}
+
+impl Span {
+    fn start(name: &'static str, parent: Option<SpanContext>, enter: bool) -> Self {
+        if EXPORTER.read().unwrap().is_none() {
+            return Self {
+                data: None,
+                entered: false,
+            };
+        }
+        let context = SpanContext {
+            trace_id: parent.map_or_else(rand::random, |parent| parent.trace_id),
+            span_id: rand::random(),
+        };
+        if enter {
+            CURRENT.with(|current| current.borrow_mut().push(context));
+        }
+        Self {
+            data: Some(SpanData {
+                name,
+                context,
+                parent_span_id: parent.map(|parent| parent.span_id),
+                start: SystemTime::now(),
+                end: SystemTime::now(),
+                attributes: Vec::new(),
+            }),
+            entered: enter,
+        }
+    }
+
+    /// Context of the span, `None` while no exporter is installed
+    pub fn context(&self) -> Option<SpanContext> {
+        self.data.as_ref().map(|data| data.context)
+    }
+
+    /// Enter the span on this thread, if it isn't entered yet
+    pub fn enter(&mut self) {
+        if let (Some(data), false) = (&self.data, self.entered) {
+            CURRENT.with(|current| current.borrow_mut().push(data.context));
+            self.entered = true;
+        }
+    }
+
+    /// Annotate the span
+    pub fn set_attribute(&mut self, key: &'static str, value: impl ToString) {
+        if let Some(data) = &mut self.data {
+            data.attributes.push((key, value.to_string()));
+        }
+    }
+}
+
+impl Drop for Span {
+    fn drop(&mut self) {
+        let Some(mut data) = self.data.take() else {
+            return;
+        };
+        if self.entered {
+            CURRENT.with(|current| {
+                let mut current = current.borrow_mut();
+                if let Some(i) = current.iter().rposition(|c| *c == data.context) {
+                    current.truncate(i);
+                }
+            });
+        }
+        data.end = SystemTime::now();
+        if let Some(exporter) = EXPORTER.read().unwrap().as_ref() {
+            exporter.export(data);
+        }
+    }
+}
+
+/// Innermost span entered on this thread, or else the span the current
+/// task runs in
+pub fn current() -> Option<SpanContext> {
+    CURRENT
+        .with(|current| current.borrow().last().copied())
+        .or_else(|| TASK_SPAN.try_with(|context| *context).ok())
+}
+
+/// Run `future` in `span`: spans started while it is polled are children
+/// of `span`
+pub async fn instrument<F: Future>(span: &Span, future: F) -> F::Output {
+    match span.context() {
+        Some(context) => TASK_SPAN.scope(context, future).await,
+        None => future.await,
+    }
+}
+
+/// Span entered on this thread, a child of the current span or else the
+/// root of a new trace
+pub fn span(name: &'static str) -> Span {
+    Span::start(name, current(), true)
+}
+
+/// Span that isn't entered, for work that crosses threads or awaits; a child
+/// of `parent` or else the root of a new trace
+pub fn detached(name: &'static str, parent: Option<SpanContext>) -> Span {
+    Span::start(name, parent, false)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_spans() {
+        let exporter = Arc::new(MemoryExporter::default());
+        set_exporter(exporter.clone());
+
+        let mut root = span("collect");
+        root.set_attribute("signers", 3);
+        let root_context = root.context().unwrap();
+        {
+            let _build = span("build");
+            assert_ne!(current(), Some(root_context));
+            let _tree = span("tree_build");
+        }
+        assert_eq!(current(), Some(root_context));
+        let submit = detached("submit", root.context());
+        assert_eq!(current(), Some(root_context));
+        drop(submit);
+        drop(root);
+        assert_eq!(current(), None);
+
+        let spans = exporter.spans(root_context.trace_id);
+        let names: Vec<&str> = spans.iter().map(|span| span.name).collect();
+        assert_eq!(names, ["tree_build", "build", "submit", "collect"]);
+        let build = &spans[1];
+        assert_eq!(build.parent_span_id, Some(root_context.span_id));
+        assert_eq!(spans[0].parent_span_id, Some(build.context.span_id));
+        assert_eq!(spans[2].parent_span_id, Some(root_context.span_id));
+        assert_eq!(spans[3].parent_span_id, None);
+        assert!(spans.iter().all(|span| span.start <= span.end));
+
+        // Spans started in an instrumented future are children of its span
+        let relay = detached("relay", None);
+        let runtime = tokio::runtime::Builder::new_current_thread()
+            .build()
+            .unwrap();
+        let serialize = runtime.block_on(instrument(&relay, async {
+            span("serialize").context().unwrap()
+        }));
+        let relay_context = relay.context().unwrap();
+        drop(relay);
+        let relayed = exporter.spans(relay_context.trace_id);
+        assert_eq!(relayed[0].context, serialize);
+        assert_eq!(relayed[0].parent_span_id, Some(relay_context.span_id));
+        assert_eq!(relayed[1].name, "relay");
+
+        let otlp = otlp_request("niropokd", &spans);
+        let exported = &otlp["resourceSpans"][0]["scopeSpans"][0]["spans"];
+        assert_eq!(exported[3]["name"], "collect");
+        assert_eq!(exported[3]["parentSpanId"], "");
+        assert_eq!(exported[3]["attributes"][0]["value"]["stringValue"], "3");
+        assert_eq!(
+            exported[1]["parentSpanId"],
+            hex::encode(root_context.span_id)
+        );
+
+        let header = root_context.traceparent();
+        assert_eq!(
+            SpanContext::from_traceparent(&header).unwrap(),
+            root_context
+        );
+        assert!(SpanContext::from_traceparent("01-00-00-01").is_err());
+    }
+}
@@ -0,0 +1,441 @@
+//! Typed transactions. Every kind of transaction is a `Payload` wrapped in an
+//! `UnsignedTx` that names the sender, its signature scheme, a nonce and a fee.
+//! The sender signs the canonical msgpack encoding of the unsigned transaction
+//! with any registered scheme, so wallets are not tied to Dilithium2.
+use crate::accounts::Account;
+use crate::block::merkle_root;
+use crate::ccok::Certificate;
+use crate::governance::{GovernanceCert, Proposal};
+use crate::msgpack;
+use crate::msgpack::Msgpack;
+use crate::scheme::{lookup_scheme, verify_signature, SchemeId};
+use crate::signer::{SignatureScheme, Signer};
+use rayon::prelude::*;
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Sha3_256};
+
+/// Domain separation prefix of the signed transaction bytes
+const TX_DOMAIN: &[u8] = b"NIROPoK-TX";
+
+/// Body of a transaction of one kind
+pub trait Payload: Clone + Serialize + DeserializeOwned + Into<TxBody> {
+    /// Amount the transaction moves out of the sender's balance
+    fn amount(&self) -> u64;
+
+    /// Stateless validity checks of the payload
+    fn check(&self) -> Result<(), String> {
+        if self.amount() == 0 {
+            return Err("Transaction amount must be positive".to_string());
+        }
+        Ok(())
+    }
+}
+
+/// Transfer to another sidechain account
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Payment {
+    pub recipient: Account,
+    pub amount: u64,
+}
+
+/// Lock part of the sender's balance as validator stake
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Stake {
+    pub amount: u64,
+}
+
+/// Release part of the sender's stake
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Unstake {
+    pub amount: u64,
+}
+
+/// Burn bridged assets to be released to a main chain address
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BridgeWithdraw {
+    /// Main chain address receiving the assets
+    pub recipient: String,
+    pub amount: u64,
+}
+
+/// Register the key the sender signs certificates with as a validator; its
+/// weight follows the sender's stake
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Register {
+    /// Certificate public key in hex
+    pub public_key: String,
+    /// Scheme of the certificate public key
+    pub scheme: SchemeId,
+}
+
+/// Enact a governance proposal certified by the validators
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct GovernanceTx {
+    pub proposal: Proposal,
+    /// Canonical msgpack encoding of the certificate over the proposal
+    #[serde(with = "serde_bytes")]
+    pub certificate: Vec<u8>,
+}
+
+impl GovernanceTx {
+    pub fn new(cert: &GovernanceCert) -> Result<Self, String> {
+        Ok(Self {
+            proposal: cert.proposal.clone(),
+            certificate: cert.certificate.to_msgpack()?,
+        })
+    }
+
+    /// The certificate carried, decoded
+    pub fn cert(&self) -> Result<GovernanceCert, String> {
+        Ok(GovernanceCert {
+            proposal: self.proposal.clone(),
+            certificate: Certificate::from_msgpack(&self.certificate)?,
+        })
+    }
+}
+
+impl Payload for Payment {
+    fn amount(&self) -> u64 {
+        self.amount
+    }
+}
+
+impl Payload for Stake {
+    fn amount(&self) -> u64 {
+        self.amount
+    }
+}
+
+impl Payload for Unstake {
+    fn amount(&self) -> u64 {
+        self.amount
+    }
+}
+
+impl Payload for BridgeWithdraw {
+    fn amount(&self) -> u64 {
+        self.amount
+    }
+
+    fn check(&self) -> Result<(), String> {
+        if self.recipient.is_empty() {
+            return Err("Withdrawal recipient is empty".to_string());
+        }
+        if self.amount == 0 {
+            return Err("Transaction amount must be positive".to_string());
+        }
+        Ok(())
+    }
+}
+
+impl Payload for Register {
+    fn amount(&self) -> u64 {
+        0
+    }
+
+    fn check(&self) -> Result<(), String> {
+        let public_key = hex::decode(&self.public_key)
+            .map_err(|e| format!("Invalid validator public key: {}", e))?;
+        lookup_scheme(self.scheme)?.check_public_key_len(public_key.len())
+    }
+}
+
+impl Payload for GovernanceTx {
+    fn amount(&self) -> u64 {
+        0
+    }
+
+    fn check(&self) -> Result<(), String> {
+        self.cert().map(|_| ())
+    }
+}
+
+/// Payload of any kind, as carried in blocks
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub enum TxBody {
+    Payment(Payment),
+    Stake(Stake),
+    Unstake(Unstake),
+    BridgeWithdraw(BridgeWithdraw),
+    Register(Register),
+    Governance(GovernanceTx),
+}
+
+impl From<Payment> for TxBody {
+    fn from(payment: Payment) -> Self {
+        TxBody::Payment(payment)
+    }
+}
+
+impl From<Stake> for TxBody {
+    fn from(stake: Stake) -> Self {
+        TxBody::Stake(stake)
+    }
+}
+
+impl From<Unstake> for TxBody {
+    fn from(unstake: Unstake) -> Self {
+        TxBody::Unstake(unstake)
+    }
+}
+
+impl From<BridgeWithdraw> for TxBody {
+    fn from(withdraw: BridgeWithdraw) -> Self {
+        TxBody::BridgeWithdraw(withdraw)
+    }
+}
+
+impl From<Register> for TxBody {
+    fn from(register: Register) -> Self {
+        TxBody::Register(register)
+    }
+}
+
+impl From<GovernanceTx> for TxBody {
+    fn from(governance: GovernanceTx) -> Self {
+        TxBody::Governance(governance)
+    }
+}
+
+impl TxBody {
+    /// Amount the transaction moves out of the sender's balance
+    pub fn amount(&self) -> u64 {
+        match self {
+            TxBody::Payment(p) => p.amount(),
+            TxBody::Stake(p) => p.amount(),
+            TxBody::Unstake(p) => p.amount(),
+            TxBody::BridgeWithdraw(p) => p.amount(),
+            TxBody::Register(p) => p.amount(),
+            TxBody::Governance(p) => p.amount(),
+        }
+    }
+
+    /// Stateless validity checks of the payload
+    pub fn check(&self) -> Result<(), String> {
+        match self {
+            TxBody::Payment(p) => p.check(),
+            TxBody::Stake(p) => p.check(),
+            TxBody::Unstake(p) => p.check(),
+            TxBody::BridgeWithdraw(p) => p.check(),
+            TxBody::Register(p) => p.check(),
+            TxBody::Governance(p) => p.check(),
+        }
+    }
+}
+
+/// Transaction before signing
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct UnsignedTx {
+    /// Sender account, the hex public key of its signer
+    pub sender: Account,
+    /// Scheme the sender signs with
+    pub scheme: SchemeId,
+    /// Sequence number of the sender's transactions
+    pub nonce: u64,
+    pub fee: u64,
+    pub body: TxBody,
+}
+
+impl UnsignedTx {
+    /// Transaction of `payload` from the account of `signer`
+    pub fn new<P: Payload>(signer: &dyn Signer, nonce: u64, fee: u64, payload: P) -> Self {
+        Self {
+            sender: Account {
+                address: signer.public_key_hex(),
+            },
+            scheme: signer.scheme(),
+            nonce,
+            fee,
+            body: payload.into(),
+        }
+    }
+
+    /// Bytes signed by the sender: the domain prefix followed by the
+    /// canonical msgpack encoding
+    pub fn signing_bytes(&self) -> Result<Vec<u8>, String> {
+        let mut bytes = TX_DOMAIN.to_vec();
+        bytes.extend_from_slice(&msgpack::to_vec(self)?);
+        Ok(bytes)
+    }
+
+    /// Transaction id, the hash of the signed bytes
+    pub fn hash(&self) -> Result<[u8; 32], String> {
+        Ok(Sha3_256::digest(self.signing_bytes()?).into())
+    }
+
+    /// Sign with `signer`, which must be the sender's
+    pub fn sign(self, signer: &dyn Signer) -> Result<SignedTx, String> {
+        if signer.public_key_hex() != self.sender.address || signer.scheme() != self.scheme {
+            return Err("Signer is not the transaction sender".to_string());
+        }
+        let signature = signer.sign(&self.signing_bytes()?);
+        Ok(SignedTx {
+            tx: self,
+            signature,
+        })
+    }
+}
+
+/// Transaction together with the sender's signature
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SignedTx {
+    pub tx: UnsignedTx,
+    #[serde(with = "serde_bytes")]
+    pub signature: Vec<u8>,
+}
+
+impl SignedTx {
+    /// Transaction id, independent of the signature
+    pub fn hash(&self) -> Result<[u8; 32], String> {
+        self.tx.hash()
+    }
+
+    /// Canonical msgpack encoding of the signed transaction
+    pub fn encode(&self) -> Result<Vec<u8>, String> {
+        msgpack::to_vec(self)
+    }
+
+    /// Decode a signed transaction, rejecting non-canonical encodings
+    pub fn decode(bytes: &[u8]) -> Result<Self, String> {
+        msgpack::from_slice(bytes)
+    }
+}
+
+/// Checks signed transactions before they enter the mempool or a block
+#[derive(Debug, Clone)]
+pub struct TxVerifier {
+    schemes: Vec<SchemeId>,
+}
+
+impl Default for TxVerifier {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl TxVerifier {
+    /// Verifier accepting every built-in post-quantum scheme
+    pub fn new() -> Self {
+        Self {
+            schemes: SignatureScheme::ALL
+                .iter()
+                .filter(|scheme| scheme.is_post_quantum())
+                .map(SignatureScheme::id)
+                .collect(),
+        }
+    }
+
+    /// Accept only signatures of `schemes`
+    pub fn with_schemes(mut self, schemes: &[SchemeId]) -> Self {
+        self.schemes = schemes.to_vec();
+        self
+    }
+
+    /// Check the payload and the sender's signature
+    pub fn verify(&self, tx: &SignedTx) -> Result<(), String> {
+        let unsigned = &tx.tx;
+        if !self.schemes.contains(&unsigned.scheme) {
+            return Err(format!(
+                "Signature scheme {:?} not accepted",
+                unsigned.scheme
+            ));
+        }
+        unsigned.body.check()?;
+        let public_key = hex::decode(&unsigned.sender.address)
+            .map_err(|e| format!("Invalid sender public key: {}", e))?;
+        if !verify_signature(
+            unsigned.scheme,
+            &public_key,
+            &unsigned.signing_bytes()?,
+            &tx.signature,
+        )? {
+            return Err("Invalid transaction signature".to_string());
+        }
+        Ok(())
+    }
+
+    /// Check every transaction in parallel, failing on the first invalid one
+    pub fn verify_all(&self, txs: &[SignedTx]) -> Result<(), String> {
+        txs.par_iter().try_for_each(|tx| self.verify(tx))
+    }
+}
+
+/// Transaction root of a block header over `txs`, in order
+pub fn tx_root(txs: &[SignedTx]) -> Result<[u8; 32], String> {
+    let hashes = txs
+        .iter()
+        .map(SignedTx::hash)
+        .collect::<Result<Vec<_>, _>>()?;
+    Ok(merkle_root(&hashes))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::signer::DilithiumSigner;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_sign_and_verify() {
+        let wallet = Wallet::new().expect("Failed to create wallet");
+        let signer = DilithiumSigner::new().expect("Failed to create signer");
+        let payment = UnsignedTx::new(
+            &wallet,
+            0,
+            1,
+            Payment {
+                recipient: Account {
+                    address: signer.public_key_hex(),
+                },
+                amount: 10,
+            },
+        )
+        .sign(&wallet)
+        .unwrap();
+        let withdraw = UnsignedTx::new(
+            &signer,
+            0,
+            1,
+            BridgeWithdraw {
+                recipient: "0xbob".to_string(),
+                amount: 5,
+            },
+        )
+        .sign(&signer)
+        .unwrap();
+
+        let verifier = TxVerifier::new();
+        verifier
+            .verify_all(&[payment.clone(), withdraw.clone()])
+            .unwrap();
+        assert_eq!(
+            SignedTx::decode(&payment.encode().unwrap()).unwrap(),
+            payment
+        );
+
+        // Only the sender can sign, and changed transactions no longer verify
+        assert!(UnsignedTx::new(&wallet, 1, 1, Stake { amount: 1 })
+            .sign(&signer)
+            .is_err());
+        let mut tampered = withdraw.clone();
+        tampered.tx.body = BridgeWithdraw {
+            recipient: "0xbob".to_string(),
+            amount: 50,
+        }
+        .into();
+        assert!(verifier.verify(&tampered).is_err());
+        let zero = UnsignedTx::new(&signer, 1, 1, Unstake { amount: 0 })
+            .sign(&signer)
+            .unwrap();
+        assert!(verifier.verify(&zero).is_err());
+        let dilithium2 = TxVerifier::new().with_schemes(&[SignatureScheme::Dilithium2.id()]);
+        assert!(dilithium2.verify(&payment).is_ok());
+        assert!(dilithium2.verify(&withdraw).is_err());
+
+        // The root commits to the transactions in order
+        let root = tx_root(&[payment.clone(), withdraw.clone()]).unwrap();
+        assert_ne!(root, tx_root(&[withdraw, payment]).unwrap());
+        assert_eq!(tx_root(&[]).unwrap(), [0u8; 32]);
+    }
+}
@@ -0,0 +1,312 @@
+//! Validator set of the typed transactions. Accounts join with a `Register`
+//! transaction naming the key they sign certificates with, and take part in
+//! an epoch with a weight proportional to their stake in the `ChainState`.
+//! Each epoch's participants and party tree root follow from the registrations
+//! and the state at its start; the root is the voters commitment the state
+//! proofs of the previous epoch hand over to.
+use crate::accounts::Account;
+use crate::block::Block;
+use crate::ccok::{Builder, KeyLayout, Params, Participant};
+use crate::config::STAKING_AMOUNT;
+use crate::error::CcokError;
+use crate::merkle::{Hashing, MerkleTreeBuilder};
+use crate::scheme::SchemeId;
+use crate::state::ChainState;
+use crate::stateproof::{voters_commitment, StateProofMessage};
+use crate::tx::{SignedTx, TxBody};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+/// Conversion of stake into certificate weight
+#[derive(Debug, Clone)]
+pub struct ValidatorConfig {
+    /// Stake below which a registered account has no weight
+    pub min_stake: u64,
+    /// Stake per unit of weight
+    pub stake_per_weight: u64,
+}
+
+impl Default for ValidatorConfig {
+    fn default() -> Self {
+        Self {
+            min_stake: STAKING_AMOUNT as u64,
+            stake_per_weight: 1,
+        }
+    }
+}
+
+/// Certificate key registered by an account
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Registration {
+    pub account: Account,
+    /// Certificate public key in hex
+    pub public_key: String,
+    pub scheme: SchemeId,
+}
+
+/// Registered validators
+#[derive(Debug, Clone)]
+pub struct ValidatorSet {
+    config: ValidatorConfig,
+    /// Registrations by account address; a later registration replaces the key
+    registrations: BTreeMap<String, Registration>,
+    /// Whether governance froze the set, ignoring registrations
+    frozen: bool,
+}
+
+/// Validators of one epoch
+#[derive(Debug, Clone)]
+pub struct EpochValidators {
+    pub epoch: u64,
+    /// Participants, ordered by account address
+    pub participants: Vec<Participant>,
+    /// Party tree root of the participants, the voters commitment of the epoch
+    pub root: Vec<u8>,
+}
+
+impl EpochValidators {
+    /// Total weight of the participants
+    pub fn total_weight(&self) -> u64 {
+        self.participants.iter().map(|p| p.weight).sum()
+    }
+
+    /// Root in the form of the block header validator root
+    pub fn validator_root(&self) -> Result<[u8; 32], String> {
+        self.root
+            .as_slice()
+            .try_into()
+            .map_err(|_| format!("Invalid party tree root length: {}", self.root.len()))
+    }
+
+    /// Party tree of the participants
+    pub fn party_tree(&self, hashing: Hashing) -> Result<MerkleTreeBuilder, String> {
+        let mut tree = MerkleTreeBuilder::with_hash(hashing);
+        tree.build(&self.participants)?;
+        Ok(tree)
+    }
+
+    /// State proof message over `blocks`, the last interval before the
+    /// epoch, handing over to its validators
+    pub fn handover_message(
+        &self,
+        hashing: Hashing,
+        blocks: &[Block],
+    ) -> Result<StateProofMessage, String> {
+        Ok(StateProofMessage::new(hashing, blocks, self.root.clone())?)
+    }
+
+    /// Certificate builder of the epoch's validators over `params`
+    pub fn builder(&self, params: Params) -> Result<Builder, CcokError> {
+        Builder::new(params, self.participants.clone(), self.root.clone())
+    }
+}
+
+impl ValidatorSet {
+    pub fn new(config: ValidatorConfig) -> Self {
+        Self {
+            config,
+            registrations: BTreeMap::new(),
+            frozen: false,
+        }
+    }
+
+    /// Freeze the set, or unfreeze it
+    pub fn set_frozen(&mut self, frozen: bool) {
+        self.frozen = frozen;
+    }
+
+    pub fn is_frozen(&self) -> bool {
+        self.frozen
+    }
+
+    /// Registration of `account`
+    pub fn registration(&self, account: &Account) -> Option<&Registration> {
+        self.registrations.get(&account.address)
+    }
+
+    /// Account that registered the certificate key `public_key`
+    pub fn account_of(&self, public_key: &str) -> Option<&Account> {
+        self.registrations
+            .values()
+            .find(|registration| registration.public_key == public_key)
+            .map(|registration| &registration.account)
+    }
+
+    /// Record the registration of a verified transaction; returns whether it
+    /// recorded one. A frozen set ignores registrations.
+    pub fn register(&mut self, tx: &SignedTx) -> Result<bool, String> {
+        let TxBody::Register(register) = &tx.tx.body else {
+            return Ok(false);
+        };
+        if self.frozen {
+            return Ok(false);
+        }
+        tx.tx.body.check()?;
+        let account = tx.tx.sender.clone();
+        self.registrations.insert(
+            account.address.clone(),
+            Registration {
+                account,
+                public_key: register.public_key.clone(),
+                scheme: register.scheme,
+            },
+        );
+        Ok(true)
+    }
+
+    /// Record the registrations of a block applied to the state, returning
+    /// how many it held
+    pub fn apply_block(&mut self, block: &Block) -> Result<usize, String> {
+        let mut registered = 0;
+        for tx in &block.txs {
+            if self.register(tx)? {
+                registered += 1;
+            }
+        }
+        Ok(registered)
+    }
+
+    /// Certificate weight of `stake`
+    pub fn weight(&self, stake: u64) -> u64 {
+        if stake < self.config.min_stake || self.config.stake_per_weight == 0 {
+            return 0;
+        }
+        stake / self.config.stake_per_weight
+    }
+
+    /// Registered accounts with weight under `state`, as participants
+    pub fn participants(&self, state: &ChainState) -> Vec<Participant> {
+        self.registrations
+            .values()
+            .filter_map(|registration| {
+                let weight = self.weight(state.account(&registration.account).stake);
+                (weight > 0).then(|| Participant {
+                    public_key: registration.public_key.clone(),
+                    weight,
+                    scheme: registration.scheme,
+                    key_commitment: None,
+                    vrf_key: None,
+                    key_layout: KeyLayout::InLeaf,
+                })
+            })
+            .collect()
+    }
+
+    /// Validators of `epoch` from the state at its start
+    pub fn epoch(
+        &self,
+        epoch: u64,
+        hashing: Hashing,
+        state: &ChainState,
+    ) -> Result<EpochValidators, String> {
+        let participants = self.participants(state);
+        if participants.is_empty() {
+            return Err(format!("No validator with stake for epoch {}", epoch));
+        }
+        let root = voters_commitment(hashing, &participants)?;
+        Ok(EpochValidators {
+            epoch,
+            participants,
+            root,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::merkle::HashAlgorithm;
+    use crate::signer::{DilithiumSigner, Signer};
+    use crate::tx::{Register, Stake, UnsignedTx};
+    use crate::utils::Seed;
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_epoch_validators() {
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let wallets: Vec<Wallet> = (0..3)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let mut state = ChainState::new(hashing);
+        let mut validators = ValidatorSet::new(ValidatorConfig {
+            min_stake: 100,
+            stake_per_weight: 10,
+        });
+        let proposer = Account {
+            address: "proposer".to_string(),
+        };
+
+        // Each account registers a certificate key and stakes
+        let cert_keys: Vec<DilithiumSigner> = (0..3)
+            .map(|_| DilithiumSigner::new().expect("Failed to create signer"))
+            .collect();
+        for ((wallet, key), stake) in wallets.iter().zip(&cert_keys).zip([300, 150, 50]) {
+            let account = Account {
+                address: wallet.public_key_hex(),
+            };
+            state.credit(&account, 1000).unwrap();
+            let txs = vec![
+                UnsignedTx::new(
+                    wallet,
+                    0,
+                    0,
+                    Register {
+                        public_key: key.public_key_hex(),
+                        scheme: key.scheme(),
+                    },
+                )
+                .sign(wallet)
+                .unwrap(),
+                UnsignedTx::new(wallet, 1, 0, Stake { amount: stake })
+                    .sign(wallet)
+                    .unwrap(),
+            ];
+            state.apply_txs(&txs, &proposer).unwrap();
+            for tx in &txs {
+                validators.register(tx).unwrap();
+            }
+        }
+
+        // The account below the minimum stake has no weight
+        let epoch = validators.epoch(1, hashing, &state).unwrap();
+        let weights: Vec<u64> = epoch.participants.iter().map(|p| p.weight).collect();
+        assert_eq!(epoch.participants.len(), 2);
+        assert_eq!(epoch.total_weight(), 45);
+        assert!(weights.contains(&30) && weights.contains(&15));
+        assert_eq!(epoch.party_tree(hashing).unwrap().root(), epoch.root);
+        let block = Block::new(
+            1,
+            [0u8; 32],
+            0,
+            vec![],
+            proposer.clone(),
+            String::new(),
+            Seed { seed: [0u8; 32] },
+            None,
+        )
+        .unwrap();
+        let message = epoch.handover_message(hashing, &[block]).unwrap();
+        assert_eq!(message.voters_commitment, epoch.root);
+        assert!(epoch
+            .participants
+            .iter()
+            .all(|p| cert_keys.iter().any(|k| k.public_key_hex() == p.public_key)));
+
+        // Invalid keys don't register
+        let invalid = UnsignedTx::new(
+            &wallets[0],
+            2,
+            0,
+            Register {
+                public_key: "00".to_string(),
+                scheme: wallets[0].scheme(),
+            },
+        )
+        .sign(&wallets[0])
+        .unwrap();
+        assert!(validators.register(&invalid).is_err());
+        assert!(ValidatorSet::new(ValidatorConfig::default())
+            .epoch(1, hashing, &state)
+            .is_err());
+    }
+}
@@ -0,0 +1,189 @@
+//! Hash-based verifiable random function. A participant commits to one
+//! secret value per round in a Merkle tree and publishes the root with its
+//! party-tree leaf. Evaluating the VRF for a round reveals that round's value
+//! and its path, so the output is unique and can't be ground, while the
+//! values of later rounds stay unpredictable to everyone else. Only hashing
+//! is involved, which keeps the construction post-quantum.
+//!
+//! Revealing a round's value discloses the outputs of every input of that
+//! round, so each round should be evaluated once: use a single input per
+//! round for both leader election and sortition.
+use crate::ephemeral::KeyLifetime;
+use crate::merkle::{verify_proof_with, AuditPath, HashAlgorithm, Hashing, MerkleTreeBuilder};
+use rand::Rng;
+use serde::{Deserialize, Serialize};
+use sha3::{Digest, Keccak256};
+
+const SECRET_TAG: &[u8] = b"niropok/vrf-secret\0";
+const OUTPUT_TAG: &[u8] = b"niropok/vrf-output\0";
+
+/// Hashing of VRF value trees
+pub const VRF_HASHING: Hashing = Hashing {
+    algorithm: HashAlgorithm::Keccak256,
+    domains: true,
+};
+
+/// Leaf of a VRF value tree
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct ValueLeaf {
+    round: u64,
+    value: [u8; 32],
+}
+
+/// Public key of a VRF, published in the participant's party-tree leaf
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct VrfPublicKey {
+    /// Root of the Merkle tree over the per-round values
+    pub root: Vec<u8>,
+    /// Rounds the key can be evaluated for
+    pub lifetime: KeyLifetime,
+}
+
+/// Proof of a VRF evaluation
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct VrfProof {
+    /// Round the value belongs to
+    pub round: u64,
+    /// Committed value of the round
+    pub value: [u8; 32],
+    /// Merkle path from the value leaf to the key root
+    pub path: AuditPath,
+}
+
+/// Output of the VRF for the committed `value` and `input`
+fn output(value: &[u8; 32], input: &[u8]) -> [u8; 32] {
+    let mut hasher = Keccak256::new();
+    hasher.update(OUTPUT_TAG);
+    hasher.update(value);
+    hasher.update(input);
+    hasher.finalize().into()
+}
+
+impl VrfPublicKey {
+    /// Check `proof` for `input` and return the VRF output
+    pub fn verify(&self, input: &[u8], proof: &VrfProof) -> Result<[u8; 32], String> {
+        let index = self.lifetime.index(proof.round)?;
+        let leaf = VRF_HASHING.leaf_hash(&ValueLeaf {
+            round: proof.round,
+            value: proof.value,
+        })?;
+        if proof.path.total_leaves != self.lifetime.rounds as usize
+            || !verify_proof_with(VRF_HASHING, &self.root, index, &leaf, &proof.path)
+        {
+            return Err(format!("Invalid VRF proof for round {}", proof.round));
+        }
+        Ok(output(&proof.value, input))
+    }
+}
+
+/// Secret VRF key. The per-round values are derived from a seed, so only the
+/// seed and the value tree are kept.
+pub struct VrfKey {
+    seed: [u8; 32],
+    lifetime: KeyLifetime,
+    tree: MerkleTreeBuilder,
+}
+
+// Implement Debug trait for VrfKey without leaking the seed
+impl std::fmt::Debug for VrfKey {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "VrfKey {{ lifetime: {:?}, seed: <secret> }}",
+            self.lifetime
+        )
+    }
+}
+
+impl VrfKey {
+    /// Generate a key covering `lifetime` from a random seed
+    pub fn generate(lifetime: KeyLifetime) -> Result<Self, String> {
+        Self::from_seed(rand::thread_rng().gen(), lifetime)
+    }
+
+    /// Derive a key covering `lifetime` from `seed`
+    pub fn from_seed(seed: [u8; 32], lifetime: KeyLifetime) -> Result<Self, String> {
+        if lifetime.rounds == 0 {
+            return Err("VRF lifetime must cover at least one round".to_string());
+        }
+        let leaves: Vec<ValueLeaf> = (0..lifetime.rounds)
+            .map(|i| {
+                let round = lifetime.first_round + i;
+                ValueLeaf {
+                    round,
+                    value: Self::value(&seed, round),
+                }
+            })
+            .collect();
+        let mut tree = MerkleTreeBuilder::with_hash(VRF_HASHING);
+        tree.build(&leaves)?;
+        Ok(Self {
+            seed,
+            lifetime,
+            tree,
+        })
+    }
+
+    fn value(seed: &[u8; 32], round: u64) -> [u8; 32] {
+        let mut hasher = Keccak256::new();
+        hasher.update(SECRET_TAG);
+        hasher.update(seed);
+        hasher.update(round.to_le_bytes());
+        hasher.finalize().into()
+    }
+
+    /// Public key to publish with the participant
+    pub fn public_key(&self) -> VrfPublicKey {
+        VrfPublicKey {
+            root: self.tree.root(),
+            lifetime: self.lifetime,
+        }
+    }
+
+    /// Evaluate the VRF on `input` for `round`
+    pub fn prove(&self, round: u64, input: &[u8]) -> Result<([u8; 32], VrfProof), String> {
+        let index = self.lifetime.index(round)?;
+        let value = Self::value(&self.seed, round);
+        let proof = VrfProof {
+            round,
+            value,
+            path: self.tree.prove_leaf(index)?,
+        };
+        Ok((output(&value, input), proof))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_prove_verify() {
+        let key = VrfKey::generate(KeyLifetime::new(10, 5)).unwrap();
+        let public_key = key.public_key();
+        let (out, proof) = key.prove(12, b"seed of round 12").unwrap();
+        assert_eq!(public_key.verify(b"seed of round 12", &proof).unwrap(), out);
+        assert_ne!(public_key.verify(b"other input", &proof).unwrap(), out);
+
+        // Values are bound to their round and key
+        let mut moved = proof.clone();
+        moved.round = 13;
+        assert!(public_key.verify(b"seed of round 12", &moved).is_err());
+        let mut forged = proof.clone();
+        forged.value[0] ^= 1;
+        assert!(public_key.verify(b"seed of round 12", &forged).is_err());
+        let other = VrfKey::generate(KeyLifetime::new(10, 5)).unwrap();
+        assert!(other
+            .public_key()
+            .verify(b"seed of round 12", &proof)
+            .is_err());
+        assert!(key.prove(15, b"seed of round 15").is_err());
+
+        // The same seed always gives the same key and outputs
+        let seed = [7u8; 32];
+        let a = VrfKey::from_seed(seed, KeyLifetime::new(0, 3)).unwrap();
+        let b = VrfKey::from_seed(seed, KeyLifetime::new(0, 3)).unwrap();
+        assert_eq!(a.public_key(), b.public_key());
+        assert_eq!(a.prove(1, b"x").unwrap().0, b.prove(1, b"x").unwrap().0);
+    }
+}
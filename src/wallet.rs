@@ -1,4 +1,6 @@
-use crystals_dilithium::dilithium2::{Keypair, Signature};
+use crate::scheme::SchemeId;
+use crate::signer::{zeroize, ExportableSigner, SignatureScheme, Signer};
+use crystals_dilithium::dilithium2::{self, Keypair, Signature};
 use rand::Rng;
 use serde::{Deserialize, Deserializer, Serialize, Serializer};
 
@@ -41,8 +43,24 @@ impl std::fmt::Debug for Wallet {
 impl Wallet {
     pub fn new() -> Result<Self, String> {
         let seed = rand::thread_rng().gen::<[u8; 32]>();
-        let keypair = Keypair::generate(Some(&seed));
-        Ok(Self { keypair })
+        Ok(Self::from_seed(&seed))
+    }
+
+    /// Deterministically derive the keypair from a 32-byte seed
+    pub fn from_seed(seed: &[u8; 32]) -> Self {
+        Self {
+            keypair: Keypair::generate(Some(seed)),
+        }
+    }
+
+    /// Wallet of the keypair bytes `export_secret` gave
+    pub fn from_bytes(bytes: &[u8]) -> Result<Self, String> {
+        if bytes.len() != dilithium2::PUBLICKEYBYTES + dilithium2::SECRETKEYBYTES {
+            return Err(format!("Invalid Dilithium2 key length: {}", bytes.len()));
+        }
+        Ok(Self {
+            keypair: Keypair::from_bytes(bytes),
+        })
     }
 
     pub fn sign_message(&self, msg: &[u8]) -> Signature {
@@ -61,3 +79,33 @@ impl Wallet {
         hex::encode(self.keypair.secret.to_bytes())
     }
 }
+
+impl Signer for Wallet {
+    fn scheme(&self) -> SchemeId {
+        SignatureScheme::Dilithium2.id()
+    }
+
+    fn public_key(&self) -> Vec<u8> {
+        self.keypair.public.to_bytes().to_vec()
+    }
+
+    fn sign(&self, msg: &[u8]) -> Vec<u8> {
+        self.sign_message(msg).to_vec()
+    }
+}
+
+impl ExportableSigner for Wallet {
+    fn export_secret(&self) -> Vec<u8> {
+        self.keypair.to_bytes().to_vec()
+    }
+
+    fn zeroize(&mut self) {
+        zeroize(&mut self.keypair.secret.bytes);
+    }
+}
+
+impl Drop for Wallet {
+    fn drop(&mut self) {
+        ExportableSigner::zeroize(self);
+    }
+}
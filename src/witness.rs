@@ -0,0 +1,579 @@
+//! Witnesses of certificate validity for external succinct provers.
+//! `CertWitness::extract` lays a certificate out the way a circuit consumes
+//! it: public inputs in 32-byte words, reveals in position order with their
+//! leaf preimages and fixed-depth audit paths, and one entry per coin naming
+//! the reveal it lands in. `CertWitness::check` is the reference semantics of
+//! the arithmetization in `ARITHMETIZATION.md`: a proof of the witness is a
+//! proof that the certificate verifies. A `Prover` turns witnesses into
+//! `ValidityProof`s, e.g. by handing them to a STARK prover out of process.
+use crate::ccok::{
+    coin_value, num_coins, Certificate, Params, Participant, Reveal, SigSlot, PARAMS_V5,
+};
+use crate::error::CcokError;
+use crate::logging::VERIFIER;
+use crate::merkle::{AuditPath, HashAlgorithm, HashDomain, Hashing, MerkleTreeBuilder};
+use log::debug;
+use serde::{Deserialize, Serialize};
+
+/// Layout version of witnesses, changed with every change of the arithmetization
+pub const WITNESS_VERSION: u8 = 1;
+
+/// Values a validity proof is checked against, known to the on-chain verifier
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PublicInputs {
+    pub party_tree_root: [u8; 32],
+    pub sig_commit: [u8; 32],
+    /// Hash of `Params::msg` with the params hash function
+    pub message_hash: [u8; 32],
+    pub proven_weight: u64,
+    pub signed_weight: u64,
+    pub total_sigs: u64,
+    pub num_coins: u64,
+    pub security_param: u32,
+    pub hash: u8,
+    pub version: u8,
+}
+
+impl PublicInputs {
+    /// Inputs as 32-byte words, integers big-endian in the low bytes, in
+    /// field order
+    pub fn to_words(&self) -> Vec<[u8; 32]> {
+        let mut words = vec![self.party_tree_root, self.sig_commit, self.message_hash];
+        for value in [
+            self.proven_weight,
+            self.signed_weight,
+            self.total_sigs,
+            self.num_coins,
+            self.security_param as u64,
+            self.hash as u64,
+            self.version as u64,
+        ] {
+            let mut word = [0u8; 32];
+            word[24..].copy_from_slice(&value.to_be_bytes());
+            words.push(word);
+        }
+        words
+    }
+
+    /// Keccak256 of the words, a single input for proof systems that take one
+    pub fn commitment(&self) -> [u8; 32] {
+        let words = self.to_words();
+        let parts: Vec<&[u8]> = words.iter().map(|word| word.as_slice()).collect();
+        HashAlgorithm::Keccak256.hash_parts(&parts)
+    }
+}
+
+/// One level of a fixed-depth audit path, from the leaf up
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PathStep {
+    /// Sibling hash, zero when the node is carried up
+    pub sibling: [u8; 32],
+    /// Whether the node is the right child of its parent
+    pub right: bool,
+    /// Whether the node is the last of an odd layer, its own parent
+    pub carry: bool,
+}
+
+/// Root reached from `leaf` along `path`
+pub fn fold_path(hashing: Hashing, leaf: [u8; 32], path: &[PathStep]) -> [u8; 32] {
+    path.iter()
+        .fold(leaf, |node, step| match (step.carry, step.right) {
+            (true, _) => node,
+            (false, true) => hashing.hash_pair(&step.sibling, Some(&node)),
+            (false, false) => hashing.hash_pair(&node, Some(&step.sibling)),
+        })
+}
+
+// Direction and carry flags of every level above `index` in a tree of
+// `total_leaves`, which fix the shape a path must have
+fn path_shape(index: usize, total_leaves: usize) -> Vec<(bool, bool)> {
+    let mut shape = Vec::new();
+    let (mut index, mut len) = (index, total_leaves);
+    while len > 1 {
+        shape.push((index % 2 == 1, index ^ 1 >= len));
+        index /= 2;
+        len = (len + 1) / 2;
+    }
+    shape
+}
+
+// Audit path of `index` as fixed-depth steps
+fn fixed_path(index: usize, path: &AuditPath) -> Result<Vec<PathStep>, CcokError> {
+    let mut siblings = path.siblings.iter();
+    path_shape(index, path.total_leaves)
+        .into_iter()
+        .map(|(right, carry)| {
+            let sibling = match carry {
+                true => [0u8; 32],
+                false => siblings
+                    .next()
+                    .and_then(|sibling| sibling.as_slice().try_into().ok())
+                    .ok_or_else(|| CcokError::BadMerklePath("short audit path".to_string()))?,
+            };
+            Ok(PathStep {
+                sibling,
+                right,
+                carry,
+            })
+        })
+        .collect()
+}
+
+/// A revealed signature slot with everything a circuit checks about it
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RevealWitness {
+    pub position: u64,
+    pub accumulated_weight: u64,
+    pub weight: u64,
+    pub scheme: u16,
+    /// Key the signature verifies under, raw bytes
+    pub public_key: Vec<u8>,
+    pub signature: Vec<u8>,
+    /// bincode encodings of the `SigSlot` and `Participant` leaves
+    pub sig_leaf_preimage: Vec<u8>,
+    pub party_leaf_preimage: Vec<u8>,
+    pub sig_path: Vec<PathStep>,
+    pub party_path: Vec<PathStep>,
+}
+
+/// A coin of the certificate and the reveal, by witness index, it lands in
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CoinWitness {
+    pub index: u64,
+    pub coin: u64,
+    pub reveal: u64,
+}
+
+/// Everything a prover needs to show that a certificate verifies
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CertWitness {
+    pub version: u8,
+    pub params: Params,
+    pub public: PublicInputs,
+    /// Reveals by increasing position
+    pub reveals: Vec<RevealWitness>,
+    /// One entry per coin, by index
+    pub coins: Vec<CoinWitness>,
+}
+
+impl CertWitness {
+    /// Witness of `cert` under `params` and the party tree root; fails for
+    /// certificates that don't carry what verification needs
+    pub fn extract(
+        cert: &Certificate,
+        params: &Params,
+        party_tree_root: &[u8],
+    ) -> Result<Self, CcokError> {
+        params.validate()?;
+        // Witnesses open the signature tree of a plain Merkle multiproof
+        if params.version >= PARAMS_V5 {
+            return Err(CcokError::UnsupportedVersion(params.version));
+        }
+        let hashing = params.hashing();
+        let root = |bytes: &[u8], tree: &str| -> Result<[u8; 32], CcokError> {
+            bytes
+                .try_into()
+                .map_err(|_| CcokError::BadMerklePath(format!("{} root is not 32 bytes", tree)))
+        };
+        let public = PublicInputs {
+            party_tree_root: root(party_tree_root, "party tree")?,
+            sig_commit: root(&cert.sig_commit, "signature tree")?,
+            message_hash: params.hash.hash(&params.msg),
+            proven_weight: params.proven_weight,
+            signed_weight: cert.signed_weight,
+            total_sigs: cert.total_sigs as u64,
+            num_coins: num_coins(params, cert.signed_weight.max(1)) as u64,
+            security_param: params.security_param,
+            hash: params.hash.id(),
+            version: params.version,
+        };
+        // Also checks the hash and version of the certificate and that every
+        // coin lands in a reveal
+        let flips = cert.coin_flips(params, party_tree_root)?;
+
+        let reveals: Vec<(usize, &Reveal)> = cert
+            .reveals
+            .iter()
+            .map(|(pos, reveal)| (*pos as usize, reveal))
+            .collect();
+        let positions: Vec<usize> = reveals.iter().map(|(pos, _)| *pos).collect();
+        let sig_leaves = reveals
+            .iter()
+            .map(|(_, reveal)| hashing.leaf_hash(&reveal.sig_slot))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        let party_leaves = reveals
+            .iter()
+            .map(|(_, reveal)| hashing.leaf_hash(&reveal.party))
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        let sig_paths = MerkleTreeBuilder::expand_proof(
+            hashing,
+            &cert.sig_commit,
+            &cert.sig_proof_hashes()?,
+            &positions,
+            cert.total_sigs,
+            &sig_leaves,
+        )
+        .ok_or_else(|| CcokError::BadMerklePath("signature multiproof".to_string()))?;
+        let party_paths = MerkleTreeBuilder::expand_proof(
+            hashing,
+            party_tree_root,
+            &cert.party_proof_hashes()?,
+            &positions,
+            cert.total_sigs,
+            &party_leaves,
+        )
+        .ok_or_else(|| CcokError::BadMerklePath("participant multiproof".to_string()))?;
+
+        let reveals = reveals
+            .iter()
+            .zip(sig_paths.iter().zip(&party_paths))
+            .map(|((pos, reveal), (sig_path, party_path))| {
+                let missing = || CcokError::InvalidReveal(*pos as u64);
+                Ok(RevealWitness {
+                    position: *pos as u64,
+                    accumulated_weight: reveal.sig_slot.accumulated_weight,
+                    weight: reveal.party.weight,
+                    scheme: reveal.party.scheme.0,
+                    public_key: hex::decode(reveal.signing_key().ok_or_else(missing)?)?,
+                    signature: reveal
+                        .sig_slot
+                        .signature
+                        .as_ref()
+                        .ok_or_else(missing)?
+                        .as_bytes()
+                        .to_vec(),
+                    sig_leaf_preimage: bincode::serialize(&reveal.sig_slot)?,
+                    party_leaf_preimage: bincode::serialize(&reveal.party)?,
+                    sig_path: fixed_path(*pos, sig_path)?,
+                    party_path: fixed_path(*pos, party_path)?,
+                })
+            })
+            .collect::<Result<Vec<_>, CcokError>>()?;
+        let coins = flips
+            .iter()
+            .map(|flip| CoinWitness {
+                index: flip.index,
+                coin: flip.coin,
+                reveal: positions.partition_point(|&pos| (pos as u64) < flip.position) as u64,
+            })
+            .collect();
+
+        Ok(Self {
+            version: WITNESS_VERSION,
+            params: params.clone(),
+            public,
+            reveals,
+            coins,
+        })
+    }
+
+    /// Check every constraint of the arithmetization natively
+    pub fn check(&self) -> Result<bool, CcokError> {
+        let params = &self.params;
+        params.validate()?;
+        let public = &self.public;
+        if self.version != WITNESS_VERSION {
+            debug!(target: VERIFIER, "Unknown witness version {}", self.version);
+            return Ok(false);
+        }
+
+        // W1: the public inputs are those of the params
+        if public.message_hash != params.hash.hash(&params.msg)
+            || public.proven_weight != params.proven_weight
+            || public.security_param != params.security_param
+            || public.hash != params.hash.id()
+            || public.version != params.version
+            || public.signed_weight < params.proven_weight
+            || public.num_coins != num_coins(params, public.signed_weight.max(1)) as u64
+        {
+            debug!(target: VERIFIER, "Public inputs don't match the params");
+            return Ok(false);
+        }
+
+        // W2: reveals by increasing position, each leaf of both trees
+        let hashing = params.hashing();
+        let total_sigs = public.total_sigs as usize;
+        let mut last = None;
+        for reveal in &self.reveals {
+            let pos = reveal.position as usize;
+            if pos >= total_sigs || last.map_or(false, |last| pos <= last) {
+                debug!(target: VERIFIER, "Reveal position {} out of order", pos);
+                return Ok(false);
+            }
+            last = Some(pos);
+            let shape = path_shape(pos, total_sigs);
+            for (path, preimage, root) in [
+                (
+                    &reveal.sig_path,
+                    &reveal.sig_leaf_preimage,
+                    &public.sig_commit,
+                ),
+                (
+                    &reveal.party_path,
+                    &reveal.party_leaf_preimage,
+                    &public.party_tree_root,
+                ),
+            ] {
+                let leaf = hashing.hash(HashDomain::Leaf, preimage);
+                if path.len() != shape.len()
+                    || path
+                        .iter()
+                        .zip(&shape)
+                        .any(|(step, &(right, carry))| step.right != right || step.carry != carry)
+                    || &fold_path(hashing, leaf, path) != root
+                {
+                    debug!(target: VERIFIER, "Audit path of position {} failed", pos);
+                    return Ok(false);
+                }
+            }
+
+            // W3: the witness fields are those the preimages commit to, and
+            // the signature verifies
+            let slot: SigSlot = bincode::deserialize(&reveal.sig_leaf_preimage)?;
+            let party: Participant = bincode::deserialize(&reveal.party_leaf_preimage)?;
+            let public_key = party.reveals_key().then(|| hex::encode(&reveal.public_key));
+            let reveal_of_leaves = Reveal {
+                sig_slot: slot,
+                party,
+                public_key,
+            };
+            let committed_key = reveal_of_leaves
+                .signing_key()
+                .map(hex::decode)
+                .transpose()?;
+            if reveal_of_leaves.sig_slot.accumulated_weight != reveal.accumulated_weight
+                || reveal_of_leaves.party.weight != reveal.weight
+                || reveal_of_leaves.party.scheme.0 != reveal.scheme
+                || committed_key.as_ref() != Some(&reveal.public_key)
+                || reveal_of_leaves
+                    .sig_slot
+                    .signature
+                    .as_ref()
+                    .map(|sig| sig.as_bytes())
+                    != Some(reveal.signature.as_slice())
+            {
+                debug!(target: VERIFIER, "Reveal at position {} doesn't match its leaves", pos);
+                return Ok(false);
+            }
+            if !reveal_of_leaves.verify(params, reveal.position)? {
+                return Ok(false);
+            }
+        }
+
+        // W4: every coin is the Fiat-Shamir coin of its index and lands in the
+        // signed weight range of its reveal
+        if self.coins.len() as u64 != public.num_coins {
+            debug!(target: VERIFIER, "Witness has {} coins", self.coins.len());
+            return Ok(false);
+        }
+        for (index, coin) in self.coins.iter().enumerate() {
+            let expected = coin_value(
+                params,
+                index as u64,
+                &public.sig_commit,
+                public.signed_weight,
+                &public.party_tree_root,
+            );
+            let reveal = match self.reveals.get(coin.reveal as usize) {
+                Some(reveal) => reveal,
+                None => return Ok(false),
+            };
+            let end = reveal
+                .accumulated_weight
+                .checked_add(reveal.weight)
+                .ok_or(CcokError::WeightOverflow)?;
+            if coin.index != index as u64
+                || coin.coin != expected
+                || coin.coin < reveal.accumulated_weight
+                || coin.coin >= end
+            {
+                debug!(target: VERIFIER, "Coin {} doesn't land in its reveal", index);
+                return Ok(false);
+            }
+        }
+        Ok(true)
+    }
+}
+
+/// Succinct proof that a certificate verifies
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ValidityProof {
+    /// Proof system that produced the proof
+    pub system: String,
+    pub public: PublicInputs,
+    pub proof: Vec<u8>,
+}
+
+/// Proof system proving certificate witnesses, e.g. a STARK prover
+pub trait Prover {
+    /// Name of the proof system, recorded in its proofs
+    fn system(&self) -> &str;
+
+    /// Prove that the witness satisfies the arithmetization
+    fn prove(&self, witness: &CertWitness) -> Result<ValidityProof, String>;
+
+    /// Verify a proof of this system against its public inputs
+    fn verify(&self, proof: &ValidityProof) -> Result<bool, String>;
+}
+
+/// Extract the witness of a certificate and prove it with `prover`
+pub fn prove_certificate(
+    prover: &dyn Prover,
+    cert: &Certificate,
+    params: &Params,
+    party_tree_root: &[u8],
+) -> Result<ValidityProof, String> {
+    let witness = CertWitness::extract(cert, params, party_tree_root)?;
+    prover.prove(&witness)
+}
+
+/// Reference prover whose proof is the witness itself, checked natively.
+/// Not succinct: it pins down the interface and semantics for real provers.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct WitnessProver;
+
+impl Prover for WitnessProver {
+    fn system(&self) -> &str {
+        "witness"
+    }
+
+    fn prove(&self, witness: &CertWitness) -> Result<ValidityProof, String> {
+        if !witness.check()? {
+            return Err("Witness doesn't satisfy the arithmetization".to_string());
+        }
+        Ok(ValidityProof {
+            system: self.system().to_string(),
+            public: witness.public.clone(),
+            proof: bincode::serialize(witness).map_err(|e| e.to_string())?,
+        })
+    }
+
+    fn verify(&self, proof: &ValidityProof) -> Result<bool, String> {
+        if proof.system != self.system() {
+            return Err(format!("Proof of system {}", proof.system));
+        }
+        let witness: CertWitness = bincode::deserialize(&proof.proof).map_err(|e| e.to_string())?;
+        Ok(witness.public == proof.public && witness.check()?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::ccok::{Builder, PARAMS_V2};
+    use crate::wallet::Wallet;
+
+    #[test]
+    fn test_cert_witness() {
+        let wallets: Vec<Wallet> = (0..5)
+            .map(|_| Wallet::new().expect("Failed to create wallet"))
+            .collect();
+        let participants: Vec<Participant> = wallets
+            .iter()
+            .map(|w| Participant::from_signer(w, 10))
+            .collect();
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 25,
+            ..Default::default()
+        };
+        let mut party_tree = MerkleTreeBuilder::with_hash(params.hashing());
+        party_tree.build(&participants).unwrap();
+        let root = party_tree.root();
+        let mut builder = Builder::new(params.clone(), participants, root.clone()).unwrap();
+        for (pos, wallet) in wallets.iter().take(4).enumerate() {
+            builder
+                .add_signature(pos, wallet.sign_message(&params.signing_message()))
+                .unwrap();
+        }
+        let mut cert = builder.build().unwrap();
+        cert.compress_proofs().unwrap();
+
+        let witness = CertWitness::extract(&cert, &params, &root).unwrap();
+        assert_eq!(witness.reveals.len(), cert.reveals.len());
+        assert_eq!(witness.coins.len() as u64, witness.public.num_coins);
+        assert!(witness
+            .reveals
+            .iter()
+            .all(|reveal| reveal.sig_path.len() == 3 && reveal.party_path.len() == 3));
+        assert!(witness.check().unwrap());
+
+        let prover = WitnessProver;
+        let proof = prove_certificate(&prover, &cert, &params, &root).unwrap();
+        assert!(prover.verify(&proof).unwrap());
+        let mut misstated = proof.clone();
+        misstated.public.signed_weight += 10;
+        assert!(!prover.verify(&misstated).unwrap());
+
+        // Each constraint group catches its own tampering
+        let mut moved = witness.clone();
+        moved.reveals[0].sig_path[0].right ^= true;
+        assert!(!moved.check().unwrap());
+        let mut reweighted = witness.clone();
+        reweighted.reveals[0].weight += 1;
+        assert!(!reweighted.check().unwrap());
+        let mut recoined = witness.clone();
+        recoined.coins[0].coin ^= 1;
+        assert!(!recoined.check().unwrap());
+        assert!(CertWitness::extract(&cert, &params, &[0u8; 32]).is_err());
+    }
+
+    #[test]
+    fn test_golden_vectors() {
+        // Vectors an arithmetization must reproduce; they only depend on the
+        // hash functions, not on key or encoding choices
+        let hashing = Hashing::new(HashAlgorithm::Keccak256, true);
+        let path = [
+            PathStep {
+                sibling: [1u8; 32],
+                right: false,
+                carry: false,
+            },
+            PathStep {
+                sibling: [0u8; 32],
+                right: false,
+                carry: true,
+            },
+            PathStep {
+                sibling: [2u8; 32],
+                right: true,
+                carry: false,
+            },
+        ];
+        assert_eq!(
+            hex::encode(fold_path(hashing, [0u8; 32], &path)),
+            "ab3de812cadce4082f4e652e8738fcb17fae45169dce849f2602bda34e01fa72"
+        );
+
+        let public = PublicInputs {
+            party_tree_root: [0x11; 32],
+            sig_commit: [0x22; 32],
+            message_hash: HashAlgorithm::Keccak256.hash(b"Test message"),
+            proven_weight: 25,
+            signed_weight: 40,
+            total_sigs: 5,
+            num_coins: 24,
+            security_param: 128,
+            hash: HashAlgorithm::Keccak256.id(),
+            version: PARAMS_V2,
+        };
+        assert_eq!(
+            hex::encode(public.to_words()[3]),
+            "0000000000000000000000000000000000000000000000000000000000000019"
+        );
+        assert_eq!(
+            hex::encode(public.commitment()),
+            "112baf7b847544fc94e14fd404c5eaa3ce40483534437b29963a569f8ef52313"
+        );
+
+        let params = Params {
+            msg: b"Test message".to_vec(),
+            proven_weight: 25,
+            ..Default::default()
+        };
+        let coins: Vec<u64> = (0..4)
+            .map(|i| coin_value(&params, i, &[0x22; 32], 40, &[0x11; 32]))
+            .collect();
+        assert_eq!(coins, [25, 27, 1, 21]);
+    }
+}